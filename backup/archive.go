@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// walPrefix holds archived WALs, each named <last sequence>-<time>.wal,
+// the sequence number zero-padded to 20 digits
+const walPrefix = "wal/"
+
+// WALArchive archives an LSM tree's WALs to a sink, for RestoreToSeq and
+// RestoreToTime. Set it as the tree's lsm.Config.WALArchive, and back the
+// tree up to the same sink.
+type WALArchive struct {
+	sink Sink
+}
+
+// NewWALArchive returns a WALArchive uploading to sink
+func NewWALArchive(sink Sink) *WALArchive {
+	return &WALArchive{sink: sink}
+}
+
+// ArchiveWAL implements common.WALArchiver
+func (a *WALArchive) ArchiveWAL(ctx context.Context, w common.ArchivedWAL) error {
+	r, err := w.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	name := fmt.Sprintf("%s%020d-%s.wal", walPrefix, w.LastSequence, w.Archived.UTC().Format(idFormat))
+	return a.sink.Put(ctx, name, r)
+}
+
+// ListWAL returns the WALs archived to sink, oldest first. Their Open
+// reads them from the sink.
+func ListWAL(ctx context.Context, sink Sink) ([]common.ArchivedWAL, error) {
+	names, err := sink.List(ctx, walPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var wals []common.ArchivedWAL
+	for _, name := range names {
+		base, ok := strings.CutSuffix(strings.TrimPrefix(name, walPrefix), ".wal")
+		if !ok {
+			continue
+		}
+		seqPart, timePart, ok := strings.Cut(base, "-")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(seqPart, 10, 64)
+		if err != nil {
+			continue
+		}
+		archived, err := time.Parse(idFormat, timePart)
+		if err != nil {
+			continue
+		}
+		wals = append(wals, common.ArchivedWAL{
+			LastSequence: seq,
+			Archived:     archived,
+			Open: func() (io.ReadCloser, error) {
+				return sink.Get(ctx, name)
+			},
+		})
+	}
+	slices.SortFunc(wals, func(a, b common.ArchivedWAL) int {
+		return cmp.Or(cmp.Compare(a.LastSequence, b.LastSequence), a.Archived.Compare(b.Archived))
+	})
+	return wals, nil
+}
+
+// RestoreToSeq restores an LSM tree into dir as it was after the write
+// numbered seq: it restores the latest backup holding no later writes,
+// then rolls it forward with the WALs archived since (see
+// lsm.RollForward). It fails with ErrNotFound if there is no such backup,
+// or the WALs archived so far don't reach seq; the WAL a tree is writing
+// is only archived after its next flush. dir must be empty or not exist
+// yet. A nil fs means the OS filesystem.
+func RestoreToSeq(ctx context.Context, sink Sink, seq uint64, fs common.FS, dir string) error {
+	ids, err := List(ctx, sink)
+	if err != nil {
+		return err
+	}
+	var base *Manifest
+	for i := len(ids) - 1; i >= 0 && base == nil; i-- {
+		m, err := ReadManifest(ctx, sink, ids[i])
+		if err != nil {
+			return err
+		}
+		if m.Sequence <= seq {
+			base = m
+		}
+	}
+	if base == nil {
+		return fmt.Errorf("%w: no backup up to sequence %d", ErrNotFound, seq)
+	}
+
+	wals, err := ListWAL(ctx, sink)
+	if err != nil {
+		return err
+	}
+	// A WAL archived with a sequence number the backup holds has no
+	// writes it doesn't
+	var replay []common.ArchivedWAL
+	reached := base.Sequence == seq
+	for _, w := range wals {
+		if reached {
+			break
+		}
+		if w.LastSequence > base.Sequence {
+			replay = append(replay, w)
+			reached = w.LastSequence >= seq
+		}
+	}
+	if !reached {
+		return fmt.Errorf("%w: no archived WAL reaches sequence %d", ErrNotFound, seq)
+	}
+
+	if err := Restore(ctx, sink, base.ID, fs, dir); err != nil {
+		return err
+	}
+	if err := lsm.RollForward(fs, dir, seq, replay); err != nil {
+		return fmt.Errorf("backup: failed to roll %s forward: %w", base.ID, err)
+	}
+	return nil
+}
+
+// RestoreToTime restores an LSM tree into dir as RestoreToSeq does, at the
+// last write known to have been made by t. WAL records carry no time, so
+// that is the last write held by a backup taken, or a WAL archived, at
+// or before t: writes made by t that were still in the WAL the tree was
+// writing then are left out.
+func RestoreToTime(ctx context.Context, sink Sink, t time.Time, fs common.FS, dir string) error {
+	var seq uint64
+	found := false
+
+	ids, err := List(ctx, sink)
+	if err != nil {
+		return err
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		m, err := ReadManifest(ctx, sink, ids[i])
+		if err != nil {
+			return err
+		}
+		if !m.Created.After(t) {
+			seq, found = m.Sequence, true
+			break
+		}
+	}
+
+	wals, err := ListWAL(ctx, sink)
+	if err != nil {
+		return err
+	}
+	for _, w := range wals {
+		if !w.Archived.After(t) && (!found || w.LastSequence > seq) {
+			seq, found = w.LastSequence, true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%w: nothing backed up or archived by %s", ErrNotFound, t.Format(time.RFC3339))
+	}
+	return RestoreToSeq(ctx, sink, seq, fs, dir)
+}
@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// history records the value of every key after each write, numbered as
+// the LSM numbers them
+type history struct {
+	keys   []string
+	values []string // "" for a delete
+}
+
+// at returns the keys and values after the write numbered seq
+func (h *history) at(seq uint64) map[string]string {
+	kv := make(map[string]string)
+	for i := uint64(0); i < seq; i++ {
+		if h.values[i] == "" {
+			delete(kv, h.keys[i])
+		} else {
+			kv[h.keys[i]] = h.values[i]
+		}
+	}
+	return kv
+}
+
+// apply makes n writes, overwriting and deleting keys as it goes
+func (h *history) apply(t *testing.T, e *lsm.Adapter, n int) {
+	t.Helper()
+	for range n {
+		seq := len(h.keys) + 1
+		key := fmt.Sprintf("key%04d", seq%300)
+		value := fmt.Sprintf("value%06d", seq)
+		var err error
+		if seq%7 == 0 {
+			value = ""
+			err = e.Delete([]byte(key))
+		} else {
+			err = e.Put([]byte(key), []byte(value))
+		}
+		if err != nil {
+			t.Fatalf("Write %d failed: %v", seq, err)
+		}
+		h.keys = append(h.keys, key)
+		h.values = append(h.values, value)
+	}
+}
+
+// waitForArchive waits until the WALs archived to sink reach seq
+func waitForArchive(t *testing.T, sink Sink, seq uint64) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		wals, err := ListWAL(context.Background(), sink)
+		if err != nil {
+			t.Fatalf("ListWAL failed: %v", err)
+		}
+		if len(wals) > 0 && wals[len(wals)-1].LastSequence >= seq {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("WALs not archived up to sequence %d", seq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRestoreToSeq(t *testing.T) {
+	sink := NewDirSink(nil, t.TempDir())
+	ctx := context.Background()
+
+	config := lsm.DefaultConfig(t.TempDir())
+	config.MemTableSize = 4 << 10
+	config.WALArchive = NewWALArchive(sink)
+	e, err := lsm.NewAdapter(config)
+	if err != nil {
+		t.Fatalf("Failed to open LSM: %v", err)
+	}
+	defer e.Close()
+
+	h := &history{}
+	h.apply(t, e, 500)
+	m, err := Backup(ctx, e, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if m.Sequence != 500 {
+		t.Fatalf("Backup at sequence %d, want 500", m.Sequence)
+	}
+	h.apply(t, e, 2000)
+	waitForArchive(t, sink, 2000)
+
+	for _, seq := range []uint64{500, 501, 777, 1500, 2000} {
+		dir := t.TempDir()
+		if err := RestoreToSeq(ctx, sink, seq, nil, dir); err != nil {
+			t.Fatalf("RestoreToSeq(%d) failed: %v", seq, err)
+		}
+		config := lsm.DefaultConfig(dir)
+		r, err := lsm.NewAdapter(config)
+		if err != nil {
+			t.Fatalf("Failed to open LSM restored to %d: %v", seq, err)
+		}
+		checkContents(t, r, h.at(seq))
+		r.Close()
+	}
+
+	// Before the first backup, and past the archive
+	if err := RestoreToSeq(ctx, sink, 499, nil, t.TempDir()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RestoreToSeq before the backup: %v, want ErrNotFound", err)
+	}
+	if err := RestoreToSeq(ctx, sink, 1<<40, nil, t.TempDir()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RestoreToSeq past the archive: %v, want ErrNotFound", err)
+	}
+}
+
+func TestRestoreToTime(t *testing.T) {
+	sink := NewDirSink(nil, t.TempDir())
+	ctx := context.Background()
+
+	config := lsm.DefaultConfig(t.TempDir())
+	config.MemTableSize = 4 << 10
+	config.WALArchive = NewWALArchive(sink)
+	e, err := lsm.NewAdapter(config)
+	if err != nil {
+		t.Fatalf("Failed to open LSM: %v", err)
+	}
+	defer e.Close()
+
+	before := time.Now()
+	h := &history{}
+	h.apply(t, e, 300)
+	if _, err := Backup(ctx, e, sink); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	h.apply(t, e, 1000)
+	waitForArchive(t, sink, 1000)
+
+	if err := RestoreToTime(ctx, sink, before, nil, t.TempDir()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RestoreToTime before the backup: %v, want ErrNotFound", err)
+	}
+
+	wals, err := ListWAL(ctx, sink)
+	if err != nil {
+		t.Fatalf("ListWAL failed: %v", err)
+	}
+	last := wals[len(wals)-1]
+	dir := t.TempDir()
+	if err := RestoreToTime(ctx, sink, last.Archived, nil, dir); err != nil {
+		t.Fatalf("RestoreToTime failed: %v", err)
+	}
+	r, err := lsm.NewAdapter(lsm.DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to open restored LSM: %v", err)
+	}
+	defer r.Close()
+	checkContents(t, r, h.at(last.LastSequence))
+}
@@ -0,0 +1,332 @@
+// Package backup copies an engine's files to a Sink, such as a directory
+// or an S3 bucket, and restores them into a directory to open an engine
+// on.
+//
+// A backup takes a checkpoint of the engine (see common.Checkpointer) and
+// uploads its files, then a manifest listing them. Backups are
+// incremental: each is based on the one before, its parent, and an
+// immutable file (an SSTable, a sealed segment or value log file) the
+// parent has with the same name, size and checksum isn't uploaded again,
+// the manifest pointing at the object an earlier backup uploaded instead.
+// So each backup only ships the files written since its parent, plus the
+// files that change (the WAL, the MANIFEST, active segments, a B-Tree's
+// pages). Restore assembles the files from every backup of the chain.
+//
+// Immutable files go under files/<id>/, and everything else, with the
+// manifest, under backups/<id>/. A backup whose manifest wasn't written
+// never happened.
+//
+// An LSM tree can also archive the WALs it replaces to the sink (see
+// WALArchive), under wal/, so RestoreToSeq and RestoreToTime can restore
+// it to a point between backups.
+//
+// Backups are unencrypted; restore through a common.EncryptedFS to
+// encrypt the restored files again.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+const (
+	// filesPrefix holds the immutable files, under the ID of the backup
+	// that uploaded them; later backups share them
+	filesPrefix = "files/"
+
+	// backupsPrefix holds one directory per backup, with its manifest and
+	// mutable files
+	backupsPrefix = "backups/"
+	manifestName  = "manifest.json"
+
+	// idFormat sorts backup IDs by the time they were taken
+	idFormat = "20060102T150405.000000000Z"
+)
+
+var (
+	// ErrNotFound is returned for a backup or object the sink doesn't have
+	ErrNotFound = errors.New("backup: not found")
+
+	// ErrNotEmpty is returned restoring into a directory that has files
+	ErrNotEmpty = errors.New("backup: restore directory not empty")
+)
+
+// Manifest describes a backup
+type Manifest struct {
+	ID      string    `json:"id"`
+	Parent  string    `json:"parent,omitempty"` // Backup this one is incremental on
+	Created time.Time `json:"created"`
+
+	// Files are every file of the backup, including those uploaded by
+	// earlier backups of its chain
+	Files []File `json:"files"`
+
+	// UploadedBytes is the size of the files this backup uploaded
+	UploadedBytes int64 `json:"uploaded_bytes"`
+
+	// Sequence is the sequence number of the last write the backup holds,
+	// for engines that number their writes (see
+	// common.SequencedCheckpointer)
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// File is a file of a backup
+type File struct {
+	Name      string `json:"name"`   // Relative to the data directory, slash-separated
+	Object    string `json:"object"` // Sink object holding its content
+	Size      int64  `json:"size"`
+	CRC32     uint32 `json:"crc32"` // IEEE
+	Immutable bool   `json:"immutable,omitempty"`
+}
+
+// Backup backs up an engine to sink, as an incremental backup on the
+// latest one there, and returns the new backup's manifest.
+//
+// An immutable file the parent has with the same name and size is read
+// locally to compare checksums, which is much cheaper than uploading it;
+// names alone don't identify content, as a hash index compaction names
+// its output after an input.
+func Backup(ctx context.Context, engine common.Checkpointer, sink Sink) (*Manifest, error) {
+	now := time.Now().UTC()
+	m := &Manifest{ID: now.Format(idFormat), Created: now}
+
+	uploaded := make(map[string]File)
+	parent, err := Latest(ctx, sink)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if parent != nil {
+		m.Parent = parent.ID
+		for _, f := range parent.Files {
+			if f.Immutable {
+				uploaded[f.Name] = f
+			}
+		}
+	}
+
+	err = checkpoint(engine, func(files []common.CheckpointFile, seq uint64) error {
+		m.Sequence = seq
+		for _, cf := range files {
+			if prev, ok := uploaded[cf.Name]; ok && cf.Immutable && prev.Size == cf.Size {
+				crc, err := checksum(cf)
+				if err != nil {
+					return fmt.Errorf("backup: failed to read %s: %w", cf.Name, err)
+				}
+				if crc == prev.CRC32 {
+					m.Files = append(m.Files, prev)
+					continue
+				}
+			}
+
+			f := File{Name: cf.Name, Size: cf.Size, Immutable: cf.Immutable}
+			if cf.Immutable {
+				f.Object = filesPrefix + m.ID + "/" + cf.Name
+			} else {
+				f.Object = backupsPrefix + m.ID + "/" + cf.Name
+			}
+			crc, err := upload(ctx, sink, f.Object, cf)
+			if err != nil {
+				return fmt.Errorf("backup: failed to upload %s: %w", cf.Name, err)
+			}
+			f.CRC32 = crc
+			m.Files = append(m.Files, f)
+			m.UploadedBytes += f.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := sink.Put(ctx, manifestObject(m.ID), bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("backup: failed to upload manifest: %w", err)
+	}
+	return m, nil
+}
+
+// checkpoint takes a checkpoint of engine, with its sequence number if it
+// numbers its writes
+func checkpoint(engine common.Checkpointer, fn func(files []common.CheckpointFile, seq uint64) error) error {
+	if sequenced, ok := engine.(common.SequencedCheckpointer); ok {
+		return sequenced.CheckpointSeq(fn)
+	}
+	return engine.Checkpoint(func(files []common.CheckpointFile) error {
+		return fn(files, 0)
+	})
+}
+
+// upload copies a checkpoint file to an object, returning its checksum
+func upload(ctx context.Context, sink Sink, object string, cf common.CheckpointFile) (uint32, error) {
+	r, err := cf.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	counted := &checksumReader{r: r}
+	if err := sink.Put(ctx, object, counted); err != nil {
+		return 0, err
+	}
+	if counted.n != cf.Size {
+		return 0, fmt.Errorf("read %d bytes, expected %d", counted.n, cf.Size)
+	}
+	return counted.crc, nil
+}
+
+// checksum reads a checkpoint file to checksum it
+func checksum(cf common.CheckpointFile) (uint32, error) {
+	r, err := cf.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	counted := &checksumReader{r: r}
+	if _, err := io.Copy(io.Discard, counted); err != nil {
+		return 0, err
+	}
+	return counted.crc, nil
+}
+
+// checksumReader counts and checksums what is read through it
+type checksumReader struct {
+	r   io.Reader
+	n   int64
+	crc uint32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.crc = crc32.Update(c.crc, crc32.IEEETable, p[:n])
+	return n, err
+}
+
+// manifestObject returns the object holding a backup's manifest
+func manifestObject(id string) string {
+	return backupsPrefix + id + "/" + manifestName
+}
+
+// List returns the IDs of the backups in sink, oldest first
+func List(ctx context.Context, sink Sink) ([]string, error) {
+	names, err := sink.List(ctx, backupsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, name := range names {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(name, backupsPrefix), "/"+manifestName)
+		if ok && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Latest returns the manifest of the newest backup in sink, or
+// ErrNotFound if there are none
+func Latest(ctx context.Context, sink Sink) (*Manifest, error) {
+	ids, err := List(ctx, sink)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrNotFound
+	}
+	return ReadManifest(ctx, sink, ids[len(ids)-1])
+}
+
+// ReadManifest returns the manifest of a backup
+func ReadManifest(ctx context.Context, sink Sink, id string) (*Manifest, error) {
+	r, err := sink.Get(ctx, manifestObject(id))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("backup: failed to read manifest of %s: %w", id, err)
+	}
+	return &m, nil
+}
+
+// Restore writes the files of backup id into dir, which must be empty or
+// not exist yet, checking each against its checksum. If it fails, dir is
+// left partly restored. A nil fs means the OS filesystem.
+func Restore(ctx context.Context, sink Sink, id string, fs common.FS, dir string) error {
+	fs = common.FSOrDefault(fs)
+	m, err := ReadManifest(ctx, sink, id)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: %s", ErrNotEmpty, dir)
+	}
+
+	for _, f := range m.Files {
+		if err := restoreFile(ctx, sink, f, fs, dir); err != nil {
+			return fmt.Errorf("backup: failed to restore %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// restoreFile downloads one file of a backup into dir
+func restoreFile(ctx context.Context, sink Sink, f File, fs common.FS, dir string) error {
+	if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+		return fmt.Errorf("invalid file name %q", f.Name)
+	}
+	dst := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	r, err := sink.Get(ctx, f.Object)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	file, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	counted := &checksumReader{r: io.LimitReader(r, f.Size+1)}
+	_, err = io.Copy(file, counted)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if counted.n != f.Size || counted.crc != f.CRC32 {
+		return common.Corruptf(f.Object, "backup object doesn't match its checksum")
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/btree"
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// engine is what the tests back up
+type engine interface {
+	common.StorageEngine
+	common.Scanner
+	common.Checkpointer
+}
+
+// countingSink records the objects put
+type countingSink struct {
+	Sink
+	mu   sync.Mutex
+	puts []string
+}
+
+func (s *countingSink) Put(ctx context.Context, name string, r io.Reader) error {
+	s.mu.Lock()
+	s.puts = append(s.puts, name)
+	s.mu.Unlock()
+	return s.Sink.Put(ctx, name, r)
+}
+
+// contents returns an engine's keys and values
+func contents(t *testing.T, e common.Scanner) map[string]string {
+	t.Helper()
+	it, err := e.Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	defer it.Close()
+
+	kv := make(map[string]string)
+	for it.Next() {
+		kv[string(it.Key())] = string(it.Value())
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return kv
+}
+
+// checkContents checks that an engine holds exactly want
+func checkContents(t *testing.T, e common.Scanner, want map[string]string) {
+	t.Helper()
+	got := contents(t, e)
+	if len(got) != len(want) {
+		t.Fatalf("Engine has %d keys, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("%s = %.20q, want %.20q", k, got[k], v)
+		}
+	}
+}
+
+// write puts keys [from, to), with every tenth value large enough for the
+// LSM's value log
+func write(t *testing.T, e common.StorageEngine, from, to int, want map[string]string) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		value := fmt.Sprintf("value%05d", i)
+		if i%10 == 0 {
+			value = strings.Repeat(value, 50)
+		}
+		if err := e.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = value
+	}
+}
+
+func openLSM(t *testing.T, dir string) engine {
+	config := lsm.DefaultConfig(dir)
+	config.ValueThreshold = 256
+	e, err := lsm.NewAdapter(config)
+	if err != nil {
+		t.Fatalf("Failed to open LSM: %v", err)
+	}
+	return e
+}
+
+func openBTree(t *testing.T, dir string) engine {
+	e, err := btree.NewAdapter(btree.DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to open B-Tree: %v", err)
+	}
+	return e
+}
+
+func TestBackupRestoreLSM(t *testing.T) {
+	dir := t.TempDir()
+	sink := &countingSink{Sink: NewDirSink(nil, t.TempDir())}
+	ctx := context.Background()
+
+	// Reopening flushes the writes into an SSTable
+	e := openLSM(t, dir)
+	want1 := make(map[string]string)
+	write(t, e, 0, 1000, want1)
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	e = openLSM(t, dir)
+	defer func() { e.Close() }()
+
+	m1, err := Backup(ctx, e, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// The second backup has the new writes in its WAL and value log head,
+	// and shares the SSTable
+	want2 := make(map[string]string)
+	for k, v := range want1 {
+		want2[k] = v
+	}
+	write(t, e, 1000, 1100, want2)
+	for i := 0; i < 1000; i += 20 {
+		key := fmt.Sprintf("key%05d", i)
+		if err := e.Delete([]byte(key)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		delete(want2, key)
+	}
+
+	sink.puts = nil
+	m2, err := Backup(ctx, e, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	for _, name := range sink.puts {
+		if strings.HasPrefix(name, filesPrefix) {
+			t.Errorf("Immutable file %s uploaded again", name)
+		}
+	}
+	shared := 0
+	for _, f := range m2.Files {
+		if strings.HasSuffix(f.Name, ".sst") && strings.HasPrefix(f.Object, filesPrefix+m1.ID+"/") {
+			shared++
+		}
+	}
+	if shared == 0 {
+		t.Fatal("Incremental backup doesn't share the first one's SSTable")
+	}
+	if m2.Parent != m1.ID || m2.UploadedBytes >= m1.UploadedBytes {
+		t.Errorf("Incremental backup on %q uploaded %d bytes, full backup %d", m2.Parent, m2.UploadedBytes, m1.UploadedBytes)
+	}
+
+	ids, err := List(ctx, sink)
+	if err != nil || len(ids) != 2 || ids[0] != m1.ID || ids[1] != m2.ID {
+		t.Fatalf("List = %v, %v, want [%s %s]", ids, err, m1.ID, m2.ID)
+	}
+
+	for _, tc := range []struct {
+		id   string
+		want map[string]string
+	}{{m1.ID, want1}, {m2.ID, want2}} {
+		restored := t.TempDir()
+		if err := Restore(ctx, sink, tc.id, nil, restored); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		r := openLSM(t, restored)
+		checkContents(t, r, tc.want)
+		r.Close()
+	}
+}
+
+func TestBackupRestoreBTree(t *testing.T) {
+	sink := NewDirSink(nil, t.TempDir())
+	ctx := context.Background()
+
+	e := openBTree(t, t.TempDir())
+	defer e.Close()
+	want := make(map[string]string)
+	write(t, e, 0, 2000, want)
+
+	m, err := Backup(ctx, e, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// Writes after the backup aren't in it
+	write(t, e, 2000, 2100, make(map[string]string))
+
+	restored := t.TempDir()
+	if err := Restore(ctx, sink, m.ID, nil, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	r := openBTree(t, restored)
+	defer r.Close()
+	checkContents(t, r, want)
+
+	if err := Restore(ctx, sink, m.ID, nil, restored); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("Restore into a used directory: %v, want ErrNotEmpty", err)
+	}
+}
+
+func TestBackupRestoreHashIndex(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewDirSink(nil, t.TempDir())
+	ctx := context.Background()
+
+	config := hashindex.DefaultConfig(dir)
+	config.SegmentSizeBytes = 16 << 10 // Several sealed segments
+	e, err := hashindex.New(config)
+	if err != nil {
+		t.Fatalf("Failed to open hash index: %v", err)
+	}
+	defer e.Close()
+
+	want1 := make(map[string]string)
+	write(t, e, 0, 500, want1)
+	m1, err := Backup(ctx, e, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	want2 := make(map[string]string)
+	for k, v := range want1 {
+		want2[k] = v
+	}
+	write(t, e, 0, 50, want2) // Overwrites
+	m2, err := Backup(ctx, e, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if m2.UploadedBytes >= m1.UploadedBytes {
+		t.Errorf("Incremental backup uploaded %d bytes, full backup %d", m2.UploadedBytes, m1.UploadedBytes)
+	}
+
+	for _, tc := range []struct {
+		id   string
+		want map[string]string
+	}{{m1.ID, want1}, {m2.ID, want2}} {
+		restored := t.TempDir()
+		if err := Restore(ctx, sink, tc.id, nil, restored); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		r, err := hashindex.New(hashindex.DefaultConfig(restored))
+		if err != nil {
+			t.Fatalf("Failed to open restored hash index: %v", err)
+		}
+		for k, v := range tc.want {
+			got, err := r.Get([]byte(k))
+			if err != nil || string(got) != v {
+				t.Fatalf("Get(%s) = %.20q, %v, want %.20q", k, got, err, v)
+			}
+		}
+		r.Close()
+	}
+}
+
+// fileCheckpointer checkpoints a fixed set of immutable files
+type fileCheckpointer map[string]string
+
+func (c fileCheckpointer) Checkpoint(fn func(files []common.CheckpointFile) error) error {
+	var files []common.CheckpointFile
+	for name, content := range c {
+		files = append(files, common.CheckpointFile{
+			Name:      name,
+			Size:      int64(len(content)),
+			Immutable: true,
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(content)), nil
+			},
+		})
+	}
+	return fn(files)
+}
+
+func TestBackupReusedName(t *testing.T) {
+	sink := NewDirSink(nil, t.TempDir())
+	ctx := context.Background()
+
+	// The second file of each name has the same size, but other content
+	m1, err := Backup(ctx, fileCheckpointer{"1.seg": "aaaa", "2.seg": "bbbb"}, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	m2, err := Backup(ctx, fileCheckpointer{"1.seg": "aaaa", "2.seg": "cccc"}, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if m2.UploadedBytes != 4 {
+		t.Errorf("Incremental backup uploaded %d bytes, want 4", m2.UploadedBytes)
+	}
+
+	for id, want := range map[string]string{m1.ID: "bbbb", m2.ID: "cccc"} {
+		dir := t.TempDir()
+		if err := Restore(ctx, sink, id, nil, dir); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "2.seg"))
+		if err != nil || string(got) != want {
+			t.Errorf("Restored 2.seg = %q, %v, want %q", got, err, want)
+		}
+	}
+}
+
+func TestRestoreDamagedBackup(t *testing.T) {
+	sinkDir := t.TempDir()
+	sink := NewDirSink(nil, sinkDir)
+	ctx := context.Background()
+
+	e := openBTree(t, t.TempDir())
+	defer e.Close()
+	write(t, e, 0, 100, make(map[string]string))
+	m, err := Backup(ctx, e, sink)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	path := filepath.Join(sinkDir, filepath.FromSlash(m.Files[0].Object))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read object: %v", err)
+	}
+	data[len(data)/2] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to damage object: %v", err)
+	}
+
+	if err := Restore(ctx, sink, m.ID, nil, t.TempDir()); !errors.Is(err, common.ErrCorruption) {
+		t.Fatalf("Restore of a damaged backup: %v, want ErrCorruption", err)
+	}
+	if _, err := ReadManifest(ctx, sink, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ReadManifest of a missing backup: %v, want ErrNotFound", err)
+	}
+	if _, err := Latest(ctx, NewDirSink(nil, t.TempDir())); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Latest of an empty sink: %v, want ErrNotFound", err)
+	}
+}
+
+func TestDirSinkList(t *testing.T) {
+	sink := NewDirSink(nil, t.TempDir())
+	ctx := context.Background()
+	for _, name := range []string{"a/b/c", "a/b/d", "a/e", "f"} {
+		if err := sink.Put(ctx, name, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	for prefix, want := range map[string]string{
+		"":    "a/b/c a/b/d a/e f",
+		"a/":  "a/b/c a/b/d a/e",
+		"a/b": "a/b/c a/b/d",
+		"x":   "",
+	} {
+		names, err := sink.List(ctx, prefix)
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("List(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+
+	if err := sink.Put(ctx, "../escape", bytes.NewReader(nil)); err == nil {
+		t.Error("Put outside the sink's directory succeeded")
+	}
+}
@@ -0,0 +1,421 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPartSize is the size of the parts S3Sink uploads large
+	// objects in by default
+	DefaultPartSize = 8 << 20
+
+	// MinPartSize is the smallest part S3 accepts, other than the last
+	MinPartSize = 5 << 20
+
+	// s3Retries is how many times a request failing with a network error
+	// or a 5xx status is retried
+	s3Retries = 3
+
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config configures an S3Sink
+type S3Config struct {
+	// Endpoint is the service's base URL, such as
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for
+	// MinIO. Buckets are addressed by path (Endpoint/Bucket/key), which
+	// every S3-compatible store supports.
+	Endpoint string
+	Region   string // Default us-east-1
+	Bucket   string
+
+	// Prefix is prepended to every object name, so several engines can
+	// back up to one bucket, e.g. "db1/"
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // For temporary credentials, otherwise empty
+
+	// PartSize is the size of the parts of a multipart upload (0 =
+	// DefaultPartSize); objects up to this size are uploaded in one
+	// request. One part at a time is held in memory. S3 itself needs at
+	// least MinPartSize.
+	PartSize int
+
+	// HTTPClient makes the requests (nil = http.DefaultClient)
+	HTTPClient *http.Client
+}
+
+// S3Sink stores objects in an S3 bucket or one of an S3-compatible store
+// (MinIO, Ceph, R2, ...), signing requests with AWS Signature Version 4.
+// Objects larger than a part are streamed up as multipart uploads, so a
+// failed upload leaves no object behind.
+type S3Sink struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Sink returns a sink storing objects in config.Bucket
+func NewS3Sink(config S3Config) (*S3Sink, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("backup: invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("backup: no S3 bucket given")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.PartSize == 0 {
+		config.PartSize = DefaultPartSize
+	}
+	if config.PartSize < 0 {
+		return nil, fmt.Errorf("backup: PartSize must be positive, got %d", config.PartSize)
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3Sink{config: config, endpoint: endpoint, client: client}, nil
+}
+
+// Put uploads the object in one request if it fits in a part, otherwise
+// as a multipart upload, which is aborted if it fails
+func (s *S3Sink) Put(ctx context.Context, name string, r io.Reader) error {
+	part := make([]byte, s.config.PartSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do(ctx, http.MethodPut, name, nil, part[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.createMultipartUpload(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := s.uploadParts(ctx, name, uploadID, part, r); err != nil {
+		// Without this the parts uploaded so far are kept, and charged for
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if resp, abortErr := s.do(abortCtx, http.MethodDelete, name, url.Values{"uploadId": {uploadID}}, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// createMultipartUpload starts a multipart upload, returning its ID
+func (s *S3Sink) createMultipartUpload(ctx context.Context, name string) (string, error) {
+	resp, err := s.do(ctx, http.MethodPost, name, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("backup: S3 returned no upload ID for %s: %v", name, err)
+	}
+	return result.UploadID, nil
+}
+
+// completedPart is a part of a multipart upload, as listed to complete it
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// uploadParts uploads first and the rest of r as the parts of a multipart
+// upload, then completes it
+func (s *S3Sink) uploadParts(ctx context.Context, name, uploadID string, first []byte, r io.Reader) error {
+	var parts []completedPart
+	part := first
+	for {
+		number := len(parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(ctx, http.MethodPut, name, query, part)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		part = part[:n]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPost, name, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Completing can fail after the 200 status was sent, with an error in
+	// the body instead of the result
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return s3Error(http.MethodPost, name, resp.StatusCode, data)
+	}
+	return nil
+}
+
+func (s *S3Sink) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Sink) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+	for {
+		resp, err := s.doBucket(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("backup: failed to decode S3 listing: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.config.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// do sends a signed request for an object (see doBucket)
+func (s *S3Sink) do(ctx context.Context, method, name string, query url.Values, body []byte) (*http.Response, error) {
+	if name == "" {
+		return nil, fmt.Errorf("backup: empty object name")
+	}
+	return s.doBucket(ctx, method, s.config.Prefix+name, query, body)
+}
+
+// doBucket sends a signed request for key (or the bucket itself, for an
+// empty key), retrying network errors and 5xx statuses. A response with
+// another status than 2xx is returned as an error, ErrNotFound for 404.
+func (s *S3Sink) doBucket(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.config.Bucket
+	u.RawPath = s.endpoint.EscapedPath() + "/" + uriEncode(s.config.Bucket, true)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + uriEncode(key, false)
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= s3Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(100<<attempt) * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(body))
+		if s.config.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+		}
+		signV4(req, payloadHash, s.config.Region, s.config.AccessKeyID, s.config.SecretAccessKey, time.Now())
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		lastErr = s3Error(method, key, resp.StatusCode, data)
+		if resp.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// s3Error returns the error for a failed request, from the XML error
+// document S3 sends
+func s3Error(method, key string, status int, body []byte) error {
+	if status == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &e) != nil || e.Code == "" {
+		return fmt.Errorf("backup: S3 %s %s: %s", method, key, http.StatusText(status))
+	}
+	return fmt.Errorf("backup: S3 %s %s: %s: %s", method, key, e.Code, e.Message)
+}
+
+// signV4 signs req with AWS Signature Version 4, covering the host and
+// every header already set on it. req.URL must be encoded as uriEncode
+// does. payloadHash is the hex SHA-256 of the body.
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string the way Signature Version 4
+// expects: sorted by name, every name and value percent-encoded
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var pairs []string
+	for _, name := range names {
+		values := slices.Clone(query[name])
+		slices.Sort(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes every byte but the unreserved characters of
+// RFC 3986, and slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Sink is where backups are stored: a flat namespace of objects with
+// slash-separated names, like an object store's keys
+type Sink interface {
+	// Put stores an object with the content read from r, replacing any
+	// object of the same name. A failed Put may leave no object or the
+	// old one, but never part of the content.
+	Put(ctx context.Context, name string, r io.Reader) error
+
+	// Get opens an object, failing with ErrNotFound if there is none
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// List returns the names of the objects starting with prefix, sorted
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// DirSink stores objects as files under a directory, e.g. on a mounted
+// network filesystem or a second disk. Object names ending in .tmp are
+// taken by its unfinished writes.
+type DirSink struct {
+	fs  common.FS
+	dir string
+}
+
+// NewDirSink returns a sink storing objects under dir on fs (nil = the OS
+// filesystem)
+func NewDirSink(fs common.FS, dir string) *DirSink {
+	return &DirSink{fs: common.FSOrDefault(fs), dir: dir}
+}
+
+// path returns the file of an object
+func (s *DirSink) path(name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("backup: invalid object name %q", name)
+	}
+	return filepath.Join(s.dir, local), nil
+}
+
+// Put writes the object to a temporary file and renames it into place
+func (s *DirSink) Put(ctx context.Context, name string, r io.Reader) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := s.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, contextReader{ctx: ctx, r: r})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.fs.Rename(tmpPath, path)
+	}
+	if err != nil {
+		s.fs.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (s *DirSink) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.fs.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *DirSink) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	var walk func(dir, name string) error
+	walk = func(dir, name string) error {
+		entries, err := s.fs.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entryName := name + entry.Name()
+			switch {
+			case entry.IsDir():
+				// Only descend into directories that can hold a match
+				if strings.HasPrefix(entryName+"/", prefix) || strings.HasPrefix(prefix, entryName+"/") {
+					if err := walk(filepath.Join(dir, entry.Name()), entryName+"/"); err != nil {
+						return err
+					}
+				}
+			case strings.HasSuffix(entryName, ".tmp"):
+				// An unfinished Put
+			case strings.HasPrefix(entryName, prefix):
+				names = append(names, entryName)
+			}
+		}
+		return nil
+	}
+	if err := walk(s.dir, ""); err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// contextReader fails reads once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,18 @@
+package btree
+
+// Adapter wraps BTree to implement common.StorageEngine, opened the same
+// way as lsm.Adapter. The tree already implements the interface with
+// []byte keys, so everything, including Scan, RotateKeys and GetPinned,
+// goes straight to it.
+type Adapter struct {
+	*BTree
+}
+
+// NewAdapter creates a new adapter for BTree
+func NewAdapter(config Config) (*Adapter, error) {
+	btree, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Adapter{BTree: btree}, nil
+}
@@ -0,0 +1,181 @@
+package btree
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// minFilterKeys is the fewest keys a key filter is sized for, so an empty
+// tree doesn't start with a filter that fills at once
+const minFilterKeys = 1024
+
+// keyFilter is a bloom filter over every key in the tree, so that a Get of
+// a missing key mostly returns without reading a page. Keys are added as
+// they are written, by ConcurrentPuts running alongside each other and the
+// readers, so its bits are set and tested atomically.
+//
+// A bloom filter can't have keys taken out, or grow: deleted keys stay in
+// it, and past the number of keys it was sized for its false positive
+// rate climbs. So once it holds that many, another twice the size is
+// started and added to from then on, the rate summing over the filters (a
+// scalable bloom filter). The filter is rebuilt, at the size the tree
+// needs, each time it's opened.
+type keyFilter struct {
+	bitsPerKey int
+	memory     *common.MemoryAccountant
+
+	blooms atomic.Pointer[[]*keyBloom] // Newest last
+	growMu sync.Mutex                  // Serializes adding a bloom
+}
+
+// keyBloom is one of a keyFilter's filters
+type keyBloom struct {
+	words     []atomic.Uint64
+	numBits   uint64
+	numHashes uint64
+	capacity  int64        // Keys it was sized for
+	added     atomic.Int64 // Keys that set a bit
+}
+
+// newKeyFilter returns a filter of bitsPerKey bits per key, sized for
+// expectedKeys keys and charging its memory to memory
+func newKeyFilter(bitsPerKey int, expectedKeys int64, memory *common.MemoryAccountant) *keyFilter {
+	f := &keyFilter{bitsPerKey: bitsPerKey, memory: memory}
+	blooms := []*keyBloom{f.newBloom(expectedKeys)}
+	f.blooms.Store(&blooms)
+	return f
+}
+
+// newBloom returns an empty bloom for capacity keys, charged to f.memory.
+// The optimal number of hashes for m/n bits per key is (m/n) * ln(2).
+func (f *keyFilter) newBloom(capacity int64) *keyBloom {
+	capacity = max(capacity, minFilterKeys)
+	numBits := uint64(capacity) * uint64(f.bitsPerKey)
+	words := make([]atomic.Uint64, (numBits+63)/64)
+	f.memory.Charge(common.MemBloom, int64(len(words)*8))
+	return &keyBloom{
+		words:     words,
+		numBits:   uint64(len(words) * 64),
+		numHashes: uint64(max(1, math.Round(float64(f.bitsPerKey)*math.Ln2))),
+		capacity:  capacity,
+	}
+}
+
+// keyHash returns the 64-bit FNV-1a hash of key, computed in place so that
+// lookups don't allocate
+func keyHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// add sets key's bits, reporting whether any was unset. The hashes are
+// h_i = h1 + i*h2, with h1 and h2 the two halves of hash (double hashing).
+func (kb *keyBloom) add(hash uint64) bool {
+	h1, h2 := hash, hash>>32|hash<<32|1
+	set := false
+	for i := uint64(0); i < kb.numHashes; i++ {
+		bit := (h1 + i*h2) % kb.numBits
+		mask := uint64(1) << (bit % 64)
+		if kb.words[bit/64].Or(mask)&mask == 0 {
+			set = true
+		}
+	}
+	if set {
+		kb.added.Add(1)
+	}
+	return set
+}
+
+// mayContain reports whether all of hash's bits are set
+func (kb *keyBloom) mayContain(hash uint64) bool {
+	h1, h2 := hash, hash>>32|hash<<32|1
+	for i := uint64(0); i < kb.numHashes; i++ {
+		bit := (h1 + i*h2) % kb.numBits
+		if kb.words[bit/64].Load()&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds key to the filter. Writers add a key before they make it
+// visible, so no reader that could find it in the tree is told it's
+// missing. A nil filter does nothing.
+func (f *keyFilter) add(key []byte) {
+	if f == nil {
+		return
+	}
+	hash := keyHash(key)
+	blooms := *f.blooms.Load()
+	newest := blooms[len(blooms)-1]
+	// A key already in the filter, e.g. one being updated, sets no bits,
+	// so isn't counted twice
+	if !newest.add(hash) || newest.added.Load() < newest.capacity {
+		return
+	}
+
+	f.growMu.Lock()
+	defer f.growMu.Unlock()
+	if blooms := *f.blooms.Load(); blooms[len(blooms)-1] == newest {
+		grown := append(blooms[:len(blooms):len(blooms)], f.newBloom(newest.capacity*2))
+		f.blooms.Store(&grown)
+	}
+}
+
+// mayContain reports whether key may be in the tree; false means it
+// definitely isn't. A nil filter may contain anything.
+func (f *keyFilter) mayContain(key []byte) bool {
+	if f == nil {
+		return true
+	}
+	hash := keyHash(key)
+	for _, kb := range *f.blooms.Load() {
+		if kb.mayContain(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryUsed returns the bytes held by the filter's bits
+func (f *keyFilter) memoryUsed() int64 {
+	var n int64
+	for _, kb := range *f.blooms.Load() {
+		n += int64(len(kb.words) * 8)
+	}
+	return n
+}
+
+// bloomMemory returns the bytes held by the key filter for Stats, or nil
+// without one
+func (b *BTree) bloomMemory() map[string]int64 {
+	if b.filter == nil {
+		return nil
+	}
+	return map[string]int64{"keys": b.filter.memoryUsed()}
+}
+
+// release returns the filter's memory to its accountant
+func (f *keyFilter) release() {
+	if f != nil {
+		f.memory.Release(common.MemBloom, f.memoryUsed())
+	}
+}
+
+// buildKeyFilter returns a filter over the keys with the given hashes,
+// with room for as many keys again before it grows
+func (b *BTree) buildKeyFilter(hashes []uint64) *keyFilter {
+	f := newKeyFilter(b.config.BloomBitsPerKey, 2*int64(len(hashes)), b.memory)
+	newest := (*f.blooms.Load())[0]
+	for _, hash := range hashes {
+		newest.add(hash)
+	}
+	return f
+}
@@ -0,0 +1,134 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// falsePositives returns the share of n keys never written that tree's
+// filter doesn't rule out
+func falsePositives(tree *BTree, n int) float64 {
+	hits := 0
+	for i := 0; i < n; i++ {
+		if tree.filter.mayContain([]byte(fmt.Sprintf("missing%08d", i))) {
+			hits++
+		}
+	}
+	return float64(hits) / float64(n)
+}
+
+func TestBloomFilter(t *testing.T) {
+	config := DefaultConfig("btree-bloom")
+	config.InMemory = true
+	config.BloomBitsPerKey = 10
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	// Many times what an empty tree's filter is sized for, so it grows
+	const numKeys = 20 * minFilterKeys
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		put := btree.Put
+		if i%2 == 1 {
+			put = btree.ConcurrentPut
+		}
+		if err := put(key, []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if n := len(*btree.filter.blooms.Load()); n < 2 {
+		t.Errorf("Filter didn't grow past %d keys", minFilterKeys)
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		if _, err := btree.Get(key); err != nil {
+			t.Fatalf("Get(%s) failed: %v", key, err)
+		}
+	}
+	// About 1% a filter, over the few grown
+	if fp := falsePositives(btree, 10000); fp > 0.05 {
+		t.Errorf("False positive rate %.3f", fp)
+	}
+
+	missing := []byte("missing")
+	if _, err := btree.Get(missing); err != common.ErrKeyNotFound {
+		t.Errorf("Get(missing) = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := btree.ConcurrentGet(missing); err != common.ErrKeyNotFound {
+		t.Errorf("ConcurrentGet(missing) = %v, want ErrKeyNotFound", err)
+	}
+	if found, err := btree.Has(missing); found || err != nil {
+		t.Errorf("Has(missing) = %v, %v", found, err)
+	}
+
+	stats := btree.Stats()
+	if stats.BloomMemory["keys"] == 0 || stats.MemoryUsage[common.MemBloom] != stats.BloomMemory["keys"] {
+		t.Errorf("Filter memory %d, charged %d", stats.BloomMemory["keys"], stats.MemoryUsage[common.MemBloom])
+	}
+
+	// Ruled out without reading a page or allocating
+	if !btree.filter.mayContain(missing) {
+		allocs := testing.AllocsPerRun(100, func() { btree.Has(missing) })
+		if allocs != 0 {
+			t.Errorf("Has of a filtered key allocated %v times per call", allocs)
+		}
+	}
+}
+
+// TestBloomFilterRebuild tests that reopening a tree rebuilds its filter
+// from the keys in it, without those deleted since
+func TestBloomFilterRebuild(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig(dir)
+	config.BloomBitsPerKey = 10
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+
+	const numKeys = 5000
+	for i := 0; i < numKeys; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%08d", i)), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("missing%08d", i)), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := btree.Delete([]byte(fmt.Sprintf("missing%08d", i))); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if fp := falsePositives(btree, numKeys); fp != 1 {
+		t.Errorf("Deleted keys gone from the filter (%.3f left)", fp)
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	btree, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree.Close()
+
+	if btree.filter == nil {
+		t.Fatal("No filter after reopening")
+	}
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		if found, err := btree.Has(key); !found || err != nil {
+			t.Fatalf("Has(%s) = %v, %v after reopening", key, found, err)
+		}
+	}
+	if fp := falsePositives(btree, numKeys); fp > 0.03 {
+		t.Errorf("False positive rate %.3f for keys deleted before reopening", fp)
+	}
+}
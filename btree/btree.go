@@ -2,9 +2,15 @@ package btree
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/intellect4all/storage-engines/common"
 )
@@ -14,14 +20,85 @@ type Config struct {
 	DataDir   string
 	Order     int // Max keys per page (fanout)
 	CacheSize int // Number of pages to keep in memory
+
+	// OnRecoveryProgress, if set, is called during WAL replay on open
+	OnRecoveryProgress common.ProgressFunc
+
+	// Memory, if set, charges the page cache against a (possibly shared)
+	// budget. The cache shrinks, down to a small floor, to stay within it.
+	Memory *common.MemoryAccountant
+
+	// Comparator orders keys (nil = bytewise). Its name is recorded in the
+	// metadata page; opening with a different one returns
+	// common.ErrComparatorMismatch.
+	Comparator common.Comparator
+
+	// FS is the filesystem the database and its WAL are stored in (nil =
+	// the OS). A common.MemFS runs the tree without touching disk; a
+	// common.FaultFS injects IO errors for testing.
+	FS common.FS
+
+	// InMemory keeps the database and WAL in a private in-memory FS
+	// instead of files; the data is gone after Close. Can't be combined
+	// with FS.
+	InMemory bool
+
+	// DiskReserveBytes is the free disk space Health expects to remain
+	// (0 = none)
+	DiskReserveBytes int64
+
+	// EncryptionKey encrypts every file the tree writes with AES-GCM, using
+	// this AES key (16, 24 or 32 bytes). KeyProvider does the same with
+	// keys that can change over time. Files can then only be read with the
+	// key they were written with; opening unencrypted data with a key set
+	// fails with common.ErrNotEncrypted. See common.EncryptedFS.
+	EncryptionKey []byte
+	KeyProvider   common.KeyProvider
+
+	// ScrubInterval, if set, starts a background pass over every page this
+	// often, reading it back from disk and checking that it parses, so
+	// damage is found before a read runs into it. ScrubBytesPerSecond
+	// limits how fast it reads (0 = unlimited).
+	ScrubInterval       time.Duration
+	ScrubBytesPerSecond int64
+
+	// OnCorruption, if set, is called with each instance of corruption
+	// found by reads or the scrubber, on the goroutine that found it, e.g.
+	// to restore the data from a replica. It should hand slow work off.
+	OnCorruption func(err error)
+
+	// CheckpointWALBytes and CheckpointInterval, if set, have a background
+	// worker checkpoint the tree as Sync does once the WAL has grown to
+	// CheckpointWALBytes, or its oldest record is about CheckpointInterval
+	// old, so the WAL and its replay on open stay bounded without calls to
+	// Sync. Every dirty page is written out and the WAL emptied, with
+	// writes held off meanwhile.
+	CheckpointWALBytes int64
+	CheckpointInterval time.Duration
+
+	// OnWorkerPanic, if set, is called with each panic recovered from the
+	// checkpoint worker, which is then restarted with a backoff. Health
+	// reports them too.
+	OnWorkerPanic func(p *common.WorkerPanic)
+
+	// BloomBitsPerKey, if set, keeps a bloom filter over every key in
+	// memory, this many bits per key, so that most Gets of missing keys
+	// return without reading a page. 10 bits gives about 1% false
+	// positives. Deleted keys stay in it until the tree is next opened,
+	// when the filter is rebuilt by reading every page.
+	BloomBitsPerKey int
 }
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig(dataDir string) Config {
 	return Config{
-		DataDir:   dataDir + "/btree.db",
+		DataDir:   filepath.Join(dataDir, "btree.db"),
 		Order:     128,   // Good balance for 4KB pages
 		CacheSize: 50000, // Cache 50,000 pages (~200MB memory)
+
+		CheckpointWALBytes: 64 * 1024 * 1024, // 64MB
+		CheckpointInterval: time.Minute,
+
 		// Note: Larger cache reduces write amplification by minimizing page evictions.
 		// Production databases typically use 128MB-2GB caches. For workloads where
 		// the working set exceeds cache size, expect higher write amplification due
@@ -38,70 +115,271 @@ type BTree struct {
 	mu           sync.RWMutex // Global lock (used for structural changes)
 	latchManager *LatchManager // Page-level locks (for concurrent operations)
 
+	memory            *common.MemoryAccountant
+	unregisterReclaim func()
+	lock              io.Closer // On DataDir + ".lock"
+	corruption        common.CorruptionLog
+	scrubber          *common.Scrubber // nil unless ScrubInterval is set
+	filter            *keyFilter       // nil unless BloomBitsPerKey is set
+
+	// checkpointMu serializes checkpoints, which Sync and the checkpoint
+	// worker run under b.mu's read lock, and keeps out ConcurrentPut,
+	// which holds it for reading
+	checkpointMu sync.RWMutex
+
+	// The checkpoint worker, run if CheckpointWALBytes or
+	// CheckpointInterval is set
+	checkpointChan chan struct{} // Wakes it once the WAL is full
+	stopChan       chan struct{} // Closed by Close to stop it
+	workerWg       sync.WaitGroup
+	supervisor     *common.Supervisor
+	workers        struct{ checkpoint atomic.Bool }
+
 	// Statistics (atomic for lock-free access)
 	stats struct {
-		numKeys          int64
+		numKeys          atomic.Int64
 		writeCount       atomic.Int64
 		readCount        atomic.Int64
 		bytesWritten     atomic.Int64
 		userBytesWritten atomic.Int64
+		readAmp          common.ReadAmpHistogram // pages touched per Get
 	}
 
-	closed atomic.Bool
+	gate common.OpGate // Operations in flight, drained by Close
 }
 
 // New creates or opens a B-tree database
 func New(config Config) (*BTree, error) {
+	return NewWithContext(context.Background(), config)
+}
+
+// NewWithContext opens the database like New, abandoning WAL replay with
+// the context's error if ctx is cancelled. The WAL is left intact, so the
+// next open replays it from the start.
+func NewWithContext(ctx context.Context, config Config) (*BTree, error) {
+	fs, err := common.ConfigFS(config.FS, config.InMemory)
+	if err != nil {
+		return nil, err
+	}
+	if fs, err = common.Encrypt(fs, config.EncryptionKey, config.KeyProvider); err != nil {
+		return nil, err
+	}
+	config.FS = fs
+	if err := config.FS.MkdirAll(filepath.Dir(config.DataDir), 0755); err != nil {
+		return nil, err
+	}
+
+	// Only one tree may use the database at a time
+	lock, err := config.FS.Lock(config.DataDir + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
 	// Create pager
-	pager, err := NewPager(config.DataDir, config.CacheSize)
+	pager, err := openPager(config.FS, config.DataDir, config.CacheSize, config.Comparator)
 	if err != nil {
+		lock.Close()
 		return nil, err
 	}
 
 	// Create WAL
 	walPath := config.DataDir + ".wal"
-	wal, err := NewWAL(walPath)
+	wal, err := openWAL(config.FS, walPath)
 	if err != nil {
 		pager.Close()
+		lock.Close()
 		return nil, err
 	}
 
+	memory := config.Memory
+	if memory == nil {
+		memory = common.NewMemoryAccountant(0)
+	}
+
 	btree := &BTree{
 		config:       config,
 		pager:        pager,
 		wal:          wal,
 		latchManager: NewLatchManager(),
+		memory:       memory,
+		lock:         lock,
+
+		checkpointChan: make(chan struct{}, 1),
+		stopChan:       make(chan struct{}),
 	}
+	btree.corruption.OnCorruption = config.OnCorruption
+	btree.supervisor = common.NewSupervisor(btree.stopChan)
+	btree.supervisor.OnPanic = config.OnWorkerPanic
 
 	// Set WAL in pager so it can log page modifications
 	pager.SetWAL(wal)
+	pager.SetMemoryAccountant(memory)
 
 	// Perform WAL recovery if needed
-	if err := btree.recoverFromWAL(); err != nil {
+	if err := btree.recoverFromWAL(ctx); err != nil {
 		pager.Close()
 		wal.Close()
+		lock.Close()
 		return nil, err
 	}
 
+	btree.loadKeys()
+
+	btree.unregisterReclaim = memory.RegisterReclaimer(btree.reclaimMemory)
+	btree.scrubber = common.NewScrubber(config.ScrubInterval, config.ScrubBytesPerSecond, btree.scrub)
+	if config.CheckpointWALBytes > 0 || config.CheckpointInterval > 0 {
+		btree.workerWg.Add(1)
+		btree.workers.checkpoint.Store(true)
+		go func() {
+			defer btree.workerWg.Done()
+			btree.supervisor.Run("checkpoint", &btree.workers.checkpoint, btree.checkpointWorker)
+		}()
+	}
+
 	return btree, nil
 }
 
+// reclaimMemory is registered with the memory accountant and evicts cached
+// pages. It backs off while Put/Delete hold the tree lock for writing, as
+// they change pages without pinning them. Readers holding it for reading
+// don't stop it, any more than they stop their own page loads evicting:
+// latch-coupled writers pin the pages they change.
+func (b *BTree) reclaimMemory(need int64) int64 {
+	if !b.mu.TryRLock() {
+		return 0
+	}
+	defer b.mu.RUnlock()
+
+	if !b.pager.mu.TryLock() {
+		return 0
+	}
+	defer b.pager.mu.Unlock()
+
+	if b.pager.closed {
+		return 0
+	}
+	return b.pager.shrink(need)
+}
+
+// loadKeys counts the tree's keys and builds its bloom filter, if it has
+// one, in one walk over the tree. The count stored at the last checkpoint
+// is used instead if it's known and there is no filter to build.
+func (b *BTree) loadKeys() {
+	numKeys := b.pager.NumKeys()
+	bloom := b.config.BloomBitsPerKey > 0
+	if numKeys >= 0 && !bloom {
+		b.stats.numKeys.Store(numKeys)
+		return
+	}
+
+	var count int64
+	var hashes []uint64
+	err := b.forEachKey(func(key []byte) {
+		count++
+		if bloom {
+			hashes = append(hashes, keyHash(key))
+		}
+	})
+	if err != nil {
+		// Reads go to the pages, which report the damage themselves
+		b.noteCorruption(err)
+		log.Printf("Warning: no bloom filter or fresh key count, failed to read keys: %v", err)
+		if numKeys < 0 {
+			numKeys = count // Those read, at least
+		}
+	} else {
+		numKeys = count
+		if bloom {
+			b.filter = b.buildKeyFilter(hashes)
+		}
+	}
+	b.stats.numKeys.Store(numKeys)
+}
+
+// maxTreeDepth bounds walks over the whole tree, so a damaged tree whose
+// pages point back up can't send one round forever
+const maxTreeDepth = 64
+
+// forEachKey calls fn with every key in the tree, walking it from the
+// root. Caller must hold b.mu, or have the tree to itself.
+func (b *BTree) forEachKey(fn func(key []byte)) error {
+	var walk func(pageID uint32, depth int) error
+	walk = func(pageID uint32, depth int) error {
+		if depth > maxTreeDepth {
+			return fmt.Errorf("%w: page %d is over %d levels deep", common.ErrCorruption, pageID, maxTreeDepth)
+		}
+		page, err := b.pager.GetPage(pageID)
+		if err != nil {
+			return err
+		}
+		if page.IsLeaf() {
+			for i := uint16(0); i < page.NumCells(); i++ {
+				key, err := page.leafKeyAt(i)
+				if err != nil {
+					return err
+				}
+				fn(key)
+			}
+			return nil
+		}
+
+		// Listed first, as reading the children may evict the page
+		children := []uint32{page.RightPtr()}
+		for i := uint16(0); i < page.NumCells(); i++ {
+			_, child, err := page.internalCellAt(i)
+			if err != nil {
+				return err
+			}
+			children = append(children, child)
+		}
+		for _, child := range children {
+			if err := walk(child, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(b.pager.RootPageID(), 0)
+}
+
 // recoverFromWAL replays WAL records to restore consistency
-func (b *BTree) recoverFromWAL() error {
-	records, err := b.wal.ReadAll()
+func (b *BTree) recoverFromWAL(ctx context.Context) error {
+	records, damage, err := b.wal.readAll()
 	if err != nil {
 		return fmt.Errorf("failed to read WAL: %w", err)
 	}
+	b.noteCorruption(damage)
 
 	if len(records) == 0 {
 		// No recovery needed
 		return nil
 	}
 
+	// Sync and Close write a checkpoint once every page is on disk, so the
+	// records before the last one are stale; only later ones are replayed
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Type == WALRecordCheckpoint {
+			records = records[i+1:]
+			break
+		}
+	}
+	if len(records) == 0 {
+		if err := b.wal.Truncate(); err != nil {
+			return fmt.Errorf("failed to truncate WAL: %w", err)
+		}
+		return nil
+	}
+
+	progress := common.NewRecoveryTracker(ctx, b.config.OnRecoveryProgress, common.PhaseWALReplay, int64(len(records)), 0)
+
 	// Replay each record
 	for _, record := range records {
+		if err := progress.Add(1, int64(len(record.Data))); err != nil {
+			return err
+		}
+
 		switch record.Type {
-		case WALRecordPageWrite:
+		case WALRecordPageWrite, WALRecordPageDiff:
 			// Apply page modification
 			// Note: Temporarily disable WAL logging during recovery
 			// to avoid re-logging recovered operations
@@ -114,13 +392,12 @@ func (b *BTree) recoverFromWAL() error {
 				// from a crash where new pages were created but not flushed
 				// Create a blank page and apply the WAL record to it
 				page = NewPage(record.PageID, PageTypeLeaf) // Will be overwritten by WAL data
+				page.compare = b.pager.compare
 				b.pager.cache[record.PageID] = page
 			}
 
 			// Apply the modification
-			if record.Offset+record.Length <= PageSize {
-				copy(page.data[record.Offset:record.Offset+record.Length], record.Data)
-				page.SetDirty(true)
+			if record.applyTo(page) {
 				b.pager.dirty[record.PageID] = true
 			}
 
@@ -143,6 +420,10 @@ func (b *BTree) recoverFromWAL() error {
 	}
 	b.pager.metadata.NumPages = maxPageID + 1
 
+	// The pages replayed may have added or removed keys since the count
+	// was stored; loadKeys counts them again
+	b.pager.metadata.NumKeys = -1
+
 	// Flush all recovered pages
 	if err := b.pager.Sync(); err != nil {
 		return fmt.Errorf("failed to flush recovered pages: %w", err)
@@ -153,28 +434,38 @@ func (b *BTree) recoverFromWAL() error {
 		return fmt.Errorf("failed to truncate WAL: %w", err)
 	}
 
+	progress.Done()
 	return nil
 }
 
 // Put inserts or updates a key-value pair
-func (b *BTree) Put(key, value []byte) error {
+func (b *BTree) Put(key, value []byte) (err error) {
 	if len(key) == 0 {
 		return common.ErrKeyEmpty
 	}
 
-	if b.closed.Load() {
-		return common.ErrClosed
+	if err := b.gate.Enter(); err != nil {
+		return err
 	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	return b.putLocked(key, value)
+}
+
+// putLocked is Put for a caller holding b.mu for writing
+func (b *BTree) putLocked(key, value []byte) error {
 	// Track user bytes written
 	b.stats.userBytesWritten.Add(int64(len(key) + len(value)))
 	b.stats.writeCount.Add(1)
 
 	// TODO: Write to WAL (Phase 4)
 
+	b.filter.add(key)
+
 	// Traverse tree to find leaf and insert with split handling
 	rootPageID := b.pager.RootPageID()
 
@@ -185,109 +476,281 @@ func (b *BTree) Put(key, value []byte) error {
 
 	// Handle root split
 	if splitOccurred {
-		if err := b.handleRootSplit(rootPageID, splitKey, newPageID); err != nil {
+		if err := b.handleRootSplit(rootPageID, splitKey, newPageID, nil); err != nil {
 			return err
 		}
 	}
 
-	b.stats.numKeys++
+	b.checkpointIfFull()
 	return nil
 }
 
+// Incr adds delta to the counter at key and returns its new value (see
+// common.Incrementer). It holds the tree's write lock from the read to
+// the write, as Put does, so concurrent increments never lose one.
+func (b *BTree) Incr(key []byte, delta int64) (int64, error) {
+	var n int64
+	err := b.update(key, func(current []byte, found bool) ([]byte, error) {
+		value, sum, err := common.AddCounter(current, found, delta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		n = sum
+		return value, nil
+	})
+	return n, err
+}
+
+// Append adds suffix to the end of key's value, a missing key taking
+// suffix as its value (see common.Appender). The longer value replaces
+// the old one within its leaf while the leaf has room, and splits it
+// otherwise, as a Put would.
+func (b *BTree) Append(key, suffix []byte) error {
+	return b.update(key, func(current []byte, _ bool) ([]byte, error) {
+		return append(current, suffix...), nil
+	})
+}
+
+// PutIfAbsent writes key only if it doesn't exist, reporting whether it
+// did (see common.Inserter). The key is looked for in place in its leaf,
+// copying nothing, under the write lock the Put then holds.
+func (b *BTree) PutIfAbsent(key, value []byte) (inserted bool, err error) {
+	if len(key) == 0 {
+		return false, common.ErrKeyEmpty
+	}
+
+	if err := b.gate.Enter(); err != nil {
+		return false, err
+	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	leaf, err := b.findLeaf(key)
+	if err != nil {
+		return false, err
+	}
+	if exists, err := leaf.hasKey(key); err != nil || exists {
+		return false, err
+	}
+	if err := b.putLocked(key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// update writes to key the value fn returns for the key's current value
+// and existence, or nothing if fn fails. It holds the tree's write lock
+// from the read to the write, so no other write lands in between.
+func (b *BTree) update(key []byte, fn func(value []byte, found bool) ([]byte, error)) (err error) {
+	if len(key) == 0 {
+		return common.ErrKeyEmpty
+	}
+
+	if err := b.gate.Enter(); err != nil {
+		return err
+	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stats.readCount.Add(1)
+
+	leaf, err := b.findLeaf(key)
+	if err != nil {
+		return err
+	}
+	// Copied, as the write may move it within the page
+	current, err := b.searchLeaf(leaf, key)
+	if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return err
+	}
+	found := err == nil
+
+	value, err := fn(current, found)
+	if err != nil {
+		return err
+	}
+	return b.putLocked(key, value)
+}
+
+// findLeaf returns the leaf key belongs in, for a caller holding b.mu
+func (b *BTree) findLeaf(key []byte) (*Page, error) {
+	pageID := b.pager.RootPageID()
+	for {
+		page, err := b.pager.GetPage(pageID)
+		if err != nil {
+			return nil, err
+		}
+		if page.IsLeaf() {
+			return page, nil
+		}
+		pageID = b.findChild(page, key)
+	}
+}
 
 // findChild finds the child page ID for a given key in an internal node
 // Cell semantics: Cell(K, P) means P contains keys >= K
 func (b *BTree) findChild(page *Page, key []byte) uint32 {
+	if child, err := page.childFor(key); err == nil {
+		return child
+	}
+
+	// A damaged cell leaves binary search lost; scan the page, past it
 	numCells := page.NumCells()
 
-	// Find the first cell where key >= cell.Key
-	// That cell's child contains the key
+	// We want the LAST cell where key >= cell.Key; cells are sorted, so
+	// stop at the first one greater than key. Keys are compared in place.
+	// Key < all cell keys: use right pointer (for keys less than minimum)
+	child := page.RightPtr()
 	for i := uint16(0); i < numCells; i++ {
-		cell, err := page.CellAt(i)
+		cellKey, cellChild, err := page.internalCellAt(i)
 		if err != nil {
 			continue
 		}
-
-		// If key >= cell.Key, check if this is the right cell
-		// We want the LAST cell where key >= cell.Key
-		if bytes.Compare(key, cell.Key) >= 0 {
-			// Check if there's a next cell
-			if i+1 < numCells {
-				nextCell, err := page.CellAt(i + 1)
-				if err == nil && bytes.Compare(key, nextCell.Key) >= 0 {
-					// key also >= next cell, continue searching
-					continue
-				}
-			}
-			// This is the right cell
-			return cell.Child
+		if page.compareKeys(key, cellKey) < 0 {
+			break
 		}
+		child = cellChild
 	}
-
-	// Key < all cell keys, use right pointer (for keys less than minimum)
-	return page.RightPtr()
+	return child
 }
 
-// Get retrieves the value for a key
+// Get retrieves the value for a key, read optimistically (see olc.go)
 func (b *BTree) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.getValue(key, true, func(v []byte) error {
+		value = bytes.Clone(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// GetPinned calls fn with the value for a key read in place in its page
+// (see GetValue)
+func (b *BTree) GetPinned(key []byte, fn func(value []byte)) error {
+	return b.GetValue(key, func(value []byte) error {
+		fn(value)
+		return nil
+	})
+}
+
+// GetValue implements common.ValueGetter: it calls fn with the value for a
+// key read in place in its page, without copying or allocating. The page
+// is pinned by the tree's read lock and its read latch until fn returns,
+// so fn must not write to the tree.
+func (b *BTree) GetValue(key []byte, fn func(value []byte) error) error {
+	return b.getValue(key, false, fn)
+}
+
+// getValue is GetValue, reading the leaf optimistically if optimistic is
+// set (see readLeaf): fn must then only copy the value, and may be called
+// more than once
+func (b *BTree) getValue(key []byte, optimistic bool, fn func(value []byte) error) (err error) {
 	if len(key) == 0 {
-		return nil, common.ErrKeyEmpty
+		return common.ErrKeyEmpty
 	}
 
-	if b.closed.Load() {
-		return nil, common.ErrClosed
+	if err := b.gate.Enter(); err != nil {
+		return err
 	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
 
+	// Latches, or their versions, keep out ConcurrentPut, which holds the
+	// read lock too
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
 	b.stats.readCount.Add(1)
+	if !b.filter.mayContain(key) {
+		b.stats.readAmp.Record(0)
+		return common.ErrKeyNotFound
+	}
 
-	// Start at root and traverse down
-	pageID := b.pager.RootPageID()
-
-	for {
-		page, err := b.pager.GetPage(pageID)
+	pagesTouched, err := b.readLeaf(key, optimistic, func(leaf *Page) error {
+		value, err := leaf.leafValue(key)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		return fn(value)
+	})
+	b.stats.readAmp.Record(pagesTouched)
+	return err
+}
 
-		if page.IsLeaf() {
-			// Search in leaf
-			return b.searchLeaf(page, key)
-		}
+// Has reports whether key exists. It walks down to the leaf like Get,
+// optimistically, but compares keys in place, without copying any key or
+// value out of the pages.
+func (b *BTree) Has(key []byte) (found bool, err error) {
+	if len(key) == 0 {
+		return false, common.ErrKeyEmpty
+	}
 
-		// Internal node - find child
-		pageID = b.findChild(page, key)
+	if err := b.gate.Enter(); err != nil {
+		return false, err
 	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if !b.filter.mayContain(key) {
+		return false, nil
+	}
+	_, err = b.readLeaf(key, true, func(leaf *Page) error {
+		found, err = leaf.hasKey(key)
+		return err
+	})
+	return found, err
 }
 
-// searchLeaf searches for a key in a leaf page
-func (b *BTree) searchLeaf(page *Page, key []byte) ([]byte, error) {
-	index := page.searchCell(key)
-	if index < 0 {
-		// Found
-		index = -index - 1
-		cell, err := page.CellAt(uint16(index))
-		if err != nil {
-			return nil, err
-		}
-		return cell.Value, nil
+// noteCorruption counts err in Stats if it reports damaged pages. The tree
+// is a single file, so there is nothing to quarantine: operations that
+// don't touch the damaged pages carry on as before.
+func (b *BTree) noteCorruption(err error) {
+	if errors.Is(err, common.ErrCorruption) {
+		b.corruption.Record(err)
 	}
+}
 
-	// Not found
-	return nil, common.ErrKeyNotFound
+// countInsert counts a key written to its leaf as a new key, unless it
+// existed, being updated
+func (b *BTree) countInsert(existed bool) {
+	if !existed {
+		b.stats.numKeys.Add(1)
+	}
+}
+
+// searchLeaf searches for a key in a leaf page, returning a copy of its
+// value
+func (b *BTree) searchLeaf(page *Page, key []byte) ([]byte, error) {
+	value, err := page.leafValue(key)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(value), nil
 }
 
 // Delete removes a key from the tree
-func (b *BTree) Delete(key []byte) error {
+func (b *BTree) Delete(key []byte) (err error) {
 	if len(key) == 0 {
 		return common.ErrKeyEmpty
 	}
 
-	if b.closed.Load() {
-		return common.ErrClosed
+	if err := b.gate.Enter(); err != nil {
+		return err
 	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -329,7 +792,8 @@ func (b *BTree) deleteFromLeaf(page *Page, key []byte) error {
 	}
 
 	b.pager.MarkDirty(page.ID())
-	b.stats.numKeys--
+	b.stats.numKeys.Add(-1)
+	b.checkpointIfFull()
 
 	// Check if page is underfull and needs rebalancing
 	merged, err := b.mergeOrRedistribute(page.ID(), key)
@@ -342,11 +806,20 @@ func (b *BTree) deleteFromLeaf(page *Page, key []byte) error {
 	return nil
 }
 
-// Close flushes all dirty pages and closes the database
+// Close flushes all dirty pages and closes the database. New operations
+// fail with common.ErrClosed from the moment it's called, and those in
+// flight are waited for.
 func (b *BTree) Close() error {
-	if b.closed.Swap(true) {
+	if !b.gate.Close() {
 		return nil // Already closed
 	}
+	defer b.lock.Close()
+
+	b.unregisterReclaim()
+	b.scrubber.Close()
+	b.filter.release()
+	close(b.stopChan)
+	b.workerWg.Wait()
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -357,6 +830,7 @@ func (b *BTree) Close() error {
 	}
 
 	// Flush all pages
+	b.pager.SetNumKeys(b.stats.numKeys.Load())
 	if err := b.pager.Sync(); err != nil {
 		return fmt.Errorf("failed to sync pager: %w", err)
 	}
@@ -376,19 +850,32 @@ func (b *BTree) Close() error {
 
 // Sync flushes all dirty pages to disk
 func (b *BTree) Sync() error {
-	if b.closed.Load() {
-		return common.ErrClosed
+	if err := b.gate.Enter(); err != nil {
+		return err
 	}
+	defer b.gate.Exit()
 
 	b.mu.RLock()
 	defer b.mu.RUnlock()
+	return b.syncLocked()
+}
+
+// syncLocked makes the pages durable and empties the WAL. Caller must hold
+// b.mu.
+func (b *BTree) syncLocked() error {
+	b.checkpointMu.Lock()
+	defer b.checkpointMu.Unlock()
 
 	// Sync WAL first (write-ahead!)
-	if err := b.wal.Sync(); err != nil {
+	err := b.wal.Sync()
+	b.pager.walErr.Set(err)
+	if err != nil {
 		return fmt.Errorf("failed to sync WAL: %w", err)
 	}
 
-	// Then sync pages
+	// Then sync pages, with the key count they hold: writers are held
+	// off, so it doesn't change meanwhile
+	b.pager.SetNumKeys(b.stats.numKeys.Load())
 	if err := b.pager.Sync(); err != nil {
 		return fmt.Errorf("failed to sync pager: %w", err)
 	}
@@ -431,25 +918,36 @@ func (b *BTree) Stats() common.Stats {
 	pagerBytesWritten := b.pager.stats.bytesWritten
 	b.pager.mu.RUnlock()
 
-	// Calculate write amplification: disk bytes written / user data bytes
-	// Note: WAL is NOT yet implemented (see TODO in Put()), so no WAL overhead
+	// Calculate write amplification: disk bytes written (pages and WAL
+	// records) / user data bytes
 	writeAmp := 1.0
 	userBytes := b.stats.userBytesWritten.Load()
 	if userBytes > 0 {
-		writeAmp = float64(pagerBytesWritten) / float64(userBytes)
+		writeAmp = float64(pagerBytesWritten+b.wal.Appended()) / float64(userBytes)
 	}
 
 	// Space amplification: disk space used / actual user data
 	spaceAmp := float64(totalDiskSize) / float64(logicalSize)
 
 	return common.Stats{
-		NumKeys:       b.stats.numKeys,
+		NumKeys:       b.stats.numKeys.Load(),
 		NumSegments:   numPages, // "Segments" = pages for B-tree
 		TotalDiskSize: totalDiskSize,
 		WriteCount:    b.stats.writeCount.Load(),
 		ReadCount:     b.stats.readCount.Load(),
 		WriteAmp:      writeAmp,
 		SpaceAmp:      spaceAmp,
+		ReadAmp:       b.stats.readAmp.Mean(),
+		ReadAmpP99:    b.stats.readAmp.Percentile(99),
+		MemoryUsed:    b.memory.Used(),
+		MemoryBudget:  b.memory.Budget(),
+		MemoryUsage:   b.memory.Usage(),
+
+		CorruptionCount: b.corruption.Count(),
+		ScrubPasses:     b.scrubber.Passes(),
+		ScrubbedBytes:   b.scrubber.Scanned(),
+		StaleKeyFiles:   b.staleKeyFiles(),
+		BloomMemory:     b.bloomMemory(),
 		// Note: cacheHitRate is not in common.Stats, but could be added for debugging
 	}
 }
@@ -1,15 +1,19 @@
 package btree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/intellect4all/storage-engines/common"
 )
 
 func setupTestBTree(t *testing.T) (*BTree, func()) {
-	dir := fmt.Sprintf("/tmp/btree-test-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-test-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 
@@ -81,6 +85,137 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+// TestIncr increments a counter from several goroutines, none of which
+// may lose another's increment
+func TestIncr(t *testing.T) {
+	btree, cleanup := setupTestBTree(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := btree.Incr([]byte("counter"), 1); err != nil {
+					t.Errorf("Incr failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err := btree.Incr([]byte("counter"), -1000)
+	if err != nil || n != -200 {
+		t.Fatalf("Expected the counter at -200, got %d, %v", n, err)
+	}
+	if value, err := btree.Get([]byte("counter")); err != nil || string(value) != "-200" {
+		t.Fatalf("Expected -200 stored, got %q, %v", value, err)
+	}
+
+	if err := btree.Put([]byte("name"), []byte("alice")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := btree.Incr([]byte("name"), 1); !errors.Is(err, common.ErrNotCounter) {
+		t.Fatalf("Expected ErrNotCounter, got %v", err)
+	}
+}
+
+// TestAppend appends to a value from several goroutines, every append
+// landing, growing it past the room left in its leaf
+func TestAppend(t *testing.T) {
+	btree, cleanup := setupTestBTree(t)
+	defer cleanup()
+
+	for i := 0; i < 60; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte("v"), 50)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := btree.Append([]byte("log"), []byte{byte('a' + id)}); err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	value, err := btree.Get([]byte("log"))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if len(value) != 400 {
+		t.Fatalf("Expected 400 bytes appended, got %d", len(value))
+	}
+	for g := 0; g < 4; g++ {
+		if n := bytes.Count(value, []byte{byte('a' + g)}); n != 100 {
+			t.Fatalf("Expected 100 appends from goroutine %d, got %d", g, n)
+		}
+	}
+	for i := 0; i < 60; i++ {
+		if _, err := btree.Get([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatalf("Get of key%03d after the appends failed: %v", i, err)
+		}
+	}
+}
+
+// TestPutIfAbsent races goroutines to insert the same keys, exactly one
+// of which may win each
+func TestPutIfAbsent(t *testing.T) {
+	btree, cleanup := setupTestBTree(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := make(map[string]int)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%04d", i)
+				inserted, err := btree.PutIfAbsent([]byte(key), []byte(fmt.Sprint(id)))
+				if err != nil {
+					t.Errorf("PutIfAbsent failed: %v", err)
+					return
+				}
+				if inserted {
+					mu.Lock()
+					winners[key] = id
+					mu.Unlock()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if len(winners) != 200 {
+		t.Fatalf("Expected one insert of each of 200 keys, got %d", len(winners))
+	}
+	for key, id := range winners {
+		value, err := btree.Get([]byte(key))
+		if err != nil || string(value) != fmt.Sprint(id) {
+			t.Fatalf("Expected %s to hold the winner's %d, got %q, %v", key, id, value, err)
+		}
+	}
+
+	if err := btree.Delete([]byte("key0000")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if inserted, err := btree.PutIfAbsent([]byte("key0000"), []byte("again")); err != nil || !inserted {
+		t.Fatalf("Expected a deleted key to be inserted again, got %v, %v", inserted, err)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	btree, cleanup := setupTestBTree(t)
 	defer cleanup()
@@ -100,6 +235,142 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+// TestHas tests existence checks across leaves, after deletes and for
+// keys outside the tree
+func TestHas(t *testing.T) {
+	btree, cleanup := setupTestBTree(t)
+	defer cleanup()
+
+	// Enough keys to split into several leaves
+	for i := 0; i < 500; i += 2 {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.Delete([]byte("key100")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		want := i%2 == 0 && i != 100
+		if found, err := btree.Has(key); err != nil || found != want {
+			t.Fatalf("Has(%s): expected %v, got %v err=%v", key, want, found, err)
+		}
+	}
+	for _, key := range []string{"a", "key", "zzz"} {
+		if found, err := btree.Has([]byte(key)); err != nil || found {
+			t.Errorf("Has(%s): expected false, got %v err=%v", key, found, err)
+		}
+	}
+	if _, err := btree.Has(nil); err != common.ErrKeyEmpty {
+		t.Errorf("Expected ErrKeyEmpty, got %v", err)
+	}
+}
+
+func TestGetPinned(t *testing.T) {
+	btree, cleanup := setupTestBTree(t)
+	defer cleanup()
+
+	for i := 0; i < 500; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.Put([]byte("empty"), nil); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		want := fmt.Sprintf("value%03d", i)
+		var got string
+		if err := btree.GetPinned(key, func(value []byte) { got = string(value) }); err != nil || got != want {
+			t.Fatalf("GetPinned(%s): expected %s, got %s err=%v", key, want, got, err)
+		}
+	}
+
+	// Get copies the value out once; an empty value is still non-nil
+	value, err := btree.Get([]byte("empty"))
+	if err != nil || value == nil || len(value) != 0 {
+		t.Errorf("Get(empty): expected empty value, got %q err=%v", value, err)
+	}
+
+	called := false
+	if err := btree.GetPinned([]byte("missing"), func([]byte) { called = true }); err != common.ErrKeyNotFound || called {
+		t.Errorf("Expected ErrKeyNotFound without calling fn, got %v called=%v", err, called)
+	}
+
+	// Reading in place allocates nothing
+	key := []byte("key250")
+	var n int
+	allocs := testing.AllocsPerRun(100, func() {
+		btree.GetPinned(key, func(value []byte) { n += len(value) })
+	})
+	if allocs != 0 {
+		t.Errorf("GetPinned allocated %v times per call", allocs)
+	}
+}
+
+func TestAdapter(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-adapter-%d", os.Getpid()))
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	var engine common.StorageEngine
+	engine, err := NewAdapter(DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to create adapter: %v", err)
+	}
+	defer engine.Close()
+
+	if err := engine.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if value, err := engine.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("Get: expected value, got %q err=%v", value, err)
+	}
+	if _, err := engine.Get([]byte("missing")); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestApproximateSizes(t *testing.T) {
+	btree, cleanup := setupTestBTree(t)
+	defer cleanup()
+
+	for i := 0; i < 2000; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte("v"), 50)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	sizes, err := btree.ApproximateSizes([]common.KeyRange{
+		{},
+		{End: []byte("key0500")},
+		{Start: []byte("key0500"), End: []byte("key1500")},
+		{Start: []byte("key1500")},
+		{Start: []byte("key0700"), End: []byte("key0700")},
+		{Start: []byte("zzz")},
+	})
+	if err != nil {
+		t.Fatalf("ApproximateSizes failed: %v", err)
+	}
+
+	total := btree.Stats().TotalDiskSize - PageSize
+	if sizes[0].DiskBytes != total {
+		t.Errorf("Whole range: expected %d, got %d", total, sizes[0].DiskBytes)
+	}
+	for i, want := range []int64{total / 4, total / 2, total / 4} {
+		if got := sizes[i+1].DiskBytes; got < want*7/10 || got > want*13/10 {
+			t.Errorf("Range %d: expected about %d, got %d", i+1, want, got)
+		}
+	}
+	if sizes[4].DiskBytes != 0 || sizes[5].DiskBytes != 0 {
+		t.Errorf("Expected empty ranges to take nothing, got %d and %d", sizes[4].DiskBytes, sizes[5].DiskBytes)
+	}
+}
+
 func TestMultipleKeys(t *testing.T) {
 	btree, cleanup := setupTestBTree(t)
 	defer cleanup()
@@ -173,7 +444,7 @@ func TestPageSplit(t *testing.T) {
 }
 
 func TestPersistence(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-test-persist-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-test-persist-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -217,6 +488,282 @@ func TestPersistence(t *testing.T) {
 	}
 }
 
+// TestMemFS tests that a tree kept on a MemFS reopens with its data and
+// touches nothing on disk
+func TestMemFS(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/btree-memfs")
+	config.FS = fs
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		value := []byte(fmt.Sprintf("value%03d", i))
+		if err := btree.Put(key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if _, err := os.Stat("/btree-memfs"); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing on disk, got err=%v", err)
+	}
+
+	btree2, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree2.Close()
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		value, err := btree2.Get(key)
+		if err != nil || string(value) != fmt.Sprintf("value%03d", i) {
+			t.Fatalf("key%03d after reopen: got %q, err=%v", i, value, err)
+		}
+	}
+}
+
+// TestCorruptPage tests that a damaged page fails the reads that reach it
+// with common.ErrCorruption, counted in Stats, while other keys are served
+func TestCorruptPage(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/btree-corrupt")
+	config.FS = fs
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if err := btree.Put(key, []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Close wrote out every page; without the WAL, replay can't repair the
+	// damage. Page 1 is the first leaf, split off as the tree grew.
+	if err := fs.Remove(config.DataDir + ".wal"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile(config.DataDir, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xee}, PageSize+HeaderOffsetType); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	btree2, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree2.Close()
+
+	var corrupt, served int
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		value, err := btree2.Get(key)
+		switch {
+		case errors.Is(err, common.ErrCorruption):
+			corrupt++
+		case err != nil || string(value) != fmt.Sprintf("value%03d", i):
+			t.Fatalf("key%03d: got %q, err=%v", i, value, err)
+		default:
+			served++
+		}
+	}
+	if corrupt == 0 || served == 0 {
+		t.Fatalf("Expected reads of the damaged page to fail and the rest served, got %d failed, %d served", corrupt, served)
+	}
+	if stats := btree2.Stats(); stats.CorruptionCount != int64(corrupt) {
+		t.Errorf("Expected CorruptionCount %d, got %d", corrupt, stats.CorruptionCount)
+	}
+}
+
+// TestScrub tests that a scrub pass finds a damaged page no read has
+// touched and reports it to the hook
+func TestScrub(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/btree-scrub")
+	config.FS = fs
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if err := btree.Put(key, []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// As in TestCorruptPage
+	if err := fs.Remove(config.DataDir + ".wal"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile(config.DataDir, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xee}, PageSize+HeaderOffsetType); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var found []error
+	config.OnCorruption = func(err error) { found = append(found, err) }
+	btree2, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree2.Close()
+
+	btree2.scrub(nil)
+
+	if len(found) != 1 || !errors.Is(found[0], common.ErrCorruption) {
+		t.Fatalf("Expected the damaged page reported once, got %v", found)
+	}
+	if stats := btree2.Stats(); stats.CorruptionCount != 1 {
+		t.Errorf("Expected CorruptionCount 1, got %d", stats.CorruptionCount)
+	}
+}
+
+// TestInMemory tests that an in-memory tree works without creating any
+// files and starts empty each time it is opened
+func TestInMemory(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-test-inmem-%d", os.Getpid()))
+	config := DefaultConfig(dir)
+	config.InMemory = true
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if err := btree.Put(key, []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for i := 0; i < 1000; i += 3 {
+		if err := btree.Delete([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		value, err := btree.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if i%3 == 0 {
+			if !errors.Is(err, common.ErrKeyNotFound) {
+				t.Fatalf("Expected key%04d deleted, got err=%v", i, err)
+			}
+		} else if err != nil || string(value) != fmt.Sprintf("value%04d", i) {
+			t.Fatalf("key%04d: got %q, err=%v", i, value, err)
+		}
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Expected no files for an in-memory tree, got err=%v", err)
+	}
+
+	btree2, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree2.Close()
+	if _, err := btree2.Get([]byte("key0001")); !errors.Is(err, common.ErrKeyNotFound) {
+		t.Fatalf("Expected a fresh tree after reopening, got err=%v", err)
+	}
+
+	config.FS = common.NewMemFS()
+	if _, err := New(config); !errors.Is(err, common.ErrInMemoryWithFS) {
+		t.Fatalf("Expected ErrInMemoryWithFS, got %v", err)
+	}
+}
+
+// reverseComparator orders keys in descending byte order
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string            { return "test.reverse" }
+
+func TestCustomComparator(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-test-comparator-%d", os.Getpid()))
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.Comparator = reverseComparator{}
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+
+	// Enough keys to split pages
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Put(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// A scan visits keys in the comparator's order
+	iter, err := btree.Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	var prev []byte
+	for iter.Next() {
+		if prev != nil && bytes.Compare(prev, iter.Key()) <= 0 {
+			t.Fatalf("Scan out of order: %s before %s", prev, iter.Key())
+		}
+		prev = append(prev[:0], iter.Key()...)
+	}
+	iter.Close()
+	if prev == nil {
+		t.Fatal("Scan returned no keys")
+	}
+	btree.Close()
+
+	// The comparator is recorded in the metadata page
+	if _, err := New(DefaultConfig(dir)); !errors.Is(err, common.ErrComparatorMismatch) {
+		t.Fatalf("Expected ErrComparatorMismatch opening with bytewise order, got %v", err)
+	}
+
+	btree, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree.Close()
+	for i := 0; i < 2000; i++ {
+		value, err := btree.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if err != nil {
+			t.Fatalf("Get failed for key%05d: %v", i, err)
+		}
+		if string(value) != fmt.Sprintf("value%05d", i) {
+			t.Fatalf("Expected value%05d, got %s", i, value)
+		}
+	}
+}
+
 func TestStats(t *testing.T) {
 	btree, cleanup := setupTestBTree(t)
 	defer cleanup()
@@ -251,3 +798,332 @@ func TestStats(t *testing.T) {
 
 	t.Logf("Stats: %+v", stats)
 }
+
+// TestNumKeys tests that updates don't count as new keys, and that the
+// count survives reopening, cleanly or after a crash
+func TestNumKeys(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/btree-num-keys")
+	config.FS = fs
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+
+	expect := func(tree *BTree, want int64, when string) {
+		t.Helper()
+		if n := tree.Stats().NumKeys; n != want {
+			t.Errorf("%s: NumKeys = %d, want %d", when, n, want)
+		}
+	}
+
+	// Big enough values that updates split pages too
+	value := bytes.Repeat([]byte("v"), 300)
+	for i := 0; i < 200; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		put := btree.Put
+		if i%2 == 1 {
+			put = btree.ConcurrentPut
+		}
+		if err := put(key, append(value, 'x')); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+	}
+	if _, err := btree.PutIfAbsent([]byte("key000"), value); err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	if err := btree.ConcurrentPut([]byte("key200"), value); err != nil {
+		t.Fatalf("ConcurrentPut failed: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := btree.Delete([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	expect(btree, 151, "Before reopening")
+
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	btree, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	expect(btree, 151, "After reopening")
+
+	// Writes after the last checkpoint are replayed from the WAL without
+	// being counted, so the keys are counted again
+	for i := 0; i < 20; i++ {
+		if err := btree.Delete([]byte(fmt.Sprintf("key%03d", 50+i))); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := btree.wal.Sync(); err != nil {
+		t.Fatalf("WAL sync failed: %v", err)
+	}
+	config.FS = fs.CrashClone()
+	btree.Close()
+
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover btree: %v", err)
+	}
+	defer recovered.Close()
+	expect(recovered, 131, "After recovery")
+}
+
+func TestMemoryBudget(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-memory-test-%d", os.Getpid()))
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	budget := int64(100 * PageSize)
+	config := DefaultConfig(dir)
+	config.Memory = common.NewMemoryAccountant(budget)
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+
+	// Enough data for a couple of hundred pages
+	value := make([]byte, 200)
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		if err := btree.Put(key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	stats := btree.Stats()
+	if stats.NumSegments <= 100 {
+		t.Fatalf("Expected more pages than the budget holds, got %d", stats.NumSegments)
+	}
+	if stats.MemoryUsed > budget || stats.MemoryUsage[common.MemPageCache] != stats.MemoryUsed {
+		t.Errorf("Expected page cache within %d bytes, got %+v", budget, stats.MemoryUsage)
+	}
+
+	// Evicted pages must still be readable
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		if _, err := btree.Get(key); err != nil {
+			t.Fatalf("Get failed for %s: %v", key, err)
+		}
+	}
+
+	btree.Close()
+	if used := config.Memory.Used(); used != 0 {
+		t.Errorf("Expected all memory released on close, got %d", used)
+	}
+}
+
+// TestReclaimDuringReads tests that another engine's charge to a shared
+// budget takes back cached pages while readers hold the tree, but not
+// while a Put holds it
+func TestReclaimDuringReads(t *testing.T) {
+	config := DefaultConfig("/btree-reclaim")
+	config.FS = common.NewMemFS()
+	config.Memory = common.NewMemoryAccountant(1000 * PageSize)
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	value := make([]byte, 200)
+	for i := 0; i < 2000; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%06d", i)), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	cached := func() int64 { return config.Memory.Usage()[common.MemPageCache] }
+	before := cached()
+	if before <= 50*PageSize {
+		t.Fatalf("Expected over 50 cached pages, got %d bytes", before)
+	}
+
+	// The write lock held, as by Put: nothing is taken
+	btree.mu.Lock()
+	if freed := btree.reclaimMemory(10 * PageSize); freed != 0 {
+		t.Errorf("Reclaimed %d bytes under the write lock", freed)
+	}
+	btree.mu.Unlock()
+
+	// Read locks held, as by a Get and a Scan
+	btree.mu.RLock()
+	btree.mu.RLock()
+	config.Memory.Charge("other", config.Memory.Budget()-config.Memory.Used()+10*PageSize)
+	btree.mu.RUnlock()
+	btree.mu.RUnlock()
+	if after := cached(); after > before-10*PageSize {
+		t.Errorf("Expected 10 pages reclaimed during reads, cache went from %d to %d bytes", before, after)
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		if _, err := btree.Get(key); err != nil {
+			t.Fatalf("Get failed for %s: %v", key, err)
+		}
+	}
+}
+
+// TestHealth tests that Health reports a failing WAL, a full disk and a
+// closed tree
+func TestHealth(t *testing.T) {
+	mem := common.NewMemFS()
+	fs := common.NewFaultFS(mem)
+	config := DefaultConfig("/btree-health")
+	config.FS = fs
+	config.DiskReserveBytes = 1 << 20
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+
+	if h := btree.Health(); !h.OK || len(h.Workers) != 1 || !h.Workers["checkpoint"] {
+		t.Fatalf("Expected a healthy tree, got %+v", h)
+	}
+
+	mem.SetDiskFree(1 << 10)
+	if h := btree.Health(); h.OK || h.DiskFree != 1<<10 {
+		t.Errorf("Expected the disk reserve problem, got %+v", h)
+	}
+	mem.SetDiskFree(1 << 30)
+
+	fs.FailAfter(common.FaultWrite, ".wal", 0, nil)
+	btree.Put([]byte("failed"), []byte("value"))
+	h := btree.Health()
+	if h.OK || h.WALWritable || !errors.Is(h.WALError, common.ErrInjectedFault) {
+		t.Errorf("Expected an unwritable WAL, got %+v", h)
+	}
+
+	fs.Heal()
+	if err := btree.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatalf("Put after heal failed: %v", err)
+	}
+	if h := btree.Health(); !h.OK {
+		t.Errorf("Expected a healthy tree once the WAL recovered, got %+v", h)
+	}
+
+	btree.Close()
+	if h := btree.Health(); h.OK || !h.Closed {
+		t.Errorf("Expected a closed tree, got %+v", h)
+	}
+}
+
+// TestEncryption tests that with an encryption key neither the database
+// nor its WAL holds data in the clear, and that it only opens with the
+// same key
+func TestEncryption(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/btree-encrypted")
+	config.FS = fs
+	config.EncryptionKey = bytes.Repeat([]byte{0x42}, 32)
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("secret%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	scan := func() {
+		entries, err := fs.ReadDir(filepath.Dir(config.DataDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			path := filepath.Join(filepath.Dir(config.DataDir), e.Name())
+			data, err := common.ReadFile(fs, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("key0")) {
+				t.Errorf("%s holds data in the clear", path)
+			}
+		}
+	}
+	scan() // With the records still in the WAL
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	scan()
+
+	btree, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		value, err := btree.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil || string(value) != fmt.Sprintf("secret%03d", i) {
+			t.Fatalf("key%03d after reopen: got %q, err=%v", i, value, err)
+		}
+	}
+	btree.Close()
+
+	config.EncryptionKey = bytes.Repeat([]byte{0x43}, 32)
+	if _, err := New(config); !errors.Is(err, common.ErrEncryptionKey) {
+		t.Errorf("Expected ErrEncryptionKey opening with another key, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keys := common.NewKeyRing(1, bytes.Repeat([]byte{0x42}, 32))
+	config := DefaultConfig("/btree-rekey")
+	config.FS = common.NewMemFS()
+	config.KeyProvider = keys
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	keys.Rotate(2, bytes.Repeat([]byte{0x43}, 32))
+	if n := btree.Stats().StaleKeyFiles; n != 2 {
+		t.Fatalf("Expected the database file and WAL stale after rotating the key, got %d", n)
+	}
+	if err := btree.RotateKeys(); err != nil {
+		t.Fatalf("RotateKeys failed: %v", err)
+	}
+
+	// The database file keeps its key
+	if n := btree.Stats().StaleKeyFiles; n != 1 {
+		t.Fatalf("Expected only the database file stale after RotateKeys, got %d", n)
+	}
+	for i := 500; i < 600; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	btree, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer btree.Close()
+	for i := 0; i < 600; i++ {
+		value, err := btree.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%03d", i) {
+			t.Fatalf("Get key%03d: got %q, err=%v", i, value, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// checkpointSuffix names the copy of the database file a checkpoint reads
+const checkpointSuffix = ".checkpoint"
+
+// Checkpoint implements common.Checkpointer. Every page is written out
+// and the WAL emptied, as by Sync, and the database file is copied next
+// to itself with writes held off; fn then gets the copy, named after the
+// database file, while writes go on. The copy is removed when fn returns.
+func (b *BTree) Checkpoint(fn func(files []common.CheckpointFile) error) error {
+	if err := b.gate.Enter(); err != nil {
+		return err
+	}
+	defer b.gate.Exit()
+
+	path := b.config.DataDir + checkpointSuffix
+	size, err := b.copyForCheckpoint(path)
+	defer b.config.FS.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := b.config.FS.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	defer file.Close()
+
+	return fn([]common.CheckpointFile{{
+		Name: filepath.Base(b.config.DataDir),
+		Size: size,
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(file, 0, size)), nil
+		},
+	}})
+}
+
+// copyForCheckpoint syncs the tree and copies its database file to path,
+// returning the copy's size
+func (b *BTree) copyForCheckpoint(path string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.syncLocked(); err != nil {
+		return 0, err
+	}
+
+	src, err := b.config.FS.Open(b.config.DataDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open database file: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := b.config.FS.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	size, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy database file: %w", err)
+	}
+	return size, nil
+}
+
+// checkpointIfFull wakes the checkpoint worker if the WAL has grown to
+// CheckpointWALBytes
+func (b *BTree) checkpointIfFull() {
+	if limit := b.config.CheckpointWALBytes; limit > 0 && b.wal.Size() >= limit {
+		select {
+		case b.checkpointChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// checkpointDue reports whether the WAL has grown to CheckpointWALBytes or
+// its oldest record is CheckpointInterval old
+func (b *BTree) checkpointDue(now time.Time) bool {
+	if limit := b.config.CheckpointWALBytes; limit > 0 && b.wal.Size() >= limit {
+		return true
+	}
+	interval := b.config.CheckpointInterval
+	return interval > 0 && b.wal.age(now) >= interval
+}
+
+// checkpointWorker checkpoints the tree when writes find the WAL full,
+// and looks four times per CheckpointInterval for its oldest record
+// having grown too old
+func (b *BTree) checkpointWorker() {
+	var tick <-chan time.Time
+	if b.config.CheckpointInterval > 0 {
+		ticker := time.NewTicker(max(b.config.CheckpointInterval/4, time.Millisecond))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-b.stopChan:
+			return
+		case <-b.checkpointChan:
+		case <-tick:
+		}
+		// A Sync since may have emptied the WAL already
+		if !b.checkpointDue(time.Now()) {
+			continue
+		}
+		if err := b.Sync(); err != nil && !errors.Is(err, common.ErrClosed) {
+			log.Printf("Warning: background checkpoint failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common/wal"
+)
+
+// pageSeed returns the bytes of a page of the given type and format
+// holding a few cells, for the fuzzers to start from
+func pageSeed(t testing.TB, pageType, version byte) []byte {
+	page := NewPage(1, pageType)
+	page.data[HeaderOffsetVersion] = version
+	for i := 0; i < 20; i++ {
+		cell := &Cell{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte(fmt.Sprintf("value%d", i)), Child: uint32(i + 2)}
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]byte(nil), page.Data()...)
+}
+
+// FuzzLoadPage loads corrupt pages and reads every cell of those it
+// accepts, in each way the tree does, then writes to them: damage must
+// be reported as an error, never a panic
+func FuzzLoadPage(f *testing.F) {
+	for _, pageType := range []byte{PageTypeLeaf, PageTypeInternal} {
+		for _, version := range []byte{PageFormatV1, PageFormatV2} {
+			f.Add(pageSeed(f, pageType, version), []byte("key010"))
+		}
+	}
+
+	// An internal cell at the very end of the page whose key size takes
+	// two bytes, leaving no room for its child pointer
+	page := NewPage(1, PageTypeInternal)
+	page.setNumCells(1)
+	page.setFreePtr(PageSize - InternalCellHeaderSizeV2Min)
+	page.setCellOffset(0, PageSize-InternalCellHeaderSizeV2Min)
+	putUvarint16(page.data[PageSize-InternalCellHeaderSizeV2Min:], 200)
+	f.Add(append([]byte(nil), page.Data()...), []byte("key"))
+
+	f.Fuzz(func(t *testing.T, data, key []byte) {
+		if len(data) > PageSize {
+			return
+		}
+		data = append(data, make([]byte, PageSize-len(data))...)
+		page, err := LoadPage(1, data)
+		if err != nil {
+			return
+		}
+
+		for i := uint16(0); i < page.NumCells(); i++ {
+			page.CellAt(i)
+			if page.IsLeaf() {
+				page.leafEntryAt(i)
+			} else {
+				page.internalCellAt(i)
+			}
+		}
+		page.searchCell(key)
+		page.lowerBound(key)
+		if page.IsLeaf() {
+			page.leafValue(key)
+		}
+
+		page.InsertCell(&Cell{Key: key, Value: []byte("value"), Child: 2})
+		if page.NumCells() > 0 {
+			page.DeleteCell(0)
+		}
+	})
+}
+
+// FuzzWALRecord decodes corrupt WAL record payloads and applies the page
+// writes and diffs among them to a page, as recovery does
+func FuzzWALRecord(f *testing.F) {
+	write := binary.LittleEndian.AppendUint32(nil, 1)
+	write = binary.LittleEndian.AppendUint32(write, 100)
+	f.Add(uint8(WALRecordPageWrite), append(write, "data"...))
+	f.Add(uint8(WALRecordPageWrite), []byte{1, 0, 0, 0, 0xf0, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17})
+	f.Add(uint8(WALRecordCheckpoint), []byte{})
+	diff := binary.LittleEndian.AppendUint32(nil, 1)
+	diff = append(diff, 10, 0, 4, 0, 'd', 'a', 't', 'a', 0xfe, 0x0f, 4, 0, 1, 2, 3, 4)
+	f.Add(uint8(WALRecordPageDiff), diff)
+	f.Add(uint8(WALRecordPageDiff), diff[:len(diff)-2])
+
+	f.Fuzz(func(t *testing.T, typ uint8, data []byte) {
+		record, err := decodeRecord(wal.Record{Type: wal.RecordType(typ), Data: data})
+		if err != nil || record.Type != WALRecordPageWrite && record.Type != WALRecordPageDiff {
+			return
+		}
+		record.applyTo(NewPage(record.PageID, PageTypeLeaf))
+	})
+}
@@ -0,0 +1,32 @@
+package btree
+
+import (
+	"path/filepath"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Health diagnoses the tree (see common.Health). Writes happen in the
+// caller's goroutine, so the tree never stalls; the checkpoint worker is
+// the only background worker, if enabled.
+func (b *BTree) Health() common.Health {
+	h := common.Health{
+		WALWritable:     true,
+		DiskFree:        common.DiskFreeOrUnknown(b.config.FS, filepath.Dir(b.config.DataDir)),
+		DiskReserve:     b.config.DiskReserveBytes,
+		Workers:         map[string]bool{},
+		CorruptionCount: b.corruption.Count(),
+		Closed:          b.gate.Closed(),
+	}
+	if b.config.CheckpointWALBytes > 0 || b.config.CheckpointInterval > 0 {
+		h.Workers["checkpoint"] = b.workers.checkpoint.Load()
+	}
+	h.WorkerPanics, h.LastWorkerPanic = b.supervisor.Panics()
+	if err := b.pager.walErr.Err(); err != nil {
+		h.WALWritable = false
+		h.WALError = err
+	}
+
+	h.Diagnose()
+	return h
+}
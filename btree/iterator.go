@@ -1,208 +1,202 @@
 package btree
 
-import (
-	"bytes"
-
-	"github.com/intellect4all/storage-engines/common"
-)
-
-// Iterator implements range scanning over B-tree keys
+import "github.com/intellect4all/storage-engines/common"
+
+// Iterator implements range scanning over B-tree keys. It reads the tree
+// a leaf at a time, copying out the leaf's entries under the tree's read
+// lock and read latches from the root down, so it never sees a page in
+// the middle of a split or merge. Each leaf is found again from the root,
+// after the last key returned, so pages split or merged between leaves
+// neither repeat nor skip keys. Keys written while the scan runs may or
+// may not be seen.
 type Iterator struct {
-	btree       *BTree
-	currentPage *Page
-	cellIndex   uint16
-	endKey      []byte
-	err         error
-	started     bool
-	firstCall   bool // Track if this is the first Next() call
+	btree    *BTree
+	startKey []byte
+	endKey   []byte
+	last     []byte  // Last key returned, where the next leaf picks up
+	cells    []*Cell // Entries of the current leaf not yet returned
+	current  *Cell
+	done     bool
+	closed   bool
+	err      error
 }
 
 // NewIterator creates a new iterator for the given key range
 func (b *BTree) NewIterator(startKey, endKey []byte) *Iterator {
 	return &Iterator{
-		btree:   b,
-		endKey:  endKey,
-		started: false,
+		btree:    b,
+		startKey: startKey,
+		endKey:   endKey,
 	}
 }
 
 // Scan returns an iterator for the given key range
 func (b *BTree) Scan(startKey, endKey []byte) (common.Iterator, error) {
+	if err := b.gate.Enter(); err != nil {
+		return nil, err
+	}
+	defer b.gate.Exit()
+
 	it := b.NewIterator(startKey, endKey)
 
-	// Seek to start position
-	if err := it.seek(startKey); err != nil {
+	// Read the first leaf up front, so a bad start fails here
+	if err := it.fill(); err != nil {
 		return nil, err
 	}
 
 	return it, nil
 }
 
-// seek positions the iterator at the first key >= startKey
-func (it *Iterator) seek(startKey []byte) error {
-	if len(startKey) == 0 {
-		// Start from beginning - find leftmost leaf
-		pageID := it.btree.pager.RootPageID()
-		page, err := it.btree.pager.GetPage(pageID)
-		if err != nil {
+// fill reads the entries of the next leaf holding keys after the last one
+// returned (or from startKey, at first) into it.cells. Leaves left empty
+// by deletes are skipped; no entries means the end of the tree.
+func (it *Iterator) fill() (err error) {
+	b := it.btree
+	if err := b.gate.Enter(); err != nil {
+		return err
+	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
+
+	// The tree lock keeps out Put and Delete, and the read latches held
+	// from the root down to the leaves read keep out ConcurrentPut
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	lc := NewLatchCoupling(b.latchManager)
+	defer lc.ReleaseAll()
+	lc.AcquireLatch(rootLatch, LatchRead)
+	pageID := b.pager.RootPageID()
+	lc.AcquireLatch(pageID, LatchRead)
+
+	key, after := it.startKey, false
+	if it.last != nil {
+		key, after = it.last, true
+	}
+
+	// Walk down to the leaf for key
+	page, err := b.pager.GetPage(pageID)
+	if err != nil {
+		return err
+	}
+	for !page.IsLeaf() {
+		if pageID, err = b.seekChild(page, key); err != nil {
 			return err
 		}
+		if pageID == 0 {
+			return nil // Empty internal page
+		}
+		lc.AcquireLatch(pageID, LatchRead)
+		if page, err = b.pager.GetPage(pageID); err != nil {
+			return err
+		}
+	}
 
-		// Follow leftmost path to leaf
-		for !page.IsLeaf() {
-			if page.NumCells() == 0 {
-				// Empty internal node
-				it.currentPage = nil
-				return nil
-			}
-
-			// Get first child (leftmost)
-			cell, err := page.CellAt(0)
-			if err != nil {
-				return err
-			}
-
-			page, err = it.btree.pager.GetPage(cell.Child)
-			if err != nil {
-				return err
+	index := 0
+	if len(key) > 0 {
+		index = page.searchCell(key)
+		if index < 0 {
+			// Found exact match; skip it if it was already returned
+			index = -index - 1
+			if after {
+				index++
 			}
 		}
-
-		it.currentPage = page
-		it.cellIndex = 0
-		it.started = true
-		it.firstCall = true // First Next() should not advance
-		return nil
 	}
 
-	// Traverse tree to find leaf containing startKey
-	pageID := it.btree.pager.RootPageID()
-
+	// Follow the leaf chain past leaves with nothing left
 	for {
-		page, err := it.btree.pager.GetPage(pageID)
-		if err != nil {
-			it.err = err
-			return err
-		}
-
-		if page.IsLeaf() {
-			// Found leaf, binary search for start position
-			it.currentPage = page
-			index := page.searchCell(startKey)
-			if index < 0 {
-				// Found exact match
-				it.cellIndex = uint16(-index - 1)
-			} else {
-				// Not found, index is insertion point (first key >= startKey)
-				it.cellIndex = uint16(index)
+		for i := index; i < int(page.NumCells()); i++ {
+			cell, err := page.CellAt(uint16(i))
+			if err != nil {
+				return err
 			}
-			it.started = true
-			it.firstCall = true // First Next() should not advance
+			it.cells = append(it.cells, cell)
+		}
+		if len(it.cells) > 0 {
 			return nil
 		}
 
-		// Internal node - find child
-		childPageID, err := GetChildPageID(page, startKey)
-		if err != nil {
-			it.err = err
+		next := page.RightPtr()
+		if next == 0 {
+			return nil // End of tree
+		}
+		lc.AcquireLatch(next, LatchRead)
+		if page, err = b.pager.GetPage(next); err != nil {
 			return err
 		}
-		pageID = childPageID
+		index = 0
 	}
 }
 
+// seekChild returns the child of an internal page to descend to for key,
+// the leftmost one for an empty key, or 0 if the page has none
+func (b *BTree) seekChild(page *Page, key []byte) (uint32, error) {
+	// Keys below the first cell's key are under the right pointer
+	if child := b.findChild(page, key); child != 0 {
+		return child, nil
+	}
+	if page.NumCells() == 0 {
+		return 0, nil
+	}
+	cell, err := page.CellAt(0)
+	if err != nil {
+		return 0, err
+	}
+	return cell.Child, nil
+}
+
 // Next advances the iterator and returns true if there's a valid key-value pair
 func (it *Iterator) Next() bool {
-	if it.err != nil {
+	if it.err != nil || it.done {
 		return false
 	}
 
-	if !it.started {
+	if it.closed {
 		it.err = common.ErrClosed
 		return false
 	}
 
-	// Check if we're at the end of current page
-	if it.currentPage == nil {
-		return false
-	}
-
-	// If this is NOT the first call, advance to next cell
-	if !it.firstCall {
-		it.cellIndex++
-	} else {
-		it.firstCall = false // Clear flag after first call
-	}
-
-	// Check if current position is valid
-	if it.cellIndex >= it.currentPage.NumCells() {
-		// Move to next leaf page
-		rightPtr := it.currentPage.RightPtr()
-		if rightPtr == 0 {
-			// End of tree
-			it.currentPage = nil
-			return false
-		}
-
-		// Load next page
-		nextPage, err := it.btree.pager.GetPage(rightPtr)
-		if err != nil {
+	if len(it.cells) == 0 {
+		if err := it.fill(); err != nil {
 			it.err = err
 			return false
 		}
-
-		it.currentPage = nextPage
-		it.cellIndex = 0
+	}
+	if len(it.cells) == 0 {
+		// End of tree
+		it.current = nil
+		it.done = true
+		return false
 	}
 
-	// Check if current key is beyond endKey
-	if it.endKey != nil {
-		cell, err := it.currentPage.CellAt(it.cellIndex)
-		if err != nil {
-			it.err = err
-			return false
-		}
+	it.current = it.cells[0]
+	it.cells = it.cells[1:]
 
-		if bytes.Compare(cell.Key, it.endKey) >= 0 {
-			// Beyond end key
-			it.currentPage = nil
-			return false
-		}
+	// Check if current key is beyond endKey
+	if it.endKey != nil && it.btree.pager.compare(it.current.Key, it.endKey) >= 0 {
+		it.current = nil
+		it.done = true
+		return false
 	}
 
-	// Current position is valid, return true
+	it.last = it.current.Key
 	return true
 }
 
 // Key returns the current key
 func (it *Iterator) Key() []byte {
-	if it.currentPage == nil {
+	if it.current == nil {
 		return nil
 	}
-
-	cell, err := it.currentPage.CellAt(it.cellIndex)
-	if err != nil {
-		it.err = err
-		return nil
-	}
-
-	return cell.Key
+	return it.current.Key
 }
 
 // Value returns the current value
 func (it *Iterator) Value() []byte {
-	if it.currentPage == nil {
-		return nil
-	}
-
-	cell, err := it.currentPage.CellAt(it.cellIndex)
-	if err != nil {
-		it.err = err
+	if it.current == nil {
 		return nil
 	}
-
-	// Note: cellIndex is advanced in Next(), not here
-	return cell.Value
+	return it.current.Value
 }
 
 // Error returns any error encountered during iteration
@@ -212,6 +206,8 @@ func (it *Iterator) Error() error {
 
 // Close closes the iterator
 func (it *Iterator) Close() error {
-	it.currentPage = nil
+	it.closed = true
+	it.current = nil
+	it.cells = nil
 	return nil
 }
@@ -1,13 +1,19 @@
 package btree
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestIteratorBasic(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-iter-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-iter-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -63,7 +69,7 @@ func TestIteratorBasic(t *testing.T) {
 }
 
 func TestIteratorRange(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-iter-range-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-iter-range-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -122,3 +128,127 @@ func TestIteratorRange(t *testing.T) {
 
 	t.Logf("Successfully scanned %d keys in range", count)
 }
+
+// TestIteratorConcurrentWrites scans while writers split and merge pages.
+// Every scan must return the keys that were there all along, once each and
+// in order.
+func TestIteratorConcurrentWrites(t *testing.T) {
+	for _, mode := range []string{"Put", "ConcurrentPut"} {
+		t.Run(mode, func(t *testing.T) {
+			config := DefaultConfig("btree-iter-stress")
+			config.InMemory = true
+			btree, err := New(config)
+			if err != nil {
+				t.Fatalf("Failed to create btree: %v", err)
+			}
+			defer btree.Close()
+
+			// Even keys stay put; writers come and go between them
+			const numKeys = 2000
+			for i := 0; i < numKeys; i += 2 {
+				key := []byte(fmt.Sprintf("key%05d", i))
+				if err := btree.Put(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+
+			var stop atomic.Bool
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				padding := strings.Repeat("x", 100)
+				for round := 0; !stop.Load(); round++ {
+					for i := 1; i < numKeys && !stop.Load(); i += 2 {
+						key := []byte(fmt.Sprintf("key%05d", i))
+						value := []byte(fmt.Sprintf("value%05d-%d-%s", i, round, padding))
+						var err error
+						if mode == "Put" {
+							err = btree.Put(key, value)
+						} else {
+							err = btree.ConcurrentPut(key, value)
+						}
+						if err != nil {
+							errs <- fmt.Errorf("%s failed: %w", mode, err)
+							return
+						}
+					}
+					if mode != "Put" {
+						continue
+					}
+					for i := 1; i < numKeys && !stop.Load(); i += 2 {
+						if err := btree.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+							errs <- fmt.Errorf("Delete failed: %w", err)
+							return
+						}
+					}
+				}
+			}()
+
+			for r := 0; r < 4; r++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for !stop.Load() {
+						if err := checkScan(btree, numKeys); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+
+			time.Sleep(500 * time.Millisecond)
+			stop.Store(true)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// checkScan scans the whole tree, checking the keys come in order and
+// every even key below numKeys comes with its value
+func checkScan(btree *BTree, numKeys int) error {
+	iter, err := btree.Scan(nil, nil)
+	if err != nil {
+		return fmt.Errorf("Scan failed: %w", err)
+	}
+	defer iter.Close()
+
+	var prev []byte
+	next := 0 // Next even key expected
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			return fmt.Errorf("Scan out of order: %s after %s", key, prev)
+		}
+		prev = append(prev[:0], key...)
+
+		var i int
+		if _, err := fmt.Sscanf(string(key), "key%05d", &i); err != nil {
+			return fmt.Errorf("Scan returned bad key %q", key)
+		}
+		if !bytes.HasPrefix(value, []byte(fmt.Sprintf("value%05d", i))) {
+			return fmt.Errorf("Scan returned value %q for key %s", value, key)
+		}
+		if i%2 == 1 {
+			continue
+		}
+		if i != next {
+			return fmt.Errorf("Scan skipped key%05d, got %s", next, key)
+		}
+		next += 2
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("Iterator error: %w", err)
+	}
+	if next != numKeys {
+		return fmt.Errorf("Scan stopped at key%05d", next)
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package btree
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/intellect4all/storage-engines/common"
 )
@@ -14,7 +16,11 @@ import (
 // 3. Unlock parent (if child won't split/merge)
 // 4. Continue down the tree
 //
-// This allows multiple threads to traverse different paths concurrently
+// This allows multiple threads to traverse different paths concurrently.
+//
+// Latches are taken under the tree's read lock, which keeps out Put and
+// Delete, from the root down, and along the leaf chain to the right; a
+// latch is never waited for while holding one below or right of it.
 
 type LatchMode int
 
@@ -23,9 +29,12 @@ const (
 	LatchWrite                   // Exclusive lock (single writer)
 )
 
-// PageLatch represents a per-page read-write lock
+// PageLatch represents a per-page read-write lock. Its version counts
+// the write latches taken and released, so optimistic readers (see
+// olc.go) can tell a page was changed under them without latching it.
 type PageLatch struct {
-	mu sync.RWMutex
+	mu      sync.RWMutex
+	version atomic.Uint64 // Odd while write-latched
 }
 
 // Lock acquires a latch in the specified mode
@@ -34,6 +43,7 @@ func (l *PageLatch) Lock(mode LatchMode) {
 		l.mu.RLock()
 	} else {
 		l.mu.Lock()
+		l.version.Add(1)
 	}
 }
 
@@ -42,6 +52,7 @@ func (l *PageLatch) Unlock(mode LatchMode) {
 	if mode == LatchRead {
 		l.mu.RUnlock()
 	} else {
+		l.version.Add(1)
 		l.mu.Unlock()
 	}
 }
@@ -51,13 +62,35 @@ func (l *PageLatch) TryLock(mode LatchMode) bool {
 	if mode == LatchRead {
 		return l.mu.TryRLock()
 	}
-	return l.mu.TryLock()
+	if !l.mu.TryLock() {
+		return false
+	}
+	l.version.Add(1)
+	return true
+}
+
+// readVersion returns the version to validate an optimistic read of the
+// page against, or false while the page is write-latched
+func (l *PageLatch) readVersion() (uint64, bool) {
+	version := l.version.Load()
+	return version, version%2 == 0
 }
 
+// validate reports whether the page wasn't write-latched since version
+// was read, so what was read of it meanwhile is consistent
+func (l *PageLatch) validate(version uint64) bool {
+	return l.version.Load() == version
+}
+
+// rootLatch is the latch guarding the root page ID, that of the metadata
+// page it is kept in. Readers hold it from reading the ID to latching the
+// root; writers while the root may split.
+const rootLatch = MetadataPageID
+
 // LatchManager manages page-level latches
 type LatchManager struct {
 	latches map[uint32]*PageLatch
-	mu      sync.Mutex // Protects the latches map
+	mu      sync.RWMutex // Protects the latches map
 }
 
 // NewLatchManager creates a new latch manager
@@ -69,10 +102,18 @@ func NewLatchManager() *LatchManager {
 
 // GetLatch returns the latch for a page, creating it if necessary
 func (lm *LatchManager) GetLatch(pageID uint32) *PageLatch {
+	// Every operation looks up the root's latch, so lookups share the lock
+	lm.mu.RLock()
+	latch, exists := lm.latches[pageID]
+	lm.mu.RUnlock()
+	if exists {
+		return latch
+	}
+
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
-	latch, exists := lm.latches[pageID]
+	latch, exists = lm.latches[pageID]
 	if !exists {
 		latch = &PageLatch{}
 		lm.latches[pageID] = latch
@@ -83,9 +124,14 @@ func (lm *LatchManager) GetLatch(pageID uint32) *PageLatch {
 
 // LatchCoupling implements the latch coupling protocol for tree traversal
 type LatchCoupling struct {
-	lm           *LatchManager
-	heldLatches  []uint32
-	heldModes    []LatchMode
+	lm          *LatchManager
+	heldLatches []uint32
+	heldModes   []LatchMode
+
+	// pinned is the pages a writer pinned in pager to change them, until
+	// ReleaseAll
+	pager  *Pager
+	pinned []uint32
 }
 
 // NewLatchCoupling creates a new latch coupling context
@@ -142,106 +188,293 @@ func (lc *LatchCoupling) ReleaseAll() {
 
 	lc.heldLatches = lc.heldLatches[:0]
 	lc.heldModes = lc.heldModes[:0]
-}
 
-// ConcurrentGet performs a Get operation with latch coupling
-func (b *BTree) ConcurrentGet(key []byte) ([]byte, error) {
-	if len(key) == 0 {
-		return nil, common.ErrKeyEmpty
+	for _, pageID := range lc.pinned {
+		lc.pager.Unpin(pageID)
 	}
+	lc.pinned = lc.pinned[:0]
+}
 
-	if b.closed.Load() {
-		return nil, common.ErrClosed
-	}
+// upgradeLatch trades the read latch on the latest page for a write
+// latch, and pins the page to be changed. The latch above it is held, so
+// no split or merge can change the keys the page is for meanwhile; only
+// writes within it, which the caller sees after.
+func (lc *LatchCoupling) upgradeLatch() (*Page, error) {
+	last := len(lc.heldLatches) - 1
+	pageID := lc.heldLatches[last]
+	lc.lm.GetLatch(pageID).Unlock(lc.heldModes[last])
+	lc.heldLatches = lc.heldLatches[:last]
+	lc.heldModes = lc.heldModes[:last]
+	return lc.writePage(pageID)
+}
 
-	// Use latch coupling instead of global lock
+// newWriteCoupling returns a latch coupling context for a writer, which
+// pins the pages it changes
+func (b *BTree) newWriteCoupling() *LatchCoupling {
 	lc := NewLatchCoupling(b.latchManager)
-	defer lc.ReleaseAll()
+	lc.pager = b.pager
+	return lc
+}
 
-	b.stats.readCount.Add(1)
+// writePage write-latches a page and pins it, to be changed
+func (lc *LatchCoupling) writePage(pageID uint32) (*Page, error) {
+	lc.AcquireLatch(pageID, LatchWrite)
+	page, err := lc.pager.PinPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	lc.pinned = append(lc.pinned, pageID)
+	return page, nil
+}
 
-	// Start at root
-	pageID := b.pager.RootPageID()
+// newPage allocates a page for a split, pinned until ReleaseAll. No latch
+// is needed: other goroutines only reach it through pages still latched.
+func (lc *LatchCoupling) newPage(pageType byte) (*Page, error) {
+	page, err := lc.pager.NewPinnedPage(pageType)
+	if err != nil {
+		return nil, err
+	}
+	lc.pinned = append(lc.pinned, page.ID())
+	return page, nil
+}
 
-	for {
-		// Acquire read latch on current page
-		lc.AcquireLatch(pageID, LatchRead)
+// latchLeaf walks down to the leaf key belongs in with read latch
+// coupling, releasing each page once its child is latched, and returns it
+// with its latch, held for reading, and the number of pages read. It
+// allocates nothing, for GetValue. Caller must hold b.mu for reading.
+func (b *BTree) latchLeaf(key []byte) (*Page, *PageLatch, int, error) {
+	parent := b.latchManager.GetLatch(rootLatch)
+	parent.Lock(LatchRead)
+	pageID := b.pager.RootPageID()
+	for pages := 1; ; pages++ {
+		latch := b.latchManager.GetLatch(pageID)
+		latch.Lock(LatchRead)
+		parent.Unlock(LatchRead)
 
 		page, err := b.pager.GetPage(pageID)
 		if err != nil {
-			return nil, err
+			latch.Unlock(LatchRead)
+			return nil, nil, pages, err
 		}
-
 		if page.IsLeaf() {
-			// Found leaf, search in it
-			value, err := b.searchLeaf(page, key)
-
-			// Release all latches
-			lc.ReleaseAll()
-
-			return value, err
+			return page, latch, pages, nil
 		}
+		pageID = b.findChild(page, key)
+		parent = latch
+	}
+}
 
-		// Internal node - find child
-		childPageID := b.findChild(page, key)
+// ConcurrentGet performs a Get operation, read with optimistic lock
+// coupling (see olc.go)
+func (b *BTree) ConcurrentGet(key []byte) (value []byte, err error) {
+	if len(key) == 0 {
+		return nil, common.ErrKeyEmpty
+	}
 
-		// Release parent latch (we now have child)
-		// This is safe because we're doing a read and the tree structure
-		// can't change under us (writes use exclusive latches)
-		lc.ReleaseParent()
+	if err := b.gate.Enter(); err != nil {
+		return nil, err
+	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
+
+	// The tree lock keeps out Put and Delete; a ConcurrentPut changing a
+	// page read has the read done again
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-		pageID = childPageID
+	b.stats.readCount.Add(1)
+	if !b.filter.mayContain(key) {
+		b.stats.readAmp.Record(0)
+		return nil, common.ErrKeyNotFound
 	}
+
+	pagesTouched, err := b.readLeaf(key, true, func(leaf *Page) error {
+		value, err = b.searchLeaf(leaf, key)
+		return err
+	})
+	b.stats.readAmp.Record(pagesTouched)
+	return value, err
 }
 
-// ConcurrentPut performs a Put operation with latch coupling
-func (b *BTree) ConcurrentPut(key, value []byte) error {
+// errSplitEscapes reports that a ConcurrentPut's insert would split a page
+// it doesn't hold the write latch above, and was left undone
+var errSplitEscapes = errors.New("split reaches an unlatched page")
+
+// ConcurrentPut performs a Put operation with latch crabbing. Most writes
+// fit in their leaf, so it first walks down with read latches, as
+// ConcurrentGet does, and write-latches only the leaf. A write that would
+// split the leaf walks down again with write latches, releasing those
+// above each page that can take the write, or a split below it, without
+// splitting itself. Writes to different leaves go ahead at once, and the
+// root is only write-latched while it may split. Checkpoints wait for the
+// writes in flight.
+func (b *BTree) ConcurrentPut(key, value []byte) (err error) {
 	if len(key) == 0 {
 		return common.ErrKeyEmpty
 	}
 
-	if b.closed.Load() {
-		return common.ErrClosed
+	if err := b.gate.Enter(); err != nil {
+		return err
 	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
 
-	// For writes, we need to be more careful about latch coupling
-	// We acquire write latches when we might need to split
-
-	// Use latch coupling
-	lc := NewLatchCoupling(b.latchManager)
-	defer lc.ReleaseAll()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.checkpointMu.RLock()
+	defer b.checkpointMu.RUnlock()
 
 	// Track user bytes written
 	b.stats.userBytesWritten.Add(int64(len(key) + len(value)))
 	b.stats.writeCount.Add(1)
+	b.filter.add(key)
+
+	// A page is judged able to take a split below it by the length of
+	// key; a longer separator that doesn't fit has it done again, holding
+	// every latch from the root down
+	err = b.leafInsert(key, value)
+	if errors.Is(err, errSplitEscapes) {
+		err = b.crabInsert(key, value, false)
+	}
+	if errors.Is(err, errSplitEscapes) {
+		err = b.crabInsert(key, value, true)
+	}
+	if err != nil {
+		return err
+	}
 
-	// Traverse tree to find leaf
-	// For simplicity, we'll acquire exclusive latches all the way down
-	// A more sophisticated implementation would use read latches until
-	// we determine a split is needed
+	b.checkpointIfFull()
+	return nil
+}
 
-	rootPageID := b.pager.RootPageID()
+// leafInsert inserts key into its leaf under the leaf's write latch,
+// read-latching the pages above. A leaf without room is left as it is,
+// reported as errSplitEscapes.
+func (b *BTree) leafInsert(key, value []byte) error {
+	lc := b.newWriteCoupling()
+	defer lc.ReleaseAll()
 
-	// Acquire write latch on root
-	lc.AcquireLatch(rootPageID, LatchWrite)
+	lc.AcquireLatch(rootLatch, LatchRead)
+	pageID := b.pager.RootPageID()
+	for {
+		lc.AcquireLatch(pageID, LatchRead)
+		page, err := b.pager.GetPage(pageID)
+		if err != nil {
+			return err
+		}
+		if page.IsLeaf() {
+			break
+		}
+		lc.ReleaseParent()
+		if pageID, err = GetChildPageID(page, key); err != nil {
+			return err
+		}
+	}
 
-	splitOccurred, splitKey, newPageID, err := b.insertAndSplit(rootPageID, key, value)
+	leaf, err := lc.upgradeLatch()
 	if err != nil {
 		return err
 	}
+	existed, err := leaf.hasKey(key)
+	if err != nil {
+		return err
+	}
+	// Left as it was if full, updates included
+	if err := leaf.InsertCell(&Cell{Key: key, Value: value}); err != nil {
+		if errors.Is(err, ErrPageFull) {
+			err = errSplitEscapes
+		}
+		return err
+	}
+	b.pager.MarkDirty(leaf.ID())
+	b.countInsert(existed)
+	return nil
+}
+
+// crabInsert inserts key under write latches taken from the root down,
+// releasing those above each page safe from splitting unless pessimistic
+// is set. Nothing is changed if a split would need a page released, which
+// is reported as errSplitEscapes.
+func (b *BTree) crabInsert(key, value []byte, pessimistic bool) (err error) {
+	lc := b.newWriteCoupling()
+	defer lc.ReleaseAll()
 
-	// Handle root split (requires updating metadata)
-	if splitOccurred {
-		// Need global lock for root split (modifies tree structure)
-		b.mu.Lock()
-		err := b.handleRootSplit(rootPageID, splitKey, newPageID)
-		b.mu.Unlock()
+	lc.AcquireLatch(rootLatch, LatchWrite)
+	rootHeld := true
+	pageID := b.pager.RootPageID()
 
+	// The pages still latched, from the highest one a split can reach
+	var path []*Page
+	for {
+		page, err := lc.writePage(pageID)
 		if err != nil {
 			return err
 		}
+		if !pessimistic && !page.IsFull(len(key), leafValueSize(page, value)) {
+			lc.ReleaseParent()
+			path, rootHeld = path[:0], false
+		}
+		path = append(path, page)
+		if page.IsLeaf() {
+			break
+		}
+		if pageID, err = GetChildPageID(page, key); err != nil {
+			return err
+		}
 	}
 
-	b.stats.numKeys++
-	return nil
+	if ok, err := splitStaysIn(path, key, value, rootHeld); err != nil || !ok {
+		if err == nil {
+			err = errSplitEscapes
+		}
+		return err
+	}
+
+	// Insert into the leaf, and each separator a split leaves into the
+	// page above, as insertAndSplit does
+	leaf := path[len(path)-1]
+	existed, err := leaf.hasKey(key)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			b.countInsert(existed)
+		}
+	}()
+	if err := leaf.InsertCell(&Cell{Key: key, Value: value}); !errors.Is(err, ErrPageFull) {
+		if err == nil {
+			b.pager.MarkDirty(leaf.ID())
+		}
+		return err
+	}
+	result, err := b.splitLeaf(leaf, key, value, lc)
+	if err != nil {
+		return err
+	}
+	for i := len(path) - 2; i >= 0; i-- {
+		page := path[i]
+		err := page.InsertCell(&Cell{Key: result.SplitKey, Child: result.NewPageID})
+		if !errors.Is(err, ErrPageFull) {
+			if err == nil {
+				b.pager.MarkDirty(page.ID())
+			}
+			return err
+		}
+		if result, err = b.splitInternal(page, result.SplitKey, result.NewPageID, lc); err != nil {
+			return err
+		}
+	}
+
+	// The root split, and its latch is still held
+	return b.handleRootSplit(path[0].ID(), result.SplitKey, result.NewPageID, lc)
+}
+
+// leafValueSize returns the size value takes in page's cells: none in an
+// internal page
+func leafValueSize(page *Page, value []byte) int {
+	if page.IsLeaf() {
+		return len(value)
+	}
+	return 0
 }
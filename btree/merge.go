@@ -1,14 +1,19 @@
 package btree
 
 import (
-	"bytes"
 	"fmt"
 )
 
 // Page merge and rebalancing operations
-// When a page becomes underfull after deletion, we either:
-// 1. Redistribute keys with a sibling (if sibling has extra keys)
-// 2. Merge with a sibling (if both are underfull)
+// When a leaf becomes underfull after deletion, we either:
+// 1. Merge it with an adjacent sibling (if their cells fit in one page)
+// 2. Redistribute cells with the sibling (otherwise)
+//
+// Siblings are adjacent children of the same parent: in an internal page
+// the right pointer holds the keys below the first cell's key, so the
+// children in key order are RightPtr, Cell(0).Child, Cell(1).Child, ...
+// and Cell(i).Key separates Cell(i).Child from the child before it.
+// Internal pages are not rebalanced.
 
 const (
 	// MinFillFactor is the minimum page utilization before merge/redistribute
@@ -40,7 +45,8 @@ func (b *BTree) shouldMerge(page *Page) bool {
 	return true
 }
 
-// mergeOrRedistribute attempts to rebalance an underfull page
+// mergeOrRedistribute attempts to rebalance an underfull leaf, found by a
+// key it held. Nothing is changed unless the result fits in the pages.
 // Returns true if merge/redistribute occurred
 func (b *BTree) mergeOrRedistribute(pageID uint32, key []byte) (bool, error) {
 	page, err := b.pager.GetPage(pageID)
@@ -48,12 +54,12 @@ func (b *BTree) mergeOrRedistribute(pageID uint32, key []byte) (bool, error) {
 		return false, err
 	}
 
-	if !b.shouldMerge(page) {
+	if !page.IsLeaf() || !b.shouldMerge(page) {
 		return false, nil
 	}
 
 	// Find parent and sibling
-	parentID, siblingID, separatorIdx, err := b.findSibling(pageID, key)
+	parentID, leftID, rightID, separatorIdx, err := b.findSibling(pageID, key)
 	if err != nil {
 		// No parent or sibling found (root page or only child)
 		return false, nil
@@ -63,294 +69,216 @@ func (b *BTree) mergeOrRedistribute(pageID uint32, key []byte) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-
-	sibling, err := b.pager.GetPage(siblingID)
+	left, err := b.pager.GetPage(leftID)
+	if err != nil {
+		return false, err
+	}
+	right, err := b.pager.GetPage(rightID)
 	if err != nil {
 		return false, err
 	}
 
-	// Try redistribution first (less disruptive)
-	if b.canRedistribute(page, sibling) {
-		return true, b.redistribute(parent, page, sibling, separatorIdx)
+	// Leaves of one parent are chained in key order
+	if !left.IsLeaf() || !right.IsLeaf() || left.RightPtr() != right.ID() {
+		return false, nil
 	}
 
-	// Merge pages
-	return true, b.mergePage(parent, page, sibling, separatorIdx)
+	// Merge pages if they fit in one, redistribute otherwise
+	merged, err := b.mergeLeafPages(parent, left, right, separatorIdx)
+	if err != nil || merged {
+		return merged, err
+	}
+	return b.redistributeLeaf(parent, left, right, separatorIdx)
 }
 
-// findSibling finds a sibling page and parent for merging/redistribution
-// Returns: parentID, siblingID, separatorIndex in parent, error
-func (b *BTree) findSibling(pageID uint32, searchKey []byte) (uint32, uint32, uint16, error) {
+// findSibling finds the parent of a page and a sibling to rebalance it
+// with, preferring the one to its left
+// Returns: parentID, left and right page IDs (one of them pageID), the
+// index in parent of the cell separating them, error
+func (b *BTree) findSibling(pageID uint32, searchKey []byte) (uint32, uint32, uint32, uint16, error) {
 	// Traverse from root to find parent
+	parentID := uint32(0)
 	currentID := b.pager.RootPageID()
-
-	// Stack to track path from root
-	type pathEntry struct {
-		pageID        uint32
-		childIdx      int // Index in parent's cells (-1 for rightPtr)
-	}
-	path := []pathEntry{{pageID: currentID, childIdx: -1}}
-
-	// Traverse to find the target page
 	for currentID != pageID {
 		current, err := b.pager.GetPage(currentID)
 		if err != nil {
-			return 0, 0, 0, err
+			return 0, 0, 0, 0, err
 		}
 
 		if current.IsLeaf() {
-			return 0, 0, 0, fmt.Errorf("target page not found in tree")
-		}
-
-		// Find which child to follow
-		childID, err := GetChildPageID(current, searchKey)
-		if err != nil {
-			return 0, 0, 0, err
+			return 0, 0, 0, 0, fmt.Errorf("target page not found in tree")
 		}
 
-		// Record which child we're following
-		childIdx := -1
-		numCells := current.NumCells()
-		for i := uint16(0); i < numCells; i++ {
-			cell, _ := current.CellAt(i)
-			if cell.Child == childID {
-				childIdx = int(i)
-				break
-			}
-		}
-
-		path = append(path, pathEntry{pageID: childID, childIdx: childIdx})
-		currentID = childID
+		parentID = currentID
+		currentID = b.findChild(current, searchKey)
 	}
 
-	if len(path) < 2 {
+	if parentID == 0 {
 		// No parent (this is root)
-		return 0, 0, 0, fmt.Errorf("no parent found")
+		return 0, 0, 0, 0, fmt.Errorf("no parent found")
 	}
 
-	// Parent is second-to-last in path
-	parentEntry := path[len(path)-2]
-	parentID := parentEntry.pageID
-
 	parent, err := b.pager.GetPage(parentID)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, 0, err
 	}
 
-	// Find sibling (prefer left sibling, fallback to right)
-	childIdx := path[len(path)-1].childIdx
+	// Position of the page among the parent's children: -1 for the right
+	// pointer, otherwise the index of its cell
+	childIdx := -1
 	numCells := parent.NumCells()
-
-	var siblingID uint32
-	var separatorIdx uint16
-
-	if childIdx > 0 {
-		// Has left sibling
-		cell, _ := parent.CellAt(uint16(childIdx - 1))
-		siblingID = cell.Child
-		separatorIdx = uint16(childIdx - 1)
-	} else if childIdx < int(numCells)-1 {
-		// Has right sibling
-		cell, _ := parent.CellAt(uint16(childIdx + 1))
-		siblingID = cell.Child
-		separatorIdx = uint16(childIdx)
-	} else if childIdx == -1 && numCells > 0 {
-		// This page is rightPtr, use last cell as sibling
-		cell, _ := parent.CellAt(numCells - 1)
-		siblingID = cell.Child
-		separatorIdx = numCells - 1
-	} else {
-		return 0, 0, 0, fmt.Errorf("no sibling found")
+	if parent.RightPtr() != pageID {
+		for i := uint16(0); i < numCells; i++ {
+			_, child, err := parent.internalCellAt(i)
+			if err != nil {
+				return 0, 0, 0, 0, err
+			}
+			if child == pageID {
+				childIdx = int(i)
+				break
+			}
+		}
+		if childIdx < 0 {
+			return 0, 0, 0, 0, fmt.Errorf("page not found in its parent")
+		}
 	}
 
-	return parentID, siblingID, separatorIdx, nil
-}
-
-// canRedistribute checks if redistribution is possible
-// Redistribution is possible if sibling has more than minimum cells
-func (b *BTree) canRedistribute(page, sibling *Page) bool {
-	minCellsFloat := float64(MaxCellsPerPage) * MinFillFactor
-	minCells := uint16(minCellsFloat)
-
-	// Check if sibling has enough cells to share
-	siblingCells := sibling.NumCells()
-	pageCells := page.NumCells()
-
-	// After redistribution, both should have at least minCells
-	totalCells := siblingCells + pageCells
-	if totalCells < minCells*2 {
-		return false
+	switch {
+	case childIdx == 0:
+		// Left sibling is the right pointer
+		return parentID, parent.RightPtr(), pageID, 0, nil
+	case childIdx > 0:
+		_, left, err := parent.internalCellAt(uint16(childIdx - 1))
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+		return parentID, left, pageID, uint16(childIdx), nil
+	case numCells > 0:
+		// The right pointer's sibling is the first cell's child
+		_, right, err := parent.internalCellAt(0)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+		return parentID, pageID, right, 0, nil
+	default:
+		return 0, 0, 0, 0, fmt.Errorf("no sibling found")
 	}
-
-	return siblingCells > minCells
 }
 
-// redistribute moves keys from sibling to underfull page
-func (b *BTree) redistribute(parent, page, sibling *Page, separatorIdx uint16) error {
-	pageCells := page.NumCells()
-	siblingCells := sibling.NumCells()
-
-	// Calculate how many cells to move
-	totalCells := pageCells + siblingCells
-	targetCells := totalCells / 2
-
-	if page.IsLeaf() {
-		return b.redistributeLeaf(parent, page, sibling, separatorIdx, targetCells)
+// leafCells returns copies of the cells of leaf pages, in order
+func leafCells(pages ...*Page) ([]*Cell, error) {
+	var cells []*Cell
+	for _, page := range pages {
+		for i := uint16(0); i < page.NumCells(); i++ {
+			cell, err := page.CellAt(i)
+			if err != nil {
+				return nil, err
+			}
+			cells = append(cells, CopyCell(cell))
+		}
 	}
-	return b.redistributeInternal(parent, page, sibling, separatorIdx, targetCells)
+	return cells, nil
 }
 
-// redistributeLeaf redistributes cells between leaf pages
-func (b *BTree) redistributeLeaf(parent, page, sibling *Page, separatorIdx, targetCells uint16) error {
-	pageCells := page.NumCells()
-	siblingCells := sibling.NumCells()
-
-	// Collect all cells
-	var allCells []*Cell
-
-	// Determine order based on which page comes first
-	separatorCell, _ := parent.CellAt(separatorIdx)
-
-	pageFirstCell, _ := page.CellAt(0)
-	siblingFirstCell, _ := sibling.CellAt(0)
-
-	pageFirst := bytes.Compare(pageFirstCell.Key, siblingFirstCell.Key) < 0
-
-	if pageFirst {
-		// Page comes before sibling
-		for i := uint16(0); i < pageCells; i++ {
-			cell, _ := page.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
-		}
-		for i := uint16(0); i < siblingCells; i++ {
-			cell, _ := sibling.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
-		}
-	} else {
-		// Sibling comes before page
-		for i := uint16(0); i < siblingCells; i++ {
-			cell, _ := sibling.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
-		}
-		for i := uint16(0); i < pageCells; i++ {
-			cell, _ := page.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
+// rebuild returns a copy of page holding just cells, or false if they
+// don't fit
+func rebuild(page *Page, cells []*Cell) (*Page, bool) {
+	clone := page.Clone()
+	clone.setNumCells(0)
+	clone.setFreePtr(PageSize)
+	for _, cell := range cells {
+		if err := clone.InsertCell(cell); err != nil {
+			return nil, false
 		}
 	}
+	return clone, true
+}
 
-	// Clear both pages
-	page.setNumCells(0)
-	page.setFreePtr(PageSize)
-	sibling.setNumCells(0)
-	sibling.setFreePtr(PageSize)
-
-	// Redistribute cells
-	for i := 0; i < int(targetCells); i++ {
-		page.InsertCell(allCells[i])
+// mergeLeafPages merges right into left, if their cells fit in one page,
+// and drops right and its separator from parent
+func (b *BTree) mergeLeafPages(parent, left, right *Page, separatorIdx uint16) (bool, error) {
+	cells, err := leafCells(left, right)
+	if err != nil {
+		return false, err
 	}
-	for i := int(targetCells); i < len(allCells); i++ {
-		sibling.InsertCell(allCells[i])
+	merged, ok := rebuild(left, cells)
+	if !ok {
+		return false, nil
 	}
 
-	// Update separator key in parent
-	newSeparatorCell, _ := sibling.CellAt(0)
-	separatorCell.Key = CopyCell(newSeparatorCell).Key
+	// Update page links
+	merged.SetRightPtr(right.RightPtr())
+	left.copyFrom(merged)
+
+	// Remove separator from parent
+	if err := parent.DeleteCell(separatorIdx); err != nil {
+		return false, err
+	}
 
 	// Mark pages dirty
-	b.pager.MarkDirty(page.ID())
-	b.pager.MarkDirty(sibling.ID())
+	b.pager.MarkDirty(left.ID())
 	b.pager.MarkDirty(parent.ID())
 
-	return nil
-}
+	// Free right page
+	b.pager.FreePage(right.ID())
 
-// redistributeInternal redistributes pointers between internal pages
-func (b *BTree) redistributeInternal(parent, page, sibling *Page, separatorIdx, targetCells uint16) error {
-	// Similar to leaf redistribution but handles child pointers
-	// For simplicity, we'll skip internal node redistribution for now
-	// and just merge them instead
-	return b.mergePage(parent, page, sibling, separatorIdx)
+	return true, nil
 }
 
-// mergePage merges page with sibling
-func (b *BTree) mergePage(parent, page, sibling *Page, separatorIdx uint16) error {
-	if page.IsLeaf() {
-		return b.mergeLeafPages(parent, page, sibling, separatorIdx)
+// redistributeLeaf splits the cells of left and right evenly between them
+// and moves their separator in parent to right's new first key
+func (b *BTree) redistributeLeaf(parent, left, right *Page, separatorIdx uint16) (bool, error) {
+	cells, err := leafCells(left, right)
+	if err != nil {
+		return false, err
 	}
-	return b.mergeInternalPages(parent, page, sibling, separatorIdx)
-}
-
-// mergeLeafPages merges two leaf pages
-func (b *BTree) mergeLeafPages(parent, page, sibling *Page, separatorIdx uint16) error {
-	// Collect all cells from both pages
-	var allCells []*Cell
-
-	pageCells := page.NumCells()
-	siblingCells := sibling.NumCells()
-
-	// Determine which page comes first
-	pageFirstCell, _ := page.CellAt(0)
-	siblingFirstCell, _ := sibling.CellAt(0)
-	pageFirst := bytes.Compare(pageFirstCell.Key, siblingFirstCell.Key) < 0
-
-	if pageFirst {
-		for i := uint16(0); i < pageCells; i++ {
-			cell, _ := page.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
-		}
-		for i := uint16(0); i < siblingCells; i++ {
-			cell, _ := sibling.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
-		}
-	} else {
-		for i := uint16(0); i < siblingCells; i++ {
-			cell, _ := sibling.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
-		}
-		for i := uint16(0); i < pageCells; i++ {
-			cell, _ := page.CellAt(i)
-			allCells = append(allCells, CopyCell(cell))
-		}
+	if len(cells) < 2 {
+		return false, nil
 	}
+	half := len(cells) / 2
 
-	// Clear page and add all cells
-	page.setNumCells(0)
-	page.setFreePtr(PageSize)
-
-	for _, cell := range allCells {
-		page.InsertCell(cell)
+	newLeft, ok := rebuild(left, cells[:half])
+	if !ok {
+		return false, nil
+	}
+	newRight, ok := rebuild(right, cells[half:])
+	if !ok {
+		return false, nil
 	}
 
-	// Update page links
-	page.SetRightPtr(sibling.RightPtr())
-
-	// Remove separator from parent
-	if err := parent.DeleteCell(separatorIdx); err != nil {
-		return err
+	// Replace the separator; a longer key may not fit in the parent
+	newParent := parent.Clone()
+	if err := newParent.DeleteCell(separatorIdx); err != nil {
+		return false, err
+	}
+	separator := &Cell{Key: cells[half].Key, Child: right.ID()}
+	if newParent, ok = rebuildInternal(newParent, separator); !ok {
+		return false, nil
 	}
 
-	// Free sibling page
-	b.pager.FreePage(sibling.ID())
+	left.copyFrom(newLeft)
+	right.copyFrom(newRight)
+	parent.copyFrom(newParent)
 
 	// Mark pages dirty
-	b.pager.MarkDirty(page.ID())
+	b.pager.MarkDirty(left.ID())
+	b.pager.MarkDirty(right.ID())
 	b.pager.MarkDirty(parent.ID())
 
-	// Check if parent needs rebalancing
-	if b.shouldMerge(parent) {
-		// Recursively merge parent
-		// For simplicity, we'll skip recursive merging for now
-	}
-
-	return nil
+	return true, nil
 }
 
-// mergeInternalPages merges two internal pages
-func (b *BTree) mergeInternalPages(parent, page, sibling *Page, separatorIdx uint16) error {
-	// For simplicity, we'll implement a basic version
-	// In production, this would handle pulling down the separator key
-	// and redistributing child pointers
-
-	// Skip internal node merging for now
-	return nil
+// rebuildInternal returns a compacted copy of an internal page with cell
+// added, or false if it doesn't fit. Deleted cells leave their space
+// behind until the page is rebuilt.
+func rebuildInternal(page *Page, cell *Cell) (*Page, bool) {
+	cells := make([]*Cell, 0, page.NumCells()+1)
+	for i := uint16(0); i < page.NumCells(); i++ {
+		key, child, err := page.internalCellAt(i)
+		if err != nil {
+			return nil, false
+		}
+		cells = append(cells, &Cell{Key: key, Child: child})
+	}
+	return rebuild(page, append(cells, cell))
 }
@@ -1,13 +1,16 @@
 package btree
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestPageMerge(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-merge-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-merge-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -76,7 +79,7 @@ func TestPageMerge(t *testing.T) {
 }
 
 func TestPageMergeWithReinsert(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-merge-reinsert-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-merge-reinsert-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -151,7 +154,7 @@ func TestPageMergeWithReinsert(t *testing.T) {
 }
 
 func TestMergeShouldNotAffectSmallDeletes(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-merge-small-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-merge-small-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -201,3 +204,291 @@ func TestMergeShouldNotAffectSmallDeletes(t *testing.T) {
 
 	t.Log("✓ Small delete successful without merge")
 }
+
+// newMergeTree returns an in-memory tree holding numKeys keys with values
+// of valueSize bytes, deep enough that the root's children are leaves
+func newMergeTree(t *testing.T, numKeys, valueSize int) *BTree {
+	t.Helper()
+	config := DefaultConfig("btree-merge")
+	config.InMemory = true
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	t.Cleanup(func() { btree.Close() })
+	value := make([]byte, valueSize)
+	for i := 0; i < numKeys; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%04d", i)), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	return btree
+}
+
+// rootChildren returns the children of the tree's root in key order:
+// its right pointer, then the child of each cell
+func rootChildren(t *testing.T, btree *BTree) (*Page, []uint32) {
+	t.Helper()
+	root, err := btree.pager.GetPage(btree.pager.RootPageID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.IsLeaf() {
+		t.Fatal("Root is a leaf")
+	}
+	children := []uint32{root.RightPtr()}
+	for i := uint16(0); i < root.NumCells(); i++ {
+		_, child, err := root.internalCellAt(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		children = append(children, child)
+	}
+	return root, children
+}
+
+// checkLeaves checks that the leaf chain, from the leftmost leaf, holds
+// exactly want's keys in order, and returns how many leaves it has
+func checkLeaves(t *testing.T, btree *BTree, want map[string]bool) int {
+	t.Helper()
+	id := btree.pager.RootPageID()
+	for {
+		page, err := btree.pager.GetPage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.IsLeaf() {
+			break
+		}
+		id = page.RightPtr()
+	}
+
+	var prev []byte
+	seen, leaves := 0, 0
+	for ; id != 0; leaves++ {
+		page, err := btree.pager.GetPage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint16(0); i < page.NumCells(); i++ {
+			cell, err := page.CellAt(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prev != nil && bytes.Compare(prev, cell.Key) >= 0 {
+				t.Fatalf("Leaf %d: %s after %s", id, cell.Key, prev)
+			}
+			if !want[string(cell.Key)] {
+				t.Fatalf("Leaf %d holds %s, which isn't in the tree", id, cell.Key)
+			}
+			prev = append(prev[:0], cell.Key...)
+			seen++
+		}
+		id = page.RightPtr()
+	}
+	if seen != len(want) {
+		t.Fatalf("Leaves hold %d keys, want %d", seen, len(want))
+	}
+	return leaves
+}
+
+// TestFindSibling tests that each leaf is paired with the adjacent child
+// of its parent, the right pointer being the leftmost
+func TestFindSibling(t *testing.T) {
+	btree := newMergeTree(t, 300, 100)
+	root, children := rootChildren(t, btree)
+	if len(children) < 3 {
+		t.Fatalf("Only %d leaves", len(children))
+	}
+
+	for i, child := range children {
+		leaf, err := btree.pager.GetPage(child)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, err := leaf.CellAt(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parentID, leftID, rightID, separatorIdx, err := btree.findSibling(child, first.Key)
+		if err != nil {
+			t.Fatalf("findSibling(%d): %v", child, err)
+		}
+		wantLeft, wantRight, wantIdx := children[max(i-1, 0)], child, uint16(max(i-1, 0))
+		if i == 0 {
+			wantLeft, wantRight = child, children[1]
+		}
+		if parentID != root.ID() || leftID != wantLeft || rightID != wantRight || separatorIdx != wantIdx {
+			t.Errorf("findSibling(child %d) = %d, %d, %d, %d; want %d, %d, %d, %d", i,
+				parentID, leftID, rightID, separatorIdx, root.ID(), wantLeft, wantRight, wantIdx)
+		}
+
+		left, err := btree.pager.GetPage(leftID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left.RightPtr() != rightID {
+			t.Errorf("Child %d: leaf %d links to %d, not its sibling %d", i, leftID, left.RightPtr(), rightID)
+		}
+	}
+}
+
+// TestMergeLeaves tests that an underfull leaf whose cells fit in its
+// sibling is merged into one page, keeping every key
+func TestMergeLeaves(t *testing.T) {
+	btree := newMergeTree(t, 300, 100)
+	_, children := rootChildren(t, btree)
+	want := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		want[fmt.Sprintf("key%04d", i)] = true
+	}
+	before := checkLeaves(t, btree, want)
+
+	// Empty the second leaf down to a few keys
+	leaf, err := btree.pager.GetPage(children[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := leafCells(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cell := range cells[2:] {
+		if err := btree.Delete(cell.Key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		delete(want, string(cell.Key))
+	}
+
+	if after := checkLeaves(t, btree, want); after != before-1 {
+		t.Errorf("%d leaves after emptying one, want %d", after, before-1)
+	}
+	for key := range want {
+		if _, err := btree.Get([]byte(key)); err != nil {
+			t.Fatalf("Get(%s) after merge: %v", key, err)
+		}
+	}
+}
+
+// TestRedistributeLeaves tests that an underfull leaf whose cells don't
+// fit in its sibling takes half their cells, and the separator between
+// them moves to the right leaf's new first key
+func TestRedistributeLeaves(t *testing.T) {
+	btree := newMergeTree(t, 100, 400)
+	want := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		want[fmt.Sprintf("key%04d", i)] = true
+	}
+
+	// Fill the second leaf, so it can't take the first's cells
+	_, children := rootChildren(t, btree)
+	right, err := btree.pager.GetPage(children[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := right.CellAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !right.IsFull(len(first.Key)+2, 400); i++ {
+		key := fmt.Sprintf("%s%02d", first.Key, i)
+		if err := btree.Put([]byte(key), make([]byte, 400)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = true
+	}
+	before := checkLeaves(t, btree, want)
+
+	// Delete from the first leaf until it's underfull
+	minCellsFloat := float64(MaxCellsPerPage) * MinFillFactor
+	minCells := uint16(minCellsFloat)
+	leaf, err := btree.pager.GetPage(children[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := leafCells(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cell := range cells {
+		underfull := leaf.NumCells() <= minCells
+		if err := btree.Delete(cell.Key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		delete(want, string(cell.Key))
+		if underfull {
+			break
+		}
+	}
+
+	if after := checkLeaves(t, btree, want); after != before {
+		t.Errorf("%d leaves after redistributing, want %d", after, before)
+	}
+	root, children := rootChildren(t, btree)
+	left, err := btree.pager.GetPage(children[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err = btree.pager.GetPage(children[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, m := left.NumCells(), right.NumCells(); n <= 1 || n+1 < m || m+1 < n {
+		t.Errorf("Leaves hold %d and %d cells, want them even", n, m)
+	}
+	first, err = right.CellAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	separator, _, err := root.internalCellAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(separator, first.Key) {
+		t.Errorf("Separator %s, want the right leaf's first key %s", separator, first.Key)
+	}
+}
+
+// TestDeleteEverything tests that deleting every key, in random order and
+// with values of random sizes, rebalances without losing or misplacing
+// one, and leaves a tree that can be filled again
+func TestDeleteEverything(t *testing.T) {
+	config := DefaultConfig("btree-delete-everything")
+	config.InMemory = true
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := btree.Put([]byte(key), make([]byte, rng.Intn(300))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = true
+	}
+
+	for i, n := range rng.Perm(2000) {
+		key := fmt.Sprintf("key%04d", n)
+		if err := btree.Delete([]byte(key)); err != nil {
+			t.Fatalf("Delete(%s) failed: %v", key, err)
+		}
+		delete(want, key)
+		if i%100 == 0 {
+			checkLeaves(t, btree, want)
+		}
+	}
+	checkLeaves(t, btree, want)
+
+	for i := 0; i < 2000; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%04d", i)), []byte("value")); err != nil {
+			t.Fatalf("Put after deleting everything failed: %v", err)
+		}
+		want[fmt.Sprintf("key%04d", i)] = true
+	}
+	checkLeaves(t, btree, want)
+}
@@ -3,11 +3,12 @@ package btree
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestMoreKeys(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-more-keys-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-more-keys-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
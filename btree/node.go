@@ -1,9 +1,5 @@
 package btree
 
-import (
-	"bytes"
-)
-
 // NodeHelper provides helper functions for B-tree node operations
 
 // SearchKey searches for a key in a page and returns the index
@@ -21,39 +17,17 @@ func GetChildPageID(page *Page, key []byte) (uint32, error) {
 		return 0, ErrCellNotFound
 	}
 
-	numCells := page.NumCells()
-
-	// Find the last cell where key >= cell.Key
-	// That cell's child contains the key
-	for i := uint16(0); i < numCells; i++ {
-		cell, err := page.CellAt(i)
-		if err != nil {
-			return 0, err
-		}
-
-		// If key >= cell.Key, check if this is the right cell
-		// We want the LAST cell where key >= cell.Key
-		if bytes.Compare(key, cell.Key) >= 0 {
-			// Check if there's a next cell
-			if i+1 < numCells {
-				nextCell, err := page.CellAt(i + 1)
-				if err == nil && bytes.Compare(key, nextCell.Key) >= 0 {
-					// key also >= next cell, continue searching
-					continue
-				}
-			}
-			// This is the right cell
-			return cell.Child, nil
-		}
+	// The last cell where key >= cell.Key, or the right pointer for keys
+	// less than the minimum
+	child, err := page.childFor(key)
+	if err != nil {
+		return 0, err
 	}
-
-	// Key < all cell keys, use right pointer (for keys less than minimum)
-	rightPtr := page.RightPtr()
-	if rightPtr == 0 {
+	if child == 0 {
 		return 0, ErrCellNotFound
 	}
 
-	return rightPtr, nil
+	return child, nil
 }
 
 // InsertIntoLeaf inserts a key-value pair into a leaf node
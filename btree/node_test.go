@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+// internalPage returns an internal page with cells key0010, key0020, ...
+// as many as fit, the child of key0010 being page 1, and so on; the right
+// pointer is page 1000
+func internalPage(t testing.TB) (*Page, int) {
+	page := NewPage(2, PageTypeInternal)
+	page.SetRightPtr(1000)
+	n := 0
+	for ; !page.IsFull(7, 0); n++ {
+		cell := &Cell{Key: []byte(fmt.Sprintf("key%04d", (n+1)*10)), Child: uint32(n + 1)}
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return page, n
+}
+
+func TestGetChildPageID(t *testing.T) {
+	page, n := internalPage(t)
+	btree := &BTree{}
+
+	// Below the first cell, on each cell, between cells and past the last
+	for k := 0; k <= (n+1)*10; k++ {
+		key := []byte(fmt.Sprintf("key%04d", k))
+		want := uint32(min(k/10, n))
+		if want == 0 {
+			want = 1000
+		}
+
+		child, err := GetChildPageID(page, key)
+		if err != nil || child != want {
+			t.Fatalf("GetChildPageID(%s) = %d, %v; want %d", key, child, err, want)
+		}
+		if child := btree.findChild(page, key); child != want {
+			t.Fatalf("findChild(%s) = %d, want %d", key, child, want)
+		}
+	}
+	if child, err := GetChildPageID(page, []byte("a")); err != nil || child != 1000 {
+		t.Errorf("GetChildPageID(a) = %d, %v; want the right pointer", child, err)
+	}
+
+	key := []byte("key0555")
+	allocs := testing.AllocsPerRun(100, func() {
+		btree.findChild(page, key)
+		GetChildPageID(page, key)
+	})
+	if allocs != 0 {
+		t.Errorf("Finding a child allocated %v times", allocs)
+	}
+}
+
+func BenchmarkFindChild(b *testing.B) {
+	page, n := internalPage(b)
+	btree := &BTree{}
+	keys := make([][]byte, 64)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%04d", i*n*10/len(keys)+5))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		btree.findChild(page, keys[i%len(keys)])
+	}
+}
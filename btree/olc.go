@@ -0,0 +1,97 @@
+package btree
+
+import "runtime"
+
+// Optimistic lock coupling: Get, Has and ConcurrentGet walk down the tree
+// without taking latches. Each page's latch version is read before the
+// page and checked after, along with its parent's once the child's
+// version is read; a ConcurrentPut having write-latched either meanwhile
+// restarts the walk. Readers then don't contend on the root's latch, and
+// only wait for the writers whose pages they read. Put and Delete change
+// pages under the tree lock, which readers hold for reading, so they need
+// no versions.
+//
+// A page read while it changes can be torn enough for its cell offsets to
+// point anywhere, so a panic reading it is also a conflict, if the version
+// shows it changed. Reads racing with writes are what makes this work, so
+// builds with the race detector take read latches instead (see
+// optimisticReads).
+
+// optimisticRetries is how many times an optimistic read restarts before
+// it takes read latches instead, so a page written to nonstop can't keep
+// a reader out
+const optimisticRetries = 8
+
+// readLeaf calls fn with the leaf key belongs in, and returns the number
+// of pages read to find it. Caller must hold b.mu for reading. With
+// optimistic set, the leaf is first found and read without latches, so fn
+// may see a page a ConcurrentPut is changing, and run again after a
+// restart: it must only copy out of the page, and its error is returned
+// only from a read that validated. Otherwise fn runs under the leaf's read
+// latch.
+func (b *BTree) readLeaf(key []byte, optimistic bool, fn func(leaf *Page) error) (int, error) {
+	if optimistic && optimisticReads {
+		for range optimisticRetries {
+			if pages, ok, err := b.readOptimistic(key, fn); ok {
+				return pages, err
+			}
+			runtime.Gosched()
+		}
+	}
+
+	leaf, latch, pages, err := b.latchLeaf(key)
+	if err != nil {
+		return pages, err
+	}
+	defer latch.Unlock(LatchRead)
+	return pages, fn(leaf)
+}
+
+// readOptimistic is one optimistic walk of readLeaf's, reporting false if
+// a write got in its way
+func (b *BTree) readOptimistic(key []byte, fn func(leaf *Page) error) (pages int, ok bool, err error) {
+	// The page being read, and its version
+	var latch *PageLatch
+	var version uint64
+	defer func() {
+		if r := recover(); r != nil {
+			if latch == nil || latch.validate(version) {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+
+	parent := b.latchManager.GetLatch(rootLatch)
+	parentVersion, ok := parent.readVersion()
+	if !ok {
+		return 0, false, nil
+	}
+	pageID := b.pager.RootPageID()
+	for pages = 1; ; pages++ {
+		latch = b.latchManager.GetLatch(pageID)
+		if version, ok = latch.readVersion(); !ok {
+			return pages, false, nil
+		}
+		// The parent unchanged, pageID is still the page for key
+		if !parent.validate(parentVersion) {
+			return pages, false, nil
+		}
+
+		page, err := b.pager.GetPage(pageID)
+		if err != nil {
+			// pageID may have come from a torn parent; the error only
+			// stands if neither page changed meanwhile
+			if !parent.validate(parentVersion) || !latch.validate(version) {
+				return pages, false, nil
+			}
+			return pages, true, err
+		}
+		if page.IsLeaf() {
+			err := fn(page)
+			return pages, latch.validate(version), err
+		}
+		pageID = b.findChild(page, key)
+		parent, parentVersion = latch, version
+	}
+}
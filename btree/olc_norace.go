@@ -0,0 +1,6 @@
+//go:build !race
+
+package btree
+
+// optimisticReads is whether reads are optimistic (see olc.go)
+const optimisticReads = true
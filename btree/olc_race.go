@@ -0,0 +1,8 @@
+//go:build race
+
+package btree
+
+// optimisticReads is off under the race detector, which rightly reports
+// the reads of pages being written that optimistic reads validate after
+// the fact
+const optimisticReads = false
@@ -0,0 +1,169 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLatchVersion tests that a write latch makes versions read before it
+// fail to validate, and that none can be read while it's held
+func TestLatchVersion(t *testing.T) {
+	var latch PageLatch
+	version, ok := latch.readVersion()
+	if !ok || !latch.validate(version) {
+		t.Fatal("Expected an unlatched page to validate")
+	}
+
+	latch.Lock(LatchRead)
+	latch.Unlock(LatchRead)
+	if !latch.validate(version) {
+		t.Error("A read latch invalidated an optimistic read")
+	}
+
+	latch.Lock(LatchWrite)
+	if _, ok := latch.readVersion(); ok {
+		t.Error("Read a version under a write latch")
+	}
+	latch.Unlock(LatchWrite)
+	if latch.validate(version) {
+		t.Error("A write latch left an optimistic read valid")
+	}
+	if _, ok := latch.readVersion(); !ok {
+		t.Error("No version to read after the write latch was released")
+	}
+}
+
+// TestOptimisticReadWaits tests that a Get of a page write-latched for
+// longer than its restarts take waits for the writer, and reads what it
+// wrote
+func TestOptimisticReadWaits(t *testing.T) {
+	config := DefaultConfig("btree-olc-wait")
+	config.InMemory = true
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	leaf, err := btree.findLeaf([]byte("key00000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latch := btree.latchManager.GetLatch(leaf.ID())
+	latch.Lock(LatchWrite)
+	done := make(chan []byte, 1)
+	go func() {
+		value, err := btree.Get([]byte("key00000"))
+		if err != nil {
+			t.Errorf("Get failed: %v", err)
+		}
+		done <- value
+	}()
+
+	// Other leaves read as usual meanwhile
+	if _, err := btree.Get([]byte("key00999")); err != nil {
+		t.Errorf("Get of another leaf failed: %v", err)
+	}
+	select {
+	case value := <-done:
+		t.Fatalf("Get read %q from a write-latched page", value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// As a ConcurrentPut would
+	if err := leaf.InsertCell(&Cell{Key: []byte("key00000"), Value: []byte("written")}); err != nil {
+		t.Fatal(err)
+	}
+	latch.Unlock(LatchWrite)
+	if value := <-done; string(value) != "written" {
+		t.Errorf("Get = %q, want the value written", value)
+	}
+}
+
+// TestOptimisticReadsConcurrentWrites runs optimistic Gets and Has of
+// keys that ConcurrentPut writers keep rewriting, with values of changing
+// length that move cells around and split leaves. A read of a page torn
+// by a write must be redone, so every value read is whole.
+func TestOptimisticReadsConcurrentWrites(t *testing.T) {
+	config := DefaultConfig("btree-olc-stress")
+	config.InMemory = true
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	const numKeys = 500
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	// Each value is its key repeated, so a torn one shows
+	value := func(i, round int) []byte {
+		return bytes.Repeat(key(i), 1+(i+round)%20)
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := btree.Put(key(i), value(i, 0)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 1; !stop.Load(); round++ {
+				for i := w; i < numKeys && !stop.Load(); i += 2 {
+					if err := btree.ConcurrentPut(key(i), value(i, round)); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := r; !stop.Load(); n++ {
+				i := n * 7 % numKeys
+				got, err := btree.Get(key(i))
+				if err != nil {
+					errs <- fmt.Errorf("Get %s: %w", key(i), err)
+					return
+				}
+				if len(got) == 0 || strings.ReplaceAll(string(got), string(key(i)), "") != "" {
+					errs <- fmt.Errorf("Get %s = torn value %q", key(i), got)
+					return
+				}
+				if found, err := btree.Has(key(i)); err != nil || !found {
+					errs <- fmt.Errorf("Has %s = %v, %v", key(i), found, err)
+					return
+				}
+			}
+		}(r)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := btree.Stats().CorruptionCount; n != 0 {
+		t.Errorf("Torn reads counted as %d corruptions", n)
+	}
+}
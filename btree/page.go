@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 const (
@@ -59,6 +62,21 @@ type Page struct {
 	data     [PageSize]byte
 	pageType byte
 	dirty    bool
+	compare  func(a, b []byte) int // Key order (nil = bytewise)
+
+	// The bytes changed since the page was last logged to the WAL, so
+	// only they are logged
+	changes    [maxPageSpans]pageSpan // Sorted, apart
+	numChanges int
+}
+
+// maxPageSpans is how many changed spans a page tracks; past it, a change
+// is joined to the span nearest it
+const maxPageSpans = 8
+
+// pageSpan is the bytes [start, end) of a page
+type pageSpan struct {
+	start, end uint16
 }
 
 // NewPage creates a new page with the specified type
@@ -74,6 +92,9 @@ func NewPage(id uint32, pageType byte) *Page {
 	binary.BigEndian.PutUint32(p.data[HeaderOffsetRightPtr:], 0)
 	binary.BigEndian.PutUint16(p.data[HeaderOffsetFreePtr:], PageSize)
 	p.data[HeaderOffsetVersion] = PageFormatV2 // Use new varint format by default
+
+	// None of it is on disk yet
+	p.markChanged(0, PageSize)
 	return p
 }
 
@@ -88,9 +109,27 @@ func LoadPage(id uint32, data []byte) (*Page, error) {
 	}
 	copy(p.data[:], data)
 	p.pageType = p.data[HeaderOffsetType]
+
+	if p.pageType != PageTypeLeaf && p.pageType != PageTypeInternal {
+		return nil, corruptPage(id, "invalid page type %d", p.pageType)
+	}
+	if p.cellDirOffset(p.NumCells()) > PageSize {
+		return nil, corruptPage(id, "%d cells don't fit in a page", p.NumCells())
+	}
+	// Cells are written below the free pointer, and the directory grows up
+	// to it
+	if free := int(p.freePtr()); free > PageSize || free < p.cellDirOffset(p.NumCells()) {
+		return nil, corruptPage(id, "free pointer %d out of range", free)
+	}
 	return p, nil
 }
 
+// corruptPage returns an error matching common.ErrCorruption for damage
+// found in a page
+func corruptPage(id uint32, format string, args ...any) error {
+	return fmt.Errorf("%w: page %d: %s", common.ErrCorruption, id, fmt.Sprintf(format, args...))
+}
+
 // ID returns the page ID
 func (p *Page) ID() uint32 {
 	return p.id
@@ -134,6 +173,7 @@ func (p *Page) NumCells() uint16 {
 // setNumCells sets the number of cells
 func (p *Page) setNumCells(n uint16) {
 	binary.BigEndian.PutUint16(p.data[HeaderOffsetNumCells:], n)
+	p.markChanged(HeaderOffsetNumCells, HeaderOffsetNumCells+2)
 }
 
 // RightPtr returns the right pointer (for internal nodes and leaf linking)
@@ -144,6 +184,7 @@ func (p *Page) RightPtr() uint32 {
 // SetRightPtr sets the right pointer
 func (p *Page) SetRightPtr(ptr uint32) {
 	binary.BigEndian.PutUint32(p.data[HeaderOffsetRightPtr:], ptr)
+	p.markChanged(HeaderOffsetRightPtr, HeaderOffsetRightPtr+4)
 	p.dirty = true
 }
 
@@ -155,6 +196,7 @@ func (p *Page) freePtr() uint16 {
 // setFreePtr sets the free pointer
 func (p *Page) setFreePtr(ptr uint16) {
 	binary.BigEndian.PutUint16(p.data[HeaderOffsetFreePtr:], ptr)
+	p.markChanged(HeaderOffsetFreePtr, HeaderOffsetFreePtr+2)
 }
 
 // Cell represents a single key-value pair or key-pointer pair
@@ -179,6 +221,7 @@ func (p *Page) getCellOffset(n uint16) uint16 {
 func (p *Page) setCellOffset(n uint16, offset uint16) {
 	dirOffset := p.cellDirOffset(n)
 	binary.BigEndian.PutUint16(p.data[dirOffset:], offset)
+	p.markChanged(dirOffset, dirOffset+CellDirEntrySize)
 }
 
 // CellAt returns the cell at the specified index
@@ -188,10 +231,17 @@ func (p *Page) CellAt(index uint16) (*Cell, error) {
 	}
 
 	offset := p.getCellOffset(index)
+	var cell *Cell
+	var err error
 	if p.IsLeaf() {
-		return p.parseLeafCell(int(offset))
+		cell, err = p.parseLeafCell(int(offset))
+	} else {
+		cell, err = p.parseInternalCell(int(offset))
+	}
+	if err != nil {
+		return nil, corruptPage(p.id, "cell %d: %v", index, err)
 	}
-	return p.parseInternalCell(int(offset))
+	return cell, nil
 }
 
 // parseLeafCell parses a leaf cell at the given offset
@@ -297,6 +347,9 @@ func (p *Page) parseInternalCell(offset int) (*Cell, error) {
 	}
 
 	// Child page ID is still 4 bytes (fixed)
+	if offset+n+4 > PageSize {
+		return nil, errors.New("invalid cell offset")
+	}
 	child := binary.BigEndian.Uint32(p.data[offset+n:])
 
 	headerSize := n + 4
@@ -315,6 +368,43 @@ func (p *Page) parseInternalCell(offset int) (*Cell, error) {
 	return cell, nil
 }
 
+// internalCellAt returns the key of the internal cell at the specified
+// index as a slice of the page, which is only valid while the page is
+// unchanged, and its child
+func (p *Page) internalCellAt(index uint16) (key []byte, child uint32, err error) {
+	offset := int(p.getCellOffset(index))
+
+	var keySize, headerSize int
+	if p.Version() == PageFormatV1 {
+		if offset+InternalCellHeaderSizeV1 > PageSize {
+			return nil, 0, corruptPage(p.id, "cell %d: invalid cell offset", index)
+		}
+		keySize = int(binary.BigEndian.Uint16(p.data[offset:]))
+		child = binary.BigEndian.Uint32(p.data[offset+2:])
+		headerSize = InternalCellHeaderSizeV1
+	} else {
+		if offset+InternalCellHeaderSizeV2Min > PageSize {
+			return nil, 0, corruptPage(p.id, "cell %d: invalid cell offset", index)
+		}
+		size, n := uvarint16(p.data[offset:])
+		if n <= 0 {
+			return nil, 0, corruptPage(p.id, "cell %d: invalid key size varint", index)
+		}
+		if offset+n+4 > PageSize {
+			return nil, 0, corruptPage(p.id, "cell %d: invalid cell offset", index)
+		}
+		keySize = int(size)
+		child = binary.BigEndian.Uint32(p.data[offset+n:])
+		headerSize = n + 4
+	}
+
+	start := offset + headerSize
+	if start+keySize > PageSize {
+		return nil, 0, corruptPage(p.id, "cell %d: invalid cell size", index)
+	}
+	return p.data[start : start+keySize], child, nil
+}
+
 // cellSize returns the size of a cell (header + key + value)
 func (p *Page) cellSize(keySize, valueSize int) int {
 	version := p.Version()
@@ -348,7 +438,9 @@ func (p *Page) IsFull(keySize, valueSize int) bool {
 	return freeSpace < cellSize
 }
 
-// InsertCell inserts a cell at the appropriate position (maintains sort order)
+// InsertCell inserts a cell at the appropriate position (maintains sort
+// order), or replaces the cell for the same key. A page without room is
+// left as it was, and ErrPageFull returned.
 func (p *Page) InsertCell(cell *Cell) error {
 	keySize := len(cell.Key)
 	valueSize := 0
@@ -356,10 +448,6 @@ func (p *Page) InsertCell(cell *Cell) error {
 		valueSize = len(cell.Value)
 	}
 
-	if p.IsFull(keySize, valueSize) {
-		return ErrPageFull
-	}
-
 	// Find insertion position using binary search
 	numCells := p.NumCells()
 	insertPos := p.searchCell(cell.Key)
@@ -369,6 +457,10 @@ func (p *Page) InsertCell(cell *Cell) error {
 		return p.updateCell(uint16(insertPos), cell)
 	}
 
+	if p.IsFull(keySize, valueSize) {
+		return ErrPageFull
+	}
+
 	// Allocate space for the new cell (grows backward from end)
 	cellSize := p.cellSize(keySize, valueSize)
 	newFreePtr := p.freePtr() - uint16(cellSize)
@@ -395,14 +487,81 @@ func (p *Page) InsertCell(cell *Cell) error {
 	return nil
 }
 
-// updateCell updates an existing cell at the given position
+// updateCell replaces the cell at index with cell, for the same key. The
+// new cell is written over the old one if it's no bigger, and into the
+// free space otherwise, compacting the page first to take back the space
+// replaced and deleted cells left behind if there isn't enough. If it
+// doesn't fit even then, the page is left as it was, old cell included,
+// and ErrPageFull returned, for the caller to split the page.
 func (p *Page) updateCell(index uint16, cell *Cell) error {
-	// For simplicity, we'll delete and re-insert
-	// A more efficient implementation would update in-place if sizes match
-	if err := p.DeleteCell(index); err != nil {
+	oldSize, err := p.cellSizeAt(index)
+	if err != nil {
 		return err
 	}
-	return p.InsertCell(cell)
+	valueSize := 0
+	if p.IsLeaf() {
+		valueSize = len(cell.Value)
+	}
+	size := p.cellSize(len(cell.Key), valueSize)
+
+	offset := p.getCellOffset(index)
+	if size > oldSize {
+		if int(p.freePtr())-p.cellDirOffset(p.NumCells()) < size {
+			return p.compactWith(index, cell)
+		}
+		offset = p.freePtr() - uint16(size)
+		p.setFreePtr(offset)
+		p.setCellOffset(index, offset)
+	}
+
+	if p.IsLeaf() {
+		p.writeLeafCell(int(offset), cell)
+	} else {
+		p.writeInternalCell(int(offset), cell)
+	}
+	p.dirty = true
+	return nil
+}
+
+// compactWith rewrites the page with only its live cells, cell replacing
+// the one at index, or returns ErrPageFull, changing nothing, if they
+// don't fit
+func (p *Page) compactWith(index uint16, cell *Cell) error {
+	cells := make([]*Cell, p.NumCells())
+	for i := range cells {
+		if uint16(i) == index {
+			cells[i] = cell
+			continue
+		}
+		c, err := p.CellAt(uint16(i))
+		if err != nil {
+			return err
+		}
+		cells[i] = c
+	}
+	compacted, ok := rebuild(p, cells)
+	if !ok {
+		return ErrPageFull
+	}
+	p.copyFrom(compacted)
+	p.dirty = true
+	return nil
+}
+
+// cellSizeAt returns the size of the cell at index in the page
+func (p *Page) cellSizeAt(index uint16) (int, error) {
+	if p.IsLeaf() {
+		key, value, err := p.leafEntryAt(index)
+		if err != nil {
+			return 0, err
+		}
+		return p.cellSize(len(key), len(value)), nil
+	}
+	key, _, err := p.internalCellAt(index)
+	if err != nil {
+		return 0, err
+	}
+	return p.cellSize(len(key), 0), nil
 }
 
 // writeLeafCell writes a leaf cell at the specified offset
@@ -415,6 +574,7 @@ func (p *Page) writeLeafCell(offset int, cell *Cell) {
 		binary.BigEndian.PutUint16(p.data[offset+2:], uint16(len(cell.Value)))
 		copy(p.data[offset+LeafCellHeaderSizeV1:], cell.Key)
 		copy(p.data[offset+LeafCellHeaderSizeV1+len(cell.Key):], cell.Value)
+		p.markChanged(offset, offset+LeafCellHeaderSizeV1+len(cell.Key)+len(cell.Value))
 		return
 	}
 
@@ -424,6 +584,7 @@ func (p *Page) writeLeafCell(offset int, cell *Cell) {
 	headerSize := n1 + n2
 	copy(p.data[offset+headerSize:], cell.Key)
 	copy(p.data[offset+headerSize+len(cell.Key):], cell.Value)
+	p.markChanged(offset, offset+headerSize+len(cell.Key)+len(cell.Value))
 }
 
 // writeInternalCell writes an internal cell at the specified offset
@@ -435,6 +596,7 @@ func (p *Page) writeInternalCell(offset int, cell *Cell) {
 		binary.BigEndian.PutUint16(p.data[offset:], uint16(len(cell.Key)))
 		binary.BigEndian.PutUint32(p.data[offset+2:], cell.Child)
 		copy(p.data[offset+InternalCellHeaderSizeV1:], cell.Key)
+		p.markChanged(offset, offset+InternalCellHeaderSizeV1+len(cell.Key))
 		return
 	}
 
@@ -443,6 +605,15 @@ func (p *Page) writeInternalCell(offset int, cell *Cell) {
 	binary.BigEndian.PutUint32(p.data[offset+n:], cell.Child)
 	headerSize := n + 4
 	copy(p.data[offset+headerSize:], cell.Key)
+	p.markChanged(offset, offset+headerSize+len(cell.Key))
+}
+
+// compareKeys orders two keys by the page's comparator
+func (p *Page) compareKeys(a, b []byte) int {
+	if p.compare == nil {
+		return bytes.Compare(a, b)
+	}
+	return p.compare(a, b)
 }
 
 // SearchCell performs binary search for a key
@@ -454,12 +625,12 @@ func (p *Page) searchCell(key []byte) int {
 
 	for left < right {
 		mid := (left + right) / 2
-		cell, err := p.CellAt(uint16(mid))
+		cellKey, err := p.keyAt(uint16(mid))
 		if err != nil {
 			return left // Error case, insert at current position
 		}
 
-		cmp := bytes.Compare(key, cell.Key)
+		cmp := p.compareKeys(key, cellKey)
 		if cmp == 0 {
 			return -(mid + 1) // Found exact match
 		} else if cmp < 0 {
@@ -472,6 +643,42 @@ func (p *Page) searchCell(key []byte) int {
 	return left // Not found, return insertion position
 }
 
+// keyAt returns the key of the cell at index, in a leaf or internal page,
+// as a slice of the page, parsing nothing else
+func (p *Page) keyAt(index uint16) ([]byte, error) {
+	if p.IsLeaf() {
+		return p.leafKeyAt(index)
+	}
+	key, _, err := p.internalCellAt(index)
+	return key, err
+}
+
+// childFor returns the child of an internal page that key belongs in: the
+// child of the last cell whose key is at most key, found by binary
+// search, or the right pointer if key sorts before every cell
+func (p *Page) childFor(key []byte) (uint32, error) {
+	// The number of cells whose keys are at most key
+	left, right := 0, int(p.NumCells())
+	for left < right {
+		mid := (left + right) / 2
+		cellKey, err := p.keyAt(uint16(mid))
+		if err != nil {
+			return 0, err
+		}
+		if p.compareKeys(key, cellKey) < 0 {
+			right = mid
+		} else {
+			left = mid + 1
+		}
+	}
+
+	if left == 0 {
+		return p.RightPtr(), nil
+	}
+	_, child, err := p.internalCellAt(uint16(left - 1))
+	return child, err
+}
+
 // DeleteCell removes a cell at the specified index
 func (p *Page) DeleteCell(index uint16) error {
 	numCells := p.NumCells()
@@ -506,7 +713,149 @@ func (p *Page) Clone() *Page {
 		id:       p.id,
 		pageType: p.pageType,
 		dirty:    p.dirty,
+		compare:  p.compare,
 	}
 	copy(clone.data[:], p.data[:])
+	clone.changes, clone.numChanges = p.changes, p.numChanges
 	return clone
 }
+
+// copyFrom overwrites the page with src's contents
+func (p *Page) copyFrom(src *Page) {
+	copy(p.data[:], src.data[:])
+	p.markChanged(0, PageSize)
+}
+
+// markChanged notes that the page's bytes [start, end) changed. Spans
+// closer than a span header apart are joined, since logging the bytes
+// between costs no more than logging them apart.
+func (p *Page) markChanged(start, end int) {
+	span := pageSpan{uint16(start), uint16(end)}
+	spans := p.changes[:p.numChanges]
+
+	// spans[i:j] are those span overlaps or comes near
+	i := 0
+	for i < len(spans) && int(spans[i].end)+walSpanHeaderSize < start {
+		i++
+	}
+	j := i
+	for j < len(spans) && int(spans[j].start) <= end+walSpanHeaderSize {
+		j++
+	}
+	if i == j && len(spans) == maxPageSpans {
+		// No room for another: take in the nearest
+		if j == len(spans) || i > 0 && start-int(spans[i-1].end) < int(spans[j].start)-end {
+			i--
+		} else {
+			j++
+		}
+	}
+	if i < j {
+		span.start = min(span.start, spans[i].start)
+		span.end = max(span.end, spans[j-1].end)
+	}
+
+	n := copy(p.changes[i+1:], spans[j:])
+	p.changes[i] = span
+	p.numChanges = i + 1 + n
+}
+
+// changed returns the spans changed since the page was last logged
+func (p *Page) changed() []pageSpan {
+	return p.changes[:p.numChanges]
+}
+
+// logged forgets the page's changes, once they are in the WAL
+func (p *Page) logged() {
+	p.numChanges = 0
+}
+
+// hasKey reports whether a leaf page holds key
+func (p *Page) hasKey(key []byte) (bool, error) {
+	_, found, err := p.leafSearch(key)
+	return found, err
+}
+
+// leafValue returns the value of key in a leaf page as a slice of the
+// page, which is only valid while the page is unchanged, or
+// common.ErrKeyNotFound
+func (p *Page) leafValue(key []byte) ([]byte, error) {
+	index, found, err := p.leafSearch(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, common.ErrKeyNotFound
+	}
+	_, value, err := p.leafEntryAt(uint16(index))
+	return value, err
+}
+
+// leafSearch finds key in a leaf page by binary search over keys read in
+// place (see leafEntryAt), so unlike searchCell it copies nothing. It
+// returns key's index, or the index it would be inserted at if not found.
+func (p *Page) leafSearch(key []byte) (int, bool, error) {
+	left, right := 0, int(p.NumCells())
+	for left < right {
+		mid := (left + right) / 2
+		cellKey, err := p.leafKeyAt(uint16(mid))
+		if err != nil {
+			return 0, false, err
+		}
+
+		cmp := p.compareKeys(key, cellKey)
+		if cmp == 0 {
+			return mid, true, nil
+		} else if cmp < 0 {
+			right = mid
+		} else {
+			left = mid + 1
+		}
+	}
+	return left, false, nil
+}
+
+// leafKeyAt returns the key of the leaf cell at the specified index as a
+// slice of the page, which is only valid while the page is unchanged
+func (p *Page) leafKeyAt(index uint16) ([]byte, error) {
+	key, _, err := p.leafEntryAt(index)
+	return key, err
+}
+
+// leafEntryAt returns the key and value of the leaf cell at the specified
+// index as slices of the page, which are only valid while the page is
+// unchanged
+func (p *Page) leafEntryAt(index uint16) (key, value []byte, err error) {
+	offset := int(p.getCellOffset(index))
+
+	var keySize, valueSize, headerSize int
+	if p.Version() == PageFormatV1 {
+		if offset+LeafCellHeaderSizeV1 > PageSize {
+			return nil, nil, corruptPage(p.id, "cell %d: invalid cell offset", index)
+		}
+		keySize = int(binary.BigEndian.Uint16(p.data[offset:]))
+		valueSize = int(binary.BigEndian.Uint16(p.data[offset+2:]))
+		headerSize = LeafCellHeaderSizeV1
+	} else {
+		if offset+LeafCellHeaderSizeV2Min > PageSize {
+			return nil, nil, corruptPage(p.id, "cell %d: invalid cell offset", index)
+		}
+		size, n1 := uvarint16(p.data[offset:])
+		if n1 <= 0 {
+			return nil, nil, corruptPage(p.id, "cell %d: invalid key size varint", index)
+		}
+		vsize, n2 := uvarint16(p.data[offset+n1:])
+		if n2 <= 0 {
+			return nil, nil, corruptPage(p.id, "cell %d: invalid value size varint", index)
+		}
+		keySize = int(size)
+		valueSize = int(vsize)
+		headerSize = n1 + n2
+	}
+
+	start := offset + headerSize
+	if start+keySize+valueSize > PageSize {
+		return nil, nil, corruptPage(p.id, "cell %d: invalid cell size", index)
+	}
+	return p.data[start : start+keySize], p.data[start+keySize : start+keySize+valueSize], nil
+}
@@ -86,6 +86,48 @@ func TestPageV1Compatibility(t *testing.T) {
 	}
 }
 
+// TestPageSearchConsistency checks the page's binary searches against a
+// linear scan of its cells, for keys present, absent and past either end
+func TestPageSearchConsistency(t *testing.T) {
+	for _, version := range []byte{PageFormatV1, PageFormatV2} {
+		page := NewPage(1, PageTypeLeaf)
+		page.data[HeaderOffsetVersion] = version
+		for i := 0; i < 40; i += 2 {
+			cell := &Cell{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte("value")}
+			if err := page.InsertCell(cell); err != nil {
+				t.Fatalf("Failed to insert cell: %v", err)
+			}
+		}
+
+		for i := -1; i <= 41; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			want, found := 0, false
+			for ; want < int(page.NumCells()); want++ {
+				cell, err := page.CellAt(uint16(want))
+				if err != nil {
+					t.Fatalf("Failed to read cell %d: %v", want, err)
+				}
+				if c := page.compareKeys(key, cell.Key); c <= 0 {
+					found = c == 0
+					break
+				}
+			}
+
+			index := page.searchCell(key)
+			if found && index != -(want+1) || !found && index != want {
+				t.Errorf("V%d: searchCell(%s) = %d, want cell %d found=%v", version, key, index, want, found)
+			}
+			if got := page.lowerBound(key); got != want {
+				t.Errorf("V%d: lowerBound(%s) = %d, want %d", version, key, got, want)
+			}
+			got, gotFound, err := page.leafSearch(key)
+			if err != nil || got != want || gotFound != found {
+				t.Errorf("V%d: leafSearch(%s) = %d, %v, %v, want %d, %v", version, key, got, gotFound, err, want, found)
+			}
+		}
+	}
+}
+
 func TestPageV2SpaceSavings(t *testing.T) {
 	// Create two pages with same data, one V1 and one V2
 	pageV1 := NewPage(1, PageTypeLeaf)
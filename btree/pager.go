@@ -1,21 +1,30 @@
 package btree
 
 import (
+	"bytes"
 	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"sync"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
+// minCachedPages is the floor the cache is never shrunk below to meet a
+// memory budget, so pages held by an in-flight operation stay resident
+const minCachedPages = 64
+
 const (
 	// Metadata page (page 0) layout
-	MetadataPageID        = 0
-	MetadataOffsetMagic   = 0  // 4 bytes
-	MetadataOffsetRoot    = 4  // 4 bytes
-	MetadataOffsetNumPage = 8  // 4 bytes
-	MetadataOffsetFreeList = 12 // 4 bytes
+	MetadataPageID           = 0
+	MetadataOffsetMagic      = 0            // 4 bytes
+	MetadataOffsetRoot       = 4            // 4 bytes
+	MetadataOffsetNumPage    = 8            // 4 bytes
+	MetadataOffsetFreeList   = 12           // 4 bytes
+	MetadataOffsetComparator = 16           // 2-byte length + name (empty = bytewise)
+	MetadataOffsetNumKeys    = PageSize - 8 // 8 bytes: key count + 1 (0 = unknown)
 
 	MetadataMagic = 0x42545245 // "BTRE" in hex
 )
@@ -31,27 +40,37 @@ type Metadata struct {
 	RootPageID  uint32
 	NumPages    uint32
 	FreeListPtr uint32
+	Comparator  string // Name of the key comparator ("" in older files)
+
+	// NumKeys is the number of keys as of the last checkpoint, or -1 if
+	// unknown: in files written before it was recorded, and after a WAL
+	// replay, which changes keys without counting them
+	NumKeys int64
 }
 
 // Pager manages page I/O and caching
 type Pager struct {
-	file      *os.File
+	file      common.File
 	mu        sync.RWMutex
-	cache     map[uint32]*Page           // Page cache
-	lru       *list.List                 // LRU list for eviction
-	lruMap    map[uint32]*list.Element   // Quick lookup for LRU elements
-	cacheSize int                        // Max pages in cache
-	dirty     map[uint32]bool            // Track dirty pages
+	cache     map[uint32]*Page         // Page cache
+	lru       *list.List               // LRU list for eviction
+	lruMap    map[uint32]*list.Element // Quick lookup for LRU elements
+	cacheSize int                      // Max pages in cache
+	dirty     map[uint32]bool          // Track dirty pages
+	pins      map[uint32]int           // Pages a writer is changing, never evicted
 	metadata  *Metadata
 	closed    bool
-	wal       *WAL                       // Write-Ahead Log (optional)
+	wal       *WAL                     // Write-Ahead Log (optional)
+	memory    *common.MemoryAccountant // Charged per cached page (optional)
+	walErr    common.LastError         // Of the latest WAL write, for Health
+	compare   func(a, b []byte) int    // Key order, stamped on every page
 
 	// Statistics
 	stats struct {
-		pageWrites    int64 // Number of page writes to disk
-		pageReads     int64 // Number of page reads from disk
-		cacheHits     int64 // Number of cache hits
-		bytesWritten  int64 // Total bytes written to disk (pages)
+		pageWrites   int64 // Number of page writes to disk
+		pageReads    int64 // Number of page reads from disk
+		cacheHits    int64 // Number of cache hits
+		bytesWritten int64 // Total bytes written to disk (pages)
 	}
 }
 
@@ -62,23 +81,48 @@ type lruEntry struct {
 
 // NewPager creates a new pager
 func NewPager(filename string, cacheSize int) (*Pager, error) {
+	return NewPagerWithComparator(filename, cacheSize, nil)
+}
+
+// NewPagerWithComparator creates a pager whose keys are ordered by
+// comparator (nil = bytewise). A new database records the comparator's
+// name; an existing one must have been created with the same comparator.
+func NewPagerWithComparator(filename string, cacheSize int, comparator common.Comparator) (*Pager, error) {
+	return openPager(common.OSFS{}, filename, cacheSize, comparator)
+}
+
+// openPager opens or creates a database file in fs
+func openPager(fs common.FS, filename string, cacheSize int, comparator common.Comparator) (*Pager, error) {
+	name := common.ComparatorName(comparator)
+	if len(name) > MetadataOffsetNumKeys-MetadataOffsetComparator-2 {
+		return nil, fmt.Errorf("comparator name too long (%d bytes)", len(name))
+	}
+
 	// Try to open existing file
-	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	file, err := fs.OpenFile(filename, os.O_RDWR, 0644)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return nil, err
 		}
 		// Create new file
-		return createPager(filename, cacheSize)
+		return createPager(fs, filename, cacheSize, comparator)
 	}
 
 	// Load existing database
-	return loadPager(file, cacheSize)
+	return loadPager(file, cacheSize, comparator)
+}
+
+// comparatorFunc returns the compare function for comparator
+func comparatorFunc(comparator common.Comparator) func(a, b []byte) int {
+	if common.IsBytewise(comparator) {
+		return bytes.Compare
+	}
+	return comparator.Compare
 }
 
 // createPager creates a new pager with a fresh database
-func createPager(filename string, cacheSize int) (*Pager, error) {
-	file, err := os.Create(filename)
+func createPager(fs common.FS, filename string, cacheSize int, comparator common.Comparator) (*Pager, error) {
+	file, err := fs.Create(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -90,18 +134,22 @@ func createPager(filename string, cacheSize int) (*Pager, error) {
 		lruMap:    make(map[uint32]*list.Element),
 		cacheSize: cacheSize,
 		dirty:     make(map[uint32]bool),
+		pins:      make(map[uint32]int),
+		compare:   comparatorFunc(comparator),
 		metadata: &Metadata{
 			Magic:       MetadataMagic,
 			RootPageID:  1, // Root starts at page 1
 			NumPages:    2, // Page 0 (metadata) + Page 1 (root)
 			FreeListPtr: 0, // No free pages initially
+			Comparator:  common.ComparatorName(comparator),
+			NumKeys:     0, // No keys yet
 		},
 	}
 
 	// Write metadata page
 	if err := pager.writeMetadata(); err != nil {
 		file.Close()
-		os.Remove(filename)
+		fs.Remove(filename)
 		return nil, err
 	}
 
@@ -109,7 +157,15 @@ func createPager(filename string, cacheSize int) (*Pager, error) {
 	rootPage := NewPage(1, PageTypeLeaf)
 	if err := pager.writePage(rootPage); err != nil {
 		file.Close()
-		os.Remove(filename)
+		fs.Remove(filename)
+		return nil, err
+	}
+
+	// A crash before the first checkpoint must still leave a database
+	// that opens
+	if err := file.Sync(); err != nil {
+		file.Close()
+		fs.Remove(filename)
 		return nil, err
 	}
 
@@ -117,7 +173,7 @@ func createPager(filename string, cacheSize int) (*Pager, error) {
 }
 
 // loadPager loads an existing database
-func loadPager(file *os.File, cacheSize int) (*Pager, error) {
+func loadPager(file common.File, cacheSize int, comparator common.Comparator) (*Pager, error) {
 	pager := &Pager{
 		file:      file,
 		cache:     make(map[uint32]*Page),
@@ -125,6 +181,8 @@ func loadPager(file *os.File, cacheSize int) (*Pager, error) {
 		lruMap:    make(map[uint32]*list.Element),
 		cacheSize: cacheSize,
 		dirty:     make(map[uint32]bool),
+		pins:      make(map[uint32]int),
+		compare:   comparatorFunc(comparator),
 	}
 
 	// Read metadata
@@ -134,6 +192,16 @@ func loadPager(file *os.File, cacheSize int) (*Pager, error) {
 		return nil, err
 	}
 
+	// Files written before the comparator was recorded are bytewise
+	stored := metadata.Comparator
+	if stored == "" {
+		stored = common.BytewiseComparator.Name()
+	}
+	if name := common.ComparatorName(comparator); stored != name {
+		file.Close()
+		return nil, fmt.Errorf("%w: database has %q, config has %q", common.ErrComparatorMismatch, stored, name)
+	}
+
 	pager.metadata = metadata
 	return pager, nil
 }
@@ -160,6 +228,20 @@ func (p *Pager) readMetadata() (*Metadata, error) {
 		return nil, ErrInvalidDatabase
 	}
 
+	nameSize := int(binary.BigEndian.Uint16(data[MetadataOffsetComparator:]))
+	nameStart := MetadataOffsetComparator + 2
+	if nameStart+nameSize > PageSize {
+		return nil, ErrInvalidDatabase
+	}
+	meta.Comparator = string(data[nameStart : nameStart+nameSize])
+
+	// Stored plus one, so older files' zeros read as unknown. A name
+	// running into it is from before it was stored too.
+	meta.NumKeys = int64(binary.BigEndian.Uint64(data[MetadataOffsetNumKeys:])) - 1
+	if nameStart+nameSize > MetadataOffsetNumKeys {
+		meta.NumKeys = -1
+	}
+
 	return meta, nil
 }
 
@@ -170,6 +252,9 @@ func (p *Pager) writeMetadata() error {
 	binary.BigEndian.PutUint32(data[MetadataOffsetRoot:], p.metadata.RootPageID)
 	binary.BigEndian.PutUint32(data[MetadataOffsetNumPage:], p.metadata.NumPages)
 	binary.BigEndian.PutUint32(data[MetadataOffsetFreeList:], p.metadata.FreeListPtr)
+	binary.BigEndian.PutUint16(data[MetadataOffsetComparator:], uint16(len(p.metadata.Comparator)))
+	copy(data[MetadataOffsetComparator+2:], p.metadata.Comparator)
+	binary.BigEndian.PutUint64(data[MetadataOffsetNumKeys:], uint64(p.metadata.NumKeys+1))
 
 	_, err := p.file.WriteAt(data, 0)
 
@@ -186,7 +271,36 @@ func (p *Pager) writeMetadata() error {
 func (p *Pager) GetPage(pageID uint32) (*Page, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	return p.getPage(pageID)
+}
+
+// PinPage is GetPage for a writer about to change the page under a write
+// latch: the page stays in the cache until Unpin, so other goroutines'
+// reads can't evict it, and the change with it, meanwhile
+func (p *Pager) PinPage(pageID uint32) (*Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	page, err := p.getPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	p.pins[pageID]++
+	return page, nil
+}
+
+// Unpin undoes a PinPage, or a NewPinnedPage
+func (p *Pager) Unpin(pageID uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pins[pageID]--; p.pins[pageID] <= 0 {
+		delete(p.pins, pageID)
+	}
+}
 
+// getPage is GetPage for a caller holding p.mu
+func (p *Pager) getPage(pageID uint32) (*Page, error) {
 	if p.closed {
 		return nil, ErrDatabaseClosed
 	}
@@ -216,7 +330,7 @@ func (p *Pager) GetPage(pageID uint32) (*Page, error) {
 // readPage reads a page from disk
 func (p *Pager) readPage(pageID uint32) (*Page, error) {
 	if pageID >= p.metadata.NumPages {
-		return nil, errors.New("page ID out of bounds")
+		return nil, corruptPage(pageID, "beyond the last page (%d)", p.metadata.NumPages)
 	}
 
 	offset := int64(pageID) * PageSize
@@ -230,10 +344,15 @@ func (p *Pager) readPage(pageID uint32) (*Page, error) {
 		return nil, err
 	}
 	if n != PageSize {
-		return nil, errors.New("incomplete page read")
+		return nil, corruptPage(pageID, "incomplete page read")
 	}
 
-	return LoadPage(pageID, data)
+	page, err := LoadPage(pageID, data)
+	if err != nil {
+		return nil, err
+	}
+	page.compare = p.compare
+	return page, nil
 }
 
 // writePage writes a page to disk
@@ -257,17 +376,39 @@ func (p *Pager) addToCache(pageID uint32, page *Page) {
 		p.evictLRU()
 	}
 
+	// Evict to stay within the memory budget
+	if p.memory != nil {
+		for p.lru.Len() > minCachedPages && !p.memory.Fits(PageSize) && p.evictLRU() {
+		}
+		p.memory.Charge(common.MemPageCache, PageSize)
+	}
+
 	// Add to cache
 	p.cache[pageID] = page
 	elem := p.lru.PushFront(&lruEntry{pageID: pageID})
 	p.lruMap[pageID] = elem
 }
 
-// evictLRU evicts the least recently used page
-func (p *Pager) evictLRU() {
+// shrink evicts least recently used pages until need bytes are freed or
+// the cache is down to minCachedPages. Returns bytes freed.
+// Caller must hold p.mu.
+func (p *Pager) shrink(need int64) int64 {
+	freed := int64(0)
+	for freed < need && p.lru.Len() > minCachedPages && p.evictLRU() {
+		freed += PageSize
+	}
+	return freed
+}
+
+// evictLRU evicts the least recently used page that isn't pinned,
+// reporting false if every cached page is
+func (p *Pager) evictLRU() bool {
 	elem := p.lru.Back()
+	for elem != nil && p.pins[elem.Value.(*lruEntry).pageID] > 0 {
+		elem = elem.Prev()
+	}
 	if elem == nil {
-		return
+		return false
 	}
 
 	entry := elem.Value.(*lruEntry)
@@ -289,13 +430,40 @@ func (p *Pager) evictLRU() {
 	delete(p.cache, pageID)
 	delete(p.lruMap, pageID)
 	p.lru.Remove(elem)
+	p.releasePage()
+	return true
+}
+
+// releasePage returns one cached page's memory to the accountant
+func (p *Pager) releasePage() {
+	if p.memory != nil {
+		p.memory.Release(common.MemPageCache, PageSize)
+	}
 }
 
 // NewPage allocates a new page
 func (p *Pager) NewPage(pageType byte) (*Page, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	return p.newPage(pageType)
+}
+
+// NewPinnedPage is NewPage for a writer under latches, pinned as PinPage
+// pins pages until Unpin
+func (p *Pager) NewPinnedPage(pageType byte) (*Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	page, err := p.newPage(pageType)
+	if err != nil {
+		return nil, err
+	}
+	p.pins[page.ID()]++
+	return page, nil
+}
 
+// newPage is NewPage for a caller holding p.mu
+func (p *Pager) newPage(pageType byte) (*Page, error) {
 	if p.closed {
 		return nil, ErrDatabaseClosed
 	}
@@ -316,6 +484,7 @@ func (p *Pager) NewPage(pageType byte) (*Page, error) {
 
 	// Create new page
 	page := NewPage(pageID, pageType)
+	page.compare = p.compare
 
 	// Add to cache
 	p.addToCache(pageID, page)
@@ -332,11 +501,16 @@ func (p *Pager) MarkDirty(pageID uint32) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Log to WAL if enabled (before modifying)
+	// Log to WAL if enabled: the bytes changed since the page was last
+	// logged, not the whole page
 	if p.wal != nil {
-		if page, ok := p.cache[pageID]; ok {
-			// Log the entire page to WAL
-			_ = p.wal.LogPageWrite(pageID, 0, page.data[:])
+		if page, ok := p.cache[pageID]; ok && len(page.changed()) > 0 {
+			// Kept to log again next time if the write fails
+			err := p.wal.LogPageDiff(pageID, page.data[:], page.changed())
+			p.walErr.Set(err)
+			if err == nil {
+				page.logged()
+			}
 		}
 	}
 
@@ -346,6 +520,14 @@ func (p *Pager) MarkDirty(pageID uint32) {
 	}
 }
 
+// SetMemoryAccountant charges cached pages to m. Must be called before
+// the pager is used.
+func (p *Pager) SetMemoryAccountant(m *common.MemoryAccountant) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.memory = m
+}
+
 // SetWAL sets the WAL for this pager
 func (p *Pager) SetWAL(wal *WAL) {
 	p.mu.Lock()
@@ -366,6 +548,7 @@ func (p *Pager) FreePage(pageID uint32) {
 		if elem, ok := p.lruMap[pageID]; ok {
 			p.lru.Remove(elem)
 			delete(p.lruMap, pageID)
+			p.releasePage()
 		}
 	}
 
@@ -438,6 +621,21 @@ func (p *Pager) SetRootPageID(pageID uint32) error {
 	return p.writeMetadata()
 }
 
+// NumKeys returns the number of keys stored at the last checkpoint, or
+// -1 if unknown
+func (p *Pager) NumKeys() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.metadata.NumKeys
+}
+
+// SetNumKeys sets the number of keys the next metadata write stores
+func (p *Pager) SetNumKeys(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metadata.NumKeys = n
+}
+
 // NumPages returns the total number of pages
 func (p *Pager) NumPages() uint32 {
 	p.mu.RLock()
@@ -478,6 +676,11 @@ func (p *Pager) Close() error {
 		return err
 	}
 
+	// Hand cached page memory back to a shared accountant
+	if p.memory != nil {
+		p.memory.Release(common.MemPageCache, int64(p.lru.Len())*PageSize)
+	}
+
 	p.closed = true
 	return nil
 }
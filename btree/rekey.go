@@ -0,0 +1,36 @@
+package btree
+
+import (
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// RotateKeys moves the WAL onto the key provider's current key, after a
+// new one was made current (see common.KeyRing), by checkpointing and
+// starting it over like Sync. Pages are updated in place and never
+// rewritten as a whole, so the database file keeps the key it was created
+// with, and that key must stay in the key provider. Stats().StaleKeyFiles
+// counts it. It does nothing without encryption.
+func (b *BTree) RotateKeys() error {
+	if _, ok := b.config.FS.(*common.EncryptedFS); !ok {
+		return nil
+	}
+	return b.Sync()
+}
+
+// staleKeyFiles counts the database file and WAL if encrypted with an old
+// key
+func (b *BTree) staleKeyFiles() int {
+	n := 0
+	if common.StaleKey(b.config.FS, b.pager.file) {
+		n++
+	}
+	if b.wal.staleKey() {
+		n++
+	}
+	return n
+}
+
+// staleKey reports whether the WAL is encrypted with an old key
+func (w *WAL) staleKey() bool {
+	return w.log.StaleKey()
+}
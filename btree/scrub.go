@@ -0,0 +1,62 @@
+package btree
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// scrub is one pass of the scrubber: it reads every page back from disk
+// and checks that it parses. Pages carry no checksums, so this finds
+// damage to their structure, not to the keys and values in them.
+func (b *BTree) scrub(s *common.Scrubber) {
+	// Page 0 is the metadata page
+	for pageID := uint32(1); pageID < b.pager.NumPages(); pageID++ {
+		err := b.pager.scrubPage(pageID)
+		if err == ErrDatabaseClosed {
+			return
+		}
+		b.noteCorruption(err)
+		if !s.Pace(PageSize) {
+			return
+		}
+	}
+}
+
+// scrubPage reads page pageID from disk and parses all of its cells. A
+// dirty page is skipped, since what is on disk is about to be replaced,
+// as is one that was never written.
+func (p *Pager) scrubPage(pageID uint32) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrDatabaseClosed
+	}
+	if p.dirty[pageID] {
+		return nil
+	}
+
+	data := make([]byte, PageSize)
+	if _, err := p.file.ReadAt(data, int64(pageID)*PageSize); err != nil {
+		if err == io.EOF {
+			return nil // Allocated after the last flush
+		}
+		return err
+	}
+	if bytes.Equal(data, make([]byte, PageSize)) {
+		return nil
+	}
+
+	page, err := LoadPage(pageID, data)
+	if err != nil {
+		return err
+	}
+	for i := uint16(0); i < page.NumCells(); i++ {
+		if _, err := page.CellAt(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,13 +1,18 @@
 package btree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 func TestSimpleSplit(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-simple-split-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-simple-split-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -63,3 +68,197 @@ func TestSimpleSplit(t *testing.T) {
 	t.Logf("Stats: NumKeys=%d, NumPages=%d, SpaceAmp=%.2fx",
 		stats.NumKeys, stats.NumSegments, stats.SpaceAmp)
 }
+
+// TestSplitOnUpdate updates a key in a full leaf with a value too large to
+// fit, so the update splits the leaf: the new value must replace the old
+// one rather than sit beside it, where the split would leave the two on
+// either side
+func TestSplitOnUpdate(t *testing.T) {
+	config := DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	numKeys := 0
+	for {
+		root, err := btree.pager.GetPage(btree.pager.RootPageID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Full: the 300-byte value can't fit, even in place of the old
+		if root.IsFull(8, 100) {
+			break
+		}
+		if err := btree.Put([]byte(fmt.Sprintf("key%05d", numKeys)), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		numKeys++
+	}
+
+	// The key just left of the middle, where a duplicate would land
+	// across the split from the original
+	target := (numKeys+1)/2 - 1
+	updated := bytes.Repeat([]byte("u"), 300)
+	if err := btree.Put([]byte(fmt.Sprintf("key%05d", target)), updated); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if root, _ := btree.pager.GetPage(btree.pager.RootPageID()); root.IsLeaf() {
+		t.Fatal("Expected the update to split the root")
+	}
+
+	it, err := btree.Scan(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	count := 0
+	for ; it.Next(); count++ {
+		want := value
+		if count == target {
+			want = updated
+		}
+		if key := fmt.Sprintf("key%05d", count); string(it.Key()) != key || !bytes.Equal(it.Value(), want) {
+			t.Fatalf("Scan entry %d: got %s = %.10q..., want %s = %.10q...", count, it.Key(), it.Value(), key, want)
+		}
+	}
+	if count != numKeys {
+		t.Errorf("Scan returned %d keys, want %d", count, numKeys)
+	}
+}
+
+// TestUpdateCell tests that updates of a leaf's cells never lose a value:
+// written in place when no bigger, moved to the free space when bigger,
+// the page compacted when that runs out, and left as it was when the
+// value doesn't fit even then
+func TestUpdateCell(t *testing.T) {
+	page := NewPage(1, PageTypeLeaf)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	value := bytes.Repeat([]byte("v"), 100)
+	numCells := 0
+	for !page.IsFull(6, 100) {
+		if err := page.InsertCell(&Cell{Key: key(numCells), Value: value}); err != nil {
+			t.Fatal(err)
+		}
+		numCells++
+	}
+	check := func(target int, want []byte) {
+		t.Helper()
+		for i := 0; i < numCells; i++ {
+			expected := value
+			if i == target {
+				expected = want
+			}
+			if got, err := page.leafValue(key(i)); err != nil || !bytes.Equal(got, expected) {
+				t.Fatalf("%s = %.10q... (%d bytes), %v; want %d bytes", key(i), got, len(got), err, len(expected))
+			}
+		}
+	}
+
+	// The same size or smaller, over and over, in place
+	freePtr := page.freePtr()
+	for i := 0; i < 1000; i++ {
+		updated := bytes.Repeat([]byte{'a' + byte(i%26)}, 100-i%50)
+		if err := page.InsertCell(&Cell{Key: key(i % numCells), Value: updated}); err != nil {
+			t.Fatalf("Update %d failed: %v", i, err)
+		}
+		if err := page.InsertCell(&Cell{Key: key(i % numCells), Value: value}); err != nil {
+			t.Fatalf("Update %d back failed: %v", i, err)
+		}
+	}
+	if page.freePtr() != freePtr {
+		t.Errorf("Updates in place used %d bytes of free space", freePtr-page.freePtr())
+	}
+	check(-1, nil)
+
+	// Bigger, over and over: the space the old values leave behind is
+	// taken back by compacting
+	spare := int(page.freePtr()) - page.cellDirOffset(page.NumCells())
+	for i := 0; i < 100; i++ {
+		target := i % numCells
+		grown := bytes.Repeat([]byte("g"), 100+spare)
+		if err := page.InsertCell(&Cell{Key: key(target), Value: grown}); err != nil {
+			t.Fatalf("Growing update %d failed: %v", i, err)
+		}
+		check(target, grown)
+		if err := page.InsertCell(&Cell{Key: key(target), Value: value}); err != nil {
+			t.Fatalf("Update %d back failed: %v", i, err)
+		}
+	}
+
+	// Too big even after compacting: nothing changes
+	before := page.Clone()
+	tooBig := bytes.Repeat([]byte("t"), 100+spare+10)
+	if err := page.InsertCell(&Cell{Key: key(3), Value: tooBig}); !errors.Is(err, ErrPageFull) {
+		t.Fatalf("Expected ErrPageFull, got %v", err)
+	}
+	if !bytes.Equal(page.Data(), before.Data()) {
+		t.Error("A failed update changed the page")
+	}
+	check(-1, nil)
+}
+
+// TestUpdateNearCapacity grows values in full leaves until they take up
+// most of a page, with Put and ConcurrentPut, so updates split leaves
+// whose cells are far from the same size
+func TestUpdateNearCapacity(t *testing.T) {
+	config := DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	const numKeys = 300
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	want := make(map[int][]byte)
+	for i := 0; i < numKeys; i++ {
+		want[i] = bytes.Repeat([]byte("v"), 100)
+		if err := btree.Put(key(i), want[i]); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// Every seventh key grows past half a page, among its small neighbours
+	for size := 200; size <= 2800; size += 300 {
+		for i := 0; i < numKeys; i += 7 {
+			value := bytes.Repeat([]byte{byte('a' + size%26)}, size)
+			put := btree.Put
+			if i%2 == 1 {
+				put = btree.ConcurrentPut
+			}
+			if err := put(key(i), value); err != nil {
+				t.Fatalf("Update of %s to %d bytes failed: %v", key(i), size, err)
+			}
+			want[i] = value
+		}
+	}
+
+	// No split leaves room for two of them
+	tooBig := bytes.Repeat([]byte("t"), PageSize-HeaderSize)
+	if err := btree.Put(key(7), tooBig); !errors.Is(err, ErrPageFull) {
+		t.Errorf("Expected ErrPageFull for a value the size of a page, got %v", err)
+	}
+
+	it, err := btree.Scan(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	count := 0
+	for ; it.Next(); count++ {
+		if string(it.Key()) != string(key(count)) || !bytes.Equal(it.Value(), want[count]) {
+			t.Fatalf("Scan entry %d: got %s (%d bytes), want %s (%d bytes)", count, it.Key(), len(it.Value()), key(count), len(want[count]))
+		}
+	}
+	if count != numKeys {
+		t.Errorf("Scan returned %d keys, want %d", count, numKeys)
+	}
+	if n := btree.Stats().NumKeys; n != numKeys {
+		t.Errorf("NumKeys = %d, want %d", n, numKeys)
+	}
+}
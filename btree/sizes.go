@@ -0,0 +1,125 @@
+package btree
+
+import "github.com/intellect4all/storage-engines/common"
+
+// ApproximateSizes estimates the space each key range takes, to plan
+// shard splits or page sizes without scanning. It walks down from the
+// root, counting the children of each internal page that fall wholly
+// inside or outside the range without reading them, so only the pages
+// along the range's two ends are read. The share of the leaves found is
+// applied to the file's page count. Every page has its place on disk, so
+// MemoryBytes is always zero.
+func (b *BTree) ApproximateSizes(ranges []common.KeyRange) (sizes []common.RangeSize, err error) {
+	if err := b.gate.Enter(); err != nil {
+		return nil, err
+	}
+	defer b.gate.Exit()
+	defer func() { b.noteCorruption(err) }()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// Page 0 holds the metadata
+	pages := int64(b.pager.NumPages()) - 1
+
+	// Read latches from the root down keep out ConcurrentPut
+	root := b.latchManager.GetLatch(rootLatch)
+	root.Lock(LatchRead)
+	defer root.Unlock(LatchRead)
+
+	sizes = make([]common.RangeSize, len(ranges))
+	for i, r := range ranges {
+		share, err := b.rangeShare(b.pager.RootPageID(), r.Start, r.End)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i].DiskBytes = int64(share * float64(pages*PageSize))
+	}
+	return sizes, nil
+}
+
+// rangeShare estimates the share of the subtree under pageID holding keys
+// in [start, end), counting each child of an internal page as an equal
+// part
+func (b *BTree) rangeShare(pageID uint32, start, end []byte) (float64, error) {
+	latch := b.latchManager.GetLatch(pageID)
+	latch.Lock(LatchRead)
+	defer latch.Unlock(LatchRead)
+
+	page, err := b.pager.GetPage(pageID)
+	if err != nil {
+		return 0, err
+	}
+
+	if page.IsLeaf() {
+		n := int(page.NumCells())
+		lo, hi := 0, n
+		if len(start) > 0 {
+			lo = page.lowerBound(start)
+		}
+		if len(end) > 0 {
+			hi = page.lowerBound(end)
+		}
+		if n == 0 || hi <= lo {
+			return 0, nil
+		}
+		return float64(hi-lo) / float64(n), nil
+	}
+
+	// The right pointer holds the keys below the first cell's key, and
+	// each cell's child those from its key up to the next cell's
+	type child struct {
+		id     uint32
+		lo, hi []byte // nil when unbounded
+	}
+	numCells := int(page.NumCells())
+	children := make([]child, 0, numCells+1)
+	if ptr := page.RightPtr(); ptr != 0 {
+		children = append(children, child{id: ptr})
+	}
+	for i := 0; i < numCells; i++ {
+		cell, err := page.CellAt(uint16(i))
+		if err != nil {
+			return 0, err
+		}
+		if len(children) > 0 {
+			children[len(children)-1].hi = cell.Key
+		}
+		children = append(children, child{id: cell.Child, lo: cell.Key})
+	}
+	if len(children) == 0 {
+		return 0, nil
+	}
+
+	var sum float64
+	for _, c := range children {
+		if len(end) > 0 && c.lo != nil && page.compareKeys(c.lo, end) >= 0 {
+			continue
+		}
+		if len(start) > 0 && c.hi != nil && page.compareKeys(c.hi, start) <= 0 {
+			continue
+		}
+		startsInside := len(start) == 0 || (c.lo != nil && page.compareKeys(c.lo, start) >= 0)
+		endsInside := len(end) == 0 || (c.hi != nil && page.compareKeys(c.hi, end) <= 0)
+		if startsInside && endsInside {
+			sum++
+			continue
+		}
+
+		share, err := b.rangeShare(c.id, start, end)
+		if err != nil {
+			return 0, err
+		}
+		sum += share
+	}
+	return sum / float64(len(children)), nil
+}
+
+// lowerBound returns the index of the first cell whose key is >= key
+func (p *Page) lowerBound(key []byte) int {
+	index := p.searchCell(key)
+	if index < 0 {
+		return -index - 1
+	}
+	return index
+}
@@ -1,8 +1,8 @@
 package btree
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 )
 
 // SplitResult represents the result of a page split
@@ -13,8 +13,9 @@ type SplitResult struct {
 }
 
 // splitLeaf splits a full leaf page into two pages
-// Returns the separator key and the new page ID
-func (b *BTree) splitLeaf(page *Page, key, value []byte) (*SplitResult, error) {
+// Returns the separator key and the new page ID. lc is the latches of a
+// ConcurrentPut, which pins the new page, or nil under the tree lock.
+func (b *BTree) splitLeaf(page *Page, key, value []byte, lc *LatchCoupling) (*SplitResult, error) {
 	// Collect all cells including the new one
 	numCells := page.NumCells()
 	cells := make([]*Cell, 0, numCells+1)
@@ -28,25 +29,35 @@ func (b *BTree) splitLeaf(page *Page, key, value []byte) (*SplitResult, error) {
 		cells = append(cells, CopyCell(cell))
 	}
 
-	// Insert new cell in sorted position
+	// Insert new cell in sorted position, or in place of the cell for the
+	// same key: an update that didn't fit splits the page too
 	newCell := &Cell{Key: key, Value: value}
-	insertPos := 0
+	insertPos, replace := len(cells), false
 	for i, cell := range cells {
-		if bytes.Compare(key, cell.Key) < 0 {
-			insertPos = i
+		if cmp := page.compareKeys(key, cell.Key); cmp <= 0 {
+			insertPos, replace = i, cmp == 0
 			break
 		}
-		insertPos = i + 1
 	}
 
-	// Insert new cell
-	cells = append(cells[:insertPos], append([]*Cell{newCell}, cells[insertPos:]...)...)
+	if replace {
+		cells[insertPos] = newCell
+	} else {
+		cells = append(cells[:insertPos], append([]*Cell{newCell}, cells[insertPos:]...)...)
+	}
 
-	// Calculate split point (divide evenly)
-	midpoint := len(cells) / 2
+	// Calculate split point (divide evenly), before changing anything
+	sizes := make([]int, len(cells))
+	for i, cell := range cells {
+		sizes[i] = page.cellSize(len(cell.Key), len(cell.Value))
+	}
+	midpoint, ok := leafSplitPoint(sizes)
+	if !ok {
+		return nil, errNoSplit(key, value)
+	}
 
 	// Create new page for second half
-	newPage, err := b.pager.NewPage(PageTypeLeaf)
+	newPage, err := b.allocPage(PageTypeLeaf, lc)
 	if err != nil {
 		return nil, err
 	}
@@ -93,8 +104,8 @@ func (b *BTree) splitLeaf(page *Page, key, value []byte) (*SplitResult, error) {
 	}, nil
 }
 
-// splitInternal splits a full internal page
-func (b *BTree) splitInternal(page *Page, key []byte, childPageID uint32) (*SplitResult, error) {
+// splitInternal splits a full internal page, lc as for splitLeaf
+func (b *BTree) splitInternal(page *Page, key []byte, childPageID uint32, lc *LatchCoupling) (*SplitResult, error) {
 	// Collect all cells including the new one
 	numCells := page.NumCells()
 	cells := make([]*Cell, 0, numCells+1)
@@ -112,7 +123,7 @@ func (b *BTree) splitInternal(page *Page, key []byte, childPageID uint32) (*Spli
 	newCell := &Cell{Key: key, Child: childPageID}
 	insertPos := 0
 	for i, cell := range cells {
-		if bytes.Compare(key, cell.Key) < 0 {
+		if page.compareKeys(key, cell.Key) < 0 {
 			insertPos = i
 			break
 		}
@@ -133,7 +144,7 @@ func (b *BTree) splitInternal(page *Page, key []byte, childPageID uint32) (*Spli
 	middleCell := cells[midpoint]
 
 	// Create new page for right half
-	newPage, err := b.pager.NewPage(PageTypeInternal)
+	newPage, err := b.allocPage(PageTypeInternal, lc)
 	if err != nil {
 		return nil, err
 	}
@@ -150,8 +161,9 @@ func (b *BTree) splitInternal(page *Page, key []byte, childPageID uint32) (*Spli
 		}
 	}
 
-	// Set original page's right pointer to middle cell's child
-	page.SetRightPtr(middleCell.Child)
+	// The right pointer holds the keys below the first cell's, so the
+	// original page keeps its own
+	page.SetRightPtr(oldRightPtr)
 
 	// Add right half to new page
 	for i := midpoint + 1; i < len(cells); i++ {
@@ -160,8 +172,9 @@ func (b *BTree) splitInternal(page *Page, key []byte, childPageID uint32) (*Spli
 		}
 	}
 
-	// Set new page's right pointer
-	newPage.SetRightPtr(oldRightPtr)
+	// The middle cell's child holds the keys from its key up to the new
+	// page's first cell's
+	newPage.SetRightPtr(middleCell.Child)
 
 	// Mark both pages as dirty
 	b.pager.MarkDirty(page.ID())
@@ -186,13 +199,20 @@ func (b *BTree) insertAndSplit(pageID uint32, key, value []byte) (bool, []byte,
 	}
 
 	if page.IsLeaf() {
+		// An update doesn't add to the key count
+		existed, err := page.hasKey(key)
+		if err != nil {
+			return false, nil, 0, err
+		}
+
 		// Try simple insert first
 		cell := &Cell{Key: key, Value: value}
-		err := page.InsertCell(cell)
+		err = page.InsertCell(cell)
 
 		if err == nil {
 			// Success, no split needed
 			b.pager.MarkDirty(page.ID())
+			b.countInsert(existed)
 			// Note: Bytes written are tracked in pager.writePage(), not here
 			return false, nil, 0, nil
 		}
@@ -202,10 +222,11 @@ func (b *BTree) insertAndSplit(pageID uint32, key, value []byte) (bool, []byte,
 		}
 
 		// Page is full, split it
-		result, err := b.splitLeaf(page, key, value)
+		result, err := b.splitLeaf(page, key, value, nil)
 		if err != nil {
 			return false, nil, 0, err
 		}
+		b.countInsert(existed)
 
 		return true, result.SplitKey, result.NewPageID, nil
 	}
@@ -241,7 +262,7 @@ func (b *BTree) insertAndSplit(pageID uint32, key, value []byte) (bool, []byte,
 	}
 
 	// This internal node is also full, split it
-	result, err := b.splitInternal(page, splitKey, newPageID)
+	result, err := b.splitInternal(page, splitKey, newPageID, nil)
 	if err != nil {
 		return false, nil, 0, err
 	}
@@ -249,10 +270,11 @@ func (b *BTree) insertAndSplit(pageID uint32, key, value []byte) (bool, []byte,
 	return true, result.SplitKey, result.NewPageID, nil
 }
 
-// handleRootSplit creates a new root when the root splits
-func (b *BTree) handleRootSplit(oldRootID uint32, splitKey []byte, newPageID uint32) error {
+// handleRootSplit creates a new root when the root splits, lc as for
+// splitLeaf
+func (b *BTree) handleRootSplit(oldRootID uint32, splitKey []byte, newPageID uint32, lc *LatchCoupling) error {
 	// Create new root page
-	newRoot, err := b.pager.NewPage(PageTypeInternal)
+	newRoot, err := b.allocPage(PageTypeInternal, lc)
 	if err != nil {
 		return err
 	}
@@ -278,3 +300,134 @@ func (b *BTree) handleRootSplit(oldRootID uint32, splitKey []byte, newPageID uin
 
 	return nil
 }
+
+// allocPage allocates a page for a split, pinned in lc for a ConcurrentPut
+func (b *BTree) allocPage(pageType byte, lc *LatchCoupling) (*Page, error) {
+	if lc == nil {
+		return b.pager.NewPage(pageType)
+	}
+	return lc.newPage(pageType)
+}
+
+// leafSplitPoint returns the index of the first cell to move to the new
+// page when a leaf splits, given the sizes of its cells: the middle one,
+// unless either half wouldn't fit in a page, as when a large value lands
+// among many small ones; then the one that comes closest to halving the
+// bytes. False if no split point leaves both halves fitting.
+func leafSplitPoint(sizes []int) (int, bool) {
+	total := 0
+	for _, size := range sizes {
+		total += size + CellDirEntrySize
+	}
+
+	space := PageSize - HeaderSize
+	midpoint := len(sizes) / 2
+	best, bestLarger := 0, 0
+	left := 0
+	for i := 1; i < len(sizes); i++ {
+		left += sizes[i-1] + CellDirEntrySize
+		larger := max(left, total-left)
+		if larger > space {
+			continue
+		}
+		if i == midpoint {
+			return i, true
+		}
+		if best == 0 || larger < bestLarger {
+			best, bestLarger = i, larger
+		}
+	}
+	return best, best > 0
+}
+
+// errNoSplit reports that no split of a leaf leaves key and value fitting
+// in one of the halves
+func errNoSplit(key, value []byte) error {
+	return fmt.Errorf("%w: no split of the leaf fits a %d-byte entry", ErrPageFull, len(key)+len(value))
+}
+
+// splitStaysIn reports whether inserting key into the leaf at the end of
+// path, with the splits it sets off, changes no page above path[0]: one
+// of them takes the separator from below without splitting, or path[0]
+// is the root and rootHeld its latch. Nothing is changed to find out.
+func splitStaysIn(path []*Page, key, value []byte, rootHeld bool) (bool, error) {
+	leaf := path[len(path)-1]
+	if !leaf.IsFull(len(key), len(value)) {
+		return true, nil
+	}
+	separator, err := splitKey(leaf, key, value)
+	if err != nil {
+		return false, err
+	}
+	for i := len(path) - 2; i >= 0; i-- {
+		if !path[i].IsFull(len(separator), 0) {
+			return true, nil
+		}
+		if separator, err = splitKey(path[i], separator, nil); err != nil {
+			return false, err
+		}
+	}
+	return rootHeld, nil
+}
+
+// splitKey returns the key splitting a full page to insert key (and
+// value, into a leaf) moves up to its parent, as splitLeaf and
+// splitInternal pick it: the middle one, key included, or for a leaf the
+// one leafSplitPoint picks
+func splitKey(page *Page, key, value []byte) ([]byte, error) {
+	numCells := int(page.NumCells())
+	keys := make([][]byte, 0, numCells+1)
+	var sizes []int
+	for i := 0; i < numCells; i++ {
+		var cellKey []byte
+		var err error
+		if page.IsLeaf() {
+			var cellValue []byte
+			cellKey, cellValue, err = page.leafEntryAt(uint16(i))
+			sizes = append(sizes, page.cellSize(len(cellKey), len(cellValue)))
+		} else {
+			cellKey, _, err = page.internalCellAt(uint16(i))
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, cellKey)
+	}
+	if !page.IsLeaf() {
+		// An internal page puts the new cell after the one for the same key
+		pos := len(keys)
+		for i, cellKey := range keys {
+			if page.compareKeys(key, cellKey) < 0 {
+				pos = i
+				break
+			}
+		}
+		keys = append(keys[:pos], append([][]byte{key}, keys[pos:]...)...)
+		return keys[len(keys)/2], nil
+	}
+
+	// A leaf replaces the cell for the same key
+	size := page.cellSize(len(key), len(value))
+	pos := len(keys)
+	for i, cellKey := range keys {
+		cmp := page.compareKeys(key, cellKey)
+		if cmp == 0 {
+			keys[i], sizes[i] = key, size
+			pos = -1
+			break
+		}
+		if cmp < 0 {
+			pos = i
+			break
+		}
+	}
+	if pos >= 0 {
+		keys = append(keys[:pos], append([][]byte{key}, keys[pos:]...)...)
+		sizes = append(sizes[:pos], append([]int{size}, sizes[pos:]...)...)
+	}
+	midpoint, ok := leafSplitPoint(sizes)
+	if !ok {
+		return nil, errNoSplit(key, value)
+	}
+	return keys[midpoint], nil
+}
@@ -3,11 +3,12 @@ package btree
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestSplitDebug(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-split-debug-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-split-debug-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -63,7 +64,7 @@ func TestSplitDebug(t *testing.T) {
 }
 
 func TestDumpTree(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-dump-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-dump-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -2,21 +2,28 @@ package btree
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"os"
-	"sync"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/common/wal"
 )
 
-// WAL implements a physical Write-Ahead Log for crash recovery
+// WAL implements a physical Write-Ahead Log for crash recovery, kept in the
+// shared log format (see common/wal)
 // Physical WAL records actual byte-level changes to pages, not logical operations
 type WAL struct {
-	file     *os.File
-	mu       sync.Mutex
-	offset   int64
-	flushed  int64 // Last fsynced offset
-	filePath string
+	log    *wal.Log
+	damage error // Found converting an older WAL, reported by readAll
+
+	// first is when the first page write since the WAL was last emptied
+	// was logged (UnixNano), 0 while there is none
+	first atomic.Int64
 }
 
 // WAL Record Types
@@ -24,329 +31,368 @@ const (
 	WALRecordPageWrite  = 1 // Page modification
 	WALRecordCheckpoint = 2 // Checkpoint marker
 	WALRecordCommit     = 3 // Transaction commit
+	WALRecordPageDiff   = 4 // The bytes of a page changed since it was last logged
 )
 
 // WALRecord represents a single WAL entry
 type WALRecord struct {
-	Type     uint8
-	PageID   uint32
-	Offset   uint32 // Offset within page
-	Length   uint32 // Length of data
-	Data     []byte // Actual data to write
-	Checksum uint32 // CRC32 checksum
+	Type   uint8
+	PageID uint32
+	Offset uint32 // Offset within page
+	Length uint32 // Length of data
+	Data   []byte // Actual data to write
 }
 
-// WAL file format:
-// [Magic: "BWAL"][Version: 1]
-// Each record:
-// [Type(1)][PageID(4)][Offset(4)][Length(4)][Data(Length)][CRC32(4)]
+// WAL record payloads:
+// Page write: [PageID(4)][Offset(4)][Data]
+// Page diff: [PageID(4)], then per span [Offset(2)][Length(2)][Data(Length)]
+// Checkpoint: empty
+//
+// A page diff holds every byte of the page changed since its last one, so
+// replaying a page's diffs in order over any version of it since the last
+// checkpoint, even one torn writing it, leaves it as last logged.
 
 const (
-	WALMagic   = "BWAL"
-	WALVersion = 1
-	WALHeaderSize = 8 // Magic(4) + Version(4)
+	WALMagic      = "BWAL"
+	WALVersion    = 3 // 3 added page diffs
+	WALHeaderSize = wal.HeaderSize
+
+	walSpanHeaderSize = 4
 )
 
+// walOptions describe the B-Tree's log. It is started over at every
+// checkpoint, so it stays in one segment.
+var walOptions = wal.Options{Magic: WALMagic, Version: WALVersion}
+
 // NewWAL creates or opens a WAL file
 func NewWAL(filePath string) (*WAL, error) {
-	// Open WAL file (create if doesn't exist)
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open WAL: %w", err)
-	}
+	return openWAL(common.OSFS{}, filePath)
+}
 
-	wal := &WAL{
-		file:     file,
-		filePath: filePath,
+// openWAL creates or opens a WAL file in fs
+func openWAL(fs common.FS, filePath string) (*WAL, error) {
+	w := &WAL{}
+	l, err := wal.Open(fs, filePath, walOptions)
+	var formatErr *wal.FormatError
+	if errors.As(err, &formatErr) && formatErr.Path == filePath && formatErr.Magic == WALMagic && formatErr.Version >= 1 && formatErr.Version < WALVersion {
+		l, w.damage, err = convertWAL(fs, filePath, formatErr.Version)
 	}
-
-	// Check if file is new or existing
-	stat, err := file.Stat()
 	if err != nil {
-		file.Close()
-		return nil, err
-	}
-
-	if stat.Size() == 0 {
-		// New file, write header
-		if err := wal.writeHeader(); err != nil {
-			file.Close()
-			return nil, err
-		}
-		wal.offset = WALHeaderSize
-		wal.flushed = WALHeaderSize
-	} else {
-		// Existing file, validate header
-		if err := wal.validateHeader(); err != nil {
-			file.Close()
-			return nil, err
-		}
-		// Seek to end
-		offset, err := file.Seek(0, io.SeekEnd)
-		if err != nil {
-			file.Close()
-			return nil, err
-		}
-		wal.offset = offset
-		wal.flushed = offset
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
-
-	return wal, nil
+	w.log = l
+	return w, nil
 }
 
-// writeHeader writes the WAL file header
-func (w *WAL) writeHeader() error {
-	header := make([]byte, WALHeaderSize)
-	copy(header[0:4], []byte(WALMagic))
-	binary.LittleEndian.PutUint32(header[4:8], WALVersion)
+// payloadBuffers holds the buffers records are encoded into before they
+// are handed to the log
+var payloadBuffers = common.NewBufferPool(64 << 10)
 
-	_, err := w.file.WriteAt(header, 0)
-	return err
+// LogPageWrite logs a page modification to WAL
+func (w *WAL) LogPageWrite(pageID uint32, offset uint32, data []byte) error {
+	buf := payloadBuffers.Get(8 + len(data))
+	defer payloadBuffers.Put(buf)
+	payload := *buf
+	binary.LittleEndian.PutUint32(payload[0:4], pageID)
+	binary.LittleEndian.PutUint32(payload[4:8], offset)
+	copy(payload[8:], data)
+	return w.appendPage(WALRecordPageWrite, payload)
 }
 
-// validateHeader validates the WAL file header
-func (w *WAL) validateHeader() error {
-	header := make([]byte, WALHeaderSize)
-	if _, err := w.file.ReadAt(header, 0); err != nil {
-		return fmt.Errorf("failed to read WAL header: %w", err)
-	}
-
-	if string(header[0:4]) != WALMagic {
-		return fmt.Errorf("invalid WAL magic: %s", string(header[0:4]))
+// LogPageDiff logs the spans of a page's data, those changed since the
+// page was last logged
+func (w *WAL) LogPageDiff(pageID uint32, data []byte, spans []pageSpan) error {
+	size := 4
+	for _, span := range spans {
+		size += walSpanHeaderSize + int(span.end-span.start)
 	}
-
-	version := binary.LittleEndian.Uint32(header[4:8])
-	if version != WALVersion {
-		return fmt.Errorf("unsupported WAL version: %d", version)
+	buf := payloadBuffers.Get(size)
+	defer payloadBuffers.Put(buf)
+	payload := *buf
+	binary.LittleEndian.PutUint32(payload[0:4], pageID)
+	offset := 4
+	for _, span := range spans {
+		binary.LittleEndian.PutUint16(payload[offset:], span.start)
+		binary.LittleEndian.PutUint16(payload[offset+2:], span.end-span.start)
+		offset += walSpanHeaderSize
+		offset += copy(payload[offset:], data[span.start:span.end])
 	}
-
-	return nil
+	return w.appendPage(WALRecordPageDiff, payload)
 }
 
-// LogPageWrite logs a page modification to WAL
-func (w *WAL) LogPageWrite(pageID uint32, offset uint32, data []byte) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	record := &WALRecord{
-		Type:   WALRecordPageWrite,
-		PageID: pageID,
-		Offset: offset,
-		Length: uint32(len(data)),
-		Data:   data,
-	}
-
-	// Calculate checksum
-	record.Checksum = w.calculateChecksum(record)
-
-	// Encode record
-	encoded := w.encodeRecord(record)
-
-	// Write to WAL file
-	if _, err := w.file.WriteAt(encoded, w.offset); err != nil {
+// appendPage appends a record of a page's bytes
+func (w *WAL) appendPage(typ wal.RecordType, payload []byte) error {
+	if err := w.log.Append(typ, payload); err != nil {
 		return fmt.Errorf("failed to write WAL record: %w", err)
 	}
-
-	w.offset += int64(len(encoded))
+	w.first.CompareAndSwap(0, time.Now().UnixNano())
 	return nil
 }
 
 // LogCheckpoint writes a checkpoint marker
 func (w *WAL) LogCheckpoint() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	record := &WALRecord{
-		Type: WALRecordCheckpoint,
-	}
-
-	record.Checksum = w.calculateChecksum(record)
-	encoded := w.encodeRecord(record)
-
-	if _, err := w.file.WriteAt(encoded, w.offset); err != nil {
+	if err := w.log.Append(WALRecordCheckpoint, nil); err != nil {
 		return fmt.Errorf("failed to write checkpoint: %w", err)
 	}
-
-	w.offset += int64(len(encoded))
 	return nil
 }
 
-// encodeRecord encodes a WAL record to bytes
-func (w *WAL) encodeRecord(r *WALRecord) []byte {
-	// Calculate total size
-	size := 1 + 4 + 4 + 4 + len(r.Data) + 4 // type + pageID + offset + length + data + checksum
-	buf := make([]byte, size)
-
-	buf[0] = r.Type
-	binary.LittleEndian.PutUint32(buf[1:5], r.PageID)
-	binary.LittleEndian.PutUint32(buf[5:9], r.Offset)
-	binary.LittleEndian.PutUint32(buf[9:13], r.Length)
-
-	if len(r.Data) > 0 {
-		copy(buf[13:13+len(r.Data)], r.Data)
+// decodeRecord decodes a WAL record's payload
+func decodeRecord(r wal.Record) (*WALRecord, error) {
+	record := &WALRecord{Type: uint8(r.Type)}
+	if r.Type == WALRecordPageDiff {
+		return decodePageDiff(record, r.Data)
 	}
-
-	binary.LittleEndian.PutUint32(buf[size-4:], r.Checksum)
-
-	return buf
-}
-
-// decodeRecord decodes a WAL record from bytes
-func (w *WAL) decodeRecord(buf []byte) (*WALRecord, error) {
-	if len(buf) < 17 { // Minimum size: type(1) + pageID(4) + offset(4) + length(4) + checksum(4)
-		return nil, fmt.Errorf("record too short: %d bytes", len(buf))
+	if r.Type != WALRecordPageWrite {
+		return record, nil
 	}
 
-	record := &WALRecord{
-		Type:   buf[0],
-		PageID: binary.LittleEndian.Uint32(buf[1:5]),
-		Offset: binary.LittleEndian.Uint32(buf[5:9]),
-		Length: binary.LittleEndian.Uint32(buf[9:13]),
+	if len(r.Data) < 8 {
+		return nil, fmt.Errorf("page write of %d bytes is too short", len(r.Data))
 	}
+	record.PageID = binary.LittleEndian.Uint32(r.Data[0:4])
+	record.Offset = binary.LittleEndian.Uint32(r.Data[4:8])
+	record.Data = r.Data[8:]
+	record.Length = uint32(len(record.Data))
+	return record, nil
+}
 
-	if record.Length > 0 {
-		if len(buf) < 13+int(record.Length)+4 {
-			return nil, fmt.Errorf("incomplete record: expected %d bytes, got %d", 13+int(record.Length)+4, len(buf))
-		}
-		record.Data = make([]byte, record.Length)
-		copy(record.Data, buf[13:13+record.Length])
+// decodePageDiff decodes a page diff's payload into record, its spans
+// left encoded in Data
+func decodePageDiff(record *WALRecord, data []byte) (*WALRecord, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("page diff of %d bytes is too short", len(data))
 	}
-
-	record.Checksum = binary.LittleEndian.Uint32(buf[13+record.Length:])
-
-	// Validate checksum
-	expectedChecksum := w.calculateChecksum(record)
-	if record.Checksum != expectedChecksum {
-		return nil, fmt.Errorf("checksum mismatch: expected %d, got %d", expectedChecksum, record.Checksum)
+	record.PageID = binary.LittleEndian.Uint32(data[0:4])
+	record.Data = data[4:]
+	record.Length = uint32(len(record.Data))
+	for spans := record.Data; len(spans) > 0; {
+		if len(spans) < walSpanHeaderSize {
+			return nil, errors.New("page diff span header cut short")
+		}
+		length := int(binary.LittleEndian.Uint16(spans[2:4]))
+		if len(spans) < walSpanHeaderSize+length {
+			return nil, fmt.Errorf("page diff span of %d bytes cut short", length)
+		}
+		spans = spans[walSpanHeaderSize+length:]
 	}
-
 	return record, nil
 }
 
-// calculateChecksum computes CRC32 checksum for a record
-func (w *WAL) calculateChecksum(r *WALRecord) uint32 {
-	h := crc32.NewIEEE()
-
-	buf := make([]byte, 13)
-	buf[0] = r.Type
-	binary.LittleEndian.PutUint32(buf[1:5], r.PageID)
-	binary.LittleEndian.PutUint32(buf[5:9], r.Offset)
-	binary.LittleEndian.PutUint32(buf[9:13], r.Length)
-
-	h.Write(buf)
-	if len(r.Data) > 0 {
-		h.Write(r.Data)
+// pageWrites returns the writes a decoded page write or diff makes to its
+// page: the record itself, or a write of each span
+func (r *WALRecord) pageWrites() []*WALRecord {
+	if r.Type != WALRecordPageDiff {
+		return []*WALRecord{r}
+	}
+	var writes []*WALRecord
+	for spans := r.Data; len(spans) >= walSpanHeaderSize; {
+		offset := binary.LittleEndian.Uint16(spans[0:2])
+		length := int(binary.LittleEndian.Uint16(spans[2:4]))
+		data := spans[walSpanHeaderSize : walSpanHeaderSize+length]
+		writes = append(writes, &WALRecord{
+			Type:   WALRecordPageWrite,
+			PageID: r.PageID,
+			Offset: uint32(offset),
+			Length: uint32(length),
+			Data:   data,
+		})
+		spans = spans[walSpanHeaderSize+length:]
 	}
+	return writes
+}
 
-	return h.Sum32()
+// applyTo applies a page write or diff to page, reporting false, without
+// touching it, for one that doesn't fit in a page
+func (r *WALRecord) applyTo(page *Page) bool {
+	writes := r.pageWrites()
+	for _, w := range writes {
+		if uint64(w.Offset)+uint64(len(w.Data)) > PageSize {
+			return false
+		}
+	}
+	for _, w := range writes {
+		copy(page.data[w.Offset:], w.Data)
+	}
+	page.SetDirty(true)
+	return true
 }
 
 // Sync forces all buffered WAL records to disk
 func (w *WAL) Sync() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	if err := w.file.Sync(); err != nil {
+	if err := w.log.Sync(); err != nil {
 		return fmt.Errorf("failed to sync WAL: %w", err)
 	}
-
-	w.flushed = w.offset
 	return nil
 }
 
-// ReadAll reads all WAL records (for recovery)
+// ReadAll reads all WAL records (for recovery). A torn or corrupt record
+// ends the log: it and everything after it are truncated away.
 func (w *WAL) ReadAll() ([]*WALRecord, error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	records, _, err := w.readAll()
+	return records, err
+}
 
+// readAll is ReadAll, also returning the corruption that ended the log
+// early, if any (a torn last record isn't corruption)
+func (w *WAL) readAll() ([]*WALRecord, error, error) {
 	var records []*WALRecord
-	offset := int64(WALHeaderSize)
-
-	for offset < w.offset {
-		// Read record header to determine size
-		header := make([]byte, 13)
-		if _, err := w.file.ReadAt(header, offset); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return records, fmt.Errorf("failed to read record header at offset %d: %w", offset, err)
-		}
-
-		recordType := header[0]
-		length := binary.LittleEndian.Uint32(header[9:13])
-
-		// Read full record
-		recordSize := 13 + int(length) + 4 // header + data + checksum
-		fullRecord := make([]byte, recordSize)
-		if _, err := w.file.ReadAt(fullRecord, offset); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return records, fmt.Errorf("failed to read full record at offset %d: %w", offset, err)
-		}
-
-		// Decode record
-		record, err := w.decodeRecord(fullRecord)
+	damage, err := w.log.Replay(func(r wal.Record) error {
+		record, err := decodeRecord(r)
 		if err != nil {
-			// Corrupted record, stop reading
-			return records, fmt.Errorf("corrupted record at offset %d: %w", offset, err)
+			return err
 		}
-
 		records = append(records, record)
-		offset += int64(recordSize)
-
-		// Stop at checkpoint
-		if recordType == WALRecordCheckpoint {
-			break
-		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-
-	return records, nil
+	if damage == nil {
+		damage, w.damage = w.damage, nil
+	}
+	return records, damage, nil
 }
 
 // Truncate removes all WAL records (after checkpoint)
 func (w *WAL) Truncate() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	w.first.Store(0)
+	return w.log.Reset()
+}
 
-	// Close current file
-	if err := w.file.Close(); err != nil {
-		return err
+// age returns how long before now the oldest page write in the WAL was
+// logged, 0 if it holds none
+func (w *WAL) age(now time.Time) time.Duration {
+	first := w.first.Load()
+	if first == 0 {
+		return 0
 	}
+	return now.Sub(time.Unix(0, first))
+}
 
-	// Create new file with just header
-	file, err := os.OpenFile(w.filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
+// Close closes the WAL file
+func (w *WAL) Close() error {
+	if err := w.log.Sync(); err != nil {
+		w.log.Close()
 		return err
 	}
+	return w.log.Close()
+}
 
-	w.file = file
+// Size returns the current WAL size in bytes
+func (w *WAL) Size() int64 {
+	return w.log.Size()
+}
 
-	if err := w.writeHeader(); err != nil {
-		return err
+// Appended returns the bytes of WAL records written since it was opened
+func (w *WAL) Appended() int64 {
+	return w.log.Appended()
+}
+
+// convertWAL rewrites a WAL of an older version in the current one: one of
+// version 1, from before the shared log format, or 2, from before page
+// diffs. It goes by way of a temporary file so a crash leaves one or the
+// other. Returns the corruption that ended the old WAL early, if any.
+func convertWAL(fs common.FS, filePath string, version uint32) (*wal.Log, error, error) {
+	var records []*WALRecord
+	var damage, err error
+	if version == 1 {
+		records, damage, err = readLegacyWAL(fs, filePath)
+	} else {
+		records, damage, err = readOldWAL(fs, filePath, version)
+	}
+	if err != nil {
+		return nil, nil, err
 	}
 
-	w.offset = WALHeaderSize
-	w.flushed = WALHeaderSize
+	tmpPath := filePath + ".tmp"
+	fs.Remove(tmpPath) // Left over from a crash
+	w, err := openWAL(fs, tmpPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, record := range records {
+		switch record.Type {
+		case WALRecordPageWrite:
+			err = w.LogPageWrite(record.PageID, record.Offset, record.Data)
+		default:
+			err = w.log.Append(wal.RecordType(record.Type), nil)
+		}
+		if err != nil {
+			w.log.Delete()
+			return nil, nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		fs.Remove(tmpPath)
+		return nil, nil, err
+	}
+	if err := fs.Rename(tmpPath, filePath); err != nil {
+		fs.Remove(tmpPath)
+		return nil, nil, err
+	}
+	log.Printf("Converted WAL %s to version %d (%d records)", filePath, WALVersion, len(records))
 
-	return nil
+	l, err := wal.Open(fs, filePath, walOptions)
+	return l, damage, err
 }
 
-// Close closes the WAL file
-func (w *WAL) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	if err := w.file.Sync(); err != nil {
-		return err
+// readOldWAL reads a WAL of an older version in the shared log format,
+// returning the corruption that ended it early, if any
+func readOldWAL(fs common.FS, filePath string, version uint32) ([]*WALRecord, error, error) {
+	l, err := wal.Open(fs, filePath, wal.Options{Magic: WALMagic, Version: version})
+	if err != nil {
+		return nil, nil, err
 	}
-
-	return w.file.Close()
+	defer l.Close()
+	return (&WAL{log: l}).readAll()
 }
 
-// Size returns the current WAL size in bytes
-func (w *WAL) Size() int64 {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	return w.offset
+// readLegacyWAL reads a version 1 WAL up to its first torn or damaged
+// record. Version 1 files start with an 8 byte header, then records of
+// [Type(1)][PageID(4)][Offset(4)][Length(4)][Data(Length)][CRC32(4)], the
+// CRC covering everything before it. Returns the corruption that stopped
+// it early, if any.
+func readLegacyWAL(fs common.FS, filePath string) ([]*WALRecord, error, error) {
+	file, err := fs.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []*WALRecord
+	offset := int64(8)
+	for offset < stat.Size() {
+		header := make([]byte, 13)
+		if _, err := file.ReadAt(header, offset); err != nil {
+			break // Torn
+		}
+		length := binary.LittleEndian.Uint32(header[9:13])
+		size := int64(13) + int64(length) + 4
+		if offset+size > stat.Size() {
+			break // Torn
+		}
+		buf := make([]byte, size)
+		if _, err := file.ReadAt(buf, offset); err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if crc32.ChecksumIEEE(buf[:size-4]) != binary.LittleEndian.Uint32(buf[size-4:]) {
+			damage := common.Corruptf(filePath, "record at offset %d: checksum mismatch", offset)
+			log.Printf("Warning: %v, dropping %d bytes", damage, stat.Size()-offset)
+			return records, damage, nil
+		}
+		records = append(records, &WALRecord{
+			Type:   buf[0],
+			PageID: binary.LittleEndian.Uint32(buf[1:5]),
+			Offset: binary.LittleEndian.Uint32(buf[5:9]),
+			Length: length,
+			Data:   buf[13 : 13+length],
+		})
+		offset += size
+	}
+	return records, nil, nil
 }
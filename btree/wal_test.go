@@ -1,13 +1,24 @@
 package btree
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/common/wal"
 )
 
 func TestWALCrashRecovery(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-wal-test-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-wal-test-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -36,8 +47,9 @@ func TestWALCrashRecovery(t *testing.T) {
 
 		// DON'T call Close() - simulate crash
 		// Just close the underlying files without checkpoint
-		btree.wal.file.Close()
+		btree.wal.log.Close()
 		btree.pager.file.Close()
+		btree.lock.Close() // Released by the crashed process
 	}
 
 	// Phase 2: Reopen and verify data was recovered
@@ -70,7 +82,7 @@ func TestWALCrashRecovery(t *testing.T) {
 }
 
 func TestWALCheckpoint(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-wal-checkpoint-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-wal-checkpoint-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -117,7 +129,7 @@ func TestWALCheckpoint(t *testing.T) {
 }
 
 func TestWALMultipleOperations(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/btree-wal-multi-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-wal-multi-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -175,8 +187,9 @@ func TestWALMultipleOperations(t *testing.T) {
 		}
 
 		// Crash
-		btree.wal.file.Close()
+		btree.wal.log.Close()
 		btree.pager.file.Close()
+		btree.lock.Close() // Released by the crashed process
 	}
 
 	// Phase 3: Recover and verify
@@ -227,7 +240,7 @@ func TestWALMultipleOperations(t *testing.T) {
 func TestWALWithPageSplits(t *testing.T) {
 	t.Skip("Known limitation: WAL recovery with page splits requires root page ID tracking")
 
-	dir := fmt.Sprintf("/tmp/btree-wal-splits-%d", os.Getpid())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-wal-splits-%d", os.Getpid()))
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 	defer os.RemoveAll(dir)
@@ -256,10 +269,10 @@ func TestWALWithPageSplits(t *testing.T) {
 
 		// Simulate crash by closing files without proper shutdown
 		// This leaves dirty pages in cache but WAL has the changes
-		if err := btree.wal.file.Sync(); err != nil {
+		if err := btree.wal.log.Sync(); err != nil {
 			t.Logf("WAL final sync error (expected during crash): %v", err)
 		}
-		btree.wal.file.Close()
+		btree.wal.log.Close()
 
 		// For pager, we need to ensure metadata is written
 		// In a real crash, this might be partially written
@@ -267,6 +280,7 @@ func TestWALWithPageSplits(t *testing.T) {
 		btree.pager.writeMetadata()
 		btree.pager.file.Sync()
 		btree.pager.file.Close()
+		btree.lock.Close() // Released by the crashed process
 	}
 
 	// Phase 2: Recover and verify
@@ -296,3 +310,485 @@ func TestWALWithPageSplits(t *testing.T) {
 		t.Log("✓ All 200 keys with page splits successfully recovered")
 	}
 }
+
+func TestWALRecoveryProgressAndCancel(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("btree-wal-progress-test-%d", os.Getpid()))
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	// Leave records in the WAL by skipping Close (simulated crash)
+	{
+		btree, err := New(DefaultConfig(dir))
+		if err != nil {
+			t.Fatalf("Failed to create btree: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if err := btree.Put(key, []byte("value")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := btree.wal.Sync(); err != nil {
+			t.Fatalf("WAL sync failed: %v", err)
+		}
+		btree.wal.log.Close()
+		btree.pager.file.Close()
+		btree.lock.Close() // Released by the crashed process
+	}
+
+	// A cancelled open must leave the WAL for the next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewWithContext(ctx, DefaultConfig(dir)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	var last common.RecoveryProgress
+	config := DefaultConfig(dir)
+	config.OnRecoveryProgress = func(p common.RecoveryProgress) {
+		last = p
+	}
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree.Close()
+
+	if last.Phase != common.PhaseWALReplay || !last.Done || last.Entries == 0 {
+		t.Fatalf("Expected completed WAL replay report, got %+v", last)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if _, err := btree.Get(key); err != nil {
+			t.Fatalf("Get failed for %s after recovery: %v", key, err)
+		}
+	}
+}
+
+// TestStaleWALRecordsSkipped tests that records before a checkpoint, whose
+// pages are already on disk, aren't replayed on open
+func TestStaleWALRecordsSkipped(t *testing.T) {
+	config := DefaultConfig("/btree-stale-wal")
+	config.FS = common.NewMemFS()
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	replayed := false
+	config.OnRecoveryProgress = func(p common.RecoveryProgress) {
+		if p.Phase == common.PhaseWALReplay {
+			replayed = true
+		}
+	}
+	btree, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen btree: %v", err)
+	}
+	defer btree.Close()
+
+	if replayed {
+		t.Error("Expected nothing replayed after a clean close")
+	}
+	if size := btree.wal.Size(); size != WALHeaderSize {
+		t.Errorf("Expected the stale records dropped, WAL is %d bytes", size)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if _, err := btree.Get(key); err != nil {
+			t.Fatalf("Get %s after reopen: %v", key, err)
+		}
+	}
+}
+
+// TestWALDamage tests that a record failing its checksum ends the WAL
+// without failing the open, and counts as corruption
+func TestWALDamage(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/btree-wal-damage")
+	config.FS = fs
+
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			// The database file exists on disk, the rest is only in the WAL
+			if err := btree.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+		}
+		if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := btree.wal.Sync(); err != nil {
+		t.Fatalf("WAL sync failed: %v", err)
+	}
+
+	// A record whose CRC doesn't match, after the good ones
+	crashed := fs.CrashClone()
+	f, err := crashed.OpenFile(config.DataDir+".wal", os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 0, 4, 0, 0, 0, WALRecordPageWrite, 1, 2, 3, 4})
+	f.Close()
+
+	config.FS = crashed
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover btree: %v", err)
+	}
+	defer recovered.Close()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if _, err := recovered.Get(key); err != nil {
+			t.Fatalf("Get %s after recovery: %v", key, err)
+		}
+	}
+	if n := recovered.Stats().CorruptionCount; n != 1 {
+		t.Errorf("Expected 1 corruption, got %d", n)
+	}
+}
+
+// TestLegacyWAL tests that WALs from before the shared log format, and
+// from before page diffs, are converted and replayed on open
+func TestLegacyWAL(t *testing.T) {
+	// Records in version 1's format:
+	// [Type(1)][PageID(4)][Offset(4)][Length(4)][Data(Length)][CRC32(4)]
+	writeVersion1 := func(fs common.FS, walPath string, records []*WALRecord) error {
+		contents := append([]byte(WALMagic), 1, 0, 0, 0)
+		for _, r := range records {
+			buf := make([]byte, 13+len(r.Data))
+			buf[0] = r.Type
+			binary.LittleEndian.PutUint32(buf[1:], r.PageID)
+			binary.LittleEndian.PutUint32(buf[5:], r.Offset)
+			binary.LittleEndian.PutUint32(buf[9:], uint32(len(r.Data)))
+			copy(buf[13:], r.Data)
+			contents = binary.LittleEndian.AppendUint32(append(contents, buf...), crc32.ChecksumIEEE(buf))
+		}
+		f, err := fs.Create(walPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(contents)
+		return err
+	}
+	// Records in the shared log format, in version 2's payloads
+	writeVersion2 := func(fs common.FS, walPath string, records []*WALRecord) error {
+		fs.Remove(walPath)
+		l, err := wal.Open(fs, walPath, wal.Options{Magic: WALMagic, Version: 2})
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			var payload []byte
+			if r.Type == WALRecordPageWrite {
+				payload = binary.LittleEndian.AppendUint32(nil, r.PageID)
+				payload = append(binary.LittleEndian.AppendUint32(payload, r.Offset), r.Data...)
+			}
+			if err := l.Append(wal.RecordType(r.Type), payload); err != nil {
+				l.Close()
+				return err
+			}
+		}
+		return l.Close()
+	}
+
+	for _, format := range []struct {
+		version int
+		write   func(common.FS, string, []*WALRecord) error
+	}{{1, writeVersion1}, {2, writeVersion2}} {
+		t.Run(fmt.Sprintf("Version%d", format.version), func(t *testing.T) {
+			fs := common.NewMemFS()
+			config := DefaultConfig("/btree-legacy-wal")
+			config.FS = fs
+
+			btree, err := New(config)
+			if err != nil {
+				t.Fatalf("Failed to create btree: %v", err)
+			}
+			defer btree.Close()
+			for i := 0; i < 100; i++ {
+				if i == 50 {
+					// The database file exists on disk, the rest is only in the WAL
+					if err := btree.Sync(); err != nil {
+						t.Fatalf("Sync failed: %v", err)
+					}
+				}
+				if err := btree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			if err := btree.wal.Sync(); err != nil {
+				t.Fatalf("WAL sync failed: %v", err)
+			}
+			crashed := fs.CrashClone()
+			walPath := config.DataDir + ".wal"
+
+			// Write the same records out in the old format, which had
+			// page writes where there are now page diffs
+			l, err := openWAL(crashed, walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, err := l.ReadAll()
+			l.log.Close()
+			if err != nil || len(records) == 0 {
+				t.Fatalf("Expected records to convert, got %d, err=%v", len(records), err)
+			}
+			var old []*WALRecord
+			for _, r := range records {
+				if r.Type == WALRecordPageDiff {
+					old = append(old, r.pageWrites()...)
+				} else {
+					old = append(old, r)
+				}
+			}
+			if err := format.write(crashed, walPath, old); err != nil {
+				t.Fatal(err)
+			}
+
+			config.FS = crashed
+			recovered, err := New(config)
+			if err != nil {
+				t.Fatalf("Failed to recover btree: %v", err)
+			}
+			defer recovered.Close()
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key%03d", i))
+				if _, err := recovered.Get(key); err != nil {
+					t.Fatalf("Get %s after recovery: %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+// TestPageDiffs tests that the spans a page notes as changed hold every
+// byte changed since it was last logged, so that applying them to the
+// page as it was leaves it as it is now
+func TestPageDiffs(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	page := NewPage(1, PageTypeLeaf)
+	logged := NewPage(1, PageTypeLeaf)
+	if spans := page.changed(); len(spans) != 1 || spans[0] != (pageSpan{0, PageSize}) {
+		t.Fatalf("A new page changed %v, want all of it", spans)
+	}
+	page.logged()
+
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key%03d", rng.Intn(200)))
+		switch n := page.NumCells(); {
+		case rng.Intn(4) == 0 && n > 0:
+			page.DeleteCell(uint16(rng.Intn(int(n))))
+		case rng.Intn(8) == 0:
+			page.SetRightPtr(rng.Uint32())
+		default:
+			// Updates of all sizes, so some are written in place, some
+			// in free space and some compact the page
+			value := bytes.Repeat([]byte{byte(i)}, rng.Intn(100))
+			if err := page.InsertCell(&Cell{Key: key, Value: value}); err != nil && err != ErrPageFull {
+				t.Fatalf("InsertCell: %v", err)
+			}
+		}
+
+		spans := page.changed()
+		if len(spans) > maxPageSpans {
+			t.Fatalf("%d spans noted", len(spans))
+		}
+		for j := 1; j < len(spans); j++ {
+			if int(spans[j].start) <= int(spans[j-1].end)+walSpanHeaderSize {
+				t.Fatalf("Spans %v not sorted and apart", spans)
+			}
+		}
+		for _, span := range spans {
+			copy(logged.data[span.start:span.end], page.data[span.start:span.end])
+		}
+		page.logged()
+		if logged.data != page.data {
+			t.Fatalf("Operation %d: the page differs from its logged changes", i)
+		}
+	}
+
+	// Past maxPageSpans, changes are joined to the span nearest them
+	for i := 0; i <= maxPageSpans; i++ {
+		page.markChanged(i*100, i*100+10)
+	}
+	if spans := page.changed(); len(spans) != maxPageSpans || spans[len(spans)-1] != (pageSpan{700, 810}) {
+		t.Errorf("Spans %v", spans)
+	}
+}
+
+// TestPageDiffRecovery tests that a tree recovered from a WAL of page
+// diffs, with pages evicted and written before the crash, holds what was
+// written, and that the diffs are a fraction of the pages
+func TestPageDiffRecovery(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/btree-page-diffs")
+	config.FS = fs
+	config.CacheSize = 16
+	btree, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string][]byte)
+	puts := 0
+	for i := 0; i < 5000; i++ {
+		if i == 1000 {
+			if err := btree.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+		}
+		key := fmt.Sprintf("key%04d", rng.Intn(2000))
+		if _, ok := want[key]; ok && rng.Intn(4) == 0 {
+			if err := btree.Delete([]byte(key)); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			delete(want, key)
+			continue
+		}
+		value := bytes.Repeat([]byte{byte(i)}, rng.Intn(200))
+		if err := btree.Put([]byte(key), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = value
+		puts++
+	}
+	if err := btree.wal.Sync(); err != nil {
+		t.Fatalf("WAL sync failed: %v", err)
+	}
+	if perPut := btree.wal.Appended() / int64(puts); perPut > PageSize/4 {
+		t.Errorf("%d WAL bytes logged per Put", perPut)
+	}
+
+	config.FS = fs.CrashClone()
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover btree: %v", err)
+	}
+	defer recovered.Close()
+	for key, value := range want {
+		got, err := recovered.Get([]byte(key))
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("Get %s after recovery = %d bytes, %v; want %d bytes", key, len(got), err, len(value))
+		}
+	}
+	if n := recovered.Stats().NumKeys; n != int64(len(want)) {
+		t.Errorf("NumKeys = %d after recovery, want %d", n, len(want))
+	}
+}
+
+// TestAutoCheckpoint tests that the checkpoint worker empties the WAL once
+// it reaches CheckpointWALBytes or its oldest record CheckpointInterval
+func TestAutoCheckpoint(t *testing.T) {
+	// An empty WAL is its header alone
+	waitForEmptyWAL := func(t *testing.T, btree *BTree, empty int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for btree.wal.Size() != empty {
+			if time.Now().After(deadline) {
+				t.Fatalf("WAL not checkpointed, %d bytes", btree.wal.Size())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("Size", func(t *testing.T) {
+		fs := common.NewMemFS()
+		config := DefaultConfig("/btree-auto-checkpoint-size")
+		config.FS = fs
+		config.CheckpointWALBytes = 64 * 1024
+		config.CheckpointInterval = 0
+
+		btree, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create btree: %v", err)
+		}
+		defer btree.Close()
+		empty := btree.wal.Size()
+
+		for i := 0; btree.wal.Size() < config.CheckpointWALBytes; i++ {
+			if err := btree.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		waitForEmptyWAL(t, btree, empty)
+
+		// Nothing left to replay, the pages hold it all
+		config.FS = fs.CrashClone()
+		recovered, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to recover btree: %v", err)
+		}
+		defer recovered.Close()
+		if _, err := recovered.Get([]byte("key00000")); err != nil {
+			t.Errorf("Get after recovery: %v", err)
+		}
+	})
+
+	t.Run("Age", func(t *testing.T) {
+		config := DefaultConfig("/btree-auto-checkpoint-age")
+		config.FS = common.NewMemFS()
+		config.CheckpointInterval = 20 * time.Millisecond
+
+		btree, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create btree: %v", err)
+		}
+		defer btree.Close()
+		empty := btree.wal.Size()
+
+		if err := btree.Put([]byte("key"), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if btree.wal.Size() == empty {
+			t.Fatal("Expected the Put in the WAL")
+		}
+		waitForEmptyWAL(t, btree, empty)
+	})
+}
+
+// BenchmarkPutWALBytes measures the WAL bytes logged per Put of a 100 byte
+// value at a random key, and the write amplification counting the pages
+// written at checkpoints too
+func BenchmarkPutWALBytes(b *testing.B) {
+	config := DefaultConfig("/btree-put-wal-bytes")
+	config.FS = common.NewMemFS()
+	btree, err := New(config)
+	if err != nil {
+		b.Fatalf("Failed to create btree: %v", err)
+	}
+	defer btree.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	value := make([]byte, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := []byte(fmt.Sprintf("key%08d", rng.Intn(1000000)))
+		if err := btree.Put(key, value); err != nil {
+			b.Fatalf("Put failed: %v", err)
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(btree.wal.Appended())/float64(b.N), "wal-B/op")
+	b.ReportMetric(btree.Stats().WriteAmp, "write-amp")
+}
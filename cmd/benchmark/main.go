@@ -1,9 +1,13 @@
 package main
 
 import (
+	"cmp"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,17 +20,96 @@ import (
 
 func main() {
 	quick := flag.Bool("quick", false, "Run quick benchmarks (shorter duration)")
-	workload := flag.String("workload", "all", "Workload to run (all, write-heavy, read-heavy, balanced, write-only)")
+	workload := flag.String("workload", "all", "Workload to run (all, write-heavy, read-heavy, balanced, write-only, scan-heavy, or a workload name)")
 	duration := flag.Duration("duration", 60*time.Second, "Duration for each benchmark")
 	concurrency := flag.Int("concurrency", 8, "Number of concurrent workers")
 	engine := flag.String("engine", "compare", "Engine to benchmark: hashindex, lsm, btree, or compare (default: compare)")
+	enginesFlag := flag.String("engines", strings.Join(engineNames, ","), "Comma-separated engines to compare, in table order")
+	parallel := flag.Bool("parallel", false, "Compare engines at the same time rather than one after another")
+	scanLength := flag.Int("scan-length", 0, "Keys read per scan in scan workloads (default: per workload)")
+	warmup := flag.Duration("warmup", 0, "Unmeasured warm-up before each benchmark (default: 5s; negative = none)")
+	measureWindow := flag.Duration("measure-window", 0, "Measure only the last part of -duration (default: all of it)")
+	zeroCopy := flag.Bool("zero-copy", false, "Read values in place with GetValue rather than copying them out with Get")
+	deleteRatio := flag.Float64("delete-ratio", 0, "Share of writes that delete a present key")
+	updateRatio := flag.Float64("update-ratio", 0, "Share of writes that overwrite a present key (the rest are blind inserts)")
+	syncModes := flag.String("sync", "none", "Write durability: none, batch (group commit) or always (sync every write); a comma-separated list runs each workload under each")
+	preloadDist := flag.String("preload-dist", "", "Preload key order: sequential, uniform, zipfian or latest (default: sequential)")
+	cpuProfile := flag.Bool("cpuprofile", false, "Write a CPU profile per engine and workload")
+	memProfile := flag.Bool("memprofile", false, "Write a heap profile per engine and workload")
+	traceProfile := flag.Bool("trace", false, "Write an execution trace per engine and workload")
+	profileEvery := flag.Duration("profile-interval", 0, "Also write a heap profile this often while measuring (default: off)")
+	profileDir := flag.String("profile-dir", "profiles", "Directory for profiles and traces")
+	recordTrace := flag.String("record-trace", "", "Record each workload's operations to <dir>/<engine>-<workload>.ops (single engine only)")
+	replay := flag.String("replay", "", "Replay a recorded operation trace instead of the workloads")
+	replayTimed := flag.Bool("replay-timed", false, "Replay operations at their recorded times rather than as fast as possible")
+	replaySerial := flag.Bool("replay-serial", false, "Replay operations one at a time in recorded order, for exactly reproducible data")
+	restart := flag.Bool("restart", false, "Measure restart instead of the workloads: write a dataset, stop the engine, and time reopening it and its first read")
+	restartKeys := flag.Int("restart-keys", 500000, "Keys written before a -restart")
+	crash := flag.Bool("crash", false, "Stop the engine in a -restart by killing the process writing it rather than closing it")
 	flag.Parse()
 
+	restartConfig := benchmark.RestartConfig{
+		NumKeys:     *restartKeys,
+		KeySize:     16,
+		ValueSize:   100,
+		Concurrency: *concurrency,
+		Crash:       *crash,
+		Seed:        12345,
+	}
+	runCrashChild(restartConfig)
+
 	fmt.Println("Storage Engine Benchmark Suite")
 	fmt.Println("================================")
 	fmt.Printf("Duration: %v\n", *duration)
 	fmt.Printf("Concurrency: %d\n", *concurrency)
-	fmt.Printf("Mode: %s\n\n", *engine)
+	fmt.Printf("Mode: %s\n", *engine)
+	fmt.Printf("Sync: %s\n\n", *syncModes)
+
+	modes, err := parseSyncModes(*syncModes)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *restart {
+		names := []string{*engine}
+		if *engine == "compare" {
+			if names, err = parseEngines(*enginesFlag); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else if _, ok := engineLabels[*engine]; !ok {
+			fmt.Printf("Unknown engine: %s (must be hashindex, lsm, btree, or compare)\n", *engine)
+			os.Exit(1)
+		}
+		if *restartKeys <= 0 {
+			fmt.Println("-restart-keys must be positive")
+			os.Exit(1)
+		}
+		runRestart(names, restartConfig)
+		return
+	}
+
+	if *replay != "" {
+		names := []string{*engine}
+		if *engine == "compare" {
+			var err error
+			if names, err = parseEngines(*enginesFlag); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else if _, ok := engineLabels[*engine]; !ok {
+			fmt.Printf("Unknown engine: %s (must be hashindex, lsm, btree, or compare)\n", *engine)
+			os.Exit(1)
+		}
+		// A trace replays with the sync mode it was recorded with unless
+		// -sync is given
+		if !flagSet("sync") {
+			modes = nil
+		}
+		runReplay(*replay, names, modes, benchmark.ReplayOptions{Timed: *replayTimed, Serial: *replaySerial})
+		return
+	}
 
 	var configs []benchmark.Config
 	if *quick {
@@ -36,23 +119,58 @@ func main() {
 	}
 
 	// Apply custom duration and concurrency if specified
-	if flag.Lookup("duration").Value.String() != flag.Lookup("duration").DefValue {
+	if flagSet("duration") {
 		for i := range configs {
 			configs[i].Duration = *duration
 		}
 	}
 
-	if flag.Lookup("concurrency").Value.String() != flag.Lookup("concurrency").DefValue {
+	if flagSet("concurrency") {
 		for i := range configs {
 			configs[i].Concurrency = *concurrency
 		}
 	}
 
-	// Filter workloads if specified
+	if *scanLength > 0 {
+		for i := range configs {
+			configs[i].ScanLength = *scanLength
+		}
+	}
+
+	switch benchmark.KeyDistribution(*preloadDist) {
+	case "", benchmark.DistSequential, benchmark.DistUniform, benchmark.DistZipfian, benchmark.DistLatest:
+	default:
+		fmt.Printf("Unknown preload distribution: %s\n", *preloadDist)
+		os.Exit(1)
+	}
+
+	if *deleteRatio < 0 || *updateRatio < 0 || *deleteRatio+*updateRatio > 1 {
+		fmt.Println("-delete-ratio and -update-ratio must be at least 0 and add up to at most 1")
+		os.Exit(1)
+	}
+
+	if *warmup != 0 || *measureWindow > 0 || *preloadDist != "" || *zeroCopy || *deleteRatio > 0 || *updateRatio > 0 {
+		for i := range configs {
+			configs[i].ZeroCopyReads = *zeroCopy
+			configs[i].DeleteRatio = *deleteRatio
+			configs[i].UpdateRatio = *updateRatio
+			if *warmup != 0 {
+				configs[i].Warmup = *warmup
+			}
+			if *measureWindow > 0 {
+				configs[i].MeasureWindow = *measureWindow
+			}
+			if *preloadDist != "" {
+				configs[i].PreloadDistribution = benchmark.KeyDistribution(*preloadDist)
+			}
+		}
+	}
+
+	// Filter workloads if specified, by type or by name
 	if *workload != "all" {
 		filtered := make([]benchmark.Config, 0)
 		for _, config := range configs {
-			if config.Name == *workload {
+			if string(config.WorkloadType) == *workload || config.Name == *workload {
 				filtered = append(filtered, config)
 			}
 		}
@@ -63,163 +181,181 @@ func main() {
 		configs = filtered
 	}
 
+	// Run each workload under each sync mode, one after the other
+	synced := make([]benchmark.Config, 0, len(configs)*len(modes))
+	for _, config := range configs {
+		for _, mode := range modes {
+			config.Sync = mode
+			synced = append(synced, config)
+		}
+	}
+	configs = synced
+
+	profile := &benchmark.Profile{
+		Dir:              *profileDir,
+		CPU:              *cpuProfile,
+		Mem:              *memProfile,
+		Trace:            *traceProfile,
+		SnapshotInterval: *profileEvery,
+	}
+	if profile.Enabled() && *parallel && *engine == "compare" {
+		fmt.Println("Profiling needs engines compared one at a time: drop -parallel")
+		os.Exit(1)
+	}
+
+	if *recordTrace != "" && *engine == "compare" {
+		fmt.Println("-record-trace needs a single -engine; replay the trace to compare")
+		os.Exit(1)
+	}
+
 	switch *engine {
-	case "hashindex":
-		runHashIndex(configs)
-	case "lsm":
-		runLSM(configs)
-	case "btree":
-		runBTree(configs)
+	case "hashindex", "lsm", "btree":
+		runEngine(*engine, configs, profile, *recordTrace)
 	case "compare":
-		runComparison(configs)
+		names, err := parseEngines(*enginesFlag)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		runComparison(configs, names, *parallel, profile)
 	default:
 		fmt.Printf("Unknown engine: %s (must be hashindex, lsm, btree, or compare)\n", *engine)
 		os.Exit(1)
 	}
 }
 
-func runHashIndex(configs []benchmark.Config) {
-	fmt.Println("=== Hash Index Benchmark ===\n")
+// flagSet reports whether a flag was changed from its default
+func flagSet(name string) bool {
+	f := flag.Lookup(name)
+	return f.Value.String() != f.DefValue
+}
 
-	dir, err := os.MkdirTemp("", "benchmark-hashindex-*")
-	if err != nil {
-		fmt.Printf("Failed to create temp dir: %v\n", err)
-		os.Exit(1)
+// parseSyncModes parses the -sync list
+func parseSyncModes(list string) ([]benchmark.SyncMode, error) {
+	var modes []benchmark.SyncMode
+	for name := range strings.SplitSeq(list, ",") {
+		mode, err := benchmark.ParseSyncMode(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(modes, mode) {
+			modes = append(modes, mode)
+		}
 	}
-	defer os.RemoveAll(dir)
-
-	config := hashindex.DefaultConfig(dir)
-	config.SyncOnWrite = false // Async writes for better performance
+	return modes, nil
+}
 
-	h, err := hashindex.New(config)
-	if err != nil {
-		fmt.Printf("Failed to create HashIndex: %v\n", err)
-		os.Exit(1)
-	}
-	defer h.Close()
+// engineNames are the engines that can be benchmarked, in table order
+var engineNames = []string{"hashindex", "lsm", "btree"}
 
-	results := runBenchmarks(h, "HashIndex", configs)
-	printSummaryTable(results)
+// engineLabels are the names results are reported under
+var engineLabels = map[string]string{
+	"hashindex": "HashIndex",
+	"lsm":       "LSM-Tree",
+	"btree":     "B-Tree",
 }
 
-func runLSM(configs []benchmark.Config) {
-	fmt.Println("=== LSM-Tree Benchmark ===\n")
-
-	dir, err := os.MkdirTemp("", "benchmark-lsm-*")
-	if err != nil {
-		fmt.Printf("Failed to create temp dir: %v\n", err)
-		os.Exit(1)
+// parseEngines splits and checks the -engines list
+func parseEngines(list string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if _, ok := engineLabels[name]; !ok {
+			return nil, fmt.Errorf("unknown engine in -engines: %s (must be hashindex, lsm or btree)", name)
+		}
+		seen[name] = true
+		names = append(names, name)
 	}
-	defer os.RemoveAll(dir)
-
-	lsmConfig := lsm.DefaultConfig(dir)
-	l, err := lsm.NewAdapter(lsmConfig)
-	if err != nil {
-		fmt.Printf("Failed to create LSM: %v\n", err)
-		os.Exit(1)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("-engines lists no engines")
 	}
-	defer l.Close()
-
-	results := runBenchmarks(l, "LSM-Tree", configs)
-	printSummaryTable(results)
-
-	// Run LSM-specific range scan benchmark
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("LSM-TREE RANGE SCAN BENCHMARK")
-	fmt.Println(strings.Repeat("=", 80))
-	runLSMRangeScanBenchmark(l)
+	return names, nil
 }
 
-func runBTree(configs []benchmark.Config) {
-	fmt.Println("=== B-Tree Benchmark ===\n")
-
-	dir, err := os.MkdirTemp("", "benchmark-btree-*")
+// openEngine creates an engine in its own temp dir. cleanup closes the
+// engine and removes the dir.
+func openEngine(name string) (engine common.StorageEngine, cleanup func(), err error) {
+	dir, err := os.MkdirTemp("", "benchmark-"+name+"-*")
 	if err != nil {
-		fmt.Printf("Failed to create temp dir: %v\n", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("failed to create temp dir: %w", err)
 	}
-	defer os.RemoveAll(dir)
 
-	btreeConfig := btree.DefaultConfig(dir)
-	b, err := btree.New(btreeConfig)
+	engine, err = openEngineAt(name, dir)
 	if err != nil {
-		fmt.Printf("Failed to create B-Tree: %v\n", err)
-		os.Exit(1)
+		os.RemoveAll(dir)
+		return nil, nil, err
 	}
-	defer b.Close()
 
-	results := runBenchmarks(b, "B-Tree", configs)
-	printSummaryTable(results)
-
-	// Run B-Tree-specific range scan benchmark
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("B-TREE RANGE SCAN BENCHMARK")
-	fmt.Println(strings.Repeat("=", 80))
-	runBTreeRangeScanBenchmark(b)
+	return engine, func() {
+		engine.Close()
+		os.RemoveAll(dir)
+	}, nil
 }
 
-func runComparison(configs []benchmark.Config) {
-	fmt.Println("=== Comparing HashIndex vs. LSM-Tree vs. B-Tree ===\n")
-
-	// Create temp directories
-	hashDir, err := os.MkdirTemp("", "benchmark-hashindex-*")
-	if err != nil {
-		fmt.Printf("Failed to create temp dir: %v\n", err)
-		os.Exit(1)
+// openEngineAt opens an engine over the data in dir, creating it if
+// there is none
+func openEngineAt(name, dir string) (engine common.StorageEngine, err error) {
+	switch name {
+	case "hashindex":
+		// Engines run with their default durability; -sync adds the same
+		// syncing to each
+		engine, err = hashindex.New(hashindex.DefaultConfig(dir))
+	case "lsm":
+		engine, err = lsm.NewAdapter(lsm.DefaultConfig(dir))
+	case "btree":
+		engine, err = btree.NewAdapter(btree.DefaultConfig(dir))
+	default:
+		err = fmt.Errorf("unknown engine %s", name)
 	}
-	defer os.RemoveAll(hashDir)
-
-	lsmDir, err := os.MkdirTemp("", "benchmark-lsm-*")
 	if err != nil {
-		fmt.Printf("Failed to create temp dir: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to create %s: %w", engineLabels[name], err)
 	}
-	defer os.RemoveAll(lsmDir)
+	return engine, nil
+}
 
-	btreeDir, err := os.MkdirTemp("", "benchmark-btree-*")
-	if err != nil {
-		fmt.Printf("Failed to create temp dir: %v\n", err)
-		os.Exit(1)
-	}
-	defer os.RemoveAll(btreeDir)
+func runEngine(name string, configs []benchmark.Config, profile *benchmark.Profile, traceDir string) {
+	fmt.Printf("=== %s Benchmark ===\n\n", engineLabels[name])
 
-	// Create engines
-	hashConfig := hashindex.DefaultConfig(hashDir)
-	hashConfig.SyncOnWrite = false
-	h, err := hashindex.New(hashConfig)
+	engine, cleanup, err := openEngine(name)
 	if err != nil {
-		fmt.Printf("Failed to create HashIndex: %v\n", err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer h.Close()
+	defer cleanup()
 
-	lsmConfig := lsm.DefaultConfig(lsmDir)
-	l, err := lsm.NewAdapter(lsmConfig)
-	if err != nil {
-		fmt.Printf("Failed to create LSM: %v\n", err)
-		os.Exit(1)
-	}
-	defer l.Close()
+	results := runBenchmarks(engine, engineLabels[name], configs, profile, traceDir)
+	printSummaryTable(results)
+}
 
-	btreeConfig := btree.DefaultConfig(btreeDir)
-	b, err := btree.New(btreeConfig)
-	if err != nil {
-		fmt.Printf("Failed to create B-Tree: %v\n", err)
-		os.Exit(1)
+func runComparison(configs []benchmark.Config, names []string, parallel bool, profile *benchmark.Profile) {
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = engineLabels[name]
 	}
-	defer b.Close()
+	fmt.Printf("=== Comparing %s ===\n\n", strings.Join(labels, " vs. "))
 
-	// Create engine map
-	engines := map[string]common.StorageEngine{
-		"HashIndex": h,
-		"LSM-Tree":  l,
-		"B-Tree":    b,
+	// Each engine gets its own temp dir
+	engines := make([]benchmark.NamedEngine, 0, len(names))
+	for _, name := range names {
+		engine, cleanup, err := openEngine(name)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer cleanup()
+		engines = append(engines, benchmark.NamedEngine{Name: engineLabels[name], Engine: engine})
 	}
 
 	// Run comparison
 	suite := benchmark.NewComparisonSuite()
 	suite.SetWorkloads(configs)
-	results := suite.RunComparison(engines)
+	suite.SetParallel(parallel)
+	suite.SetProfile(profile)
+	results := suite.Run(engines)
 
 	// Print comparison table
 	fmt.Println("\n" + strings.Repeat("=", 80))
@@ -228,14 +364,22 @@ func runComparison(configs []benchmark.Config) {
 	suite.PrintComparisonTable(results)
 }
 
-func runBenchmarks(engine common.StorageEngine, name string, configs []benchmark.Config) []*benchmark.Result {
+func runBenchmarks(engine common.StorageEngine, name string, configs []benchmark.Config, profile *benchmark.Profile, traceDir string) []*benchmark.Result {
 	results := make([]*benchmark.Result, 0)
 
 	for _, config := range configs {
-		fmt.Printf("\n=== Running: %s ===\n", config.Name)
+		fmt.Printf("\n=== Running: %s (sync: %s) ===\n", config.Name, config.Sync)
 
 		bench := benchmark.NewBenchmark(engine, config)
+		bench.SetProfile(profile, name)
+		if traceDir != "" {
+			bench.RecordTrace()
+		}
 		result, err := bench.Run()
+		if errors.Is(err, benchmark.ErrScanNotSupported) {
+			fmt.Printf("Skipping: %s cannot run %v\n", name, err)
+			continue
+		}
 		if err != nil {
 			fmt.Printf("Benchmark failed: %v\n", err)
 			continue
@@ -243,16 +387,110 @@ func runBenchmarks(engine common.StorageEngine, name string, configs []benchmark
 
 		results = append(results, result)
 		printResult(result)
+
+		if traceDir != "" {
+			if err := saveTrace(bench.Trace(), traceDir, name); err != nil {
+				fmt.Printf("Failed to save trace: %v\n", err)
+			}
+		}
 	}
 
 	return results
 }
 
+// saveTrace writes a recorded trace to <dir>/<engine>-<workload>.ops
+func saveTrace(trace *benchmark.Trace, dir, engine string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := strings.ToLower(engine + "-" + trace.Config.Name + ".ops")
+	path := filepath.Join(dir, name)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := trace.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Trace: %d operations written to %s\n", trace.Len(), path)
+	return nil
+}
+
+// runReplay replays a recorded trace against each engine in turn, on a
+// fresh instance, and compares the results if there are several
+// runReplay replays a trace on each engine, once per sync mode, or once
+// with its recorded mode if modes is empty
+func runReplay(path string, names []string, modes []benchmark.SyncMode, opts benchmark.ReplayOptions) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Failed to open trace: %v\n", err)
+		os.Exit(1)
+	}
+	trace, err := benchmark.LoadTrace(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("Failed to load trace %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("=== Replaying %s: %s, %d operations ===\n", path, trace.Config.Name, trace.Len())
+
+	configs := []benchmark.Config{trace.Config}
+	if len(modes) > 0 {
+		configs = configs[:0]
+		for _, mode := range modes {
+			config := trace.Config
+			config.Sync = mode
+			configs = append(configs, config)
+		}
+	}
+
+	results := make(map[string][]*benchmark.Result)
+	for _, name := range names {
+		for _, config := range configs {
+			fmt.Printf("\n=== %s (sync: %s) ===\n", engineLabels[name], cmp.Or(config.Sync, benchmark.SyncNone))
+			engine, cleanup, err := openEngine(name)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			result, err := benchmark.NewBenchmark(engine, config).Replay(trace, opts)
+			cleanup()
+			if errors.Is(err, benchmark.ErrScanNotSupported) {
+				fmt.Printf("Skipping: %s cannot run %v\n", engineLabels[name], err)
+				break
+			}
+			if err != nil {
+				fmt.Printf("Replay failed: %v\n", err)
+				continue
+			}
+
+			results[engineLabels[name]] = append(results[engineLabels[name]], result)
+			printResult(result)
+		}
+	}
+
+	if len(names) > 1 || len(configs) > 1 {
+		suite := benchmark.NewComparisonSuite()
+		suite.SetWorkloads(configs)
+		suite.PrintComparisonTable(results)
+	}
+}
+
 func printResult(r *benchmark.Result) {
 	fmt.Printf("\n--- Results ---\n")
+	fmt.Printf("Sync: %s\n", r.Config.Sync)
 	fmt.Printf("Throughput: %.0f ops/sec\n", r.OpsPerSec)
-	fmt.Printf("Total Ops: %d (writes: %d, reads: %d)\n",
-		r.TotalOps, r.WriteOps, r.ReadOps)
+	fmt.Printf("Total Ops: %d (writes: %d, reads: %d, scans: %d, deletes: %d, updates: %d)\n",
+		r.TotalOps, r.WriteOps, r.ReadOps, r.ScanOps, r.DeleteOps, r.UpdateOps)
+	if r.Errors > 0 {
+		fmt.Printf("Errors: %d\n", r.Errors)
+	}
 
 	if r.WriteOps > 0 {
 		fmt.Printf("\nWrite Latency:\n")
@@ -276,8 +514,43 @@ func printResult(r *benchmark.Result) {
 		fmt.Printf("  Max:  %8s\n", r.ReadLatency.Max)
 	}
 
+	if r.ScanOps > 0 {
+		fmt.Printf("\nScan Latency (up to %d keys):\n", r.Config.ScanLength)
+		fmt.Printf("  Min:  %8s\n", r.ScanLatency.Min)
+		fmt.Printf("  Mean: %8s\n", r.ScanLatency.Mean)
+		fmt.Printf("  P50:  %8s\n", r.ScanLatency.P50)
+		fmt.Printf("  P95:  %8s\n", r.ScanLatency.P95)
+		fmt.Printf("  P99:  %8s\n", r.ScanLatency.P99)
+		fmt.Printf("  P999: %8s\n", r.ScanLatency.P999)
+		fmt.Printf("  Max:  %8s\n", r.ScanLatency.Max)
+		fmt.Printf("Scanned: %.0f keys/sec (%d keys)\n", r.ScanKeysPerSec, r.ScanKeys)
+	}
+
+	if r.DeleteOps > 0 {
+		fmt.Printf("\nDelete Latency:\n")
+		fmt.Printf("  Min:  %8s\n", r.DeleteLatency.Min)
+		fmt.Printf("  Mean: %8s\n", r.DeleteLatency.Mean)
+		fmt.Printf("  P50:  %8s\n", r.DeleteLatency.P50)
+		fmt.Printf("  P95:  %8s\n", r.DeleteLatency.P95)
+		fmt.Printf("  P99:  %8s\n", r.DeleteLatency.P99)
+		fmt.Printf("  P999: %8s\n", r.DeleteLatency.P999)
+		fmt.Printf("  Max:  %8s\n", r.DeleteLatency.Max)
+	}
+
+	if r.UpdateOps > 0 {
+		fmt.Printf("\nUpdate Latency:\n")
+		fmt.Printf("  Min:  %8s\n", r.UpdateLatency.Min)
+		fmt.Printf("  Mean: %8s\n", r.UpdateLatency.Mean)
+		fmt.Printf("  P50:  %8s\n", r.UpdateLatency.P50)
+		fmt.Printf("  P95:  %8s\n", r.UpdateLatency.P95)
+		fmt.Printf("  P99:  %8s\n", r.UpdateLatency.P99)
+		fmt.Printf("  P999: %8s\n", r.UpdateLatency.P999)
+		fmt.Printf("  Max:  %8s\n", r.UpdateLatency.Max)
+	}
+
 	fmt.Printf("\nAmplification:\n")
 	fmt.Printf("  Write: %.2fx\n", r.WriteAmplification)
+	fmt.Printf("  Read:  %.2f avg, %.0f p99 (units touched per Get)\n", r.ReadAmplification, r.ReadAmpP99)
 	fmt.Printf("  Space: %.2fx\n", r.SpaceAmplification)
 	fmt.Printf("\nDisk Usage: %.1f MB\n", r.TotalDiskMB)
 }
@@ -291,9 +564,9 @@ func printSummaryTable(results []*benchmark.Result) {
 	fmt.Println("BENCHMARK SUMMARY")
 	fmt.Println(strings.Repeat("=", 80))
 
-	fmt.Printf("\n%-25s %12s %12s %12s %12s\n",
-		"Workload", "Throughput", "Write P99", "Read P99", "Write Amp")
-	fmt.Println("--------------------------------------------------------------------------------")
+	fmt.Printf("\n%-25s %-6s %12s %12s %12s %12s %12s %12s\n",
+		"Workload", "Sync", "Throughput", "Write P99", "Read P99", "Scan P99", "Write Amp", "Read Amp")
+	fmt.Println("----------------------------------------------------------------------------------------------------")
 
 	for _, r := range results {
 		writeP99 := "N/A"
@@ -306,103 +579,19 @@ func printSummaryTable(results []*benchmark.Result) {
 			readP99 = fmt.Sprintf("%s", r.ReadLatency.P99)
 		}
 
-		fmt.Printf("%-25s %10.0f/s %12s %12s %11.2fx\n",
+		scanP99 := "N/A"
+		if r.ScanOps > 0 {
+			scanP99 = fmt.Sprintf("%s", r.ScanLatency.P99)
+		}
+
+		fmt.Printf("%-25s %-6s %10.0f/s %12s %12s %12s %11.2fx %12.2f\n",
 			r.Config.Name,
+			r.Config.Sync,
 			r.OpsPerSec,
 			writeP99,
 			readP99,
-			r.WriteAmplification)
-	}
-}
-
-func runLSMRangeScanBenchmark(adapter *lsm.Adapter) {
-	fmt.Println("\nPreparing range scan test data...")
-
-	// Insert sequential keys for range scanning
-	numKeys := 10000
-	for i := 0; i < numKeys; i++ {
-		key := fmt.Sprintf("user:%06d", i)
-		value := []byte(fmt.Sprintf(`{"id": %d, "name": "user%d"}`, i, i))
-		adapter.Put([]byte(key), value)
-	}
-
-	fmt.Println("Running range scans...")
-
-	// Test different range sizes
-	ranges := []struct {
-		name  string
-		start string
-		end   string
-	}{
-		{"Small (100 keys)", "user:000000", "user:000100"},
-		{"Medium (1000 keys)", "user:000000", "user:001000"},
-		{"Large (5000 keys)", "user:000000", "user:005000"},
-		{"Full scan", "user:000000", "user:999999"},
-	}
-
-	for _, r := range ranges {
-		start := time.Now()
-		iter := adapter.Scan(r.start, r.end)
-		count := 0
-		for iter.Valid() {
-			count++
-			iter.Next()
-		}
-		elapsed := time.Since(start)
-
-		throughput := float64(count) / elapsed.Seconds()
-		avgLatency := elapsed / time.Duration(count)
-
-		fmt.Printf("\n%s:\n", r.name)
-		fmt.Printf("  Keys scanned: %d\n", count)
-		fmt.Printf("  Duration:     %v\n", elapsed)
-		fmt.Printf("  Throughput:   %.0f keys/sec\n", throughput)
-		fmt.Printf("  Avg latency:  %v per key\n", avgLatency)
-	}
-}
-
-func runBTreeRangeScanBenchmark(bt *btree.BTree) {
-	fmt.Println("\nPreparing range scan test data...")
-
-	// Insert sequential keys for range scanning
-	numKeys := 10000
-	for i := 0; i < numKeys; i++ {
-		key := fmt.Sprintf("user:%06d", i)
-		value := []byte(fmt.Sprintf(`{"id": %d, "name": "user%d"}`, i, i))
-		bt.Put([]byte(key), value)
-	}
-
-	fmt.Println("Running range scans...")
-
-	// Test different range sizes
-	ranges := []struct {
-		name  string
-		start string
-		end   string
-	}{
-		{"Small (100 keys)", "user:000000", "user:000100"},
-		{"Medium (1000 keys)", "user:000000", "user:001000"},
-		{"Large (5000 keys)", "user:000000", "user:005000"},
-		{"Full scan", "user:000000", "user:999999"},
-	}
-
-	for _, r := range ranges {
-		start := time.Now()
-		iter, _ := bt.Scan([]byte(r.start), []byte(r.end))
-		count := 0
-		for iter.Next() {
-			count++
-		}
-		iter.Close()
-		elapsed := time.Since(start)
-
-		throughput := float64(count) / elapsed.Seconds()
-		avgLatency := elapsed / time.Duration(count)
-
-		fmt.Printf("\n%s:\n", r.name)
-		fmt.Printf("  Keys scanned: %d\n", count)
-		fmt.Printf("  Duration:     %v\n", elapsed)
-		fmt.Printf("  Throughput:   %.0f keys/sec\n", throughput)
-		fmt.Printf("  Avg latency:  %v per key\n", avgLatency)
+			scanP99,
+			r.WriteAmplification,
+			r.ReadAmplification)
 	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/common/benchmark"
+)
+
+// A crash restart loads its data in a child process, the benchmark run
+// again with these set: it opens the engine named by crashEngineEnv over
+// the directory crashDirEnv names, loads the dataset, writes how long
+// that took to crashLoadFile there and exits without closing the engine.
+const (
+	crashEngineEnv = "BENCHMARK_CRASH_ENGINE"
+	crashDirEnv    = "BENCHMARK_CRASH_DIR"
+	crashLoadFile  = "load-time"
+)
+
+// runRestart runs the restart benchmark on each engine and prints a
+// summary
+func runRestart(names []string, config benchmark.RestartConfig) {
+	mode := "close"
+	if config.Crash {
+		mode = "crash"
+	}
+	fmt.Printf("=== Restart Benchmark: %d keys, %s ===\n", config.NumKeys, mode)
+
+	var results []*benchmark.RestartResult
+	var labels []string
+	for _, name := range names {
+		fmt.Printf("\n=== %s ===\n", engineLabels[name])
+		result, err := restartEngine(name, config)
+		if err != nil {
+			fmt.Printf("Restart benchmark failed: %v\n", err)
+			continue
+		}
+		results = append(results, result)
+		labels = append(labels, engineLabels[name])
+		fmt.Printf("Reopen: %s, first read: %s, missing %d of %d sampled keys\n",
+			result.Reopen, result.FirstRead, result.Missing, result.Sampled)
+	}
+
+	printRestartSummary(labels, results)
+}
+
+// restartEngine runs the restart benchmark on one engine, in a temp dir
+func restartEngine(name string, config benchmark.RestartConfig) (*benchmark.RestartResult, error) {
+	base, err := os.MkdirTemp("", "benchmark-restart-"+name+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(base)
+	dir := filepath.Join(base, "data")
+
+	open := func() (common.StorageEngine, error) {
+		return openEngineAt(name, dir)
+	}
+	if !config.Crash {
+		return benchmark.RunRestart(open, config)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	child := exec.Command(exe, os.Args[1:]...)
+	child.Env = append(os.Environ(), crashEngineEnv+"="+name, crashDirEnv+"="+base)
+	child.Stdout, child.Stderr = os.Stdout, os.Stderr
+	if err := child.Run(); err != nil {
+		return nil, fmt.Errorf("loading process failed: %w", err)
+	}
+
+	result, err := benchmark.MeasureRestart(open, config)
+	if err != nil {
+		return nil, err
+	}
+	if data, err := os.ReadFile(filepath.Join(base, crashLoadFile)); err == nil {
+		ns, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		result.Load = time.Duration(ns)
+	}
+	return result, nil
+}
+
+// runCrashChild loads a crash restart's dataset and exits without closing
+// the engine, if this process was started to; otherwise it returns
+func runCrashChild(config benchmark.RestartConfig) {
+	name, base := os.Getenv(crashEngineEnv), os.Getenv(crashDirEnv)
+	if name == "" || base == "" {
+		return
+	}
+
+	engine, err := openEngineAt(name, filepath.Join(base, "data"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	load, err := benchmark.LoadRestartData(engine, config)
+	if err != nil {
+		fmt.Printf("Load failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(filepath.Join(base, crashLoadFile), []byte(strconv.FormatInt(load.Nanoseconds(), 10)), 0644); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Crashing...")
+	os.Exit(0)
+}
+
+func printRestartSummary(labels []string, results []*benchmark.RestartResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	fmt.Println("\n" + strings.Repeat("=", 80))
+	fmt.Println("RESTART SUMMARY")
+	fmt.Println(strings.Repeat("=", 80))
+
+	fmt.Printf("\n%-12s %12s %12s %12s %12s %10s %10s\n",
+		"Engine", "Load", "Close", "Reopen", "First Read", "Missing", "Disk MB")
+	fmt.Println("------------------------------------------------------------------------------------")
+
+	for i, r := range results {
+		closeTime := "crash"
+		if !r.Config.Crash {
+			closeTime = r.Close.Round(time.Microsecond).String()
+		}
+		fmt.Printf("%-12s %12s %12s %12s %12s %10s %10.1f\n",
+			labels[i],
+			r.Load.Round(time.Millisecond),
+			closeTime,
+			r.Reopen.Round(time.Microsecond),
+			r.FirstRead.Round(time.Microsecond),
+			fmt.Sprintf("%d/%d", r.Missing, r.Sampled),
+			r.TotalDiskMB)
+	}
+}
@@ -209,6 +209,7 @@ func demoLSM() {
 		iter.Next()
 		count++
 	}
+	iter.Close()
 	fmt.Printf("   ... found %d total user keys\n", count)
 
 	// Scan 2: Specific range
@@ -218,6 +219,7 @@ func demoLSM() {
 		fmt.Printf("   %s -> %s\n", iter2.Key(), truncate(string(iter2.Value()), 40))
 		iter2.Next()
 	}
+	iter2.Close()
 
 	// Scan 3: Different prefix
 	fmt.Println("\n3. Scan all products:")
@@ -228,6 +230,7 @@ func demoLSM() {
 		iter3.Next()
 		productCount++
 	}
+	iter3.Close()
 	fmt.Printf("   Found %d product keys\n", productCount)
 
 	// Demonstrate sorted iteration
@@ -247,6 +250,7 @@ func demoLSM() {
 		iter4.Next()
 		allKeys++
 	}
+	iter4.Close()
 	if allKeys > 5 {
 		fmt.Printf("   %s (last key)\n", lastKey)
 	}
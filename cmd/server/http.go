@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+const (
+	// maxValueSize bounds the request bodies of PUT /v1/keys/{key}
+	maxValueSize = 64 << 20
+
+	// defaultScanLimit and maxScanLimit bound the keys one scan returns
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+
+	// defaultRateInterval and maxRateInterval bound how long a request
+	// for rates watches the engine
+	defaultRateInterval = time.Second
+	maxRateInterval     = time.Minute
+)
+
+// basicAuthConfig holds the credentials requests must present
+type basicAuthConfig struct {
+	user     string
+	password string
+}
+
+// httpAPI serves an engine over HTTP:
+//
+//	PUT    /v1/keys/{key}              store the request body as key's value
+//	GET    /v1/keys/{key}              return key's value as the response body
+//	DELETE /v1/keys/{key}              delete key
+//	GET    /v1/scan?start=&end=&limit= list keys in [start, end) as JSON
+//	GET    /v1/stats                   the engine's Stats as JSON
+//	GET    /v1/stats/rates?interval=   what changed over interval, and how fast
+//	GET    /healthz                    the engine's Health as JSON, 503 if not OK
+//
+// Keys may contain slashes. Errors are returned as {"error": "..."}.
+type httpAPI struct {
+	engine common.StorageEngine
+}
+
+// newHTTPHandler returns the HTTP API for engine, requiring auth if it
+// isn't nil
+func newHTTPHandler(engine common.StorageEngine, auth *basicAuthConfig) http.Handler {
+	api := &httpAPI{engine: engine}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /v1/keys/{key...}", api.put)
+	mux.HandleFunc("GET /v1/keys/{key...}", api.get)
+	mux.HandleFunc("DELETE /v1/keys/{key...}", api.delete)
+	mux.HandleFunc("GET /v1/scan", api.scan)
+	mux.HandleFunc("GET /v1/stats", api.stats)
+	mux.HandleFunc("GET /v1/stats/rates", api.rates)
+	mux.HandleFunc("GET /healthz", api.health)
+
+	if auth == nil {
+		return mux
+	}
+	return requireBasicAuth(mux, auth)
+}
+
+// requireBasicAuth rejects requests without auth's credentials
+func requireBasicAuth(next http.Handler, auth *basicAuthConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		// Compare both in constant time, so timing reveals neither
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(auth.user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(auth.password)) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="storage-engines"`)
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pathKey returns the key a /v1/keys/{key} request names. Not every engine
+// rejects empty keys itself.
+func pathKey(r *http.Request) ([]byte, error) {
+	key := r.PathValue("key")
+	if key == "" {
+		return nil, common.ErrKeyEmpty
+	}
+	return []byte(key), nil
+}
+
+func (api *httpAPI) put(w http.ResponseWriter, r *http.Request) {
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	key, err := pathKey(r)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	if err := api.engine.Put(key, value); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *httpAPI) get(w http.ResponseWriter, r *http.Request) {
+	key, err := pathKey(r)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	value, err := api.engine.Get(key)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.Write(value)
+}
+
+func (api *httpAPI) delete(w http.ResponseWriter, r *http.Request) {
+	key, err := pathKey(r)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	if err := api.engine.Delete(key); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scanItem is one key of a scan response
+type scanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// scanResponse is the body of a scan. Next is set when the scan stopped at
+// the limit: passed as start, it continues after the last key returned.
+type scanResponse struct {
+	Items []scanItem `json:"items"`
+	Next  *string    `json:"next,omitempty"`
+}
+
+// scan lists keys in [start, end), up to limit of them. Keys and values
+// are returned as strings, or base64 with encoding=base64 for binary data.
+func (api *httpAPI) scan(w http.ResponseWriter, r *http.Request) {
+	scanner, ok := api.engine.(common.Scanner)
+	if !ok {
+		writeEngineError(w, common.ErrNotSupported)
+		return
+	}
+
+	query := r.URL.Query()
+	encode := func(b []byte) string { return string(b) }
+	switch query.Get("encoding") {
+	case "":
+	case "base64":
+		encode = base64.StdEncoding.EncodeToString
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("encoding must be base64 or omitted"))
+		return
+	}
+
+	limit := defaultScanLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a positive integer"))
+			return
+		}
+		limit = min(n, maxScanLimit)
+	}
+
+	start, err := decodeScanKey(query.Get("start"), query.Get("encoding"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var end []byte // Unbounded
+	if s := query.Get("end"); s != "" {
+		if end, err = decodeScanKey(s, query.Get("encoding")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	it, err := scanner.Scan(start, end)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	defer it.Close()
+
+	resp := scanResponse{Items: []scanItem{}}
+	var last []byte
+	for it.Next() {
+		if len(resp.Items) == limit {
+			next := encode(append(last, 0))
+			resp.Next = &next
+			break
+		}
+		last = append(last[:0], it.Key()...)
+		resp.Items = append(resp.Items, scanItem{Key: encode(it.Key()), Value: encode(it.Value())})
+	}
+	if err := it.Error(); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// decodeScanKey decodes a start or end query parameter
+func decodeScanKey(s, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func (api *httpAPI) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.engine.Stats())
+}
+
+// rates takes the engine's Stats twice, interval apart, and returns the
+// difference (see common.StatsDelta) and the rates it works out to
+func (api *httpAPI) rates(w http.ResponseWriter, r *http.Request) {
+	interval := defaultRateInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxRateInterval {
+			writeError(w, http.StatusBadRequest, errors.New("interval must be a duration up to 1m, e.g. 1s"))
+			return
+		}
+		interval = d
+	}
+
+	before := api.engine.Stats()
+	start := time.Now()
+	select {
+	case <-time.After(interval):
+	case <-r.Context().Done():
+		return
+	}
+	after := api.engine.Stats()
+	elapsed := time.Since(start)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"delta": common.StatsDelta(before, after),
+		"rates": common.Rates(before, after, elapsed),
+	})
+}
+
+// healthResponse is the body of /healthz: the engine's Health, with the
+// WAL error as its message, which JSON can't otherwise show
+type healthResponse struct {
+	common.Health
+	WALError string `json:"WALError,omitempty"`
+}
+
+// health serves the engine's Health for readiness probes, with 503 while
+// it has problems
+func (api *httpAPI) health(w http.ResponseWriter, r *http.Request) {
+	h := api.engine.Health()
+	resp := healthResponse{Health: h}
+	if h.WALError != nil {
+		resp.WALError = h.WALError.Error()
+	}
+	status := http.StatusOK
+	if !h.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// writeEngineError reports an engine error with the matching status
+func writeEngineError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, common.ErrKeyNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, common.ErrKeyEmpty):
+		status = http.StatusBadRequest
+	case errors.Is(err, common.ErrNotSupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, common.ErrDiskFull), errors.Is(err, common.ErrMemoryBudget):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, common.ErrClosed):
+		status = http.StatusServiceUnavailable
+	}
+	if status == http.StatusInternalServerError {
+		log.Printf("Warning: request failed: %v", err)
+	}
+	writeError(w, status, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Warning: writing response: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// openTestLSM opens an LSM-Tree in memory
+func openTestLSM(t *testing.T) common.StorageEngine {
+	t.Helper()
+	config := lsm.DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	engine, err := lsm.NewAdapter(config)
+	if err != nil {
+		t.Fatalf("Failed to open LSM: %v", err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+// do sends a request to h, returning the status and body
+func do(t *testing.T, h http.Handler, method, target, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestHTTPKeys(t *testing.T) {
+	h := newHTTPHandler(openTestLSM(t), nil)
+
+	if status, body := do(t, h, "PUT", "/v1/keys/users/1001", `{"name": "Alice"}`); status != http.StatusNoContent {
+		t.Fatalf("PUT returned %d: %s", status, body)
+	}
+	status, body := do(t, h, "GET", "/v1/keys/users/1001", "")
+	if status != http.StatusOK || body != `{"name": "Alice"}` {
+		t.Errorf("GET returned %d %q", status, body)
+	}
+
+	if status, body := do(t, h, "DELETE", "/v1/keys/users/1001", ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d: %s", status, body)
+	}
+	status, body = do(t, h, "GET", "/v1/keys/users/1001", "")
+	if status != http.StatusNotFound {
+		t.Errorf("GET of a deleted key returned %d %q", status, body)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal([]byte(body), &resp); err != nil || resp["error"] == "" {
+		t.Errorf("Error body %q is not {\"error\": ...}", body)
+	}
+
+	if status, _ := do(t, h, "POST", "/v1/keys/a", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d, want %d", status, http.StatusMethodNotAllowed)
+	}
+	if status, _ := do(t, h, "GET", "/v1/keys/", ""); status != http.StatusBadRequest {
+		t.Errorf("GET of an empty key returned %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestHTTPValueTooLarge(t *testing.T) {
+	h := newHTTPHandler(openTestLSM(t), nil)
+	req := httptest.NewRequest("PUT", "/v1/keys/big", io.LimitReader(zeros{}, maxValueSize+1))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT of an oversized value returned %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// zeros reads as an endless run of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestHTTPScanPaging(t *testing.T) {
+	engine := openTestLSM(t)
+	for i := 0; i < 25; i++ {
+		if err := engine.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	engine.Put([]byte("other"), []byte("x"))
+	h := newHTTPHandler(engine, nil)
+
+	// Page through [key, key~) ten at a time, following next
+	var got []string
+	query := url.Values{"start": {"key"}, "end": {"key~"}, "limit": {"10"}}
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatal("Scan did not end after 3 pages")
+		}
+		status, body := do(t, h, "GET", "/v1/scan?"+query.Encode(), "")
+		if status != http.StatusOK {
+			t.Fatalf("Scan returned %d: %s", status, body)
+		}
+		var resp scanResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("Bad scan response %q: %v", body, err)
+		}
+		for _, item := range resp.Items {
+			if item.Value != "value"+strings.TrimPrefix(item.Key, "key") {
+				t.Errorf("Key %s has value %s", item.Key, item.Value)
+			}
+			got = append(got, item.Key)
+		}
+		if resp.Next == nil {
+			break
+		}
+		query.Set("start", *resp.Next)
+	}
+	if len(got) != 25 {
+		t.Fatalf("Scan returned %d keys, want 25: %v", len(got), got)
+	}
+	for i, key := range got {
+		if key != fmt.Sprintf("key%02d", i) {
+			t.Fatalf("Key %d is %s", i, key)
+		}
+	}
+
+	// Binary keys round trip through base64, next included
+	status, body := do(t, h, "GET", "/v1/scan?encoding=base64&limit=1&start=a2V5MDU%3D", "")
+	if status != http.StatusOK {
+		t.Fatalf("Scan returned %d: %s", status, body)
+	}
+	var resp scanResponse
+	json.Unmarshal([]byte(body), &resp)
+	if len(resp.Items) != 1 || resp.Items[0].Key != "a2V5MDU=" || resp.Next == nil || *resp.Next != "a2V5MDUA" {
+		t.Errorf("Base64 scan returned %s", body)
+	}
+
+	for _, bad := range []string{"limit=0", "limit=x", "encoding=hex", "encoding=base64&start=%21"} {
+		if status, _ := do(t, h, "GET", "/v1/scan?"+bad, ""); status != http.StatusBadRequest {
+			t.Errorf("Scan with %s returned %d, want %d", bad, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHTTPScanNotSupported(t *testing.T) {
+	config := hashindex.DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	engine, err := hashindex.New(config)
+	if err != nil {
+		t.Fatalf("Failed to open hash index: %v", err)
+	}
+	defer engine.Close()
+
+	h := newHTTPHandler(engine, nil)
+	if status, _ := do(t, h, "GET", "/v1/scan", ""); status != http.StatusNotImplemented {
+		t.Errorf("Scan of the hash index returned %d, want %d", status, http.StatusNotImplemented)
+	}
+}
+
+func TestWriteEngineError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{common.ErrKeyNotFound, http.StatusNotFound},
+		{fmt.Errorf("get: %w", common.ErrKeyNotFound), http.StatusNotFound},
+		{common.ErrKeyEmpty, http.StatusBadRequest},
+		{common.ErrNotSupported, http.StatusNotImplemented},
+		{common.ErrDiskFull, http.StatusInsufficientStorage},
+		{common.ErrMemoryBudget, http.StatusInsufficientStorage},
+		{common.ErrClosed, http.StatusServiceUnavailable},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeEngineError(rec, tt.err)
+		if rec.Code != tt.status {
+			t.Errorf("%v: status %d, want %d", tt.err, rec.Code, tt.status)
+		}
+		var resp map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp["error"] != tt.err.Error() {
+			t.Errorf("%v: body %q", tt.err, rec.Body)
+		}
+	}
+}
+
+func TestHTTPHealth(t *testing.T) {
+	engine := openTestLSM(t)
+	h := newHTTPHandler(engine, nil)
+
+	status, body := do(t, h, "GET", "/healthz", "")
+	if status != http.StatusOK {
+		t.Fatalf("Health of an open engine returned %d: %s", status, body)
+	}
+	var health healthResponse
+	if err := json.Unmarshal([]byte(body), &health); err != nil || !health.OK {
+		t.Errorf("Health body %q", body)
+	}
+
+	engine.Close()
+	status, body = do(t, h, "GET", "/healthz", "")
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("Health of a closed engine returned %d: %s", status, body)
+	}
+	if err := json.Unmarshal([]byte(body), &health); err != nil || health.OK || !health.Closed || len(health.Problems) == 0 {
+		t.Errorf("Health body %q", body)
+	}
+	if status, _ := do(t, h, "GET", "/v1/keys/a", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("GET on a closed engine returned %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHTTPBasicAuth(t *testing.T) {
+	h := newHTTPHandler(openTestLSM(t), &basicAuthConfig{user: "admin", password: "secret"})
+
+	tests := []struct {
+		name           string
+		user, password string
+		noAuth         bool
+		status         int
+	}{
+		{"none", "", "", true, http.StatusUnauthorized},
+		{"wrong password", "admin", "guess", false, http.StatusUnauthorized},
+		{"wrong user", "root", "secret", false, http.StatusUnauthorized},
+		{"password prefix", "admin", "secre", false, http.StatusUnauthorized},
+		{"right", "admin", "secret", false, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		for _, target := range []string{"/v1/keys/missing", "/healthz"} {
+			req := httptest.NewRequest("GET", target, nil)
+			if !tt.noAuth {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			want := tt.status
+			if target == "/healthz" && want != http.StatusUnauthorized {
+				want = http.StatusOK
+			}
+			if rec.Code != want {
+				t.Errorf("%s: GET %s returned %d, want %d", tt.name, target, rec.Code, want)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: 401 without WWW-Authenticate", tt.name)
+			}
+		}
+	}
+}
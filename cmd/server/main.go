@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/intellect4all/storage-engines/btree"
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// shutdownTimeout is how long in-flight requests get to finish on exit
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	engineName := flag.String("engine", "lsm", "Engine to serve: hashindex, lsm or btree")
+	dir := flag.String("dir", "./data", "Data directory")
+	httpAddr := flag.String("http", ":8080", "Address for the HTTP API")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (serves HTTPS with -tls-key)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	basicAuth := flag.String("basic-auth", "", "Require HTTP basic auth as user:password (default: $SERVER_BASIC_AUTH, or none)")
+	memcachedAddr := flag.String("memcached", "", "Also serve the memcached text protocol on this address (default: off)")
+	flag.Parse()
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+
+	credentials := *basicAuth
+	if credentials == "" {
+		credentials = os.Getenv("SERVER_BASIC_AUTH")
+	}
+	var auth *basicAuthConfig
+	if credentials != "" {
+		user, password, ok := strings.Cut(credentials, ":")
+		if !ok || user == "" {
+			log.Fatal("basic auth must be given as user:password")
+		}
+		auth = &basicAuthConfig{user: user, password: password}
+	}
+
+	engine, err := openEngine(*engineName, *dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Addr:              *httpAddr,
+		Handler:           newHTTPHandler(engine, auth),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Serve until interrupted, then let in-flight requests finish before
+	// closing the engine
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 2)
+	go func() {
+		scheme := "http"
+		if *tlsCert != "" {
+			scheme = "https"
+		}
+		log.Printf("Serving %s from %s over %s on %s", *engineName, *dir, scheme, *httpAddr)
+		if *tlsCert != "" {
+			serveErr <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	var memcached *memcachedServer
+	if *memcachedAddr != "" {
+		ln, err := net.Listen("tcp", *memcachedAddr)
+		if err != nil {
+			log.Fatalf("memcached listener: %v", err)
+		}
+		memcached = newMemcachedServer(engine)
+		go func() {
+			log.Printf("Serving memcached protocol on %s", *memcachedAddr)
+			if err := memcached.Serve(ln); !errors.Is(err, net.ErrClosed) {
+				serveErr <- fmt.Errorf("memcached: %w", err)
+			}
+		}()
+	}
+
+	select {
+	case err = <-serveErr:
+		log.Printf("Server failed: %v", err)
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: shutdown: %v", err)
+	}
+	cancel()
+	if memcached != nil {
+		memcached.Close()
+	}
+
+	if err := engine.Close(); err != nil {
+		log.Printf("Warning: closing engine: %v", err)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		os.Exit(1)
+	}
+}
+
+// openEngine opens the named engine on dir, creating it if needed
+func openEngine(name, dir string) (common.StorageEngine, error) {
+	var engine common.StorageEngine
+	var err error
+	switch name {
+	case "hashindex":
+		engine, err = hashindex.New(hashindex.DefaultConfig(dir))
+	case "lsm":
+		engine, err = lsm.NewAdapter(lsm.DefaultConfig(dir))
+	case "btree":
+		engine, err = btree.NewAdapter(btree.DefaultConfig(dir))
+	default:
+		return nil, fmt.Errorf("unknown engine %s (must be hashindex, lsm or btree)", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return engine, nil
+}
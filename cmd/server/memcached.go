@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+)
+
+const (
+	// memcachedMaxKeySize and memcachedMaxValueSize are memcached's own
+	// default limits
+	memcachedMaxKeySize   = 250
+	memcachedMaxValueSize = 1 << 20
+
+	// memcachedMaxLine bounds a command line, which holds up to a few
+	// hundred keys for a multi-get
+	memcachedMaxLine = 64 << 10
+
+	memcachedVersion = "storage-engines"
+)
+
+// errMemcachedClient is a malformed request, answered with CLIENT_ERROR
+type errMemcachedClient string
+
+func (e errMemcachedClient) Error() string { return string(e) }
+
+// memcachedServer serves an engine over the memcached text protocol, so
+// memcached clients and load generators such as memtier_benchmark can
+// drive it. It supports get, gets, set, delete, stats, version and quit.
+//
+// Items have no flags or expiry: set fails for nonzero ones, and get
+// returns flags 0 (gets a CAS value of 0). The hash index stores an empty
+// value as a deletion, so set refuses 0-byte values there. There is no
+// authentication or TLS, so it should only listen where clients are
+// trusted.
+type memcachedServer struct {
+	engine  common.StorageEngine
+	started time.Time
+
+	// emptyDeletes is set for engines that take an empty value as a delete
+	emptyDeletes bool
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+
+	currConns  atomic.Int64
+	totalConns atomic.Int64
+	cmdGet     atomic.Int64
+	cmdSet     atomic.Int64
+	getHits    atomic.Int64
+	getMisses  atomic.Int64
+	deleteHits atomic.Int64
+	deleteMiss atomic.Int64
+}
+
+func newMemcachedServer(engine common.StorageEngine) *memcachedServer {
+	_, emptyDeletes := engine.(*hashindex.HashIndex)
+	return &memcachedServer{
+		engine:       engine,
+		started:      time.Now(),
+		emptyDeletes: emptyDeletes,
+		conns:        make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on ln until Close
+func (s *memcachedServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their commands to finish
+func (s *memcachedServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// serveConn runs one client's commands until it quits or disconnects
+func (s *memcachedServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	s.currConns.Add(1)
+	s.totalConns.Add(1)
+	defer s.currConns.Add(-1)
+
+	r := bufio.NewReaderSize(conn, 16<<10)
+	w := bufio.NewWriterSize(conn, 16<<10)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				// Can't find the end of the command to carry on after it
+				w.WriteString("CLIENT_ERROR line too long\r\n")
+				w.Flush()
+			}
+			return
+		}
+
+		quit, err := s.command(line, r, w)
+		if err != nil {
+			var clientErr errMemcachedClient
+			if !errors.As(err, &clientErr) {
+				// The connection broke
+				return
+			}
+			fmt.Fprintf(w, "CLIENT_ERROR %s\r\n", clientErr)
+		}
+		if quit {
+			w.Flush()
+			return
+		}
+
+		// Answer pipelined commands together
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads a command line without its "\r\n". A line longer than
+// memcachedMaxLine returns bufio.ErrBufferFull.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > memcachedMaxLine+2 {
+			return nil, bufio.ErrBufferFull
+		}
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > memcachedMaxLine {
+		return nil, bufio.ErrBufferFull
+	}
+	return line, nil
+}
+
+// command runs one command line, reading any data block after it from r
+// and writing the reply to w. It returns true if the client quit.
+// Errors other than errMemcachedClient mean the connection broke.
+func (s *memcachedServer) command(line []byte, r *bufio.Reader, w *bufio.Writer) (bool, error) {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		_, err := w.WriteString("ERROR\r\n")
+		return false, err
+	}
+
+	switch string(fields[0]) {
+	case "get":
+		return false, s.get(fields[1:], false, w)
+	case "gets":
+		return false, s.get(fields[1:], true, w)
+	case "set":
+		return false, s.set(fields[1:], r, w)
+	case "delete":
+		return false, s.delete(fields[1:], w)
+	case "stats":
+		if len(fields) > 1 {
+			// No sub-statistics (items, slabs, ...) to report
+			_, err := w.WriteString("END\r\n")
+			return false, err
+		}
+		return false, s.stats(w)
+	case "version":
+		_, err := w.WriteString("VERSION " + memcachedVersion + "\r\n")
+		return false, err
+	case "quit":
+		return true, nil
+	default:
+		_, err := w.WriteString("ERROR\r\n")
+		return false, err
+	}
+}
+
+// checkKey validates a key as memcached would
+func checkKey(key []byte) error {
+	if len(key) > memcachedMaxKeySize {
+		return errMemcachedClient("key too long")
+	}
+	return nil
+}
+
+// get answers get and gets <key>*, with a VALUE for each key found
+func (s *memcachedServer) get(keys [][]byte, withCAS bool, w *bufio.Writer) error {
+	if len(keys) == 0 {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+
+	// Look up every key before answering, so an engine error is the whole
+	// reply rather than following some VALUEs
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		s.cmdGet.Add(1)
+		value, err := s.engine.Get(key)
+		if errors.Is(err, common.ErrKeyNotFound) {
+			s.getMisses.Add(1)
+			continue
+		}
+		if err != nil {
+			return writeServerError(w, err)
+		}
+		s.getHits.Add(1)
+		values[i], found[i] = value, true
+	}
+
+	for i, key := range keys {
+		if !found[i] {
+			continue
+		}
+		value := values[i]
+		w.WriteString("VALUE ")
+		w.Write(key)
+		w.WriteString(" 0 ")
+		w.WriteString(strconv.Itoa(len(value)))
+		if withCAS {
+			w.WriteString(" 0")
+		}
+		w.WriteString("\r\n")
+		w.Write(value)
+		w.WriteString("\r\n")
+	}
+	_, err := w.WriteString("END\r\n")
+	return err
+}
+
+// set answers set <key> <flags> <exptime> <bytes> [noreply], followed by
+// a data block of <bytes> bytes
+func (s *memcachedServer) set(args [][]byte, r *bufio.Reader, w *bufio.Writer) error {
+	if len(args) != 4 && len(args) != 5 {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+	noreply := len(args) == 5 && string(args[4]) == "noreply"
+
+	size, err := strconv.Atoi(string(args[3]))
+	if err != nil || size < 0 {
+		return errMemcachedClient("bad command line format")
+	}
+	if size > memcachedMaxValueSize {
+		// Skip the data block so the connection stays usable
+		if _, err := r.Discard(size + 2); err != nil {
+			return err
+		}
+		return reply(w, noreply, "SERVER_ERROR object too large for cache\r\n")
+	}
+
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(value, []byte("\r\n")) {
+		return errMemcachedClient("bad data chunk")
+	}
+	value = value[:size]
+
+	key := args[0]
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	flags, err := strconv.ParseUint(string(args[1]), 10, 32)
+	if err != nil {
+		return errMemcachedClient("bad command line format")
+	}
+	exptime, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errMemcachedClient("bad command line format")
+	}
+	if flags != 0 || exptime != 0 {
+		return errMemcachedClient("flags and expiration not supported")
+	}
+	if size == 0 && s.emptyDeletes {
+		return errMemcachedClient("empty values not supported by this engine")
+	}
+
+	s.cmdSet.Add(1)
+	if err := s.engine.Put(key, value); err != nil {
+		return writeServerError(w, err)
+	}
+	return reply(w, noreply, "STORED\r\n")
+}
+
+// delete answers delete <key> [noreply]
+func (s *memcachedServer) delete(args [][]byte, w *bufio.Writer) error {
+	if len(args) != 1 && len(args) != 2 {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+	noreply := len(args) == 2 && string(args[1]) == "noreply"
+	key := args[0]
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	// Engines delete missing keys without complaint, so look first
+	exists, err := s.engine.Has(key)
+	if err != nil {
+		return writeServerError(w, err)
+	}
+	if !exists {
+		s.deleteMiss.Add(1)
+		return reply(w, noreply, "NOT_FOUND\r\n")
+	}
+	if err := s.engine.Delete(key); err != nil {
+		return writeServerError(w, err)
+	}
+	s.deleteHits.Add(1)
+	return reply(w, noreply, "DELETED\r\n")
+}
+
+// stats answers stats with memcached's general statistics that apply,
+// followed by the engine's
+func (s *memcachedServer) stats(w *bufio.Writer) error {
+	engineStats := s.engine.Stats()
+	now := time.Now()
+
+	stat := func(name string, value any) {
+		fmt.Fprintf(w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.started).Seconds()))
+	stat("time", now.Unix())
+	stat("version", memcachedVersion)
+	stat("curr_connections", s.currConns.Load())
+	stat("total_connections", s.totalConns.Load())
+	stat("cmd_get", s.cmdGet.Load())
+	stat("cmd_set", s.cmdSet.Load())
+	stat("get_hits", s.getHits.Load())
+	stat("get_misses", s.getMisses.Load())
+	stat("delete_hits", s.deleteHits.Load())
+	stat("delete_misses", s.deleteMiss.Load())
+	stat("curr_items", engineStats.NumKeys)
+	stat("bytes", engineStats.TotalDiskSize)
+	stat("engine_write_amp", engineStats.WriteAmp)
+	stat("engine_space_amp", engineStats.SpaceAmp)
+	stat("engine_read_amp", engineStats.ReadAmp)
+	stat("engine_compactions", engineStats.CompactCount)
+	_, err := w.WriteString("END\r\n")
+	return err
+}
+
+// reply writes msg unless the client asked for no reply
+func reply(w *bufio.Writer, noreply bool, msg string) error {
+	if noreply {
+		return nil
+	}
+	_, err := w.WriteString(msg)
+	return err
+}
+
+// writeServerError reports an engine error to the client
+func writeServerError(w *bufio.Writer, err error) error {
+	log.Printf("Warning: memcached command failed: %v", err)
+	_, werr := fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+	return werr
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+)
+
+// memcachedSession sends input to a connection served by s, all at once
+// so its commands are pipelined, and returns everything the server wrote
+// until it closed the connection
+func memcachedSession(t *testing.T, s *memcachedServer, input string) string {
+	t.Helper()
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serveConn(server)
+	}()
+	go func() {
+		// Fails once the server hangs up on a bad request; what it
+		// answered is all that matters
+		client.Write([]byte(input))
+	}()
+
+	output, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Reading replies failed: %v", err)
+	}
+	client.Close()
+	<-done
+	return string(output)
+}
+
+func TestMemcachedPipelining(t *testing.T) {
+	s := newMemcachedServer(openTestLSM(t))
+	got := memcachedSession(t, s, ""+
+		"set a 0 0 5\r\nhello\r\n"+
+		"set b 0 0 0\r\n\r\n"+
+		"get a b c\r\n"+
+		"gets a\r\n"+
+		"delete a\r\n"+
+		"delete a\r\n"+
+		"get a\r\n"+
+		"bogus\r\n"+
+		"version\r\n"+
+		"quit\r\n"+
+		"get b\r\n")
+	want := "" +
+		"STORED\r\n" +
+		"STORED\r\n" +
+		"VALUE a 0 5\r\nhello\r\nVALUE b 0 0\r\n\r\nEND\r\n" +
+		"VALUE a 0 5 0\r\nhello\r\nEND\r\n" +
+		"DELETED\r\n" +
+		"NOT_FOUND\r\n" +
+		"END\r\n" +
+		"ERROR\r\n" +
+		"VERSION " + memcachedVersion + "\r\n"
+	if got != want {
+		t.Errorf("Replies:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestMemcachedNoreply(t *testing.T) {
+	s := newMemcachedServer(openTestLSM(t))
+	got := memcachedSession(t, s, ""+
+		"set a 0 0 1 noreply\r\nx\r\n"+
+		"set b 0 0 1 noreply\r\ny\r\n"+
+		"delete b noreply\r\n"+
+		"delete missing noreply\r\n"+
+		"get a b\r\n"+
+		"quit\r\n")
+	if want := "VALUE a 0 1\r\nx\r\nEND\r\n"; got != want {
+		t.Errorf("Replies %q, want %q", got, want)
+	}
+}
+
+func TestMemcachedBadRequests(t *testing.T) {
+	s := newMemcachedServer(openTestLSM(t))
+	got := memcachedSession(t, s, ""+
+		"set a 1 0 1\r\nx\r\n"+
+		"set a 0 0 x\r\n"+
+		"set a 0 0 1\r\nxy\r\n"+
+		"get "+strings.Repeat("k", memcachedMaxKeySize+1)+"\r\n"+
+		"quit\r\n")
+	want := "" +
+		"CLIENT_ERROR flags and expiration not supported\r\n" +
+		"CLIENT_ERROR bad command line format\r\n" +
+		"CLIENT_ERROR bad data chunk\r\n"
+	// The rest of the bad data chunk, "\r\n", reads as an empty command
+	want += "ERROR\r\n" +
+		"CLIENT_ERROR key too long\r\n"
+	if got != want {
+		t.Errorf("Replies:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestMemcachedOversizedValue(t *testing.T) {
+	s := newMemcachedServer(openTestLSM(t))
+	size := memcachedMaxValueSize + 1
+	got := memcachedSession(t, s, fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", size, strings.Repeat("v", size))+
+		"get big\r\n"+
+		"set a 0 0 1 noreply\r\nx\r\n"+
+		"get a\r\n"+
+		"quit\r\n")
+
+	// The value is skipped, and the connection carries on after it
+	want := "" +
+		"SERVER_ERROR object too large for cache\r\n" +
+		"END\r\n" +
+		"VALUE a 0 1\r\nx\r\nEND\r\n"
+	if got != want {
+		t.Errorf("Replies %q, want %q", got, want)
+	}
+}
+
+func TestMemcachedLongLine(t *testing.T) {
+	s := newMemcachedServer(openTestLSM(t))
+
+	// A multi-get of many keys is fine up to the limit
+	keys := strings.Repeat(" k", (memcachedMaxLine-3)/2)
+	if got := memcachedSession(t, s, "get"+keys+"\r\nquit\r\n"); got != "END\r\n" {
+		t.Errorf("Long multi-get replied %q", got)
+	}
+
+	// Past it, by a byte or many, the connection is closed
+	for _, n := range []int{memcachedMaxLine + 1, 3 * memcachedMaxLine} {
+		line := "get" + strings.Repeat(" k", n/2)[:n-3] + "\r\nversion\r\nquit\r\n"
+		if got, want := memcachedSession(t, s, line), "CLIENT_ERROR line too long\r\n"; got != want {
+			t.Errorf("Line of %d bytes replied %q, want %q", n, got, want)
+		}
+	}
+}
+
+// failingEngine fails Get for one key
+type failingEngine struct {
+	common.StorageEngine
+	key string
+}
+
+func (e *failingEngine) Get(key []byte) ([]byte, error) {
+	if string(key) == e.key {
+		return nil, errors.New("disk on fire")
+	}
+	return e.StorageEngine.Get(key)
+}
+
+func TestMemcachedGetError(t *testing.T) {
+	engine := openTestLSM(t)
+	for _, key := range []string{"a", "b", "c"} {
+		engine.Put([]byte(key), []byte(key))
+	}
+	s := newMemcachedServer(&failingEngine{StorageEngine: engine, key: "b"})
+
+	// The error is the whole reply, with no VALUE before it
+	got := memcachedSession(t, s, "get a b c\r\nget a\r\nquit\r\n")
+	want := "SERVER_ERROR disk on fire\r\n" +
+		"VALUE a 0 1\r\na\r\nEND\r\n"
+	if got != want {
+		t.Errorf("Replies %q, want %q", got, want)
+	}
+}
+
+func TestMemcachedEmptyValueHashIndex(t *testing.T) {
+	config := hashindex.DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	engine, err := hashindex.New(config)
+	if err != nil {
+		t.Fatalf("Failed to open hash index: %v", err)
+	}
+	defer engine.Close()
+	s := newMemcachedServer(engine)
+
+	// An empty value would delete a, so it is refused
+	got := memcachedSession(t, s, ""+
+		"set a 0 0 1\r\nx\r\n"+
+		"set a 0 0 0\r\n\r\n"+
+		"get a\r\n"+
+		"quit\r\n")
+	want := "STORED\r\n" +
+		"CLIENT_ERROR empty values not supported by this engine\r\n" +
+		"VALUE a 0 1\r\nx\r\nEND\r\n"
+	if got != want {
+		t.Errorf("Replies %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,254 @@
+// Command soak runs a mixed workload against an engine for hours, checking
+// it as it goes: every read is compared with a shadow of what each key
+// should hold, kept apart from the engine and saved beside its data
+// directory; random keys and ranges are audited on an interval; the
+// process's memory is sampled for a leak; and operations that hang are
+// reported as stalls. It ends with a pass/fail report, and exits 1 on a
+// failure.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/intellect4all/storage-engines/btree"
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// options are the command's flags
+type options struct {
+	engine string
+	dir    string
+	shadow string
+	resume bool
+	keep   bool
+
+	duration    time.Duration
+	concurrency int
+	keys        int
+	maxValue    int
+
+	auditInterval  time.Duration
+	auditKeys      int
+	reopenInterval time.Duration
+	sampleInterval time.Duration
+	stallTimeout   time.Duration
+	maxRSSGrowth   float64
+
+	report string
+}
+
+func main() {
+	var o options
+	flag.StringVar(&o.engine, "engine", "lsm", "Engine to soak: hashindex, lsm or btree")
+	flag.StringVar(&o.dir, "dir", "", "Data directory (default: a temp dir, removed if the run passes)")
+	flag.StringVar(&o.shadow, "shadow", "", "File the shadow of expected values is saved to (default: <dir>.shadow)")
+	flag.BoolVar(&o.resume, "resume", false, "Continue a run stopped cleanly, from -dir and its saved shadow")
+	flag.BoolVar(&o.keep, "keep", false, "Keep the data directory and shadow even if the run passes")
+	flag.DurationVar(&o.duration, "duration", time.Hour, "How long to run")
+	flag.IntVar(&o.concurrency, "concurrency", 8, "Number of concurrent workers")
+	flag.IntVar(&o.keys, "keys", 100000, "Number of distinct keys")
+	flag.IntVar(&o.maxValue, "max-value", 1024, "Largest value written, in bytes")
+	flag.DurationVar(&o.auditInterval, "audit-interval", time.Minute, "How often to audit random keys and save the shadow")
+	flag.IntVar(&o.auditKeys, "audit-keys", 1000, "Random keys checked by each audit")
+	flag.DurationVar(&o.reopenInterval, "reopen-interval", 0, "Also close and reopen the engine this often (default: never)")
+	flag.DurationVar(&o.sampleInterval, "sample-interval", 10*time.Second, "How often to sample memory")
+	flag.DurationVar(&o.stallTimeout, "stall-timeout", 30*time.Second, "Report an operation running longer than this as a stall")
+	flag.Float64Var(&o.maxRSSGrowth, "max-rss-growth", 64, "Fail if RSS trends upward faster than this many MiB/hour")
+	flag.StringVar(&o.report, "report", "", "Also write the report as JSON to this file")
+	flag.Parse()
+
+	if o.keys <= 0 || o.concurrency <= 0 || o.maxValue < minValue {
+		log.Fatalf("-keys and -concurrency must be positive and -max-value at least %d", minValue)
+	}
+
+	temp := o.dir == ""
+	if temp {
+		if o.resume {
+			log.Fatal("-resume needs -dir")
+		}
+		var err error
+		if o.dir, err = os.MkdirTemp("", "soak-"+o.engine+"-*"); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if o.shadow == "" {
+		o.shadow = o.dir + ".shadow"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := newSoak(o)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := s.run(ctx)
+	r.print()
+	if o.report != "" {
+		data, _ := json.MarshalIndent(r, "", "  ")
+		if err := os.WriteFile(o.report, data, 0644); err != nil {
+			log.Printf("Warning: failed to write report: %v", err)
+		}
+	}
+
+	if !r.Pass {
+		fmt.Printf("Data kept in %s, shadow in %s\n", o.dir, o.shadow)
+		os.Exit(1)
+	}
+	if temp && !o.keep {
+		os.RemoveAll(o.dir)
+		os.Remove(o.shadow)
+	}
+}
+
+// openEngine opens the named engine on dir, creating it if needed
+func openEngine(name, dir string) (common.StorageEngine, error) {
+	var engine common.StorageEngine
+	var err error
+	switch name {
+	case "hashindex":
+		engine, err = hashindex.New(hashindex.DefaultConfig(dir))
+	case "lsm":
+		engine, err = lsm.NewAdapter(lsm.DefaultConfig(dir))
+	case "btree":
+		engine, err = btree.NewAdapter(btree.DefaultConfig(dir))
+	default:
+		return nil, fmt.Errorf("unknown engine %s (must be hashindex, lsm or btree)", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return engine, nil
+}
+
+// newSoak opens the engine and the shadow, fresh or saved by a previous
+// run for -resume
+func newSoak(o options) (*soak, error) {
+	s := &soak{opts: o}
+	if o.resume {
+		sh, err := loadShadow(o.shadow)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load shadow %s: %w", o.shadow, err)
+		}
+		s.shadow = sh
+		s.opts.keys = len(sh.entries)
+	} else {
+		if entries, err := os.ReadDir(o.dir); err == nil && len(entries) > 0 {
+			return nil, fmt.Errorf("%s isn't empty: use -resume to continue a run", o.dir)
+		}
+		s.shadow = newShadow(o.keys)
+	}
+
+	engine, err := openEngine(o.engine, o.dir)
+	if err != nil {
+		return nil, err
+	}
+	s.setEngine(engine)
+	s.canScan = s.scan != nil
+	return s, nil
+}
+
+// minValue is the smallest value written, room for the key and version
+// it starts with
+const minValue = 32
+
+// maxScan is the most keys a scan covers
+const maxScan = 100
+
+// nextOp picks a worker's next operation and key: reads, writes and
+// deletes, and scans on engines that can. Half the operations go to the
+// hottest 1% of keys, so keys are overwritten and deleted many times over
+// and compaction has garbage to collect.
+func (s *soak) nextOp(rng *rand.Rand) (string, int) {
+	n := rng.Intn(s.opts.keys)
+	if rng.Intn(2) == 0 {
+		n = rng.Intn(s.opts.keys/100 + 1)
+	}
+	switch r := rng.Float64(); {
+	case r < 0.45:
+		return "get", n
+	case r < 0.80:
+		return "put", n
+	case r < 0.95:
+		return "delete", n
+	case s.canScan:
+		return "scan", n
+	default:
+		return "get", n
+	}
+}
+
+// mismatch reports a mismatch between the engine and the shadow
+func (s *soak) mismatch(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mismatches++
+	if len(s.firstMismatches) < maxMismatches {
+		s.firstMismatches = append(s.firstMismatches, msg)
+		fmt.Printf("MISMATCH: %s\n", msg)
+	}
+}
+
+// opError reports an operation on key n that failed, or on no key if n
+// is negative
+func (s *soak) opError(op string, n int, err error) {
+	msg := fmt.Sprintf("%s: %v", op, err)
+	if n >= 0 {
+		msg = fmt.Sprintf("%s %s: %v", op, key(n), err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors++
+	if len(s.firstErrors) < maxMismatches {
+		s.firstErrors = append(s.firstErrors, msg)
+		fmt.Printf("ERROR: %s\n", msg)
+	}
+}
+
+// maxMismatches is how many mismatches and errors are kept for the report
+const maxMismatches = 20
+
+// checkGet compares a Get of key n with the shadow. Caller must hold n's
+// stripe.
+func (s *soak) checkGet(n int, got []byte, err error) {
+	want := s.shadow.entries[n]
+	switch {
+	case err != nil && !errors.Is(err, common.ErrKeyNotFound):
+		s.opError("get", n, err)
+	case want.size == unknownSize:
+	case want.size == 0 && err == nil:
+		s.mismatch("%s: deleted at version %d, but read %q", key(n), want.version, truncate(got))
+	case want.size == 0:
+	case err != nil:
+		s.mismatch("%s: missing, want version %d", key(n), want.version)
+	default:
+		if v := value(n, want.version, want.size); string(got) != string(v) {
+			s.mismatch("%s: read %q, want %q", key(n), truncate(got), truncate(v))
+		}
+	}
+}
+
+// unknownSize marks a key whose last write failed: it may or may not
+// have been applied, so it isn't checked until it is written again
+const unknownSize = ^uint32(0)
+
+// truncate shortens a value for a report
+func truncate(v []byte) []byte {
+	if len(v) > 40 {
+		return append(v[:40:40], "..."...)
+	}
+	return v
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memSample is the process's memory at one point in the run
+type memSample struct {
+	At      time.Duration `json:"at_ns"` // Since the start
+	RSS     uint64        `json:"rss"`
+	HeapMiB float64       `json:"heap_mib"`
+}
+
+// rss returns the process's resident set size, from /proc where there is
+// one and otherwise the memory the Go runtime has obtained from the OS
+func rss() uint64 {
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys
+}
+
+func sampleMemory(start time.Time) memSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return memSample{At: time.Since(start), RSS: rss(), HeapMiB: float64(m.HeapAlloc) / (1 << 20)}
+}
+
+// rssTrend fits a line to the RSS samples after the first quarter of the
+// run, once caches and memtables have filled, and returns its slope in
+// MiB per hour. ok is false with too few samples to tell.
+func rssTrend(samples []memSample) (mibPerHour float64, ok bool) {
+	samples = samples[len(samples)/4:]
+	if len(samples) < minTrendSamples {
+		return 0, false
+	}
+
+	var sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x := s.At.Hours()
+		y := float64(s.RSS) / (1 << 20)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	n := float64(len(samples))
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0, false
+	}
+	return (n*sxy - sx*sy) / d, true
+}
+
+// minTrendSamples is the fewest samples rssTrend judges a trend from
+const minTrendSamples = 20
+
+// stall is an operation that took longer than -stall-timeout
+type stall struct {
+	Worker  int           `json:"worker"`
+	Op      string        `json:"op"`
+	Key     string        `json:"key"`
+	Started time.Duration `json:"started_ns"` // Since the start
+	Waited  time.Duration `json:"waited_ns"`  // When it was noticed
+}
+
+func (s stall) String() string {
+	return fmt.Sprintf("worker %d: %s %s started at %s, still running after %s",
+		s.Worker, s.Op, s.Key, s.Started.Round(time.Second), s.Waited.Round(time.Second))
+}
+
+// inFlight is the operation a worker is running, watched for stalls
+type inFlight struct {
+	start    atomic.Int64 // Unix nanoseconds; 0 when idle
+	op       atomic.Value // string
+	key      atomic.Value // string
+	reported int64        // Start of the last stall reported; watchdog only
+}
+
+func (f *inFlight) begin(op string, key []byte) {
+	f.op.Store(op)
+	f.key.Store(string(key))
+	f.start.Store(time.Now().UnixNano())
+}
+
+func (f *inFlight) end() {
+	f.start.Store(0)
+}
+
+// watchdog reports operations running longer than timeout, once each
+type watchdog struct {
+	start   time.Time
+	timeout time.Duration
+	workers []*inFlight
+
+	mu     sync.Mutex
+	stalls []stall
+}
+
+// check looks for stalled operations
+func (w *watchdog) check() {
+	now := time.Now()
+	for id, f := range w.workers {
+		started := f.start.Load()
+		if started == 0 || started == f.reported {
+			continue
+		}
+		waited := now.Sub(time.Unix(0, started))
+		if waited < w.timeout {
+			continue
+		}
+		f.reported = started
+		s := stall{
+			Worker:  id,
+			Op:      f.op.Load().(string),
+			Key:     f.key.Load().(string),
+			Started: time.Unix(0, started).Sub(w.start),
+			Waited:  waited,
+		}
+		fmt.Printf("STALL: %s\n", s)
+		w.mu.Lock()
+		w.stalls = append(w.stalls, s)
+		w.mu.Unlock()
+	}
+}
+
+func (w *watchdog) result() []stall {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]stall(nil), w.stalls...)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// shadowStripes is how many locks the keys are spread over. A key's
+// stripe is held across a write to the engine and to the shadow, and
+// across a read and its check, so the two always agree on what a key
+// should hold.
+const shadowStripes = 1024
+
+// shadowEntry is what a key should hold: the value written by its
+// version'th write, of size bytes, or nothing if size is 0
+type shadowEntry struct {
+	version uint32
+	size    uint32
+}
+
+// shadow is the harness's own record of every key's expected value,
+// independent of the engine. Values are derived from the key, version
+// and size (see value), so only those are kept.
+type shadow struct {
+	stripes [shadowStripes]sync.Mutex
+	entries []shadowEntry // By key number
+}
+
+func newShadow(keys int) *shadow {
+	return &shadow{entries: make([]shadowEntry, keys)}
+}
+
+// present reports whether key n should hold a value. Caller must hold its
+// stripe.
+func (s *shadow) present(n int) bool {
+	size := s.entries[n].size
+	return size != 0 && size != unknownSize
+}
+
+// lock locks key n's stripe
+func (s *shadow) lock(n int) {
+	s.stripes[n%shadowStripes].Lock()
+}
+
+func (s *shadow) unlock(n int) {
+	s.stripes[n%shadowStripes].Unlock()
+}
+
+// lockAll stops every write and check, for a consistent snapshot
+func (s *shadow) lockAll() {
+	for i := range s.stripes {
+		s.stripes[i].Lock()
+	}
+}
+
+func (s *shadow) unlockAll() {
+	for i := range s.stripes {
+		s.stripes[i].Unlock()
+	}
+}
+
+// key returns the engine key for key number n
+func key(n int) []byte {
+	return fmt.Appendf(nil, "soak%012d", n)
+}
+
+// value returns the value key n holds after its version'th write, size
+// bytes long: the key and version, then filler that depends on both, so a
+// value read back from the wrong key or version doesn't match
+func value(n int, version, size uint32) []byte {
+	v := fmt.Appendf(make([]byte, 0, size), "%d/%d:", n, version)
+	x := uint32(n)*2654435761 ^ version*40503
+	for len(v) < int(size) {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		v = append(v, 'a'+byte(x%26))
+	}
+	return v[:size]
+}
+
+// shadowMagic starts a saved shadow
+const shadowMagic = "SOAKSHDW"
+
+// save writes the shadow to path, replacing it atomically. Caller must
+// hold every stripe.
+func (s *shadow) save(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+	w.WriteString(shadowMagic)
+	binary.Write(w, binary.LittleEndian, uint64(len(s.entries)))
+	for _, e := range s.entries {
+		binary.Write(w, binary.LittleEndian, e)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = binary.Write(f, binary.LittleEndian, crc.Sum32())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save shadow: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadShadow reads a shadow saved by save
+func loadShadow(path string) (*shadow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(shadowMagic)+12 || string(data[:len(shadowMagic)]) != shadowMagic {
+		return nil, errors.New("not a soak shadow")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.New("shadow checksum mismatch")
+	}
+
+	body = body[len(shadowMagic):]
+	n := binary.LittleEndian.Uint64(body)
+	body = body[8:]
+	if uint64(len(body)) != n*8 {
+		return nil, fmt.Errorf("shadow holds %d bytes for %d keys", len(body), n)
+	}
+	s := newShadow(int(n))
+	for i := range s.entries {
+		s.entries[i] = shadowEntry{
+			version: binary.LittleEndian.Uint32(body[i*8:]),
+			size:    binary.LittleEndian.Uint32(body[i*8+4:]),
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// soak is one run
+type soak struct {
+	opts   options
+	shadow *shadow
+	start  time.Time
+
+	// engine is swapped by a reopen, with every stripe held; workers read
+	// it holding a stripe. closed is set if a reopen failed.
+	engine common.StorageEngine
+	scan   common.Scanner
+	closed bool
+
+	// canScan is whether the engine can scan, which doesn't change when
+	// it is reopened, so it can be read without a stripe
+	canScan bool
+
+	ops     [numOps]atomic.Int64 // By opIndex
+	checked atomic.Int64         // Values compared with the shadow
+
+	mu              sync.Mutex
+	errors          int64
+	firstErrors     []string
+	mismatches      int64
+	firstMismatches []string
+	audits          int
+	reopens         int
+	maxPause        time.Duration // Longest checkpoint
+}
+
+// The operations counted, in the report's order
+var opNames = [...]string{"get", "put", "delete", "scan"}
+
+const numOps = len(opNames)
+
+func opIndex(op string) int {
+	return slices.Index(opNames[:], op)
+}
+
+func (s *soak) setEngine(engine common.StorageEngine) {
+	s.engine = engine
+	s.scan, _ = engine.(common.Scanner)
+}
+
+// run soaks the engine until the duration is up or ctx is cancelled, and
+// returns the report. The engine is closed when it returns.
+func (s *soak) run(ctx context.Context) *report {
+	s.start = time.Now()
+	ctx, cancel := context.WithTimeout(ctx, s.opts.duration)
+	defer cancel()
+	fmt.Printf("Soaking %s in %s for %s: %d keys, %d workers\n",
+		s.opts.engine, s.opts.dir, s.opts.duration, s.opts.keys, s.opts.concurrency)
+
+	// The last slot is the checkpointer's
+	flights := make([]*inFlight, s.opts.concurrency+1)
+	for i := range flights {
+		flights[i] = &inFlight{}
+	}
+	dog := &watchdog{start: s.start, timeout: s.opts.stallTimeout, workers: flights}
+
+	var wg sync.WaitGroup
+	for id := range s.opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx, id, flights[id])
+		}()
+	}
+
+	r := &report{Engine: s.opts.engine, Dir: s.opts.dir, Keys: s.opts.keys}
+	r.Memory = append(r.Memory, sampleMemory(s.start))
+
+	audit := time.NewTicker(s.opts.auditInterval)
+	defer audit.Stop()
+	sample := time.NewTicker(s.opts.sampleInterval)
+	defer sample.Stop()
+	watch := time.NewTicker(time.Second)
+	defer watch.Stop()
+	progress := time.NewTicker(time.Minute)
+	defer progress.Stop()
+	lastReopen := s.start
+	checkpointed := make(chan struct{}) // Closed when no checkpoint is running
+	close(checkpointed)
+
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-watch.C:
+			dog.check()
+		case <-sample.C:
+			r.Memory = append(r.Memory, sampleMemory(s.start))
+		case <-progress.C:
+			s.printProgress(r.Memory[len(r.Memory)-1])
+		case <-audit.C:
+			// The checkpoint may take a while, or hang on a stuck worker:
+			// keep watching meanwhile
+			done := make(chan struct{})
+			checkpointed = done
+			go func() {
+				defer close(done)
+				reopen := s.opts.reopenInterval > 0 && time.Since(lastReopen) >= s.opts.reopenInterval
+				if !s.checkpointAndAudit(flights[len(flights)-1], reopen) {
+					cancel()
+				}
+				if reopen {
+					lastReopen = time.Now()
+				}
+			}()
+			for waiting := true; waiting; {
+				select {
+				case <-done:
+					waiting = false
+				case <-watch.C:
+					dog.check()
+				case <-ctx.Done():
+					waiting, running = false, false
+				}
+			}
+		}
+	}
+
+	// Wait for the workers, still watching for one that hangs. One that
+	// is stuck is abandoned after the stall timeout, along with the
+	// engine it is stuck in.
+	fmt.Println("Stopping workers...")
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		<-checkpointed
+		close(stopped)
+	}()
+	abandon := time.After(s.opts.stallTimeout)
+	stuck := false
+	for waiting := true; waiting; {
+		select {
+		case <-stopped:
+			waiting = false
+		case <-watch.C:
+			dog.check()
+		case <-abandon:
+			dog.check()
+			waiting, stuck = false, true
+		}
+	}
+
+	r.Memory = append(r.Memory, sampleMemory(s.start))
+	r.Stalls = dog.result()
+	switch {
+	case stuck:
+		r.Failures = append(r.Failures, "operations stuck in the engine didn't stop, so the final audit was skipped")
+	case !s.closed:
+		s.finalAudit()
+	}
+	s.finish(r)
+	return r
+}
+
+// finalAudit checks every key, saves the shadow for -resume and closes
+// the engine
+func (s *soak) finalAudit() {
+	fmt.Println("Auditing every key...")
+	s.shadow.lockAll()
+	for n := range s.shadow.entries {
+		got, err := s.engine.Get(key(n))
+		s.checkGet(n, got, err)
+		s.checked.Add(1)
+	}
+	if err := s.engine.Sync(); err != nil {
+		s.opError("sync", -1, err)
+	} else if err := s.shadow.save(s.opts.shadow); err != nil {
+		s.opError("save shadow", -1, err)
+	}
+	s.shadow.unlockAll()
+	if err := s.engine.Close(); err != nil {
+		s.opError("close", -1, err)
+	}
+}
+
+// worker runs operations until ctx is done
+func (s *soak) worker(ctx context.Context, id int, flight *inFlight) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	for ctx.Err() == nil {
+		op, n := s.nextOp(rng)
+		switch op {
+		case "scan":
+			s.doScan(n, rng.Intn(maxScan)+1, flight)
+		default:
+			s.shadow.lock(n)
+			if !s.closed {
+				s.doKeyOp(op, n, rng, flight)
+			}
+			s.shadow.unlock(n)
+		}
+		s.ops[opIndex(op)].Add(1)
+	}
+}
+
+// doKeyOp runs a get, put or delete of key n and checks or updates the
+// shadow. Caller must hold n's stripe.
+func (s *soak) doKeyOp(op string, n int, rng *rand.Rand, flight *inFlight) {
+	k := key(n)
+	entry := &s.shadow.entries[n]
+
+	flight.begin(op, k)
+	switch op {
+	case "get":
+		got, err := s.engine.Get(k)
+		flight.end()
+		s.checkGet(n, got, err)
+		s.checked.Add(1)
+
+	case "put":
+		version := entry.version + 1
+		size := uint32(minValue + rng.Intn(s.opts.maxValue-minValue+1))
+		err := s.engine.Put(k, value(n, version, size))
+		flight.end()
+		if err != nil {
+			s.opError(op, n, err)
+			size = unknownSize
+		}
+		*entry = shadowEntry{version: version, size: size}
+
+	case "delete":
+		err := s.engine.Delete(k)
+		flight.end()
+		size := uint32(0)
+		if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+			s.opError(op, n, err)
+			size = unknownSize
+		}
+		*entry = shadowEntry{version: entry.version + 1, size: size}
+	}
+}
+
+// doScan scans keys [n, n+length) and checks what it returns against the
+// shadow, holding every stripe the range covers
+func (s *soak) doScan(n, length int, flight *inFlight) {
+	end := min(n+length, s.opts.keys)
+	stripes := make([]int, 0, end-n)
+	for i := n; i < end; i++ {
+		stripes = append(stripes, i%shadowStripes)
+	}
+	// In order, as lockAll takes them
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	for _, i := range stripes {
+		s.shadow.stripes[i].Lock()
+	}
+	defer func() {
+		for _, i := range stripes {
+			s.shadow.stripes[i].Unlock()
+		}
+	}()
+
+	if s.closed {
+		return
+	}
+	flight.begin("scan", key(n))
+	defer flight.end()
+	if err := s.checkScan(n, end); err != nil {
+		s.opError("scan", n, err)
+	}
+}
+
+// checkScan compares a scan of keys [from, to) with the shadow. Caller
+// must hold their stripes.
+func (s *soak) checkScan(from, to int) error {
+	it, err := s.scan.Scan(key(from), key(to))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	next := from
+	for it.Next() {
+		got := it.Key()
+		for ; next < to && bytes.Compare(key(next), got) < 0; next++ {
+			if s.shadow.present(next) {
+				s.mismatch("scan [%s, %s) missed %s, version %d", key(from), key(to), key(next), s.shadow.entries[next].version)
+			}
+		}
+		if next == to || !bytes.Equal(got, key(next)) {
+			s.mismatch("scan [%s, %s) returned %q, which was never written", key(from), key(to), got)
+			continue
+		}
+		want := s.shadow.entries[next]
+		switch {
+		case want.size == unknownSize:
+		case want.size == 0:
+			s.mismatch("scan [%s, %s) returned %s, deleted at version %d", key(from), key(to), got, want.version)
+		case !bytes.Equal(it.Value(), value(next, want.version, want.size)):
+			s.mismatch("scan [%s, %s) returned %q for %s, want version %d", key(from), key(to), truncate(it.Value()), got, want.version)
+		}
+		s.checked.Add(1)
+		next++
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	for ; next < to; next++ {
+		if want := s.shadow.entries[next]; s.shadow.present(next) {
+			s.mismatch("scan [%s, %s) missed %s, version %d", key(from), key(to), key(next), want.version)
+		}
+	}
+	return nil
+}
+
+// checkpointAndAudit checks random keys, then stops the workers to sync
+// the engine and save the shadow, reopening the engine too if reopen is
+// set. It returns false if the engine failed to reopen, ending the run.
+func (s *soak) checkpointAndAudit(flight *inFlight, reopen bool) bool {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	s.mu.Lock()
+	before := s.mismatches
+	s.mu.Unlock()
+	for range s.opts.auditKeys {
+		n := rng.Intn(s.opts.keys)
+		s.shadow.lock(n)
+		flight.begin("audit", key(n))
+		got, err := s.engine.Get(key(n))
+		flight.end()
+		s.checkGet(n, got, err)
+		s.shadow.unlock(n)
+		s.checked.Add(1)
+	}
+
+	start := time.Now()
+	flight.begin("checkpoint", nil)
+	s.shadow.lockAll()
+	err := s.engine.Sync()
+	flight.end()
+	if err != nil {
+		s.opError("sync", -1, err)
+	} else if err := s.shadow.save(s.opts.shadow); err != nil {
+		s.opError("save shadow", -1, err)
+	}
+
+	if reopen {
+		flight.begin("reopen", nil)
+		err := s.engine.Close()
+		if err == nil {
+			var engine common.StorageEngine
+			if engine, err = openEngine(s.opts.engine, s.opts.dir); err == nil {
+				s.setEngine(engine)
+			}
+		}
+		flight.end()
+		if err != nil {
+			// Nothing more can run against a closed engine
+			s.opError("reopen", -1, err)
+			s.closed = true
+			s.shadow.unlockAll()
+			return false
+		}
+	}
+	s.shadow.unlockAll()
+
+	pause := time.Since(start)
+	s.mu.Lock()
+	s.audits++
+	if reopen {
+		s.reopens++
+	}
+	s.maxPause = max(s.maxPause, pause)
+	audits, found := s.audits, s.mismatches-before
+	s.mu.Unlock()
+	fmt.Printf("[%s] Audit %d: %d keys, %d new mismatches, paused %s\n",
+		time.Since(s.start).Round(time.Second), audits, s.opts.auditKeys, found, pause.Round(time.Millisecond))
+	return true
+}
+
+func (s *soak) printProgress(m memSample) {
+	var total int64
+	for i := range s.ops {
+		total += s.ops[i].Load()
+	}
+	elapsed := time.Since(s.start)
+	s.mu.Lock()
+	errs, mismatches := s.errors, s.mismatches
+	s.mu.Unlock()
+	fmt.Printf("[%s] %d ops (%.0f/s), %d errors, %d mismatches, RSS %.1f MiB\n",
+		elapsed.Round(time.Second), total, float64(total)/elapsed.Seconds(), errs, mismatches, float64(m.RSS)/(1<<20))
+}
+
+// report is the outcome of a run
+type report struct {
+	Engine   string        `json:"engine"`
+	Dir      string        `json:"dir"`
+	Keys     int           `json:"keys"`
+	Duration time.Duration `json:"duration_ns"`
+
+	Ops       map[string]int64 `json:"ops"`
+	OpsPerSec float64          `json:"ops_per_sec"`
+	Checked   int64            `json:"checked"` // Values compared with the shadow
+
+	Errors          int64    `json:"errors"`
+	FirstErrors     []string `json:"first_errors,omitempty"`
+	Mismatches      int64    `json:"mismatches"`
+	FirstMismatches []string `json:"first_mismatches,omitempty"`
+
+	Audits   int           `json:"audits"`
+	Reopens  int           `json:"reopens"`
+	MaxPause time.Duration `json:"max_pause_ns"` // Longest checkpoint
+
+	Memory      []memSample `json:"memory"`
+	RSSTrend    float64     `json:"rss_trend_mib_per_hour"`
+	RSSTrendSet bool        `json:"rss_trend_known"`
+
+	Stalls []stall `json:"stalls,omitempty"`
+
+	Pass     bool     `json:"pass"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+// finish fills in the totals and decides whether the run passed
+func (s *soak) finish(r *report) {
+	r.Duration = time.Since(s.start)
+	r.Ops = make(map[string]int64)
+	var total int64
+	for i, name := range opNames {
+		r.Ops[name] = s.ops[i].Load()
+		total += r.Ops[name]
+	}
+	r.OpsPerSec = float64(total) / r.Duration.Seconds()
+	r.Checked = s.checked.Load()
+
+	s.mu.Lock()
+	r.Errors, r.FirstErrors = s.errors, s.firstErrors
+	r.Mismatches, r.FirstMismatches = s.mismatches, s.firstMismatches
+	r.Audits, r.Reopens, r.MaxPause = s.audits, s.reopens, s.maxPause
+	s.mu.Unlock()
+	r.RSSTrend, r.RSSTrendSet = rssTrend(r.Memory)
+
+	if r.Mismatches > 0 {
+		r.Failures = append(r.Failures, fmt.Sprintf("%d reads didn't match the shadow", r.Mismatches))
+	}
+	if r.Errors > 0 {
+		r.Failures = append(r.Failures, fmt.Sprintf("%d operations failed", r.Errors))
+	}
+	if len(r.Stalls) > 0 {
+		r.Failures = append(r.Failures, fmt.Sprintf("%d operations stalled for over %s", len(r.Stalls), s.opts.stallTimeout))
+	}
+	if r.RSSTrendSet && r.RSSTrend > s.opts.maxRSSGrowth {
+		r.Failures = append(r.Failures, fmt.Sprintf("RSS grew %.1f MiB/hour, over %.1f", r.RSSTrend, s.opts.maxRSSGrowth))
+	}
+	r.Pass = len(r.Failures) == 0
+}
+
+func (r *report) print() {
+	fmt.Println("\n" + strings.Repeat("=", 80))
+	fmt.Println("SOAK REPORT")
+	fmt.Println(strings.Repeat("=", 80))
+	fmt.Printf("Engine:     %s (%d keys)\n", r.Engine, r.Keys)
+	fmt.Printf("Duration:   %s\n", r.Duration.Round(time.Second))
+	fmt.Printf("Operations: %d gets, %d puts, %d deletes, %d scans (%.0f ops/sec)\n",
+		r.Ops["get"], r.Ops["put"], r.Ops["delete"], r.Ops["scan"], r.OpsPerSec)
+	fmt.Printf("Checked:    %d values, %d mismatches\n", r.Checked, r.Mismatches)
+	fmt.Printf("Errors:     %d\n", r.Errors)
+	fmt.Printf("Audits:     %d (%d reopens, longest pause %s)\n", r.Audits, r.Reopens, r.MaxPause.Round(time.Millisecond))
+
+	first, last := r.Memory[0], r.Memory[len(r.Memory)-1]
+	var peak uint64
+	for _, m := range r.Memory {
+		peak = max(peak, m.RSS)
+	}
+	fmt.Printf("RSS:        %.1f MiB at start, %.1f MiB at end, %.1f MiB peak\n",
+		float64(first.RSS)/(1<<20), float64(last.RSS)/(1<<20), float64(peak)/(1<<20))
+	if r.RSSTrendSet {
+		fmt.Printf("RSS trend:  %+.1f MiB/hour\n", r.RSSTrend)
+	} else {
+		fmt.Printf("RSS trend:  too few samples to tell\n")
+	}
+	fmt.Printf("Stalls:     %d\n", len(r.Stalls))
+
+	for _, e := range r.FirstErrors {
+		fmt.Printf("  error: %s\n", e)
+	}
+	for _, m := range r.FirstMismatches {
+		fmt.Printf("  mismatch: %s\n", m)
+	}
+	for _, st := range r.Stalls {
+		fmt.Printf("  stall: %s\n", st)
+	}
+
+	if r.Pass {
+		fmt.Println("\nRESULT: PASS")
+		return
+	}
+	fmt.Println("\nRESULT: FAIL")
+	for _, f := range r.Failures {
+		fmt.Printf("  - %s\n", f)
+	}
+}
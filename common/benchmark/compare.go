@@ -1,8 +1,11 @@
 package benchmark
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -11,7 +14,16 @@ import (
 
 // ComparisonSuite runs benchmarks across multiple engines
 type ComparisonSuite struct {
-	configs []Config
+	configs  []Config
+	parallel bool
+	profile  *Profile
+	engines  []string // Table columns: engine names in the order run
+}
+
+// NamedEngine is an engine to compare and the name its results go under
+type NamedEngine struct {
+	Name   string
+	Engine common.StorageEngine
 }
 
 func NewComparisonSuite() *ComparisonSuite {
@@ -25,6 +37,19 @@ func (cs *ComparisonSuite) SetWorkloads(configs []Config) {
 	cs.configs = configs
 }
 
+// SetParallel runs the engines at the same time, each on its own
+// goroutine, instead of one after another. They then compete for CPU and
+// disk, so numbers are lower and only comparable within the run.
+func (cs *ComparisonSuite) SetParallel(parallel bool) {
+	cs.parallel = parallel
+}
+
+// SetProfile profiles every workload run against each engine. Profiles
+// cover the whole process, so don't combine it with SetParallel.
+func (cs *ComparisonSuite) SetProfile(p *Profile) {
+	cs.profile = p
+}
+
 // StandardWorkloads returns common benchmark scenarios
 func StandardWorkloads() []Config {
 	return []Config{
@@ -76,6 +101,19 @@ func StandardWorkloads() []Config {
 			PreloadKeys:     0,
 			Seed:            12345,
 		},
+		{
+			Name:            "scan-heavy-uniform",
+			WorkloadType:    WorkloadScanHeavy,
+			KeyDistribution: DistUniform,
+			NumKeys:         100000, // Preloaded densely, so scans are full length
+			KeySize:         16,
+			ValueSize:       100,
+			Duration:        60 * time.Second,
+			Concurrency:     8,
+			PreloadKeys:     100000,
+			ScanLength:      100,
+			Seed:            12345,
+		},
 	}
 }
 
@@ -120,42 +158,131 @@ func QuickWorkloads() []Config {
 			PreloadKeys:     30000, // Need data to read
 			Seed:            12345,
 		},
+		{
+			Name:            "quick-scan-heavy",
+			WorkloadType:    WorkloadScanHeavy,
+			KeyDistribution: DistUniform,
+			NumKeys:         30000,
+			KeySize:         16,
+			ValueSize:       100,
+			Duration:        15 * time.Second,
+			Concurrency:     8,
+			PreloadKeys:     30000,
+			ScanLength:      100,
+			Seed:            12345,
+		},
 	}
 }
 
-// RunComparison runs all workloads against multiple engines
+// RunComparison runs all workloads against multiple engines, in name order
 func (cs *ComparisonSuite) RunComparison(engines map[string]common.StorageEngine) map[string][]*Result {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	named := make([]NamedEngine, len(names))
+	for i, name := range names {
+		named[i] = NamedEngine{Name: name, Engine: engines[name]}
+	}
+	return cs.Run(named)
+}
+
+// Run runs all workloads against each engine, one engine after another
+// or all at once (see SetParallel). The comparison tables list the
+// engines in the order given.
+func (cs *ComparisonSuite) Run(engines []NamedEngine) map[string][]*Result {
+	cs.engines = make([]string, len(engines))
+	for i, e := range engines {
+		cs.engines[i] = e.Name
+	}
+
 	results := make(map[string][]*Result)
+	if !cs.parallel {
+		for _, e := range engines {
+			fmt.Printf("\n=== Benchmarking %s ===\n", e.Name)
+			results[e.Name] = cs.runEngine(e, true)
+		}
+		return results
+	}
 
-	for engineName, engine := range engines {
-		fmt.Printf("\n=== Benchmarking %s ===\n", engineName)
-		engineResults := make([]*Result, 0)
+	fmt.Printf("\n=== Benchmarking %d engines in parallel ===\n", len(engines))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, e := range engines {
+		wg.Add(1)
+		go func(e NamedEngine) {
+			defer wg.Done()
+			engineResults := cs.runEngine(e, false)
+			mu.Lock()
+			results[e.Name] = engineResults
+			mu.Unlock()
+		}(e)
+	}
+	wg.Wait()
 
-		for _, config := range cs.configs {
-			fmt.Printf("\nRunning: %s\n", config.Name)
+	// Progress lines interleave while running, so results come after
+	for _, e := range engines {
+		fmt.Printf("\n=== %s ===\n", e.Name)
+		for _, r := range results[e.Name] {
+			cs.printResult(r)
+		}
+	}
+	return results
+}
 
-			bench := NewBenchmark(engine, config)
-			result, err := bench.Run()
-			if err != nil {
-				fmt.Printf("ERROR: %v\n", err)
-				continue
-			}
+// runEngine runs every workload against one engine, printing each result
+// as it completes if print is set
+func (cs *ComparisonSuite) runEngine(e NamedEngine, print bool) []*Result {
+	engineResults := make([]*Result, 0)
 
-			engineResults = append(engineResults, result)
-			cs.printResult(result)
+	for _, config := range cs.configs {
+		fmt.Printf("\n[%s] Running: %s (sync: %s)\n", e.Name, config.Name, config.syncMode())
+
+		bench := NewBenchmark(e.Engine, config)
+		bench.SetProfile(cs.profile, e.Name)
+		result, err := bench.Run()
+		if errors.Is(err, ErrScanNotSupported) {
+			fmt.Printf("[%s] Skipping: %v\n", e.Name, err)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("[%s] ERROR: %v\n", e.Name, err)
+			continue
 		}
 
-		results[engineName] = engineResults
+		engineResults = append(engineResults, result)
+		if print {
+			cs.printResult(result)
+		}
 	}
 
-	return results
+	return engineResults
+}
+
+// engineOrder returns the table columns: the engines in the order they
+// were run, or by name for results from elsewhere
+func (cs *ComparisonSuite) engineOrder(results map[string][]*Result) []string {
+	if len(cs.engines) > 0 {
+		return cs.engines
+	}
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func (cs *ComparisonSuite) printResult(r *Result) {
-	fmt.Printf("\nResults for: %s\n", r.Config.Name)
+	fmt.Printf("\nResults for: %s (sync: %s)\n", r.Config.Name, r.Config.syncMode())
 	fmt.Printf("  Throughput: %.0f ops/sec\n", r.OpsPerSec)
-	fmt.Printf("  Total Ops: %d (writes: %d, reads: %d)\n",
-		r.TotalOps, r.WriteOps, r.ReadOps)
+	fmt.Printf("  Total Ops: %d (writes: %d, reads: %d, scans: %d)\n",
+		r.TotalOps, r.WriteOps, r.ReadOps, r.ScanOps)
+	if r.Errors > 0 {
+		fmt.Printf("  Errors: %d\n", r.Errors)
+	}
 
 	if r.WriteOps > 0 {
 		fmt.Printf("  Write Latency (μs):\n")
@@ -173,8 +300,30 @@ func (cs *ComparisonSuite) printResult(r *Result) {
 		fmt.Printf("    p999: %6d\n", r.ReadLatency.P999.Microseconds())
 	}
 
+	if r.ScanOps > 0 {
+		fmt.Printf("  Scan Latency (μs, %d keys/scan max):\n", r.Config.ScanLength)
+		fmt.Printf("    p50:  %6d\n", r.ScanLatency.P50.Microseconds())
+		fmt.Printf("    p95:  %6d\n", r.ScanLatency.P95.Microseconds())
+		fmt.Printf("    p99:  %6d\n", r.ScanLatency.P99.Microseconds())
+		fmt.Printf("    p999: %6d\n", r.ScanLatency.P999.Microseconds())
+		fmt.Printf("  Scanned: %.0f keys/sec\n", r.ScanKeysPerSec)
+	}
+
+	if r.DeleteOps > 0 {
+		fmt.Printf("  Delete Latency (μs, %d deletes):\n", r.DeleteOps)
+		fmt.Printf("    p50:  %6d\n", r.DeleteLatency.P50.Microseconds())
+		fmt.Printf("    p99:  %6d\n", r.DeleteLatency.P99.Microseconds())
+	}
+
+	if r.UpdateOps > 0 {
+		fmt.Printf("  Update Latency (μs, %d updates):\n", r.UpdateOps)
+		fmt.Printf("    p50:  %6d\n", r.UpdateLatency.P50.Microseconds())
+		fmt.Printf("    p99:  %6d\n", r.UpdateLatency.P99.Microseconds())
+	}
+
 	fmt.Printf("  Amplification:\n")
 	fmt.Printf("    Write: %.2fx\n", r.WriteAmplification)
+	fmt.Printf("    Read:  %.2f avg, %.0f p99\n", r.ReadAmplification, r.ReadAmpP99)
 	fmt.Printf("    Space: %.2fx\n", r.SpaceAmplification)
 	fmt.Printf("  Disk Usage: %.1f MB\n", r.TotalDiskMB)
 }
@@ -182,20 +331,23 @@ func (cs *ComparisonSuite) printResult(r *Result) {
 // PrintComparisonTable prints a comparison table
 func (cs *ComparisonSuite) PrintComparisonTable(results map[string][]*Result) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	engines := cs.engineOrder(results)
 
 	fmt.Fprintln(w, "\n=== THROUGHPUT COMPARISON (ops/sec) ===")
-	fmt.Fprintf(w, "Workload\t")
-	for engine := range results {
+	fmt.Fprintf(w, "Workload\tSync\t")
+	for _, engine := range engines {
 		fmt.Fprintf(w, "%s\t", engine)
 	}
 	fmt.Fprintln(w)
 
-	// Assuming all engines ran same workloads
-	for i, config := range cs.configs {
-		fmt.Fprintf(w, "%s\t", config.Name)
-		for engine := range results {
-			if i < len(results[engine]) {
-				fmt.Fprintf(w, "%.0f\t", results[engine][i].OpsPerSec)
+	// Engines skip workloads they can't run (scans on the hash index)
+	for _, config := range cs.configs {
+		fmt.Fprintf(w, "%s\t%s\t", config.Name, config.syncMode())
+		for _, engine := range engines {
+			if r := findResult(results[engine], config); r != nil {
+				fmt.Fprintf(w, "%.0f\t", r.OpsPerSec)
+			} else {
+				fmt.Fprintf(w, "N/A\t")
 			}
 		}
 		fmt.Fprintln(w)
@@ -204,17 +356,17 @@ func (cs *ComparisonSuite) PrintComparisonTable(results map[string][]*Result) {
 
 	// Latency comparison
 	fmt.Fprintln(w, "\n=== WRITE P99 LATENCY COMPARISON (μs) ===")
-	fmt.Fprintf(w, "Workload\t")
-	for engine := range results {
+	fmt.Fprintf(w, "Workload\tSync\t")
+	for _, engine := range engines {
 		fmt.Fprintf(w, "%s\t", engine)
 	}
 	fmt.Fprintln(w)
 
-	for i, config := range cs.configs {
-		fmt.Fprintf(w, "%s\t", config.Name)
-		for engine := range results {
-			if i < len(results[engine]) && results[engine][i].WriteOps > 0 {
-				fmt.Fprintf(w, "%d\t", results[engine][i].WriteLatency.P99.Microseconds())
+	for _, config := range cs.configs {
+		fmt.Fprintf(w, "%s\t%s\t", config.Name, config.syncMode())
+		for _, engine := range engines {
+			if r := findResult(results[engine], config); r != nil && r.WriteOps > 0 {
+				fmt.Fprintf(w, "%d\t", r.WriteLatency.P99.Microseconds())
 			} else {
 				fmt.Fprintf(w, "N/A\t")
 			}
@@ -225,20 +377,85 @@ func (cs *ComparisonSuite) PrintComparisonTable(results map[string][]*Result) {
 
 	// Amplification comparison
 	fmt.Fprintln(w, "\n=== WRITE AMPLIFICATION COMPARISON ===")
-	fmt.Fprintf(w, "Workload\t")
-	for engine := range results {
+	fmt.Fprintf(w, "Workload\tSync\t")
+	for _, engine := range engines {
 		fmt.Fprintf(w, "%s\t", engine)
 	}
 	fmt.Fprintln(w)
 
-	for i, config := range cs.configs {
-		fmt.Fprintf(w, "%s\t", config.Name)
-		for engine := range results {
-			if i < len(results[engine]) {
-				fmt.Fprintf(w, "%.2fx\t", results[engine][i].WriteAmplification)
+	for _, config := range cs.configs {
+		fmt.Fprintf(w, "%s\t%s\t", config.Name, config.syncMode())
+		for _, engine := range engines {
+			if r := findResult(results[engine], config); r != nil {
+				fmt.Fprintf(w, "%.2fx\t", r.WriteAmplification)
+			} else {
+				fmt.Fprintf(w, "N/A\t")
 			}
 		}
 		fmt.Fprintln(w)
 	}
 	w.Flush()
+
+	// Read amplification comparison
+	fmt.Fprintln(w, "\n=== READ AMPLIFICATION COMPARISON (avg units per Get) ===")
+	fmt.Fprintf(w, "Workload\tSync\t")
+	for _, engine := range engines {
+		fmt.Fprintf(w, "%s\t", engine)
+	}
+	fmt.Fprintln(w)
+
+	for _, config := range cs.configs {
+		fmt.Fprintf(w, "%s\t%s\t", config.Name, config.syncMode())
+		for _, engine := range engines {
+			if r := findResult(results[engine], config); r != nil && r.ReadOps > 0 {
+				fmt.Fprintf(w, "%.2f\t", r.ReadAmplification)
+			} else {
+				fmt.Fprintf(w, "N/A\t")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	// Scan comparison, for the scan workloads
+	var scanConfigs []Config
+	for _, config := range cs.configs {
+		if config.WorkloadType == WorkloadScanHeavy {
+			scanConfigs = append(scanConfigs, config)
+		}
+	}
+	if len(scanConfigs) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\n=== SCAN COMPARISON (keys/sec, p99 μs per scan) ===")
+	fmt.Fprintf(w, "Workload\tSync\t")
+	for _, engine := range engines {
+		fmt.Fprintf(w, "%s\t", engine)
+	}
+	fmt.Fprintln(w)
+
+	for _, config := range scanConfigs {
+		fmt.Fprintf(w, "%s\t%s\t", config.Name, config.syncMode())
+		for _, engine := range engines {
+			if r := findResult(results[engine], config); r != nil && r.ScanOps > 0 {
+				fmt.Fprintf(w, "%.0f (%d)\t", r.ScanKeysPerSec, r.ScanLatency.P99.Microseconds())
+			} else {
+				fmt.Fprintf(w, "N/A\t")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// findResult returns the result for a workload, run with its sync mode,
+// or nil if the engine didn't run it
+func findResult(results []*Result, config Config) *Result {
+	for _, r := range results {
+		if r.Config.Name == config.Name && r.Config.syncMode() == config.syncMode() {
+			return r
+		}
+	}
+	return nil
 }
@@ -0,0 +1,121 @@
+package benchmark
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// SyncMode is how durable a benchmark's writes are. It is applied the
+// same way to every engine, by calling its Sync, so engines are compared
+// at the same durability whatever their own defaults.
+type SyncMode string
+
+const (
+	// SyncNone returns from a write once the engine has it; the engine
+	// syncs whenever it would on its own (default)
+	SyncNone SyncMode = "none"
+
+	// SyncBatch returns from a write once it is synced, concurrent
+	// writers sharing each Sync (group commit)
+	SyncBatch SyncMode = "batch"
+
+	// SyncAlways follows every write with a Sync of its own
+	SyncAlways SyncMode = "always"
+)
+
+// ParseSyncMode checks a sync mode's name
+func ParseSyncMode(name string) (SyncMode, error) {
+	switch mode := SyncMode(name); mode {
+	case SyncNone, SyncBatch, SyncAlways:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown sync mode %q (must be none, batch or always)", name)
+}
+
+// syncMode returns the config's sync mode, SyncNone if unset
+func (c Config) syncMode() SyncMode {
+	if c.Sync == "" {
+		return SyncNone
+	}
+	return c.Sync
+}
+
+// groupSync shares engine syncs among concurrent writers. A writer needs
+// a Sync that started after its write: it waits for the one running to
+// finish, then either starts the next or finds another writer did and
+// waits for that.
+type groupSync struct {
+	engine common.StorageEngine
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running bool
+	started uint64 // Syncs started
+	done    uint64 // Syncs finished
+	err     error  // Of the last sync finished
+}
+
+func newGroupSync(engine common.StorageEngine) *groupSync {
+	g := &groupSync{engine: engine}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// sync returns once a Sync that started after the call has finished
+func (g *groupSync) sync() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	want := g.started + 1
+	if g.running {
+		// The running sync may have started before the write
+		want++
+	}
+	for g.done < want {
+		if g.running {
+			g.cond.Wait()
+			continue
+		}
+		g.running = true
+		g.started++
+		n := g.started
+		g.mu.Unlock()
+		err := g.engine.Sync()
+		g.mu.Lock()
+		g.running = false
+		g.done, g.err = n, err
+		g.cond.Broadcast()
+	}
+	return g.err
+}
+
+// put writes a key with the durability the config asks for
+func (b *Benchmark) put(key, value []byte) error {
+	if err := b.engine.Put(key, value); err != nil {
+		return err
+	}
+	return b.sync()
+}
+
+// delete deletes a key with the durability the config asks for. Deleting
+// a key that isn't there is not an error.
+func (b *Benchmark) delete(key []byte) error {
+	if err := b.engine.Delete(key); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return err
+	}
+	return b.sync()
+}
+
+// sync makes a write just done as durable as the config asks for
+func (b *Benchmark) sync() error {
+	switch b.config.syncMode() {
+	case SyncAlways:
+		return b.engine.Sync()
+	case SyncBatch:
+		return b.syncer.sync()
+	}
+	return nil
+}
@@ -4,6 +4,9 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	mrand "math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,6 +23,7 @@ const (
 	WorkloadBalanced   WorkloadType = "balanced"    // 50/50
 	WorkloadReadOnly   WorkloadType = "read-only"   // 100% reads
 	WorkloadWriteOnly  WorkloadType = "write-only"  // 100% writes
+	WorkloadScanHeavy  WorkloadType = "scan-heavy"  // 90% scans, 5% writes, 5% reads
 )
 
 // Config defines a benchmark scenario
@@ -38,26 +42,83 @@ type Config struct {
 
 	PreloadKeys int // Keys to load before benchmark starts
 
+	// PreloadDistribution is the order keys are preloaded in: sequential
+	// (default) loads keys 0..PreloadKeys-1 in order, uniform loads the
+	// same keys shuffled, and zipfian or latest draw PreloadKeys keys
+	// from that distribution (repeats included)
+	PreloadDistribution KeyDistribution
+
+	// Warmup is how long the workload runs unmeasured before Duration
+	// (default 5s; negative = none)
+	Warmup time.Duration
+
+	// MeasureWindow, if set below Duration, measures only the last
+	// MeasureWindow of Duration, once the engine has reached a steady
+	// state (e.g. compaction keeping up); the rest runs unmeasured
+	MeasureWindow time.Duration
+
+	ScanLength int // Keys read per scan (scan workloads; default 100)
+
+	// DeleteRatio and UpdateRatio are the shares of the workload's writes
+	// that delete a key and that overwrite one, together at most 1. Both
+	// pick a key that is present, starting from one drawn from
+	// KeyDistribution, so deletes leave tombstones rather than missing
+	// and updates never insert. The other writes are blind inserts: a Put
+	// of the drawn key, present or not.
+	DeleteRatio float64
+	UpdateRatio float64
+
+	// ZeroCopyReads reads with GetValue on engines that implement
+	// common.ValueGetter, borrowing each value rather than copying it out
+	// (Get otherwise)
+	ZeroCopyReads bool
+
+	// Sync is how durable writes are made before they count as done
+	// (default SyncNone); the time taken to sync is part of each write's
+	// latency
+	Sync SyncMode
+
 	Seed int64
 }
 
+// validate checks the settings Run can't work around
+func (c Config) validate() error {
+	if c.DeleteRatio < 0 || c.UpdateRatio < 0 || c.DeleteRatio+c.UpdateRatio > 1 {
+		return fmt.Errorf("%s: delete and update ratios must be at least 0 and add up to at most 1", c.Name)
+	}
+	return nil
+}
+
 type Result struct {
 	Config Config
 
 	// Throughput
 	TotalOps  int64
-	WriteOps  int64
+	WriteOps  int64 // Blind inserts
 	ReadOps   int64
+	ScanOps   int64
+	DeleteOps int64
+	UpdateOps int64
+	Errors    int64 // Failed operations, not counted in TotalOps
 	Duration  time.Duration
 	OpsPerSec float64
 
+	// Scans
+	ScanKeys       int64 // Keys returned by all scans
+	ScanKeysPerSec float64
+
 	// Latency (microseconds)
 	WriteLatency LatencyStats
 	ReadLatency  LatencyStats
+	ScanLatency  LatencyStats // Whole scan, open to close
+
+	DeleteLatency LatencyStats
+	UpdateLatency LatencyStats
 
 	// Amplification
 	WriteAmplification float64 // Measured from engine stats
-	ReadAmplification  float64
+	ReadAmplification  float64 // Average units touched per Get
+	ReadAmpP99         float64
 	SpaceAmplification float64
 
 	// Resource usage
@@ -69,37 +130,80 @@ type Result struct {
 }
 
 type Benchmark struct {
-	engine common.StorageEngine
-	config Config
-
-	// Metrics collection
-	writeLatencies *LatencyHistogram
-	readLatencies  *LatencyHistogram
+	engine  common.StorageEngine
+	scanner ScanCapable        // nil if the engine can't scan
+	getter  common.ValueGetter // nil unless ZeroCopyReads and the engine has GetValue
+	config  Config
+	syncer  *groupSync // Shares syncs among workers for SyncBatch
 
-	// Counters
-	writeCount atomic.Int64
-	readCount  atomic.Int64
-	errorCount atomic.Int64
+	// Operations are only recorded while measuring, into the recording
+	// worker's own workerStats
+	measuring atomic.Bool
 
-	// Key generation
+	// Key generation; workers use forks of it
 	keyGen *KeyGenerator
 
-	// Random seed for this benchmark
-	randSeed atomic.Int64
+	// Keys present, for deletes and updates; nil if the workload has none
+	present *keySet
+
+	// Profiles taken while measuring, named after profileEngine
+	profile       *Profile
+	profileEngine string
+
+	// Operation trace (see RecordTrace)
+	recordTrace bool
+	traceStart  time.Time
+	trace       *Trace
 }
 
 func NewBenchmark(engine common.StorageEngine, config Config) *Benchmark {
-	return &Benchmark{
-		engine:         engine,
-		config:         config,
-		writeLatencies: NewLatencyHistogram(),
-		readLatencies:  NewLatencyHistogram(),
-		keyGen:         NewKeyGenerator(config.NumKeys, config.KeySize, config.KeyDistribution, config.Seed),
+	if config.ScanLength == 0 {
+		config.ScanLength = defaultScanLength
+	}
+	if config.Warmup == 0 {
+		config.Warmup = defaultWarmup
+	}
+	config.Sync = config.syncMode()
+	scanner, _ := engine.(ScanCapable)
+	var getter common.ValueGetter
+	if config.ZeroCopyReads {
+		getter, _ = engine.(common.ValueGetter)
+	}
+
+	b := &Benchmark{
+		engine:  engine,
+		scanner: scanner,
+		getter:  getter,
+		config:  config,
+		syncer:  newGroupSync(engine),
+		keyGen:  NewKeyGenerator(config.NumKeys, config.KeySize, config.KeyDistribution, config.Seed),
+	}
+	if config.DeleteRatio > 0 || config.UpdateRatio > 0 {
+		// A zipfian draw can be NumKeys itself
+		b.present = newKeySet(config.NumKeys + 1)
 	}
+	return b
 }
 
-// Run executes the benchmark
+const defaultWarmup = 5 * time.Second
+
+// SetProfile profiles the measured window of Run, writing files named
+// after engine and the workload (see Profile)
+func (b *Benchmark) SetProfile(p *Profile, engine string) {
+	b.profile = p
+	b.profileEngine = engine
+}
+
+// Run executes the benchmark. Scan workloads fail with
+// ErrScanNotSupported on engines that aren't ScanCapable.
 func (b *Benchmark) Run() (*Result, error) {
+	if err := b.config.validate(); err != nil {
+		return nil, err
+	}
+	if b.config.WorkloadType == WorkloadScanHeavy && b.scanner == nil {
+		return nil, fmt.Errorf("%w: %s", ErrScanNotSupported, b.config.Name)
+	}
+
 	// Phase 1: Preload data
 	if b.config.PreloadKeys > 0 {
 		fmt.Printf("Preloading %d keys...\n", b.config.PreloadKeys)
@@ -109,163 +213,451 @@ func (b *Benchmark) Run() (*Result, error) {
 		fmt.Println("Preload complete")
 	}
 
-	// Phase 2: Warm-up (not measured)
-	fmt.Println("Warming up...")
-	b.runWorkload(5 * time.Second)
+	// Phase 2: Warm-up and the unmeasured part of Duration. The workers
+	// keep running into the measured window, so it starts from steady
+	// state rather than from a cold start.
+	window := b.config.Duration
+	if b.config.MeasureWindow > 0 && b.config.MeasureWindow < window {
+		window = b.config.MeasureWindow
+	}
+	unmeasured := b.config.Duration - window
+	if b.config.Warmup > 0 {
+		unmeasured += b.config.Warmup
+	}
 
-	// Reset metrics
-	b.writeLatencies = NewLatencyHistogram()
-	b.readLatencies = NewLatencyHistogram()
-	b.writeCount.Store(0)
-	b.readCount.Store(0)
-	b.errorCount.Store(0)
+	b.traceStart = time.Now()
+	stop := b.startWorkers()
+	if unmeasured > 0 {
+		fmt.Printf("Warming up for %v...\n", unmeasured)
+		time.Sleep(unmeasured)
+	}
 
 	// Phase 3: Actual benchmark
-	fmt.Printf("Running benchmark for %v...\n", b.config.Duration)
+	var stopProfile func() error
+	if b.profile.Enabled() {
+		var err error
+		stopProfile, err = b.profile.start(b.profileEngine, b.config.Name)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+	}
+
+	fmt.Printf("Measuring for %v...\n", window)
 	startStats := b.engine.Stats()
 	startTime := time.Now()
+	b.measuring.Store(true)
 
-	b.runWorkload(b.config.Duration)
+	time.Sleep(window)
 
+	b.measuring.Store(false)
 	endTime := time.Now()
 	endStats := b.engine.Stats()
 	duration := endTime.Sub(startTime)
+	var profileErr error
+	if stopProfile != nil {
+		profileErr = stopProfile()
+	}
+	stats := stop()
+	if profileErr != nil {
+		return nil, fmt.Errorf("failed to write profiles: %w", profileErr)
+	}
+	if b.recordTrace {
+		sort.SliceStable(stats.ops, func(i, j int) bool {
+			return stats.ops[i].offset < stats.ops[j].offset
+		})
+		b.trace = &Trace{Config: b.config, ops: stats.ops}
+	}
 
 	// Phase 4: Calculate results
-	result := b.calculateResults(duration, startStats, endStats)
+	result := b.calculateResults(duration, stats, startStats, endStats)
 
 	return result, nil
 }
 
-// preload fills the database with initial data
+// preload fills the database with initial data, in the order set by
+// PreloadDistribution. Concurrency workers each load their own share of
+// the keys, a contiguous run of the order, so the keys loaded don't depend
+// on how the workers interleave.
 func (b *Benchmark) preload() error {
 	value := make([]byte, b.config.ValueSize)
 	rand.Read(value)
 
-	for i := 0; i < b.config.PreloadKeys; i++ {
-		key := b.keyGen.GenerateSequential(i)
-		if err := b.engine.Put(key, value); err != nil {
-			return err
-		}
+	// nextKey returns the i'th key number of the order for a worker's
+	// generator
+	nextKey := func(gen *KeyGenerator, i int) int { return i }
+	switch b.config.PreloadDistribution {
+	case "", DistSequential:
+	case DistUniform:
+		order := mrand.New(mrand.NewSource(b.config.Seed)).Perm(b.config.PreloadKeys)
+		nextKey = func(gen *KeyGenerator, i int) int { return order[i] }
+	default:
+		nextKey = func(gen *KeyGenerator, _ int) int { return gen.nextKeyNum() }
+	}
+
+	total := b.config.PreloadKeys
+	workers := min(max(b.config.Concurrency, 1), total)
+	var loaded atomic.Int64
+	var failed atomic.Bool
+	errs := make(chan error, workers)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			gen := NewKeyGenerator(b.config.NumKeys, b.config.KeySize, b.config.PreloadDistribution, b.config.Seed+int64(w))
+			for i := w * total / workers; i < (w+1)*total/workers; i++ {
+				if failed.Load() {
+					return
+				}
+				n := nextKey(gen, i)
+				if err := b.engine.Put(gen.formatKey(n), value); err != nil {
+					failed.Store(true)
+					errs <- err
+					return
+				}
+				if b.present != nil {
+					b.present.add(n)
+				}
+				loaded.Add(1)
+			}
+		}(w)
+	}
 
-		if i > 0 && i%10000 == 0 {
-			fmt.Printf("  Loaded %d keys\n", i)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(preloadProgressInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			printPreloadProgress(loaded.Load(), total, time.Since(start))
 		}
 	}
 
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	printPreloadProgress(loaded.Load(), total, time.Since(start))
+
 	// Force sync after preload
 	return b.engine.Sync()
 }
 
-// runWorkload executes the workload for the given duration
-func (b *Benchmark) runWorkload(duration time.Duration) {
+// preloadProgressInterval is how often preload reports its progress
+const preloadProgressInterval = time.Second
+
+// printPreloadProgress prints a progress bar and the rate keys are loaded
+func printPreloadProgress(loaded int64, total int, elapsed time.Duration) {
+	const width = 30
+	filled := int(loaded * width / int64(total))
+	fmt.Printf("  [%s%s] %3d%% %d/%d keys, %.0f keys/sec\n",
+		strings.Repeat("#", filled), strings.Repeat(" ", width-filled),
+		loaded*100/int64(total), loaded, total, float64(loaded)/elapsed.Seconds())
+}
+
+// startWorkers starts the workload; the returned func stops it, waits
+// for the workers to finish and returns what they recorded, merged
+func (b *Benchmark) startWorkers() func() *workerStats {
 	var wg sync.WaitGroup
 	stop := make(chan struct{})
 
-	// Start workers
-	for i := 0; i < b.config.Concurrency; i++ {
+	// Start workers, each recording into its own stats
+	stats := make([]*workerStats, b.config.Concurrency)
+	for i := range stats {
+		stats[i] = newWorkerStats()
+		stats[i].worker = i
 		wg.Add(1)
 		go func(workerID int) {
 			defer wg.Done()
-			b.worker(workerID, stop)
+			b.worker(workerID, stats[workerID], stop)
 		}(i)
 	}
 
-	// Let them run
-	time.Sleep(duration)
+	return func() *workerStats {
+		close(stop)
+		wg.Wait()
+
+		merged := newWorkerStats()
+		for _, s := range stats {
+			merged.merge(s)
+		}
+		return merged
+	}
+}
+
+// workerStats is what one worker recorded while measuring, and its
+// operations when recording a trace. Only that worker touches it until
+// the workers stop, so recording takes no lock and workers never contend
+// in the measurement layer.
+type workerStats struct {
+	worker   int
+	latency  [numOpTypes]*LatencyHistogram // By opType
+	errors   int64
+	scanKeys int64     // Keys returned by scans
+	ops      []traceOp // Every operation, if recording a trace
+}
+
+func newWorkerStats() *workerStats {
+	s := &workerStats{}
+	for op := range s.latency {
+		s.latency[op] = NewLatencyHistogram()
+	}
+	return s
+}
+
+// record adds one successful operation of type op
+func (s *workerStats) record(op opType, latency time.Duration) {
+	s.latency[op].Record(latency)
+}
 
-	// Stop workers
-	close(stop)
-	wg.Wait()
+func (s *workerStats) merge(other *workerStats) {
+	for op := range s.latency {
+		s.latency[op].Merge(other.latency[op])
+	}
+	s.errors += other.errors
+	s.scanKeys += other.scanKeys
+	s.ops = append(s.ops, other.ops...)
 }
 
-// worker performs operations until stopped
-func (b *Benchmark) worker(id int, stop <-chan struct{}) {
+// worker performs operations until stopped. Each worker draws from its
+// own PRNG, seeded from Config.Seed and its id, so operation choices are
+// independent across workers and need no shared state.
+func (b *Benchmark) worker(id int, stats *workerStats, stop <-chan struct{}) {
 	value := make([]byte, b.config.ValueSize)
 	rand.Read(value)
 
+	rng := mrand.New(mrand.NewSource(b.config.Seed + int64(id) + 1))
+	keyGen := b.keyGen.fork(rng.Int63())
+
 	for {
 		select {
 		case <-stop:
 			return
 		default:
-			if b.shouldWrite() {
-				b.doWrite(value)
-			} else {
-				b.doRead()
+			switch b.nextOp(rng) {
+			case opScan:
+				b.doScan(keyGen, stats)
+			case opWrite:
+				b.doWrite(keyGen, value, stats)
+			case opDelete:
+				b.doDelete(keyGen, stats)
+			case opUpdate:
+				b.doUpdate(keyGen, value, stats)
+			default:
+				b.doRead(keyGen, stats)
 			}
 		}
 	}
 }
 
+// opType is the kind of operation a worker performs next
+type opType int
+
+const (
+	opRead  opType = iota
+	opWrite        // Blind insert
+	opScan
+	opDelete
+	opUpdate
+
+	numOpTypes
+)
+
+// nextOp picks the next operation from the workload's mix
+func (b *Benchmark) nextOp(rng *mrand.Rand) opType {
+	if b.config.WorkloadType == WorkloadScanHeavy {
+		r := rng.Float64()
+		switch {
+		case r < 0.90:
+			return opScan
+		case r < 0.95:
+			return b.writeOp(rng)
+		default:
+			return opRead
+		}
+	}
+
+	if b.shouldWrite(rng) {
+		return b.writeOp(rng)
+	}
+	return opRead
+}
+
+// writeOp picks the kind of write from DeleteRatio and UpdateRatio
+func (b *Benchmark) writeOp(rng *mrand.Rand) opType {
+	if b.present == nil {
+		return opWrite
+	}
+	r := rng.Float64()
+	switch {
+	case r < b.config.DeleteRatio:
+		return opDelete
+	case r < b.config.DeleteRatio+b.config.UpdateRatio:
+		return opUpdate
+	default:
+		return opWrite
+	}
+}
+
 // shouldWrite determines if this operation should be a write
-func (b *Benchmark) shouldWrite() bool {
+func (b *Benchmark) shouldWrite(rng *mrand.Rand) bool {
 	switch b.config.WorkloadType {
 	case WorkloadWriteOnly:
 		return true
 	case WorkloadReadOnly:
 		return false
 	case WorkloadWriteHeavy:
-		return b.randFloat() < 0.95
+		return rng.Float64() < 0.95
 	case WorkloadReadHeavy:
-		return b.randFloat() < 0.05
+		return rng.Float64() < 0.05
 	case WorkloadBalanced:
-		return b.randFloat() < 0.50
+		return rng.Float64() < 0.50
 	default:
-		return b.randFloat() < 0.50
+		return rng.Float64() < 0.50
+	}
+}
+
+func (b *Benchmark) doWrite(keyGen *KeyGenerator, value []byte, stats *workerStats) {
+	n := keyGen.nextKeyNum()
+	b.write(opWrite, n, keyGen.formatKey(n), value, stats)
+}
+
+// doUpdate overwrites a key that is present
+func (b *Benchmark) doUpdate(keyGen *KeyGenerator, value []byte, stats *workerStats) {
+	n := b.presentKey(keyGen)
+	b.write(opUpdate, n, keyGen.formatKey(n), value, stats)
+}
+
+// write puts key n for an insert or update
+func (b *Benchmark) write(op opType, n int, key, value []byte, stats *workerStats) {
+	start := time.Now()
+	err := b.put(key, value)
+	latency := time.Since(start)
+	if err == nil && b.present != nil {
+		b.present.add(n)
+	}
+
+	measured := b.measuring.Load()
+	b.traceOp(stats, op, key, nil, len(value), start, measured)
+	if !measured {
+		return
+	}
+	if err != nil {
+		stats.errors++
+		return
 	}
+
+	stats.record(op, latency)
 }
 
-func (b *Benchmark) doWrite(value []byte) {
-	key := b.keyGen.NextKey()
+// doDelete deletes a key that is present
+func (b *Benchmark) doDelete(keyGen *KeyGenerator, stats *workerStats) {
+	n := b.presentKey(keyGen)
+	key := keyGen.formatKey(n)
 
 	start := time.Now()
-	err := b.engine.Put(key, value)
+	err := b.delete(key)
 	latency := time.Since(start)
+	if err == nil {
+		b.present.remove(n)
+	}
 
+	measured := b.measuring.Load()
+	b.traceOp(stats, opDelete, key, nil, 0, start, measured)
+	if !measured {
+		return
+	}
 	if err != nil {
-		b.errorCount.Add(1)
+		stats.errors++
 		return
 	}
 
-	b.writeLatencies.Record(latency)
-	b.writeCount.Add(1)
+	stats.record(opDelete, latency)
+}
+
+// presentKey returns the first key present from one drawn from the
+// distribution, or the drawn key itself if none is
+func (b *Benchmark) presentKey(keyGen *KeyGenerator) int {
+	n := keyGen.nextKeyNum()
+	if p := b.present.next(n); p >= 0 {
+		return p
+	}
+	return n
 }
 
-func (b *Benchmark) doRead() {
-	key := b.keyGen.NextKey()
+func (b *Benchmark) doRead(keyGen *KeyGenerator, stats *workerStats) {
+	key := keyGen.NextKey()
 
 	start := time.Now()
-	_, err := b.engine.Get(key)
+	var err error
+	if b.getter != nil {
+		err = b.getter.GetValue(key, discardValue)
+	} else {
+		_, err = b.engine.Get(key)
+	}
 	latency := time.Since(start)
 
+	measured := b.measuring.Load()
+	b.traceOp(stats, opRead, key, nil, 0, start, measured)
+	if !measured {
+		return
+	}
 	if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
-		b.errorCount.Add(1)
+		stats.errors++
 		return
 	}
 
-	b.readLatencies.Record(latency)
-	b.readCount.Add(1)
+	stats.record(opRead, latency)
 }
 
-func (b *Benchmark) calculateResults(duration time.Duration, startStats, endStats common.Stats) *Result {
-	writeOps := b.writeCount.Load()
-	readOps := b.readCount.Load()
-	totalOps := writeOps + readOps
+// discardValue is the GetValue callback of zero-copy reads
+func discardValue([]byte) error {
+	return nil
+}
+
+func (b *Benchmark) calculateResults(duration time.Duration, stats *workerStats, startStats, endStats common.Stats) *Result {
+	writeOps := stats.latency[opWrite].Count()
+	readOps := stats.latency[opRead].Count()
+	scanOps := stats.latency[opScan].Count()
+	deleteOps := stats.latency[opDelete].Count()
+	updateOps := stats.latency[opUpdate].Count()
+	totalOps := writeOps + readOps + scanOps + deleteOps + updateOps
 
 	result := &Result{
 		Config:    b.config,
 		TotalOps:  totalOps,
 		WriteOps:  writeOps,
 		ReadOps:   readOps,
+		ScanOps:   scanOps,
+		DeleteOps: deleteOps,
+		UpdateOps: updateOps,
+		Errors:    stats.errors,
 		Duration:  duration,
 		OpsPerSec: float64(totalOps) / duration.Seconds(),
 
-		WriteLatency: b.writeLatencies.Stats(),
-		ReadLatency:  b.readLatencies.Stats(),
+		ScanKeys:       stats.scanKeys,
+		ScanKeysPerSec: float64(stats.scanKeys) / duration.Seconds(),
+
+		WriteLatency: stats.latency[opWrite].Stats(),
+		ReadLatency:  stats.latency[opRead].Stats(),
+		ScanLatency:  stats.latency[opScan].Stats(),
+
+		DeleteLatency: stats.latency[opDelete].Stats(),
+		UpdateLatency: stats.latency[opUpdate].Stats(),
 
 		// Amplification from engine stats
 		WriteAmplification: endStats.WriteAmp,
+		ReadAmplification:  endStats.ReadAmp,
+		ReadAmpP99:         endStats.ReadAmpP99,
 		SpaceAmplification: endStats.SpaceAmp,
 
 		TotalDiskMB: float64(endStats.TotalDiskSize) / (1024 * 1024),
@@ -274,7 +666,3 @@ func (b *Benchmark) calculateResults(duration time.Duration, startStats, endStat
 
 	return result
 }
-
-func (b *Benchmark) randFloat() float64 {
-	return float64(b.randSeed.Add(1)%10000) / 10000.0
-}
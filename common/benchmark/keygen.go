@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"math/bits"
 	mrand "math/rand"
 	"sync/atomic"
 )
@@ -28,8 +29,8 @@ type KeyGenerator struct {
 	// For Zipfian distribution
 	zipf *mrand.Zipf
 
-	// For sequential
-	seqCounter atomic.Int64
+	// For sequential (shared with forks)
+	seqCounter *atomic.Int64
 }
 
 func NewKeyGenerator(numKeys, keySize int, distribution KeyDistribution, seed int64) *KeyGenerator {
@@ -40,6 +41,7 @@ func NewKeyGenerator(numKeys, keySize int, distribution KeyDistribution, seed in
 		keySize:      keySize,
 		distribution: distribution,
 		rng:          rng,
+		seqCounter:   new(atomic.Int64),
 	}
 
 	// Setup Zipfian if needed (80/20 distribution)
@@ -50,7 +52,27 @@ func NewKeyGenerator(numKeys, keySize int, distribution KeyDistribution, seed in
 	return kg
 }
 
+// fork returns a generator over the same keys with its own random source,
+// for one goroutine: a KeyGenerator is not safe for concurrent use. The
+// sequential counter is shared, so forks continue one sequence.
+func (kg *KeyGenerator) fork(seed int64) *KeyGenerator {
+	f := NewKeyGenerator(kg.numKeys, kg.keySize, kg.distribution, seed)
+	f.seqCounter = kg.seqCounter
+	return f
+}
+
 func (kg *KeyGenerator) NextKey() []byte {
+	return kg.formatKey(kg.nextKeyNum())
+}
+
+// NextRange returns the bounds of a scan over length consecutive keys,
+// starting at a key drawn from the distribution: [start, end)
+func (kg *KeyGenerator) NextRange(length int) (start, end []byte) {
+	keyNum := kg.nextKeyNum()
+	return kg.formatKey(keyNum), kg.formatKey(keyNum + length)
+}
+
+func (kg *KeyGenerator) nextKeyNum() int {
 	var keyNum int
 
 	switch kg.distribution {
@@ -79,7 +101,7 @@ func (kg *KeyGenerator) NextKey() []byte {
 		keyNum = kg.rng.Intn(kg.numKeys)
 	}
 
-	return kg.formatKey(keyNum)
+	return keyNum
 }
 
 func (kg *KeyGenerator) GenerateSequential(n int) []byte {
@@ -107,3 +129,38 @@ func (kg *KeyGenerator) formatKey(n int) []byte {
 
 	return []byte(key)[:kg.keySize]
 }
+
+// keySet tracks which key numbers are present, for workloads that delete
+// and update existing keys. It is safe for concurrent use; keys added or
+// removed concurrently with a lookup may or may not be seen.
+type keySet struct {
+	words []atomic.Uint64
+}
+
+// newKeySet returns an empty set of key numbers up to n
+func newKeySet(n int) *keySet {
+	return &keySet{words: make([]atomic.Uint64, n/64+1)}
+}
+
+func (s *keySet) add(n int) {
+	s.words[n/64].Or(1 << (n % 64))
+}
+
+func (s *keySet) remove(n int) {
+	s.words[n/64].And(^uint64(1 << (n % 64)))
+}
+
+// next returns the first key present at or after n, wrapping around at
+// the end, or -1 if the set is empty
+func (s *keySet) next(n int) int {
+	i := n / 64
+	word := s.words[i].Load() &^ (1<<(n%64) - 1)
+	for range len(s.words) + 1 {
+		if word != 0 {
+			return i*64 + bits.TrailingZeros64(word)
+		}
+		i = (i + 1) % len(s.words)
+		word = s.words[i].Load()
+	}
+	return -1
+}
@@ -1,14 +1,30 @@
 package benchmark
 
 import (
-	"sort"
-	"sync"
+	"math"
+	"math/bits"
 	"time"
 )
 
+// Latencies are bucketed log-linearly: values below subBuckets ns get a
+// bucket each, and every power of two above that is split into subBuckets
+// equal buckets, so a recorded value is off by at most 1/subBuckets (~1.6%)
+const (
+	subBucketBits = 6
+	subBuckets    = 1 << subBucketBits
+	numBuckets    = (64 - subBucketBits) * subBuckets
+)
+
+// LatencyHistogram records operation latencies into fixed buckets. Record
+// neither locks nor allocates, so it doesn't distort what it measures, but
+// a histogram is not safe for concurrent use: give each goroutine its own
+// and Merge them once recording is done.
 type LatencyHistogram struct {
-	mu      sync.RWMutex
-	samples []time.Duration
+	buckets [numBuckets]uint64
+	count   uint64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
 }
 
 type LatencyStats struct {
@@ -22,46 +38,105 @@ type LatencyStats struct {
 }
 
 func NewLatencyHistogram() *LatencyHistogram {
-	return &LatencyHistogram{
-		samples: make([]time.Duration, 0, 1000000),
+	return &LatencyHistogram{}
+}
+
+// bucketIndex returns the bucket a latency of v nanoseconds falls in
+func bucketIndex(v uint64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits - 1
+	return (shift+1)*subBuckets + int(v>>shift) - subBuckets
+}
+
+// bucketRange returns the smallest latency in bucket idx and its width
+func bucketRange(idx int) (lower, width uint64) {
+	if idx < subBuckets {
+		return uint64(idx), 1
 	}
+	shift := idx/subBuckets - 1
+	mantissa := uint64(idx%subBuckets + subBuckets)
+	return mantissa << shift, 1 << shift
 }
 
 func (h *LatencyHistogram) Record(d time.Duration) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.samples = append(h.samples, d)
+	if d < 0 {
+		d = 0
+	}
+	h.buckets[bucketIndex(uint64(d))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
 }
 
-func (h *LatencyHistogram) Stats() LatencyStats {
-	var copied []time.Duration
-	func() {
-		h.mu.RLock()
-		defer h.mu.RUnlock()
-		copied = make([]time.Duration, len(h.samples))
-		copy(copied, h.samples)
-	}()
+// Merge adds other's recorded latencies to h
+func (h *LatencyHistogram) Merge(other *LatencyHistogram) {
+	if other.count == 0 {
+		return
+	}
+	for i, n := range other.buckets {
+		h.buckets[i] += n
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// Count returns the number of latencies recorded
+func (h *LatencyHistogram) Count() int64 {
+	return int64(h.count)
+}
 
-	if len(copied) == 0 {
+func (h *LatencyHistogram) Stats() LatencyStats {
+	if h.count == 0 {
 		return LatencyStats{}
 	}
 
-	sort.Slice(copied, func(i, j int) bool {
-		return copied[i] < copied[j]
-	})
+	return LatencyStats{
+		Min:  h.min,
+		Max:  h.max,
+		Mean: h.sum / time.Duration(h.count),
+		P50:  h.percentile(50),
+		P95:  h.percentile(95),
+		P99:  h.percentile(99),
+		P999: h.percentile(99.9),
+	}
+}
 
-	sum := time.Duration(0)
-	for _, d := range copied {
-		sum += d
+// percentile returns the midpoint of the bucket holding percentile p
+// (0-100), clamped to the exact min and max
+func (h *LatencyHistogram) percentile(p float64) time.Duration {
+	target := uint64(math.Ceil(float64(h.count) * p / 100))
+	if target == 0 {
+		target = 1
 	}
 
-	return LatencyStats{
-		Min:  copied[0],
-		Max:  copied[len(copied)-1],
-		Mean: sum / time.Duration(len(copied)),
-		P50:  copied[len(copied)*50/100],
-		P95:  copied[len(copied)*95/100],
-		P99:  copied[len(copied)*99/100],
-		P999: copied[len(copied)*999/1000],
+	var seen uint64
+	for i, n := range h.buckets {
+		seen += n
+		if seen < target {
+			continue
+		}
+		lower, width := bucketRange(i)
+		d := time.Duration(lower + width/2)
+		if d < h.min {
+			d = h.min
+		}
+		if d > h.max {
+			d = h.max
+		}
+		return d
 	}
+	return h.max
 }
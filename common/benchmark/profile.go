@@ -0,0 +1,157 @@
+package benchmark
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"time"
+)
+
+// Profile sets which profiles are taken while a workload is measured.
+// Each (engine, workload) pair gets its own files in Dir, named
+// <engine>-<workload>.<kind>.
+//
+// CPU profiles and execution traces cover the whole process, so engines
+// must not be benchmarked in parallel while profiling.
+type Profile struct {
+	Dir   string // Created if missing
+	CPU   bool   // .cpu.pprof
+	Mem   bool   // .mem.pprof, a heap profile at the end of the window
+	Trace bool   // .trace, for go tool trace (includes syscalls and IO waits)
+
+	// SnapshotInterval, if set, also writes a heap profile this often
+	// during the window: .heap-001.pprof, .heap-002.pprof, ...
+	SnapshotInterval time.Duration
+}
+
+// Enabled reports whether p takes any profile
+func (p *Profile) Enabled() bool {
+	return p != nil && (p.CPU || p.Mem || p.Trace || p.SnapshotInterval > 0)
+}
+
+// start begins profiling a pair; the returned func stops it and writes the
+// remaining profiles
+func (p *Profile) start(engine, workload string) (func() error, error) {
+	if err := os.MkdirAll(p.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create profile dir: %w", err)
+	}
+	prefix := filepath.Join(p.Dir, profileName(engine)+"-"+profileName(workload))
+
+	// Stopped in reverse order
+	var stops []func() error
+	stopAll := func() error {
+		var firstErr error
+		for i := len(stops) - 1; i >= 0; i-- {
+			if err := stops[i](); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	if p.CPU {
+		f, err := os.Create(prefix + ".cpu.pprof")
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			stopAll()
+			return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+
+	if p.Trace {
+		f, err := os.Create(prefix + ".trace")
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stopAll()
+			return nil, fmt.Errorf("failed to start trace: %w", err)
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+
+	if p.SnapshotInterval > 0 {
+		done := make(chan struct{})
+		finished := make(chan error, 1)
+		go func() {
+			ticker := time.NewTicker(p.SnapshotInterval)
+			defer ticker.Stop()
+
+			var firstErr error
+			for n := 1; ; n++ {
+				select {
+				case <-done:
+					finished <- firstErr
+					return
+				case <-ticker.C:
+					// No GC first: that would disturb the run being measured
+					path := fmt.Sprintf("%s.heap-%03d.pprof", prefix, n)
+					if err := writeHeapProfile(path, false); err != nil && firstErr == nil {
+						firstErr = err
+					}
+				}
+			}
+		}()
+		stops = append(stops, func() error {
+			close(done)
+			return <-finished
+		})
+	}
+
+	if p.Mem {
+		stops = append(stops, func() error {
+			return writeHeapProfile(prefix+".mem.pprof", true)
+		})
+	}
+
+	fmt.Printf("Profiling to %s.*\n", prefix)
+	return stopAll, nil
+}
+
+// writeHeapProfile writes a heap profile to path. With gc set it collects
+// first, so the profile is up to date rather than as of the last GC.
+func writeHeapProfile(path string, gc bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if gc {
+		runtime.GC()
+	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// profileName turns an engine or workload name into part of a file name
+func profileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, name)
+}
@@ -0,0 +1,331 @@
+package benchmark
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Trace is the sequence of operations a benchmark performed, recorded
+// with RecordTrace, so it can be replayed exactly against another engine
+// or version. The config is kept with it: replaying preloads the same
+// keys first.
+type Trace struct {
+	Config Config
+	ops    []traceOp // By offset
+}
+
+// traceOp is one recorded operation
+type traceOp struct {
+	worker   int
+	offset   time.Duration // From the start of the workload
+	op       opType
+	measured bool // Done inside the measured window
+	size     int  // Value size for writes, key limit for scans
+	key      []byte
+	end      []byte // Scans only
+}
+
+// traceHeader is the first line of a trace file. The config follows as
+// JSON, then one line per operation:
+//
+//	worker <TAB> offset-ns <TAB> op <TAB> measured (0/1) <TAB> size <TAB> "key" [<TAB> "end"]
+const traceHeader = "storage-engines trace v1"
+
+var opTypeNames = [numOpTypes]string{
+	opRead:   "read",
+	opWrite:  "write",
+	opScan:   "scan",
+	opDelete: "delete",
+	opUpdate: "update",
+}
+
+func (op opType) String() string {
+	if op < 0 || op >= numOpTypes {
+		return fmt.Sprintf("op(%d)", int(op))
+	}
+	return opTypeNames[op]
+}
+
+// Len returns the number of operations in the trace
+func (t *Trace) Len() int {
+	return len(t.ops)
+}
+
+// Write writes the trace in its text format
+func (t *Trace) Write(w io.Writer) error {
+	config, err := json.Marshal(t.Config)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, traceHeader)
+	fmt.Fprintf(bw, "%s\n", config)
+	for _, op := range t.ops {
+		measured := 0
+		if op.measured {
+			measured = 1
+		}
+		fmt.Fprintf(bw, "%d\t%d\t%s\t%d\t%d\t%s", op.worker, op.offset.Nanoseconds(),
+			op.op, measured, op.size, strconv.Quote(string(op.key)))
+		if op.op == opScan {
+			fmt.Fprintf(bw, "\t%s", strconv.Quote(string(op.end)))
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// LoadTrace reads a trace written by Trace.Write
+func LoadTrace(r io.Reader) (*Trace, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() || scanner.Text() != traceHeader {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("not a benchmark trace")
+	}
+
+	t := &Trace{}
+	if !scanner.Scan() {
+		return nil, errors.New("trace has no config")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &t.Config); err != nil {
+		return nil, fmt.Errorf("invalid trace config: %w", err)
+	}
+
+	for line := 3; scanner.Scan(); line++ {
+		op, err := parseTraceOp(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		t.ops = append(t.ops, op)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(t.ops, func(i, j int) bool {
+		return t.ops[i].offset < t.ops[j].offset
+	})
+	return t, nil
+}
+
+func parseTraceOp(line string) (traceOp, error) {
+	var op traceOp
+	fields := strings.Split(line, "\t")
+	if len(fields) < 6 {
+		return op, fmt.Errorf("expected at least 6 fields, got %d", len(fields))
+	}
+
+	var err error
+	if op.worker, err = strconv.Atoi(fields[0]); err != nil {
+		return op, fmt.Errorf("invalid worker: %w", err)
+	}
+	offset, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return op, fmt.Errorf("invalid offset: %w", err)
+	}
+	op.offset = time.Duration(offset)
+
+	op.op = -1
+	for t, name := range opTypeNames {
+		if fields[2] == name {
+			op.op = opType(t)
+		}
+	}
+	if op.op < 0 {
+		return op, fmt.Errorf("unknown operation %q", fields[2])
+	}
+
+	op.measured = fields[3] == "1"
+	if op.size, err = strconv.Atoi(fields[4]); err != nil || op.size < 0 {
+		return op, fmt.Errorf("invalid size %q", fields[4])
+	}
+
+	key, err := strconv.Unquote(fields[5])
+	if err != nil {
+		return op, fmt.Errorf("invalid key: %w", err)
+	}
+	op.key = []byte(key)
+
+	if op.op == opScan {
+		if len(fields) < 7 {
+			return op, errors.New("scan without an end key")
+		}
+		end, err := strconv.Unquote(fields[6])
+		if err != nil {
+			return op, fmt.Errorf("invalid end key: %w", err)
+		}
+		op.end = []byte(end)
+	}
+	return op, nil
+}
+
+// RecordTrace makes Run record every operation the workers perform,
+// warm-up included, for Trace. Recording keeps the trace in memory.
+func (b *Benchmark) RecordTrace() {
+	b.recordTrace = true
+}
+
+// Trace returns the operations recorded by the last Run, or nil if
+// RecordTrace wasn't called
+func (b *Benchmark) Trace() *Trace {
+	return b.trace
+}
+
+// traceOp records an operation a worker started at start, if recording
+func (b *Benchmark) traceOp(stats *workerStats, op opType, key, end []byte, size int, start time.Time, measured bool) {
+	if !b.recordTrace {
+		return
+	}
+	stats.ops = append(stats.ops, traceOp{
+		worker:   stats.worker,
+		offset:   start.Sub(b.traceStart),
+		op:       op,
+		measured: measured,
+		size:     size,
+		key:      key,
+		end:      end,
+	})
+}
+
+// ReplayOptions controls how Replay issues a trace's operations
+type ReplayOptions struct {
+	// Timed issues each operation at its recorded offset, reproducing the
+	// original rate; otherwise operations go as fast as possible
+	Timed bool
+
+	// Serial issues every operation from one goroutine, in recorded
+	// order, so the resulting data is exactly reproducible. Otherwise each
+	// recorded worker gets a goroutine that keeps only its own order.
+	Serial bool
+}
+
+// Replay preloads the keys the trace's benchmark preloaded, then performs
+// the trace's operations against the engine. Only the operations that
+// were measured when recording are measured again. b must have been
+// created with the trace's config.
+func (b *Benchmark) Replay(t *Trace, opts ReplayOptions) (*Result, error) {
+	groups := make(map[int][]traceOp)
+	maxSize := 0
+	for _, op := range t.ops {
+		if op.op == opScan && b.scanner == nil {
+			return nil, fmt.Errorf("%w: %s", ErrScanNotSupported, t.Config.Name)
+		}
+		worker := op.worker
+		if opts.Serial {
+			worker = 0
+		}
+		groups[worker] = append(groups[worker], op)
+		if (op.op == opWrite || op.op == opUpdate) && op.size > maxSize {
+			maxSize = op.size
+		}
+	}
+
+	if b.config.PreloadKeys > 0 {
+		fmt.Printf("Preloading %d keys...\n", b.config.PreloadKeys)
+		if err := b.preload(); err != nil {
+			return nil, err
+		}
+		fmt.Println("Preload complete")
+	}
+
+	value := make([]byte, maxSize)
+	rand.Read(value)
+
+	fmt.Printf("Replaying %d operations...\n", len(t.ops))
+	startStats := b.engine.Stats()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	merged := newWorkerStats()
+	var first, last time.Time // Of the measured operations
+	for _, ops := range groups {
+		wg.Add(1)
+		go func(ops []traceOp) {
+			defer wg.Done()
+			stats := newWorkerStats()
+			var opsFirst, opsLast time.Time
+			for _, op := range ops {
+				if opts.Timed {
+					time.Sleep(time.Until(start.Add(op.offset)))
+				}
+				begin := time.Now()
+				b.replayOp(op, value, stats)
+				if op.measured {
+					if opsFirst.IsZero() {
+						opsFirst = begin
+					}
+					opsLast = time.Now()
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			merged.merge(stats)
+			if !opsFirst.IsZero() && (first.IsZero() || opsFirst.Before(first)) {
+				first = opsFirst
+			}
+			if opsLast.After(last) {
+				last = opsLast
+			}
+		}(ops)
+	}
+	wg.Wait()
+
+	endStats := b.engine.Stats()
+	duration := last.Sub(first)
+	if first.IsZero() {
+		duration = time.Since(start)
+	}
+	return b.calculateResults(duration, merged, startStats, endStats), nil
+}
+
+// replayOp performs one traced operation, recording it if it was measured
+func (b *Benchmark) replayOp(op traceOp, value []byte, stats *workerStats) {
+	begin := time.Now()
+	var err error
+	n := 0
+	switch op.op {
+	case opWrite, opUpdate:
+		err = b.put(op.key, value[:op.size])
+	case opDelete:
+		err = b.delete(op.key)
+	case opScan:
+		n, err = b.scan(op.key, op.end, op.size)
+	default:
+		_, err = b.engine.Get(op.key)
+		if errors.Is(err, common.ErrKeyNotFound) {
+			err = nil
+		}
+	}
+	latency := time.Since(begin)
+
+	if !op.measured {
+		return
+	}
+	if err != nil {
+		stats.errors++
+		return
+	}
+
+	stats.record(op.op, latency)
+	if op.op == opScan {
+		stats.scanKeys += int64(n)
+	}
+}
@@ -0,0 +1,154 @@
+package benchmark
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// RestartConfig defines a restart benchmark: a dataset is written, the
+// engine stopped, and the time it takes to open again and serve reads is
+// measured
+type RestartConfig struct {
+	NumKeys     int // Keys written before the restart
+	KeySize     int // Bytes
+	ValueSize   int // Bytes
+	Concurrency int // Workers writing the dataset
+
+	// Crash stops the engine without closing it, so reopening has to
+	// recover rather than find a clean shutdown. LoadRestartData is then
+	// run by a process that exits straight after.
+	Crash bool
+
+	// SampleKeys is how many keys are read back after reopening, to check
+	// the dataset survived (default 1000)
+	SampleKeys int
+
+	Seed int64
+}
+
+// RestartResult is what a restart benchmark measured
+type RestartResult struct {
+	Config RestartConfig
+
+	Load  time.Duration // Writing the dataset, synced
+	Close time.Duration // Zero after a crash
+
+	// Reopen is how long opening the engine took, and FirstRead how long
+	// from the start of opening until the first read returned (a missing
+	// key is counted among the sampled keys, not failed here)
+	Reopen    time.Duration
+	FirstRead time.Duration
+
+	Sampled int // Keys read back
+	Missing int // Of those, keys not found
+
+	TotalDiskMB float64
+}
+
+// Opener opens an engine over the same data directory each time
+type Opener func() (common.StorageEngine, error)
+
+const defaultSampleKeys = 1000
+
+// benchConfig is the Config preloading the dataset
+func (c RestartConfig) benchConfig() Config {
+	return Config{
+		Name:        "restart",
+		NumKeys:     c.NumKeys,
+		KeySize:     c.KeySize,
+		ValueSize:   c.ValueSize,
+		Concurrency: c.Concurrency,
+		PreloadKeys: c.NumKeys,
+		Seed:        c.Seed,
+	}
+}
+
+// LoadRestartData writes a restart benchmark's dataset, keys
+// 0..NumKeys-1, and syncs it
+func LoadRestartData(engine common.StorageEngine, config RestartConfig) (time.Duration, error) {
+	fmt.Printf("Loading %d keys...\n", config.NumKeys)
+	start := time.Now()
+	if err := NewBenchmark(engine, config.benchConfig()).preload(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// RunRestart runs a clean restart benchmark: it opens the engine, loads
+// the dataset, closes the engine and measures reopening it
+func RunRestart(open Opener, config RestartConfig) (*RestartResult, error) {
+	if config.Crash {
+		return nil, errors.New("a crash restart loads its data in another process: use MeasureRestart")
+	}
+	engine, err := open()
+	if err != nil {
+		return nil, err
+	}
+	load, err := LoadRestartData(engine, config)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+
+	fmt.Println("Closing...")
+	start := time.Now()
+	if err := engine.Close(); err != nil {
+		return nil, fmt.Errorf("close failed: %w", err)
+	}
+	closeTime := time.Since(start)
+
+	result, err := MeasureRestart(open, config)
+	if err != nil {
+		return nil, err
+	}
+	result.Load, result.Close = load, closeTime
+	return result, nil
+}
+
+// MeasureRestart opens an engine over a dataset written by
+// LoadRestartData, and measures how long it takes to open and to serve
+// its first read. It then reads a sample of the keys back and closes the
+// engine.
+func MeasureRestart(open Opener, config RestartConfig) (*RestartResult, error) {
+	if config.SampleKeys == 0 {
+		config.SampleKeys = defaultSampleKeys
+	}
+	keyGen := NewKeyGenerator(config.NumKeys, config.KeySize, DistUniform, config.Seed)
+	rng := mrand.New(mrand.NewSource(config.Seed))
+	first := keyGen.GenerateSequential(rng.Intn(config.NumKeys))
+
+	fmt.Println("Reopening...")
+	start := time.Now()
+	engine, err := open()
+	if err != nil {
+		return nil, fmt.Errorf("reopen failed: %w", err)
+	}
+	defer engine.Close()
+	reopen := time.Since(start)
+
+	if _, err := engine.Get(first); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return nil, fmt.Errorf("first read failed: %w", err)
+	}
+	firstRead := time.Since(start)
+
+	result := &RestartResult{
+		Config:    config,
+		Reopen:    reopen,
+		FirstRead: firstRead,
+		Sampled:   min(config.SampleKeys, config.NumKeys),
+	}
+	for range result.Sampled {
+		_, err := engine.Get(keyGen.GenerateSequential(rng.Intn(config.NumKeys)))
+		if errors.Is(err, common.ErrKeyNotFound) {
+			result.Missing++
+		} else if err != nil {
+			return nil, fmt.Errorf("read failed: %w", err)
+		}
+	}
+	result.TotalDiskMB = float64(engine.Stats().TotalDiskSize) / (1024 * 1024)
+	return result, nil
+}
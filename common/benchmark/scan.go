@@ -0,0 +1,57 @@
+package benchmark
+
+import (
+	"errors"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// ScanCapable is implemented by engines that support range scans (the
+// B-Tree and the LSM adapter). Scan workloads need it.
+type ScanCapable = common.Scanner
+
+// ErrScanNotSupported is returned by Run for a scan workload on an engine
+// that isn't ScanCapable
+var ErrScanNotSupported = errors.New("engine does not support range scans")
+
+const defaultScanLength = 100
+
+// doScan reads up to ScanLength keys from a random start key. Its latency
+// covers opening, iterating and closing the scan.
+func (b *Benchmark) doScan(keyGen *KeyGenerator, stats *workerStats) {
+	start, end := keyGen.NextRange(b.config.ScanLength)
+
+	begin := time.Now()
+	n, err := b.scan(start, end, b.config.ScanLength)
+	latency := time.Since(begin)
+
+	measured := b.measuring.Load()
+	b.traceOp(stats, opScan, start, end, b.config.ScanLength, begin, measured)
+	if !measured {
+		return
+	}
+	if err != nil {
+		stats.errors++
+		return
+	}
+
+	stats.record(opScan, latency)
+	stats.scanKeys += int64(n)
+}
+
+// scan reads up to limit keys in [start, end) and returns how many
+func (b *Benchmark) scan(start, end []byte, limit int) (int, error) {
+	iter, err := b.scanner.Scan(start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	n := 0
+	for n < limit && iter.Next() {
+		_ = iter.Value()
+		n++
+	}
+	return n, iter.Error()
+}
@@ -0,0 +1,43 @@
+package common
+
+import "sync"
+
+// BufferPool reuses byte buffers across calls on hot paths, such as the
+// scratch space records are encoded into, so they don't allocate on every
+// call. Buffers that grew past the pool's limit are left to the garbage
+// collector, so a single large value doesn't keep its memory alive.
+//
+// The zero value is a pool with no limit.
+type BufferPool struct {
+	pool    sync.Pool
+	maxSize int
+}
+
+// NewBufferPool returns a pool keeping buffers of up to maxSize bytes
+func NewBufferPool(maxSize int) *BufferPool {
+	return &BufferPool{maxSize: maxSize}
+}
+
+// Get returns a buffer holding n bytes, of unspecified content. The
+// buffer is reached through a pointer so it can be grown in place and
+// still be handed back with Put.
+func (p *BufferPool) Get(n int) *[]byte {
+	buf, _ := p.pool.Get().(*[]byte)
+	if buf == nil {
+		buf = new([]byte)
+	}
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// Put hands a buffer from Get back to the pool. It must not be used
+// afterwards.
+func (p *BufferPool) Put(buf *[]byte) {
+	if p.maxSize > 0 && cap(*buf) > p.maxSize {
+		return
+	}
+	p.pool.Put(buf)
+}
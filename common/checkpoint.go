@@ -0,0 +1,70 @@
+package common
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// CheckpointFile is one file of a checkpoint
+type CheckpointFile struct {
+	// Name is the file's path relative to the engine's data directory,
+	// slash-separated
+	Name string
+
+	// Size is how many bytes Open returns
+	Size int64
+
+	// Immutable files (SSTables, sealed segments and value log files) are
+	// never changed once written, so a copy kept from an earlier
+	// checkpoint can stand in for one. A name can be taken again by a new
+	// file with other content, though.
+	Immutable bool
+
+	// Open returns the file's content, unencrypted. It can be called
+	// until the Checkpoint callback returns.
+	Open func() (io.ReadCloser, error)
+}
+
+// Checkpointer is implemented by engines that can list a consistent set of
+// their files, for backups
+type Checkpointer interface {
+	// Checkpoint calls fn with the files that, written to an empty
+	// directory, open as an engine holding the data written before the
+	// call. The engine keeps serving while fn runs, and the files stay
+	// readable until it returns.
+	Checkpoint(fn func(files []CheckpointFile) error) error
+}
+
+// SequencedCheckpointer is implemented by engines that number their
+// writes. Their checkpoints hold exactly the writes numbered up to a
+// sequence number, so archived WALs can roll a restored checkpoint
+// forward from there.
+type SequencedCheckpointer interface {
+	Checkpointer
+
+	// CheckpointSeq is Checkpoint, also passing fn the sequence number of
+	// the last write the checkpoint holds
+	CheckpointSeq(fn func(files []CheckpointFile, seq uint64) error) error
+}
+
+// ArchivedWAL is a write-ahead log an engine has finished with, kept for
+// point-in-time recovery
+type ArchivedWAL struct {
+	// LastSequence is the highest sequence number its records can have
+	LastSequence uint64
+
+	// Archived is when the engine replaced it; every record in it was
+	// written by then
+	Archived time.Time
+
+	// Open returns its content, unencrypted
+	Open func() (io.ReadCloser, error)
+}
+
+// WALArchiver keeps the WALs an engine hands it. ArchiveWAL is called from
+// a background goroutine, one WAL at a time, oldest first; a WAL it fails
+// to keep is handed over again later.
+type WALArchiver interface {
+	ArchiveWAL(ctx context.Context, w ArchivedWAL) error
+}
@@ -0,0 +1,29 @@
+package common
+
+import "math/rand/v2"
+
+// ChecksumVerification says how often reads check the checksums of the
+// data they return. Recovery and compaction check every checksum whatever
+// the setting, so damaged data is never copied into a new file.
+type ChecksumVerification int
+
+const (
+	VerifyAlways  ChecksumVerification = iota // Every read (the default)
+	VerifySampled                             // One read in ChecksumSampleRate, at random
+	VerifyNever                               // Damage goes unnoticed until compaction reads it
+)
+
+// ChecksumSampleRate is how many reads share one check under VerifySampled
+const ChecksumSampleRate = 16
+
+// Verify reports whether the next read should check its checksum
+func (v ChecksumVerification) Verify() bool {
+	switch v {
+	case VerifySampled:
+		return rand.IntN(ChecksumSampleRate) == 0
+	case VerifyNever:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,140 @@
+// Package cluster spreads keys across several engine instances, each on
+// its own directory or disk or behind its own server, with a consistent
+// hash ring, so adding or removing an instance moves only the keys it
+// gains or gives up.
+package cluster
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is how many points each node gets on a ring by
+// default. More points spread keys more evenly, at some memory per node.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent hash ring. Each node is hashed to several points
+// (virtual nodes) on a circle of 64-bit hashes; a key belongs to the node
+// of the first point at or after the key's hash, wrapping around.
+//
+// A Ring is not safe for concurrent use while it is being changed; Clone
+// it to change a copy instead.
+type Ring struct {
+	virtualNodes int
+	points       []uint64          // Sorted
+	owners       map[uint64]string // Node of each point
+	nodes        map[string]bool
+}
+
+// NewRing returns an empty ring placing each node at virtualNodes points
+// (0 = DefaultVirtualNodes)
+func NewRing(virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint64]string),
+		nodes:        make(map[string]bool),
+	}
+}
+
+// Clone returns a copy of the ring that can be changed independently
+func (r *Ring) Clone() *Ring {
+	clone := &Ring{
+		virtualNodes: r.virtualNodes,
+		points:       slices.Clone(r.points),
+		owners:       make(map[uint64]string, len(r.owners)),
+		nodes:        make(map[string]bool, len(r.nodes)),
+	}
+	for point, node := range r.owners {
+		clone.owners[point] = node
+	}
+	for node := range r.nodes {
+		clone.nodes[node] = true
+	}
+	return clone
+}
+
+// Add places a node on the ring; adding it again does nothing
+func (r *Ring) Add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.virtualNodes; i++ {
+		point := hashString(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[point]; taken {
+			// A 64-bit collision: the point stays with its first owner
+			continue
+		}
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+	slices.Sort(r.points)
+}
+
+// Remove takes a node off the ring
+func (r *Ring) Remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == node {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// Owner returns the node key belongs to, or "" if the ring is empty
+func (r *Ring) Owner(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := hashBytes(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Has reports whether node is on the ring
+func (r *Ring) Has(node string) bool {
+	return r.nodes[node]
+}
+
+// Nodes returns the ring's nodes, sorted
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+func hashString(s string) uint64 {
+	return hashBytes([]byte(s))
+}
+
+// hashBytes is FNV-1a, finished with a 64-bit mix so that similar keys
+// (key1, key2, ...) land far apart
+func hashBytes(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,439 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// migrateBatch is how many keys a ring change moves at a time, with
+// reads and writes paused
+const migrateBatch = 256
+
+// Router routes each key to one of several engines, its node, with a
+// consistent hash Ring. Nodes can be local engines or clients of remote
+// ones: anything implementing common.StorageEngine.
+//
+// AddNode and RemoveNode change the ring while the Router is in use,
+// moving the keys whose node changed a batch at a time. Until a move is
+// done, reads of a key not found on its new node fall back to the old,
+// and writes go to the new node and clear the old, so no write is lost
+// or undone. Moving keys needs nodes implementing common.Scanner.
+//
+// Router implements common.StorageEngine for point operations; it has no
+// Scan, as keys of one range are spread over all the nodes.
+type Router struct {
+	mu    sync.RWMutex // Held for writing while moving a batch
+	ring  *Ring
+	prev  *Ring // Ring before the change in progress, nil for none
+	nodes map[string]common.StorageEngine
+
+	changing string // Node added or removed by the change in progress
+
+	changeMu sync.Mutex // Serializes ring changes
+}
+
+// NewRouter returns a router with no nodes, placing each node at
+// virtualNodes points on its ring (0 = DefaultVirtualNodes)
+func NewRouter(virtualNodes int) *Router {
+	return &Router{
+		ring:  NewRing(virtualNodes),
+		nodes: make(map[string]common.StorageEngine),
+	}
+}
+
+// Nodes returns the names of the router's nodes, sorted
+func (r *Router) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ring.Nodes()
+}
+
+// Node returns the engine of a node, or nil
+func (r *Router) Node(name string) common.StorageEngine {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes[name]
+}
+
+// Owner returns the name of the node key belongs to
+func (r *Router) Owner(key []byte) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ring.Owner(key)
+}
+
+// AddNode adds a node and moves the keys it now owns to it from the other
+// nodes, returning how many it moved
+func (r *Router) AddNode(name string, engine common.StorageEngine) (int64, error) {
+	r.changeMu.Lock()
+	defer r.changeMu.Unlock()
+
+	r.mu.RLock()
+	_, exists := r.nodes[name]
+	sources := r.ring.Nodes()
+	changing := r.changing
+	r.mu.RUnlock()
+	if exists {
+		return 0, fmt.Errorf("cluster: node %s already exists", name)
+	}
+	if changing != "" {
+		return 0, fmt.Errorf("cluster: change of node %s in progress, remove it first", changing)
+	}
+	if err := r.checkScanners(sources); err != nil {
+		return 0, err
+	}
+
+	next := r.ring.Clone()
+	next.Add(name)
+	r.mu.Lock()
+	r.nodes[name] = engine
+	r.prev, r.ring = r.ring, next
+	r.changing = name
+	r.mu.Unlock()
+
+	var moved int64
+	for _, source := range sources {
+		n, err := r.migrate(source)
+		moved += n
+		if err != nil {
+			// The change stays in progress, with reads falling back to
+			// the old nodes; RemoveNode of the new node undoes it
+			return moved, err
+		}
+	}
+	r.finishChange()
+	return moved, nil
+}
+
+// RemoveNode moves a node's keys to the nodes now owning them, then
+// removes it and returns its engine for the caller to close. If moving
+// fails, the change stays in progress until RemoveNode is called again.
+func (r *Router) RemoveNode(name string) (common.StorageEngine, int64, error) {
+	r.changeMu.Lock()
+	defer r.changeMu.Unlock()
+
+	r.mu.RLock()
+	engine, exists := r.nodes[name]
+	last := len(r.nodes) == 1
+	changing := r.changing
+	r.mu.RUnlock()
+	if !exists {
+		return nil, 0, fmt.Errorf("cluster: no node %s", name)
+	}
+	if changing != "" && changing != name {
+		// Keys of an unfinished change may be on either of its rings,
+		// so it must finish before the ring changes again
+		return nil, 0, fmt.Errorf("cluster: change of node %s in progress, remove it first", changing)
+	}
+	if last {
+		return nil, 0, fmt.Errorf("cluster: can't remove the last node")
+	}
+	if err := r.checkScanners([]string{name}); err != nil {
+		return nil, 0, err
+	}
+
+	next := r.ring.Clone()
+	next.Remove(name)
+	r.mu.Lock()
+	if r.prev == nil {
+		r.prev = r.ring
+	}
+	r.ring = next
+	r.changing = name
+	r.mu.Unlock()
+
+	moved, err := r.migrate(name)
+	if err != nil {
+		return nil, moved, err
+	}
+
+	r.mu.Lock()
+	delete(r.nodes, name)
+	r.mu.Unlock()
+	r.finishChange()
+	return engine, moved, nil
+}
+
+// checkScanners checks that keys can be moved off the named nodes
+func (r *Router) checkScanners(names []string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, name := range names {
+		if _, ok := r.nodes[name].(common.Scanner); !ok {
+			return fmt.Errorf("cluster: node %s can't list its keys to move them: %w", name, common.ErrNotSupported)
+		}
+	}
+	return nil
+}
+
+// finishChange ends a ring change once all its keys have moved
+func (r *Router) finishChange() {
+	r.mu.Lock()
+	r.prev = nil
+	r.changing = ""
+	r.mu.Unlock()
+}
+
+// migrate moves the keys of a node that belong elsewhere on the current
+// ring to their owners, a batch at a time
+func (r *Router) migrate(source string) (int64, error) {
+	var moved int64
+	var from []byte
+	for {
+		n, next, err := r.migrateBatch(source, from)
+		moved += n
+		if err != nil || next == nil {
+			return moved, err
+		}
+		from = next
+	}
+}
+
+// migrateBatch looks at the next migrateBatch keys of a node, from the
+// given key on, and moves those belonging elsewhere, holding off reads and
+// writes. It returns where the next batch starts, or nil when the node's
+// keys are done.
+func (r *Router) migrateBatch(source string, from []byte) (int64, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	engine := r.nodes[source]
+	it, err := engine.(common.Scanner).Scan(from, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	var keys, values [][]byte
+	var next []byte
+	for scanned := 0; it.Next(); scanned++ {
+		if scanned == migrateBatch {
+			next = bytes.Clone(it.Key())
+			break
+		}
+		key := it.Key()
+		if r.ring.Owner(key) == source {
+			continue
+		}
+		keys = append(keys, bytes.Clone(key))
+		values = append(values, bytes.Clone(it.Value()))
+	}
+	err = it.Error()
+	it.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var moved int64
+	for i, key := range keys {
+		if err := r.nodes[r.ring.Owner(key)].Put(key, values[i]); err != nil {
+			return moved, nil, err
+		}
+		if err := engine.Delete(key); err != nil {
+			return moved, nil, err
+		}
+		moved++
+	}
+	return moved, next, nil
+}
+
+// owners returns the engine a key belongs to, and the engine it belonged
+// to before the ring change in progress if that's another. Must be called
+// with mu held.
+func (r *Router) owners(key []byte) (common.StorageEngine, common.StorageEngine) {
+	owner := r.nodes[r.ring.Owner(key)]
+	if r.prev == nil {
+		return owner, nil
+	}
+	prev := r.nodes[r.prev.Owner(key)]
+	if prev == owner {
+		return owner, nil
+	}
+	return owner, prev
+}
+
+func (r *Router) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return common.ErrKeyEmpty
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	owner, prev := r.owners(key)
+	if owner == nil {
+		return errNoNodes
+	}
+	if err := owner.Put(key, value); err != nil {
+		return err
+	}
+	if prev != nil {
+		// Don't leave an older value to be read or moved over this one
+		return prev.Delete(key)
+	}
+	return nil
+}
+
+func (r *Router) Get(key []byte) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	owner, prev := r.owners(key)
+	if owner == nil {
+		return nil, errNoNodes
+	}
+	value, err := owner.Get(key)
+	if errors.Is(err, common.ErrKeyNotFound) && prev != nil {
+		return prev.Get(key)
+	}
+	return value, err
+}
+
+func (r *Router) Has(key []byte) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	owner, prev := r.owners(key)
+	if owner == nil {
+		return false, errNoNodes
+	}
+	exists, err := owner.Has(key)
+	if err == nil && !exists && prev != nil {
+		return prev.Has(key)
+	}
+	return exists, err
+}
+
+func (r *Router) Delete(key []byte) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	owner, prev := r.owners(key)
+	if owner == nil {
+		return errNoNodes
+	}
+	if err := owner.Delete(key); err != nil {
+		return err
+	}
+	if prev != nil {
+		return prev.Delete(key)
+	}
+	return nil
+}
+
+// errNoNodes is returned routing a key before any node was added
+var errNoNodes = errors.New("cluster: router has no nodes")
+
+// each calls fn for every node, in name order, joining their errors. A
+// node whose removal is in progress is off the ring but still included.
+func (r *Router) each(fn func(name string, engine common.StorageEngine) error) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(r.nodes)) {
+		if err := fn(name, r.nodes[name]); err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sync syncs every node
+func (r *Router) Sync() error {
+	return r.each(func(_ string, engine common.StorageEngine) error {
+		return engine.Sync()
+	})
+}
+
+// Compact compacts every node
+func (r *Router) Compact() error {
+	return r.each(func(_ string, engine common.StorageEngine) error {
+		return engine.Compact()
+	})
+}
+
+// Close closes every node
+func (r *Router) Close() error {
+	return r.each(func(_ string, engine common.StorageEngine) error {
+		return engine.Close()
+	})
+}
+
+// Stats adds up the nodes' counts and sizes. Amplification factors are
+// averaged over the nodes.
+func (r *Router) Stats() common.Stats {
+	var total common.Stats
+	var n float64
+	r.each(func(_ string, engine common.StorageEngine) error {
+		s := engine.Stats()
+		total.NumKeys += s.NumKeys
+		total.NumSegments += s.NumSegments
+		total.ActiveSegSize += s.ActiveSegSize
+		total.TotalDiskSize += s.TotalDiskSize
+		total.NumTombstones += s.NumTombstones
+		total.DeadBytes += s.DeadBytes
+		total.WriteCount += s.WriteCount
+		total.ReadCount += s.ReadCount
+		total.CompactCount += s.CompactCount
+		total.WriteAmp += s.WriteAmp
+		total.SpaceAmp += s.SpaceAmp
+		total.ReadAmp += s.ReadAmp
+		total.ReadAmpP99 = max(total.ReadAmpP99, s.ReadAmpP99)
+		total.CorruptionCount += s.CorruptionCount
+		total.Quarantined = append(total.Quarantined, s.Quarantined...)
+		total.DiskFullEvents += s.DiskFullEvents
+		total.ReadRepairs += s.ReadRepairs
+		n++
+		return nil
+	})
+	if n > 0 {
+		total.WriteAmp /= n
+		total.SpaceAmp /= n
+		total.ReadAmp /= n
+	}
+	return total
+}
+
+// Health combines the nodes' diagnoses: it is OK only if every node is,
+// and each problem is prefixed with its node's name
+func (r *Router) Health() common.Health {
+	combined := common.Health{
+		WALWritable: true,
+		DiskFree:    -1,
+		Workers:     make(map[string]bool),
+	}
+	var errs []error
+	r.each(func(name string, engine common.StorageEngine) error {
+		h := engine.Health()
+		for _, problem := range h.Problems {
+			combined.Problems = append(combined.Problems, name+": "+problem)
+		}
+		if !h.WALWritable {
+			combined.WALWritable = false
+			errs = append(errs, h.WALError)
+		}
+		if h.DiskFree >= 0 && (combined.DiskFree < 0 || h.DiskFree < combined.DiskFree) {
+			combined.DiskFree = h.DiskFree
+			combined.DiskReserve = h.DiskReserve
+		}
+		combined.ReadOnly = combined.ReadOnly || h.ReadOnly
+		for worker, running := range h.Workers {
+			combined.Workers[name+"/"+worker] = running
+		}
+		if h.Stalled {
+			combined.Stalled = true
+			combined.StallReason = name + ": " + h.StallReason
+		}
+		combined.CorruptionCount += h.CorruptionCount
+		combined.Quarantined = append(combined.Quarantined, h.Quarantined...)
+		combined.Closed = combined.Closed || h.Closed
+		return nil
+	})
+	combined.WALError = errors.Join(errs...)
+	combined.OK = len(combined.Problems) == 0
+	return combined
+}
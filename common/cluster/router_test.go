@@ -0,0 +1,454 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// openNode opens an LSM-Tree in memory for a router node
+func openNode(t *testing.T) *lsm.Adapter {
+	t.Helper()
+	config := lsm.DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 16 << 10
+	engine, err := lsm.NewAdapter(config)
+	if err != nil {
+		t.Fatalf("Failed to open node: %v", err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+// newTestRouter returns a router over the named nodes, with numKeys keys
+// written through it
+func newTestRouter(t *testing.T, names []string, numKeys int) *Router {
+	t.Helper()
+	r := NewRouter(0)
+	for _, name := range names {
+		if _, err := r.AddNode(name, openNode(t)); err != nil {
+			t.Fatalf("AddNode %s failed: %v", name, err)
+		}
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := r.Put(testKey(i), testValue(i, 0)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	return r
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%05d", i))
+}
+
+func testValue(i, version int) []byte {
+	return []byte(fmt.Sprintf("value%05d-%d", i, version))
+}
+
+// checkPlacement checks that every key below numKeys reads back through
+// the router and is held by its owner alone
+func checkPlacement(t *testing.T, r *Router, numKeys int) {
+	t.Helper()
+	for i := 0; i < numKeys; i++ {
+		key := testKey(i)
+		value, err := r.Get(key)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", key, err)
+		}
+		if !bytes.Equal(value, testValue(i, 0)) {
+			t.Fatalf("Get %s = %s, want %s", key, value, testValue(i, 0))
+		}
+		owner := r.Owner(key)
+		for _, name := range r.Nodes() {
+			has, err := r.Node(name).Has(key)
+			if err != nil {
+				t.Fatalf("Has failed: %v", err)
+			}
+			if has != (name == owner) {
+				t.Fatalf("Node %s has %s = %v, owner is %s", name, key, has, owner)
+			}
+		}
+	}
+}
+
+// countKeys returns how many keys an engine holds
+func countKeys(t *testing.T, engine common.StorageEngine) int {
+	t.Helper()
+	it, err := engine.(common.Scanner).Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return n
+}
+
+func TestRingDistribution(t *testing.T) {
+	ring := NewRing(0)
+	nodes := []string{"a", "b", "c", "d"}
+	for _, node := range nodes {
+		ring.Add(node)
+	}
+
+	const numKeys = 40000
+	counts := make(map[string]int)
+	for i := 0; i < numKeys; i++ {
+		counts[ring.Owner(testKey(i))]++
+	}
+	for _, node := range nodes {
+		share := float64(counts[node]) / numKeys
+		if math.Abs(share-0.25) > 0.07 {
+			t.Errorf("Node %s owns %.1f%% of keys, want about 25%%", node, share*100)
+		}
+	}
+
+	// Placement depends on the nodes alone, not the order they came in
+	other := NewRing(0)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		other.Add(nodes[i])
+	}
+	other.Add("a") // Again, which does nothing
+	clone := ring.Clone()
+	for i := 0; i < numKeys; i++ {
+		key := testKey(i)
+		if owner := ring.Owner(key); other.Owner(key) != owner || clone.Owner(key) != owner {
+			t.Fatalf("Owner of %s differs between rings with the same nodes", key)
+		}
+	}
+
+	if owner := NewRing(0).Owner([]byte("key")); owner != "" {
+		t.Errorf("Empty ring placed a key on %q", owner)
+	}
+}
+
+func TestRingStability(t *testing.T) {
+	ring := NewRing(0)
+	for _, node := range []string{"a", "b", "c", "d"} {
+		ring.Add(node)
+	}
+
+	// Adding a node moves only keys to it, about a fifth of them
+	grown := ring.Clone()
+	grown.Add("e")
+	const numKeys = 20000
+	moved := 0
+	for i := 0; i < numKeys; i++ {
+		before, after := ring.Owner(testKey(i)), grown.Owner(testKey(i))
+		if before == after {
+			continue
+		}
+		if after != "e" {
+			t.Fatalf("Adding e moved %s from %s to %s", testKey(i), before, after)
+		}
+		moved++
+	}
+	if share := float64(moved) / numKeys; math.Abs(share-0.2) > 0.06 {
+		t.Errorf("Adding a fifth node moved %.1f%% of keys, want about 20%%", share*100)
+	}
+
+	// Removing a node moves only its keys, and removing the one added
+	// puts every key back
+	shrunk := ring.Clone()
+	shrunk.Remove("b")
+	grown.Remove("e")
+	for i := 0; i < numKeys; i++ {
+		key := testKey(i)
+		before := ring.Owner(key)
+		if after := shrunk.Owner(key); (before == "b") == (after == before) || after == "b" {
+			t.Fatalf("Removing b moved %s from %s to %s", key, before, after)
+		}
+		if grown.Owner(key) != before {
+			t.Fatalf("Adding and removing e moved %s", key)
+		}
+	}
+	if ring.Has("e") || !grown.Has("a") || shrunk.Has("b") {
+		t.Error("Has disagrees with the ring's nodes")
+	}
+}
+
+func TestRouterAddRemoveNode(t *testing.T) {
+	const numKeys = 3000
+	r := newTestRouter(t, []string{"a", "b", "c"}, numKeys)
+	checkPlacement(t, r, numKeys)
+
+	// AddNode moves exactly the keys the new node owns
+	before := r.ring.Clone()
+	if _, err := r.AddNode("a", openNode(t)); err == nil {
+		t.Error("AddNode accepted a node that exists")
+	}
+	moved, err := r.AddNode("d", openNode(t))
+	if err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+	want := int64(0)
+	for i := 0; i < numKeys; i++ {
+		if before.Owner(testKey(i)) != r.Owner(testKey(i)) {
+			want++
+		}
+	}
+	if moved != want || moved == 0 {
+		t.Errorf("AddNode moved %d keys, want %d", moved, want)
+	}
+	checkPlacement(t, r, numKeys)
+
+	// RemoveNode moves exactly the keys the node owned
+	want = 0
+	for i := 0; i < numKeys; i++ {
+		if r.Owner(testKey(i)) == "b" {
+			want++
+		}
+	}
+	engine, moved, err := r.RemoveNode("b")
+	if err != nil {
+		t.Fatalf("RemoveNode failed: %v", err)
+	}
+	if moved != want || moved == 0 {
+		t.Errorf("RemoveNode moved %d keys, want %d", moved, want)
+	}
+	if n := countKeys(t, engine); n != 0 {
+		t.Errorf("Removed node still holds %d keys", n)
+	}
+	if r.Node("b") != nil {
+		t.Error("Removed node is still in the router")
+	}
+	checkPlacement(t, r, numKeys)
+
+	if _, _, err := r.RemoveNode("b"); err == nil {
+		t.Error("RemoveNode accepted a node that doesn't exist")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, _, err := r.RemoveNode(name); err != nil {
+			t.Fatalf("RemoveNode failed: %v", err)
+		}
+	}
+	if _, _, err := r.RemoveNode("d"); err == nil {
+		t.Error("RemoveNode removed the last node")
+	}
+	checkPlacement(t, r, numKeys)
+}
+
+// TestRouterConcurrentMigration writes, reads and deletes while nodes are
+// added and removed. Each writer has keys of its own, so it knows what
+// every read must return.
+func TestRouterConcurrentMigration(t *testing.T) {
+	const numKeys = 2000
+	const writers = 4
+	r := newTestRouter(t, []string{"a", "b"}, numKeys)
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	finals := make([]map[int]int, writers) // Each key's version, -1 deleted
+	for w := 0; w < writers; w++ {
+		finals[w] = make(map[int]int)
+		wg.Add(1)
+		go func(w int, versions map[int]int) {
+			defer wg.Done()
+			for round := 1; !stop.Load(); round++ {
+				for i := w; i < numKeys && !stop.Load(); i += writers {
+					key := testKey(i)
+					var err error
+					if (i+round)%5 == 0 {
+						err = r.Delete(key)
+						versions[i] = -1
+					} else {
+						err = r.Put(key, testValue(i, round))
+						versions[i] = round
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+
+					value, err := r.Get(key)
+					if versions[i] == -1 {
+						if !errors.Is(err, common.ErrKeyNotFound) {
+							errs <- fmt.Errorf("Get %s after Delete returned %q, %v", key, value, err)
+							return
+						}
+						continue
+					}
+					if err != nil || !bytes.Equal(value, testValue(i, round)) {
+						errs <- fmt.Errorf("Get %s = %q, %v, want %s", key, value, err, testValue(i, round))
+						return
+					}
+				}
+			}
+		}(w, finals[w])
+	}
+
+	// Change the ring under the writers a few times
+	for _, change := range []string{"+c", "+d", "-a", "+e", "-c"} {
+		var err error
+		if change[0] == '+' {
+			_, err = r.AddNode(change[1:], openNode(t))
+		} else {
+			_, _, err = r.RemoveNode(change[1:])
+		}
+		if err != nil {
+			t.Fatalf("%s failed: %v", change, err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Every key has its last write, on its owner alone
+	for w, versions := range finals {
+		for i := w; i < numKeys; i += writers {
+			key := testKey(i)
+			version, written := versions[i]
+			value, err := r.Get(key)
+			switch {
+			case written && version == -1:
+				if !errors.Is(err, common.ErrKeyNotFound) {
+					t.Fatalf("Deleted %s reads back as %q, %v", key, value, err)
+				}
+			case !written:
+				version = 0
+				fallthrough
+			default:
+				if err != nil || !bytes.Equal(value, testValue(i, version)) {
+					t.Fatalf("Get %s = %q, %v, want %s", key, value, err, testValue(i, version))
+				}
+			}
+
+			owner := r.Owner(key)
+			for _, name := range r.Nodes() {
+				has, _ := r.Node(name).Has(key)
+				if has && name != owner {
+					t.Fatalf("Node %s holds %s, owned by %s", name, key, owner)
+				}
+			}
+		}
+	}
+}
+
+func TestRouterNotSupported(t *testing.T) {
+	config := hashindex.DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	hash, err := hashindex.New(config)
+	if err != nil {
+		t.Fatalf("Failed to open hash index: %v", err)
+	}
+	defer hash.Close()
+
+	// The hash index can't list the keys to move off it
+	r := newTestRouter(t, []string{"a"}, 500)
+	if _, err := r.AddNode("hash", hash); err != nil {
+		t.Fatalf("AddNode of the hash index failed: %v", err)
+	}
+	checkPlacement(t, r, 500)
+	if _, err := r.AddNode("b", openNode(t)); !errors.Is(err, common.ErrNotSupported) {
+		t.Errorf("AddNode with a hash index node returned %v, want ErrNotSupported", err)
+	}
+	if _, _, err := r.RemoveNode("hash"); !errors.Is(err, common.ErrNotSupported) {
+		t.Errorf("RemoveNode of a hash index returned %v, want ErrNotSupported", err)
+	}
+
+	// Turned down before anything changed
+	if nodes := r.Nodes(); len(nodes) != 2 || r.Node("b") != nil {
+		t.Errorf("Router has nodes %v after the changes were turned down", nodes)
+	}
+	checkPlacement(t, r, 500)
+
+	if _, err := NewRouter(0).Get([]byte("key")); err == nil {
+		t.Error("Get on a router without nodes succeeded")
+	}
+}
+
+// failingNode fails Put once armed
+type failingNode struct {
+	*lsm.Adapter
+	fail atomic.Bool
+}
+
+var errInjected = errors.New("injected failure")
+
+func (n *failingNode) Put(key, value []byte) error {
+	if n.fail.Load() {
+		return errInjected
+	}
+	return n.Adapter.Put(key, value)
+}
+
+func TestRouterFailedMigration(t *testing.T) {
+	const numKeys = 2000
+	r := newTestRouter(t, []string{"a", "b"}, numKeys)
+
+	// An added node failing partway leaves the change in progress, with
+	// reads falling back to the old nodes
+	bad := &failingNode{Adapter: openNode(t)}
+	bad.fail.Store(true)
+	if _, err := r.AddNode("bad", bad); !errors.Is(err, errInjected) {
+		t.Fatalf("AddNode returned %v, want the injected failure", err)
+	}
+	for i := 0; i < numKeys; i++ {
+		if value, err := r.Get(testKey(i)); err != nil || !bytes.Equal(value, testValue(i, 0)) {
+			t.Fatalf("Get %s = %q, %v during the failed change", testKey(i), value, err)
+		}
+	}
+
+	// No other change can start until it is undone
+	if _, err := r.AddNode("c", openNode(t)); err == nil {
+		t.Error("AddNode started a change with another in progress")
+	}
+	if _, _, err := r.RemoveNode("a"); err == nil {
+		t.Error("RemoveNode started a change with another in progress")
+	}
+
+	// Removing it undoes the change
+	bad.fail.Store(false)
+	if _, _, err := r.RemoveNode("bad"); err != nil {
+		t.Fatalf("RemoveNode failed: %v", err)
+	}
+	if r.prev != nil {
+		t.Error("Change still in progress after RemoveNode")
+	}
+	checkPlacement(t, r, numKeys)
+
+	// A removal failing partway can be retried
+	c := &failingNode{Adapter: openNode(t)}
+	if _, err := r.AddNode("c", c); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+	c.fail.Store(true)
+	if _, _, err := r.RemoveNode("a"); !errors.Is(err, errInjected) {
+		t.Fatalf("RemoveNode returned %v, want the injected failure", err)
+	}
+	for i := 0; i < numKeys; i++ {
+		if value, err := r.Get(testKey(i)); err != nil || !bytes.Equal(value, testValue(i, 0)) {
+			t.Fatalf("Get %s = %q, %v during the failed removal", testKey(i), value, err)
+		}
+	}
+	if nodes := r.Nodes(); len(nodes) != 2 {
+		t.Errorf("Ring has nodes %v during the removal of a", nodes)
+	}
+	c.fail.Store(false)
+	engine, _, err := r.RemoveNode("a")
+	if err != nil {
+		t.Fatalf("Retried RemoveNode failed: %v", err)
+	}
+	if n := countKeys(t, engine); n != 0 {
+		t.Errorf("Removed node still holds %d keys", n)
+	}
+	checkPlacement(t, r, numKeys)
+}
@@ -0,0 +1,38 @@
+package common
+
+import "bytes"
+
+// Comparator defines the key order of the ordered engines (LSM-Tree and
+// B-Tree). Compare returns a negative number, zero or a positive number
+// when a sorts before, equal to or after b. It must return zero only for
+// identical keys, since equality and bloom filters work on raw bytes: a
+// case-insensitive order, for example, breaks ties bytewise. Name
+// identifies the ordering: it is stored with the data and checked on
+// open, because data sorted by one comparator can't be read with another.
+type Comparator interface {
+	Compare(a, b []byte) int
+	Name() string
+}
+
+// BytewiseComparator orders keys by their raw bytes (bytes.Compare). It is
+// the default.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int { return bytes.Compare(a, b) }
+func (bytewiseComparator) Name() string            { return "bytewise" }
+
+// ComparatorName returns c's name, treating nil as BytewiseComparator
+func ComparatorName(c Comparator) string {
+	if c == nil {
+		return BytewiseComparator.Name()
+	}
+	return c.Name()
+}
+
+// IsBytewise reports whether c orders keys bytewise (nil included), so
+// callers can use faster native comparisons
+func IsBytewise(c Comparator) bool {
+	return c == nil || c.Name() == BytewiseComparator.Name()
+}
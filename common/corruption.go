@@ -0,0 +1,114 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// QuarantineDir is the subdirectory of a data directory that damaged files
+// are moved into
+const QuarantineDir = "corrupt"
+
+// CorruptionError reports damaged data in a file. It matches ErrCorruption
+// with errors.Is.
+type CorruptionError struct {
+	Path string // File holding the damaged data
+	Err  error  // What is wrong with it
+}
+
+// Corruptf returns a CorruptionError for the file at path
+func Corruptf(path, format string, args ...any) error {
+	return &CorruptionError{Path: path, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v in %s: %v", ErrCorruption, e.Path, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() []error {
+	return []error{ErrCorruption, e.Err}
+}
+
+// CorruptPath returns the file a corruption error is about, or "" if err
+// doesn't report corruption in a known file
+func CorruptPath(err error) string {
+	var ce *CorruptionError
+	if errors.As(err, &ce) {
+		return ce.Path
+	}
+	return ""
+}
+
+// Quarantine moves the file at path into the QuarantineDir subdirectory of
+// dataDir, where engines no longer see it but it is kept for inspection.
+// A numeric suffix keeps it from replacing an earlier file of the same
+// name. The file must not be open (see FS.Rename). Returns the new path.
+func Quarantine(fs FS, dataDir, path string) (string, error) {
+	dir := filepath.Join(dataDir, QuarantineDir)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(path)
+	dest := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := fs.Stat(dest); err != nil {
+			break
+		}
+		dest = filepath.Join(dir, fmt.Sprintf("%s.%d", name, i))
+	}
+
+	if err := fs.Rename(path, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// CorruptionLog records the corruption an engine has run into, for its
+// Stats
+type CorruptionLog struct {
+	// OnCorruption, if set, is called by Record with what was found. Set
+	// it before the log is used.
+	OnCorruption func(err error)
+
+	mu          sync.Mutex
+	count       int64
+	quarantined []string
+}
+
+// Record counts one instance of corruption found, described by err
+func (l *CorruptionLog) Record(err error) {
+	l.mu.Lock()
+	l.count++
+	l.mu.Unlock()
+
+	if l.OnCorruption != nil {
+		l.OnCorruption(err)
+	}
+}
+
+// Quarantined notes a file moved into quarantine
+func (l *CorruptionLog) Quarantined(path string) {
+	l.mu.Lock()
+	l.quarantined = append(l.quarantined, path)
+	l.mu.Unlock()
+}
+
+// Count returns how many instances of corruption were recorded
+func (l *CorruptionLog) Count() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+// Files returns the paths files were quarantined to, oldest first
+func (l *CorruptionLog) Files() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.quarantined) == 0 {
+		return nil
+	}
+	return append([]string(nil), l.quarantined...)
+}
@@ -0,0 +1,25 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// AddCounter adds delta to a counter's current value, as Incrementer's
+// engines store it, and returns the value to write back and the sum. A
+// counter not found counts as 0.
+func AddCounter(value []byte, found bool, delta int64) ([]byte, int64, error) {
+	var n int64
+	if found {
+		var err error
+		if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return nil, 0, fmt.Errorf("%w: %.20q", ErrNotCounter, value)
+		}
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		return nil, 0, fmt.Errorf("%w: %d%+d overflows", ErrNotCounter, n, delta)
+	}
+	n += delta
+	return strconv.AppendInt(nil, n, 10), n, nil
+}
@@ -0,0 +1,173 @@
+package common
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DeferredDeleteFS wraps an FS so that removing a file that can't be
+// removed yet queues it instead of failing. Windows refuses to delete a
+// file while any handle has it open (an iterator, a read racing a
+// compaction, a virus scanner), where Unix just unlinks it.
+//
+// Queued files are retried whenever a file opened through the FS is
+// closed, and by RetryDeletes. Until then they are hidden: Open, Stat and
+// ReadDir report them missing, and creating or renaming onto the name
+// replaces them, so a later retry never deletes a newer file.
+type DeferredDeleteFS struct {
+	FS
+
+	mu      sync.Mutex
+	pending map[string]bool // Cleaned paths
+}
+
+// NewDeferredDeleteFS wraps fs
+func NewDeferredDeleteFS(fs FS) *DeferredDeleteFS {
+	return &DeferredDeleteFS{FS: FSOrDefault(fs), pending: make(map[string]bool)}
+}
+
+// Pending lists the files waiting to be deleted, sorted
+func (d *DeferredDeleteFS) Pending() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names := make([]string, 0, len(d.pending))
+	for name := range d.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RetryDeletes tries to delete every queued file again and returns how
+// many are still queued
+func (d *DeferredDeleteFS) RetryDeletes() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name := range d.pending {
+		if err := d.FS.Remove(name); err == nil || errors.Is(err, fs.ErrNotExist) {
+			delete(d.pending, name)
+		}
+	}
+	return len(d.pending)
+}
+
+// isPending reports whether name is queued for deletion
+func (d *DeferredDeleteFS) isPending(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending[filepath.Clean(name)]
+}
+
+func (d *DeferredDeleteFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	d.mu.Lock()
+	key := filepath.Clean(name)
+	if d.pending[key] {
+		if flag&os.O_CREATE == 0 {
+			d.mu.Unlock()
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		// A new file of the same name: start it empty whether or not the
+		// old one can go yet
+		if err := d.FS.Remove(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			flag |= os.O_TRUNC
+		}
+		delete(d.pending, key)
+	}
+	d.mu.Unlock()
+
+	f, err := d.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &deferredDeleteFile{File: f, fs: d}, nil
+}
+
+func (d *DeferredDeleteFS) Open(name string) (File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (d *DeferredDeleteFS) Create(name string) (File, error) {
+	return d.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Remove deletes name, or queues it if the wrapped FS refuses
+func (d *DeferredDeleteFS) Remove(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := filepath.Clean(name)
+	if d.pending[key] {
+		return nil
+	}
+	err := d.FS.Remove(name)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	d.pending[key] = true
+	return nil
+}
+
+func (d *DeferredDeleteFS) Rename(oldpath, newpath string) error {
+	if d.isPending(oldpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := d.FS.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	delete(d.pending, filepath.Clean(newpath))
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *DeferredDeleteFS) Stat(name string) (os.FileInfo, error) {
+	if d.isPending(name) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.FS.Stat(name)
+}
+
+func (d *DeferredDeleteFS) ReadDir(name string) ([]os.DirEntry, error) {
+	entries, err := d.FS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) == 0 {
+		return entries, nil
+	}
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !d.pending[filepath.Join(name, entry.Name())] {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, nil
+}
+
+// deferredDeleteFile retries the queued deletions once it's closed, as
+// it may have been what kept them open
+type deferredDeleteFile struct {
+	File
+	fs *DeferredDeleteFS
+}
+
+func (f *deferredDeleteFile) Close() error {
+	err := f.File.Close()
+
+	f.fs.mu.Lock()
+	retry := len(f.fs.pending) > 0
+	f.fs.mu.Unlock()
+	if retry {
+		f.fs.RetryDeletes()
+	}
+	return err
+}
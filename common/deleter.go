@@ -0,0 +1,146 @@
+package common
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// DeleteScheduler removes obsolete files (compaction inputs) in a
+// background goroutine, pacing itself to a byte rate. Deleting many large
+// files at once after a big compaction can stall other IO for a while on
+// some filesystems; spreading the deletions out avoids the latency spike.
+//
+// The caller must make sure a queued file is no longer part of the
+// engine's state on disk before queueing it, since it may still be there
+// after a crash.
+type DeleteScheduler struct {
+	fs          FS
+	bytesPerSec int64 // 0 = delete immediately
+
+	mu     sync.Mutex
+	queue  []string
+	closed bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDeleteScheduler returns a scheduler deleting from fs at up to
+// bytesPerSec. With bytesPerSec <= 0 Delete removes files right away and
+// no goroutine is started.
+func NewDeleteScheduler(fs FS, bytesPerSec int64) *DeleteScheduler {
+	d := &DeleteScheduler{fs: fs, bytesPerSec: bytesPerSec}
+	if bytesPerSec > 0 {
+		d.wake = make(chan struct{}, 1)
+		d.stop = make(chan struct{})
+		d.done = make(chan struct{})
+		go d.run()
+	}
+	return d
+}
+
+// Delete removes path, or queues it if deletions are paced. A queued
+// file that can't be deleted is left behind for the engine's startup
+// cleanup.
+func (d *DeleteScheduler) Delete(path string) error {
+	d.mu.Lock()
+	if d.bytesPerSec <= 0 || d.closed {
+		d.mu.Unlock()
+		return d.remove(path)
+	}
+	d.queue = append(d.queue, path)
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the number of files waiting to be deleted
+func (d *DeleteScheduler) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queue)
+}
+
+// Close deletes whatever is still queued without pacing and stops the
+// goroutine. Files passed to Delete afterwards are removed right away.
+func (d *DeleteScheduler) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+	for path := d.next(); path != ""; path = d.next() {
+		d.remove(path)
+	}
+}
+
+// run deletes queued files, waiting after each for as long as its size
+// takes at the configured rate
+func (d *DeleteScheduler) run() {
+	defer close(d.done)
+
+	for {
+		path := d.next()
+		if path == "" {
+			select {
+			case <-d.wake:
+				continue
+			case <-d.stop:
+				return
+			}
+		}
+
+		var size int64
+		if info, err := d.fs.Stat(path); err == nil {
+			size = info.Size()
+		}
+		d.remove(path)
+
+		pause := time.Duration(float64(size) / float64(d.bytesPerSec) * float64(time.Second))
+		if pause <= 0 {
+			continue
+		}
+		timer := time.NewTimer(pause)
+		select {
+		case <-timer.C:
+		case <-d.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// next pops the oldest queued file, "" if there is none
+func (d *DeleteScheduler) next() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.queue) == 0 {
+		return ""
+	}
+	path := d.queue[0]
+	d.queue = d.queue[1:]
+	return path
+}
+
+// remove deletes path, ignoring a file that is already gone
+func (d *DeleteScheduler) remove(path string) error {
+	if err := d.fs.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
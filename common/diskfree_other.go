@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || windows)
+
+package common
+
+import "errors"
+
+// diskFree is unsupported where there's no statfs-like call
+func diskFree(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
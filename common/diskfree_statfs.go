@@ -0,0 +1,15 @@
+//go:build darwin || dragonfly || freebsd || linux
+
+package common
+
+import "syscall"
+
+// diskFree returns the space statfs reports available to unprivileged
+// users
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DiskGuard checks free space before an engine starts writing a new file
+// (a flush, a compaction, a new segment). Below the low watermark the work
+// is refused and the engine turns read-only, rather than failing halfway
+// through a file and leaving it behind; once space is freed it turns
+// writable again.
+type DiskGuard struct {
+	fs        FS
+	path      string
+	watermark int64 // 0 = off
+
+	readOnly atomic.Bool
+	events   atomic.Int64 // Times it turned read-only
+}
+
+// NewDiskGuard returns a guard for the filesystem holding path. A
+// watermark of 0 or less disables it.
+func NewDiskGuard(fs FS, path string, watermark int64) *DiskGuard {
+	return &DiskGuard{fs: fs, path: path, watermark: watermark}
+}
+
+// Check measures the free space, returning an error matching ErrDiskFull
+// if it is below the watermark. Space the FS can't measure counts as
+// enough.
+func (g *DiskGuard) Check() error {
+	if g.watermark <= 0 {
+		return nil
+	}
+	free, err := g.fs.DiskFree(g.path)
+	if err != nil || free >= g.watermark {
+		g.readOnly.Store(false)
+		return nil
+	}
+	if !g.readOnly.Swap(true) {
+		g.events.Add(1)
+	}
+	return fmt.Errorf("%w: %d bytes free, below the %d byte low watermark", ErrDiskFull, free, g.watermark)
+}
+
+// ReadOnly reports whether the last Check found too little space
+func (g *DiskGuard) ReadOnly() bool {
+	return g.readOnly.Load()
+}
+
+// Events counts the times Check has turned the guard read-only
+func (g *DiskGuard) Events() int64 {
+	return g.events.Load()
+}
@@ -0,0 +1,521 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// KeyProvider hands out the AES keys (16, 24 or 32 bytes) an EncryptedFS
+// encrypts files with. Every file records the id of the key it was
+// written with, so a provider can introduce new keys while files written
+// with older ones stay readable.
+type KeyProvider interface {
+	// CurrentKey returns the key new files are written with, and its id
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given id
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider with a single key, id 0
+type StaticKey []byte
+
+func (k StaticKey) CurrentKey() (uint32, []byte, error) { return 0, k, nil }
+
+func (k StaticKey) Key(id uint32) ([]byte, error) {
+	if id != 0 {
+		return nil, fmt.Errorf("%w: no key with id %d", ErrEncryptionKey, id)
+	}
+	return k, nil
+}
+
+// Encrypt wraps fs in an EncryptedFS when an engine config sets a key or
+// a key provider, and returns it unchanged when it sets neither
+func Encrypt(fs FS, key []byte, keys KeyProvider) (FS, error) {
+	switch {
+	case key == nil && keys == nil:
+		return fs, nil
+	case key != nil && keys != nil:
+		return nil, errors.New("EncryptionKey can't be combined with a KeyProvider")
+	case key != nil:
+		keys = StaticKey(key)
+	}
+	return NewEncryptedFS(fs, keys)
+}
+
+// A file written through an EncryptedFS starts with a header naming the
+// key it is encrypted with, followed by the data in blocks that are each
+// sealed with AES-GCM under a fresh random nonce:
+//
+//	header: [magic(4)][keyID(4)][fileID(16)][checkNonce(12)][checkTag(16)]
+//	block:  [nonce(12)][ciphertext(up to 4096)][tag(16)]
+//
+// The file ID is random, and with the block number forms each block's
+// additional data, so blocks can't be moved within or between files
+// undetected. The check tag seals the header itself, so a wrong key is
+// told apart from damaged data. Writing into a block re-encrypts all of
+// it, including appending to the last one.
+const (
+	encryptedMagic      = 0x454E4352 // "ENCR" in hex
+	encryptedNonceSize  = 12
+	encryptedTagSize    = 16
+	encryptedFileIDSize = 16
+	encryptedHeaderSize = 4 + 4 + encryptedFileIDSize + encryptedNonceSize + encryptedTagSize
+
+	encryptedDataSize  = 4096 // Plaintext bytes per block
+	encryptedBlockSize = encryptedNonceSize + encryptedDataSize + encryptedTagSize
+)
+
+// EncryptedFS wraps an FS and encrypts the contents of every file opened
+// through it (see KeyProvider). Names, sizes and directory layout are not
+// hidden; sizes reported by Stat and ReadDir are those of the plaintext.
+type EncryptedFS struct {
+	FS
+	keys KeyProvider
+
+	mu    sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+// NewEncryptedFS wraps fs, failing if keys has no usable current key
+func NewEncryptedFS(fs FS, keys KeyProvider) (*EncryptedFS, error) {
+	e := &EncryptedFS{FS: FSOrDefault(fs), keys: keys, aeads: make(map[uint32]cipher.AEAD)}
+	if _, _, err := e.currentKey(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// currentKey returns the cipher new files are written with, and its id
+func (e *EncryptedFS) currentKey() (uint32, cipher.AEAD, error) {
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := e.cipher(id, key)
+	return id, aead, err
+}
+
+// cipher returns the cipher for key id, creating it from key, or from
+// the provider if key is nil
+func (e *EncryptedFS) cipher(id uint32, key []byte) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if aead, ok := e.aeads[id]; ok {
+		return aead, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = e.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d: %v", ErrEncryptionKey, id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[id] = aead
+	return aead, nil
+}
+
+// StaleKey reports whether f, opened through fs, is encrypted with a key
+// other than the provider's current one, so it should be rewritten after
+// a key rotation. It is always false without encryption.
+func StaleKey(fs FS, f File) bool {
+	e, ok := fs.(*EncryptedFS)
+	if !ok {
+		return false
+	}
+	ef, ok := f.(*encryptedFile)
+	if !ok || ef.aead == nil {
+		return false
+	}
+	id, _, err := e.keys.CurrentKey()
+	return err == nil && ef.keyID != id
+}
+
+func (e *EncryptedFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	// The last block is read back to append to it
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	rawFlag := flag &^ (os.O_WRONLY | os.O_APPEND)
+	if writable {
+		rawFlag |= os.O_RDWR
+	}
+
+	f, err := e.FS.OpenFile(name, rawFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	ef := &encryptedFile{File: f, append: flag&os.O_APPEND != 0}
+	if err := e.init(ef, writable); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ef, nil
+}
+
+func (e *EncryptedFS) Open(name string) (File, error) {
+	return e.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (e *EncryptedFS) Create(name string) (File, error) {
+	return e.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// init reads the header of a newly opened file, or writes one if the file
+// is empty. A header cut short was never synced, so nothing was written
+// after it either, and the file counts as empty.
+func (e *EncryptedFS) init(f *encryptedFile, writable bool) error {
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, min(info.Size(), encryptedHeaderSize))
+	if _, err := f.File.ReadAt(header, 0); err != nil && len(header) > 0 {
+		return fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	if len(header) >= 4 && binary.LittleEndian.Uint32(header[0:]) != encryptedMagic {
+		return fmt.Errorf("%s: %w", f.Name(), ErrNotEncrypted)
+	}
+	if len(header) < encryptedHeaderSize {
+		if !writable {
+			return nil
+		}
+		return e.writeHeader(f)
+	}
+	id := binary.LittleEndian.Uint32(header[4:])
+	aead, err := e.cipher(id, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	fields := header[:8+encryptedFileIDSize]
+	nonce := header[len(fields) : len(fields)+encryptedNonceSize]
+	if _, err := aead.Open(nil, nonce, header[len(fields)+encryptedNonceSize:], fields); err != nil {
+		return fmt.Errorf("%s: %w: the header doesn't authenticate with key %d", f.Name(), ErrEncryptionKey, id)
+	}
+
+	f.aead = aead
+	f.keyID = id
+	copy(f.fileID[:], header[8:])
+	f.size = plaintextSize(info.Size())
+	return nil
+}
+
+// writeHeader starts f as an empty file encrypted with the current key
+func (e *EncryptedFS) writeHeader(f *encryptedFile) error {
+	id, aead, err := e.currentKey()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 8+encryptedFileIDSize, encryptedHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], encryptedMagic)
+	binary.LittleEndian.PutUint32(header[4:], id)
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := rand.Read(header[8:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	header = aead.Seal(append(header, nonce...), nonce, nil, header)
+
+	if err := f.File.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.File.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	f.aead = aead
+	f.keyID = id
+	copy(f.fileID[:], header[8:])
+	return nil
+}
+
+func (e *EncryptedFS) Stat(name string) (os.FileInfo, error) {
+	info, err := e.FS.Stat(name)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	return encryptedInfo{FileInfo: info, size: plaintextSize(info.Size())}, nil
+}
+
+func (e *EncryptedFS) ReadDir(name string) ([]os.DirEntry, error) {
+	entries, err := e.FS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if !entry.IsDir() {
+			entries[i] = encryptedEntry{entry}
+		}
+	}
+	return entries, nil
+}
+
+// plaintextSize returns the size of the data in an encrypted file of
+// rawSize bytes. A block cut short by a crash adds only what is left of
+// its ciphertext, which then fails to authenticate when read.
+func plaintextSize(rawSize int64) int64 {
+	if rawSize <= encryptedHeaderSize {
+		return 0
+	}
+	rawSize -= encryptedHeaderSize
+	size := rawSize / encryptedBlockSize * encryptedDataSize
+	if rest := rawSize%encryptedBlockSize - encryptedNonceSize - encryptedTagSize; rest > 0 {
+		size += rest
+	}
+	return size
+}
+
+// encryptedInfo reports the plaintext size of an encrypted file
+type encryptedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i encryptedInfo) Size() int64 { return i.size }
+
+// encryptedEntry is a directory entry for an encrypted file
+type encryptedEntry struct {
+	os.DirEntry
+}
+
+func (e encryptedEntry) Info() (os.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return encryptedInfo{FileInfo: info, size: plaintextSize(info.Size())}, nil
+}
+
+// encryptedFile is a file opened through an EncryptedFS. Reads and writes
+// go through whole blocks; the file's own offset is kept here, since the
+// wrapped file's doesn't correspond to it.
+type encryptedFile struct {
+	File
+	aead   cipher.AEAD // nil for an empty file opened read-only
+	keyID  uint32
+	fileID [encryptedFileIDSize]byte
+	append bool
+
+	mu     sync.RWMutex
+	size   int64 // Plaintext bytes
+	offset int64 // For Read, Write and Seek
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.readAt(p, off)
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.append {
+		f.offset = f.size
+	}
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *encryptedFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case size == f.size:
+		return nil
+	case size > f.size:
+		_, err := f.writeAt(make([]byte, size-f.size), f.size)
+		return err
+	}
+
+	block := size / encryptedDataSize
+	rawSize := blockOffset(block)
+	if rest := size % encryptedDataSize; rest > 0 {
+		plain, err := f.readBlock(block)
+		if err != nil {
+			return err
+		}
+		if err := f.writeBlock(block, plain[:rest]); err != nil {
+			return err
+		}
+		rawSize += encryptedNonceSize + rest + encryptedTagSize
+	}
+	if err := f.File.Truncate(rawSize); err != nil {
+		return err
+	}
+	f.size = size
+	return nil
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return encryptedInfo{FileInfo: info, size: f.size}, nil
+}
+
+// readAt reads like ReadAt; the caller holds f.mu
+func (f *encryptedFile) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	end := min(off+int64(len(p)), f.size)
+
+	n := 0
+	for pos := off; pos < end; {
+		block := pos / encryptedDataSize
+		plain, err := f.readBlock(block)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:end-off], plain[pos-block*encryptedDataSize:])
+		n += copied
+		pos += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// writeAt writes like WriteAt, filling any gap past the end with zeros;
+// the caller holds f.mu
+func (f *encryptedFile) writeAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	if f.aead == nil {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: os.ErrPermission}
+	}
+	gap := int64(0)
+	if off > f.size {
+		gap = off - f.size
+		p = append(make([]byte, gap), p...)
+		off = f.size
+	}
+	end := off + int64(len(p))
+
+	for pos := off; pos < end; {
+		block := pos / encryptedDataSize
+		start := block * encryptedDataSize
+		stop := min(start+encryptedDataSize, end)
+		existing := min(max(f.size-start, 0), encryptedDataSize)
+
+		plain := make([]byte, max(existing, stop-start))
+		if pos > start || stop-start < existing {
+			old, err := f.readBlock(block)
+			if err != nil {
+				return int(max(pos-off-gap, 0)), err
+			}
+			copy(plain, old)
+		}
+		copy(plain[pos-start:], p[pos-off:stop-off])
+		if err := f.writeBlock(block, plain); err != nil {
+			return int(max(pos-off-gap, 0)), err
+		}
+
+		pos = stop
+		f.size = max(f.size, pos)
+	}
+	return len(p) - int(gap), nil
+}
+
+// readBlock reads and decrypts block number block
+func (f *encryptedFile) readBlock(block int64) ([]byte, error) {
+	length := min(f.size-block*encryptedDataSize, encryptedDataSize)
+	raw := make([]byte, encryptedNonceSize+length+encryptedTagSize)
+	if _, err := f.File.ReadAt(raw, blockOffset(block)); err != nil {
+		if err == io.EOF {
+			return nil, Corruptf(f.Name(), "encrypted block %d is truncated", block)
+		}
+		return nil, err
+	}
+
+	nonce := raw[:encryptedNonceSize]
+	plain, err := f.aead.Open(raw[encryptedNonceSize:encryptedNonceSize], nonce, raw[encryptedNonceSize:], f.blockData(block))
+	if err != nil {
+		return nil, Corruptf(f.Name(), "encrypted block %d failed authentication", block)
+	}
+	return plain, nil
+}
+
+// writeBlock encrypts plain as block number block under a new nonce
+func (f *encryptedFile) writeBlock(block int64, plain []byte) error {
+	nonce := make([]byte, encryptedNonceSize, encryptedBlockSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	raw := f.aead.Seal(nonce, nonce, plain, f.blockData(block))
+	_, err := f.File.WriteAt(raw, blockOffset(block))
+	return err
+}
+
+// blockData returns the additional data block number block is sealed with
+func (f *encryptedFile) blockData(block int64) []byte {
+	data := make([]byte, encryptedFileIDSize+8)
+	copy(data, f.fileID[:])
+	binary.LittleEndian.PutUint64(data[encryptedFileIDSize:], uint64(block))
+	return data
+}
+
+// blockOffset returns where block number block starts in the file
+func blockOffset(block int64) int64 {
+	return encryptedHeaderSize + block*encryptedBlockSize
+}
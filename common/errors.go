@@ -8,4 +8,31 @@ var (
 
 	ErrClosed   = errors.New("storage engine closed")
 	ErrKeyEmpty = errors.New("key cannot be empty")
+
+	ErrMemoryBudget = errors.New("memory budget exceeded")
+
+	ErrComparatorMismatch = errors.New("data was written with a different comparator")
+
+	ErrLocked = errors.New("data directory is locked by another engine")
+
+	// ErrConflict is returned by a conditional write whose key was
+	// written since it was read (see ConditionalWriter)
+	ErrConflict = errors.New("conditional write conflict")
+
+	// ErrNotCounter is returned by Incr for a key that doesn't hold a
+	// counter, or whose counter would overflow (see Incrementer)
+	ErrNotCounter = errors.New("value is not a counter")
+
+	// ErrNotSupported is returned for an operation the underlying engine
+	// can't do, such as a scan of a hash index
+	ErrNotSupported = errors.New("operation not supported by this engine")
+
+	// Returned by an EncryptedFS for a file written without encryption,
+	// and for a key it can't find or that doesn't decrypt the file
+	ErrNotEncrypted  = errors.New("file is not encrypted")
+	ErrEncryptionKey = errors.New("wrong or missing encryption key")
+
+	// ErrCorruption matches every error reporting damaged data on disk
+	// (see CorruptionError)
+	ErrCorruption = errors.New("data corruption")
 )
@@ -0,0 +1,202 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrInjectedFault is the error FaultFS fails operations with by default
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultOp is a kind of operation FaultFS can fail
+type FaultOp int
+
+const (
+	FaultOpen       FaultOp = iota // OpenFile, Open, Create, Lock
+	FaultRead                      // Read, ReadAt
+	FaultWrite                     // Write, WriteAt, Truncate
+	FaultShortWrite                // Write, WriteAt: writes half the buffer, then fails (a torn write)
+	FaultSync                      // File.Sync
+	FaultRename                    // Rename
+	FaultRemove                    // Remove
+	FaultMkdir                     // MkdirAll
+)
+
+// FaultFS wraps an FS and fails chosen operations, so tests can drive an
+// engine down its error and crash-recovery paths deterministically.
+// Operations nothing is injected into pass through to the wrapped FS.
+type FaultFS struct {
+	fs FS
+
+	mu     sync.Mutex
+	faults []*fault
+}
+
+// fault fails the operations matching it once skip more have succeeded
+type fault struct {
+	op    FaultOp
+	match string // Substring of the file name ("" = any file)
+	skip  int
+	err   error
+}
+
+// NewFaultFS wraps fs
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: FSOrDefault(fs)}
+}
+
+// FailAfter makes op fail with err on files whose name contains match
+// ("" = any file), once after more such operations have succeeded. Every
+// matching operation after that fails too, until Heal. A nil err is
+// ErrInjectedFault.
+func (f *FaultFS) FailAfter(op FaultOp, match string, after int, err error) {
+	if err == nil {
+		err = ErrInjectedFault
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault{op: op, match: match, skip: after, err: err})
+}
+
+// Heal removes every injected fault
+func (f *FaultFS) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// inject returns the error an operation on name fails with, if any
+func (f *FaultFS) inject(op FaultOp, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, flt := range f.faults {
+		if flt.op != op || !strings.Contains(name, flt.match) {
+			continue
+		}
+		if flt.skip > 0 {
+			flt.skip--
+			continue
+		}
+		return &os.PathError{Op: "fault", Path: name, Err: flt.err}
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := f.inject(FaultOpen, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if err := f.inject(FaultRename, oldpath); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.inject(FaultRemove, name); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.inject(FaultMkdir, path); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := f.inject(FaultOpen, name); err != nil {
+		return nil, err
+	}
+	return f.fs.Lock(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return f.fs.ReadDir(name)
+}
+
+func (f *FaultFS) DiskFree(path string) (int64, error) {
+	return f.fs.DiskFree(path)
+}
+
+// faultFile is a file opened through a FaultFS
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.inject(FaultRead, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.inject(FaultRead, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.inject(FaultWrite, f.Name()); err != nil {
+		return 0, err
+	}
+	if err := f.fs.inject(FaultShortWrite, f.Name()); err != nil {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.inject(FaultWrite, f.Name()); err != nil {
+		return 0, err
+	}
+	if err := f.fs.inject(FaultShortWrite, f.Name()); err != nil {
+		n, _ := f.File.WriteAt(p[:len(p)/2], off)
+		return n, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.inject(FaultWrite, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.inject(FaultSync, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// File is an open file handed out by an FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Name() string
+}
+
+// FS is the filesystem an engine keeps its files in. Engines make every
+// file operation through their configured FS, so tests can run them on a
+// MemFS or inject faults with a FaultFS. A nil FS in a config means OSFS.
+//
+// Names are slash- or OS-separated paths, as built with filepath.Join.
+type FS interface {
+	// OpenFile opens a file with os.OpenFile flags
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Open opens a file for reading
+	Open(name string) (File, error)
+	// Create creates or truncates a file for reading and writing
+	Create(name string) (File, error)
+
+	// Rename atomically moves oldpath to newpath, replacing any file
+	// already there. Neither may be open: Windows can't rename open files.
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir lists a directory, sorted by name
+	ReadDir(name string) ([]os.DirEntry, error)
+
+	// Lock creates the file name if needed and takes an exclusive lock on
+	// it, so only one engine at a time opens a data directory. It fails
+	// with ErrLocked if the file is already locked, by this process or
+	// another. Closing the returned lock releases it.
+	Lock(name string) (io.Closer, error)
+
+	// DiskFree returns the bytes available for new data on the filesystem
+	// holding path, failing with errors.ErrUnsupported where that can't
+	// be found out
+	DiskFree(path string) (int64, error)
+}
+
+// OSFS is the operating system's filesystem
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFS) Create(name string) (File, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Rename replaces newpath atomically. On Unix the directory is synced
+// afterwards so the rename survives a crash; on Windows a rename that
+// fails because another process (a virus scanner, an indexer) briefly
+// has either file open is retried.
+func (OSFS) Rename(oldpath, newpath string) error { return renameFile(oldpath, newpath) }
+
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+
+func (OSFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, name)
+		}
+		return nil, &os.PathError{Op: "lock", Path: name, Err: err}
+	}
+	// Closing the file releases the lock
+	return f, nil
+}
+
+func (OSFS) DiskFree(path string) (int64, error) { return diskFree(path) }
+
+// FSOrDefault returns fs, or OSFS if it is nil
+func FSOrDefault(fs FS) FS {
+	if fs == nil {
+		return OSFS{}
+	}
+	return fs
+}
+
+// ErrInMemoryWithFS is returned when a config asks for an in-memory engine
+// and also names an FS
+var ErrInMemoryWithFS = errors.New("InMemory can't be combined with an FS")
+
+// ConfigFS returns the FS an engine config selects: a fresh volatile MemFS
+// if inMemory is set, otherwise fs, or OSFS if that is nil. It's wrapped
+// in a DeferredDeleteFS, so engines can delete files other handles still
+// have open on Windows.
+func ConfigFS(fs FS, inMemory bool) (FS, error) {
+	if inMemory {
+		if fs != nil {
+			return nil, ErrInMemoryWithFS
+		}
+		fs = NewVolatileMemFS()
+	}
+	return NewDeferredDeleteFS(fs), nil
+}
+
+// ReadFile reads a whole file from fs
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
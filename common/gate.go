@@ -0,0 +1,66 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// gateClosed is the OpGate state bit set once the gate is closed; the bits
+// below it count operations in flight
+const gateClosed = 1 << 62
+
+// OpGate tracks an engine's in-flight operations so Close can stop new
+// ones and wait for the rest before closing files. Entering and leaving
+// are a single atomic add each, so it adds no contention to hot paths.
+//
+// The zero value is an open gate.
+type OpGate struct {
+	state    atomic.Int64
+	drained  chan struct{}
+	initOnce sync.Once
+	doneOnce sync.Once
+}
+
+func (g *OpGate) init() {
+	g.initOnce.Do(func() {
+		g.drained = make(chan struct{})
+	})
+}
+
+// Enter starts an operation, or returns ErrClosed once Close has been
+// called. Every successful Enter must be matched by an Exit.
+func (g *OpGate) Enter() error {
+	if g.state.Add(1)&gateClosed != 0 {
+		g.Exit()
+		return ErrClosed
+	}
+	return nil
+}
+
+// Exit ends an operation started with Enter
+func (g *OpGate) Exit() {
+	if g.state.Add(-1) == gateClosed {
+		g.init()
+		g.doneOnce.Do(func() { close(g.drained) })
+	}
+}
+
+// Closed reports whether Close has been called
+func (g *OpGate) Closed() bool {
+	return g.state.Load()&gateClosed != 0
+}
+
+// Close makes every later Enter fail with ErrClosed, then waits for the
+// operations already in flight to Exit. It returns false, without
+// waiting, if the gate was already closed.
+func (g *OpGate) Close() bool {
+	g.init()
+	if g.state.Or(gateClosed)&gateClosed != 0 {
+		return false
+	}
+	if g.state.Load() == gateClosed {
+		g.doneOnce.Do(func() { close(g.drained) })
+	}
+	<-g.drained
+	return true
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Health is an engine's diagnosis of itself, from StorageEngine.Health
+type Health struct {
+	// OK is true when none of the checks below found a problem. Problems
+	// describes each one that did.
+	OK       bool
+	Problems []string
+
+	// WALWritable is false once an append to or sync of the write-ahead
+	// log (the active segment for the hash index) has failed, until one
+	// succeeds again. WALError is the failure.
+	WALWritable bool
+	WALError    error
+
+	// Free space on the data directory's filesystem (-1 = unknown), and
+	// the reserve it should stay above (Config.DiskReserveBytes)
+	DiskFree    int64
+	DiskReserve int64
+
+	// ReadOnly is true while writes are refused because free space fell
+	// below Config.DiskLowWatermarkBytes (see DiskGuard)
+	ReadOnly bool
+
+	// Workers maps each background goroutine to whether it is running
+	Workers map[string]bool
+
+	// Stalled is true when background work has fallen behind writes;
+	// StallReason says how
+	Stalled     bool
+	StallReason string
+
+	// Corruption found since the engine was opened (see Stats)
+	CorruptionCount int64
+	Quarantined     []string
+
+	// Panics recovered from background workers since the engine was
+	// opened, which were restarted, and the latest (see Supervisor)
+	WorkerPanics    int64
+	LastWorkerPanic *WorkerPanic
+
+	// Closed is true once Close has been called
+	Closed bool
+}
+
+// Diagnose sets Problems and OK from the other fields
+func (h *Health) Diagnose() {
+	h.Problems = nil
+	if h.Closed {
+		h.Problems = append(h.Problems, "engine is closed")
+	}
+	if !h.WALWritable {
+		h.Problems = append(h.Problems, fmt.Sprintf("write-ahead log is not writable: %v", h.WALError))
+	}
+	if h.DiskFree >= 0 && h.DiskFree < h.DiskReserve {
+		h.Problems = append(h.Problems, fmt.Sprintf("%d bytes free on disk, below the %d byte reserve", h.DiskFree, h.DiskReserve))
+	}
+	if h.ReadOnly {
+		h.Problems = append(h.Problems, "read-only: disk space is below the low watermark")
+	}
+
+	names := make([]string, 0, len(h.Workers))
+	for name := range h.Workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !h.Workers[name] && !h.Closed {
+			h.Problems = append(h.Problems, fmt.Sprintf("%s worker is not running", name))
+		}
+	}
+
+	if h.Stalled {
+		h.Problems = append(h.Problems, "stalled: "+h.StallReason)
+	}
+	if h.CorruptionCount > 0 {
+		h.Problems = append(h.Problems, fmt.Sprintf("%d instances of corruption found, %d files quarantined", h.CorruptionCount, len(h.Quarantined)))
+	}
+	if h.WorkerPanics > 0 {
+		h.Problems = append(h.Problems, fmt.Sprintf("%d background worker panics, the latest: %v", h.WorkerPanics, h.LastWorkerPanic))
+	}
+	h.OK = len(h.Problems) == 0
+}
+
+// DiskFreeOrUnknown returns the free space fs reports for path, or -1 if
+// it can't tell
+func DiskFreeOrUnknown(fs FS, path string) int64 {
+	free, err := fs.DiskFree(path)
+	if err != nil {
+		return -1
+	}
+	return free
+}
+
+// LastError remembers the error of an operation that is repeated, like
+// appending to a log, until it next succeeds. It is lock-free, so the
+// write path can record every outcome.
+type LastError struct {
+	err atomic.Pointer[error]
+}
+
+// Set records the outcome of the latest attempt (nil = success)
+func (l *LastError) Set(err error) {
+	if err == nil {
+		if l.err.Load() != nil {
+			l.err.Store(nil)
+		}
+		return
+	}
+	l.err.Store(&err)
+}
+
+// Err returns the error of the latest attempt, nil if it succeeded
+func (l *LastError) Err() error {
+	if p := l.err.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Package keyenc encodes keys made of several parts, such as a namespace
+// and a key within it, into single byte strings for the engines. Encoded
+// keys sort bytewise in the order of their parts, and no encoded part is
+// a prefix of another, so all the keys under one part form a contiguous
+// range of an ordered engine that no other part's keys fall into.
+//
+// A byte string part is written with each 0x00 escaped as 0x00 0xFF and
+// ends with 0x00 0x01.
+package keyenc
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	escape     = 0x00
+	escapedNul = 0xFF
+	terminator = 0x01
+)
+
+// ErrInvalid is returned decoding a part that wasn't encoded by this
+// package
+var ErrInvalid = errors.New("keyenc: invalid encoding")
+
+// AppendBytes appends the encoding of b to dst
+func AppendBytes(dst, b []byte) []byte {
+	for {
+		i := bytes.IndexByte(b, escape)
+		if i < 0 {
+			break
+		}
+		dst = append(dst, b[:i+1]...)
+		dst = append(dst, escapedNul)
+		b = b[i+1:]
+	}
+	dst = append(dst, b...)
+	return append(dst, escape, terminator)
+}
+
+// DecodeBytes decodes the byte string part that key starts with,
+// returning it and the rest of key
+func DecodeBytes(key []byte) (part, rest []byte, err error) {
+	for {
+		i := bytes.IndexByte(key, escape)
+		if i < 0 || i+1 == len(key) {
+			return nil, nil, ErrInvalid
+		}
+		part = append(part, key[:i]...)
+		switch key[i+1] {
+		case terminator:
+			return part, key[i+2:], nil
+		case escapedNul:
+			part = append(part, escape)
+			key = key[i+2:]
+		default:
+			return nil, nil, ErrInvalid
+		}
+	}
+}
+
+// PrefixEnd returns the first key after every key starting with prefix,
+// the exclusive end of a scan over them. It returns nil, unbounded, when
+// prefix is empty or all 0xFF bytes.
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
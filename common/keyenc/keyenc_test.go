@@ -0,0 +1,80 @@
+package keyenc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBytesRoundTrip(t *testing.T) {
+	parts := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("tenant"),
+		{0x00},
+		{0x00, 0x00},
+		{0xFF},
+		{0x00, 0xFF},
+		{0xFF, 0x00},
+		{'a', 0x00, 'b', 0x01, 0xFF},
+	}
+	for _, part := range parts {
+		for _, rest := range [][]byte{nil, []byte("key"), {0x00, 0x01}} {
+			key := append(AppendBytes(nil, part), rest...)
+			got, gotRest, err := DecodeBytes(key)
+			if err != nil || !bytes.Equal(got, part) || !bytes.Equal(gotRest, rest) {
+				t.Errorf("DecodeBytes(%x) = %x, %x, %v; want %x, %x", key, got, gotRest, err, part, rest)
+			}
+		}
+	}
+
+	// Encodings sort like their parts, and none is a prefix of another's
+	for _, a := range parts {
+		for _, b := range parts {
+			ea, eb := AppendBytes(nil, a), AppendBytes(nil, b)
+			if got, want := bytes.Compare(ea, eb), bytes.Compare(a, b); got != want {
+				t.Errorf("Encodings of %x and %x compare %d, want %d", a, b, got, want)
+			}
+			if !bytes.Equal(a, b) && bytes.HasPrefix(eb, ea) {
+				t.Errorf("Encoding of %x is a prefix of %x's", a, b)
+			}
+		}
+	}
+}
+
+func TestDecodeBytesInvalid(t *testing.T) {
+	for _, key := range [][]byte{
+		nil,
+		[]byte("abc"),     // No terminator
+		{'a', 0x00},       // Cut off after the escape
+		{'a', 0x00, 0x02}, // Neither an escaped 0x00 nor the terminator
+		{0x00, 0xFF},      // An escaped 0x00, then nothing
+	} {
+		if _, _, err := DecodeBytes(key); err != ErrInvalid {
+			t.Errorf("DecodeBytes(%x) = %v, want ErrInvalid", key, err)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix, want []byte
+	}{
+		{[]byte("a"), []byte("b")},
+		{[]byte("ab"), []byte("ac")},
+		{[]byte{'a', 0xFF}, []byte("b")},
+		{[]byte{'a', 0xFF, 0xFF}, []byte("b")},
+		{AppendBytes(nil, []byte("a")), []byte{'a', 0x00, 0x02}},
+		{nil, nil},
+		{[]byte{0xFF}, nil},
+		{[]byte{0xFF, 0xFF, 0xFF}, nil},
+	}
+	for _, tt := range tests {
+		prefix := bytes.Clone(tt.prefix)
+		if got := PrefixEnd(prefix); !bytes.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("PrefixEnd(%x) = %x, want %x", tt.prefix, got, tt.want)
+		}
+		if !bytes.Equal(prefix, tt.prefix) {
+			t.Errorf("PrefixEnd changed its argument to %x", prefix)
+		}
+	}
+}
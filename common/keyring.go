@@ -0,0 +1,58 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+)
+
+// KeyRing is a KeyProvider for rotating keys. It holds every key files
+// may still be encrypted with, and one of them is current. After Rotate
+// makes a new key current, an engine's RotateKeys rewrites the files
+// encrypted with older keys. An old key can be removed once the engine's
+// Stats report no StaleKeyFiles.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyRing returns a ring whose current key is key, with the given id
+func NewKeyRing(id uint32, key []byte) *KeyRing {
+	return &KeyRing{keys: map[uint32][]byte{id: key}, current: id}
+}
+
+// Rotate adds key with the given id and makes it current
+func (r *KeyRing) Rotate(id uint32, key []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[id] = key
+	r.current = id
+}
+
+// Remove drops the key with the given id. Files still encrypted with it
+// can't be opened afterwards. The current key can't be removed.
+func (r *KeyRing) Remove(id uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id == r.current {
+		return fmt.Errorf("key %d is the current key", id)
+	}
+	delete(r.keys, id)
+	return nil
+}
+
+func (r *KeyRing) CurrentKey() (uint32, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: no key with id %d", ErrEncryptionKey, id)
+	}
+	return key, nil
+}
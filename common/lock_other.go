@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package common
+
+import "os"
+
+// lockFile is a no-op where there's no supported locking call: engines
+// still open, but nothing stops two opening the same directory
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,8 @@
+package common
+
+// Logger receives the lines an engine logs about its operations, such as
+// slow ones. *log.Logger satisfies it, and so do adapters to structured
+// loggers. It must be safe for concurrent use.
+type Logger interface {
+	Printf(format string, args ...any)
+}
@@ -0,0 +1,487 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemFS is an FS held entirely in memory, for tests and engines that
+// don't need to persist anything. It follows POSIX semantics where the
+// engines rely on them: removed or renamed files stay readable through
+// handles that are already open, and files need their parent directory.
+//
+// MemFS also remembers what each file held when it was last synced, so
+// CrashClone can show what a crash would leave behind.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]bool
+	locks map[string]bool
+
+	volatile bool  // Sync keeps no copy; nothing survives a crash
+	diskFree int64 // Reported by DiskFree (-1 = unsupported)
+}
+
+// memFile is a file's contents, shared by all handles open on it
+type memFile struct {
+	mu      sync.RWMutex
+	data    []byte
+	synced  []byte // Contents as of the last Sync
+	modTime time.Time
+}
+
+// NewMemFS creates an empty in-memory filesystem
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memFile),
+		dirs:  map[string]bool{"/": true, ".": true},
+		locks: make(map[string]bool),
+
+		diskFree: -1,
+	}
+}
+
+// NewVolatileMemFS creates an empty in-memory filesystem whose Sync does
+// nothing, for engines running purely in memory. It doesn't keep a second
+// copy of each file as it was last synced, so CrashClone leaves every
+// file empty.
+func NewVolatileMemFS() *MemFS {
+	m := NewMemFS()
+	m.volatile = true
+	return m
+}
+
+// CrashClone returns a copy of the filesystem as it would be after a
+// crash: every file holds only what it held when it was last synced.
+// Creates, renames and removes are treated as durable immediately. Locks
+// die with the process, so the copy has none.
+func (m *MemFS) CrashClone() *MemFS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clone := NewMemFS()
+	clone.volatile = m.volatile
+	clone.diskFree = m.diskFree
+	for dir := range m.dirs {
+		clone.dirs[dir] = true
+	}
+	for name, f := range m.files {
+		f.mu.RLock()
+		clone.files[name] = &memFile{
+			data:    append([]byte(nil), f.synced...),
+			synced:  append([]byte(nil), f.synced...),
+			modTime: f.modTime,
+		}
+		f.mu.RUnlock()
+	}
+	return clone
+}
+
+func memPath(name string) string {
+	return filepath.Clean(name)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = memPath(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && m.dirs[name]:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		f = &memFile{modTime: time.Now()}
+		m.files[name] = f
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		f.mu.Lock()
+		f.data = f.data[:0]
+		f.modTime = time.Now()
+		f.mu.Unlock()
+	}
+	return &memHandle{name: name, file: f, flag: flag, volatile: m.volatile}, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = memPath(oldpath), memPath(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !m.dirs[filepath.Dir(newpath)] || m.dirs[newpath] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = f
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = memPath(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if m.dirs[name] {
+		if len(m.children(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = memPath(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f, ok := m.files[name]; ok {
+		return f.stat(name), nil
+	}
+	if m.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = memPath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := path; !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	name = memPath(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.children(name), nil
+}
+
+func (m *MemFS) Lock(name string) (io.Closer, error) {
+	f, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	name = memPath(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[name] {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, name)
+	}
+	m.locks[name] = true
+	return &memLock{fs: m, name: name}, nil
+}
+
+// DiskFree reports the free space set with SetDiskFree, or fails with
+// errors.ErrUnsupported if none was
+func (m *MemFS) DiskFree(path string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.diskFree < 0 {
+		return 0, errors.ErrUnsupported
+	}
+	return m.diskFree, nil
+}
+
+// SetDiskFree sets the free space DiskFree reports, so tests can simulate
+// a filling disk. It doesn't limit writes.
+func (m *MemFS) SetDiskFree(n int64) {
+	m.mu.Lock()
+	m.diskFree = n
+	m.mu.Unlock()
+}
+
+// memLock is a lock held on a MemFS file
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+// children lists the entries directly inside dir, sorted by name
+func (m *MemFS) children(dir string) []os.DirEntry {
+	var entries []os.DirEntry
+	for name, f := range m.files {
+		if filepath.Dir(name) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(f.stat(name)))
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(name), dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+func (f *memFile) stat(name string) *memFileInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(f.data)), modTime: f.modTime}
+}
+
+// memHandle is an open MemFS file with its own offset
+type memHandle struct {
+	name     string
+	file     *memFile
+	flag     int
+	volatile bool
+	closed   atomic.Bool
+
+	mu     sync.Mutex // protects offset
+	offset int64
+}
+
+var errBadFileMode = errors.New("bad file descriptor")
+
+func (h *memHandle) check(op string, write bool) error {
+	if h.closed.Load() {
+		return &os.PathError{Op: op, Path: h.name, Err: fs.ErrClosed}
+	}
+	access := h.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if write && access == os.O_RDONLY || !write && access == os.O_WRONLY {
+		return &os.PathError{Op: op, Path: h.name, Err: errBadFileMode}
+	}
+	return nil
+}
+
+func (h *memHandle) Read(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.ReadAt(p, h.offset)
+	h.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	if err := h.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: h.name, Err: fs.ErrInvalid}
+	}
+
+	h.file.mu.RLock()
+	defer h.file.mu.RUnlock()
+	if off >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.file.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memHandle) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, end, err := h.writeAt(p, h.offset, h.flag&os.O_APPEND != 0)
+	if err == nil {
+		h.offset = end
+	}
+	return n, err
+}
+
+func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
+	if h.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: h.name, Err: errors.New("invalid use of WriteAt on file opened with O_APPEND")}
+	}
+	n, _, err := h.writeAt(p, off, false)
+	return n, err
+}
+
+// writeAt writes p at off, or at the end of the file if appending, and
+// returns the offset after it
+func (h *memHandle) writeAt(p []byte, off int64, appending bool) (int, int64, error) {
+	if err := h.check("write", true); err != nil {
+		return 0, 0, err
+	}
+	if off < 0 {
+		return 0, 0, &os.PathError{Op: "write", Path: h.name, Err: fs.ErrInvalid}
+	}
+
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	if appending {
+		off = int64(len(h.file.data))
+	}
+	end := off + int64(len(p))
+	if end > int64(len(h.file.data)) {
+		h.file.grow(end)
+	}
+	copy(h.file.data[off:], p)
+	h.file.modTime = time.Now()
+	return len(p), end, nil
+}
+
+// grow extends the file to size bytes, zero-filled
+func (f *memFile) grow(size int64) {
+	if size <= int64(cap(f.data)) {
+		old := len(f.data)
+		f.data = f.data[:size]
+		clear(f.data[old:])
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, f.data)
+	f.data = data
+}
+
+func (h *memHandle) Seek(offset int64, whence int) (int64, error) {
+	if h.closed.Load() {
+		return 0, &os.PathError{Op: "seek", Path: h.name, Err: fs.ErrClosed}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += h.offset
+	case io.SeekEnd:
+		h.file.mu.RLock()
+		offset += int64(len(h.file.data))
+		h.file.mu.RUnlock()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: h.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: h.name, Err: fs.ErrInvalid}
+	}
+	h.offset = offset
+	return offset, nil
+}
+
+func (h *memHandle) Truncate(size int64) error {
+	if err := h.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: h.name, Err: fs.ErrInvalid}
+	}
+
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	if size > int64(len(h.file.data)) {
+		h.file.grow(size)
+	} else {
+		h.file.data = h.file.data[:size]
+	}
+	h.file.modTime = time.Now()
+	return nil
+}
+
+func (h *memHandle) Sync() error {
+	if h.closed.Load() {
+		return &os.PathError{Op: "sync", Path: h.name, Err: fs.ErrClosed}
+	}
+	if h.volatile {
+		return nil
+	}
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	h.file.synced = append(h.file.synced[:0], h.file.data...)
+	return nil
+}
+
+func (h *memHandle) Stat() (os.FileInfo, error) {
+	if h.closed.Load() {
+		return nil, &os.PathError{Op: "stat", Path: h.name, Err: fs.ErrClosed}
+	}
+	return h.file.stat(h.name), nil
+}
+
+func (h *memHandle) Name() string {
+	return h.name
+}
+
+func (h *memHandle) Close() error {
+	if h.closed.Swap(true) {
+		return &os.PathError{Op: "close", Path: h.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// memFileInfo describes a MemFS file or directory
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() any           { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Memory components tracked by MemoryAccountant
+const (
+	MemMemtable  = "memtable"   // LSM memtables (active and immutable)
+	MemPageCache = "page_cache" // B-Tree page cache
+	MemBloom     = "bloom"      // LSM and B-Tree bloom filters
+	MemIndex     = "index"      // SSTable block indexes, hash index entries
+)
+
+// MemoryAccountant tracks memory held by engine components against a
+// single budget. Several engines may share one accountant so that their
+// combined footprint stays bounded.
+//
+// Memory that must be held (memtable entries, loaded filters) is recorded
+// with Charge. Optional allocations such as cache pages or new index
+// entries first ask Fits, which runs the registered reclaimers when the
+// budget is exhausted; callers evict or reject with ErrMemoryBudget when
+// the answer is still no.
+type MemoryAccountant struct {
+	budget int64 // 0 = unlimited
+	used   atomic.Int64
+
+	components sync.Map // component name -> *atomic.Int64
+
+	mu         sync.Mutex // protects reclaimers
+	reclaimers map[int]func(need int64) int64
+	nextID     int
+}
+
+// NewMemoryAccountant creates an accountant with the given budget in
+// bytes. A budget <= 0 only tracks usage.
+func NewMemoryAccountant(budget int64) *MemoryAccountant {
+	if budget < 0 {
+		budget = 0
+	}
+	return &MemoryAccountant{
+		budget:     budget,
+		reclaimers: make(map[int]func(need int64) int64),
+	}
+}
+
+func (m *MemoryAccountant) component(name string) *atomic.Int64 {
+	if c, ok := m.components.Load(name); ok {
+		return c.(*atomic.Int64)
+	}
+	c, _ := m.components.LoadOrStore(name, new(atomic.Int64))
+	return c.(*atomic.Int64)
+}
+
+// Charge records n bytes held by a component, even if that exceeds the
+// budget. Reclaimers are asked to make up any overshoot.
+func (m *MemoryAccountant) Charge(component string, n int64) {
+	m.component(component).Add(n)
+	if over := m.used.Add(n) - m.budget; m.budget > 0 && over > 0 {
+		m.reclaim(over)
+	}
+}
+
+// Fits reports whether n more bytes fit in the budget, first asking
+// reclaimers to free memory if they don't. Callers that get true Charge
+// the bytes; concurrent callers may overshoot slightly.
+func (m *MemoryAccountant) Fits(n int64) bool {
+	if m.budget == 0 {
+		return true
+	}
+	if over := m.used.Load() + n - m.budget; over > 0 {
+		m.reclaim(over)
+	}
+	return m.used.Load()+n <= m.budget
+}
+
+// Release returns n bytes previously charged by a component
+func (m *MemoryAccountant) Release(component string, n int64) {
+	m.component(component).Add(-n)
+	m.used.Add(-n)
+}
+
+// OverBudget reports whether usage exceeds the budget
+func (m *MemoryAccountant) OverBudget() bool {
+	return m.budget > 0 && m.used.Load() > m.budget
+}
+
+// Budget returns the budget in bytes (0 = unlimited)
+func (m *MemoryAccountant) Budget() int64 {
+	return m.budget
+}
+
+// Used returns the total bytes currently charged
+func (m *MemoryAccountant) Used() int64 {
+	return m.used.Load()
+}
+
+// Usage returns the bytes currently charged per component
+func (m *MemoryAccountant) Usage() map[string]int64 {
+	usage := make(map[string]int64)
+	m.components.Range(func(name, c any) bool {
+		usage[name.(string)] = c.(*atomic.Int64).Load()
+		return true
+	})
+	return usage
+}
+
+// RegisterReclaimer adds a function that frees evictable memory (e.g.
+// cached pages) when the budget is exceeded. It is called with the number
+// of bytes wanted and returns how many it released; it must not block on
+// locks held by callers of Charge or Fits. The returned function
+// unregisters it.
+func (m *MemoryAccountant) RegisterReclaimer(fn func(need int64) int64) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextID
+	m.nextID++
+	m.reclaimers[id] = fn
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.reclaimers, id)
+	}
+}
+
+// reclaim asks reclaimers to free need bytes, stopping once enough is freed
+func (m *MemoryAccountant) reclaim(need int64) {
+	m.mu.Lock()
+	fns := make([]func(int64) int64, 0, len(m.reclaimers))
+	for _, fn := range m.reclaimers {
+		fns = append(fns, fn)
+	}
+	m.mu.Unlock()
+
+	for _, fn := range fns {
+		need -= fn(need)
+		if need <= 0 {
+			return
+		}
+	}
+}
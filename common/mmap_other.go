@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package common
+
+import "errors"
+
+// Mmap is unsupported on this platform (see mmap_unix.go)
+func Mmap(f File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.ErrUnsupported
+}
@@ -0,0 +1,31 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package common
+
+import (
+	"errors"
+	"math"
+	"os"
+	"syscall"
+)
+
+// Mmap maps the first size bytes of f read-only, returning the mapping
+// and a function that unmaps it. The mapping stays valid after f is
+// closed, until it is unmapped; reading past the end of a file that was
+// truncated under it faults. Only OS files can be mapped: files of a
+// MemFS, FaultFS or EncryptedFS, and platforms without mmap, get
+// errors.ErrUnsupported.
+func Mmap(f File, size int64) ([]byte, func() error, error) {
+	osFile, ok := f.(*os.File)
+	if !ok || size > math.MaxInt {
+		return nil, nil, errors.ErrUnsupported
+	}
+	if size <= 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+	data, err := syscall.Mmap(int(osFile.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,262 @@
+package common
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/intellect4all/storage-engines/common/keyenc"
+)
+
+// deleteNamespaceBatch is how many keys DeleteNamespace collects per scan
+// before deleting them
+const deleteNamespaceBatch = 1000
+
+// NamespacedEngine is one logical database hosted in a shared engine, such
+// as one tenant's. Every key it is given is stored under the namespace's
+// prefix, encoded with keyenc so no namespace's prefix is a prefix of
+// another's: namespaces sharing an engine never see each other's keys.
+// Keys written to the engine directly should be kept out of its range.
+//
+// It implements StorageEngine. Sync, Compact and Health act on the whole
+// shared engine; Close only closes the namespace, leaving the engine to
+// its owner. Scan, DeleteNamespace and the key count in Stats need an
+// engine implementing Scanner, ordering keys bytewise, so that the keys
+// of a namespace are one contiguous range.
+type NamespacedEngine struct {
+	engine    StorageEngine
+	namespace string
+	prefix    []byte // Every key of the namespace starts with it
+	end       []byte // First key after the namespace's, nil for none
+
+	closed atomic.Bool
+	writes atomic.Int64
+	reads  atomic.Int64
+}
+
+// NewNamespacedEngine returns the namespace of engine with the given name.
+// Several may be open on one engine at once, including for the same name.
+func NewNamespacedEngine(engine StorageEngine, namespace string) *NamespacedEngine {
+	prefix := keyenc.AppendBytes(nil, []byte(namespace))
+	return &NamespacedEngine{
+		engine:    engine,
+		namespace: namespace,
+		prefix:    prefix,
+		end:       keyenc.PrefixEnd(prefix),
+	}
+}
+
+// Namespace returns the namespace's name
+func (n *NamespacedEngine) Namespace() string {
+	return n.namespace
+}
+
+// Engine returns the shared engine the namespace is stored in
+func (n *NamespacedEngine) Engine() StorageEngine {
+	return n.engine
+}
+
+// key returns the engine's key for a key of the namespace
+func (n *NamespacedEngine) key(key []byte) ([]byte, error) {
+	if n.closed.Load() {
+		return nil, ErrClosed
+	}
+	if len(key) == 0 {
+		return nil, ErrKeyEmpty
+	}
+	k := make([]byte, 0, len(n.prefix)+len(key))
+	k = append(k, n.prefix...)
+	return append(k, key...), nil
+}
+
+func (n *NamespacedEngine) Put(key, value []byte) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	n.writes.Add(1)
+	return n.engine.Put(k, value)
+}
+
+func (n *NamespacedEngine) Get(key []byte) ([]byte, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	n.reads.Add(1)
+	return n.engine.Get(k)
+}
+
+// GetValue reads a value without copying it if the engine is a
+// ValueGetter, and through Get otherwise
+func (n *NamespacedEngine) GetValue(key []byte, fn func(value []byte) error) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	n.reads.Add(1)
+	if getter, ok := n.engine.(ValueGetter); ok {
+		return getter.GetValue(k, fn)
+	}
+	value, err := n.engine.Get(k)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+func (n *NamespacedEngine) Has(key []byte) (bool, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return false, err
+	}
+	n.reads.Add(1)
+	return n.engine.Has(k)
+}
+
+func (n *NamespacedEngine) Delete(key []byte) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	n.writes.Add(1)
+	return n.engine.Delete(k)
+}
+
+// Scan returns an iterator over the namespace's keys in [start, end); a
+// nil end runs to the namespace's last key. Keys are returned without the
+// namespace's prefix. Returns ErrNotSupported if the engine can't scan.
+func (n *NamespacedEngine) Scan(start, end []byte) (Iterator, error) {
+	if n.closed.Load() {
+		return nil, ErrClosed
+	}
+	scanner, ok := n.engine.(Scanner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	from := append(bytes.Clone(n.prefix), start...)
+	to := n.end
+	if end != nil {
+		to = append(bytes.Clone(n.prefix), end...)
+	}
+	it, err := scanner.Scan(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceIterator{Iterator: it, prefixLen: len(n.prefix)}, nil
+}
+
+// namespaceIterator strips the namespace's prefix off the keys of a scan
+type namespaceIterator struct {
+	Iterator
+	prefixLen int
+}
+
+func (it *namespaceIterator) Key() []byte {
+	key := it.Iterator.Key()
+	if len(key) < it.prefixLen {
+		return nil
+	}
+	return key[it.prefixLen:]
+}
+
+// DeleteNamespace deletes every key of the namespace, a batch at a time,
+// and returns how many it deleted. Keys written while it runs may
+// survive. Returns ErrNotSupported if the engine can't scan.
+func (n *NamespacedEngine) DeleteNamespace() (int64, error) {
+	if n.closed.Load() {
+		return 0, ErrClosed
+	}
+	scanner, ok := n.engine.(Scanner)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+
+	var deleted int64
+	from := n.prefix
+	for {
+		// Collect a batch before deleting, so the scan doesn't run over
+		// keys being deleted
+		keys, err := n.scanKeys(scanner, from, deleteNamespaceBatch)
+		if err != nil {
+			return deleted, err
+		}
+		for _, key := range keys {
+			if err := n.engine.Delete(key); err != nil {
+				return deleted, err
+			}
+			deleted++
+			n.writes.Add(1)
+		}
+		if len(keys) < deleteNamespaceBatch {
+			return deleted, nil
+		}
+
+		// Carry on after the last key deleted
+		from = append(keys[len(keys)-1], 0)
+	}
+}
+
+// scanKeys returns up to limit of the engine's keys in the namespace,
+// from the given engine key on
+func (n *NamespacedEngine) scanKeys(scanner Scanner, from []byte, limit int) ([][]byte, error) {
+	it, err := scanner.Scan(from, n.end)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys [][]byte
+	for len(keys) < limit && it.Next() {
+		keys = append(keys, bytes.Clone(it.Key()))
+	}
+	return keys, it.Error()
+}
+
+// Stats returns the namespace's own statistics: the reads and writes made
+// through it, and with a Scanner engine the keys it holds, counted with a
+// scan. Everything else describes the shared engine (see Engine).
+func (n *NamespacedEngine) Stats() Stats {
+	stats := Stats{
+		WriteCount: n.writes.Load(),
+		ReadCount:  n.reads.Load(),
+	}
+	if scanner, ok := n.engine.(Scanner); ok && !n.closed.Load() {
+		it, err := scanner.Scan(n.prefix, n.end)
+		if err == nil {
+			for it.Next() {
+				stats.NumKeys++
+			}
+			it.Close()
+		}
+	}
+	return stats
+}
+
+// Sync syncs the shared engine
+func (n *NamespacedEngine) Sync() error {
+	if n.closed.Load() {
+		return ErrClosed
+	}
+	return n.engine.Sync()
+}
+
+// Compact compacts the shared engine
+func (n *NamespacedEngine) Compact() error {
+	if n.closed.Load() {
+		return ErrClosed
+	}
+	return n.engine.Compact()
+}
+
+// Health diagnoses the shared engine
+func (n *NamespacedEngine) Health() Health {
+	return n.engine.Health()
+}
+
+// Close closes the namespace; later calls fail with ErrClosed. The shared
+// engine stays open.
+func (n *NamespacedEngine) Close() error {
+	n.closed.Store(true)
+	return nil
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"errors"
+	"os"
+)
+
+// Preallocate reserves disk space for f to grow to size bytes, extending
+// it with zeros, so that writes up to size don't have to allocate blocks
+// or change the file's size. Where the OS can't preallocate, and for files
+// that aren't OS files (a MemFS's, or an EncryptedFS's, whose blocks on
+// disk don't line up with the data), the file is extended with Truncate
+// instead. It never shrinks f.
+func Preallocate(f File, size int64) error {
+	if osFile, ok := f.(*os.File); ok {
+		if err := fallocate(osFile, size); !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// Datasync flushes f's data to disk along with only the metadata needed to
+// read it back, skipping e.g. its modification time. Where the OS doesn't
+// tell the two apart, and for files that aren't OS files, it is f.Sync.
+// It is cheaper than Sync when writes don't change the file's size, as in
+// a preallocated file.
+func Datasync(f File) error {
+	if osFile, ok := f.(*os.File); ok {
+		if err := fdatasync(osFile); !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+	return f.Sync()
+}
@@ -0,0 +1,20 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocate allocates the blocks for f up to size, extending it
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
+
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package common
+
+import (
+	"errors"
+	"os"
+)
+
+// fallocate is unsupported outside Linux; Preallocate extends the file
+// instead
+func fallocate(f *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
+
+// fdatasync is unsupported outside Linux; Datasync falls back to Sync
+func fdatasync(f *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,83 @@
+package common
+
+import "context"
+
+// RecoveryPhase names a step of opening an engine
+type RecoveryPhase string
+
+const (
+	PhaseWALReplay    RecoveryPhase = "wal_replay"    // replaying a write-ahead log
+	PhaseSSTableLoad  RecoveryPhase = "sstable_load"  // opening SSTables (LSM)
+	PhaseSnapshotLoad RecoveryPhase = "snapshot_load" // loading an index snapshot (hashindex)
+	PhaseSegmentScan  RecoveryPhase = "segment_scan"  // rebuilding the index from segments (hashindex)
+)
+
+// RecoveryProgress describes how far an engine has got through one phase
+// of opening. Entries counts the phase's units: records for replays and
+// scans, files for SSTable loading. Totals are 0 when unknown.
+type RecoveryProgress struct {
+	Phase        RecoveryPhase
+	Entries      int64
+	TotalEntries int64
+	Bytes        int64
+	TotalBytes   int64
+	Done         bool // last report for this phase
+}
+
+// ProgressFunc receives recovery progress reports. It is called from the
+// goroutine opening the engine and should return quickly.
+type ProgressFunc func(RecoveryProgress)
+
+// progressEvery is how many entries pass between progress reports
+const progressEvery = 10000
+
+// RecoveryTracker throttles progress reports for one phase and checks for
+// cancellation as entries are processed. A nil ProgressFunc only checks
+// the context.
+type RecoveryTracker struct {
+	ctx        context.Context
+	fn         ProgressFunc
+	progress   RecoveryProgress
+	lastReport int64
+}
+
+// NewRecoveryTracker starts tracking a phase and reports it as begun
+func NewRecoveryTracker(ctx context.Context, fn ProgressFunc, phase RecoveryPhase, totalEntries, totalBytes int64) *RecoveryTracker {
+	t := &RecoveryTracker{
+		ctx: ctx,
+		fn:  fn,
+		progress: RecoveryProgress{
+			Phase:        phase,
+			TotalEntries: totalEntries,
+			TotalBytes:   totalBytes,
+		},
+	}
+	t.report()
+	return t
+}
+
+// Add records processed entries and bytes. It returns the context's error
+// once the open has been cancelled, and callers should abort.
+func (t *RecoveryTracker) Add(entries, bytes int64) error {
+	t.progress.Entries += entries
+	t.progress.Bytes += bytes
+
+	if t.progress.Entries-t.lastReport >= progressEvery {
+		t.lastReport = t.progress.Entries
+		t.report()
+	}
+
+	return t.ctx.Err()
+}
+
+// Done reports the phase as finished
+func (t *RecoveryTracker) Done() {
+	t.progress.Done = true
+	t.report()
+}
+
+func (t *RecoveryTracker) report() {
+	if t.fn != nil {
+		t.fn(t.progress)
+	}
+}
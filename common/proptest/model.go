@@ -0,0 +1,99 @@
+package proptest
+
+import (
+	"bytes"
+	"slices"
+)
+
+// version is a value a key held, or its deletion
+type version struct {
+	value   []byte
+	deleted bool
+}
+
+func (v version) String() string {
+	if v.deleted {
+		return "deleted"
+	}
+	return string(truncate(v.value))
+}
+
+// model is what the engine should hold: a map from key to value, and for
+// keys written since the last sync, every version a crash could leave
+// behind
+type model struct {
+	values map[string][]byte
+
+	// unsynced holds, for each key written since the last sync, the
+	// version it was synced at followed by every version written since
+	unsynced map[string][]version
+}
+
+func newModel() *model {
+	return &model{values: make(map[string][]byte), unsynced: make(map[string][]version)}
+}
+
+func (m *model) get(key []byte) version {
+	value, ok := m.values[string(key)]
+	return version{value: value, deleted: !ok}
+}
+
+func (m *model) set(key []byte, v version) {
+	if _, ok := m.unsynced[string(key)]; !ok {
+		m.unsynced[string(key)] = []version{m.get(key)}
+	}
+	m.unsynced[string(key)] = append(m.unsynced[string(key)], v)
+	if v.deleted {
+		delete(m.values, string(key))
+	} else {
+		m.values[string(key)] = v.value
+	}
+}
+
+func (m *model) put(key, value []byte) {
+	m.set(key, version{value: slices.Clone(value)})
+}
+
+func (m *model) delete(key []byte) {
+	m.set(key, version{deleted: true})
+}
+
+// sync records that every write so far is durable
+func (m *model) sync() {
+	clear(m.unsynced)
+}
+
+// crash returns the keys a crash may have left at an earlier version,
+// with the versions each may hold. The caller settles each with settle.
+func (m *model) crash() map[string][]version {
+	unsynced := m.unsynced
+	m.unsynced = make(map[string][]version)
+	return unsynced
+}
+
+// settle records the version a crash left key at
+func (m *model) settle(key string, v version) {
+	if v.deleted {
+		delete(m.values, key)
+	} else {
+		m.values[key] = v.value
+	}
+}
+
+// keys returns the model's keys in [start, end) in order; a nil end is
+// unbounded
+func (m *model) keys(start, end []byte) []string {
+	var keys []string
+	for k := range m.values {
+		if k >= string(start) && (end == nil || k < string(end)) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// matches reports whether a Get's result is version v
+func (v version) matches(value []byte, found bool) bool {
+	return found != v.deleted && (!found || bytes.Equal(value, v.value))
+}
@@ -0,0 +1,131 @@
+package proptest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+// Kind is the kind of an operation
+type Kind int
+
+const (
+	Put Kind = iota
+	Delete
+	Get // Also checks Has
+	Scan
+	Sync
+	Compact
+	Reopen // Close the engine and open it again
+	Crash  // Open what a crash would leave on disk, without closing first
+)
+
+var kindNames = [...]string{"put", "delete", "get", "scan", "sync", "compact", "reopen", "crash"}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+	return kindNames[k]
+}
+
+// Op is one operation of a sequence
+type Op struct {
+	Kind  Kind
+	Key   []byte // Put, Delete and Get; where a Scan starts
+	End   []byte // Where a Scan ends, nil for unbounded
+	Value []byte // Put
+}
+
+func (o Op) String() string {
+	switch o.Kind {
+	case Put:
+		return fmt.Sprintf("put %s = %q", o.Key, truncate(o.Value))
+	case Delete, Get:
+		return fmt.Sprintf("%s %s", o.Kind, o.Key)
+	case Scan:
+		if o.End == nil {
+			return fmt.Sprintf("scan [%s, end)", o.Key)
+		}
+		return fmt.Sprintf("scan [%s, %s)", o.Key, o.End)
+	default:
+		return o.Kind.String()
+	}
+}
+
+// truncate shortens a value for a message
+func truncate(v []byte) []byte {
+	if len(v) > 20 {
+		return append(v[:20:20], "..."...)
+	}
+	return v
+}
+
+// opWeights is how often Generate picks each Kind, in Kind order
+var opWeights = [...]int{
+	Put:     35,
+	Delete:  12,
+	Get:     25,
+	Scan:    8,
+	Sync:    8,
+	Compact: 3,
+	Reopen:  4,
+	Crash:   5,
+}
+
+// Generate returns a random sequence of config.Ops operations. Keys are
+// drawn from config.Keys distinct keys, so each is written and deleted many
+// times, and gets and scans also look for keys never written.
+func Generate(rng *rand.Rand, config Config) []Op {
+	config = config.withDefaults()
+	total := 0
+	for _, w := range opWeights {
+		total += w
+	}
+
+	ops := make([]Op, config.Ops)
+	for i := range ops {
+		kind := Kind(0)
+		for r := rng.Intn(total); r >= opWeights[kind]; kind++ {
+			r -= opWeights[kind]
+		}
+		op := Op{Kind: kind}
+		switch kind {
+		case Put:
+			op.Key = genKey(rng, config.Keys)
+			op.Value = genValue(rng, config)
+		case Delete:
+			op.Key = genKey(rng, config.Keys)
+		case Get:
+			op.Key = genKey(rng, config.Keys+config.Keys/4+1)
+		case Scan:
+			op.Key = genKey(rng, config.Keys+1)
+			if rng.Intn(4) != 0 {
+				op.End = genKey(rng, config.Keys+1)
+				if bytes.Compare(op.Key, op.End) > 0 {
+					op.Key, op.End = op.End, op.Key
+				}
+			}
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+// genKey returns one of n keys. They're numbered without padding, so
+// their byte order isn't their numeric order.
+func genKey(rng *rand.Rand, n int) []byte {
+	return fmt.Appendf(nil, "k%d", rng.Intn(n))
+}
+
+func genValue(rng *rand.Rand, config Config) []byte {
+	size := 1 + rng.Intn(config.MaxValue)
+	if config.EmptyValues && rng.Intn(10) == 0 {
+		size = 0
+	}
+	v := make([]byte, size)
+	for i := range v {
+		v[i] = 'a' + byte(rng.Intn(26))
+	}
+	return v
+}
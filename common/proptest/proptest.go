@@ -0,0 +1,363 @@
+// Package proptest checks storage engines against a model of what they
+// should hold: a map from key to value. It runs random sequences of puts,
+// deletes, gets, scans, syncs, compactions, restarts and crashes against
+// an engine and the model side by side, and reports the first result that
+// differs, shrunk to a short sequence that still fails. Engines that all
+// agree with the model agree with each other, so a semantic divergence
+// between them, such as one reading an empty value back as missing, shows
+// up as a failure of one.
+//
+// Engines run on a common.MemFS, which a crash is simulated on with
+// CrashClone. Writes synced before a crash must survive it; a key written
+// since may be left at any of the versions it held since the sync.
+package proptest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Config defines the sequences Check runs
+type Config struct {
+	Sequences int // Random sequences run (default 20)
+	Ops       int // Operations in each (default 300)
+	Keys      int // Distinct keys written (default 40)
+	MaxValue  int // Largest value written, in bytes (default 100)
+
+	// EmptyValues also writes empty values, which must read back as
+	// empty rather than missing, unless EmptyDeletes is set
+	EmptyValues bool
+
+	// EmptyDeletes expects an empty value written to delete the key, as
+	// the hash index's tombstones do, so it reads back as missing
+	EmptyDeletes bool
+
+	Seed int64 // Of the first sequence; each after it uses the next
+}
+
+func (c Config) withDefaults() Config {
+	if c.Sequences <= 0 {
+		c.Sequences = 20
+	}
+	if c.Ops <= 0 {
+		c.Ops = 300
+	}
+	if c.Keys <= 0 {
+		c.Keys = 40
+	}
+	if c.MaxValue <= 0 {
+		c.MaxValue = 100
+	}
+	return c
+}
+
+// Opener opens an engine on fs, over the same data directory each time
+type Opener func(fs common.FS) (common.StorageEngine, error)
+
+// Failure is a sequence of operations the engine and the model disagree
+// on
+type Failure struct {
+	Seed int64 // Of the sequence Ops was shrunk from
+	Ops  []Op
+
+	// Step is the operation that failed, or len(Ops) if it was the check
+	// of everything the engine holds at the end
+	Step int
+	Err  error
+}
+
+func (f *Failure) Error() string {
+	var b strings.Builder
+	step := "final check"
+	if f.Step < len(f.Ops) {
+		step = fmt.Sprintf("step %d (%s)", f.Step, f.Ops[f.Step])
+	}
+	fmt.Fprintf(&b, "seed %d: %s: %v\nsequence:", f.Seed, step, f.Err)
+	for i, op := range f.Ops {
+		fmt.Fprintf(&b, "\n  %3d %s", i, op)
+	}
+	return b.String()
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// Check runs config.Sequences random sequences against engines from
+// open, and returns the first Failure, shrunk, or nil if the engine
+// agreed with the model throughout
+func Check(open Opener, config Config) error {
+	config = config.withDefaults()
+	for i := range config.Sequences {
+		seed := config.Seed + int64(i)
+		ops := Generate(rand.New(rand.NewSource(seed)), config)
+		err := Run(open, config, ops)
+		var failure *Failure
+		if errors.As(err, &failure) {
+			failure = shrink(open, config, failure)
+			failure.Seed = seed
+			return failure
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run runs ops against an engine from open on a fresh MemFS, and returns
+// a *Failure if it disagrees with the model, or any other error if the
+// engine couldn't be opened to begin with. Of config, only EmptyDeletes
+// applies.
+func Run(open Opener, config Config, ops []Op) error {
+	r := &runner{open: open, fs: common.NewMemFS(), model: newModel(), emptyDeletes: config.EmptyDeletes}
+	engine, err := open(r.fs)
+	if err != nil {
+		return fmt.Errorf("failed to open engine: %w", err)
+	}
+	r.engine = engine
+	defer func() {
+		if r.engine != nil {
+			r.engine.Close()
+		}
+	}()
+
+	for i, op := range ops {
+		if err := r.step(op); err != nil {
+			return &Failure{Ops: ops, Step: i, Err: err}
+		}
+	}
+	if err := r.checkAll(); err != nil {
+		return &Failure{Ops: ops, Step: len(ops), Err: err}
+	}
+	return nil
+}
+
+// runner runs a sequence against an engine and the model
+type runner struct {
+	open   Opener
+	fs     *common.MemFS
+	engine common.StorageEngine // nil after a failed reopen
+	model  *model
+
+	emptyDeletes bool // See Config.EmptyDeletes
+}
+
+// step runs op, turning a panic into an error
+func (r *runner) step(op Op) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	switch op.Kind {
+	case Put:
+		if err := r.engine.Put(op.Key, op.Value); err != nil {
+			return fmt.Errorf("put failed: %w", err)
+		}
+		if len(op.Value) == 0 && r.emptyDeletes {
+			r.model.delete(op.Key)
+		} else {
+			r.model.put(op.Key, op.Value)
+		}
+	case Delete:
+		err := r.engine.Delete(op.Key)
+		if err != nil && !(errors.Is(err, common.ErrKeyNotFound) && r.model.get(op.Key).deleted) {
+			return fmt.Errorf("delete failed: %w", err)
+		}
+		r.model.delete(op.Key)
+	case Get:
+		return r.checkKey(op.Key)
+	case Scan:
+		return r.checkScan(op.Key, op.End)
+	case Sync:
+		if err := r.engine.Sync(); err != nil {
+			return fmt.Errorf("sync failed: %w", err)
+		}
+		r.model.sync()
+	case Compact:
+		// An engine may turn Compact down while it is compacting already;
+		// all that matters is what it holds after
+		r.engine.Compact()
+	case Reopen:
+		err := r.engine.Close()
+		r.engine = nil
+		if err != nil {
+			return fmt.Errorf("close failed: %w", err)
+		}
+		if err := r.reopen(r.fs); err != nil {
+			return err
+		}
+		r.model.sync()
+		return r.checkAll()
+	case Crash:
+		// The crashed engine is closed once its disk has been copied, so
+		// it frees its resources without touching what reopens
+		crashed := r.fs.CrashClone()
+		r.engine.Close()
+		r.engine = nil
+		if err := r.reopen(crashed); err != nil {
+			return err
+		}
+		if err := r.settleCrash(); err != nil {
+			return err
+		}
+		return r.checkAll()
+	default:
+		return fmt.Errorf("unknown operation %v", op.Kind)
+	}
+	return nil
+}
+
+func (r *runner) reopen(fs *common.MemFS) error {
+	engine, err := r.open(fs)
+	if err != nil {
+		return fmt.Errorf("reopen failed: %w", err)
+	}
+	r.fs, r.engine = fs, engine
+	return nil
+}
+
+// settleCrash reads each key written since the last sync, checks a crash
+// could have left it at the version found, and records that version in
+// the model
+func (r *runner) settleCrash() error {
+	for key, versions := range r.model.crash() {
+		value, found, err := r.read([]byte(key))
+		if err != nil {
+			return err
+		}
+		i := len(versions) - 1
+		for i >= 0 && !versions[i].matches(value, found) {
+			i--
+		}
+		if i < 0 {
+			return fmt.Errorf("after the crash %s read %s, want one of %v", key, version{value: value, deleted: !found}, versions)
+		}
+		r.model.settle(key, versions[i])
+	}
+	return nil
+}
+
+// read gets key from the engine
+func (r *runner) read(key []byte) (value []byte, found bool, err error) {
+	value, err = r.engine.Get(key)
+	if errors.Is(err, common.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("get %s failed: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// checkKey checks Get and Has of key against the model
+func (r *runner) checkKey(key []byte) error {
+	want := r.model.get(key)
+	value, found, err := r.read(key)
+	if err != nil {
+		return err
+	}
+	if !want.matches(value, found) {
+		return fmt.Errorf("get %s read %s, want %s", key, version{value: value, deleted: !found}, want)
+	}
+
+	has, err := r.engine.Has(key)
+	if err != nil {
+		return fmt.Errorf("has %s failed: %w", key, err)
+	}
+	if has == want.deleted {
+		return fmt.Errorf("has %s = %v, want %v", key, has, !want.deleted)
+	}
+	return nil
+}
+
+// checkScan checks a scan of [start, end) against the model, if the
+// engine can scan
+func (r *runner) checkScan(start, end []byte) error {
+	scanner, ok := r.engine.(common.Scanner)
+	if !ok {
+		return nil
+	}
+	it, err := scanner.Scan(start, end)
+	if err != nil {
+		return fmt.Errorf("scan failed: %w", err)
+	}
+	defer it.Close()
+
+	want := r.model.keys(start, end)
+	n := 0
+	for ; it.Next(); n++ {
+		key := string(it.Key())
+		if n >= len(want) {
+			return fmt.Errorf("scan returned %s after every key", key)
+		}
+		if key != want[n] {
+			return fmt.Errorf("scan returned %s, want %s", key, want[n])
+		}
+		if v := r.model.get(it.Key()); !v.matches(it.Value(), true) {
+			return fmt.Errorf("scan returned %s = %q, want %s", key, truncate(it.Value()), v)
+		}
+	}
+	if err := it.Error(); err != nil {
+		return fmt.Errorf("scan failed after %d keys: %w", n, err)
+	}
+	if n < len(want) {
+		return fmt.Errorf("scan ended after %d keys, missing %s", n, want[n])
+	}
+	return nil
+}
+
+// checkAll checks everything the engine holds against the model: every
+// key the model holds, and a scan of all keys
+func (r *runner) checkAll() error {
+	for _, key := range r.model.keys(nil, nil) {
+		if err := r.checkKey([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return r.checkScan(nil, nil)
+}
+
+// maxShrinkRuns bounds how many sequences shrinking tries
+const maxShrinkRuns = 500
+
+// shrink looks for a shorter sequence that still fails, by cutting the
+// operations after the failing one and then removing ever smaller runs of
+// operations while the result still fails
+func shrink(open Opener, config Config, failure *Failure) *Failure {
+	best := failure
+	if best.Step < len(best.Ops) {
+		if f := runFailure(open, config, best.Ops[:best.Step+1]); f != nil {
+			best = f
+		}
+	}
+
+	runs := 0
+	for chunk := len(best.Ops) / 2; chunk > 0 && runs < maxShrinkRuns; chunk /= 2 {
+		for i := 0; i+chunk <= len(best.Ops) && runs < maxShrinkRuns; {
+			ops := append(best.Ops[:i:i], best.Ops[i+chunk:]...)
+			runs++
+			if f := runFailure(open, config, ops); f != nil {
+				best = f
+			} else {
+				i += chunk
+			}
+		}
+	}
+	return best
+}
+
+// runFailure runs ops, returning the Failure if they fail
+func runFailure(open Opener, config Config, ops []Op) *Failure {
+	var failure *Failure
+	if errors.As(Run(open, config, ops), &failure) {
+		return failure
+	}
+	return nil
+}
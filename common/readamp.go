@@ -0,0 +1,61 @@
+package common
+
+import "sync/atomic"
+
+// readAmpBuckets is the number of exact buckets kept by ReadAmpHistogram.
+// Gets touching more units than this are recorded in the last bucket.
+const readAmpBuckets = 64
+
+// ReadAmpHistogram records how many storage units (memtables, SSTables,
+// data blocks, segments or pages) each Get touched. It is lock-free so
+// engines can record from the read path without extra contention.
+type ReadAmpHistogram struct {
+	buckets [readAmpBuckets]atomic.Int64
+	count   atomic.Int64
+	total   atomic.Int64
+}
+
+// Record adds a single Get that touched n units
+func (h *ReadAmpHistogram) Record(n int) {
+	if n < 0 {
+		n = 0
+	}
+	bucket := n
+	if bucket >= readAmpBuckets {
+		bucket = readAmpBuckets - 1
+	}
+	h.buckets[bucket].Add(1)
+	h.count.Add(1)
+	h.total.Add(int64(n))
+}
+
+// Mean returns the average number of units touched per Get
+func (h *ReadAmpHistogram) Mean() float64 {
+	count := h.count.Load()
+	if count == 0 {
+		return 0
+	}
+	return float64(h.total.Load()) / float64(count)
+}
+
+// Percentile returns the number of units touched at percentile p (0-100)
+func (h *ReadAmpHistogram) Percentile(p float64) float64 {
+	count := h.count.Load()
+	if count == 0 {
+		return 0
+	}
+
+	target := int64(float64(count) * p / 100)
+	if target >= count {
+		target = count - 1
+	}
+
+	var seen int64
+	for i := 0; i < readAmpBuckets; i++ {
+		seen += h.buckets[i].Load()
+		if seen > target {
+			return float64(i)
+		}
+	}
+	return float64(readAmpBuckets - 1)
+}
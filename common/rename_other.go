@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package common
+
+import "os"
+
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// renameFile renames, then syncs the parent directory so the new name is
+// durable
+func renameFile(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// Some filesystems can't sync directories; the rename itself stands
+	if err := dir.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
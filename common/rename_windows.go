@@ -0,0 +1,34 @@
+//go:build windows
+
+package common
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	errorAccessDenied     syscall.Errno = 5
+	errorSharingViolation syscall.Errno = 32
+)
+
+// renameRetries bounds how long renameFile waits for another process to
+// let go of a file
+const renameRetries = 10
+
+// renameFile renames with MoveFileEx(MOVEFILE_REPLACE_EXISTING), which
+// os.Rename uses. That fails while any process has either file open, as
+// scanners and indexers briefly do, so sharing errors are retried.
+func renameFile(oldpath, newpath string) error {
+	var err error
+	for i := 0; i < renameRetries; i++ {
+		err = os.Rename(oldpath, newpath)
+		if !errors.Is(err, errorAccessDenied) && !errors.Is(err, errorSharingViolation) {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+	return err
+}
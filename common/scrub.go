@@ -0,0 +1,126 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scrubber checks an engine's data in a background goroutine, so damage
+// is found before a read runs into it. Every interval it runs a pass,
+// which the engine implements by reading its files piece by piece and
+// calling Pace after each piece. Pace waits for as long as the bytes read
+// take at the configured rate, keeping the scrub from competing with
+// foreground IO.
+//
+// A nil Scrubber is valid: Pace never waits and the counters are zero, so
+// an engine can run a pass directly.
+type Scrubber struct {
+	interval    time.Duration
+	bytesPerSec int64 // 0 = unpaced
+	pass        func(*Scrubber)
+
+	passes  atomic.Int64
+	scanned atomic.Int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewScrubber starts a scrubber calling pass every interval, reading at
+// up to bytesPerSec (<= 0 = unpaced). With interval <= 0 it returns nil
+// and nothing runs.
+func NewScrubber(interval time.Duration, bytesPerSec int64, pass func(*Scrubber)) *Scrubber {
+	if interval <= 0 {
+		return nil
+	}
+	s := &Scrubber{
+		interval:    interval,
+		bytesPerSec: bytesPerSec,
+		pass:        pass,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Scrubber) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.pass(s)
+			if s.stopping() {
+				return
+			}
+			s.passes.Add(1)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Pace counts n bytes checked by the pass and waits for as long as they
+// take at the configured rate. It returns false once the scrubber is
+// being closed, and the pass should then return.
+func (s *Scrubber) Pace(n int64) bool {
+	if s == nil {
+		return true
+	}
+	s.scanned.Add(n)
+	if s.bytesPerSec <= 0 {
+		return !s.stopping()
+	}
+
+	pause := time.Duration(float64(n) / float64(s.bytesPerSec) * float64(time.Second))
+	if pause <= 0 {
+		return !s.stopping()
+	}
+	timer := time.NewTimer(pause)
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		timer.Stop()
+		return false
+	}
+}
+
+func (s *Scrubber) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Passes returns the number of passes completed
+func (s *Scrubber) Passes() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.passes.Load()
+}
+
+// Scanned returns the number of bytes checked
+func (s *Scrubber) Scanned() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.scanned.Load()
+}
+
+// Close stops the scrubber, waiting for a pass in progress to return
+func (s *Scrubber) Close() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"maps"
+	"time"
+)
+
+// StatsDelta returns what changed between before and after, two Stats of
+// one engine taken in that order: its counters (WriteCount, ReadCount,
+// CompactCount, CorruptionCount, ScrubPasses, ScrubbedBytes,
+// DiskFullEvents, ReadRepairs and HitLocations) hold how much they grew,
+// and every other field after's value. A counter lower in after than in
+// before was reset by the engine reopening, and holds after's value, all
+// of which was counted since.
+func StatsDelta(before, after Stats) Stats {
+	delta := after
+	delta.WriteCount = counterDelta(before.WriteCount, after.WriteCount)
+	delta.ReadCount = counterDelta(before.ReadCount, after.ReadCount)
+	delta.CompactCount = counterDelta(before.CompactCount, after.CompactCount)
+	delta.CorruptionCount = counterDelta(before.CorruptionCount, after.CorruptionCount)
+	delta.ScrubPasses = counterDelta(before.ScrubPasses, after.ScrubPasses)
+	delta.ScrubbedBytes = counterDelta(before.ScrubbedBytes, after.ScrubbedBytes)
+	delta.DiskFullEvents = counterDelta(before.DiskFullEvents, after.DiskFullEvents)
+	delta.ReadRepairs = counterDelta(before.ReadRepairs, after.ReadRepairs)
+
+	if after.HitLocations != nil {
+		delta.HitLocations = maps.Clone(after.HitLocations)
+		for location, n := range delta.HitLocations {
+			delta.HitLocations[location] = counterDelta(before.HitLocations[location], n)
+		}
+	}
+	return delta
+}
+
+// counterDelta returns how much a counter grew from before to after
+func counterDelta(before, after int64) int64 {
+	if after < before {
+		return after
+	}
+	return after - before
+}
+
+// StatsRates is how fast an engine worked between two Stats, per second
+type StatsRates struct {
+	Interval time.Duration // Between the two Stats
+
+	Writes      float64
+	Reads       float64
+	Compactions float64
+
+	ScrubbedBytes float64
+
+	// DiskGrowth is how fast TotalDiskSize changed: negative when
+	// compaction freed more than was written
+	DiskGrowth float64
+
+	// HitLocations is Gets satisfied per second by each component (see
+	// Stats.HitLocations)
+	HitLocations map[string]float64
+}
+
+// Rates returns how fast an engine worked between before and after, two
+// of its Stats taken interval apart. An interval that isn't positive, as
+// a clock stepping back can give, has no rates: they are all zero rather
+// than infinite.
+func Rates(before, after Stats, interval time.Duration) StatsRates {
+	if interval <= 0 {
+		return StatsRates{Interval: interval}
+	}
+	delta := StatsDelta(before, after)
+	seconds := interval.Seconds()
+	rates := StatsRates{
+		Interval:      interval,
+		Writes:        float64(delta.WriteCount) / seconds,
+		Reads:         float64(delta.ReadCount) / seconds,
+		Compactions:   float64(delta.CompactCount) / seconds,
+		ScrubbedBytes: float64(delta.ScrubbedBytes) / seconds,
+		DiskGrowth:    float64(after.TotalDiskSize-before.TotalDiskSize) / seconds,
+	}
+	if delta.HitLocations != nil {
+		rates.HitLocations = make(map[string]float64, len(delta.HitLocations))
+		for location, n := range delta.HitLocations {
+			rates.HitLocations[location] = float64(n) / seconds
+		}
+	}
+	return rates
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStatsDelta(t *testing.T) {
+	before := Stats{
+		NumKeys:       100,
+		TotalDiskSize: 4096,
+		WriteCount:    10,
+		ReadCount:     20,
+		CompactCount:  1,
+		ScrubbedBytes: 1000,
+		HitLocations:  map[string]int64{"memtable": 5, "L0": 3},
+	}
+	after := Stats{
+		NumKeys:       150,
+		TotalDiskSize: 2048,
+		WriteCount:    60,
+		ReadCount:     20,
+		CompactCount:  3,
+		ScrubbedBytes: 1500,
+		HitLocations:  map[string]int64{"memtable": 9, "L0": 3, "L1": 2},
+	}
+
+	delta := StatsDelta(before, after)
+	if delta.WriteCount != 50 || delta.ReadCount != 0 || delta.CompactCount != 2 || delta.ScrubbedBytes != 500 {
+		t.Errorf("Counters grew by %d writes, %d reads, %d compactions, %d scrubbed bytes, want 50, 0, 2, 500",
+			delta.WriteCount, delta.ReadCount, delta.CompactCount, delta.ScrubbedBytes)
+	}
+	// Gauges are after's, even when they went down
+	if delta.NumKeys != 150 || delta.TotalDiskSize != 2048 {
+		t.Errorf("Gauges are %d keys, %d bytes, want 150, 2048", delta.NumKeys, delta.TotalDiskSize)
+	}
+	want := map[string]int64{"memtable": 4, "L0": 0, "L1": 2}
+	if len(delta.HitLocations) != len(want) {
+		t.Errorf("HitLocations %v, want %v", delta.HitLocations, want)
+	}
+	for location, n := range want {
+		if delta.HitLocations[location] != n {
+			t.Errorf("HitLocations %v, want %v", delta.HitLocations, want)
+			break
+		}
+	}
+	if after.HitLocations["memtable"] != 9 {
+		t.Error("StatsDelta changed after's HitLocations")
+	}
+
+	if delta := StatsDelta(before, Stats{}); delta.HitLocations != nil {
+		t.Errorf("HitLocations %v, want nil", delta.HitLocations)
+	}
+}
+
+func TestStatsDeltaReset(t *testing.T) {
+	// The engine reopened between the two, starting its counters over
+	before := Stats{WriteCount: 1000, ReadCount: 500, HitLocations: map[string]int64{"memtable": 40}}
+	after := Stats{WriteCount: 30, ReadCount: 500, HitLocations: map[string]int64{"memtable": 7}}
+
+	delta := StatsDelta(before, after)
+	if delta.WriteCount != 30 {
+		t.Errorf("WriteCount after a reset is %d, want 30", delta.WriteCount)
+	}
+	if delta.ReadCount != 0 {
+		t.Errorf("ReadCount that didn't change is %d, want 0", delta.ReadCount)
+	}
+	if delta.HitLocations["memtable"] != 7 {
+		t.Errorf("HitLocations after a reset is %v, want memtable 7", delta.HitLocations)
+	}
+}
+
+func TestRates(t *testing.T) {
+	before := Stats{
+		WriteCount:    100,
+		ReadCount:     1000,
+		CompactCount:  2,
+		ScrubbedBytes: 0,
+		TotalDiskSize: 10000,
+		HitLocations:  map[string]int64{"cache": 10},
+	}
+	after := Stats{
+		WriteCount:    300,
+		ReadCount:     1500,
+		CompactCount:  3,
+		ScrubbedBytes: 8000,
+		TotalDiskSize: 6000,
+		HitLocations:  map[string]int64{"cache": 30},
+	}
+
+	rates := Rates(before, after, 2*time.Second)
+	want := StatsRates{
+		Interval:      2 * time.Second,
+		Writes:        100,
+		Reads:         250,
+		Compactions:   0.5,
+		ScrubbedBytes: 4000,
+		DiskGrowth:    -2000,
+	}
+	if rates.Interval != want.Interval || rates.Writes != want.Writes || rates.Reads != want.Reads ||
+		rates.Compactions != want.Compactions || rates.ScrubbedBytes != want.ScrubbedBytes || rates.DiskGrowth != want.DiskGrowth {
+		t.Errorf("Rates %+v, want %+v", rates, want)
+	}
+	if rates.HitLocations["cache"] != 10 {
+		t.Errorf("HitLocations rates %v, want cache 10", rates.HitLocations)
+	}
+
+	// Shorter than a second scales up
+	if rates := Rates(before, after, 100*time.Millisecond); rates.Writes != 2000 {
+		t.Errorf("Writes over 100ms is %v per second, want 2000", rates.Writes)
+	}
+
+	// A reset counts everything since
+	after.WriteCount = 50
+	if rates := Rates(before, after, 2*time.Second); rates.Writes != 25 {
+		t.Errorf("Writes after a reset is %v per second, want 25", rates.Writes)
+	}
+}
+
+func TestRatesNoInterval(t *testing.T) {
+	before := Stats{WriteCount: 1, TotalDiskSize: 100, HitLocations: map[string]int64{"cache": 1}}
+	after := Stats{WriteCount: 5, TotalDiskSize: 50, HitLocations: map[string]int64{"cache": 2}}
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		rates := Rates(before, after, interval)
+		if rates.Interval != interval || rates.Writes != 0 || rates.DiskGrowth != 0 || rates.HitLocations != nil {
+			t.Errorf("Rates over %v are %+v, want none", interval, rates)
+		}
+		// Infinities or NaNs would fail to encode
+		if _, err := json.Marshal(rates); err != nil {
+			t.Errorf("Rates over %v don't encode: %v", interval, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backoff between restarts of a worker that panicked: it doubles from the
+// first to the most with every panic, and starts over once the worker has
+// run for the most without one
+const (
+	firstRestartBackoff = 100 * time.Millisecond
+	mostRestartBackoff  = time.Minute
+)
+
+// WorkerPanic is a panic recovered from an engine's background worker
+type WorkerPanic struct {
+	Worker string // e.g. "compaction"
+	Value  any    // What the worker panicked with
+	Stack  []byte // Of the worker's goroutine when it panicked
+	Time   time.Time
+}
+
+func (p *WorkerPanic) Error() string {
+	return fmt.Sprintf("%s worker panicked: %v", p.Worker, p.Value)
+}
+
+// Supervisor runs an engine's background workers, so that a panic in one
+// doesn't silently stop the work it does: the panic is recovered, logged
+// with its stack, counted for Health and handed to OnPanic, and the
+// worker is started again after a backoff. A panic doesn't unlock what
+// the worker had locked without a defer, so workers take their locks
+// with one.
+type Supervisor struct {
+	// OnPanic, if set, is called with each panic recovered, on the
+	// worker's goroutine before it restarts. Set it before Run.
+	OnPanic func(p *WorkerPanic)
+
+	stop <-chan struct{}
+
+	mu     sync.Mutex
+	panics int64
+	last   *WorkerPanic
+}
+
+// NewSupervisor returns a supervisor whose workers stop being restarted
+// once stop is closed
+func NewSupervisor(stop <-chan struct{}) *Supervisor {
+	return &Supervisor{stop: stop}
+}
+
+// Run runs work, the loop of the worker named name, until it returns,
+// restarting it each time it panics unless stop is closed by then.
+// running is set while the loop runs, for Health.
+func (s *Supervisor) Run(name string, running *atomic.Bool, work func()) {
+	backoff := firstRestartBackoff
+	for {
+		started := time.Now()
+		p := s.runOnce(name, running, work)
+		if p == nil {
+			return
+		}
+		s.record(p)
+
+		if time.Since(started) >= mostRestartBackoff {
+			backoff = firstRestartBackoff
+		}
+		log.Printf("Error: %v, restarting it in %v\n%s", p, backoff, p.Stack)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, mostRestartBackoff)
+	}
+}
+
+// runOnce runs work, returning the panic it ended with if any
+func (s *Supervisor) runOnce(name string, running *atomic.Bool, work func()) (p *WorkerPanic) {
+	running.Store(true)
+	defer running.Store(false)
+	defer func() {
+		if v := recover(); v != nil {
+			p = &WorkerPanic{Worker: name, Value: v, Stack: debug.Stack(), Time: time.Now()}
+		}
+	}()
+	work()
+	return nil
+}
+
+// record counts a panic and hands it to OnPanic
+func (s *Supervisor) record(p *WorkerPanic) {
+	s.mu.Lock()
+	s.panics++
+	s.last = p
+	s.mu.Unlock()
+
+	if s.OnPanic != nil {
+		s.OnPanic(p)
+	}
+}
+
+// Panics returns how many panics were recovered, and the latest, nil if
+// there were none
+func (s *Supervisor) Panics() (int64, *WorkerPanic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.panics, s.last
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer receives a span for each operation an engine traces, so its
+// latency can be correlated with the application's traces. It is shaped
+// after OpenTelemetry's, which it takes a few lines to bridge to (see the
+// LSM README), without the engines depending on it. It is called from the
+// operation's goroutine, background workers' included, and must be safe
+// for concurrent use.
+type Tracer interface {
+	// Start begins a span named name at start, a child of the span ctx
+	// holds if any. Spans of background work get a context of their own.
+	Start(ctx context.Context, name string, start time.Time) Span
+}
+
+// Span is one operation being traced
+type Span interface {
+	// SetAttributes adds details of the operation
+	SetAttributes(attrs ...Attribute)
+
+	// End ends the span at end, as failed with err if err isn't nil
+	End(end time.Time, err error)
+}
+
+// Attribute is a detail of a span: its Value is an int64, a string or a
+// bool
+type Attribute struct {
+	Key   string
+	Value any
+}
@@ -7,6 +7,10 @@ type StorageEngine interface {
 	// Get Returns ErrKeyNotFound if key doesn't exist
 	Get(key []byte) ([]byte, error)
 
+	// Has reports whether key exists, reading as little as the engine's
+	// index structures allow and never the value itself
+	Has(key []byte) (bool, error)
+
 	// Delete removes a key
 	Delete(key []byte) error
 
@@ -21,6 +25,9 @@ type StorageEngine interface {
 
 	// Compact manually triggers compaction
 	Compact() error
+
+	// Health diagnoses the engine's state
+	Health() Health
 }
 
 // Stats contains engine statistics
@@ -31,6 +38,12 @@ type Stats struct {
 	ActiveSegSize int64
 	TotalDiskSize int64
 
+	// Deleted keys whose tombstones are still on disk, and the bytes of
+	// overwritten or deleted records compaction would reclaim. Zero for
+	// engines that don't track them.
+	NumTombstones int64
+	DeadBytes     int64
+
 	// Performance metrics
 	WriteCount   int64
 	ReadCount    int64
@@ -39,6 +52,126 @@ type Stats struct {
 	// Amplification factors
 	WriteAmp float64 // bytes written to disk / bytes written by user
 	SpaceAmp float64 // disk space used / logical data size
+
+	// Read amplification: storage units (memtables, SSTables, data blocks,
+	// segments or pages) touched per Get
+	ReadAmp    float64 // average
+	ReadAmpP99 float64 // 99th percentile
+
+	// HitLocations counts where Gets were satisfied, keyed by an
+	// engine-specific component name (e.g. "memtable", "L0", "miss").
+	// Nil for engines that don't break lookups down.
+	HitLocations map[string]int64
+
+	// Memory held by tracked components (see MemoryAccountant). Engines
+	// sharing an accountant all report the shared totals.
+	MemoryUsed   int64
+	MemoryBudget int64 // 0 = unlimited
+	MemoryUsage  map[string]int64
+
+	// Memory held by an LSM-Tree's bloom filters and SSTable block indexes
+	// by level ("L0".."L{n}"), which grows with the data set. Unlike
+	// MemoryUsage they cover this engine alone. A B-Tree with a bloom
+	// filter over its keys reports it as BloomMemory["keys"]. Nil for
+	// other engines.
+	BloomMemory map[string]int64
+	IndexMemory map[string]int64
+
+	// Corruption found since the engine was opened. Damaged files the
+	// engine can serve without are moved into the QuarantineDir of its data
+	// directory; Quarantined lists their new paths.
+	CorruptionCount int64
+	Quarantined     []string
+
+	// Background scrubbing (see Scrubber): passes over all the data
+	// completed, and bytes checked. Corruption it finds is counted above.
+	ScrubPasses   int64
+	ScrubbedBytes int64
+
+	// DiskFullEvents counts the times the engine turned read-only because
+	// free disk space fell below its low watermark (see DiskGuard)
+	DiskFullEvents int64
+
+	// ReadRepairs counts index entries found pointing at a file no longer
+	// there, and repaired to the key's latest record elsewhere. Zero for
+	// engines that don't repair them.
+	ReadRepairs int64
+
+	// StaleKeyFiles counts files still encrypted with a key other than the
+	// key provider's current one, waiting to be rewritten after RotateKeys
+	StaleKeyFiles int
+
+	// NextFlushReason names the trigger an LSM-Tree's active memtable is
+	// closest to reaching, which will flush it: "size", "entries", "age"
+	// or "memory" (see lsm.Config.MemTableMaxEntries). Empty for other
+	// engines.
+	NextFlushReason string
+}
+
+// ValueGetter is implemented by engines that can read a value without
+// copying it out. GetValue calls fn with key's value, borrowed from the
+// page, block or buffer it was read into and held there until fn returns:
+// it is only valid during fn, and must not be modified or kept. It returns
+// ErrKeyNotFound, without calling fn, if key doesn't exist, and otherwise
+// fn's error.
+type ValueGetter interface {
+	GetValue(key []byte, fn func(value []byte) error) error
+}
+
+// ConditionalWriter is implemented by engines that can write a key only
+// if it hasn't changed since it was read, for optimistic concurrency
+// without transactions. Each write of a key raises its sequence number.
+type ConditionalWriter interface {
+	// GetWithMeta is Get also returning key's sequence number
+	GetWithMeta(key []byte) (value []byte, seq uint64, err error)
+
+	// PutIf writes key only if its sequence number is still expectedSeq
+	// (0 = the key doesn't exist), and fails with ErrConflict otherwise.
+	// It may also fail when the engine renumbered the key without a
+	// write, but never succeeds over a write since expectedSeq was read.
+	PutIf(key, value []byte, expectedSeq uint64) error
+
+	// CompareAndSwap writes value to key only if it holds old, or doesn't
+	// exist if old is nil, and fails with ErrConflict otherwise
+	CompareAndSwap(key, old, value []byte) error
+}
+
+// Incrementer is implemented by engines with atomic counters, so callers
+// don't have to read, add and write a counter back themselves, racing
+// every other caller doing the same. A counter is an int64 stored as its
+// decimal string, as AddCounter writes it.
+type Incrementer interface {
+	// Incr adds delta to the counter at key, a missing key counting as 0,
+	// and returns its new value; a negative delta decrements it. It fails
+	// with ErrNotCounter if key holds anything else or the sum overflows.
+	Incr(key []byte, delta int64) (int64, error)
+}
+
+// Appender is implemented by engines that can append to a value in one
+// atomic step, for log-style values many writers add to
+type Appender interface {
+	// Append adds suffix to the end of key's value, a missing key taking
+	// suffix as its value. Concurrent appends to a key all land, in some
+	// order.
+	Append(key, suffix []byte) error
+}
+
+// Inserter is implemented by engines that can write a key only if it
+// doesn't exist, checking and writing in one atomic step
+type Inserter interface {
+	// PutIfAbsent writes key only if it doesn't exist, and reports
+	// whether it did. An existing key is left as it is, without error.
+	PutIfAbsent(key, value []byte) (inserted bool, err error)
+}
+
+// Undeleter is implemented by engines that can keep deleted values
+// restorable for a while after the delete (see their UndeleteWindow)
+type Undeleter interface {
+	// Undelete restores the value key held before its latest Delete, if
+	// that was within the undelete window. It fails with ErrKeyNotFound if
+	// there is nothing to restore: the key isn't deleted, was deleted
+	// before the window, or held no value.
+	Undelete(key []byte) error
 }
 
 // Iterator for range scans
@@ -49,3 +182,24 @@ type Iterator interface {
 	Error() error
 	Close() error
 }
+
+// Scanner is implemented by engines that support range scans (the B-Tree
+// and the LSM adapter)
+type Scanner interface {
+	// Scan returns an iterator over the keys in [start, end); a nil end
+	// is unbounded
+	Scan(start, end []byte) (Iterator, error)
+}
+
+// KeyRange is the key range [Start, End). An empty Start or End leaves
+// that side unbounded.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+// RangeSize is an engine's estimate of the space a KeyRange takes
+type RangeSize struct {
+	DiskBytes   int64 // On disk, including versions not yet compacted away
+	MemoryBytes int64 // Written but held only in memory, such as memtables
+}
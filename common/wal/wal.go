@@ -0,0 +1,493 @@
+// Package wal is the write-ahead log the engines share: an append-only log
+// of typed, checksummed records, kept in one or more segment files. What a
+// record holds is up to the engine, which defines its own record types; the
+// log frames, checksums and replays them, and recovers from a damaged tail
+// the same way for every engine.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+const (
+	// HeaderSize is the size of the header each segment starts with:
+	// [magic(4)][version(4)][logID(8)][segment(4)][crc32(4)]
+	HeaderSize = 24
+
+	// recordHeaderSize is [crc32(4)][length(4)][type(1)]. The CRC covers
+	// everything after it, and length is the payload's.
+	recordHeaderSize = 9
+)
+
+// recordBuffers holds the buffers Append frames records in
+var recordBuffers = common.NewBufferPool(64 << 10)
+
+// RecordType tells an engine what a record's payload holds. Engines number
+// their own types from 1.
+type RecordType uint8
+
+// Record is one entry in the log
+type Record struct {
+	Type RecordType
+	Data []byte
+}
+
+// Options describe the log an engine keeps
+type Options struct {
+	// Magic identifies the engine's log, so one engine never replays
+	// another's. It must be four bytes.
+	Magic string
+
+	// Version is the engine's version of its record payloads. A log
+	// written under another version fails to open with a FormatError.
+	Version uint32
+
+	// SegmentSize, if set, starts a new segment file once the current one
+	// would grow past it. 0 keeps the whole log in one file.
+	SegmentSize int64
+}
+
+// FormatError is returned by Open for an existing file that doesn't start
+// with the header the Options ask for: another kind of file, or a log in
+// an older format the engine may still know how to read and convert
+type FormatError struct {
+	Path    string
+	Magic   string // As found: whatever the file starts with if it has no header
+	Version uint32
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("unsupported WAL format in %s: magic %q version %d", e.Path, e.Magic, e.Version)
+}
+
+// segment is one file of the log
+type segment struct {
+	file common.File
+	path string
+	size int64
+}
+
+// Log is an open write-ahead log. Segment 0 is the file at the log's path,
+// and segment n the file at path.00000n. Every segment header carries the
+// log's ID, so segments left behind when the log was started over are
+// recognised and removed.
+type Log struct {
+	fs   common.FS
+	path string
+	opts Options
+
+	mu       sync.Mutex
+	id       uint64
+	segments []*segment // Oldest first; records are appended to the last
+	appended int64      // Record bytes appended since the log was opened
+}
+
+// Open opens the log at path in fs, creating it if needed
+func Open(fs common.FS, path string, opts Options) (*Log, error) {
+	if len(opts.Magic) != 4 {
+		return nil, fmt.Errorf("WAL magic %q is not four bytes", opts.Magic)
+	}
+
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	l := &Log{fs: fs, path: path, opts: opts}
+	first := &segment{file: file, path: path}
+	l.segments = []*segment{first}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat WAL: %w", err)
+	}
+	first.size = stat.Size()
+
+	id, index, err := l.readHeader(first)
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// New, or cut short while being started: start over
+		if err := l.startOver(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	case err != nil:
+		file.Close()
+		return nil, err
+	case index != 0:
+		file.Close()
+		return nil, common.Corruptf(path, "first WAL segment is numbered %d", index)
+	default:
+		l.id = id
+	}
+
+	if err := l.openSegments(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// segmentPath returns the file segment n is kept in
+func (l *Log) segmentPath(n int) string {
+	if n == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%06d", l.path, n)
+}
+
+// readHeader reads and checks a segment's header, returning the log ID and
+// segment number in it. A header cut short returns io.ErrUnexpectedEOF.
+func (l *Log) readHeader(s *segment) (uint64, uint32, error) {
+	header := make([]byte, HeaderSize)
+	n, err := s.file.ReadAt(header, 0)
+	if n >= 4 && string(header[:4]) != l.opts.Magic {
+		return 0, 0, &FormatError{Path: s.path, Magic: string(header[:4]), Version: binary.LittleEndian.Uint32(header[4:])}
+	}
+	if n < HeaderSize {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	if version := binary.LittleEndian.Uint32(header[4:]); version != l.opts.Version {
+		return 0, 0, &FormatError{Path: s.path, Magic: l.opts.Magic, Version: version}
+	}
+	if crc32.ChecksumIEEE(header[:20]) != binary.LittleEndian.Uint32(header[20:]) {
+		return 0, 0, common.Corruptf(s.path, "WAL header checksum mismatch")
+	}
+	return binary.LittleEndian.Uint64(header[8:]), binary.LittleEndian.Uint32(header[16:]), nil
+}
+
+// writeHeader writes the header of segment n of the log
+func (l *Log) writeHeader(s *segment, n int) error {
+	header := make([]byte, HeaderSize)
+	copy(header[0:], l.opts.Magic)
+	binary.LittleEndian.PutUint32(header[4:], l.opts.Version)
+	binary.LittleEndian.PutUint64(header[8:], l.id)
+	binary.LittleEndian.PutUint32(header[16:], uint32(n))
+	binary.LittleEndian.PutUint32(header[20:], crc32.ChecksumIEEE(header[:20]))
+	if _, err := s.file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("failed to write WAL header: %w", err)
+	}
+	s.size = HeaderSize
+	return nil
+}
+
+// openSegments opens the segments after the first that belong to the log,
+// and removes any left behind when it was started over
+func (l *Log) openSegments() error {
+	for n := 1; ; n++ {
+		path := l.segmentPath(n)
+		file, err := l.fs.OpenFile(path, os.O_RDWR, 0644)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open WAL segment: %w", err)
+		}
+		s := &segment{file: file, path: path}
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to stat WAL segment: %w", err)
+		}
+		s.size = stat.Size()
+
+		// A segment cut short while being started holds no records
+		id, index, err := l.readHeader(s)
+		if err != nil || id != l.id || index != uint32(n) {
+			file.Close()
+			break
+		}
+		l.segments = append(l.segments, s)
+	}
+	return l.removeStale()
+}
+
+// removeStale removes segment files past the log's last segment
+func (l *Log) removeStale() error {
+	dir, base := filepath.Split(l.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := l.fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok || len(suffix) != 6 {
+			continue
+		}
+		if n, err := strconv.Atoi(suffix); err == nil && n >= len(l.segments) {
+			if err := l.fs.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return fmt.Errorf("failed to remove stale WAL segment: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// startOver empties the first segment under a new log ID, which disowns
+// every later segment. The file is created anew rather than truncated, so
+// with encryption it moves onto the current key. Caller must hold l.mu or
+// have the log to itself.
+func (l *Log) startOver() error {
+	first := l.segments[0]
+	first.file.Close()
+	file, err := l.fs.Create(first.path)
+	if err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+	first.file = file
+	l.id = uint64(time.Now().UnixNano())
+	if err := l.writeHeader(first, 0); err != nil {
+		return err
+	}
+	return first.file.Sync()
+}
+
+// Append adds a record to the end of the log. It is durable once Sync
+// returns.
+func (l *Log) Append(typ RecordType, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size := int64(recordHeaderSize + len(data))
+	active := l.segments[len(l.segments)-1]
+	if l.opts.SegmentSize > 0 && active.size > HeaderSize && active.size+size > l.opts.SegmentSize {
+		var err error
+		if active, err = l.roll(); err != nil {
+			return err
+		}
+	}
+
+	buf := recordBuffers.Get(int(size))
+	defer recordBuffers.Put(buf)
+	record := *buf
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(data)))
+	record[8] = byte(typ)
+	copy(record[recordHeaderSize:], data)
+	binary.LittleEndian.PutUint32(record[0:], crc32.ChecksumIEEE(record[4:]))
+
+	// A failed write may leave part of the record behind; the next one
+	// overwrites it
+	if _, err := active.file.WriteAt(record, active.size); err != nil {
+		return fmt.Errorf("failed to write WAL record: %w", err)
+	}
+	active.size += size
+	l.appended += size
+	return nil
+}
+
+// roll syncs the active segment and starts the next one. Caller must hold
+// l.mu.
+func (l *Log) roll() (*segment, error) {
+	if err := l.segments[len(l.segments)-1].file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync WAL segment: %w", err)
+	}
+
+	n := len(l.segments)
+	path := l.segmentPath(n)
+	file, err := l.fs.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	s := &segment{file: file, path: path}
+	if err := l.writeHeader(s, n); err != nil {
+		file.Close()
+		l.fs.Remove(path)
+		return nil, err
+	}
+	l.segments = append(l.segments, s)
+	return s, nil
+}
+
+// Replay calls fn with each record in the log, oldest first. A record cut
+// short by a crash, or one failing its checksum, ends the log: it and
+// everything after it are truncated away, so new records don't land behind
+// it. For a failed checksum, damage reports the corruption; a torn last
+// record isn't corruption. An error from fn stops the replay and is
+// returned as err, leaving the log as it was.
+func (l *Log) Replay(fn func(Record) error) (damage, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, s := range l.segments {
+		offset, damage, err := l.replaySegment(s, fn)
+		if err != nil {
+			return nil, err
+		}
+		if damage == nil {
+			continue
+		}
+
+		if errors.Is(damage, io.ErrUnexpectedEOF) {
+			log.Printf("Warning: torn write in WAL %s at offset %d, truncating %d bytes", s.path, offset, s.size-offset)
+			damage = nil
+		} else {
+			damage = common.Corruptf(s.path, "record at offset %d: %w", offset, damage)
+			log.Printf("Warning: %v, truncating %d bytes", damage, s.size-offset)
+		}
+		if err := l.truncate(i, offset); err != nil {
+			return nil, err
+		}
+		return damage, nil
+	}
+	return nil, nil
+}
+
+// replaySegment calls fn with each record in s, returning the offset where
+// reading stopped and why, if before the end
+func (l *Log) replaySegment(s *segment, fn func(Record) error) (int64, error, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(s.file, HeaderSize, s.size-HeaderSize), 64*1024)
+	header := make([]byte, recordHeaderSize)
+	offset := int64(HeaderSize)
+	for offset < s.size {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return offset, io.ErrUnexpectedEOF, nil
+		}
+
+		// A length past the end is a torn header as often as a damaged
+		// one; either way nothing after it can be trusted
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		if offset+recordHeaderSize+length > s.size {
+			return offset, io.ErrUnexpectedEOF, nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return offset, io.ErrUnexpectedEOF, nil
+		}
+
+		digest := crc32.NewIEEE()
+		digest.Write(header[4:])
+		digest.Write(data)
+		if digest.Sum32() != binary.LittleEndian.Uint32(header[0:]) {
+			return offset, fmt.Errorf("CRC mismatch"), nil
+		}
+
+		if err := fn(Record{Type: RecordType(header[8]), Data: data}); err != nil {
+			return offset, nil, err
+		}
+		offset += recordHeaderSize + length
+	}
+	return offset, nil, nil
+}
+
+// truncate cuts the log short at offset in segment i, removing the
+// segments after it. Caller must hold l.mu.
+func (l *Log) truncate(i int, offset int64) error {
+	s := l.segments[i]
+	if err := s.file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	s.size = offset
+
+	for _, later := range l.segments[i+1:] {
+		later.file.Close()
+	}
+	l.segments = l.segments[:i+1]
+	return l.removeStale()
+}
+
+// Reset drops every record, starting the log over empty
+func (l *Log) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.startOver(); err != nil {
+		return err
+	}
+	for _, s := range l.segments[1:] {
+		s.file.Close()
+	}
+	l.segments = l.segments[:1]
+	return l.removeStale()
+}
+
+// Sync makes the records appended so far durable. Segments before the
+// active one were synced when it was started.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[len(l.segments)-1].file.Sync()
+}
+
+// Size returns the bytes the log takes on disk, headers included
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var size int64
+	for _, s := range l.segments {
+		size += s.size
+	}
+	return size
+}
+
+// Appended returns the bytes of the records appended since the log was
+// opened, record headers included, however often it was started over
+func (l *Log) Appended() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.appended
+}
+
+// StaleKey reports whether a segment is encrypted with an old key (see
+// common.StaleKey)
+func (l *Log) StaleKey() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range l.segments {
+		if common.StaleKey(l.fs, s.file) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the log's files without syncing them
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	for _, s := range l.segments {
+		if err := s.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Delete closes the log and removes its files
+func (l *Log) Delete() error {
+	l.Close()
+
+	var firstErr error
+	for _, s := range l.segments {
+		if err := l.fs.Remove(s.path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,378 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+var testOptions = Options{Magic: "TWAL", Version: 1}
+
+// openLog opens the log at /wal in fs, failing the test on error
+func openLog(t *testing.T, fs common.FS, opts Options) *Log {
+	t.Helper()
+	l, err := Open(fs, "/wal", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return l
+}
+
+// appendRecords appends n records numbered from first, and syncs them
+func appendRecords(t *testing.T, l *Log, first, n int) {
+	t.Helper()
+	for i := first; i < first+n; i++ {
+		if err := l.Append(RecordType(i%3+1), recordData(i)); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if err := l.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+}
+
+func recordData(i int) []byte {
+	return []byte(fmt.Sprintf("record-%04d", i))
+}
+
+// replayAll replays the log, checking the records are the first n
+// appended by appendRecords, in order
+func replayAll(t *testing.T, l *Log, n int) error {
+	t.Helper()
+	i := 0
+	damage, err := l.Replay(func(r Record) error {
+		if r.Type != RecordType(i%3+1) || !bytes.Equal(r.Data, recordData(i)) {
+			t.Fatalf("Record %d is type %d %q, want type %d %q", i, r.Type, r.Data, i%3+1, recordData(i))
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if i != n {
+		t.Fatalf("Replayed %d records, want %d", i, n)
+	}
+	return damage
+}
+
+// segmentFiles returns how many of the log's segment files exist
+func segmentFiles(t *testing.T, fs common.FS) int {
+	t.Helper()
+	n := 0
+	for {
+		path := "/wal"
+		if n > 0 {
+			path = fmt.Sprintf("/wal.%06d", n)
+		}
+		if _, err := fs.Stat(path); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestAppendReplay(t *testing.T) {
+	fs := common.NewMemFS()
+	l := openLog(t, fs, testOptions)
+	if damage := replayAll(t, l, 0); damage != nil {
+		t.Fatalf("New log reported damage: %v", damage)
+	}
+	if l.Size() != HeaderSize {
+		t.Errorf("Size of an empty log is %d, want %d", l.Size(), HeaderSize)
+	}
+
+	appendRecords(t, l, 0, 10)
+	if damage := replayAll(t, l, 10); damage != nil {
+		t.Fatalf("Replay reported damage: %v", damage)
+	}
+	want := int64(0)
+	for i := 0; i < 10; i++ {
+		want += recordHeaderSize + int64(len(recordData(i)))
+	}
+	if l.Appended() != want {
+		t.Errorf("Appended %d bytes, want %d", l.Appended(), want)
+	}
+	if l.Size() != HeaderSize+want {
+		t.Errorf("Size %d, want %d", l.Size(), HeaderSize+want)
+	}
+	l.Close()
+
+	// Reopen and append behind what was there
+	l = openLog(t, fs, testOptions)
+	defer l.Close()
+	if l.Appended() != 0 {
+		t.Errorf("Appended %d bytes after reopening, want 0", l.Appended())
+	}
+	if damage := replayAll(t, l, 10); damage != nil {
+		t.Fatalf("Replay reported damage: %v", damage)
+	}
+	appendRecords(t, l, 10, 5)
+	replayAll(t, l, 15)
+
+	// Reset drops everything
+	if err := l.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	replayAll(t, l, 0)
+	if l.Size() != HeaderSize {
+		t.Errorf("Size after Reset is %d, want %d", l.Size(), HeaderSize)
+	}
+}
+
+func TestSegmentRollover(t *testing.T) {
+	fs := common.NewMemFS()
+	opts := testOptions
+	opts.SegmentSize = 100 // Three records a segment
+	l := openLog(t, fs, opts)
+
+	appendRecords(t, l, 0, 20)
+	if n := segmentFiles(t, fs); n != 7 {
+		t.Errorf("Log has %d segments, want 7", n)
+	}
+	replayAll(t, l, 20)
+	size := l.Size()
+	l.Close()
+
+	l = openLog(t, fs, opts)
+	defer l.Close()
+	if l.Size() != size {
+		t.Errorf("Size after reopening is %d, want %d", l.Size(), size)
+	}
+	replayAll(t, l, 20)
+
+	// Appends go on in the last segment
+	appendRecords(t, l, 20, 4)
+	if n := segmentFiles(t, fs); n != 8 {
+		t.Errorf("Log has %d segments, want 8", n)
+	}
+	replayAll(t, l, 24)
+
+	// A record larger than a segment still goes in one
+	if err := l.Append(1, make([]byte, 200)); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if n := segmentFiles(t, fs); n != 9 {
+		t.Errorf("Log has %d segments, want 9", n)
+	}
+}
+
+func TestStaleSegmentsRemoved(t *testing.T) {
+	fs := common.NewMemFS()
+	opts := testOptions
+	opts.SegmentSize = 100
+	l := openLog(t, fs, opts)
+	appendRecords(t, l, 0, 20)
+
+	// Starting over disowns the later segments
+	if err := l.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if n := segmentFiles(t, fs); n != 1 {
+		t.Errorf("Log has %d segments after Reset, want 1", n)
+	}
+	appendRecords(t, l, 0, 5)
+	l.Close()
+
+	// A segment past the last, as left by a crash in the middle of
+	// removing them, and one belonging to an earlier log
+	stray, err := fs.Create("/wal.000009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stray.Close()
+	other := common.NewMemFS()
+	old := openLog(t, other, opts)
+	appendRecords(t, old, 0, 20)
+	old.Close()
+	data, err := readFile(other, "/wal.000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(fs, "/wal.000002", data); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, fs, opts)
+	defer l.Close()
+	replayAll(t, l, 5)
+	for _, path := range []string{"/wal.000002", "/wal.000009"} {
+		if _, err := fs.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stale segment %s was not removed: %v", path, err)
+		}
+	}
+	if n := segmentFiles(t, fs); n != 2 {
+		t.Errorf("Log has %d segments, want 2", n)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	fs := common.NewMemFS()
+	l := openLog(t, fs, testOptions)
+	appendRecords(t, l, 0, 10)
+	size := l.Size()
+	l.Close()
+
+	// Cut the last record short
+	if err := truncateFile(fs, "/wal", size-3); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, fs, testOptions)
+	defer l.Close()
+	if damage := replayAll(t, l, 9); damage != nil {
+		t.Errorf("A torn last record was reported as damage: %v", damage)
+	}
+	want := size - recordHeaderSize - int64(len(recordData(9)))
+	if l.Size() != want {
+		t.Errorf("Size after truncating is %d, want %d", l.Size(), want)
+	}
+
+	// New records land where the torn one was
+	appendRecords(t, l, 9, 3)
+	replayAll(t, l, 12)
+}
+
+func TestCRCMismatch(t *testing.T) {
+	fs := common.NewMemFS()
+	opts := testOptions
+	opts.SegmentSize = 100
+	l := openLog(t, fs, opts)
+	appendRecords(t, l, 0, 20)
+	l.Close()
+
+	// Damage the second record of the second segment. Everything from
+	// it on is dropped, later segments included.
+	offset := int64(HeaderSize + 2*recordHeaderSize + len(recordData(3)) + len(recordData(4)) - 1)
+	if err := flipByte(fs, "/wal.000001", offset); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, fs, opts)
+	defer l.Close()
+	damage := replayAll(t, l, 4)
+	if !errors.Is(damage, common.ErrCorruption) {
+		t.Fatalf("Replay reported %v, want corruption", damage)
+	}
+	if path := common.CorruptPath(damage); path != "/wal.000001" {
+		t.Errorf("Corruption reported in %q, want /wal.000001", path)
+	}
+	if n := segmentFiles(t, fs); n != 2 {
+		t.Errorf("Log has %d segments after truncating, want 2", n)
+	}
+
+	appendRecords(t, l, 4, 2)
+	if damage := replayAll(t, l, 6); damage != nil {
+		t.Errorf("Replay reported damage after truncating: %v", damage)
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	fs := common.NewMemFS()
+	l := openLog(t, fs, testOptions)
+	appendRecords(t, l, 0, 3)
+	l.Close()
+
+	// Another engine's log
+	_, err := Open(fs, "/wal", Options{Magic: "OTHR", Version: 1})
+	var formatErr *FormatError
+	if !errors.As(err, &formatErr) {
+		t.Fatalf("Opening another engine's log returned %v, want a FormatError", err)
+	}
+	if formatErr.Magic != "TWAL" || formatErr.Version != 1 {
+		t.Errorf("FormatError has magic %q version %d, want TWAL version 1", formatErr.Magic, formatErr.Version)
+	}
+
+	// Another version of the same engine's
+	_, err = Open(fs, "/wal", Options{Magic: "TWAL", Version: 2})
+	if !errors.As(err, &formatErr) {
+		t.Fatalf("Opening a log of another version returned %v, want a FormatError", err)
+	}
+	if formatErr.Magic != "TWAL" || formatErr.Version != 1 {
+		t.Errorf("FormatError has magic %q version %d, want TWAL version 1", formatErr.Magic, formatErr.Version)
+	}
+
+	// The log is left as it was
+	l = openLog(t, fs, testOptions)
+	defer l.Close()
+	replayAll(t, l, 3)
+
+	if _, err := Open(fs, "/other", Options{Magic: "WAL", Version: 1}); err == nil {
+		t.Error("Open accepted a three-byte magic")
+	}
+}
+
+func TestDamagedHeader(t *testing.T) {
+	fs := common.NewMemFS()
+	l := openLog(t, fs, testOptions)
+	appendRecords(t, l, 0, 3)
+	l.Close()
+
+	if err := flipByte(fs, "/wal", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(fs, "/wal", testOptions); !errors.Is(err, common.ErrCorruption) {
+		t.Errorf("Open with a damaged header returned %v, want corruption", err)
+	}
+
+	// A header cut short was never finished, so the log starts over
+	if err := truncateFile(fs, "/wal", HeaderSize-1); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, fs, testOptions)
+	defer l.Close()
+	replayAll(t, l, 0)
+}
+
+func readFile(fs common.FS, path string) ([]byte, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, stat.Size())
+	_, err = file.ReadAt(data, 0)
+	return data, err
+}
+
+func writeFile(fs common.FS, path string, data []byte) error {
+	file, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteAt(data, 0)
+	return err
+}
+
+func truncateFile(fs common.FS, path string, size int64) error {
+	file, err := fs.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Truncate(size)
+}
+
+func flipByte(fs common.FS, path string, offset int64) error {
+	file, err := fs.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		return err
+	}
+	b[0] ^= 0xFF
+	_, err = file.WriteAt(b, offset)
+	return err
+}
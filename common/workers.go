@@ -0,0 +1,58 @@
+package common
+
+import "runtime"
+
+// WorkerLimiter bounds how many of an engine's background goroutines
+// (flushes, compactions, garbage collection) do work at once, so they
+// leave CPU to the application the engine runs in. Each unit of
+// background work runs between Acquire and Release; goroutines over the
+// limit wait their turn.
+//
+// A nil WorkerLimiter is valid and never waits.
+type WorkerLimiter struct {
+	slots chan struct{}
+}
+
+// NewWorkerLimiter returns a limiter letting at most maxWorkers
+// goroutines work at once, and at most cpuPercent percent of GOMAXPROCS
+// (rounded down, but at least one). Either may be 0 for no limit; with
+// both 0 it returns nil.
+func NewWorkerLimiter(maxWorkers, cpuPercent int) *WorkerLimiter {
+	limit := max(maxWorkers, 0)
+	if cpuPercent > 0 {
+		share := max(runtime.GOMAXPROCS(0)*cpuPercent/100, 1)
+		if limit == 0 || share < limit {
+			limit = share
+		}
+	}
+	if limit == 0 {
+		return nil
+	}
+	return &WorkerLimiter{slots: make(chan struct{}, limit)}
+}
+
+// Acquire waits until the calling goroutine may start work. Every Acquire
+// must be matched by a Release. Work holding a slot must not wait for
+// other background work, which may be waiting for that slot.
+func (l *WorkerLimiter) Acquire() {
+	if l == nil {
+		return
+	}
+	l.slots <- struct{}{}
+}
+
+// Release ends work started with Acquire
+func (l *WorkerLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Limit returns how many goroutines may work at once (0 = no limit)
+func (l *WorkerLimiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.slots)
+}
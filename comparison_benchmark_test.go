@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/intellect4all/storage-engines/btree"
 	"github.com/intellect4all/storage-engines/hashindex"
 	"github.com/intellect4all/storage-engines/lsm"
 )
@@ -86,7 +88,7 @@ func BenchmarkMixedWorkload(b *testing.B) {
 
 // LSM Benchmark Implementations
 func benchmarkLSMWrites(b *testing.B, numOps int) {
-	dir := fmt.Sprintf("/tmp/bench-lsm-write-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-lsm-write-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := lsm.DefaultConfig(dir)
@@ -116,7 +118,7 @@ func benchmarkLSMWrites(b *testing.B, numOps int) {
 }
 
 func benchmarkLSMReads(b *testing.B, numKeys int) {
-	dir := fmt.Sprintf("/tmp/bench-lsm-read-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-lsm-read-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := lsm.DefaultConfig(dir)
@@ -157,7 +159,7 @@ func benchmarkLSMReads(b *testing.B, numKeys int) {
 }
 
 func benchmarkLSMMixed(b *testing.B, numKeys int, readRatio float64) {
-	dir := fmt.Sprintf("/tmp/bench-lsm-mixed-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-lsm-mixed-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := lsm.DefaultConfig(dir)
@@ -192,7 +194,7 @@ func benchmarkLSMMixed(b *testing.B, numKeys int, readRatio float64) {
 
 // HashIndex Benchmark Implementations
 func benchmarkHashIndexWrites(b *testing.B, numOps int) {
-	dir := fmt.Sprintf("/tmp/bench-hash-write-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-hash-write-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	db, err := hashindex.New(hashindex.Config{DataDir: dir})
@@ -221,7 +223,7 @@ func benchmarkHashIndexWrites(b *testing.B, numOps int) {
 }
 
 func benchmarkHashIndexReads(b *testing.B, numKeys int) {
-	dir := fmt.Sprintf("/tmp/bench-hash-read-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-hash-read-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	db, err := hashindex.New(hashindex.Config{DataDir: dir})
@@ -257,7 +259,7 @@ func benchmarkHashIndexReads(b *testing.B, numKeys int) {
 }
 
 func benchmarkHashIndexMixed(b *testing.B, numKeys int, readRatio float64) {
-	dir := fmt.Sprintf("/tmp/bench-hash-mixed-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-hash-mixed-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	db, err := hashindex.New(hashindex.Config{DataDir: dir})
@@ -290,7 +292,7 @@ func benchmarkHashIndexMixed(b *testing.B, numKeys int, readRatio float64) {
 
 // BenchmarkRangeScanCapability demonstrates LSM's unique advantage
 func BenchmarkRangeScanCapability(b *testing.B) {
-	dir := fmt.Sprintf("/tmp/bench-lsm-range-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-lsm-range-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := lsm.DefaultConfig(dir)
@@ -316,13 +318,14 @@ func BenchmarkRangeScanCapability(b *testing.B) {
 			count++
 			iter.Next()
 		}
+		iter.Close()
 	}
 }
 
 // BenchmarkNegativeLookups tests bloom filter effectiveness
 func BenchmarkNegativeLookups(b *testing.B) {
 	b.Run("LSM_WithBloomFilter", func(b *testing.B) {
-		dir := fmt.Sprintf("/tmp/bench-lsm-neg-%d", time.Now().UnixNano())
+		dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-lsm-neg-%d", time.Now().UnixNano()))
 		defer os.RemoveAll(dir)
 
 		config := lsm.DefaultConfig(dir)
@@ -348,7 +351,7 @@ func BenchmarkNegativeLookups(b *testing.B) {
 	})
 
 	b.Run("HashIndex_NoBloomFilter", func(b *testing.B) {
-		dir := fmt.Sprintf("/tmp/bench-hash-neg-%d", time.Now().UnixNano())
+		dir := filepath.Join(os.TempDir(), fmt.Sprintf("bench-hash-neg-%d", time.Now().UnixNano()))
 		defer os.RemoveAll(dir)
 
 		db, err := hashindex.New(hashindex.Config{DataDir: dir})
@@ -370,4 +373,33 @@ func BenchmarkNegativeLookups(b *testing.B) {
 			db.Get(key)
 		}
 	})
+
+	for _, bitsPerKey := range []int{0, 10} {
+		name := "BTree_NoBloomFilter"
+		if bitsPerKey > 0 {
+			name = "BTree_WithBloomFilter"
+		}
+		b.Run(name, func(b *testing.B) {
+			config := btree.DefaultConfig(b.TempDir())
+			config.BloomBitsPerKey = bitsPerKey
+			db, err := btree.New(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			// Populate
+			for i := 0; i < 10000; i++ {
+				key := []byte(fmt.Sprintf("key%010d", i))
+				value := []byte("value")
+				db.Put(key, value)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := []byte(fmt.Sprintf("key%010d", 10000+i)) // Non-existent keys
+				db.Get(key)
+			}
+		})
+	}
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common/proptest"
+)
+
+// TestEngineEquivalence runs the same random sequences against each
+// engine, configured small so they flush, compact and split within a few
+// hundred operations, and checks each holds what a map would
+func TestEngineEquivalence(t *testing.T) {
+	engines := []struct {
+		name string
+		open proptest.Opener
+
+		// The hash index stores an empty value as a tombstone, so one
+		// written reads back as missing there and as empty elsewhere
+		emptyDeletes bool
+	}{
+		{"hashindex", openHashIndex, true},
+		{"lsm", openLSM, false},
+		{"btree", openBTree, false},
+	}
+
+	for _, e := range engines {
+		t.Run(e.name, func(t *testing.T) {
+			config := proptest.Config{EmptyValues: true, EmptyDeletes: e.emptyDeletes, Seed: 1}
+			if testing.Short() {
+				config.Sequences = 5
+			}
+			if err := proptest.Check(e.open, config); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package hashindex
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Checkpoint implements common.Checkpointer. The checkpoint holds every
+// segment: the sealed ones, which are immutable, and the active ones up to
+// the last record appended. Writes and compactions go on while fn runs;
+// segments compacted away meanwhile stay readable until it returns.
+//
+// A compaction's output takes the name of its newest input, so a sealed
+// segment's name alone doesn't identify its content.
+func (h *HashIndex) Checkpoint(fn func(files []common.CheckpointFile) error) error {
+	if err := h.gate.Enter(); err != nil {
+		return err
+	}
+	defer h.gate.Exit()
+
+	var held []*segment
+	defer func() {
+		for _, seg := range held {
+			seg.release()
+		}
+	}()
+
+	// Rotations and compactions change the segment list under segmentsMu,
+	// so the sealed and active segments read under it are one set. A
+	// segment being rotated out can be in both.
+	var files []common.CheckpointFile
+	seen := make(map[int]bool)
+	add := func(seg *segment, active bool) error {
+		if seen[seg.id] {
+			return nil
+		}
+		seen[seg.id] = true
+		if !seg.acquire() {
+			return fmt.Errorf("failed to acquire segment %d", seg.id)
+		}
+		held = append(held, seg)
+		file := seg.file.Load()
+		if file == nil {
+			return fmt.Errorf("segment %d closed", seg.id)
+		}
+
+		size := seg.Size()
+		files = append(files, common.CheckpointFile{
+			Name:      filepath.Base(seg.path),
+			Size:      size,
+			Immutable: !active,
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(file, 0, size)), nil
+			},
+		})
+		return nil
+	}
+
+	h.segmentsMu.Lock()
+	var err error
+	for _, seg := range *h.segments.Load() {
+		if err = add(seg, false); err != nil {
+			break
+		}
+	}
+	for _, seg := range h.activeSegments() {
+		if err != nil {
+			break
+		}
+		err = add(seg, true)
+	}
+	h.segmentsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fn(files)
+}
@@ -3,7 +3,7 @@ package hashindex
 import (
 	"fmt"
 	"io"
-	"os"
+	"strings"
 	"time"
 )
 
@@ -11,28 +11,52 @@ import (
 // Returns: new segment, new index entries, error
 func (h *HashIndex) compactSegments(segments []*segment) (*segment, map[string]*indexEntry, error) {
 
-	latestValues := make(map[string][]byte)
+	// Records keep the time they were written. With an UndeleteWindow, the
+	// record of a key before its latest is kept too, for a tombstone
+	// within the window to keep the value it deleted.
+	type record struct {
+		value     []byte
+		timestamp int64
+	}
+	latestValues := make(map[string]record)
+	var priorValues map[string]record
+	if h.config.UndeleteWindow > 0 {
+		priorValues = make(map[string]record)
+	}
 
 	for _, seg := range segments {
 		offset := int64(0)
 		segSize := seg.Size()
 
+		reader := h.newScanReader(seg)
 		for offset < segSize {
-			key, value, nextOffset, err := seg.readRecord(offset)
+			key, value, nextOffset, err := reader.readRecord(offset)
 			if err != nil {
+				reader.close()
 				if err == io.EOF {
 					break
 				}
 				return nil, nil, fmt.Errorf("error reading segment %d: %w", seg.id, err)
 			}
 
-			latestValues[string(key)] = value
+			// Skip the marker a preallocated segment starts with
+			if len(key) > 0 {
+				if prior, ok := latestValues[string(key)]; ok && priorValues != nil {
+					priorValues[string(key)] = prior
+				}
+				latestValues[string(key)] = record{value, reader.timestamp}
+			}
 			offset = nextOffset
 		}
+		reader.close()
 	}
 
-	// Create new compacted segment
-	newSeg, err := h.createSegment()
+	// Create new compacted segment under a temporary name. Recovery
+	// replays segments in id order, so the output takes the id just after
+	// its newest input: later than the records it replaces, earlier than
+	// any segment created since (ids are creation times in nanoseconds,
+	// and pickSegments makes sure no segment has that id).
+	newSeg, err := h.createSegmentFile(segments[len(segments)-1].id+1, tmpSuffix)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -40,38 +64,60 @@ func (h *HashIndex) compactSegments(segments []*segment) (*segment, map[string]*
 	// Write all latest values to new segment
 	newIndex := make(map[string]*indexEntry)
 	compactionBytesWritten := int64(0)
-
-	for key, value := range latestValues {
-		// Skip tombstones (deleted keys have nil or empty value)
-		if value == nil || len(value) == 0 {
-			continue
+	retainAfter := time.Now().Add(-h.config.UndeleteWindow).Unix()
+
+	for key, latest := range latestValues {
+		// Skip tombstones (deleted keys have nil or empty value), but for
+		// those within the undelete window of a value, kept after it
+		var records []record
+		if len(latest.value) > 0 {
+			records = []record{latest}
+		} else if prior := priorValues[key]; len(prior.value) > 0 && latest.timestamp >= retainAfter {
+			records = []record{prior, latest}
 		}
 
-		offset, size, err := newSeg.append([]byte(key), value)
-		if err != nil {
-			newSeg.close()
-			os.Remove(newSeg.path)
-			return nil, nil, err
-		}
+		for _, rec := range records {
+			offset, size, err := newSeg.appendAt([]byte(key), rec.value, rec.timestamp)
+			if err != nil {
+				newSeg.close()
+				h.config.FS.Remove(newSeg.path)
+				return nil, nil, err
+			}
 
-		newIndex[key] = &indexEntry{
-			segmentID: newSeg.id,
-			offset:    offset,
-			size:      size,
-			timestamp: time.Now().Unix(),
-		}
+			newIndex[key] = &indexEntry{
+				segmentID: newSeg.id,
+				offset:    offset,
+				size:      size,
+				timestamp: time.Now().Unix(),
+				deleted:   len(rec.value) == 0,
+			}
 
-		compactionBytesWritten += int64(size)
+			// Both are dead: tombstones always are, and the value one
+			// keeps is only read by Undelete
+			if len(records) > 1 {
+				newSeg.dead.Add(int64(size))
+			}
+			compactionBytesWritten += int64(size)
+		}
 	}
 
 	h.stats.bytesWrittenToDisk.Add(compactionBytesWritten)
 
 	if err := newSeg.sync(); err != nil {
 		newSeg.close()
-		os.Remove(newSeg.path)
+		h.config.FS.Remove(newSeg.path)
 		return nil, nil, err
 	}
 
+	// Complete and on disk, so recovery may now load it
+	path := strings.TrimSuffix(newSeg.path, tmpSuffix)
+	if err := h.config.FS.Rename(newSeg.path, path); err != nil {
+		newSeg.close()
+		h.config.FS.Remove(newSeg.path)
+		return nil, nil, fmt.Errorf("failed to install compacted segment: %w", err)
+	}
+	newSeg.path = path
+
 	return newSeg, newIndex, nil
 }
 
@@ -86,9 +132,7 @@ func (h *HashIndex) applyCompaction(oldSegments []*segment, newSegment *segment,
 	updates := make(map[string]*indexEntry)
 	deletions := make([]string, 0)
 
-	for shardIdx := 0; shardIdx < 256; shardIdx++ {
-		shard := h.index.shards[shardIdx]
-
+	h.index.forEachShard(func(shard *shard) {
 		shard.mu.RLock()
 		for key, entry := range shard.entries {
 			if compactedIDs[entry.segmentID] {
@@ -100,28 +144,43 @@ func (h *HashIndex) applyCompaction(oldSegments []*segment, newSegment *segment,
 			}
 		}
 		shard.mu.RUnlock()
-	}
+	})
 
-	h.index.UpdateBatch(updates, deletions)
+	// The output is listed before the index points at it, and its inputs
+	// until it no longer does, so that a Get always finds the segment of
+	// the entry it read (copy-on-write)
+	h.segmentsMu.Lock()
+	withOutput := append([]*segment{newSegment}, *h.segments.Load()...)
+	h.segments.Store(&withOutput)
+	h.segmentsMu.Unlock()
+
+	// Records of keys written again in newer segments, before or while the
+	// compaction ran, are dead on arrival
+	dead := h.index.UpdateBatch(updates, deletions, compactedIDs)
+	for key, entry := range newIndex {
+		if _, ok := updates[key]; !ok && !entry.deleted {
+			dead += int64(entry.size)
+		}
+	}
+	newSegment.dead.Add(dead)
 
-	// Update segment list (copy-on-write)
 	h.segmentsMu.Lock()
 	oldSegmentList := h.segments.Load()
 
-	newSegmentList := make([]*segment, 0, len(*oldSegmentList)+1)
+	// The output takes the place of its inputs, ahead of newer segments
+	newSegmentList := make([]*segment, 0, len(*oldSegmentList))
 	for _, seg := range *oldSegmentList {
 		if !compactedIDs[seg.id] {
 			newSegmentList = append(newSegmentList, seg)
 		}
 	}
 
-	newSegmentList = append(newSegmentList, newSegment)
 	h.segments.Store(&newSegmentList)
 	h.segmentsMu.Unlock()
 
 	for _, seg := range oldSegments {
 
-		os.Remove(seg.path)
+		h.retireSegment(seg)
 
 		seg.close()
 	}
@@ -130,3 +189,20 @@ func (h *HashIndex) applyCompaction(oldSegments []*segment, newSegment *segment,
 
 	return nil
 }
+
+// retireSegment deletes a compacted segment. With paced deletion it is
+// renamed out of the way and queued, so that if the process dies first
+// the next open deletes it rather than recovering its stale records.
+func (h *HashIndex) retireSegment(seg *segment) {
+	if h.config.DeleteBytesPerSecond <= 0 {
+		h.config.FS.Remove(seg.path)
+		return
+	}
+
+	obsolete := seg.path + obsoleteSuffix
+	if err := h.config.FS.Rename(seg.path, obsolete); err != nil {
+		h.config.FS.Remove(seg.path)
+		return
+	}
+	h.deleter.Delete(obsolete)
+}
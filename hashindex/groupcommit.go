@@ -0,0 +1,148 @@
+package hashindex
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultGroupCommitInterval bounds how long a writer waits for its batch
+// when only SyncEveryNBytes is configured
+const defaultGroupCommitInterval = time.Millisecond
+
+// commitBatch is a set of appended records that share a single fsync
+type commitBatch struct {
+	segments map[*segment]struct{}
+	bytes    int64
+	done     chan struct{}
+	err      error
+}
+
+// groupCommitter batches fsyncs for concurrent writers when SyncOnWrite is
+// combined with SyncEveryNBytes or SyncEveryInterval. Every writer blocks
+// until an fsync covering its record completes, so a successful Put is
+// still durable, but one fsync is shared by all records in the batch.
+type groupCommitter struct {
+	maxBytes int64
+	interval time.Duration
+
+	mu      sync.Mutex
+	current *commitBatch
+	stopped bool
+
+	kick chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	syncCount atomic.Int64 // fsync batches completed
+}
+
+func newGroupCommitter(maxBytes int64, interval time.Duration) *groupCommitter {
+	if interval <= 0 {
+		interval = defaultGroupCommitInterval
+	}
+
+	g := &groupCommitter{
+		maxBytes: maxBytes,
+		interval: interval,
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+
+	g.wg.Add(1)
+	go g.flusher()
+
+	return g
+}
+
+// commit registers a record of n bytes appended to seg and blocks until
+// it has been synced
+func (g *groupCommitter) commit(seg *segment, n int64) error {
+	g.mu.Lock()
+	if g.stopped {
+		// Flusher is gone (engine closing), fall back to a direct sync
+		g.mu.Unlock()
+		return seg.sync()
+	}
+
+	b := g.current
+	if b == nil {
+		b = &commitBatch{
+			segments: make(map[*segment]struct{}),
+			done:     make(chan struct{}),
+		}
+		g.current = b
+	}
+	b.segments[seg] = struct{}{}
+	b.bytes += n
+	full := g.maxBytes > 0 && b.bytes >= g.maxBytes
+	g.mu.Unlock()
+
+	if full {
+		select {
+		case g.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	<-b.done
+	return b.err
+}
+
+// flusher syncs the pending batch whenever it fills up or the interval
+// elapses
+func (g *groupCommitter) flusher() {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.stop:
+			g.mu.Lock()
+			g.stopped = true
+			g.mu.Unlock()
+			g.flush()
+			return
+		case <-g.kick:
+			g.flush()
+		case <-ticker.C:
+			g.flush()
+		}
+	}
+}
+
+// flush takes the current batch, syncs every segment it touched and wakes
+// its writers
+func (g *groupCommitter) flush() {
+	g.mu.Lock()
+	b := g.current
+	g.current = nil
+	g.mu.Unlock()
+
+	if b == nil {
+		return
+	}
+
+	for seg := range b.segments {
+		// A segment that can't be acquired was compacted away, which
+		// means its live records were rewritten and synced elsewhere
+		if !seg.acquire() {
+			continue
+		}
+		if err := seg.sync(); err != nil && b.err == nil {
+			b.err = err
+		}
+		seg.release()
+	}
+
+	g.syncCount.Add(1)
+	close(b.done)
+}
+
+// close flushes any pending batch and stops the flusher
+func (g *groupCommitter) close() {
+	close(g.stop)
+	g.wg.Wait()
+}
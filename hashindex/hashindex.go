@@ -1,9 +1,16 @@
 package hashindex
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,11 +18,151 @@ import (
 	"github.com/intellect4all/storage-engines/common"
 )
 
+// lockFileName is locked while an index has the data directory open
+const lockFileName = "LOCK"
+
+// obsoleteSuffix is added to a compacted segment's name while it waits to
+// be deleted, so recovery never mistakes it for live data
+const obsoleteSuffix = ".obsolete"
+
+// tmpSuffix is added to a compaction's output segment until it has been
+// written in full, so a crash mid-compaction leaves nothing recovery loads
+const tmpSuffix = ".tmp"
+
+// keyLockStripes is how many locks writes of keys are spread over
+const keyLockStripes = 256
+
 type Config struct {
 	DataDir          string
 	SegmentSizeBytes int64 // Rotate to new segment when this size reached
 	MaxSegments      int   // Trigger compaction when this many segments exist
 	SyncOnWrite      bool  // fsync after every write (slow but durable)
+
+	// WriteStripes is how many active segments writers append to (0 =
+	// 1). A key's hash picks its stripe, so its records stay in order in
+	// one stripe's segments, while writers of different stripes append
+	// and sync in parallel. Each stripe rotates at SegmentSizeBytes.
+	WriteStripes int
+
+	// IndexShards is how many shards, each with its own lock, the
+	// in-memory index of keys starts with, rounded up to a power of 2 (0 =
+	// 256). Once they hold IndexShardMaxEntries keys on average, the index
+	// doubles its shard count in the background while reads and writes go
+	// on, up to 65536 shards (0 = never).
+	IndexShards          int
+	IndexShardMaxEntries int64
+
+	// Group commit: with SyncOnWrite set, concurrent writers share one
+	// fsync per batch instead of issuing one each. A batch is synced once
+	// it holds SyncEveryNBytes of records or SyncEveryInterval has passed,
+	// whichever comes first. Each Put still returns only after its record
+	// is synced. Zero for both keeps the fsync-per-write behaviour.
+	SyncEveryNBytes   int64
+	SyncEveryInterval time.Duration
+
+	// PreallocateSegments creates each new segment at SegmentSizeBytes,
+	// allocating its blocks up front (fallocate where the OS has it), and
+	// syncs it with fdatasync. Appends then don't change the file's size
+	// or allocate blocks, so a sync has no metadata to flush: the cheaper
+	// durable write path for SyncOnWrite. A segment is trimmed to its
+	// records once sealed. Each one starts with a marker record telling
+	// recovery that zeros after its records are unwritten space, not
+	// damage.
+	PreallocateSegments bool
+
+	// Workers, if set, bounds background compaction together with the
+	// background work of the other engines sharing it, so it leaves cores
+	// to the application (see common.NewWorkerLimiter). An index runs one
+	// compaction at a time, which waits its turn for the limiter.
+	Workers *common.WorkerLimiter
+
+	// SegmentReadAhead is how many bytes compaction, recovery and the
+	// scrubber read from a segment at once as they go through its records,
+	// instead of two reads per record (0 = record by record).
+	// MmapSegmentScans has them read a mapping of the segment instead,
+	// where it can be mapped: segments of the OS filesystem, not encrypted,
+	// on Unix. Others are read ahead.
+	SegmentReadAhead int
+	MmapSegmentScans bool
+
+	// IndexSnapshotInterval, if set, has the in-memory index written to
+	// disk this often if it changed, and on Close. An open then loads the
+	// latest snapshot and only scans the records written after it, rather
+	// than every segment in full. Writes go on while a snapshot is taken.
+	// SnapshotIndex writes one on demand.
+	IndexSnapshotInterval time.Duration
+
+	// UndeleteWindow, if set, keeps the value a Delete removes restorable
+	// with Undelete for this long: compaction keeps a tombstone written
+	// within the window, and the record of the key before it, and drops
+	// both once past it. Until then they count as dead space.
+	UndeleteWindow time.Duration
+
+	// OnRecoveryProgress, if set, is called as segments are scanned on open
+	OnRecoveryProgress common.ProgressFunc
+
+	// Memory, if set, accounts the in-memory index against a (possibly
+	// shared) budget. Puts of new keys fail with common.ErrMemoryBudget
+	// once it is exhausted, since index entries can't be evicted.
+	Memory *common.MemoryAccountant
+
+	// FS is the filesystem segments are stored in (nil = the OS). A
+	// common.MemFS runs the index without touching disk; a
+	// common.FaultFS injects IO errors for testing.
+	FS common.FS
+
+	// InMemory keeps the segments in a private in-memory FS instead of
+	// files; the data is gone after Close. Can't be combined with FS.
+	InMemory bool
+
+	// DiskReserveBytes is the free disk space Health expects to remain
+	// (0 = none)
+	DiskReserveBytes int64
+
+	// DiskLowWatermarkBytes guards against running out of disk: with less
+	// free space than this, no new segment is started, compaction is
+	// skipped and writes fail with common.ErrDiskFull until space is
+	// freed (0 = off)
+	DiskLowWatermarkBytes int64
+
+	// DeleteBytesPerSecond paces the deletion of segments replaced by
+	// compaction, which then happens in a background goroutine, so a big
+	// compaction doesn't free all its input at once (0 = delete right
+	// away). Files still queued at Close are deleted then, and after a
+	// crash on the next open.
+	DeleteBytesPerSecond int64
+
+	// EncryptionKey encrypts every file the index writes with AES-GCM, using
+	// this AES key (16, 24 or 32 bytes). KeyProvider does the same with
+	// keys that can change over time. Files can then only be read with the
+	// key they were written with; opening unencrypted data with a key set
+	// fails with common.ErrNotEncrypted. See common.EncryptedFS.
+	EncryptionKey []byte
+	KeyProvider   common.KeyProvider
+
+	// VerifyChecksumsOnRead says how often Get checks the CRC of the
+	// record it reads (default: every time). Recovery and compaction
+	// always check.
+	VerifyChecksumsOnRead common.ChecksumVerification
+
+	// ScrubInterval, if set, starts a background pass over every segment
+	// this often, checking record CRCs so damage is found before a read
+	// runs into it. ScrubBytesPerSecond limits how fast it reads (0 =
+	// unlimited). A damaged segment is quarantined as when a read finds
+	// it.
+	ScrubInterval       time.Duration
+	ScrubBytesPerSecond int64
+
+	// OnCorruption, if set, is called with each instance of corruption
+	// found by reads, recovery, compaction or the scrubber, on the
+	// goroutine that found it, e.g. to restore the data from a replica. It
+	// should hand slow work off.
+	OnCorruption func(err error)
+
+	// OnWorkerPanic, if set, is called with each panic recovered from the
+	// compaction worker, which is then restarted with a backoff. Health
+	// reports them too.
+	OnWorkerPanic func(p *common.WorkerPanic)
 }
 
 func DefaultConfig(dataDir string) Config {
@@ -24,25 +171,61 @@ func DefaultConfig(dataDir string) Config {
 		SegmentSizeBytes: 4 * 1024 * 1024,
 		MaxSegments:      4,
 		SyncOnWrite:      false,
+		SegmentReadAhead: 1 << 20, // 1MB
+
+		IndexShardMaxEntries: 1 << 16,
 	}
 }
 
+// stripe is an active segment, and the lock held to rotate it
+type stripe struct {
+	active atomic.Pointer[segment]
+	mu     sync.Mutex
+}
+
 // HashIndex is a high-concurrency hash index with lock-free techniques
 type HashIndex struct {
 	config Config
 
-	index *shardedIndex
+	index  *shardedIndex
+	memory *common.MemoryAccountant
+
+	// Every write of a key holds the key's lock, picked by hash, so that
+	// update's read and write of a key have no other write in between
+	keyLocks [keyLockStripes]sync.Mutex
 
-	activeSegment atomic.Pointer[segment]
-	segmentMu     sync.Mutex
+	stripes       []*stripe    // Active segments, one per WriteStripes
+	lastSegmentID atomic.Int64 // Of the newest segment created
 
-	segments   atomic.Pointer[[]*segment]
+	segments   atomic.Pointer[[]*segment] // Sealed, oldest id first
 	segmentsMu sync.Mutex
 
 	compactChan chan struct{}
+	compactMu   sync.Mutex // Held by the compaction running, if any
 	compactWg   sync.WaitGroup
 	stopChan    chan struct{}
 
+	snapshotMu    sync.Mutex   // Held while an index snapshot is written
+	snapshotSeq   int64        // Of the latest snapshot on disk
+	snapshotTaken atomic.Int64 // snapshotWrites at the latest snapshot (-1 = none since open)
+	snapshotWg    sync.WaitGroup
+
+	committer *groupCommitter // nil unless group commit is configured
+
+	lock       io.Closer // On the data directory
+	corruption common.CorruptionLog
+	walErr     common.LastError // Of the latest append to or sync of the active segment
+	disk       *common.DiskGuard
+	deleter    *common.DeleteScheduler
+	scrubber   *common.Scrubber // nil unless ScrubInterval is set
+	background *common.WorkerLimiter
+
+	supervisor *common.Supervisor // Restarts background workers that panic
+	workers    struct {
+		compaction atomic.Bool // Running, for Health
+		snapshot   atomic.Bool
+	}
+
 	stats struct {
 		writeCount         atomic.Int64
 		readCount          atomic.Int64
@@ -50,41 +233,108 @@ type HashIndex struct {
 		bytesWritten       atomic.Int64
 		bytesWrittenToDisk atomic.Int64
 		bytesRead          atomic.Int64
+		readAmp            common.ReadAmpHistogram // segments touched per Get
+		readRepairs        atomic.Int64
 	}
 
-	closed  atomic.Bool
-	closeMu sync.Mutex
+	gate common.OpGate // Operations in flight, drained by Close
 }
 
 func New(config Config) (*HashIndex, error) {
-	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+	return NewWithContext(context.Background(), config)
+}
+
+// NewWithContext opens the index like New, aborting recovery with the
+// context's error if ctx is cancelled before the segment scan finishes
+func NewWithContext(ctx context.Context, config Config) (*HashIndex, error) {
+	fs, err := common.ConfigFS(config.FS, config.InMemory)
+	if err != nil {
+		return nil, err
+	}
+	if fs, err = common.Encrypt(fs, config.EncryptionKey, config.KeyProvider); err != nil {
+		return nil, err
+	}
+	config.FS = fs
+	if err := config.FS.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Only one index may use the directory at a time
+	lock, err := config.FS.Lock(filepath.Join(config.DataDir, lockFileName))
+	if err != nil {
 		return nil, err
 	}
 
 	h := &HashIndex{
 		config:      config,
-		index:       newShardedIndex(),
+		index:       newShardedIndex(config.IndexShards, config.IndexShardMaxEntries),
+		memory:      config.Memory,
+		background:  config.Workers,
 		compactChan: make(chan struct{}, 1),
 		stopChan:    make(chan struct{}),
+		lock:        lock,
+		disk:        common.NewDiskGuard(config.FS, config.DataDir, config.DiskLowWatermarkBytes),
+		deleter:     common.NewDeleteScheduler(config.FS, config.DeleteBytesPerSecond),
+	}
+	if h.memory == nil {
+		h.memory = common.NewMemoryAccountant(0)
+	}
+	h.index.memory = h.memory
+	h.corruption.OnCorruption = config.OnCorruption
+	h.supervisor = common.NewSupervisor(h.stopChan)
+	h.supervisor.OnPanic = config.OnWorkerPanic
+	h.stripes = make([]*stripe, max(config.WriteStripes, 1))
+	for i := range h.stripes {
+		h.stripes[i] = &stripe{}
 	}
 
 	emptySegments := make([]*segment, 0)
 	h.segments.Store(&emptySegments)
 
-	if err := h.recover(); err != nil {
+	if err := h.recover(ctx); err != nil {
+		h.deleter.Close()
+		lock.Close()
 		return nil, fmt.Errorf("recovery failed: %w", err)
 	}
 
-	if h.activeSegment.Load() == nil {
+	for _, st := range h.stripes {
+		if st.active.Load() != nil {
+			continue
+		}
 		seg, err := h.createSegment()
 		if err != nil {
+			for _, seg := range h.activeSegments() {
+				seg.close()
+			}
+			for _, seg := range *h.segments.Load() {
+				seg.close()
+			}
+			h.deleter.Close()
+			lock.Close()
 			return nil, err
 		}
-		h.activeSegment.Store(seg)
+		st.active.Store(seg)
+	}
+
+	if config.SyncOnWrite && (config.SyncEveryNBytes > 0 || config.SyncEveryInterval > 0) {
+		h.committer = newGroupCommitter(config.SyncEveryNBytes, config.SyncEveryInterval)
 	}
 
 	h.compactWg.Add(1)
-	go h.compactionWorker()
+	h.workers.compaction.Store(true)
+	go func() {
+		defer h.compactWg.Done()
+		h.supervisor.Run("compaction", &h.workers.compaction, h.compactionWorker)
+	}()
+	if config.IndexSnapshotInterval > 0 {
+		h.snapshotWg.Add(1)
+		h.workers.snapshot.Store(true)
+		go func() {
+			defer h.snapshotWg.Done()
+			h.supervisor.Run("index-snapshot", &h.workers.snapshot, h.snapshotWorker)
+		}()
+	}
+	h.scrubber = common.NewScrubber(config.ScrubInterval, config.ScrubBytesPerSecond, h.scrub)
 
 	return h, nil
 }
@@ -94,92 +344,214 @@ func (h *HashIndex) Put(key, value []byte) error {
 		return common.ErrKeyEmpty
 	}
 
-	if h.closed.Load() {
-		return common.ErrClosed
+	if err := h.gate.Enter(); err != nil {
+		return err
 	}
+	defer h.gate.Exit()
+
+	mu := h.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
 
-	activeSeg := h.activeSegment.Load()
+	return h.put(key, value)
+}
+
+// put is Put for a caller holding key's lock
+func (h *HashIndex) put(key, value []byte) error {
+	// Read-only since a rotation or compaction found the disk nearly full
+	if h.disk.ReadOnly() {
+		if err := h.disk.Check(); err != nil {
+			return err
+		}
+	}
+
+	// New keys grow the index, which has nothing it can evict
+	if len(value) > 0 && !h.memory.Fits(indexEntryMemory(string(key))) {
+		if _, exists := h.index.Get(string(key)); !exists {
+			return common.ErrMemoryBudget
+		}
+	}
+
+	st := h.stripeFor(key)
+	activeSeg := st.active.Load()
 	if activeSeg != nil && activeSeg.Size() < h.config.SegmentSizeBytes {
 		offset, recordSize, err := activeSeg.append(key, value)
 		if err == nil {
-			h.index.Put(string(key), &indexEntry{
-				segmentID: activeSeg.id,
-				offset:    offset,
-				size:      recordSize,
-				timestamp: time.Now().Unix(),
-			})
+			h.indexRecord(activeSeg, string(key), offset, recordSize, len(value) == 0)
 
 			h.stats.writeCount.Add(1)
 			h.stats.bytesWritten.Add(int64(len(key) + len(value)))
 			h.stats.bytesWrittenToDisk.Add(int64(recordSize)) // Track actual disk write
 
-			if h.config.SyncOnWrite {
-				activeSeg.sync()
-			}
+			return h.syncAfterWrite(activeSeg, recordSize)
+		}
 
-			return nil
+	}
+
+	return h.putWithRotation(st, key, value)
+}
+
+// keyLock returns the lock writes of key hold
+func (h *HashIndex) keyLock(key []byte) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write(key)
+	return &h.keyLocks[hash.Sum32()%keyLockStripes]
+}
+
+// Incr adds delta to the counter at key and returns its new value (see
+// common.Incrementer). It holds the key's lock from the read to the
+// write, so concurrent increments never lose one.
+func (h *HashIndex) Incr(key []byte, delta int64) (int64, error) {
+	var n int64
+	err := h.update(key, func(current []byte, found bool) ([]byte, error) {
+		value, sum, err := common.AddCounter(current, found, delta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
 		}
+		n = sum
+		return value, nil
+	})
+	return n, err
+}
+
+// Append adds suffix to the end of key's value, a missing key taking
+// suffix as its value (see common.Appender). Records are never rewritten,
+// so the whole longer value is appended as a new record.
+func (h *HashIndex) Append(key, suffix []byte) error {
+	return h.update(key, func(current []byte, _ bool) ([]byte, error) {
+		return append(current, suffix...), nil
+	})
+}
+
+// PutIfAbsent writes key only if it doesn't exist, reporting whether it
+// did (see common.Inserter). Existence is answered by the in-memory index
+// alone, while the key's lock keeps other writes of it out until the
+// record is appended.
+func (h *HashIndex) PutIfAbsent(key, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, common.ErrKeyEmpty
+	}
+
+	if err := h.gate.Enter(); err != nil {
+		return false, err
+	}
+	defer h.gate.Exit()
+
+	mu := h.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if entry, exists := h.index.Get(string(key)); exists && !entry.deleted {
+		return false, nil
+	}
+	if err := h.put(key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
+// update writes to key the value fn returns for the key's current value,
+// a copy, and existence, or nothing if fn fails. It holds the key's lock
+// from the read to the write, so no other write lands in between.
+func (h *HashIndex) update(key []byte, fn func(value []byte, found bool) ([]byte, error)) error {
+	if len(key) == 0 {
+		return common.ErrKeyEmpty
 	}
 
-	return h.putWithRotation(key, value)
+	if err := h.gate.Enter(); err != nil {
+		return err
+	}
+	defer h.gate.Exit()
+
+	mu := h.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var current []byte
+	err := h.getValue(key, func(value []byte) error {
+		current = bytes.Clone(value)
+		return nil
+	})
+	found := err == nil
+	if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return err
+	}
+
+	value, err := fn(current, found)
+	if err != nil {
+		return err
+	}
+	return h.put(key, value)
 }
 
-func (h *HashIndex) putWithRotation(key, value []byte) error {
-	h.segmentMu.Lock()
-	defer h.segmentMu.Unlock()
+// stripeFor returns the stripe key is written to
+func (h *HashIndex) stripeFor(key []byte) *stripe {
+	if len(h.stripes) == 1 {
+		return h.stripes[0]
+	}
+	hash := fnv.New32a()
+	hash.Write(key)
+	return h.stripes[hash.Sum32()%uint32(len(h.stripes))]
+}
+
+// activeSegments returns the active segment of each stripe
+func (h *HashIndex) activeSegments() []*segment {
+	active := make([]*segment, 0, len(h.stripes))
+	for _, st := range h.stripes {
+		if seg := st.active.Load(); seg != nil {
+			active = append(active, seg)
+		}
+	}
+	return active
+}
+
+func (h *HashIndex) putWithRotation(st *stripe, key, value []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 
 	// Check again after acquiring lock (another goroutine may have rotated)
-	activeSeg := h.activeSegment.Load()
+	activeSeg := st.active.Load()
 	if activeSeg != nil && activeSeg.Size() < h.config.SegmentSizeBytes {
 		offset, recordSize, err := activeSeg.append(key, value)
 		if err != nil {
+			h.walErr.Set(err)
 			return err
 		}
 
-		h.index.Put(string(key), &indexEntry{
-			segmentID: activeSeg.id,
-			offset:    offset,
-			size:      recordSize,
-			timestamp: time.Now().Unix(),
-		})
+		h.indexRecord(activeSeg, string(key), offset, recordSize, len(value) == 0)
 
 		h.stats.writeCount.Add(1)
 		h.stats.bytesWritten.Add(int64(len(key) + len(value)))
 		h.stats.bytesWrittenToDisk.Add(int64(recordSize)) // Track actual disk write
 
-		if h.config.SyncOnWrite {
-			activeSeg.sync()
-		}
-
-		return nil
+		return h.syncAfterWrite(activeSeg, recordSize)
 	}
 
-	// Need to rotate
-	if err := h.rotateSegment(); err != nil {
+	// Need to rotate, unless the disk is too full for another segment
+	if err := h.disk.Check(); err != nil {
+		return err
+	}
+	if err := h.rotateSegment(st); err != nil {
+		h.walErr.Set(err)
 		return err
 	}
 
 	// Now write to new active segment
-	activeSeg = h.activeSegment.Load()
+	activeSeg = st.active.Load()
 	offset, recordSize, err := activeSeg.append(key, value)
 	if err != nil {
+		h.walErr.Set(err)
 		return err
 	}
 
-	h.index.Put(string(key), &indexEntry{
-		segmentID: activeSeg.id,
-		offset:    offset,
-		size:      recordSize,
-		timestamp: time.Now().Unix(),
-	})
+	h.indexRecord(activeSeg, string(key), offset, recordSize, len(value) == 0)
 
 	h.stats.writeCount.Add(1)
 	h.stats.bytesWritten.Add(int64(len(key) + len(value)))
 	h.stats.bytesWrittenToDisk.Add(int64(recordSize)) // Track actual disk write
 
-	if h.config.SyncOnWrite {
-		activeSeg.sync()
+	if err := h.syncAfterWrite(activeSeg, recordSize); err != nil {
+		return err
 	}
 
 	segments := h.segments.Load()
@@ -190,16 +562,14 @@ func (h *HashIndex) putWithRotation(key, value []byte) error {
 	} else if len(*segments) >= 2 {
 		// Also trigger if space amplification is getting high
 		// This prevents accumulation of duplicate data
-		logicalSize := h.getLogicalSize()
-		diskSize := int64(0)
-		for _, seg := range *segments {
+		diskSize, deadBytes := int64(0), int64(0)
+		for _, seg := range append(h.activeSegments(), *segments...) {
 			diskSize += seg.Size()
+			deadBytes += seg.dead.Load()
 		}
-		activeSegSize := h.activeSegment.Load().Size()
-		diskSize += activeSegSize
 
 		// Trigger compaction if space amp > 3.0x (tunable threshold)
-		if logicalSize > 0 && float64(diskSize)/float64(logicalSize) > 3.0 {
+		if liveBytes := diskSize - deadBytes; liveBytes > 0 && float64(diskSize)/float64(liveBytes) > 3.0 {
 			shouldCompact = true
 		}
 	}
@@ -214,70 +584,191 @@ func (h *HashIndex) putWithRotation(key, value []byte) error {
 	return nil
 }
 
+// indexRecord points key at a record just appended to seg. The record it
+// supersedes becomes dead, and so does a tombstone itself: compaction
+// drops both.
+func (h *HashIndex) indexRecord(seg *segment, key string, offset int64, size int32, deleted bool) {
+	old := h.index.Put(key, &indexEntry{
+		segmentID: seg.id,
+		offset:    offset,
+		size:      size,
+		timestamp: time.Now().Unix(),
+		deleted:   deleted,
+	})
+	if old != nil {
+		if oldSeg := h.findSegment(old.segmentID); oldSeg != nil {
+			oldSeg.dead.Add(int64(old.size))
+		}
+	}
+	if deleted {
+		seg.dead.Add(int64(size))
+	}
+}
+
+// findSegment returns the active or sealed segment with the given id, nil
+// if it was compacted away
+func (h *HashIndex) findSegment(id int) *segment {
+	for _, st := range h.stripes {
+		if active := st.active.Load(); active != nil && active.id == id {
+			return active
+		}
+	}
+	for _, seg := range *h.segments.Load() {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// syncAfterWrite makes a record appended to seg durable when SyncOnWrite
+// is set, either directly or by joining the current group commit batch
+func (h *HashIndex) syncAfterWrite(seg *segment, recordSize int32) error {
+	var err error
+	switch {
+	case !h.config.SyncOnWrite:
+	case h.committer != nil:
+		err = h.committer.commit(seg, int64(recordSize))
+	default:
+		err = seg.sync()
+	}
+	h.walErr.Set(err)
+	return err
+}
+
 func (h *HashIndex) Get(key []byte) ([]byte, error) {
-	if h.closed.Load() {
-		return nil, common.ErrClosed
+	var value []byte
+	err := h.GetValue(key, func(v []byte) error {
+		value = bytes.Clone(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return value, nil
+}
 
-	entry, exists := h.index.Get(string(key))
-	if !exists {
-		return nil, common.ErrKeyNotFound
+// GetValue implements common.ValueGetter: it calls fn with the value read
+// into a pooled buffer, holding the segment open until fn returns
+func (h *HashIndex) GetValue(key []byte, fn func(value []byte) error) error {
+	if err := h.gate.Enter(); err != nil {
+		return err
 	}
+	defer h.gate.Exit()
+
+	return h.getValue(key, fn)
+}
 
-	activeSeg := h.activeSegment.Load()
-	var seg *segment
+// getValue is GetValue for a caller in the gate
+func (h *HashIndex) getValue(key []byte, fn func(value []byte) error) error {
+	entry, exists := h.index.Get(string(key))
+	for lookups := 1; ; lookups++ {
+		if !exists || entry.deleted {
+			// Answered from the in-memory index alone
+			h.stats.readAmp.Record(0)
+			return common.ErrKeyNotFound
+		}
 
-	if entry.segmentID == activeSeg.id {
-		seg = activeSeg
-	} else {
-		segments := h.segments.Load()
-		for _, s := range *segments {
-			if s.id == entry.segmentID {
-				seg = s
-				break
+		// The segment can be compacted away after the entry was read
+		if seg := h.findSegment(entry.segmentID); seg != nil {
+			err := h.readEntry(seg, entry, fn)
+			if !errors.Is(err, errSegmentClosed) {
+				return err
 			}
 		}
-	}
+		if lookups == maxLookups {
+			return fmt.Errorf("segment %d not found", entry.segmentID)
+		}
 
-	if seg == nil {
-		return nil, fmt.Errorf("segment %d not found", entry.segmentID)
+		var err error
+		if entry, err = h.repairEntry(string(key), entry); err != nil {
+			return err
+		}
+		exists = entry != nil
 	}
+}
 
-	value, err := seg.read(entry.offset)
+// readEntry reads the value of entry, a record in seg, for getValue
+func (h *HashIndex) readEntry(seg *segment, entry *indexEntry, fn func(value []byte) error) error {
+	h.stats.readAmp.Record(1)
+	var found bool
+	err := seg.readValue(entry.offset, h.config.VerifyChecksumsOnRead.Verify(), func(value []byte) error {
+		// Check for tombstone
+		if len(value) == 0 {
+			return nil
+		}
+		found = true
+
+		h.stats.readCount.Add(1)
+		h.stats.bytesRead.Add(int64(len(value)))
+		return fn(value)
+	})
 	if err != nil {
-		return nil, err
+		if !found {
+			h.handleCorruption(err)
+		}
+		return err
 	}
-
-	// Check for tombstone
-	if value == nil || len(value) == 0 {
-		return nil, common.ErrKeyNotFound
+	if !found {
+		return common.ErrKeyNotFound
 	}
+	return nil
+}
 
-	h.stats.readCount.Add(1)
-	h.stats.bytesRead.Add(int64(len(value)))
+// Has reports whether key exists, from the in-memory index alone
+func (h *HashIndex) Has(key []byte) (bool, error) {
+	if err := h.gate.Enter(); err != nil {
+		return false, err
+	}
+	defer h.gate.Exit()
 
-	return value, nil
+	entry, exists := h.index.Get(string(key))
+	return exists && !entry.deleted, nil
 }
 
 func (h *HashIndex) Delete(key []byte) error {
 	return h.Put(key, nil)
 }
 
+// Close closes the index. New operations fail with common.ErrClosed from
+// the moment it's called; those already in flight are waited for, and a
+// compaction in progress completes. The active segment is synced before
+// the files are closed.
 func (h *HashIndex) Close() error {
-	h.closeMu.Lock()
-	defer h.closeMu.Unlock()
-
-	if h.closed.Swap(true) {
+	if !h.gate.Close() {
 		return nil // Already closed
 	}
+	defer h.lock.Close()
 
-	// Stop background worker
+	// Stop background workers
 	close(h.stopChan)
+	h.scrubber.Close()
 	h.compactWg.Wait()
+	h.snapshotWg.Wait()
 
-	// Close active segment
-	activeSeg := h.activeSegment.Load()
-	if activeSeg != nil {
+	// Sync any pending group commit batch before segments are closed
+	if h.committer != nil {
+		h.committer.close()
+	}
+
+	// Close active segments
+	var err error
+	for _, activeSeg := range h.activeSegments() {
+		if syncErr := activeSeg.sync(); err == nil {
+			err = syncErr
+		}
+		if sealErr := activeSeg.seal(); err == nil {
+			err = sealErr
+		}
+	}
+
+	// The next open loads the index instead of scanning for it
+	if h.config.IndexSnapshotInterval > 0 && h.snapshotDue() {
+		if snapErr := h.snapshotIndex(); snapErr != nil {
+			fmt.Printf("Warning: failed to snapshot the index: %v\n", snapErr)
+		}
+	}
+	for _, activeSeg := range h.activeSegments() {
 		activeSeg.close()
 	}
 
@@ -287,38 +778,51 @@ func (h *HashIndex) Close() error {
 		seg.close()
 	}
 
-	return nil
+	// Finish deleting compacted segments
+	h.deleter.Close()
+
+	// Hand the index memory back to a shared accountant
+	h.index.wait()
+	h.memory.Release(common.MemIndex, h.index.bytes.Load())
+
+	return err
 }
 
 func (h *HashIndex) Sync() error {
-	if h.closed.Load() {
-		return common.ErrClosed
+	if err := h.gate.Enter(); err != nil {
+		return err
 	}
+	defer h.gate.Exit()
 
-	activeSeg := h.activeSegment.Load()
-	if activeSeg != nil {
-		return activeSeg.sync()
+	var err error
+	for _, activeSeg := range h.activeSegments() {
+		if syncErr := activeSeg.sync(); err == nil {
+			err = syncErr
+		}
 	}
-
-	return nil
+	h.walErr.Set(err)
+	return err
 }
 
 func (h *HashIndex) Stats() common.Stats {
 	numKeys := h.index.Count()
 
-	activeSeg := h.activeSegment.Load()
+	active := h.activeSegments()
 	activeSegSize := int64(0)
-	if activeSeg != nil {
-		activeSegSize = activeSeg.Size()
+	deadBytes := int64(0)
+	for _, seg := range active {
+		activeSegSize += seg.Size()
+		deadBytes += seg.dead.Load()
 	}
 
 	segments := h.segments.Load()
-	numSegments := len(*segments) + 1 // +1 for active
+	numSegments := len(*segments) + len(active)
 
 	// Calculate disk size
 	totalDiskSize := activeSegSize
 	for _, seg := range *segments {
 		totalDiskSize += seg.Size()
+		deadBytes += seg.dead.Load()
 	}
 
 	writeCount := h.stats.writeCount.Load()
@@ -344,6 +848,8 @@ func (h *HashIndex) Stats() common.Stats {
 
 	return common.Stats{
 		NumKeys:       numKeys,
+		NumTombstones: h.index.Deleted(),
+		DeadBytes:     deadBytes,
 		NumSegments:   numSegments,
 		ActiveSegSize: activeSegSize,
 		TotalDiskSize: totalDiskSize,
@@ -352,19 +858,62 @@ func (h *HashIndex) Stats() common.Stats {
 		CompactCount:  compactCount,
 		WriteAmp:      writeAmp,
 		SpaceAmp:      spaceAmp,
+		ReadAmp:       h.stats.readAmp.Mean(),
+		ReadAmpP99:    h.stats.readAmp.Percentile(99),
+		MemoryUsed:    h.memory.Used(),
+		MemoryBudget:  h.memory.Budget(),
+		MemoryUsage:   h.memory.Usage(),
+
+		CorruptionCount: h.corruption.Count(),
+		Quarantined:     h.corruption.Files(),
+		ScrubPasses:     h.scrubber.Passes(),
+		ScrubbedBytes:   h.scrubber.Scanned(),
+		DiskFullEvents:  h.disk.Events(),
+		ReadRepairs:     h.stats.readRepairs.Load(),
+		StaleKeyFiles:   h.staleKeyFiles(),
 	}
 }
 
+// SegmentStats describes one segment, for compaction heuristics
+type SegmentStats struct {
+	ID        int
+	Size      int64
+	DeadBytes int64 // Of records overwritten or deleted since, and tombstones
+	Active    bool
+}
+
+// SegmentStats returns every segment, oldest first, with the active ones
+// (one per stripe) last. DeadBytes is what compacting a segment would
+// reclaim.
+func (h *HashIndex) SegmentStats() []SegmentStats {
+	segments := *h.segments.Load()
+	active := h.activeSegments()
+
+	stats := make([]SegmentStats, 0, len(segments)+len(active))
+	for _, seg := range segments {
+		stats = append(stats, SegmentStats{ID: seg.id, Size: seg.Size(), DeadBytes: seg.dead.Load()})
+	}
+	for _, seg := range active {
+		stats = append(stats, SegmentStats{ID: seg.id, Size: seg.Size(), DeadBytes: seg.dead.Load(), Active: true})
+	}
+	return stats
+}
+
 // getLogicalSize calculates the total size of all unique keys (latest versions only)
 // This represents the actual data size without duplicates or tombstones
 func (h *HashIndex) getLogicalSize() int64 {
 	var totalSize atomic.Int64
 
+	// The shards can't move while they're summed
+	h.index.resizeMu.RLock()
+	defer h.index.resizeMu.RUnlock()
+	shards := h.index.table.Load().shards
+
 	var wg sync.WaitGroup
-	wg.Add(len(h.index.shards))
+	wg.Add(len(shards))
 
 	// Calculate size for each shard in parallel
-	for _, sh := range h.index.shards {
+	for _, sh := range shards {
 		go func(s *shard) {
 			defer wg.Done()
 
@@ -385,9 +934,10 @@ func (h *HashIndex) getLogicalSize() int64 {
 }
 
 func (h *HashIndex) Compact() error {
-	if h.closed.Load() {
-		return common.ErrClosed
+	if err := h.gate.Enter(); err != nil {
+		return err
 	}
+	defer h.gate.Exit()
 
 	select {
 	case h.compactChan <- struct{}{}:
@@ -397,8 +947,10 @@ func (h *HashIndex) Compact() error {
 	}
 }
 
-func (h *HashIndex) rotateSegment() error {
-	activeSeg := h.activeSegment.Load()
+// rotateSegment seals the stripe's active segment and starts a new one.
+// Caller must hold st.mu.
+func (h *HashIndex) rotateSegment(st *stripe) error {
+	activeSeg := st.active.Load()
 	if activeSeg == nil {
 		return fmt.Errorf("no active segment")
 	}
@@ -406,12 +958,20 @@ func (h *HashIndex) rotateSegment() error {
 	if err := activeSeg.sync(); err != nil {
 		return err
 	}
+	if err := activeSeg.seal(); err != nil {
+		return err
+	}
 
+	// Stripes rotate in any order, so the sealed segment goes in by id
 	h.segmentsMu.Lock()
 	oldSegments := h.segments.Load()
-	newSegments := make([]*segment, len(*oldSegments)+1)
-	copy(newSegments, *oldSegments)
-	newSegments[len(*oldSegments)] = activeSeg
+	i := sort.Search(len(*oldSegments), func(i int) bool {
+		return (*oldSegments)[i].id > activeSeg.id
+	})
+	newSegments := make([]*segment, 0, len(*oldSegments)+1)
+	newSegments = append(newSegments, (*oldSegments)[:i]...)
+	newSegments = append(newSegments, activeSeg)
+	newSegments = append(newSegments, (*oldSegments)[i:]...)
 	h.segments.Store(&newSegments)
 	h.segmentsMu.Unlock()
 
@@ -421,15 +981,60 @@ func (h *HashIndex) rotateSegment() error {
 		return err
 	}
 
-	h.activeSegment.Store(newSeg)
+	st.active.Store(newSeg)
 	return nil
 }
 
 func (h *HashIndex) createSegment() (*segment, error) {
-	segmentID := int(time.Now().UnixNano())
-	path := filepath.Join(h.config.DataDir, fmt.Sprintf("%d.seg", segmentID))
+	seg, err := h.createSegmentFile(h.nextSegmentID(), "")
+	if err != nil || !h.config.PreallocateSegments {
+		return seg, err
+	}
+
+	// The marker and the preallocated size are synced before any record,
+	// so recovery never finds zeros without the marker
+	file := seg.file.Load()
+	if err := common.Preallocate(file, h.config.SegmentSizeBytes); err != nil {
+		seg.close()
+		h.config.FS.Remove(seg.path)
+		return nil, fmt.Errorf("failed to preallocate segment: %w", err)
+	}
+	seg.preallocated = true
+	_, size, err := seg.append(nil, []byte(preallocMarker))
+	if err != nil {
+		seg.close()
+		h.config.FS.Remove(seg.path)
+		return nil, err
+	}
+	seg.dead.Add(int64(size)) // Compaction drops it
+	if err := file.Sync(); err != nil {
+		seg.close()
+		h.config.FS.Remove(seg.path)
+		return nil, err
+	}
+	return seg, nil
+}
+
+// nextSegmentID returns the id for a new segment: the current time, but
+// always after the last one, as stripes may create segments at once. It
+// leaves the id after the last one free for a compaction's output (see
+// pickSegments).
+func (h *HashIndex) nextSegmentID() int {
+	for {
+		last := h.lastSegmentID.Load()
+		id := max(time.Now().UnixNano(), last+2)
+		if h.lastSegmentID.CompareAndSwap(last, id) {
+			return int(id)
+		}
+	}
+}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+// createSegmentFile creates segment segmentID, with suffix appended to its
+// file name
+func (h *HashIndex) createSegmentFile(segmentID int, suffix string) (*segment, error) {
+	path := filepath.Join(h.config.DataDir, fmt.Sprintf("%d.seg", segmentID)+suffix)
+
+	file, err := h.config.FS.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -438,57 +1043,54 @@ func (h *HashIndex) createSegment() (*segment, error) {
 }
 
 func (h *HashIndex) compactionWorker() {
-	defer h.compactWg.Done()
-
 	for {
 		select {
 		case <-h.stopChan:
 			return
 		case <-h.compactChan:
-
-			if err := h.doCompact(); err != nil {
+			if err := h.compactInBackground(); err != nil {
 				fmt.Printf("compaction error: %v\n", err)
+				h.handleCorruption(err)
 			}
 		}
 	}
 }
 
+// compactInBackground runs a compaction holding a background worker slot
+func (h *HashIndex) compactInBackground() error {
+	h.background.Acquire()
+	defer h.background.Release()
+	return h.doCompact()
+}
+
 // doCompact performs the actual compaction using a leveled strategy
 // Instead of compacting ALL segments, we compact only a subset to reduce write amplification
 func (h *HashIndex) doCompact() error {
+	// Outputs are named after their newest input, so two compactions
+	// running at once would write the same file
+	h.compactMu.Lock()
+	defer h.compactMu.Unlock()
 
-	h.segmentsMu.Lock()
-	segments := h.segments.Load()
-	if len(*segments) < 2 {
-		h.segmentsMu.Unlock()
-		return nil // Nothing to compact
+	// Compaction needs room for its output before it frees its input
+	if err := h.disk.Check(); err != nil {
+		return err
 	}
 
-	numToCompact := len(*segments)
-
-	// If we have many segments, only compact a portion
-	// This implements a simple leveled approach
-	if numToCompact > 3 {
-		// Compact oldest half, but at least 2 segments
-		numToCompact = (numToCompact + 1) / 2
-		if numToCompact < 2 {
-			numToCompact = 2
+	// The output takes its inputs' place in recovery order, so no segment
+	// a key may have been written to since can be older than an input.
+	// With several stripes, an idle stripe's active segment can be older
+	// than sealed segments of the others: it is rotated out first.
+	if len(h.stripes) > 1 {
+		segments := *h.segments.Load()
+		if n := h.compactionSize(segments); n > 0 {
+			h.rotateStripesBefore(segments[n-1].id)
 		}
 	}
 
-	// Segments are ordered from oldest to newest (added in order)
-	// Select the oldest numToCompact segments
-	segmentsToCompact := make([]*segment, numToCompact)
-	copy(segmentsToCompact, (*segments)[:numToCompact])
-
-	// Acquire references to prevent deletion during compaction
-	for _, seg := range segmentsToCompact {
-		if !seg.acquire() {
-			h.segmentsMu.Unlock()
-			return fmt.Errorf("failed to acquire segment %d", seg.id)
-		}
+	segmentsToCompact, err := h.pickSegments()
+	if err != nil || segmentsToCompact == nil {
+		return err // Nothing to compact without an error
 	}
-	h.segmentsMu.Unlock()
 
 	// Release references when done
 	defer func() {
@@ -506,3 +1108,92 @@ func (h *HashIndex) doCompact() error {
 	// Atomically update state
 	return h.applyCompaction(segmentsToCompact, newSeg, newIndex)
 }
+
+// newScanReader returns a reader for a scan through seg's records
+func (h *HashIndex) newScanReader(seg *segment) *segmentReader {
+	return seg.newReader(h.config.SegmentReadAhead, h.config.MmapSegmentScans)
+}
+
+// pickSegments returns the oldest segments due for compaction, nil if
+// none are, with a reference acquired on each so they aren't deleted
+// while they are compacted
+func (h *HashIndex) pickSegments() ([]*segment, error) {
+	h.segmentsMu.Lock()
+	defer h.segmentsMu.Unlock()
+
+	segments := h.segments.Load()
+	numToCompact := h.compactionSize(*segments)
+	oldestActive := h.oldestActiveID()
+	for numToCompact > 0 && (*segments)[numToCompact-1].id >= oldestActive {
+		numToCompact--
+	}
+	// The output takes the id after its newest input, so that must be
+	// free. nextSegmentID leaves it so, but not after an earlier output.
+	for numToCompact > 0 && numToCompact < len(*segments) &&
+		(*segments)[numToCompact].id == (*segments)[numToCompact-1].id+1 {
+		numToCompact--
+	}
+	if numToCompact == 0 {
+		return nil, nil
+	}
+
+	// Segments are ordered from oldest to newest (by id)
+	// Select the oldest numToCompact segments
+	segmentsToCompact := make([]*segment, numToCompact)
+	copy(segmentsToCompact, (*segments)[:numToCompact])
+
+	// Acquire references to prevent deletion during compaction
+	for _, seg := range segmentsToCompact {
+		if !seg.acquire() {
+			return nil, fmt.Errorf("failed to acquire segment %d", seg.id)
+		}
+	}
+	return segmentsToCompact, nil
+}
+
+// compactionSize returns how many of the oldest segments to compact, or 0
+// if there is nothing to compact
+func (h *HashIndex) compactionSize(segments []*segment) int {
+	stale := h.staleKeyPrefix(segments)
+	if len(segments) < 2 && stale == 0 {
+		return 0
+	}
+
+	numToCompact := len(segments)
+
+	// If we have many segments, only compact a portion
+	// This implements a simple leveled approach
+	if numToCompact > 3 {
+		// Compact oldest half, but at least 2 segments
+		numToCompact = (numToCompact + 1) / 2
+		if numToCompact < 2 {
+			numToCompact = 2
+		}
+	}
+
+	// Take along every segment still encrypted with an old key
+	return max(numToCompact, stale)
+}
+
+// rotateStripesBefore rotates every stripe whose active segment is older
+// than segment id
+func (h *HashIndex) rotateStripesBefore(id int) {
+	for _, st := range h.stripes {
+		st.mu.Lock()
+		if active := st.active.Load(); active != nil && active.id < id {
+			if err := h.rotateSegment(st); err != nil {
+				fmt.Printf("Warning: failed to rotate segment %d for compaction: %v\n", active.id, err)
+			}
+		}
+		st.mu.Unlock()
+	}
+}
+
+// oldestActiveID returns the id of the oldest active segment
+func (h *HashIndex) oldestActiveID() int {
+	oldest := math.MaxInt
+	for _, seg := range h.activeSegments() {
+		oldest = min(oldest, seg.id)
+	}
+	return oldest
+}
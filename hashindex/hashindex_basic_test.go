@@ -2,7 +2,10 @@ package hashindex
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/intellect4all/storage-engines/common"
@@ -60,6 +63,96 @@ func TestBasicOperations(t *testing.T) {
 	}
 }
 
+// TestHas tests existence checks answered from the index
+func TestHas(t *testing.T) {
+	config := DefaultConfig("/hashindex-has")
+	config.InMemory = true
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if err := h.Put([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Put([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete([]byte("key2")); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"key1": true, "key2": false, "key3": false} {
+		if found, err := h.Has([]byte(key)); err != nil || found != want {
+			t.Errorf("Has(%s): expected %v, got %v err=%v", key, want, found, err)
+		}
+	}
+
+	h.Close()
+	if _, err := h.Has([]byte("key1")); err != common.ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestGetValue(t *testing.T) {
+	config := DefaultConfig("/hashindex-getvalue")
+	config.InMemory = true
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if err := h.Put([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Put([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete([]byte("key2")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	if err := h.GetValue([]byte("key1"), func(value []byte) error {
+		got = string(value)
+		return nil
+	}); err != nil || got != "value1" {
+		t.Errorf("GetValue(key1): expected value1, got %q err=%v", got, err)
+	}
+	for _, key := range []string{"key2", "key3"} {
+		called := false
+		err := h.GetValue([]byte(key), func([]byte) error {
+			called = true
+			return nil
+		})
+		if err != common.ErrKeyNotFound || called {
+			t.Errorf("GetValue(%s): expected ErrKeyNotFound without calling fn, got %v called=%v", key, err, called)
+		}
+	}
+
+	errStop := errors.New("stop")
+	if err := h.GetValue([]byte("key1"), func([]byte) error { return errStop }); err != errStop {
+		t.Errorf("Expected fn's error, got %v", err)
+	}
+
+	// Get copies the value out of the pooled buffer
+	if err := h.Put([]byte("key4"), []byte("value4")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := h.Get([]byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.GetValue([]byte("key4"), func([]byte) error { return nil })
+	if string(value) != "value1" {
+		t.Errorf("Get value changed to %q by a later read", value)
+	}
+}
+
 // TestEdgeCases tests various edge cases and error conditions
 func TestEdgeCases(t *testing.T) {
 	dir, err := os.MkdirTemp("", "hashindex-test-*")
@@ -203,3 +296,97 @@ func TestSync(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestInMemory tests that an in-memory index behaves and reports stats
+// exactly like one on disk, without creating any files
+func TestInMemory(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// No overwrites, so space amplification never triggers a compaction
+	// that would make the stats timing-dependent
+	run := func(config Config) common.Stats {
+		config.SegmentSizeBytes = 4096 // Several segments
+		config.MaxSegments = 1000
+		h, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			value := []byte(fmt.Sprintf("value%03d", i))
+			if err := h.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			if err := h.Delete([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			val, err := h.Get(key)
+			if i < 50 {
+				if err != common.ErrKeyNotFound {
+					t.Errorf("Expected %s deleted, got err=%v", key, err)
+				}
+			} else if err != nil || string(val) != fmt.Sprintf("value%03d", i) {
+				t.Errorf("Key %s: got %q, err=%v", key, val, err)
+			}
+		}
+		return h.Stats()
+	}
+
+	disk := run(DefaultConfig(dir))
+
+	memDir := filepath.Join(dir, "mem")
+	config := DefaultConfig(memDir)
+	config.InMemory = true
+	mem := run(config)
+
+	if _, err := os.Stat(memDir); !os.IsNotExist(err) {
+		t.Errorf("Expected no files for an in-memory index, got err=%v", err)
+	}
+	if mem.NumKeys != disk.NumKeys || mem.NumSegments != disk.NumSegments ||
+		mem.TotalDiskSize != disk.TotalDiskSize || mem.ReadCount != disk.ReadCount ||
+		mem.WriteAmp != disk.WriteAmp || mem.SpaceAmp != disk.SpaceAmp {
+		t.Errorf("Stats differ: in memory %+v, on disk %+v", mem, disk)
+	}
+
+	config.FS = common.NewMemFS()
+	if _, err := New(config); !errors.Is(err, common.ErrInMemoryWithFS) {
+		t.Errorf("Expected ErrInMemoryWithFS, got %v", err)
+	}
+}
+
+// TestDirectoryLock tests that a data directory can only be open once
+func TestDirectoryLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(DefaultConfig(dir)); !errors.Is(err, common.ErrLocked) {
+		t.Fatalf("Expected ErrLocked opening a directory twice, got %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen after Close: %v", err)
+	}
+	h.Close()
+}
@@ -2,10 +2,12 @@ package hashindex
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/intellect4all/storage-engines/common"
 	"github.com/intellect4all/storage-engines/common/benchmark"
 )
 
@@ -75,3 +77,40 @@ func TestQuickBenchmark(t *testing.T) {
 		t.Errorf("Expected at least 10000 ops/sec, got %.0f", result.OpsPerSec)
 	}
 }
+
+// BenchmarkSegmentScan compares reading a 64MB segment in order, as
+// compaction and recovery do, record by record, read ahead and mapped
+func BenchmarkSegmentScan(b *testing.B) {
+	path := b.TempDir() + "/1.seg"
+	seg := writeTestSegment(b, common.OSFS{}, path, 64<<10, 1000)
+	defer seg.closeFile()
+
+	for _, mode := range []struct {
+		name      string
+		readAhead int
+		mmap      bool
+	}{
+		{"record", 0, false},
+		{"readahead-64KB", 64 << 10, false},
+		{"readahead-1MB", 1 << 20, false},
+		{"mmap", 0, true},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			b.SetBytes(seg.Size())
+			for i := 0; i < b.N; i++ {
+				reader := seg.newReader(mode.readAhead, mode.mmap)
+				for offset := int64(0); ; {
+					_, _, next, err := reader.readRecord(offset)
+					if err != nil {
+						if err != io.EOF {
+							b.Fatal(err)
+						}
+						break
+					}
+					offset = next
+				}
+				reader.close()
+			}
+		})
+	}
+}
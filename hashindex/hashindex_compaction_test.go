@@ -1,8 +1,11 @@
 package hashindex
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -305,3 +308,312 @@ func TestSpaceAmplificationTrigger(t *testing.T) {
 		}
 	}
 }
+
+// TestPacedDeletion tests that compacted segments are deleted in the
+// background, and that ones a crash leaves behind are deleted on the next
+// open rather than recovered
+func TestPacedDeletion(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/hashindex-paced-delete")
+	config.FS = fs
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 2
+	config.DeleteBytesPerSecond = 1 // Only the first segment goes before Close
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obsolete := func(fs common.FS) int {
+		entries, err := fs.ReadDir(config.DataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), obsoleteSuffix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	written := 0
+	for ; written < 5000 && h.deleter.Pending() == 0; written++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%05d", written)), []byte(fmt.Sprintf("value%05d", written))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if written%20 == 19 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if h.deleter.Pending() == 0 || obsolete(fs) == 0 {
+		t.Fatal("Expected compacted segments queued for deletion")
+	}
+	if err := h.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	crashed := fs.CrashClone()
+	config.FS = crashed
+	config.DeleteBytesPerSecond = 0
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if n := obsolete(crashed); n != 0 {
+		t.Errorf("Expected leftover segments deleted on open, %d remain", n)
+	}
+	for i := 0; i < written; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		value, err := recovered.Get([]byte(key))
+		if err != nil || string(value) != fmt.Sprintf("value%05d", i) {
+			t.Fatalf("Get %s: got %q, err=%v", key, value, err)
+		}
+	}
+	recovered.Close()
+
+	h.Close()
+	if n := obsolete(fs); n != 0 || h.deleter.Pending() != 0 {
+		t.Errorf("Expected the queue drained by Close: %d segments left, %d pending", n, h.deleter.Pending())
+	}
+}
+
+// TestUnfinishedCompactionIgnored tests that a compaction's output is only
+// loaded by recovery once it was written in full and renamed into place
+func TestUnfinishedCompactionIgnored(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/hashindex-compaction-tmp")
+	config.FS = fs
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100 // Compacted below instead
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i%50)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := h.doCompact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpFiles := func() int {
+		entries, err := fs.ReadDir(config.DataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), tmpSuffix) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := tmpFiles(); n != 0 {
+		t.Fatalf("Expected no temporary segments after compaction, found %d", n)
+	}
+
+	// A compaction cut short, holding records that aren't the latest
+	id := int(time.Now().UnixNano())
+	path := filepath.Join(config.DataDir, fmt.Sprintf("%d.seg", id)+tmpSuffix)
+	file, err := fs.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := newSegment(id, path, file)
+	if _, _, err := partial.append([]byte("key000"), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	partial.close()
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer h.Close()
+
+	if n := tmpFiles(); n != 0 {
+		t.Errorf("Expected the unfinished output deleted on open, %d remain", n)
+	}
+	for i := 150; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i%50)
+		value, err := h.Get([]byte(key))
+		if err != nil || string(value) != fmt.Sprintf("value%03d", i) {
+			t.Fatalf("Get %s: got %q, err=%v", key, value, err)
+		}
+	}
+}
+
+// TestReadRepair tests that a Get of a key whose index entry points at a
+// segment that is gone repairs the entry from the segments on disk
+func TestReadRepair(t *testing.T) {
+	config := DefaultConfig("/hashindex-read-repair")
+	config.FS = common.NewMemFS()
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i%20)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := h.Put([]byte("deleted"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete([]byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	keys := h.index.Count()
+
+	// Entries left pointing at a segment older than any there is
+	stale := func(key string) {
+		h.index.Put(key, &indexEntry{segmentID: 1, size: 32, timestamp: time.Now().Unix()})
+	}
+	stale("key005")
+	stale("deleted")
+	stale("missing")
+
+	value, err := h.Get([]byte("key005"))
+	if err != nil || string(value) != "value085" {
+		t.Fatalf("Expected value085, got %q, err=%v", value, err)
+	}
+	if _, err := h.Get([]byte("deleted")); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected the deleted key not found, got %v", err)
+	}
+	if _, err := h.Get([]byte("missing")); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected the missing key not found, got %v", err)
+	}
+	if got := h.Stats().ReadRepairs; got != 3 {
+		t.Errorf("Expected 3 read repairs, got %d", got)
+	}
+
+	// Repaired, so read as any other
+	if value, err := h.Get([]byte("key005")); err != nil || string(value) != "value085" {
+		t.Fatalf("Expected value085 again, got %q, err=%v", value, err)
+	}
+	if got := h.Stats().ReadRepairs; got != 3 {
+		t.Errorf("Expected no further read repairs, got %d", got)
+	}
+	if got := h.index.Count(); got != keys {
+		t.Errorf("Expected %d keys after repair, got %d", keys, got)
+	}
+	if entry, ok := h.index.Get("missing"); ok {
+		t.Errorf("Expected the entry of a key never written dropped, got %+v", entry)
+	}
+}
+
+// TestUndelete tests that a deleted value can be restored within
+// UndeleteWindow, through compaction and recovery, and not after
+func TestUndelete(t *testing.T) {
+	config := DefaultConfig("/hashindex-undelete")
+	config.FS = common.NewMemFS()
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100 // Compacted below instead
+	config.UndeleteWindow = time.Hour
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { h.Close() }()
+
+	for i := 0; i < 20; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := h.Put([]byte("key005"), []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key005", "key006", "key007", "missing"} {
+		if err := h.Delete([]byte(key)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	expectUndelete := func(key string, want error) {
+		t.Helper()
+		if err := h.Undelete([]byte(key)); !errors.Is(err, want) {
+			t.Fatalf("Undelete %s: expected %v, got %v", key, want, err)
+		}
+	}
+	expectValue := func(key, expected string) {
+		t.Helper()
+		if value, err := h.Get([]byte(key)); err != nil || string(value) != expected {
+			t.Fatalf("Get %s: expected %s, got %q, err=%v", key, expected, value, err)
+		}
+	}
+	// Rolls the deletes into sealed segments and compacts them all
+	compactAll := func() {
+		t.Helper()
+		for i := 0; i < 20; i++ {
+			if err := h.Put([]byte(fmt.Sprintf("filler%02d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for len(*h.segments.Load()) > 1 {
+			if err := h.doCompact(); err != nil {
+				t.Fatalf("Compaction failed: %v", err)
+			}
+		}
+	}
+
+	expectUndelete("key005", nil)
+	expectValue("key005", "second")
+	expectUndelete("key005", common.ErrKeyNotFound) // Not deleted
+	expectUndelete("key001", common.ErrKeyNotFound) // Never deleted
+	expectUndelete("missing", common.ErrKeyNotFound)
+
+	// Compaction keeps the tombstones and the values before them
+	if err := h.Delete([]byte("key005")); err != nil {
+		t.Fatal(err)
+	}
+	compactAll()
+	if entry, ok := h.index.Get("key007"); !ok || !entry.deleted {
+		t.Fatalf("Expected key007's tombstone kept, got %+v", entry)
+	}
+	expectUndelete("key006", nil)
+	expectValue("key006", "value006")
+
+	// So does recovery
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	expectUndelete("key005", nil)
+	expectValue("key005", "second")
+
+	// Past the window, the value is gone and compaction drops the tombstone
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config.UndeleteWindow = time.Millisecond
+	if h, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond) // Records are timed in seconds
+	expectUndelete("key007", common.ErrKeyNotFound)
+	compactAll()
+	if entry, ok := h.index.Get("key007"); ok {
+		t.Errorf("Expected key007's tombstone dropped, got %+v", entry)
+	}
+	expectValue("key005", "second")
+	expectValue("key006", "value006")
+}
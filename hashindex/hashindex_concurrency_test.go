@@ -1,9 +1,13 @@
 package hashindex
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -150,3 +154,259 @@ func TestConcurrentReadsAndWrites(t *testing.T) {
 	stats := h.Stats()
 	t.Logf("Concurrent R/W stats: %d reads, %d writes", stats.ReadCount, stats.WriteCount)
 }
+
+// TestCloseDuringWrites tests that Close waits for in-flight writes, that
+// every write acknowledged before it survives, and that later operations
+// fail with ErrClosed
+func TestCloseDuringWrites(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.SegmentSizeBytes = 64 * 1024
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	acked := make([]int, writers) // Writes each writer got nil back for
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				err := h.Put([]byte(fmt.Sprintf("key%02d%06d", id, i)), []byte(fmt.Sprintf("value%d", i)))
+				if errors.Is(err, common.ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				acked[id]++
+			}
+		}(g)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := h.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	wg.Wait()
+
+	if _, err := h.Get([]byte("key00000000")); !errors.Is(err, common.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Get after Close, got %v", err)
+	}
+	if err := h.Sync(); !errors.Is(err, common.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Sync after Close, got %v", err)
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for g := 0; g < writers; g++ {
+		for i := 0; i < acked[g]; i++ {
+			key := fmt.Sprintf("key%02d%06d", g, i)
+			if _, err := h.Get([]byte(key)); err != nil {
+				t.Fatalf("Acknowledged write %s lost: %v", key, err)
+			}
+		}
+	}
+}
+
+// TestIncr increments a counter from several goroutines, alongside Puts
+// rotating segments, none of which may lose another's increment
+func TestIncr(t *testing.T) {
+	config := DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	config.SegmentSizeBytes = 4096
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := h.Put([]byte(fmt.Sprintf("filler-%d-%d", id, i)), []byte("value")); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				if _, err := h.Incr([]byte("counter"), 1); err != nil {
+					t.Errorf("Incr failed: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	n, err := h.Incr([]byte("counter"), -800)
+	if err != nil || n != 0 {
+		t.Fatalf("Expected the counter at 0, got %d, %v", n, err)
+	}
+	if value, err := h.Get([]byte("counter")); err != nil || string(value) != "0" {
+		t.Fatalf("Expected 0 stored, got %q, %v", value, err)
+	}
+
+	if err := h.Delete([]byte("counter")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := h.Incr([]byte("counter"), 5); err != nil || n != 5 {
+		t.Fatalf("Expected a deleted counter to restart at 5, got %d, %v", n, err)
+	}
+	if _, err := h.Incr([]byte("filler-0-0"), 1); !errors.Is(err, common.ErrNotCounter) {
+		t.Fatalf("Expected ErrNotCounter, got %v", err)
+	}
+}
+
+// TestAppend appends to a value from several goroutines, every append
+// landing
+func TestAppend(t *testing.T) {
+	config := DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	config.SegmentSizeBytes = 16 * 1024
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := h.Append([]byte("log"), []byte{byte('a' + id)}); err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	value, err := h.Get([]byte("log"))
+	if err != nil || len(value) != 400 {
+		t.Fatalf("Expected 400 bytes appended, got %d, %v", len(value), err)
+	}
+	for g := 0; g < 4; g++ {
+		if n := bytes.Count(value, []byte{byte('a' + g)}); n != 100 {
+			t.Fatalf("Expected 100 appends from goroutine %d, got %d", g, n)
+		}
+	}
+}
+
+// TestPutIfAbsent races goroutines to insert the same key, exactly one of
+// which may win, and inserts a deleted key again
+func TestPutIfAbsent(t *testing.T) {
+	config := DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var wg sync.WaitGroup
+	var wins atomic.Int32
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			inserted, err := h.PutIfAbsent([]byte("key"), []byte(fmt.Sprint(id)))
+			if err != nil {
+				t.Errorf("PutIfAbsent failed: %v", err)
+			}
+			if inserted {
+				wins.Add(1)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := wins.Load(); n != 1 {
+		t.Fatalf("Expected one insert to win, got %d", n)
+	}
+
+	if err := h.Delete([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if inserted, err := h.PutIfAbsent([]byte("key"), []byte("again")); err != nil || !inserted {
+		t.Fatalf("Expected a deleted key to be inserted again, got %v, %v", inserted, err)
+	}
+	if inserted, err := h.PutIfAbsent([]byte("key"), []byte("lost")); err != nil || inserted {
+		t.Fatalf("Expected an existing key to be kept, got %v, %v", inserted, err)
+	}
+	if value, err := h.Get([]byte("key")); err != nil || string(value) != "again" {
+		t.Fatalf("Expected again, got %q, %v", value, err)
+	}
+}
+
+// TestReadsDuringCompaction tests that Gets racing with compactions that
+// move their keys find them, rather than the segment they were in gone
+func TestReadsDuringCompaction(t *testing.T) {
+	config := DefaultConfig(t.TempDir())
+	config.SegmentSizeBytes = 4 * 1024
+	config.MaxSegments = 1000
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	const numKeys = 200
+	for i := 0; i < numKeys; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%d", i%numKeys)
+				if val, err := h.Get([]byte(key)); err != nil || string(val) != fmt.Sprintf("value%d", i%numKeys) {
+					t.Errorf("Get(%s) = %q, %v", key, val, err)
+					return
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	// Each round seals new segments for the next compaction to merge
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 50; i++ {
+			if err := h.Put([]byte(fmt.Sprintf("filler%d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := h.doCompact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package hashindex
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// segmentSeed returns the bytes of a segment holding a few records, a
+// tombstone among them, for the fuzzers to start from
+func segmentSeed(t testing.TB) []byte {
+	fs := common.NewMemFS()
+	file, err := fs.Create("seed.seg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := newSegment(1, "seed.seg", file)
+	for i := 0; i < 5; i++ {
+		value := []byte(fmt.Sprintf("value%d", i))
+		if i == 3 {
+			value = nil
+		}
+		if _, _, err := seg.append([]byte(fmt.Sprintf("key%d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seg.closeFile()
+
+	f, err := fs.Open("seed.seg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// FuzzReadRecord reads the records of corrupt segments, as recovery,
+// compaction and the scrubber do, and reads each one found back as Get
+// does: damage must be reported as an error, never a panic
+func FuzzReadRecord(f *testing.F) {
+	f.Add(segmentSeed(f))
+	f.Add(make([]byte, headerSize))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := common.NewMemFS()
+		file, err := fs.Create("fuzz.seg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(data)
+		seg := newSegment(1, "fuzz.seg", file)
+		seg.size.Store(int64(len(data)))
+		defer seg.closeFile()
+
+		for offset := int64(0); offset < int64(len(data)); {
+			seg.zeroAt(offset)
+			seg.tornAt(offset)
+			_, _, next, err := seg.readRecord(offset)
+			if err != nil {
+				break
+			}
+			if next <= offset {
+				t.Fatalf("record at offset %d ends at %d", offset, next)
+			}
+			if _, err := seg.read(offset, true); err != nil {
+				t.Fatalf("record at offset %d read by readRecord but not read: %v", offset, err)
+			}
+			offset = next
+		}
+	})
+}
+
+// FuzzRecovery opens an index over a corrupt segment, which recovery must
+// truncate at the damage, and reads and writes it
+func FuzzRecovery(f *testing.F) {
+	f.Add(segmentSeed(f))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := common.NewMemFS()
+		if err := fs.MkdirAll("/data", 0755); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fs.Create("/data/1.seg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(data)
+		file.Close()
+
+		config := DefaultConfig("/data")
+		config.FS = fs
+		h, err := New(config)
+		if err != nil {
+			return
+		}
+		defer h.Close()
+
+		for i := 0; i < 5; i++ {
+			h.Get([]byte(fmt.Sprintf("key%d", i)))
+		}
+		if err := h.Put([]byte("key0"), []byte("new")); err != nil {
+			t.Fatalf("Put after recovery failed: %v", err)
+		}
+		if v, err := h.Get([]byte("key0")); err != nil || string(v) != "new" {
+			t.Fatalf("Get after recovery = %q, %v", v, err)
+		}
+	})
+}
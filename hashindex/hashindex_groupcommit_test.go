@@ -0,0 +1,107 @@
+package hashindex
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestGroupCommit tests that concurrent synced writers share fsyncs and
+// that every acknowledged write survives a reopen
+func TestGroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.SyncOnWrite = true
+	config.SyncEveryNBytes = 64 * 1024
+	config.SyncEveryInterval = 2 * time.Millisecond
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numWorkers := 16
+	numOpsPerWorker := 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for j := 0; j < numOpsPerWorker; j++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", workerID, j))
+				value := []byte(fmt.Sprintf("value-%d-%d", workerID, j))
+				if err := h.Put(key, value); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := int64(numWorkers * numOpsPerWorker)
+	syncs := h.committer.syncCount.Load()
+	if syncs == 0 || syncs >= total {
+		t.Errorf("Expected writes to share fsyncs, got %d syncs for %d writes", syncs, total)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < numWorkers; i++ {
+		for j := 0; j < numOpsPerWorker; j++ {
+			key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+			expected := fmt.Sprintf("value-%d-%d", i, j)
+
+			val, err := h.Get(key)
+			if err != nil {
+				t.Fatalf("Get failed for key %s after reopen: %v", key, err)
+			}
+			if string(val) != expected {
+				t.Fatalf("Key %s: expected %s, got %s", key, expected, val)
+			}
+		}
+	}
+}
+
+// TestGroupCommitDisabled tests that SyncOnWrite alone keeps the
+// fsync-per-write path
+func TestGroupCommitDisabled(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.SyncOnWrite = true
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if h.committer != nil {
+		t.Error("Expected no group committer without SyncEveryNBytes or SyncEveryInterval")
+	}
+
+	if err := h.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+}
@@ -1,10 +1,15 @@
 package hashindex
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/intellect4all/storage-engines/common"
 )
@@ -208,9 +213,11 @@ func TestRecoveryWithDeletes(t *testing.T) {
 	}
 
 	stats := h2.Stats()
-	// Note: Stats may include tombstone entries that haven't been compacted
 	t.Logf("After recovery: %d keys in stats, %d deleted keys found, %d remaining keys verified",
 		stats.NumKeys, deletedFound, remainingFound)
+	if stats.NumKeys != 50 {
+		t.Errorf("Expected deleted keys left out of NumKeys, got %d", stats.NumKeys)
+	}
 
 	// At minimum, all non-deleted keys should be present
 	if remainingFound != 50 {
@@ -445,3 +452,890 @@ func TestRecoveryWithNewWrites(t *testing.T) {
 		t.Errorf("Expected 'value2' in third session, got '%s'", val2Final)
 	}
 }
+
+// TestRecoveryTornTail tests that a partially written final record is
+// truncated on recovery so later appends stay readable
+func TestRecoveryTornTail(t *testing.T) {
+	lastRecord := int64(headerSize + len("key9") + len("value9"))
+
+	tests := []struct {
+		name string
+		chop int64
+	}{
+		{"one byte of value", 1},
+		{"whole value", int64(len("value9"))},
+		{"into key", int64(len("value9")) + 2},
+		{"into header", int64(len("key9")+len("value9")) + 5},
+		{"all but one header byte", lastRecord - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "hashindex-test-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			h, err := New(DefaultConfig(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+				value := []byte(fmt.Sprintf("value%d", i))
+				if err := h.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := h.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			segFiles, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+			if err != nil || len(segFiles) != 1 {
+				t.Fatalf("Expected 1 segment file, got %v (err=%v)", segFiles, err)
+			}
+			info, err := os.Stat(segFiles[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			intact := info.Size() - lastRecord
+			if err := os.Truncate(segFiles[0], info.Size()-tt.chop); err != nil {
+				t.Fatal(err)
+			}
+
+			// Recover: torn record dropped, file cut back to the last good record
+			h2, err := New(DefaultConfig(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info, err := os.Stat(segFiles[0]); err != nil || info.Size() != intact {
+				t.Fatalf("Expected segment truncated to %d bytes, got %v (err=%v)", intact, info.Size(), err)
+			}
+			if _, err := h2.Get([]byte("key9")); err != common.ErrKeyNotFound {
+				t.Errorf("Expected torn key9 to be missing, got err=%v", err)
+			}
+			if err := h2.Put([]byte("after"), []byte("crash")); err != nil {
+				t.Fatal(err)
+			}
+			if err := h2.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Reopen: writes made after the truncation must still be found
+			h3, err := New(DefaultConfig(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h3.Close()
+
+			for i := 0; i < 9; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+				val, err := h3.Get(key)
+				if err != nil || string(val) != fmt.Sprintf("value%d", i) {
+					t.Errorf("Key %s: got %q, err=%v", key, val, err)
+				}
+			}
+			val, err := h3.Get([]byte("after"))
+			if err != nil || string(val) != "crash" {
+				t.Errorf("Expected write after truncation to survive, got %q, err=%v", val, err)
+			}
+		})
+	}
+}
+
+// TestRecoveryProgressAndCancel tests progress reporting during the
+// segment scan and that a cancelled context aborts the open
+func TestRecoveryProgressAndCancel(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25000; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []common.RecoveryProgress
+	config.OnRecoveryProgress = func(p common.RecoveryProgress) {
+		reports = append(reports, p)
+	}
+	h2, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2.Close()
+
+	// Start, two throttled reports and the final one
+	if len(reports) != 4 {
+		t.Fatalf("Expected 4 progress reports, got %d: %+v", len(reports), reports)
+	}
+	last := reports[len(reports)-1]
+	if !last.Done || last.Phase != common.PhaseSegmentScan {
+		t.Errorf("Expected final %s report, got %+v", common.PhaseSegmentScan, last)
+	}
+	if last.Entries != 25000 || last.Bytes != last.TotalBytes {
+		t.Errorf("Expected 25000 entries and %d bytes, got %+v", last.TotalBytes, last)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewWithContext(ctx, config); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// TestRecoveryShortWrite tests that a torn write injected by a FaultFS is
+// dropped on recovery while everything synced before it survives
+func TestRecoveryShortWrite(t *testing.T) {
+	mem := common.NewMemFS()
+	fs := common.NewFaultFS(mem)
+	config := DefaultConfig("/hashindex-faultfs")
+	config.FS = fs
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		value := []byte(fmt.Sprintf("value%d", i))
+		if err := h.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.FailAfter(common.FaultShortWrite, ".seg", 0, nil)
+	if err := h.Put([]byte("torn"), []byte("value")); !errors.Is(err, common.ErrInjectedFault) {
+		t.Fatalf("Expected injected fault, got %v", err)
+	}
+	fs.Heal()
+	h.Sync()
+
+	// Crash: the torn half-record is on "disk"
+	config.FS = mem.CrashClone()
+	h2, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		val, err := h2.Get(key)
+		if err != nil || string(val) != fmt.Sprintf("value%d", i) {
+			t.Errorf("Key %s: got %q, err=%v", key, val, err)
+		}
+	}
+	if _, err := h2.Get([]byte("torn")); err != common.ErrKeyNotFound {
+		t.Errorf("Expected torn key to be missing, got err=%v", err)
+	}
+	if err := h2.Put([]byte("after"), []byte("crash")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := h2.Get([]byte("after")); err != nil || string(val) != "crash" {
+		t.Errorf("Expected write after recovery, got %q, err=%v", val, err)
+	}
+}
+
+// TestCorruptSegmentQuarantined tests that a segment found damaged by a
+// read is moved aside while the other segments keep serving
+func TestCorruptSegmentQuarantined(t *testing.T) {
+	mem := common.NewMemFS()
+	config := DefaultConfig("/hashindex-corrupt")
+	config.FS = mem
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	const numKeys = 100
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if err := h.Put(key, []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*h.segments.Load()) < 2 {
+		t.Fatal("Expected several sealed segments")
+	}
+
+	// Flip a byte of a value in the oldest segment and in the active one
+	corrupt := func(seg *segment, key string) {
+		entry, _ := h.index.Get(key)
+		f, err := mem.OpenFile(seg.path, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{0}, entry.offset+headerSize+int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldest := (*h.segments.Load())[0]
+	corrupt(oldest, "key000")
+	active := h.stripes[0].active.Load()
+	corrupt(active, fmt.Sprintf("key%03d", numKeys-1))
+
+	keysBefore := h.Stats().NumKeys
+	if _, err := h.Get([]byte("key000")); !errors.Is(err, common.ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+	if _, err := h.Get([]byte("key000")); err != common.ErrKeyNotFound {
+		t.Errorf("Expected keys of the quarantined segment dropped, got err=%v", err)
+	}
+	if stats := h.Stats(); stats.NumKeys >= keysBefore {
+		t.Errorf("Expected fewer keys after quarantine, had %d, now %d", keysBefore, stats.NumKeys)
+	}
+
+	// The active segment is rotated out first, and writes carry on
+	if _, err := h.Get([]byte(fmt.Sprintf("key%03d", numKeys-1))); !errors.Is(err, common.ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+	if h.stripes[0].active.Load() == active {
+		t.Error("Expected the corrupt active segment rotated out")
+	}
+	if err := h.Put([]byte("after"), []byte("corruption")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := h.Get([]byte("after")); err != nil || string(val) != "corruption" {
+		t.Errorf("Expected write after quarantine, got %q, err=%v", val, err)
+	}
+
+	// Keys in the remaining segments are untouched
+	found := 0
+	for i := 0; i < numKeys; i++ {
+		val, err := h.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err == common.ErrKeyNotFound {
+			continue
+		}
+		if err != nil || string(val) != fmt.Sprintf("value%03d", i) {
+			t.Fatalf("Key key%03d: got %q, err=%v", i, val, err)
+		}
+		found++
+	}
+	if found == 0 {
+		t.Error("Expected keys outside the quarantined segments still served")
+	}
+
+	stats := h.Stats()
+	if stats.CorruptionCount != 2 || len(stats.Quarantined) != 2 {
+		t.Fatalf("Expected 2 segments quarantined, got count=%d files=%v", stats.CorruptionCount, stats.Quarantined)
+	}
+	for _, seg := range []*segment{oldest, active} {
+		if _, err := mem.Stat(seg.path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %s moved out of the data directory, got err=%v", seg.path, err)
+		}
+		if _, err := mem.Stat(filepath.Join(config.DataDir, common.QuarantineDir, filepath.Base(seg.path))); err != nil {
+			t.Errorf("Expected %s in quarantine: %v", seg.path, err)
+		}
+	}
+}
+
+// TestEmptySegmentsRemoved tests that recovery deletes segments that were
+// created but never written
+func TestEmptySegmentsRemoved(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/hashindex-empty-segments")
+	config.FS = fs
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// One older than the data and one newer, as if created just before a crash
+	var empty []string
+	for _, id := range []int64{1, time.Now().UnixNano() + int64(time.Hour)} {
+		path := filepath.Join(config.DataDir, fmt.Sprintf("%d.seg", id))
+		file, err := fs.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		empty = append(empty, path)
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer h.Close()
+
+	for _, path := range empty {
+		if _, err := fs.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected empty segment %s deleted, stat err=%v", path, err)
+		}
+	}
+	if value, err := h.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Get after reopen: got %q, err=%v", value, err)
+	}
+	if err := h.Put([]byte("key2"), []byte("value2")); err != nil {
+		t.Errorf("Put after reopen failed: %v", err)
+	}
+}
+
+// TestEncryption tests that with an encryption key no segment holds data
+// in the clear, and that the index only opens with the same key
+func TestEncryption(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/hashindex-encrypted")
+	config.FS = fs
+	config.SegmentSizeBytes = 4096
+	config.MaxSegments = 100 // Compacted below instead
+	config.EncryptionKey = bytes.Repeat([]byte{0x42}, 32)
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i%200)), []byte(fmt.Sprintf("secret%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := h.doCompact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fs.ReadDir(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		data, err := common.ReadFile(fs, filepath.Join(config.DataDir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("key0")) {
+			t.Errorf("%s holds data in the clear", e.Name())
+		}
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	for i := 300; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i%200)
+		value, err := h.Get([]byte(key))
+		if err != nil || string(value) != fmt.Sprintf("secret%03d", i) {
+			t.Fatalf("Get %s: got %q, err=%v", key, value, err)
+		}
+	}
+	h.Close()
+
+	config.EncryptionKey = bytes.Repeat([]byte{0x43}, 32)
+	if _, err := New(config); !errors.Is(err, common.ErrEncryptionKey) {
+		t.Errorf("Expected ErrEncryptionKey opening with another key, got %v", err)
+	}
+}
+
+// TestEncryptionTornTail tests that a torn last block of an encrypted
+// segment loses only the records in that block
+func TestEncryptionTornTail(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/hashindex-encrypted")
+	config.FS = fs
+	config.SyncOnWrite = true
+	config.EncryptionKey = bytes.Repeat([]byte{0x42}, 32)
+
+	// Records of 128 bytes: 192 fill six 4KB blocks, and the last 8 are in
+	// the seventh, which is cut short below
+	value := func(i int) string { return fmt.Sprintf("value%03d-%093d", i, i) }
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(value(i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the segment's last block short, below the encryption
+	entries, err := fs.ReadDir(config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segFiles []string
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".seg" {
+			segFiles = append(segFiles, filepath.Join(config.DataDir, e.Name()))
+		}
+	}
+	if len(segFiles) != 1 {
+		t.Fatalf("Expected 1 segment file, got %v", segFiles)
+	}
+	file, err := fs.OpenFile(segFiles[0], os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := file.Stat()
+	if err == nil {
+		err = file.Truncate(info.Size() - 50)
+	}
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer h.Close()
+	found := 0
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		got, err := h.Get([]byte(key))
+		if errors.Is(err, common.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil || string(got) != value(i) {
+			t.Fatalf("Get %s: got %q, err=%v", key, got, err)
+		}
+		if found != i {
+			t.Fatalf("Found %s after a missing key", key)
+		}
+		found++
+	}
+	if found != 192 {
+		t.Errorf("Recovered %d of 200 keys, want the 192 before the last block", found)
+	}
+
+	if err := h.Put([]byte("after"), []byte("crash")); err != nil {
+		t.Fatalf("Put after recovery failed: %v", err)
+	}
+	if value, err := h.Get([]byte("after")); err != nil || string(value) != "crash" {
+		t.Errorf("Get after recovery: got %q, err=%v", value, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	fs := common.NewMemFS()
+	keys := common.NewKeyRing(1, bytes.Repeat([]byte{0x42}, 32))
+	config := DefaultConfig("/hashindex-rekey")
+	config.FS = fs
+	config.SegmentSizeBytes = 4096
+	config.MaxSegments = 100
+	config.KeyProvider = keys
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i%200)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if n := h.Stats().StaleKeyFiles; n != 0 {
+		t.Fatalf("Expected no stale segments before rotating, got %d", n)
+	}
+
+	keys.Rotate(2, bytes.Repeat([]byte{0x43}, 32))
+	if n := h.Stats().StaleKeyFiles; n != h.Stats().NumSegments {
+		t.Fatalf("Expected all %d segments stale after rotating the key, got %d", h.Stats().NumSegments, n)
+	}
+	if err := h.RotateKeys(); err != nil {
+		t.Fatalf("RotateKeys failed: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for h.Stats().StaleKeyFiles > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d segments still on the old key", h.Stats().StaleKeyFiles)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing needs the old key any more
+	if err := keys.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	h, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen without the old key: %v", err)
+	}
+	defer h.Close()
+	for i := 300; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i%200)
+		value, err := h.Get([]byte(key))
+		if err != nil || string(value) != fmt.Sprintf("value%03d", i) {
+			t.Fatalf("Get %s: got %q, err=%v", key, value, err)
+		}
+	}
+}
+
+func TestChecksumVerification(t *testing.T) {
+	mem := common.NewMemFS()
+	config := DefaultConfig("/hashindex-verify")
+	config.FS = mem
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100
+	config.VerifyChecksumsOnRead = common.VerifyNever
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Damage the first value in the oldest segment
+	oldest := (*h.segments.Load())[0]
+	entry, _ := h.index.Get("key000")
+	f, err := mem.OpenFile(oldest.path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("V"), entry.offset+headerSize+int64(len("key000"))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if val, err := h.Get([]byte("key000")); err != nil || string(val) != "Value000" {
+		t.Errorf("Expected the damaged value unchecked, got %q, err=%v", val, err)
+	}
+	if err := h.doCompact(); !errors.Is(err, common.ErrCorruption) {
+		t.Errorf("Expected compaction to check the record anyway, got %v", err)
+	}
+}
+
+// TestScrub tests that a scrub pass finds a damaged record no read has
+// touched, quarantines its segment and reports it to the hook
+func TestScrub(t *testing.T) {
+	mem := common.NewMemFS()
+	config := DefaultConfig("/hashindex-scrub")
+	config.FS = mem
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100
+
+	var found []error
+	config.OnCorruption = func(err error) { found = append(found, err) }
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Damage the first value in the oldest segment
+	oldest := (*h.segments.Load())[0]
+	entry, _ := h.index.Get("key000")
+	f, err := mem.OpenFile(oldest.path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("V"), entry.offset+headerSize+int64(len("key000"))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	h.scrub(nil)
+
+	if len(found) != 1 || common.CorruptPath(found[0]) != oldest.path {
+		t.Fatalf("Expected the damaged segment reported once, got %v", found)
+	}
+	stats := h.Stats()
+	if stats.CorruptionCount != 1 || len(stats.Quarantined) != 1 {
+		t.Errorf("Expected the segment quarantined, got count=%d files=%v", stats.CorruptionCount, stats.Quarantined)
+	}
+	if _, err := h.Get([]byte("key000")); err != common.ErrKeyNotFound {
+		t.Errorf("Expected keys of the quarantined segment dropped, got err=%v", err)
+	}
+	if val, err := h.Get([]byte("key099")); err != nil || string(val) != "value099" {
+		t.Errorf("Expected the other segments served, got %q, err=%v", val, err)
+	}
+}
+
+// recoveredState is what an index holds once opened, to compare how it
+// was recovered
+type recoveredState struct {
+	values     map[string]string
+	segments   []SegmentStats
+	keys       int64
+	tombstones int64
+}
+
+// openRecovered opens the index in config's directory and returns its
+// state for numKeys keys named key0..., and its recovery progress reports
+func openRecovered(t *testing.T, config Config, numKeys int) (recoveredState, []common.RecoveryProgress) {
+	t.Helper()
+	var reports []common.RecoveryProgress
+	config.OnRecoveryProgress = func(p common.RecoveryProgress) {
+		reports = append(reports, p)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	state := recoveredState{values: make(map[string]string), segments: h.SegmentStats()}
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if val, err := h.Get([]byte(key)); err == nil {
+			state.values[key] = string(val)
+		} else if !errors.Is(err, common.ErrKeyNotFound) {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+	}
+	stats := h.Stats()
+	state.keys, state.tombstones = stats.NumKeys, stats.NumTombstones
+	return state, reports
+}
+
+// removeIndexSnapshots deletes the index snapshots in dir
+func removeIndexSnapshots(t *testing.T, dir string) {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
+
+// compareRecovered fails unless recovering from the snapshot in config's
+// directory ends up where scanning every segment does
+func compareRecovered(t *testing.T, config Config, numKeys int) []common.RecoveryProgress {
+	t.Helper()
+	fromSnapshot, reports := openRecovered(t, config, numKeys)
+	removeIndexSnapshots(t, config.DataDir)
+	fullScan, _ := openRecovered(t, config, numKeys)
+
+	if len(fromSnapshot.values) != len(fullScan.values) {
+		t.Errorf("Recovered %d keys from the snapshot, %d by a full scan", len(fromSnapshot.values), len(fullScan.values))
+	}
+	for key, val := range fullScan.values {
+		if fromSnapshot.values[key] != val {
+			t.Errorf("Key %s is %q recovered from the snapshot, %q by a full scan", key, fromSnapshot.values[key], val)
+		}
+	}
+	if fromSnapshot.keys != fullScan.keys || fromSnapshot.tombstones != fullScan.tombstones {
+		t.Errorf("Recovered %d keys and %d tombstones from the snapshot, %d and %d by a full scan",
+			fromSnapshot.keys, fromSnapshot.tombstones, fullScan.keys, fullScan.tombstones)
+	}
+	if fmt.Sprint(fromSnapshot.segments) != fmt.Sprint(fullScan.segments) {
+		t.Errorf("Segments recovered from the snapshot:\n%v\nby a full scan:\n%v", fromSnapshot.segments, fullScan.segments)
+	}
+	return reports
+}
+
+// TestIndexSnapshot tests that recovery from an index snapshot taken
+// while keys were written, and the records written after it, matches a
+// full scan, and scans only the records after it
+func TestIndexSnapshot(t *testing.T) {
+	config := DefaultConfig(t.TempDir())
+	config.SegmentSizeBytes = 16 * 1024
+	config.MaxSegments = 1000
+	const numKeys = 2000
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(round, from, to int) {
+		for i := from; i < to; i++ {
+			key := []byte(fmt.Sprintf("key%d", i%numKeys))
+			var err error
+			if (i+round)%7 == 0 {
+				err = h.Delete(key)
+			} else {
+				err = h.Put(key, []byte(fmt.Sprintf("value%d-%d", i, round)))
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+	write(0, 0, numKeys)
+
+	// Writers carry on while the snapshot is taken
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			write(w+1, w*numKeys/8, (w+1)*numKeys/8)
+		}(w)
+	}
+	if err := h.SnapshotIndex(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	write(9, numKeys/4, numKeys/2)
+	if h.Stats().CompactCount != 0 {
+		t.Fatal("Expected no compaction")
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reports := compareRecovered(t, config, numKeys)
+	loaded, scanned := reports[1], reports[len(reports)-1]
+	if loaded.Phase != common.PhaseSnapshotLoad || loaded.Entries == 0 {
+		t.Errorf("Expected the snapshot loaded, got %+v", loaded)
+	}
+	var total int64
+	for _, seg := range h.SegmentStats() {
+		total += seg.Size
+	}
+	if scanned.Phase != common.PhaseSegmentScan || scanned.TotalBytes == 0 || scanned.TotalBytes >= total/2 {
+		t.Errorf("Expected part of the %d bytes of segments scanned, got %+v", total, scanned)
+	}
+}
+
+// TestIndexSnapshotOnClose tests that with IndexSnapshotInterval set the
+// index is snapshotted on Close, in a part per snapshotPartEntries keys,
+// and on the next open nothing is scanned
+func TestIndexSnapshotOnClose(t *testing.T) {
+	config := DefaultConfig(t.TempDir())
+	config.SegmentSizeBytes = 1024 * 1024
+	config.IndexSnapshotInterval = time.Hour
+	const numKeys = snapshotPartEntries + 1000
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numKeys+1000; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%d", i%numKeys)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if health := h.Health(); !health.Workers["index-snapshot"] {
+		t.Errorf("Expected the snapshot worker running, got %v", health.Workers)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if parts, _ := filepath.Glob(filepath.Join(config.DataDir, "*"+snapshotPartSuffix)); len(parts) != 2 {
+		t.Errorf("Expected 2 snapshot parts, found %v", parts)
+	}
+	reports := compareRecovered(t, config, numKeys)
+	if loaded := reports[len(reports)-3]; loaded.Phase != common.PhaseSnapshotLoad || loaded.Entries != numKeys {
+		t.Errorf("Expected %d entries loaded, got %+v", numKeys, loaded)
+	}
+	if scanned := reports[len(reports)-1]; scanned.TotalBytes != 0 {
+		t.Errorf("Expected no records scanned, got %+v", scanned)
+	}
+}
+
+// TestIndexSnapshotStale tests recovery from a snapshot of segments
+// compacted since, and that a damaged snapshot is skipped
+func TestIndexSnapshotStale(t *testing.T) {
+	config := DefaultConfig(t.TempDir())
+	config.SegmentSizeBytes = 8 * 1024
+	config.MaxSegments = 1000
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i%500))
+		if i%11 == 0 {
+			err = h.Delete(key)
+		} else {
+			err = h.Put(key, []byte(fmt.Sprintf("value%d", i)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.SnapshotIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.doCompact(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%d", i)), []byte("after")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compareRecovered(t, config, 500)
+
+	// A damaged part leaves the snapshot unused, and deleted
+	h, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SnapshotIndex(); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	part := h.snapshotPath(h.snapshotSeq, 0)
+	data, err := os.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(part, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, reports := openRecovered(t, config, 500)
+	if reports[1].Entries != 0 || reports[len(reports)-1].Entries == 0 {
+		t.Errorf("Expected a full scan, got %+v", reports)
+	}
+	if names, _ := filepath.Glob(filepath.Join(config.DataDir, snapshotPrefix+"*")); len(names) != 0 {
+		t.Errorf("Expected the damaged snapshot deleted, found %v", names)
+	}
+	if state.values["key1"] != "after" {
+		t.Errorf("Expected key1 recovered, got %q", state.values["key1"])
+	}
+}
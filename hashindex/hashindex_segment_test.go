@@ -1,10 +1,16 @@
 package hashindex
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 // TestSegmentRotation tests that segments rotate at the configured size
@@ -61,3 +67,402 @@ func TestSegmentRotation(t *testing.T) {
 		}
 	}
 }
+
+// TestPreallocatedSegments tests that segments are created at full size,
+// trimmed once sealed, and recovered from a crash without their zeros
+// counting as damage
+func TestPreallocatedSegments(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/hashindex-prealloc")
+	config.FS = fs
+	config.SegmentSizeBytes = 4096
+	config.MaxSegments = 100
+	config.SyncOnWrite = true
+	config.PreallocateSegments = true
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { h.Close() }()
+
+	fileSize := func(fs *common.MemFS, path string) int64 {
+		info, err := fs.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	active := h.stripes[0].active.Load()
+	if size := fileSize(fs, active.path); size != config.SegmentSizeBytes {
+		t.Errorf("Expected the active segment preallocated to %d bytes, got %d", config.SegmentSizeBytes, size)
+	}
+
+	// A record torn by the crash, with the preallocated zeros after it
+	crashed := fs.CrashClone()
+	f, err := crashed.OpenFile(active.path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := make([]byte, headerSize+6)
+	binary.LittleEndian.PutUint32(torn[0:], 0xdeadbeef)
+	binary.LittleEndian.PutUint32(torn[12:], 6)
+	binary.LittleEndian.PutUint32(torn[16:], 5)
+	copy(torn[headerSize:], "key020")
+	f.WriteAt(torn, active.Size())
+	f.Close()
+
+	recoveredConfig := config
+	recoveredConfig.FS = crashed
+	recovered, err := New(recoveredConfig)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := recovered.Get([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatalf("Get key%03d after recovery: %v", i, err)
+		}
+	}
+	if n := recovered.Stats().CorruptionCount; n != 0 {
+		t.Errorf("Expected no corruption, got %d", n)
+	}
+	if got := recovered.stripes[0].active.Load().Size(); got != active.Size() {
+		t.Errorf("Expected the active segment to end at %d, got %d", active.Size(), got)
+	}
+	if size := fileSize(crashed, active.path); size != config.SegmentSizeBytes {
+		t.Errorf("Expected the recovered active segment preallocated again, file is %d bytes", size)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sealed segments, and the active one at Close, are trimmed
+	for i := 0; i < 200; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sealed := *h.segments.Load()
+	if len(sealed) == 0 {
+		t.Fatal("Expected segments to rotate")
+	}
+	for _, seg := range sealed {
+		if size := fileSize(fs, seg.path); size != seg.Size() {
+			t.Errorf("Expected sealed segment %d trimmed to %d bytes, file is %d", seg.id, seg.Size(), size)
+		}
+	}
+	active = h.stripes[0].active.Load()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(fs, active.path); size != active.Size() {
+		t.Errorf("Expected the active segment trimmed at Close to %d bytes, file is %d", active.Size(), size)
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := h.Get([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatalf("Get key%03d after reopen: %v", i, err)
+		}
+	}
+	if n := h.Stats().NumKeys; n != 200 {
+		t.Errorf("Expected 200 keys, the markers not among them, got %d", n)
+	}
+}
+
+// TestWriteStripes tests that keys written to several active segments keep
+// their latest values through compaction and a restart
+func TestWriteStripes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.SegmentSizeBytes = 512
+	config.MaxSegments = 1000 // Compact by hand
+	config.WriteStripes = 4
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Stats().NumSegments; got != 4 {
+		t.Fatalf("Expected 4 initial segments, got %d", got)
+	}
+
+	want := make(map[string]string)
+	put := func(key, value string) {
+		t.Helper()
+		if err := h.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+
+	// Overwrite keys of every stripe, in parallel rounds
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < 200; i += 4 {
+					key := fmt.Sprintf("key%03d", i)
+					if err := h.Put([]byte(key), []byte(fmt.Sprintf("value%d-%d", round, i))); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		want[fmt.Sprintf("key%03d", i)] = fmt.Sprintf("value4-%d", i)
+	}
+
+	// Only the first stripe's keys move on, leaving the other stripes'
+	// active segments older than its sealed ones
+	first := h.stripeFor([]byte("key000"))
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if h.stripeFor([]byte(key)) == first {
+				put(key, fmt.Sprintf("late%d-%d", round, i))
+			}
+		}
+	}
+	for len(*h.segments.Load()) > 1 {
+		if err := h.doCompact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(h *HashIndex, when string) {
+		t.Helper()
+		for key, value := range want {
+			got, err := h.Get([]byte(key))
+			if err != nil {
+				t.Fatalf("%s: Get(%s) failed: %v", when, key, err)
+			}
+			if string(got) != value {
+				t.Fatalf("%s: Get(%s) = %s, want %s", when, key, got, value)
+			}
+		}
+	}
+	check(h, "after compaction")
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	check(h, "after reopening")
+}
+
+// writeTestSegment writes numRecords records with valueSize byte values,
+// every tenth a tombstone, to a segment at path
+func writeTestSegment(t testing.TB, fs common.FS, path string, numRecords, valueSize int) *segment {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := newSegment(1, path, file)
+	value := make([]byte, valueSize)
+	for i := 0; i < numRecords; i++ {
+		v := value
+		if i%10 == 9 {
+			v = nil
+		}
+		binary.LittleEndian.PutUint32(value, uint32(i))
+		if _, _, err := seg.append([]byte(fmt.Sprintf("key%07d", i)), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return seg
+}
+
+// TestSegmentIDsSameNanosecond tests compaction when stripes rotate in
+// the same nanosecond, so their segments' ids are consecutive: no
+// compaction output may take the id of a live segment
+func TestSegmentIDsSameNanosecond(t *testing.T) {
+	config := DefaultConfig("/data")
+	config.FS = common.NewMemFS()
+	config.SegmentSizeBytes = 256
+	config.MaxSegments = 1000 // Compact by hand
+	config.WriteStripes = 4
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the last id ahead of the clock, every new id is the next one
+	// free, as for segments created in the same nanosecond
+	h.lastSegmentID.Store(time.Now().Add(time.Hour).UnixNano())
+
+	want := make(map[string]string)
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			want[key] = fmt.Sprintf("value%d-%03d", round, i)
+			if err := h.Put([]byte(key), []byte(want[key])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := h.doCompact(); err != nil {
+			t.Fatalf("Compaction failed: %v", err)
+		}
+	}
+
+	check := func(h *HashIndex) {
+		t.Helper()
+		for key, value := range want {
+			got, err := h.Get([]byte(key))
+			if err != nil || string(got) != value {
+				t.Fatalf("Get %s: got %q, err=%v, want %s", key, got, err, value)
+			}
+		}
+	}
+	check(h)
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer h.Close()
+	check(h)
+}
+
+// TestSegmentReader tests that scans read the same records record by
+// record, read ahead and mapped, and find a torn tail and damage alike
+func TestSegmentReader(t *testing.T) {
+	dir := t.TempDir()
+	fs := common.OSFS{}
+	path := dir + "/1.seg"
+	seg := writeTestSegment(t, fs, path, 1000, 300)
+	defer seg.closeFile()
+
+	for _, mode := range []struct {
+		name      string
+		readAhead int
+		mmap      bool
+	}{
+		{"record", 0, false},
+		{"readahead-small", 100, false},
+		{"readahead-1MB", 1 << 20, false},
+		{"mmap", 0, true},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			reader := seg.newReader(mode.readAhead, mode.mmap)
+			defer reader.close()
+			if mode.mmap && reader.unmap == nil {
+				t.Skip("mmap unsupported")
+			}
+
+			offset, i := int64(0), 0
+			for {
+				key, value, next, err := reader.readRecord(offset)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Record %d at offset %d: %v", i, offset, err)
+				}
+				if string(key) != fmt.Sprintf("key%07d", i) {
+					t.Fatalf("Record %d has key %q", i, key)
+				}
+				if i%10 == 9 && len(value) != 0 || i%10 != 9 && (len(value) != 300 || binary.LittleEndian.Uint32(value) != uint32(i)) {
+					t.Fatalf("Record %d has a wrong value", i)
+				}
+				offset, i = next, i+1
+			}
+			if i != 1000 || offset != seg.Size() {
+				t.Fatalf("Read %d records to offset %d, want 1000 to %d", i, offset, seg.Size())
+			}
+		})
+	}
+
+	// A record cut short, then one damaged. The last record is a
+	// tombstone, with a 10 byte key.
+	seg.size.Add(-5)
+	reader := seg.newReader(1<<20, true)
+	if _, _, _, err := reader.readRecord(seg.Size() + 5 - (headerSize + 10)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected a torn record, got %v", err)
+	}
+	reader.close()
+	seg.size.Add(5)
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xff}, headerSize+10)
+	file.Close()
+	for _, readAhead := range []int{0, 1 << 20} {
+		reader := seg.newReader(readAhead, readAhead == 0)
+		if _, _, _, err := reader.readRecord(0); !errors.Is(err, common.ErrCorruption) {
+			t.Errorf("Expected the damaged record found (read ahead %d), got %v", readAhead, err)
+		}
+		reader.close()
+	}
+}
+
+// TestMmapSegmentScans tests recovery and compaction reading mapped
+// segments
+func TestMmapSegmentScans(t *testing.T) {
+	config := DefaultConfig(t.TempDir())
+	config.SegmentSizeBytes = 4096
+	config.MaxSegments = 100
+	config.MmapSegmentScans = true
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i%200)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.doCompact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for i := 300; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i%200)
+		if val, err := h.Get([]byte(key)); err != nil || string(val) != fmt.Sprintf("value%03d", i) {
+			t.Errorf("Get(%s) = %q, %v", key, val, err)
+		}
+	}
+}
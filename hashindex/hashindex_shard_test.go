@@ -2,12 +2,13 @@ package hashindex
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 )
 
 // TestShardedIndexDistribution tests that keys distribute evenly across shards
 func TestShardedIndexDistribution(t *testing.T) {
-	index := newShardedIndex()
+	index := newShardedIndex(0, 0)
 
 	// Add many keys
 	numKeys := 10000
@@ -27,9 +28,10 @@ func TestShardedIndexDistribution(t *testing.T) {
 	}
 
 	// Check distribution across shards
+	numShards := index.Shards()
 	shardCounts := make([]int, numShards)
 	for i := 0; i < numShards; i++ {
-		shardCounts[i] = len(index.shards[i].entries)
+		shardCounts[i] = len(index.table.Load().shards[i].entries)
 	}
 
 	// Each shard should have approximately numKeys/numShards entries
@@ -54,7 +56,7 @@ func TestShardedIndexDistribution(t *testing.T) {
 
 // TestBatchUpdates tests batch update operations
 func TestBatchUpdates(t *testing.T) {
-	index := newShardedIndex()
+	index := newShardedIndex(0, 0)
 
 	// Add initial keys
 	for i := 0; i < 100; i++ {
@@ -85,7 +87,7 @@ func TestBatchUpdates(t *testing.T) {
 	}
 
 	// Apply batch update
-	index.UpdateBatch(updates, deletions)
+	index.UpdateBatch(updates, deletions, nil)
 
 	// Verify updates
 	for i := 0; i < 50; i++ {
@@ -115,3 +117,101 @@ func TestBatchUpdates(t *testing.T) {
 		t.Errorf("Expected count %d after batch update, got %d", expectedCount, index.Count())
 	}
 }
+
+// TestBatchUpdatesFrom tests that a batch limited to some segments leaves
+// keys written elsewhere since alone, and counts tombstones apart
+func TestBatchUpdatesFrom(t *testing.T) {
+	index := newShardedIndex(0, 0)
+	index.Put("kept", &indexEntry{segmentID: 1, size: 100})
+	index.Put("moved", &indexEntry{segmentID: 1, size: 100})
+	index.Put("gone", &indexEntry{segmentID: 1, size: 100, deleted: true})
+	index.Put("rewritten", &indexEntry{segmentID: 1, size: 100})
+
+	// Written again while segment 1 was being compacted
+	index.Put("rewritten", &indexEntry{segmentID: 3, size: 100, deleted: true})
+	if index.Count() != 2 || index.Deleted() != 2 {
+		t.Fatalf("Expected 2 live and 2 deleted keys, got %d and %d", index.Count(), index.Deleted())
+	}
+
+	updates := map[string]*indexEntry{
+		"kept":      {segmentID: 2, size: 100},
+		"moved":     {segmentID: 2, size: 100},
+		"rewritten": {segmentID: 2, size: 50},
+	}
+	skipped := index.UpdateBatch(updates, []string{"gone"}, map[int]bool{1: true})
+
+	if skipped != 50 {
+		t.Errorf("Expected the rewritten key's 50 bytes skipped, got %d", skipped)
+	}
+	if entry, _ := index.Get("rewritten"); entry.segmentID != 3 {
+		t.Errorf("Expected the newer write kept, got segment %d", entry.segmentID)
+	}
+	if _, exists := index.Get("gone"); exists {
+		t.Error("Expected the tombstone dropped")
+	}
+	if index.Count() != 2 || index.Deleted() != 1 {
+		t.Errorf("Expected 2 live and 1 deleted key, got %d and %d", index.Count(), index.Deleted())
+	}
+}
+
+// TestShardedIndexGrowth tests that the index doubles its shards as keys
+// are added, while writers and readers carry on
+func TestShardedIndexGrowth(t *testing.T) {
+	if got := newShardedIndex(100, 0).Shards(); got != 128 {
+		t.Errorf("Expected 100 shards rounded up to 128, got %d", got)
+	}
+
+	index := newShardedIndex(2, 4)
+	const writers, perWriter = 8, 2000
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%d-key%d", w, i)
+				index.Put(key, &indexEntry{segmentID: 1, offset: int64(i), size: 100})
+				if entry, ok := index.Get(key); !ok || entry.offset != int64(i) {
+					t.Errorf("Key %s not found right after its Put", key)
+					return
+				}
+				if i%4 == 3 && !index.Delete(key) {
+					t.Errorf("Key %s not found to delete", key)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	index.wait()
+
+	if index.Shards() < writers*perWriter/4/2 {
+		t.Errorf("Expected the index grown to hold about 4 keys per shard, got %d shards", index.Shards())
+	}
+	if want := int64(writers * perWriter * 3 / 4); index.Count() != want {
+		t.Errorf("Expected %d keys, got %d", want, index.Count())
+	}
+	var entries int
+	index.forEachShard(func(s *shard) { entries += len(s.entries) })
+	if entries != int(index.Count()) {
+		t.Errorf("Expected %d entries in the shards, got %d", index.Count(), entries)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			key := fmt.Sprintf("w%d-key%d", w, i)
+			if _, ok := index.Get(key); ok != (i%4 != 3) {
+				t.Fatalf("Key %s found: %v", key, ok)
+			}
+		}
+	}
+
+	// A batch goes to the grown table
+	skipped := index.UpdateBatch(map[string]*indexEntry{"w0-key0": {segmentID: 2, size: 100}}, []string{"w0-key1"}, nil)
+	if entry, _ := index.Get("w0-key0"); skipped != 0 || entry.segmentID != 2 {
+		t.Error("Expected the batch update applied")
+	}
+	if _, ok := index.Get("w0-key1"); ok {
+		t.Error("Expected the batch deletion applied")
+	}
+}
@@ -1,10 +1,13 @@
 package hashindex
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 // TestStats tests statistics tracking
@@ -85,3 +88,350 @@ func TestStats(t *testing.T) {
 	t.Logf("Stats: NumKeys=%d, NumSegments=%d, WriteAmp=%.2f, SpaceAmp=%.2f, CompactCount=%d",
 		stats.NumKeys, stats.NumSegments, stats.WriteAmp, stats.SpaceAmp, stats.CompactCount)
 }
+
+// TestLiveAndDeadCounts tests that deleted keys are counted apart from
+// live ones, and superseded records as dead bytes, across compaction and
+// recovery
+func TestLiveAndDeadCounts(t *testing.T) {
+	mem := common.NewMemFS()
+	config := DefaultConfig("/hashindex-dead")
+	config.FS = mem
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 keys, 20 overwritten and 30 deleted
+	for i := 0; i < 100; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("VALUE%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 50; i < 80; i++ {
+		if err := h.Delete([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each overwrite and delete kills a 34-byte record, and each
+	// tombstone is 26 bytes
+	const record, tombstone = headerSize + 6 + 8, headerSize + 6
+	wantDead := int64(50*record + 30*tombstone)
+	check := func(when string, tombstones, dead int64) {
+		t.Helper()
+		stats := h.Stats()
+		if stats.NumKeys != 70 || stats.NumTombstones != tombstones || stats.DeadBytes != dead {
+			t.Errorf("%s: expected 70 keys, %d tombstones and %d dead bytes, got %d, %d and %d",
+				when, tombstones, dead, stats.NumKeys, stats.NumTombstones, stats.DeadBytes)
+		}
+		var segDead int64
+		for _, seg := range h.SegmentStats() {
+			segDead += seg.DeadBytes
+		}
+		if segDead != stats.DeadBytes {
+			t.Errorf("%s: expected segments to add up to %d dead bytes, got %d", when, stats.DeadBytes, segDead)
+		}
+	}
+	check("after writes", 30, wantDead)
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	check("after recovery", 30, wantDead)
+
+	// Compacting a prefix of the segments rewrites records superseded
+	// further on, so they stay dead
+	if err := h.doCompact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after compacting some segments", 30, wantDead)
+
+	// Compacting all of them reclaims everything
+	h.stripes[0].mu.Lock()
+	err = h.rotateSegment(h.stripes[0])
+	h.stripes[0].mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(*h.segments.Load()) > 1 {
+		if err := h.doCompact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("after compacting all segments", 0, 0)
+	if _, err := h.Get([]byte("key060")); err != common.ErrKeyNotFound {
+		t.Errorf("Expected a deleted key to stay deleted, got %v", err)
+	}
+}
+
+// TestReadAmpStats tests that Gets record the number of segments touched
+func TestReadAmpStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := h.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hits touch exactly one segment
+	for i := 0; i < 10; i++ {
+		if _, err := h.Get([]byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := h.Stats()
+	if stats.ReadAmp != 1.0 {
+		t.Errorf("Expected read amp 1.0 for hits, got %.2f", stats.ReadAmp)
+	}
+
+	// Misses are answered from the index alone
+	for i := 0; i < 10; i++ {
+		h.Get([]byte(fmt.Sprintf("missing%d", i)))
+	}
+
+	stats = h.Stats()
+	if stats.ReadAmp != 0.5 {
+		t.Errorf("Expected read amp 0.5 after equal hits and misses, got %.2f", stats.ReadAmp)
+	}
+	if stats.ReadAmpP99 != 1 {
+		t.Errorf("Expected p99 read amp 1, got %.0f", stats.ReadAmpP99)
+	}
+}
+
+// TestMemoryBudget tests index memory accounting and that new keys are
+// rejected once the budget is exhausted
+func TestMemoryBudget(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hashindex-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Room for roughly 100 index entries
+	budget := int64(100 * (len("key000") + indexEntryOverhead))
+	config := DefaultConfig(dir)
+	config.Memory = common.NewMemoryAccountant(budget)
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var accepted int
+	for i := 0; i < 200; i++ {
+		err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+		if err == common.ErrMemoryBudget {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		accepted++
+	}
+	if accepted != 100 {
+		t.Errorf("Expected 100 keys accepted within budget, got %d", accepted)
+	}
+
+	// Existing keys can still be updated and deleted
+	if err := h.Put([]byte("key000"), []byte("updated")); err != nil {
+		t.Errorf("Update of existing key failed: %v", err)
+	}
+	if err := h.Delete([]byte("key001")); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+
+	stats := h.Stats()
+	if stats.MemoryBudget != budget || stats.MemoryUsage[common.MemIndex] != stats.MemoryUsed {
+		t.Errorf("Unexpected memory stats: used=%d budget=%d usage=%v", stats.MemoryUsed, stats.MemoryBudget, stats.MemoryUsage)
+	}
+
+	h.Close()
+	if used := config.Memory.Used(); used != 0 {
+		t.Errorf("Expected all memory released on close, got %d", used)
+	}
+}
+
+// TestHealth tests that Health reports a failing segment write, a full
+// disk and a closed index
+func TestHealth(t *testing.T) {
+	mem := common.NewMemFS()
+	fs := common.NewFaultFS(mem)
+	config := DefaultConfig("/hashindex-health")
+	config.FS = fs
+	config.DiskReserveBytes = 1 << 20
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if health := h.Health(); !health.OK || !health.Workers["compaction"] {
+		t.Fatalf("Expected a healthy index, got %+v", health)
+	}
+
+	mem.SetDiskFree(1 << 10)
+	if health := h.Health(); health.OK || health.DiskFree != 1<<10 {
+		t.Errorf("Expected the disk reserve problem, got %+v", health)
+	}
+	mem.SetDiskFree(1 << 30)
+
+	fs.FailAfter(common.FaultWrite, ".seg", 0, nil)
+	h.Put([]byte("failed"), []byte("value"))
+	health := h.Health()
+	if health.OK || health.WALWritable || !errors.Is(health.WALError, common.ErrInjectedFault) {
+		t.Errorf("Expected an unwritable segment, got %+v", health)
+	}
+
+	fs.Heal()
+	if err := h.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatalf("Put after heal failed: %v", err)
+	}
+	if health := h.Health(); !health.OK {
+		t.Errorf("Expected a healthy index once writes recovered, got %+v", health)
+	}
+
+	h.Close()
+	if health := h.Health(); health.OK || !health.Closed || health.Workers["compaction"] {
+		t.Errorf("Expected a closed index with no compaction worker, got %+v", health)
+	}
+}
+
+// TestWorkerPanic tests that a panic in the compaction worker, here from
+// the corruption hook, is recovered, reported to the hook and by Health,
+// and that the worker is restarted and compacts again
+func TestWorkerPanic(t *testing.T) {
+	mem := common.NewMemFS()
+	config := DefaultConfig("/hashindex-panic")
+	config.FS = mem
+	config.SegmentSizeBytes = 1024
+	config.MaxSegments = 100
+	config.OnCorruption = func(err error) { panic("injected") }
+	panics := make(chan *common.WorkerPanic, 10)
+	config.OnWorkerPanic = func(p *common.WorkerPanic) { panics <- p }
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := h.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Damage the first value in the oldest segment, for compaction to
+	// find
+	oldest := (*h.segments.Load())[0]
+	entry, _ := h.index.Get("key000")
+	f, err := mem.OpenFile(oldest.path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("V"), entry.offset+headerSize+int64(len("key000"))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := h.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-panics:
+		if p.Worker != "compaction" || p.Value != "injected" || len(p.Stack) == 0 {
+			t.Errorf("Unexpected panic: %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the panic reported to OnWorkerPanic")
+	}
+	if health := h.Health(); health.OK || health.WorkerPanics != 1 || health.LastWorkerPanic == nil {
+		t.Errorf("Expected the panic reported, got %+v", health)
+	}
+
+	// The worker is restarted after a backoff, and compacts the segments
+	// left
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().CompactCount == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a compaction by the restarted worker")
+		}
+		h.Compact()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !h.Health().Workers["compaction"] {
+		t.Error("Expected the compaction worker running again")
+	}
+	if val, err := h.Get([]byte("key099")); err != nil || string(val) != "value099" {
+		t.Errorf("Expected the other segments served, got %q, err=%v", val, err)
+	}
+}
+
+// TestDiskLowWatermark tests that no new segment is started while the disk
+// is nearly full, and that writes resume once space is freed
+func TestDiskLowWatermark(t *testing.T) {
+	mem := common.NewMemFS()
+	config := DefaultConfig("/hashindex-watermark")
+	config.FS = mem
+	config.SegmentSizeBytes = 1024
+	config.DiskLowWatermarkBytes = 1 << 20
+
+	h, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	mem.SetDiskFree(1 << 10)
+	var refused error
+	for i := 0; i < 1000 && refused == nil; i++ {
+		refused = h.Put([]byte(fmt.Sprintf("key%04d", i)), []byte("value"))
+	}
+	if !errors.Is(refused, common.ErrDiskFull) {
+		t.Fatalf("Expected writes to be refused with ErrDiskFull, got %v", refused)
+	}
+	if health := h.Health(); !health.ReadOnly {
+		t.Errorf("Expected Health to report read-only, got %+v", health)
+	}
+	if err := h.Put([]byte("small"), []byte("v")); !errors.Is(err, common.ErrDiskFull) {
+		t.Errorf("Expected every write refused while read-only, got %v", err)
+	}
+
+	mem.SetDiskFree(1 << 30)
+	if err := h.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatalf("Put after freeing space failed: %v", err)
+	}
+	stats := h.Stats()
+	if stats.DiskFullEvents != 1 || stats.NumSegments < 2 {
+		t.Errorf("Expected 1 disk full event and a new segment, got %+v", stats)
+	}
+	if _, err := h.Get([]byte("key0000")); err != nil {
+		t.Errorf("Get key0000: %v", err)
+	}
+}
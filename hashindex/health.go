@@ -0,0 +1,42 @@
+package hashindex
+
+import (
+	"fmt"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Health diagnoses the index (see common.Health). The active segment
+// stands in for the write-ahead log. It counts as stalled once twice
+// MaxSegments segments have piled up because compaction can't keep up.
+func (h *HashIndex) Health() common.Health {
+	health := common.Health{
+		WALWritable: true,
+		DiskFree:    common.DiskFreeOrUnknown(h.config.FS, h.config.DataDir),
+		DiskReserve: h.config.DiskReserveBytes,
+		ReadOnly:    h.disk.ReadOnly(),
+		Workers: map[string]bool{
+			"compaction": h.workers.compaction.Load(),
+		},
+		CorruptionCount: h.corruption.Count(),
+		Quarantined:     h.corruption.Files(),
+		Closed:          h.gate.Closed(),
+	}
+	if h.config.IndexSnapshotInterval > 0 {
+		health.Workers["index-snapshot"] = h.workers.snapshot.Load()
+	}
+	health.WorkerPanics, health.LastWorkerPanic = h.supervisor.Panics()
+	if err := h.walErr.Err(); err != nil {
+		health.WALWritable = false
+		health.WALError = err
+	}
+
+	numSegments := len(*h.segments.Load())
+	if h.config.MaxSegments > 0 && numSegments >= 2*h.config.MaxSegments {
+		health.Stalled = true
+		health.StallReason = fmt.Sprintf("%d segments, compaction is behind", numSegments)
+	}
+
+	health.Diagnose()
+	return health
+}
@@ -0,0 +1,63 @@
+package hashindex
+
+import (
+	"fmt"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// handleCorruption takes the segment a corruption error is about out of
+// service and moves its file into quarantine (see common.Quarantine), so
+// the index keeps serving from the other segments. Keys whose latest
+// record was in it are dropped from the index and read as not found. An
+// active segment is rotated out first so writes carry on in a new one.
+// Errors that don't report corruption in a segment are ignored.
+func (h *HashIndex) handleCorruption(err error) {
+	path := common.CorruptPath(err)
+	if path == "" {
+		return
+	}
+
+	for _, st := range h.stripes {
+		st.mu.Lock()
+		if active := st.active.Load(); active != nil && active.path == path {
+			if err := h.rotateSegment(st); err != nil {
+				st.mu.Unlock()
+				fmt.Printf("Warning: failed to rotate out corrupt segment %s: %v\n", path, err)
+				return
+			}
+		}
+		st.mu.Unlock()
+	}
+
+	h.segmentsMu.Lock()
+	oldSegments := h.segments.Load()
+	var seg *segment
+	remaining := make([]*segment, 0, len(*oldSegments))
+	for _, s := range *oldSegments {
+		if s.path == path {
+			seg = s
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+	if seg != nil {
+		h.segments.Store(&remaining)
+	}
+	h.segmentsMu.Unlock()
+	if seg == nil {
+		return // Already quarantined, or compacted away
+	}
+
+	h.corruption.Record(err)
+	dropped := h.index.DeleteSegment(seg.id)
+	fmt.Printf("Warning: quarantining segment %d (%d keys lost): %v\n", seg.id, dropped, err)
+
+	seg.close()
+	dest, err := common.Quarantine(h.config.FS, h.config.DataDir, path)
+	if err != nil {
+		fmt.Printf("Warning: failed to quarantine segment %d: %v\n", seg.id, err)
+		return
+	}
+	h.corruption.Quarantined(dest)
+}
@@ -1,6 +1,8 @@
 package hashindex
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,23 +11,48 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
-func (h *HashIndex) recover() error {
+// segmentInfo is a segment file found on open
+type segmentInfo struct {
+	id   int
+	path string
+	size int64
+}
+
+func (h *HashIndex) recover(ctx context.Context) error {
 	// List all segment files
-	files, err := os.ReadDir(h.config.DataDir)
+	files, err := h.config.FS.ReadDir(h.config.DataDir)
 	if err != nil {
 		return err
 	}
 
 	// Parse segment IDs and sort by timestamp (oldest first)
-	type segmentInfo struct {
-		id   int
-		path string
-	}
 	segmentInfos := make([]segmentInfo, 0)
+	var snapshotNames []string
 
 	for _, file := range files {
+		if _, _, ok := parseSnapshotName(file.Name()); ok {
+			snapshotNames = append(snapshotNames, file.Name())
+			continue
+		}
+
+		// Compacted segments a crash kept from being deleted
+		if strings.HasSuffix(file.Name(), ".seg"+obsoleteSuffix) {
+			h.deleter.Delete(filepath.Join(h.config.DataDir, file.Name()))
+			continue
+		}
+
+		// Output of a compaction that never finished
+		if strings.HasSuffix(file.Name(), ".seg"+tmpSuffix) {
+			if err := h.config.FS.Remove(filepath.Join(h.config.DataDir, file.Name())); err != nil {
+				fmt.Printf("Warning: failed to delete %s: %v\n", file.Name(), err)
+			}
+			continue
+		}
+
 		if file.IsDir() || !strings.HasSuffix(file.Name(), ".seg") {
 			continue
 		}
@@ -38,7 +65,19 @@ func (h *HashIndex) recover() error {
 		}
 
 		path := filepath.Join(h.config.DataDir, file.Name())
-		segmentInfos = append(segmentInfos, segmentInfo{id: id, path: path})
+		var size int64
+		if info, err := file.Info(); err == nil {
+			size = info.Size()
+
+			// Created just before a crash or Close, and never written
+			if size == 0 {
+				if err := h.config.FS.Remove(path); err != nil {
+					fmt.Printf("Warning: failed to delete empty segment %d: %v\n", id, err)
+				}
+				continue
+			}
+		}
+		segmentInfos = append(segmentInfos, segmentInfo{id: id, path: path, size: size})
 	}
 
 	// Sort by ID (timestamp order)
@@ -46,78 +85,215 @@ func (h *HashIndex) recover() error {
 		return segmentInfos[i].id < segmentInfos[j].id
 	})
 
+	// An index snapshot saves scanning the records it covers
+	var snap *indexSnapshot
+	if len(snapshotNames) > 0 {
+		loading := common.NewRecoveryTracker(ctx, h.config.OnRecoveryProgress, common.PhaseSnapshotLoad, 0, 0)
+		if snap = h.loadSnapshot(snapshotNames, segmentInfos); snap != nil {
+			loading.Add(int64(len(snap.entries)), 0)
+		}
+		loading.Done()
+	}
+
 	if len(segmentInfos) == 0 {
 		// No segments to recover, will create new one
 		return nil
 	}
 
+	err = h.recoverSegments(ctx, segmentInfos, snap)
+	if errors.Is(err, errSnapshotStale) {
+		fmt.Printf("Warning: %v %d, scanning segments in full\n", err, snap.seq)
+		h.removeSnapshots(-1)
+		err = h.recoverSegments(ctx, segmentInfos, nil)
+	}
+	return err
+}
+
+// recoverSegments opens the segments and rebuilds the index from their
+// records, starting from snap's entries if it isn't nil. It fails with
+// errSnapshotStale, having changed nothing snap covers, if a segment is
+// damaged where snap covers it.
+func (h *HashIndex) recoverSegments(ctx context.Context, segmentInfos []segmentInfo, snap *indexSnapshot) error {
+	var totalBytes int64
+	for _, info := range segmentInfos {
+		totalBytes += info.size
+		if snap != nil {
+			totalBytes -= snap.segments[info.id].replayFrom
+		}
+	}
+	progress := common.NewRecoveryTracker(ctx, h.config.OnRecoveryProgress, common.PhaseSegmentScan, 0, totalBytes)
+
 	// Recover all segments
 	recoveredSegments := make([]*segment, 0)
 	latestValues := make(map[string]*indexEntry)
+	segmentsByID := make(map[int]*segment)
+	if snap != nil {
+		latestValues = snap.entries
+	}
+	h.snapshotTaken.Store(-1)
+
+	// Close everything opened so far if recovery is abandoned
+	abort := func(err error) error {
+		for _, seg := range recoveredSegments {
+			seg.close()
+		}
+		return err
+	}
 
 	for i, info := range segmentInfos {
 		// Determine if this will be the active segment (last one)
 		isLastSegment := i == len(segmentInfos)-1
 
-		// Active segment needs O_APPEND for new writes, others are read-only
-		var file *os.File
-		if isLastSegment {
-			// Active segment: needs append capability for new writes
-			file, err = os.OpenFile(info.path, os.O_RDWR|os.O_APPEND, 0644)
-		} else {
-			// Immutable segments: read-only
-			file, err = os.OpenFile(info.path, os.O_RDWR, 0644)
-		}
+		// Records are written at the segment's end, which may come before
+		// the file's, so even the active segment isn't opened for append
+		file, err := h.config.FS.OpenFile(info.path, os.O_RDWR, 0644)
 		if err != nil {
-			return fmt.Errorf("failed to open segment %s: %w", info.path, err)
+			return abort(fmt.Errorf("failed to open segment %s: %w", info.path, err))
 		}
 
 		// Get file size
 		stat, err := file.Stat()
 		if err != nil {
 			file.Close()
-			return fmt.Errorf("failed to stat segment %s: %w", info.path, err)
+			return abort(fmt.Errorf("failed to stat segment %s: %w", info.path, err))
 		}
 
 		seg := newSegment(info.id, info.path, file)
 		seg.size.Store(stat.Size())
+		segmentsByID[seg.id] = seg
+
+		// Records before covered are in the snapshot, or newer ones are,
+		// and the segment's dead bytes count them. Scanning starts where
+		// the snapshot may be missing some.
+		reader := h.newScanReader(seg)
+		offset, covered := int64(0), int64(0)
+		if s, ok := snap.segment(seg.id); ok {
+			offset, covered = s.replayFrom, s.size
+			seg.dead.Store(s.dead)
+			if offset > 0 {
+				key, _, _, err := reader.readRecord(0)
+				seg.preallocated = err == nil && len(key) == 0
+			}
+		}
 
-		// Scan segment and build index
-		offset := int64(0)
+		// Scan segment and build index. A preallocated segment's records
+		// end where the zeros it was preallocated with begin.
 		for offset < stat.Size() {
-			key, _, nextOffset, err := seg.readRecord(offset)
+			if seg.preallocated && reader.zeroAt(offset) {
+				reader.close()
+				if offset < covered {
+					file.Close()
+					return abort(errSnapshotStale)
+				}
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return abort(fmt.Errorf("failed to trim segment %s: %w", info.path, err))
+				}
+				seg.size.Store(offset)
+				break
+			}
+
+			key, value, nextOffset, err := reader.readRecord(offset)
 			if err != nil {
+				reader.close()
 				if err == io.EOF {
 					break
 				}
-				// Corruption detected, truncate at this point
-				fmt.Printf("Warning: corruption in segment %d at offset %d, truncating\n", seg.id, offset)
+				if offset < covered {
+					file.Close()
+					return abort(errSnapshotStale)
+				}
+				if seg.preallocated && err != io.ErrUnexpectedEOF && seg.tornAt(offset) {
+					err = io.ErrUnexpectedEOF
+				}
+				// Torn write or corruption: truncate so new appends don't
+				// land after garbage that would hide them on the next scan
+				if err == io.ErrUnexpectedEOF {
+					fmt.Printf("Warning: torn write in segment %d at offset %d, truncating %d bytes\n", seg.id, offset, stat.Size()-offset)
+				} else {
+					h.corruption.Record(err)
+					fmt.Printf("Warning: corruption in segment %d at offset %d, truncating\n", seg.id, offset)
+				}
 				if err := file.Truncate(offset); err != nil {
-					fmt.Printf("Failed to truncate segment %d: %v\n", seg.id, err)
+					file.Close()
+					return abort(fmt.Errorf("failed to truncate segment %s: %w", info.path, err))
+				}
+				if err := file.Sync(); err != nil {
+					file.Close()
+					return abort(fmt.Errorf("failed to sync segment %s: %w", info.path, err))
 				}
 				seg.size.Store(offset)
 				break
 			}
 
-			// Store latest value for this key
+			// Store latest value for this key; what it supersedes, and a
+			// tombstone itself, is dead
 			recordSize := int32(nextOffset - offset)
-			latestValues[string(key)] = &indexEntry{
-				segmentID: seg.id,
-				offset:    offset,
-				size:      recordSize,
-				timestamp: time.Now().Unix(),
+			if len(key) == 0 {
+				// The marker a preallocated segment starts with
+				seg.preallocated = true
+				if offset >= covered {
+					seg.dead.Add(int64(recordSize))
+				}
+				if err := progress.Add(1, nextOffset-offset); err != nil {
+					reader.close()
+					file.Close()
+					return abort(err)
+				}
+				offset = nextOffset
+				continue
+			}
+			old, ok := latestValues[string(key)]
+			switch {
+			case ok && !old.before(seg.id, offset):
+				// The snapshot has this record or a newer one, which after
+				// covered can only be in a segment it found newer
+				if offset >= covered {
+					seg.dead.Add(int64(recordSize))
+				}
+			default:
+				if ok && offset >= covered {
+					segmentsByID[old.segmentID].dead.Add(int64(old.size))
+				}
+				latestValues[string(key)] = &indexEntry{
+					segmentID: seg.id,
+					offset:    offset,
+					size:      recordSize,
+					timestamp: time.Now().Unix(),
+					deleted:   len(value) == 0,
+				}
+				if len(value) == 0 && offset >= covered {
+					seg.dead.Add(int64(recordSize))
+				}
+			}
+
+			if err := progress.Add(1, nextOffset-offset); err != nil {
+				reader.close()
+				file.Close()
+				return abort(err)
 			}
 
 			offset = nextOffset
 		}
+		reader.close()
+
+		// The active segment gets its preallocated space back
+		if isLastSegment && seg.preallocated && h.config.PreallocateSegments {
+			if err := common.Preallocate(file, h.config.SegmentSizeBytes); err != nil {
+				file.Close()
+				return abort(fmt.Errorf("failed to preallocate segment %s: %w", info.path, err))
+			}
+		}
 
 		recoveredSegments = append(recoveredSegments, seg)
 	}
+	progress.Done()
 
-	// The last segment becomes the active segment
+	// The last segment becomes the first stripe's active segment; the
+	// other stripes start new ones
 	if len(recoveredSegments) > 0 {
 		activeSeg := recoveredSegments[len(recoveredSegments)-1]
-		h.activeSegment.Store(activeSeg)
+		h.stripes[0].active.Store(activeSeg)
 
 		// All others are immutable
 		if len(recoveredSegments) > 1 {
@@ -126,16 +302,23 @@ func (h *HashIndex) recover() error {
 		}
 	}
 
-	// Rebuild index from latest values
+	// Rebuild index from latest values. Tombstones are kept, as they are
+	// while running, so the deleted key count survives a restart.
+	if snap != nil {
+		h.index.presize(snap.shards)
+	}
 	for key, entry := range latestValues {
-		// Skip tombstones
-		if entry.size == 0 {
-			continue
-		}
 		h.index.Put(key, entry)
 	}
 
-	fmt.Printf("Recovered %d segments, %d keys\n", len(recoveredSegments), h.index.Count())
+	if snap != nil {
+		fmt.Printf("Recovered %d segments, %d keys from index snapshot %d and %d bytes of records\n", len(recoveredSegments), h.index.Count(), snap.seq, totalBytes)
+		if totalBytes == 0 {
+			h.snapshotTaken.Store(0) // Nothing to add to the snapshot
+		}
+	} else {
+		fmt.Printf("Recovered %d segments, %d keys\n", len(recoveredSegments), h.index.Count())
+	}
 
 	return nil
 }
@@ -0,0 +1,67 @@
+package hashindex
+
+import (
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// RotateKeys moves the index onto the key provider's current key, after a
+// new one was made current (see common.KeyRing). Active segments are
+// sealed if they use an older key, and the next compaction takes along
+// every sealed segment that does. Stats().StaleKeyFiles counts the
+// segments left. It does nothing without encryption.
+func (h *HashIndex) RotateKeys() error {
+	if err := h.gate.Enter(); err != nil {
+		return err
+	}
+	defer h.gate.Exit()
+
+	if _, ok := h.config.FS.(*common.EncryptedFS); !ok {
+		return nil
+	}
+
+	for _, st := range h.stripes {
+		st.mu.Lock()
+		if seg := st.active.Load(); seg != nil && seg.staleKey(h.config.FS) {
+			if err := h.rotateSegment(st); err != nil {
+				st.mu.Unlock()
+				return err
+			}
+		}
+		st.mu.Unlock()
+	}
+
+	select {
+	case h.compactChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// staleKeyPrefix returns how many of the oldest segments must be compacted
+// to rewrite all those encrypted with an old key
+func (h *HashIndex) staleKeyPrefix(segments []*segment) int {
+	n := 0
+	for i, seg := range segments {
+		if seg.staleKey(h.config.FS) {
+			n = i + 1
+		}
+	}
+	return n
+}
+
+// staleKeyFiles counts the segments still encrypted with an old key
+func (h *HashIndex) staleKeyFiles() int {
+	n := 0
+	for _, seg := range append(h.activeSegments(), *h.segments.Load()...) {
+		if seg.staleKey(h.config.FS) {
+			n++
+		}
+	}
+	return n
+}
+
+// staleKey reports whether the segment's file is encrypted with an old key
+func (s *segment) staleKey(fs common.FS) bool {
+	file := s.file.Load()
+	return file != nil && common.StaleKey(fs, file.File)
+}
@@ -0,0 +1,114 @@
+package hashindex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// maxLookups bounds how many times a Get follows its key to another
+// segment after finding the one it was in gone
+const maxLookups = 3
+
+// repairEntry is called by a Get that found the segment of key's entry
+// stale gone. If the entry has changed since it was read, as when a
+// compaction moved the key in between, the current one is returned.
+// Otherwise the entry is stale, e.g. left by a compaction that missed it:
+// key's latest record is looked for in the segments newer than stale's,
+// and the entry repaired to point at it, or dropped if there is none (the
+// compaction dropped a tombstone). It returns the entry the index then
+// holds, nil if none.
+func (h *HashIndex) repairEntry(key string, stale *indexEntry) (*indexEntry, error) {
+	if current, ok := h.index.Get(key); !ok || current != stale {
+		return current, nil
+	}
+
+	entry, seg, err := h.findLatest([]byte(key), stale.segmentID)
+	if err != nil {
+		return nil, fmt.Errorf("segment %d not found, looking for the key elsewhere: %w", stale.segmentID, err)
+	}
+
+	// A write of the key since wins
+	if !h.index.Replace(key, stale, entry) {
+		current, _ := h.index.Get(key)
+		return current, nil
+	}
+	h.stats.readRepairs.Add(1)
+	if entry == nil {
+		fmt.Printf("Warning: index entry pointed at missing segment %d, key has no newer record, dropped\n", stale.segmentID)
+		return nil, nil
+	}
+
+	// Compaction counted the record dead, as the index pointed elsewhere
+	if !entry.deleted {
+		seg.dead.Add(-int64(entry.size))
+	}
+	fmt.Printf("Warning: index entry pointed at missing segment %d, repaired to segment %d\n", stale.segmentID, entry.segmentID)
+	return entry, nil
+}
+
+// findLatest returns the entry of key's latest record in a segment newer
+// than segment after, and that segment, nil if there is none
+func (h *HashIndex) findLatest(key []byte, after int) (*indexEntry, *segment, error) {
+	newer := h.segmentsNewestFirst(func(seg *segment) bool {
+		return seg.id > after
+	})
+
+	// The newest segment with a record of key has its latest
+	for _, seg := range newer {
+		entry, err := h.findInSegment(seg, key, seg.Size())
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry != nil {
+			return entry, seg, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// segmentsNewestFirst returns the active and sealed segments keep
+// selects, newest first
+func (h *HashIndex) segmentsNewestFirst(keep func(seg *segment) bool) []*segment {
+	var selected []*segment
+	for _, seg := range append(h.activeSegments(), *h.segments.Load()...) {
+		if keep(seg) {
+			selected = append(selected, seg)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].id > selected[j].id
+	})
+	return selected
+}
+
+// findInSegment returns the entry of key's last record in seg before
+// offset end, nil if seg has none
+func (h *HashIndex) findInSegment(seg *segment, key []byte, end int64) (*indexEntry, error) {
+	reader := h.newScanReader(seg)
+	defer reader.close()
+
+	var found *indexEntry
+	for offset := int64(0); offset < end; {
+		k, value, next, err := reader.readRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading segment %d: %w", seg.id, err)
+		}
+		if bytes.Equal(k, key) {
+			found = &indexEntry{
+				segmentID: seg.id,
+				offset:    offset,
+				size:      int32(next - offset),
+				timestamp: time.Now().Unix(),
+				deleted:   len(value) == 0,
+			}
+		}
+		offset = next
+	}
+	return found, nil
+}
@@ -0,0 +1,50 @@
+package hashindex
+
+import (
+	"errors"
+	"io"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// scrub is one pass of the scrubber: it reads every record of every
+// segment, checking its CRC
+func (h *HashIndex) scrub(s *common.Scrubber) {
+	segments := append(append([]*segment(nil), *h.segments.Load()...), h.activeSegments()...)
+
+	for _, seg := range segments {
+		if !h.scrubSegment(seg, s) {
+			return
+		}
+	}
+}
+
+// scrubSegment checks the records of seg written before the pass reached
+// it, quarantining the segment if one is damaged. It returns false if the
+// scrubber is stopping.
+func (h *HashIndex) scrubSegment(seg *segment, s *common.Scrubber) bool {
+	size := seg.Size()
+	reader := h.newScanReader(seg)
+	defer reader.close()
+	for offset := int64(0); offset < size; {
+		_, _, next, err := reader.readRecord(offset)
+		if err == io.ErrUnexpectedEOF {
+			// The record was complete when the pass started
+			err = common.Corruptf(seg.path, "record at offset %d runs past the end of the segment", offset)
+		}
+		if err != nil {
+			// Quarantine moves the file, which must be closed first
+			reader.close()
+			if errors.Is(err, common.ErrCorruption) {
+				h.handleCorruption(err)
+			}
+			// Otherwise compaction closed the segment
+			return true
+		}
+		if !s.Pace(next - offset) {
+			return false
+		}
+		offset = next
+	}
+	return true
+}
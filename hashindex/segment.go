@@ -1,14 +1,16 @@
 package hashindex
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
-	"io"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 // Record format on disk:
@@ -17,27 +19,43 @@ const (
 	headerSize = 4 + 8 + 4 + 4 // crc + timestamp + keysize + valuesize
 )
 
+// preallocMarker is the value of the record a preallocated segment starts
+// with. Its key is empty, as no other record's is. Recovery takes it as
+// the sign that a run of zeros ends the segment's records, rather than
+// damage.
+const preallocMarker = "preallocated"
+
 // segment represents a single data file with reference counting
 type segment struct {
 	id   int
 	path string
 
 	// File handle (protected by atomic operations)
-	file   atomic.Pointer[os.File]
+	file   atomic.Pointer[segmentFile]
 	size   atomic.Int64
+	dead   atomic.Int64 // Bytes of records superseded, and of tombstones
 	closed atomic.Bool
 
+	// preallocated segments start with the marker record and may be
+	// followed by zeros up to their preallocated size
+	preallocated bool
+
 	// Reference counting for safe deletion
 	refCount atomic.Int32
 	mu       sync.RWMutex // Protects file operations
 }
 
-func newSegment(id int, path string, file *os.File) *segment {
+// segmentFile holds a segment's open file, so it can be swapped atomically
+type segmentFile struct {
+	common.File
+}
+
+func newSegment(id int, path string, file common.File) *segment {
 	s := &segment{
 		id:   id,
 		path: path,
 	}
-	s.file.Store(file)
+	s.file.Store(&segmentFile{file})
 	s.refCount.Store(1)
 	return s
 }
@@ -61,8 +79,14 @@ func (s *segment) release() {
 // append writes a key-value pair to the segment
 // Returns: offset, record size, error
 func (s *segment) append(key, value []byte) (int64, int32, error) {
+	return s.appendAt(key, value, time.Now().Unix())
+}
+
+// appendAt is append for a record written at timestamp, in Unix seconds,
+// as compaction rewrites them
+func (s *segment) appendAt(key, value []byte, timestamp int64) (int64, int32, error) {
 	if s.closed.Load() {
-		return 0, 0, fmt.Errorf("segment closed")
+		return 0, 0, errSegmentClosed
 	}
 
 	s.mu.Lock()
@@ -74,49 +98,29 @@ func (s *segment) append(key, value []byte) (int64, int32, error) {
 	}
 
 	// Build record
-	timestamp := time.Now().Unix()
 	keySize := uint32(len(key))
 	valueSize := uint32(len(value))
 	recordSize := headerSize + len(key) + len(value)
 
-	// Calculate CRC (over timestamp, sizes, key, and value)
-	crcData := make([]byte, 0, 8+4+4+len(key)+len(value))
-	tmpBuf := make([]byte, 8)
-
-	binary.LittleEndian.PutUint64(tmpBuf, uint64(timestamp))
-	crcData = append(crcData, tmpBuf...)
-
-	binary.LittleEndian.PutUint32(tmpBuf, keySize)
-	crcData = append(crcData, tmpBuf[:4]...)
-
-	binary.LittleEndian.PutUint32(tmpBuf, valueSize)
-	crcData = append(crcData, tmpBuf[:4]...)
-
-	crcData = append(crcData, key...)
-	crcData = append(crcData, value...)
-
-	crc := crc32.ChecksumIEEE(crcData)
+	// Encode the record into a pooled buffer, so it goes out in one write
+	buf := recordBuffers.Get(recordSize)
+	defer recordBuffers.Put(buf)
+	record := *buf
+	binary.LittleEndian.PutUint64(record[4:12], uint64(timestamp))
+	binary.LittleEndian.PutUint32(record[12:16], keySize)
+	binary.LittleEndian.PutUint32(record[16:20], valueSize)
+	copy(record[headerSize:], key)
+	copy(record[headerSize+len(key):], value)
 
-	// Write record
-	header := make([]byte, headerSize)
-	binary.LittleEndian.PutUint32(header[0:4], crc)
-	binary.LittleEndian.PutUint64(header[4:12], uint64(timestamp))
-	binary.LittleEndian.PutUint32(header[12:16], keySize)
-	binary.LittleEndian.PutUint32(header[16:20], valueSize)
+	// The CRC covers everything after it
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
 
 	offset := s.size.Load()
 
-	// Write header
-	if _, err := file.Write(header); err != nil {
-		return 0, 0, err
-	}
-
-	// Write key and value
-	if _, err := file.Write(key); err != nil {
-		return 0, 0, err
-	}
-
-	if _, err := file.Write(value); err != nil {
+	// Write at the segment's end rather than the file's, which is further
+	// on in a preallocated segment. A failed write leaves the size as it
+	// was, so the next record overwrites whatever made it to the file.
+	if _, err := file.WriteAt(record, offset); err != nil {
 		return 0, 0, err
 	}
 
@@ -124,14 +128,51 @@ func (s *segment) append(key, value []byte) (int64, int32, error) {
 	return offset, int32(recordSize), nil
 }
 
-// read reads a record at the given offset
+// read reads a record at the given offset, checking its CRC if verify is
+// set
 // Returns the value (key is in the index)
-func (s *segment) read(offset int64) ([]byte, error) {
+func (s *segment) read(offset int64, verify bool) ([]byte, error) {
+	var value []byte
+	err := s.readValue(offset, verify, func(v []byte) error {
+		value = bytes.Clone(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// errSegmentClosed is returned by reads of a segment closed since it was
+// found, e.g. by a compaction that replaced it
+var errSegmentClosed = errors.New("segment closed")
+
+// recordBuffers holds the buffers records are encoded into by append and
+// read into by readValue. Buffers over 64KB aren't kept.
+var recordBuffers = common.NewBufferPool(64 << 10)
+
+// readValue reads a record at the given offset like read, into a pooled
+// buffer, and calls fn with the value, which is only valid during fn. The
+// segment is held open until fn returns.
+func (s *segment) readValue(offset int64, verify bool, fn func(value []byte) error) error {
 	if !s.acquire() {
-		return nil, fmt.Errorf("segment closed")
+		return errSegmentClosed
 	}
 	defer s.release()
 
+	buf := recordBuffers.Get(headerSize)
+	defer recordBuffers.Put(buf)
+
+	value, err := s.readInto(buf, offset, verify)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+// readInto reads the record at the given offset into *buf, growing it if
+// needed, and returns its value as a slice of it
+func (s *segment) readInto(buf *[]byte, offset int64, verify bool) ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -141,113 +182,95 @@ func (s *segment) read(offset int64) ([]byte, error) {
 	}
 
 	// Read header
-	header := make([]byte, headerSize)
+	if cap(*buf) < headerSize {
+		*buf = make([]byte, headerSize)
+	}
+	header := (*buf)[:headerSize]
 	if _, err := file.ReadAt(header, offset); err != nil {
 		return nil, err
 	}
 
 	crcStored := binary.LittleEndian.Uint32(header[0:4])
-	timestamp := binary.LittleEndian.Uint64(header[4:12])
 	keySize := binary.LittleEndian.Uint32(header[12:16])
 	valueSize := binary.LittleEndian.Uint32(header[16:20])
 
+	// Garbage sizes would otherwise turn into huge allocations
+	if offset+headerSize+int64(keySize)+int64(valueSize) > s.size.Load() {
+		return nil, common.Corruptf(s.path, "record at offset %d runs past the end of the segment", offset)
+	}
+
 	// Read key and value
-	data := make([]byte, keySize+valueSize)
-	if _, err := file.ReadAt(data, offset+headerSize); err != nil {
+	size := headerSize + int(keySize) + int(valueSize)
+	if cap(*buf) < size {
+		grown := make([]byte, size)
+		copy(grown, header)
+		*buf = grown
+	}
+	record := (*buf)[:size]
+	if _, err := file.ReadAt(record[headerSize:], offset+headerSize); err != nil {
 		return nil, err
 	}
 
-	// Verify CRC
-	crcData := make([]byte, 0, 8+4+4+len(data))
-	tmpBuf := make([]byte, 8)
-
-	binary.LittleEndian.PutUint64(tmpBuf, timestamp)
-	crcData = append(crcData, tmpBuf...)
-
-	binary.LittleEndian.PutUint32(tmpBuf, keySize)
-	crcData = append(crcData, tmpBuf[:4]...)
-
-	binary.LittleEndian.PutUint32(tmpBuf, valueSize)
-	crcData = append(crcData, tmpBuf[:4]...)
-
-	crcData = append(crcData, data...)
-
-	crcCalculated := crc32.ChecksumIEEE(crcData)
-	if crcCalculated != crcStored {
-		return nil, fmt.Errorf("CRC mismatch: stored=%x calculated=%x", crcStored, crcCalculated)
+	// The CRC covers everything after it
+	if verify {
+		crcCalculated := crc32.Update(crc32.ChecksumIEEE(record[4:headerSize]), crc32.IEEETable, record[headerSize:])
+		if crcCalculated != crcStored {
+			return nil, common.Corruptf(s.path, "record at offset %d: CRC mismatch: stored=%x calculated=%x", offset, crcStored, crcCalculated)
+		}
 	}
 
 	// Return value (skip key)
-	value := data[keySize:]
-	return value, nil
+	return record[headerSize+int(keySize):], nil
 }
 
 // readRecord reads a complete record (key and value) at the given offset
 // Returns: key, value, next offset, error
-// Used during compaction and recovery
+// Used to read single records; compaction, recovery and the scrubber go
+// through a segmentReader
 func (s *segment) readRecord(offset int64) ([]byte, []byte, int64, error) {
-	if !s.acquire() {
-		return nil, nil, 0, fmt.Errorf("segment closed")
-	}
-	defer s.release()
-
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	r := s.newReader(0, false)
+	defer r.close()
+	return r.readRecord(offset)
+}
 
+// zeroAt reports whether the record header at offset is all zeros, as
+// the unwritten part of a preallocated segment is
+func (s *segment) zeroAt(offset int64) bool {
 	file := s.file.Load()
 	if file == nil {
-		return nil, nil, 0, fmt.Errorf("segment file closed")
+		return false
 	}
-
-	// Read header
 	header := make([]byte, headerSize)
-	n, err := file.ReadAt(header, offset)
-	if err != nil {
-		if err == io.EOF && n == 0 {
-			return nil, nil, 0, io.EOF
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return false
+	}
+	for _, b := range header {
+		if b != 0 {
+			return false
 		}
-		return nil, nil, 0, err
 	}
+	return true
+}
 
-	crcStored := binary.LittleEndian.Uint32(header[0:4])
-	timestamp := binary.LittleEndian.Uint64(header[4:12])
-	keySize := binary.LittleEndian.Uint32(header[12:16])
-	valueSize := binary.LittleEndian.Uint32(header[16:20])
-
-	// Read key and value
-	data := make([]byte, keySize+valueSize)
-	if _, err := file.ReadAt(data, offset+headerSize); err != nil {
-		return nil, nil, 0, err
+// tornAt reports whether the damaged record at offset in a preallocated
+// segment was its last, cut short by a crash: only zeros follow it
+func (s *segment) tornAt(offset int64) bool {
+	file := s.file.Load()
+	if file == nil {
+		return false
 	}
-
-	// Verify CRC
-	crcData := make([]byte, 0, 8+4+4+len(data))
-	tmpBuf := make([]byte, 8)
-
-	binary.LittleEndian.PutUint64(tmpBuf, timestamp)
-	crcData = append(crcData, tmpBuf...)
-
-	binary.LittleEndian.PutUint32(tmpBuf, keySize)
-	crcData = append(crcData, tmpBuf[:4]...)
-
-	binary.LittleEndian.PutUint32(tmpBuf, valueSize)
-	crcData = append(crcData, tmpBuf[:4]...)
-
-	crcData = append(crcData, data...)
-
-	crcCalculated := crc32.ChecksumIEEE(crcData)
-	if crcCalculated != crcStored {
-		return nil, nil, 0, fmt.Errorf("CRC mismatch")
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return false
 	}
-
-	key := data[:keySize]
-	value := data[keySize:]
-	nextOffset := offset + headerSize + int64(keySize) + int64(valueSize)
-
-	return key, value, nextOffset, nil
+	keySize := binary.LittleEndian.Uint32(header[12:16])
+	valueSize := binary.LittleEndian.Uint32(header[16:20])
+	end := offset + headerSize + int64(keySize) + int64(valueSize)
+	return end >= s.size.Load() || s.zeroAt(end)
 }
 
-// sync ensures all data is persisted to disk
+// sync ensures all data is persisted to disk. A preallocated segment's
+// size doesn't change as records are appended, so only its data is.
 func (s *segment) sync() error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -257,9 +280,30 @@ func (s *segment) sync() error {
 		return fmt.Errorf("segment file closed")
 	}
 
+	if s.preallocated {
+		return common.Datasync(file)
+	}
 	return file.Sync()
 }
 
+// seal trims a preallocated segment that will take no more records to the
+// records it holds. Trimming isn't synced: after a crash, recovery finds
+// the records' end by the zeros that follow them either way.
+func (s *segment) seal() error {
+	if !s.preallocated {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.file.Load()
+	if file == nil {
+		return fmt.Errorf("segment file closed")
+	}
+	return file.Truncate(s.size.Load())
+}
+
 // closeFile closes the segment file (internal)
 func (s *segment) closeFile() {
 	if s.closed.Swap(true) {
@@ -0,0 +1,175 @@
+package hashindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// segmentReader reads a segment's records in order, as compaction,
+// recovery and the scrubber do. Read record by record, each takes a
+// ReadAt for its header and another for its key and value; a reader with
+// readAhead reads that many bytes at once and serves the records in them
+// from memory, and a mapped reader reads the segment's mapping. The
+// segment is held open until close.
+type segmentReader struct {
+	seg       *segment
+	readAhead int
+	held      bool // A reference to seg is held
+
+	buf      []byte // File data from bufStart, or the whole mapping
+	bufStart int64
+	unmap    func() error // Set when buf is a mapping
+
+	timestamp int64 // Of the record readRecord last read
+}
+
+// newReader returns a reader of s reading readAhead bytes at once (<= 0 =
+// record by record), or from a mapping of the file if mmap is set and it
+// can be mapped
+func (s *segment) newReader(readAhead int, mmap bool) *segmentReader {
+	r := &segmentReader{seg: s, readAhead: readAhead}
+	if !s.acquire() {
+		return r // readRecord reports the segment closed
+	}
+	r.held = true
+
+	if mmap {
+		s.mu.RLock()
+		if file := s.file.Load(); file != nil {
+			if data, unmap, err := common.Mmap(file.File, s.size.Load()); err == nil {
+				r.buf, r.unmap = data, unmap
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return r
+}
+
+// close unmaps the segment and lets it be closed
+func (r *segmentReader) close() {
+	if r.unmap != nil {
+		r.unmap()
+		r.unmap, r.buf = nil, nil
+	}
+	if r.held {
+		r.held = false
+		r.seg.release()
+	}
+}
+
+// readRecord reads the complete record at offset, checking its CRC, and
+// returns its key and value and the offset of the next record. The end of
+// the segment is io.EOF, and a record cut short io.ErrUnexpectedEOF.
+func (r *segmentReader) readRecord(offset int64) ([]byte, []byte, int64, error) {
+	if !r.held {
+		return nil, nil, 0, errSegmentClosed
+	}
+
+	header, err := r.bytes(offset, headerSize)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	crcStored := binary.LittleEndian.Uint32(header[0:4])
+	timestamp := int64(binary.LittleEndian.Uint64(header[4:12]))
+	keySize := binary.LittleEndian.Uint32(header[12:16])
+	valueSize := binary.LittleEndian.Uint32(header[16:20])
+
+	// A record running past the end of the segment was never fully written.
+	// Checking before reading also stops garbage sizes from a torn header
+	// turning into huge allocations.
+	end := offset + headerSize + int64(keySize) + int64(valueSize)
+	if end > r.seg.size.Load() {
+		return nil, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	// The CRC covers the rest of the header, key and value. The header is
+	// checked first, as reading the data may reuse the buffer it is in.
+	crc := crc32.ChecksumIEEE(header[4:])
+	data, err := r.bytes(offset+headerSize, int(keySize+valueSize))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if crc32.Update(crc, crc32.IEEETable, data) != crcStored {
+		return nil, nil, 0, common.Corruptf(r.seg.path, "record at offset %d: CRC mismatch", offset)
+	}
+
+	// Callers keep records, which mustn't pin the buffer or the mapping
+	data = bytes.Clone(data)
+	r.timestamp = timestamp
+	return data[:keySize], data[keySize:], end, nil
+}
+
+// zeroAt reports whether the record header at offset is all zeros, as
+// the unwritten part of a preallocated segment is
+func (r *segmentReader) zeroAt(offset int64) bool {
+	header, err := r.bytes(offset, headerSize)
+	if err != nil {
+		return false
+	}
+	for _, b := range header {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bytes returns the n bytes of the file at offset, from the buffer or the
+// mapping where they are in it, and otherwise read into the buffer along
+// with the readAhead bytes after offset. It returns io.EOF if the file
+// ends at offset, and io.ErrUnexpectedEOF if it ends before offset+n. An
+// error reading ahead, past the n bytes, is left for the read that needs
+// those bytes.
+func (r *segmentReader) bytes(offset int64, n int) ([]byte, error) {
+	if start := offset - r.bufStart; start >= 0 && start+int64(n) <= int64(len(r.buf)) {
+		return r.buf[start : start+int64(n)], nil
+	}
+	if r.unmap != nil {
+		// Written after the segment was mapped
+		return r.readAt(make([]byte, n), offset)
+	}
+
+	size := max(n, r.readAhead)
+	if cap(r.buf) < size {
+		r.buf = make([]byte, size)
+	}
+	data, err := r.readAt(r.buf[:size], offset)
+	r.buf, r.bufStart = data, offset
+	if len(data) >= n {
+		return data[:n], nil
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// readAt reads buf at offset, returning what was read: all of buf, or
+// less with io.EOF if the file ends before (io.ErrUnexpectedEOF if it
+// ends after offset), or less with the error that stopped it, such as a
+// damaged block of an encrypted file past the bytes that did read
+func (r *segmentReader) readAt(buf []byte, offset int64) ([]byte, error) {
+	r.seg.mu.RLock()
+	defer r.seg.mu.RUnlock()
+
+	file := r.seg.file.Load()
+	if file == nil {
+		return nil, fmt.Errorf("segment file closed")
+	}
+	n, err := file.ReadAt(buf, offset)
+	if err == io.EOF {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		return buf[:n], io.ErrUnexpectedEOF
+	}
+	return buf[:n], err
+}
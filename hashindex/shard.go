@@ -1,103 +1,346 @@
 package hashindex
 
 import (
+	"fmt"
 	"hash/fnv"
 	"runtime"
 	"sync"
 	"sync/atomic"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 const (
-	// Number of shards for the index map (power of 2 for efficient modulo)
-	numShards = 256
-	shardMask = numShards - 1
+	// Number of shards the index map starts with by default, and the most
+	// it grows to (powers of 2 for efficient modulo)
+	defaultShards = 256
+	maxShards     = 1 << 16
+
+	// indexEntryOverhead approximates the memory of one index entry beyond
+	// its key bytes: map slot, string header, pointer and indexEntry
+	indexEntryOverhead = 80
 )
 
+// indexEntryMemory is the approximate memory held by key's index entry
+func indexEntryMemory(key string) int64 {
+	return int64(len(key)) + indexEntryOverhead
+}
+
 // indexEntry represents a key's location in a segment
 type indexEntry struct {
 	segmentID int
 	offset    int64
 	size      int32
 	timestamp int64
+	deleted   bool // The record is a tombstone
 }
 
 // shard is a single partition of the index map
 type shard struct {
 	mu      sync.RWMutex
 	entries map[string]*indexEntry
+	movedTo *shardTable // Set once its entries moved to a larger table
 }
 
-// shardedIndex is a concurrent hash map with fine-grained locking
-type shardedIndex struct {
-	shards [numShards]*shard
-	count  atomic.Int64 // Total number of keys
+// shardTable is the shards of the index map. A key is in the shard its
+// hash masked with mask picks.
+type shardTable struct {
+	shards []*shard
+	mask   uint32
 }
 
-func newShardedIndex() *shardedIndex {
-	si := &shardedIndex{}
-	for i := 0; i < numShards; i++ {
-		si.shards[i] = &shard{
+func newShardTable(n int) *shardTable {
+	t := &shardTable{shards: make([]*shard, n), mask: uint32(n - 1)}
+	for i := range t.shards {
+		t.shards[i] = &shard{
 			entries: make(map[string]*indexEntry),
 		}
 	}
+	return t
+}
+
+// shardedIndex is a concurrent hash map with fine-grained locking. It
+// doubles its shard count in the background once shards hold
+// maxPerShard entries on average, so a very large index keeps short
+// lock queues and small maps. Gets and Puts go on while it grows: the
+// shards are moved one at a time, and an operation that finds its shard
+// moved retries in the new table.
+type shardedIndex struct {
+	table   atomic.Pointer[shardTable]
+	count   atomic.Int64 // Live keys
+	deleted atomic.Int64 // Keys whose latest record is a tombstone
+	bytes   atomic.Int64 // Approximate memory held by entries
+
+	memory *common.MemoryAccountant // Charged as entries come and go (optional)
+
+	// Operations on every shard hold resizeMu read-locked, and growing
+	// holds it locked, so they see one table whose shards all hold their
+	// entries
+	resizeMu    sync.RWMutex
+	maxPerShard int64 // Grow beyond this many entries per shard (0 = never)
+	growing     atomic.Bool
+	growWg      sync.WaitGroup
+}
+
+// newShardedIndex returns an index of shards shards, rounded up to a power
+// of 2 (0 = defaultShards), which grows once they hold maxPerShard
+// entries on average (0 = never)
+func newShardedIndex(shards int, maxPerShard int64) *shardedIndex {
+	n := defaultShards
+	if shards > 0 {
+		n = 1
+		for n < min(shards, maxShards) {
+			n <<= 1
+		}
+	}
+	si := &shardedIndex{maxPerShard: maxPerShard}
+	si.table.Store(newShardTable(n))
 	return si
 }
 
-// getShard returns the shard for a given key
-func (si *shardedIndex) getShard(key string) *shard {
+// keyHash returns the hash that picks key's shard
+func keyHash(key string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(key))
-	hash := h.Sum32()
-	return si.shards[hash&shardMask]
+	return h.Sum32()
+}
+
+// lockShard returns key's shard locked, for writing if write is set
+func (si *shardedIndex) lockShard(key string, write bool) *shard {
+	hash := keyHash(key)
+	t := si.table.Load()
+	for {
+		shard := t.shards[hash&t.mask]
+		if write {
+			shard.mu.Lock()
+		} else {
+			shard.mu.RLock()
+		}
+		if shard.movedTo == nil {
+			return shard
+		}
+		t = shard.movedTo
+		if write {
+			shard.mu.Unlock()
+		} else {
+			shard.mu.RUnlock()
+		}
+	}
+}
+
+// Shards returns the current shard count
+func (si *shardedIndex) Shards() int {
+	return len(si.table.Load().shards)
 }
 
 func (si *shardedIndex) Get(key string) (*indexEntry, bool) {
-	shard := si.getShard(key)
-	shard.mu.RLock()
+	shard := si.lockShard(key, false)
 	defer shard.mu.RUnlock()
 	entry, exists := shard.entries[key]
 	return entry, exists
 }
 
-func (si *shardedIndex) Put(key string, entry *indexEntry) {
-	shard := si.getShard(key)
-	shard.mu.Lock()
-	_, existed := shard.entries[key]
+// Put sets key's entry and returns the one it replaces, nil if none
+func (si *shardedIndex) Put(key string, entry *indexEntry) *indexEntry {
+	shard := si.lockShard(key, true)
+	old, existed := shard.entries[key]
 	shard.entries[key] = entry
 	shard.mu.Unlock()
 
-	if !existed {
-		si.count.Add(1)
+	si.tally(entry, 1)
+	if existed {
+		si.tally(old, -1)
+	} else {
+		si.charge(indexEntryMemory(key))
+		si.maybeGrow()
 	}
+	return old
 }
 
 func (si *shardedIndex) Delete(key string) bool {
-	shard := si.getShard(key)
-	shard.mu.Lock()
-	_, existed := shard.entries[key]
+	shard := si.lockShard(key, true)
+	old, existed := shard.entries[key]
 	delete(shard.entries, key)
 	shard.mu.Unlock()
 
 	if existed {
-		si.count.Add(-1)
+		si.tally(old, -1)
+		si.charge(-indexEntryMemory(key))
 	}
 	return existed
 }
 
-// Count returns the total number of keys
+// Replace sets key's entry to entry, or deletes it if entry is nil, if it
+// is still old, and reports whether it was
+func (si *shardedIndex) Replace(key string, old, entry *indexEntry) bool {
+	shard := si.lockShard(key, true)
+	if current, ok := shard.entries[key]; !ok || current != old {
+		shard.mu.Unlock()
+		return false
+	}
+	if entry == nil {
+		delete(shard.entries, key)
+	} else {
+		shard.entries[key] = entry
+	}
+	shard.mu.Unlock()
+
+	si.tally(old, -1)
+	if entry == nil {
+		si.charge(-indexEntryMemory(key))
+	} else {
+		si.tally(entry, 1)
+	}
+	return true
+}
+
+// tally adds n entries like entry to the live or deleted key count
+func (si *shardedIndex) tally(entry *indexEntry, n int64) {
+	if entry.deleted {
+		si.deleted.Add(n)
+	} else {
+		si.count.Add(n)
+	}
+}
+
+// charge adjusts the tracked index memory by n bytes
+func (si *shardedIndex) charge(n int64) {
+	si.bytes.Add(n)
+	if si.memory == nil {
+		return
+	}
+	if n > 0 {
+		si.memory.Charge(common.MemIndex, n)
+	} else {
+		si.memory.Release(common.MemIndex, -n)
+	}
+}
+
+// Count returns the number of live keys
 func (si *shardedIndex) Count() int64 {
 	return si.count.Load()
 }
 
+// Deleted returns the number of keys whose latest record is a tombstone
+func (si *shardedIndex) Deleted() int64 {
+	return si.deleted.Load()
+}
+
+// maybeGrow starts doubling the shard count in the background if the
+// shards are full, and keeps doubling it while they still are
+func (si *shardedIndex) maybeGrow() {
+	if !si.full() || !si.growing.CompareAndSwap(false, true) {
+		return
+	}
+	si.growWg.Add(1)
+	go func() {
+		defer si.growWg.Done()
+		defer si.growing.Store(false)
+		for si.full() {
+			si.grow()
+		}
+	}()
+}
+
+// full reports whether the shards hold more than maxPerShard entries on
+// average, and there may be more of them
+func (si *shardedIndex) full() bool {
+	n := int64(si.Shards())
+	return si.maxPerShard > 0 && n < maxShards && si.count.Load()+si.deleted.Load() > n*si.maxPerShard
+}
+
+// grow doubles the shard count. Old shard i splits into new shards i and
+// i+n; each is moved under its lock and then marked moved, so operations
+// on it before then are carried over and ones after retry in the new
+// table.
+func (si *shardedIndex) grow() {
+	si.resizeMu.Lock()
+	defer si.resizeMu.Unlock()
+
+	old := si.table.Load()
+	n := len(old.shards)
+	next := newShardTable(2 * n)
+	for i, shard := range old.shards {
+		shard.mu.Lock()
+		low, high := next.shards[i], next.shards[i+n]
+		for key, entry := range shard.entries {
+			if keyHash(key)&next.mask == uint32(i) {
+				low.entries[key] = entry
+			} else {
+				high.entries[key] = entry
+			}
+		}
+		shard.entries = nil
+		shard.movedTo = next
+		shard.mu.Unlock()
+	}
+	si.table.Store(next)
+	fmt.Printf("Index grown to %d shards for %d keys\n", 2*n, si.count.Load()+si.deleted.Load())
+}
+
+// presize gives an index that is still empty n shards, e.g. the count an
+// index snapshot was taken with, rather than growing step by step to it
+func (si *shardedIndex) presize(n int) {
+	if n <= si.Shards() || n > maxShards || n&(n-1) != 0 || si.count.Load()+si.deleted.Load() > 0 {
+		return
+	}
+	si.table.Store(newShardTable(n))
+}
+
+// wait waits for the index to finish growing
+func (si *shardedIndex) wait() {
+	si.growWg.Wait()
+}
+
+// forEachShard calls fn with each shard, while the index can't grow
+func (si *shardedIndex) forEachShard(fn func(s *shard)) {
+	si.resizeMu.RLock()
+	defer si.resizeMu.RUnlock()
+	for _, shard := range si.table.Load().shards {
+		fn(shard)
+	}
+}
+
+// DeleteSegment removes every entry pointing into the given segment and
+// returns how many of them were live keys
+func (si *shardedIndex) DeleteSegment(segmentID int) int {
+	dropped := 0
+	si.forEachShard(func(shard *shard) {
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if entry.segmentID == segmentID {
+				delete(shard.entries, key)
+				si.tally(entry, -1)
+				si.charge(-indexEntryMemory(key))
+				if !entry.deleted {
+					dropped++
+				}
+			}
+		}
+		shard.mu.Unlock()
+	})
+	return dropped
+}
+
 // UpdateBatch atomically updates multiple entries
-// Used during compaction to replace entries for compacted segments
-func (si *shardedIndex) UpdateBatch(updates map[string]*indexEntry, deletions []string) {
+// Used during compaction to replace entries for compacted segments. With
+// from set, a key is only updated or deleted while its entry still points
+// into one of those segments, so a write that raced with the compaction
+// wins; the sizes of the updates left out are returned, but for those of
+// tombstones.
+func (si *shardedIndex) UpdateBatch(updates map[string]*indexEntry, deletions []string, from map[int]bool) (skipped int64) {
 
 	type batchOp struct {
 		updates   map[string]*indexEntry
 		deletions []string
 	}
 
+	// The table can't change while the batch is applied
+	si.resizeMu.RLock()
+	defer si.resizeMu.RUnlock()
+	table := si.table.Load()
+	numShards := len(table.shards)
+
 	shardOps := make([]batchOp, numShards)
 	for i := 0; i < numShards; i++ {
 		shardOps[i].updates = make(map[string]*indexEntry)
@@ -106,23 +349,17 @@ func (si *shardedIndex) UpdateBatch(updates map[string]*indexEntry, deletions []
 
 	// Distribute operations to shards
 	for k, v := range updates {
-		h := fnv.New32a()
-		h.Write([]byte(k))
-		hash := h.Sum32()
-		idx := hash & shardMask
+		idx := keyHash(k) & table.mask
 		shardOps[idx].updates[k] = v
 	}
 
 	for _, k := range deletions {
-		h := fnv.New32a()
-		h.Write([]byte(k))
-		hash := h.Sum32()
-		idx := hash & shardMask
+		idx := keyHash(k) & table.mask
 		shardOps[idx].deletions = append(shardOps[idx].deletions, k)
 	}
 
-	// Apply operations in parallel with atomic counter
-	var deltaCount atomic.Int64
+	// Apply operations in parallel with atomic counters
+	var deltaCount, deltaDeleted, deltaBytes, deltaSkipped atomic.Int64
 	wg := sync.WaitGroup{}
 	for i := 0; i < numShards; i++ {
 		wg.Add(1)
@@ -132,30 +369,53 @@ func (si *shardedIndex) UpdateBatch(updates map[string]*indexEntry, deletions []
 			shard.mu.Lock()
 			defer shard.mu.Unlock()
 
-			localDelta := int64(0)
+			localCount := int64(0)
+			localDeleted := int64(0)
+			localBytes := int64(0)
+			localSkipped := int64(0)
+			tally := func(e *indexEntry, n int64) {
+				if e.deleted {
+					localDeleted += n
+				} else {
+					localCount += n
+				}
+			}
 
 			// Apply updates
 			for k, v := range shardOps.updates {
-				_, existed := shard.entries[k]
+				old, existed := shard.entries[k]
+				if from != nil && (!existed || !from[old.segmentID]) {
+					// Tombstones were counted dead when written
+					if !v.deleted {
+						localSkipped += int64(v.size)
+					}
+					continue
+				}
 				shard.entries[k] = v
-				if !existed {
-					localDelta++
+				tally(v, 1)
+				if existed {
+					tally(old, -1)
+				} else {
+					localBytes += indexEntryMemory(k)
 				}
 			}
 
 			// Apply deletions
 			for _, k := range shardOps.deletions {
-				_, existed := shard.entries[k]
-				delete(shard.entries, k)
-				if existed {
-					localDelta--
+				old, existed := shard.entries[k]
+				if !existed || (from != nil && !from[old.segmentID]) {
+					continue
 				}
+				delete(shard.entries, k)
+				tally(old, -1)
+				localBytes -= indexEntryMemory(k)
 			}
 
-			if localDelta != 0 {
-				deltaCount.Add(localDelta)
-			}
-		}(si.shards[i], &shardOps[i])
+			deltaCount.Add(localCount)
+			deltaDeleted.Add(localDeleted)
+			deltaBytes.Add(localBytes)
+			deltaSkipped.Add(localSkipped)
+		}(table.shards[i], &shardOps[i])
 
 		// Yield to other goroutines every few shards
 		if i%16 == 0 {
@@ -165,4 +425,7 @@ func (si *shardedIndex) UpdateBatch(updates map[string]*indexEntry, deletions []
 
 	wg.Wait()
 	si.count.Add(deltaCount.Load())
+	si.deleted.Add(deltaDeleted.Load())
+	si.charge(deltaBytes.Load())
+	return deltaSkipped.Load()
 }
@@ -0,0 +1,531 @@
+package hashindex
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Index snapshots are written to a manifest, index-<seq>.manifest, and
+// part files, index-<seq>-<part>.part, each holding the entries of the
+// shards numbered part modulo the part count.
+//
+// A snapshot is taken while writes go on, between two cuts: moments no
+// write is between appending its record and indexing it. The entries
+// copied between them hold every record before the first cut, and some
+// records after it, all before the second, so the manifest records both
+// offsets for each segment. Recovery loads the entries and scans each
+// segment from its first cut offset: records before the second are
+// indexed if newer than the snapshot's entry for their key, and the
+// segment's dead bytes are those at the second cut; records after it are
+// recovered as without a snapshot.
+//
+// Manifest format: [magic(4)][version(4)][seq(8)][shards(4)][parts(4)]
+// [numSegments(4)]{[id(8)][replayFrom(8)][size(8)][dead(8)]}*[crc32(4)]
+// Part format: [magic(4)][version(4)][numEntries(8)]{[keySize(uvarint)]
+// [key][segmentID(uvarint)][offset(uvarint)][size(uvarint)]
+// [timestamp(varint)][deleted(1)]}*[crc32(4)]
+const (
+	snapshotPrefix         = "index-"
+	snapshotManifestSuffix = ".manifest"
+	snapshotPartSuffix     = ".part"
+	snapshotMagic          = 0x48495853 // "HIXS" in hex
+	snapshotVersion        = 1
+
+	// A snapshot has a part file per snapshotPartEntries entries, and at
+	// most snapshotParts of them
+	snapshotPartEntries = 1 << 16
+	snapshotParts       = 256
+)
+
+// errSnapshotStale means a segment was damaged where an index snapshot
+// covers it, so it no longer matches the snapshot's entries
+var errSnapshotStale = errors.New("segment changed under index snapshot")
+
+// snapshotSegment is a segment as an index snapshot covers it
+type snapshotSegment struct {
+	id         int
+	replayFrom int64 // Records from here on may be missing from the snapshot
+	size       int64 // Records before here were indexed and synced
+	dead       int64 // Dead bytes at size
+}
+
+// indexSnapshot is an index snapshot loaded for recovery
+type indexSnapshot struct {
+	seq      int64
+	shards   int
+	parts    int
+	segments map[int]snapshotSegment
+
+	// Entries of keys in segments found on disk
+	entries map[string]*indexEntry
+}
+
+// SnapshotIndex writes a snapshot of the in-memory index, so the next
+// open loads it and scans only the records written since, instead of
+// every segment in full (see Config.IndexSnapshotInterval). Writes go on
+// while it is taken; a compaction waits for it to copy the index.
+func (h *HashIndex) SnapshotIndex() error {
+	if err := h.gate.Enter(); err != nil {
+		return err
+	}
+	defer h.gate.Exit()
+	return h.snapshotIndex()
+}
+
+// snapshotIndex writes a snapshot and deletes the one it replaces
+func (h *HashIndex) snapshotIndex() error {
+	h.snapshotMu.Lock()
+	defer h.snapshotMu.Unlock()
+
+	// Compaction moves keys to another segment, which a snapshot taken
+	// meanwhile would find some keys in and not others
+	h.compactMu.Lock()
+	writes := h.snapshotWrites()
+	first := h.cutSegments()
+	shards, parts := h.encodeSnapshotParts()
+	segments := h.cutSegments()
+	h.compactMu.Unlock()
+
+	replayFrom := make(map[int]int64, len(first))
+	for _, s := range first {
+		replayFrom[s.id] = s.size
+	}
+	for i := range segments {
+		segments[i].replayFrom = replayFrom[segments[i].id]
+	}
+
+	// Everything the snapshot points at must survive a crash with it
+	for _, s := range segments {
+		seg := h.findSegment(s.id)
+		if seg == nil || !seg.acquire() {
+			continue // Compacted since: recovery won't find it either
+		}
+		err := seg.sync()
+		seg.release()
+		if err != nil {
+			return fmt.Errorf("failed to sync segment %d: %w", s.id, err)
+		}
+	}
+
+	seq := h.snapshotSeq + 1
+	for i, part := range parts {
+		if err := writeSnapshotFile(h.config.FS, h.snapshotPath(seq, i), part, false); err != nil {
+			h.removeSnapshots(h.snapshotSeq)
+			return err
+		}
+	}
+	manifest := encodeSnapshotManifest(seq, shards, len(parts), segments)
+	if err := writeSnapshotFile(h.config.FS, h.snapshotPath(seq, -1), manifest, true); err != nil {
+		h.removeSnapshots(h.snapshotSeq)
+		return err
+	}
+
+	h.snapshotSeq = seq
+	h.snapshotTaken.Store(writes)
+	h.removeSnapshots(seq)
+	return nil
+}
+
+// snapshotWrites counts the changes to the index so far, to tell whether
+// a snapshot would differ from the last
+func (h *HashIndex) snapshotWrites() int64 {
+	return h.stats.writeCount.Load() + h.stats.compactCount.Load()
+}
+
+// snapshotDue reports whether the index changed since the last snapshot,
+// or since it was recovered
+func (h *HashIndex) snapshotDue() bool {
+	return h.snapshotWrites() != h.snapshotTaken.Load()
+}
+
+// cutSegments returns the segments and their sizes at a moment no write
+// is between appending its record and indexing it
+func (h *HashIndex) cutSegments() []snapshotSegment {
+	for i := range h.keyLocks {
+		h.keyLocks[i].Lock()
+	}
+	defer func() {
+		for i := range h.keyLocks {
+			h.keyLocks[i].Unlock()
+		}
+	}()
+	h.segmentsMu.Lock()
+	defer h.segmentsMu.Unlock()
+
+	var segments []snapshotSegment
+	seen := make(map[int]bool)
+	sealed := *h.segments.Load()
+	for _, seg := range append(sealed[:len(sealed):len(sealed)], h.activeSegments()...) {
+		if !seen[seg.id] {
+			seen[seg.id] = true
+			segments = append(segments, snapshotSegment{id: seg.id, size: seg.Size(), dead: seg.dead.Load()})
+		}
+	}
+	return segments
+}
+
+// encodeSnapshotParts encodes the index's entries into part files,
+// returning the shard count too. Each shard is read locked only while its
+// entries are encoded.
+func (h *HashIndex) encodeSnapshotParts() (int, [][]byte) {
+	h.index.resizeMu.RLock()
+	defer h.index.resizeMu.RUnlock()
+	shards := h.index.table.Load().shards
+
+	entries := h.index.count.Load() + h.index.deleted.Load()
+	numParts := (entries + snapshotPartEntries - 1) / snapshotPartEntries
+	parts := make([][]byte, max(1, min(int(numParts), len(shards), snapshotParts)))
+	counts := make([]uint64, len(parts))
+	for i := range parts {
+		parts[i] = make([]byte, 16, 4096)
+	}
+	for i, shard := range shards {
+		p := i % len(parts)
+		shard.mu.RLock()
+		for key, entry := range shard.entries {
+			parts[p] = appendSnapshotEntry(parts[p], key, entry)
+		}
+		counts[p] += uint64(len(shard.entries))
+		shard.mu.RUnlock()
+	}
+
+	for p, part := range parts {
+		binary.LittleEndian.PutUint32(part[0:], snapshotMagic)
+		binary.LittleEndian.PutUint32(part[4:], snapshotVersion)
+		binary.LittleEndian.PutUint64(part[8:], counts[p])
+		parts[p] = binary.LittleEndian.AppendUint32(part, crc32.ChecksumIEEE(part))
+	}
+	return len(shards), parts
+}
+
+// appendSnapshotEntry appends key's entry to a part
+func appendSnapshotEntry(buf []byte, key string, entry *indexEntry) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, uint64(entry.segmentID))
+	buf = binary.AppendUvarint(buf, uint64(entry.offset))
+	buf = binary.AppendUvarint(buf, uint64(entry.size))
+	buf = binary.AppendVarint(buf, entry.timestamp)
+	if entry.deleted {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+// encodeSnapshotManifest returns the contents of a snapshot manifest
+func encodeSnapshotManifest(seq int64, shards, parts int, segments []snapshotSegment) []byte {
+	data := make([]byte, 28, 28+32*len(segments)+4)
+	binary.LittleEndian.PutUint32(data[0:], snapshotMagic)
+	binary.LittleEndian.PutUint32(data[4:], snapshotVersion)
+	binary.LittleEndian.PutUint64(data[8:], uint64(seq))
+	binary.LittleEndian.PutUint32(data[16:], uint32(shards))
+	binary.LittleEndian.PutUint32(data[20:], uint32(parts))
+	binary.LittleEndian.PutUint32(data[24:], uint32(len(segments)))
+	for _, s := range segments {
+		data = binary.LittleEndian.AppendUint64(data, uint64(s.id))
+		data = binary.LittleEndian.AppendUint64(data, uint64(s.replayFrom))
+		data = binary.LittleEndian.AppendUint64(data, uint64(s.size))
+		data = binary.LittleEndian.AppendUint64(data, uint64(s.dead))
+	}
+	return binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+// writeSnapshotFile writes and syncs a snapshot file. The manifest, which
+// makes the snapshot complete, is written under a temporary name and
+// renamed into place.
+func writeSnapshotFile(fs common.FS, path string, data []byte, atomic bool) error {
+	name := path
+	if atomic {
+		name += tmpSuffix
+	}
+	file, err := fs.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %w", filepath.Base(path), err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", filepath.Base(path), err)
+	}
+	if atomic {
+		if err := fs.Rename(name, path); err != nil {
+			return fmt.Errorf("failed to install %s: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// snapshotPath returns the path of snapshot seq's part, or of its
+// manifest for part -1
+func (h *HashIndex) snapshotPath(seq int64, part int) string {
+	if part < 0 {
+		return filepath.Join(h.config.DataDir, fmt.Sprintf("%s%06d%s", snapshotPrefix, seq, snapshotManifestSuffix))
+	}
+	return filepath.Join(h.config.DataDir, fmt.Sprintf("%s%06d-%03d%s", snapshotPrefix, seq, part, snapshotPartSuffix))
+}
+
+// parseSnapshotName returns the sequence number of the snapshot a file
+// belongs to, and whether it is a complete manifest or part
+func parseSnapshotName(name string) (seq int64, complete bool, ok bool) {
+	if !strings.HasPrefix(name, snapshotPrefix) {
+		return 0, false, false
+	}
+	rest := strings.TrimPrefix(name, snapshotPrefix)
+	end := strings.IndexAny(rest, "-.")
+	if end < 0 {
+		return 0, false, false
+	}
+	seq, err := strconv.ParseInt(rest[:end], 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	complete = strings.HasSuffix(name, snapshotManifestSuffix) || strings.HasSuffix(name, snapshotPartSuffix)
+	return seq, complete, true
+}
+
+// removeSnapshots deletes the files of every snapshot but keep, and any
+// written in part
+func (h *HashIndex) removeSnapshots(keep int64) {
+	files, err := h.config.FS.ReadDir(h.config.DataDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		seq, complete, ok := parseSnapshotName(file.Name())
+		if !ok || (seq == keep && complete) {
+			continue
+		}
+		if err := h.config.FS.Remove(filepath.Join(h.config.DataDir, file.Name())); err != nil {
+			fmt.Printf("Warning: failed to delete %s: %v\n", file.Name(), err)
+		}
+	}
+}
+
+// loadSnapshot loads the newest index snapshot from names, the snapshot
+// files in the data directory, keeping the entries of keys in segments
+// that are on disk. It returns nil if there is none or it can't be used,
+// and deletes the files of every other snapshot.
+func (h *HashIndex) loadSnapshot(names []string, segments []segmentInfo) *indexSnapshot {
+	var seq int64 = -1
+	for _, name := range names {
+		if s, _, ok := parseSnapshotName(name); ok {
+			h.snapshotSeq = max(h.snapshotSeq, s)
+			if strings.HasSuffix(name, snapshotManifestSuffix) {
+				seq = max(seq, s)
+			}
+		}
+	}
+	if seq < 0 {
+		h.removeSnapshots(-1)
+		return nil
+	}
+
+	snap, err := h.readSnapshot(seq, segments)
+	if err != nil {
+		fmt.Printf("Warning: not using index snapshot %d: %v\n", seq, err)
+		h.removeSnapshots(-1)
+		return nil
+	}
+	h.removeSnapshots(seq)
+	return snap
+}
+
+// readSnapshot reads snapshot seq, checking it covers no more of a
+// segment than is on disk
+func (h *HashIndex) readSnapshot(seq int64, segments []segmentInfo) (*indexSnapshot, error) {
+	data, err := common.ReadFile(h.config.FS, h.snapshotPath(seq, -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 32 || crc32.ChecksumIEEE(data[:len(data)-4]) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("manifest checksum mismatch")
+	}
+	if binary.LittleEndian.Uint32(data[0:]) != snapshotMagic {
+		return nil, fmt.Errorf("invalid manifest magic number")
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", version)
+	}
+	snap := &indexSnapshot{
+		seq:      int64(binary.LittleEndian.Uint64(data[8:])),
+		shards:   int(binary.LittleEndian.Uint32(data[16:])),
+		parts:    int(binary.LittleEndian.Uint32(data[20:])),
+		segments: make(map[int]snapshotSegment),
+	}
+	numSegments := int(binary.LittleEndian.Uint32(data[24:]))
+	if 28+32*numSegments+4 != len(data) || snap.parts < 1 || snap.parts > snapshotParts {
+		return nil, fmt.Errorf("manifest truncated")
+	}
+
+	// The snapshot's entries are only good for segments it covers that
+	// are still there: others were compacted away or quarantined, and
+	// their keys are recovered from where they went
+	onDisk := make(map[int]int64, len(segments))
+	for _, info := range segments {
+		onDisk[info.id] = info.size
+	}
+	for i := 0; i < numSegments; i++ {
+		pos := 28 + 32*i
+		s := snapshotSegment{
+			id:         int(binary.LittleEndian.Uint64(data[pos:])),
+			replayFrom: int64(binary.LittleEndian.Uint64(data[pos+8:])),
+			size:       int64(binary.LittleEndian.Uint64(data[pos+16:])),
+			dead:       int64(binary.LittleEndian.Uint64(data[pos+24:])),
+		}
+		size, ok := onDisk[s.id]
+		if !ok {
+			continue
+		}
+		if size < s.size {
+			return nil, fmt.Errorf("segment %d is shorter than the snapshot covers", s.id)
+		}
+		snap.segments[s.id] = s
+	}
+
+	// Parts are read in parallel, and their entries then merged
+	parts := make([][]snapshotEntry, snap.parts)
+	errs := make([]error, snap.parts)
+	var wg sync.WaitGroup
+	for p := range parts {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			parts[p], errs[p] = h.readSnapshotPart(h.snapshotPath(seq, p), snap.segments)
+		}(p)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	var total int
+	for _, part := range parts {
+		total += len(part)
+	}
+	snap.entries = make(map[string]*indexEntry, total)
+	for _, part := range parts {
+		for _, e := range part {
+			snap.entries[e.key] = e.entry
+		}
+	}
+	return snap, nil
+}
+
+// segment returns how the snapshot covers segment id; a nil snapshot
+// covers none
+func (snap *indexSnapshot) segment(id int) (snapshotSegment, bool) {
+	if snap == nil {
+		return snapshotSegment{}, false
+	}
+	s, ok := snap.segments[id]
+	return s, ok
+}
+
+// snapshotEntry is a key's entry read from a snapshot part
+type snapshotEntry struct {
+	key   string
+	entry *indexEntry
+}
+
+// readSnapshotPart reads a part's entries, skipping those of segments not
+// in segments
+func (h *HashIndex) readSnapshotPart(path string, segments map[int]snapshotSegment) ([]snapshotEntry, error) {
+	data, err := common.ReadFile(h.config.FS, path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	if len(data) < 20 || crc32.ChecksumIEEE(data[:len(data)-4]) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("%s: checksum mismatch", name)
+	}
+	if binary.LittleEndian.Uint32(data[0:]) != snapshotMagic || binary.LittleEndian.Uint32(data[4:]) != snapshotVersion {
+		return nil, fmt.Errorf("%s: invalid header", name)
+	}
+	count := binary.LittleEndian.Uint64(data[8:])
+	body := data[16 : len(data)-4]
+
+	// Each entry takes at least 6 bytes
+	if count > uint64(len(body))/6 {
+		return nil, fmt.Errorf("%s: truncated", name)
+	}
+	entries := make([]snapshotEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var fields [3]uint64
+		keySize, n := binary.Uvarint(body)
+		if n <= 0 || keySize > uint64(len(body)-n) {
+			return nil, fmt.Errorf("%s: truncated", name)
+		}
+		key := string(body[n : n+int(keySize)])
+		body = body[n+int(keySize):]
+		for f := range fields {
+			if fields[f], n = binary.Uvarint(body); n <= 0 {
+				return nil, fmt.Errorf("%s: truncated", name)
+			}
+			body = body[n:]
+		}
+		timestamp, n := binary.Varint(body)
+		if n <= 0 || len(body) < n+1 {
+			return nil, fmt.Errorf("%s: truncated", name)
+		}
+		deleted := body[n] == 1
+		body = body[n+1:]
+
+		if _, ok := segments[int(fields[0])]; !ok {
+			continue
+		}
+		entries = append(entries, snapshotEntry{key: key, entry: &indexEntry{
+			segmentID: int(fields[0]),
+			offset:    int64(fields[1]),
+			size:      int32(fields[2]),
+			timestamp: timestamp,
+			deleted:   deleted,
+		}})
+	}
+	return entries, nil
+}
+
+// before reports whether the record e points at was written before the one
+// at offset in segment segmentID. Segments are in id order, as recovery
+// scans them.
+func (e *indexEntry) before(segmentID int, offset int64) bool {
+	return e.segmentID < segmentID || (e.segmentID == segmentID && e.offset < offset)
+}
+
+// snapshotWorker writes an index snapshot every IndexSnapshotInterval the
+// index has changed in
+func (h *HashIndex) snapshotWorker() {
+	ticker := time.NewTicker(h.config.IndexSnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stopChan:
+			return
+		case <-ticker.C:
+			if !h.snapshotDue() {
+				continue
+			}
+			h.background.Acquire()
+			err := h.snapshotIndex()
+			h.background.Release()
+			if err != nil {
+				fmt.Printf("index snapshot error: %v\n", err)
+			}
+		}
+	}
+}
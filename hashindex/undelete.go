@@ -0,0 +1,97 @@
+package hashindex
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Undelete restores the value key held before its latest Delete, if that
+// was within UndeleteWindow (see common.Undeleter). It fails with
+// common.ErrKeyNotFound if there is nothing to restore. Compaction keeps
+// the record the tombstone follows while in the window, so it is found
+// on disk, and written again as the key's latest.
+func (h *HashIndex) Undelete(key []byte) error {
+	if len(key) == 0 {
+		return common.ErrKeyEmpty
+	}
+
+	if err := h.gate.Enter(); err != nil {
+		return err
+	}
+	defer h.gate.Exit()
+
+	// No compaction moves the records read below meanwhile. Compactions
+	// take key locks after it, as snapshots do.
+	h.compactMu.Lock()
+	defer h.compactMu.Unlock()
+
+	mu := h.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	notFound := fmt.Errorf("%w: %s has no deleted value to restore", common.ErrKeyNotFound, key)
+	tombstone, exists := h.index.Get(string(key))
+	if !exists || !tombstone.deleted || h.config.UndeleteWindow <= 0 {
+		return notFound
+	}
+	seg := h.findSegment(tombstone.segmentID)
+	if seg == nil {
+		return fmt.Errorf("segment %d not found", tombstone.segmentID)
+	}
+	deletedAt, err := h.recordTime(seg, tombstone.offset)
+	if err != nil {
+		return err
+	}
+	if time.Since(deletedAt) > h.config.UndeleteWindow {
+		return notFound
+	}
+
+	prior, priorSeg, err := h.findBefore(key, tombstone)
+	if err != nil {
+		return err
+	}
+	if prior == nil || prior.deleted {
+		return notFound
+	}
+	value, err := priorSeg.read(prior.offset, true)
+	if err != nil {
+		return err
+	}
+	return h.put(key, value)
+}
+
+// recordTime returns when the record at offset in seg was written
+func (h *HashIndex) recordTime(seg *segment, offset int64) (time.Time, error) {
+	reader := h.newScanReader(seg)
+	defer reader.close()
+	if _, _, _, err := reader.readRecord(offset); err != nil {
+		return time.Time{}, fmt.Errorf("error reading segment %d: %w", seg.id, err)
+	}
+	return time.Unix(reader.timestamp, 0), nil
+}
+
+// findBefore returns the entry of key's record before entry, and the
+// segment it is in, nil if there is none
+func (h *HashIndex) findBefore(key []byte, entry *indexEntry) (*indexEntry, *segment, error) {
+	older := h.segmentsNewestFirst(func(seg *segment) bool {
+		return seg.id <= entry.segmentID
+	})
+
+	// The newest segment with a record of key before entry has it
+	for _, seg := range older {
+		end := seg.Size()
+		if seg.id == entry.segmentID {
+			end = entry.offset
+		}
+		found, err := h.findInSegment(seg, key, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		if found != nil {
+			return found, seg, nil
+		}
+	}
+	return nil, nil, nil
+}
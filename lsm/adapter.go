@@ -34,6 +34,59 @@ func (a *Adapter) Get(key []byte) ([]byte, error) {
 	return value, nil
 }
 
+// GetValue implements common.ValueGetter (see LSM.GetValue)
+func (a *Adapter) GetValue(key []byte, fn func(value []byte) error) error {
+	return a.lsm.GetValue(string(key), fn)
+}
+
+// GetWithMeta implements common.ConditionalWriter (see LSM.GetWithMeta)
+func (a *Adapter) GetWithMeta(key []byte) ([]byte, uint64, error) {
+	value, seq, found, err := a.lsm.GetWithMeta(string(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, common.ErrKeyNotFound
+	}
+	return value, seq, nil
+}
+
+// PutIf implements common.ConditionalWriter (see LSM.PutIf)
+func (a *Adapter) PutIf(key, value []byte, expectedSeq uint64) error {
+	return a.lsm.PutIf(string(key), value, expectedSeq)
+}
+
+// CompareAndSwap implements common.ConditionalWriter (see
+// LSM.CompareAndSwap)
+func (a *Adapter) CompareAndSwap(key, old, value []byte) error {
+	return a.lsm.CompareAndSwap(string(key), old, value)
+}
+
+// Incr implements common.Incrementer (see LSM.Incr)
+func (a *Adapter) Incr(key []byte, delta int64) (int64, error) {
+	return a.lsm.Incr(string(key), delta)
+}
+
+// Append implements common.Appender (see LSM.Append)
+func (a *Adapter) Append(key, suffix []byte) error {
+	return a.lsm.Append(string(key), suffix)
+}
+
+// PutIfAbsent implements common.Inserter (see LSM.PutIfAbsent)
+func (a *Adapter) PutIfAbsent(key, value []byte) (bool, error) {
+	return a.lsm.PutIfAbsent(string(key), value)
+}
+
+// Undelete implements common.Undeleter (see LSM.Undelete)
+func (a *Adapter) Undelete(key []byte) error {
+	return a.lsm.Undelete(string(key))
+}
+
+// Has implements common.StorageEngine
+func (a *Adapter) Has(key []byte) (bool, error) {
+	return a.lsm.Has(string(key))
+}
+
 // Delete implements common.StorageEngine
 func (a *Adapter) Delete(key []byte) error {
 	return a.lsm.Delete(string(key))
@@ -53,10 +106,17 @@ func (a *Adapter) Sync() error {
 func (a *Adapter) Stats() common.Stats {
 	// Calculate statistics
 	totalFiles := a.lsm.levels.GetTotalFiles()
-	totalSize := a.lsm.levels.GetTotalSize()
+	totalSize := a.lsm.levels.GetTotalSize() + a.lsm.vlog.size()
 
-	// Active segment size is the memtable size
+	// Active segment size is the memtable size. A flush may swap the
+	// memtables at any time, so they are read under lsm.mu.
+	a.lsm.mu.RLock()
 	activeSegSize := int64(a.lsm.activeMemtable.Size())
+	memtableKeys := int64(a.lsm.activeMemtable.Len())
+	if a.lsm.immutableMemtable != nil {
+		memtableKeys += int64(a.lsm.immutableMemtable.Len())
+	}
+	a.lsm.mu.RUnlock()
 
 	// Get tracked stats
 	writeCount := a.lsm.stats.writeCount.Load()
@@ -66,10 +126,7 @@ func (a *Adapter) Stats() common.Stats {
 
 	// Calculate approximate number of keys
 	// Count unique keys in active + immutable memtables, plus estimate from SSTables
-	numKeys := int64(a.lsm.activeMemtable.Len())
-	if a.lsm.immutableMemtable != nil {
-		numKeys += int64(a.lsm.immutableMemtable.Len())
-	}
+	numKeys := memtableKeys
 	// Estimate from SSTables (rough approximation: 10k keys per file)
 	numKeys += int64(totalFiles * 10000)
 
@@ -117,6 +174,8 @@ func (a *Adapter) Stats() common.Stats {
 		}
 	}
 
+	bloomMemory, indexMemory := a.lsm.MemoryByLevel()
+
 	return common.Stats{
 		NumKeys:       numKeys,
 		NumSegments:   totalFiles + 1, // +1 for active memtable
@@ -127,9 +186,30 @@ func (a *Adapter) Stats() common.Stats {
 		CompactCount:  compactCount,
 		WriteAmp:      writeAmp,
 		SpaceAmp:      spaceAmp,
+		ReadAmp:       a.lsm.stats.readAmp.Mean(),
+		ReadAmpP99:    a.lsm.stats.readAmp.Percentile(99),
+		HitLocations:  a.lsm.HitLocations(),
+		MemoryUsed:    a.lsm.memory.Used(),
+		MemoryBudget:  a.lsm.memory.Budget(),
+		MemoryUsage:   a.lsm.memory.Usage(),
+		BloomMemory:   bloomMemory,
+		IndexMemory:   indexMemory,
+
+		CorruptionCount: a.lsm.corruption.Count(),
+		Quarantined:     a.lsm.corruption.Files(),
+		ScrubPasses:     a.lsm.scrubber.Passes(),
+		ScrubbedBytes:   a.lsm.scrubber.Scanned(),
+		DiskFullEvents:  a.lsm.disk.Events(),
+		StaleKeyFiles:   a.lsm.staleKeyFiles(),
+		NextFlushReason: a.lsm.NextFlushReason(),
 	}
 }
 
+// Health implements common.StorageEngine
+func (a *Adapter) Health() common.Health {
+	return a.lsm.Health()
+}
+
 // Compact implements common.StorageEngine
 func (a *Adapter) Compact() error {
 	// LSM has automatic compaction, this is a no-op
@@ -137,7 +217,66 @@ func (a *Adapter) Compact() error {
 	return nil
 }
 
-// Scan returns an iterator for range queries (LSM-specific feature)
-func (a *Adapter) Scan(start, end string) Iterator {
-	return a.lsm.Scan(start, end)
+// RotateKeys moves the tree onto the current encryption key (see
+// LSM.RotateKeys)
+func (a *Adapter) RotateKeys() error {
+	return a.lsm.RotateKeys()
+}
+
+// ApproximateSizes estimates the space each key range takes (see
+// LSM.ApproximateSizes)
+func (a *Adapter) ApproximateSizes(ranges []common.KeyRange) []common.RangeSize {
+	return a.lsm.ApproximateSizes(ranges)
+}
+
+// Scan returns an iterator over the keys in [start, end), matching the
+// B-Tree's Scan; a nil end is unbounded
+func (a *Adapter) Scan(start, end []byte) (common.Iterator, error) {
+	iter := a.lsm.Scan(string(start), string(end))
+	if err := iter.Error(); err != nil {
+		iter.Close()
+		return nil, err
+	}
+	return &scanIterator{
+		iter:    iter,
+		end:     string(end),
+		compare: a.lsm.compare,
+	}, nil
+}
+
+// scanIterator adapts an LSM Iterator to common.Iterator, stopping before
+// end (LSM.Scan includes it)
+type scanIterator struct {
+	iter    Iterator
+	end     string
+	compare compareFunc
+	started bool
+}
+
+func (it *scanIterator) Next() bool {
+	if it.started {
+		it.iter.Next()
+	}
+	it.started = true
+
+	if !it.iter.Valid() {
+		return false
+	}
+	return it.end == "" || it.compare(it.iter.Key(), it.end) < 0
+}
+
+func (it *scanIterator) Key() []byte {
+	return []byte(it.iter.Key())
+}
+
+func (it *scanIterator) Value() []byte {
+	return it.iter.Value()
+}
+
+func (it *scanIterator) Error() error {
+	return it.iter.Error()
+}
+
+func (it *scanIterator) Close() error {
+	return it.iter.Close()
 }
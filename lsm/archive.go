@@ -0,0 +1,237 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/common/wal"
+)
+
+// walArchiveDir holds, under the data directory, the WALs replaced while
+// Config.WALArchive is set that haven't been handed to it yet. Each is
+// named <last sequence>-<unix nanoseconds archived>.wal, both zero-padded
+// to 20 digits, so they sort oldest first.
+const walArchiveDir = "wal-archive"
+
+// archiveWAL moves the WAL at walPath, which must be closed, into the
+// archive directory and returns its new path. Caller must hold lsm.mu for
+// writing, so every write numbered so far is in it.
+func (lsm *LSM) archiveWAL(walPath string) (string, error) {
+	dir := filepath.Join(lsm.config.DataDir, walArchiveDir)
+	if err := lsm.config.FS.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create WAL archive directory: %w", err)
+	}
+	name := fmt.Sprintf("%020d-%020d.wal", atomic.LoadUint64(&lsm.sequence), time.Now().UnixNano())
+	path := filepath.Join(dir, name)
+	if err := lsm.config.FS.Rename(walPath, path); err != nil {
+		return "", fmt.Errorf("failed to archive WAL: %w", err)
+	}
+	return path, nil
+}
+
+// parseArchivedWALName returns the last sequence number and archive time
+// an archived WAL's name holds
+func parseArchivedWALName(name string) (uint64, time.Time, bool) {
+	base, ok := strings.CutSuffix(name, ".wal")
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	seqPart, timePart, ok := strings.Cut(base, "-")
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(timePart, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return seq, time.Unix(0, nanos), true
+}
+
+// finishWALArchive completes a WAL reset that a crash interrupted between
+// archiving the old WAL and renaming its replacement into place. The
+// replacement was synced before the old WAL was moved, so with no WAL
+// left it is complete.
+func finishWALArchive(fs common.FS, dataDir string) error {
+	walPath := filepath.Join(dataDir, "wal.log")
+	tmpPath := walPath + ".tmp"
+	if _, err := fs.Stat(walPath); !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := fs.Stat(tmpPath); err != nil {
+		return nil
+	}
+	log.Printf("Completing interrupted WAL archive in %s", dataDir)
+	if err := fs.Rename(tmpPath, walPath); err != nil {
+		return fmt.Errorf("failed to complete WAL archive: %w", err)
+	}
+	return nil
+}
+
+// walArchiveWorker hands archived WALs to Config.WALArchive: any left from
+// before the tree was opened, and then each as a flush archives it
+func (lsm *LSM) walArchiveWorker() {
+
+	// Abandon an archive in progress on Close
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-lsm.closeChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	retry := time.NewTicker(time.Minute)
+	defer retry.Stop()
+
+	for {
+		if err := lsm.shipArchivedWALs(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: failed to archive WAL: %v", err)
+		}
+
+		select {
+		case <-lsm.closeChan:
+			return
+		case <-lsm.walArchived:
+		case <-retry.C:
+		}
+	}
+}
+
+// shipArchivedWALs hands the WALs in the archive directory to
+// Config.WALArchive, oldest first, deleting each once it is archived
+func (lsm *LSM) shipArchivedWALs(ctx context.Context) error {
+	dir := filepath.Join(lsm.config.DataDir, walArchiveDir)
+	entries, err := lsm.config.FS.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		seq, archived, ok := parseArchivedWALName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		err := lsm.config.WALArchive.ArchiveWAL(ctx, common.ArchivedWAL{
+			LastSequence: seq,
+			Archived:     archived,
+			Open: func() (io.ReadCloser, error) {
+				return lsm.config.FS.Open(path)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if err := lsm.config.FS.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RollForward replays archived WALs into a tree restored from a
+// checkpoint in dir (see Checkpoint), which isn't open, bringing it up to
+// the write numbered upTo. wals are the WALs archived since the
+// checkpoint was taken, oldest first; records in them the checkpoint
+// already holds, or numbered past upTo, are skipped. A nil fs means the
+// OS filesystem.
+//
+// The records are appended to dir's WAL, and replayed from it when the
+// tree is next opened. A record pointing into the value log can't be
+// replayed, as the value log isn't archived.
+func RollForward(fs common.FS, dir string, upTo uint64, wals []common.ArchivedWAL) error {
+	fs = common.FSOrDefault(fs)
+	m, err := readManifest(fs, dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("no MANIFEST in %s", dir)
+	}
+	if upTo < m.LastSequence {
+		return fmt.Errorf("checkpoint in %s is at sequence %d, past %d", dir, m.LastSequence, upTo)
+	}
+
+	w, err := openWAL(fs, filepath.Join(dir, "wal.log"), false)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// A WAL replaced after a flush starts with the records of the active
+	// memtable, which the WAL before it also holds
+	replayed := make(map[uint64]bool)
+	tmpPath := filepath.Join(dir, "archived-wal.tmp")
+	defer fs.Remove(tmpPath)
+
+	for _, archived := range wals {
+		if err := copyArchivedWAL(fs, tmpPath, archived); err != nil {
+			return err
+		}
+		l, err := wal.Open(fs, tmpPath, walOptions)
+		if err != nil {
+			return fmt.Errorf("failed to open archived WAL %d: %w", archived.LastSequence, err)
+		}
+		damage, err := l.Replay(func(r wal.Record) error {
+			entry, err := decodeEntry(r)
+			if err != nil {
+				return err
+			}
+			seq := entry.Sequence
+			if seq <= m.LastSequence || seq > upTo || replayed[seq] {
+				return nil
+			}
+			if entry.ValuePointer {
+				return fmt.Errorf("record %d points into the value log, which isn't archived", seq)
+			}
+			replayed[seq] = true
+			return w.appendEntry(entry)
+		})
+		l.Close()
+		if err == nil {
+			err = damage
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay archived WAL %d: %w", archived.LastSequence, err)
+		}
+	}
+	return w.Sync()
+}
+
+// copyArchivedWAL copies an archived WAL to path
+func copyArchivedWAL(fs common.FS, path string, archived common.ArchivedWAL) error {
+	r, err := archived.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	file, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
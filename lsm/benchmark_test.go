@@ -4,13 +4,14 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
 )
 
 func BenchmarkWriteHeavy(b *testing.B) {
-	dir := fmt.Sprintf("/tmp/lsm-bench-write-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bench-write-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -38,7 +39,7 @@ func BenchmarkWriteHeavy(b *testing.B) {
 }
 
 func BenchmarkReadHeavy(b *testing.B) {
-	dir := fmt.Sprintf("/tmp/lsm-bench-read-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bench-read-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -80,7 +81,7 @@ func BenchmarkReadHeavy(b *testing.B) {
 }
 
 func BenchmarkBalanced(b *testing.B) {
-	dir := fmt.Sprintf("/tmp/lsm-bench-balanced-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bench-balanced-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -135,7 +136,7 @@ func BenchmarkWriteThroughput(b *testing.B) {
 
 	for _, bm := range benchmarks {
 		b.Run(bm.name, func(b *testing.B) {
-			dir := fmt.Sprintf("/tmp/lsm-bench-throughput-%d", time.Now().UnixNano())
+			dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bench-throughput-%d", time.Now().UnixNano()))
 			defer os.RemoveAll(dir)
 
 			config := DefaultConfig(dir)
@@ -165,7 +166,7 @@ func BenchmarkWriteThroughput(b *testing.B) {
 }
 
 func BenchmarkReadLatency(b *testing.B) {
-	dir := fmt.Sprintf("/tmp/lsm-bench-latency-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bench-latency-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -214,7 +215,7 @@ func BenchmarkReadLatency(b *testing.B) {
 }
 
 func BenchmarkNegativeLookup(b *testing.B) {
-	dir := fmt.Sprintf("/tmp/lsm-bench-negative-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bench-negative-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -254,7 +255,7 @@ func BenchmarkNegativeLookup(b *testing.B) {
 }
 
 func BenchmarkUpdateExisting(b *testing.B) {
-	dir := fmt.Sprintf("/tmp/lsm-bench-update-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bench-update-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -0,0 +1,402 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// blockFormat is the layout of an SSTable's data blocks, which its footer
+// magic determines. Every format starts with the entry count:
+//
+//	[numEntries(4)][entry1][entry2]...
+//	Entry: [keySize(4)][valueSize(4)][flags(1)][key][value]
+//
+// Blocks with restart points end with the offsets of every
+// blockRestartInterval'th entry, starting with the first, which a seek
+// binary searches:
+//
+//	...[entryN][restart1(4)]...[restartM(4)][numRestarts(4)]
+//
+// Blocks with delta-encoded keys also have restart points, and store each
+// key as the length of the prefix it shares with its restart point's key
+// and the rest. Restart points' keys share nothing, so any entry's key can
+// be rebuilt from its restart point's alone:
+//
+//	Entry: [shared(uvarint)][unshared(uvarint)][valueSize(uvarint)][flags(1)][key suffix][value]
+//
+// Blocks with entry offsets are delta-encoded too. Those holding
+// blockOffsetsMinEntries entries or more end with the offset of every
+// entry, so a seek binary searches all of them rather than reading on from
+// a restart point; smaller blocks have none, only the count of 0:
+//
+//	...[numRestarts(4)][offset1(2)]...[offsetN(2)][numOffsets(4)]
+type blockFormat int
+
+const (
+	blockFormatPlain    blockFormat = iota // "STBL" and "STB2" files
+	blockFormatRestarts                    // "STB3" files
+	blockFormatDelta                       // "STB4" files
+	blockFormatOffsets                     // "STB5" files
+)
+
+// magic returns the footer magic of files with blocks of format f
+func (f blockFormat) magic() uint32 {
+	switch f {
+	case blockFormatPlain:
+		return sstableMagicV2
+	case blockFormatRestarts:
+		return sstableMagicV3
+	case blockFormatDelta:
+		return sstableMagicV4
+	default:
+		return sstableMagicV5
+	}
+}
+
+// blockRestartInterval is how many entries apart restart points are
+const blockRestartInterval = 16
+
+// blockOffsetsMinEntries is how many entries a block needs to be given
+// entry offsets. A block is at most 4KB, so they fit in 2 bytes; one a
+// key's versions grew larger goes without if they don't (see addVersion).
+const blockOffsetsMinEntries = 64
+
+// entryHeaderSize is the size of an entry's key and value sizes and flags
+const entryHeaderSize = 9
+
+// blockIter reads the entries of a data block in order from the first,
+// or from the first >= a key with seekGE. Seeks compare keys in place,
+// copying only the key of the entry they stop at; values are slices of
+// the block.
+type blockIter struct {
+	block   []byte
+	format  blockFormat
+	compare compareBytesFunc
+
+	end         int // Where the entries end
+	restarts    int // Offset of the first restart point
+	numRestarts int
+
+	// For delta-encoded keys: the next restart point, and the key of the
+	// last one read, a slice of the block as it shares nothing, and its
+	// index
+	restart      int
+	restartKey   []byte
+	restartKeyOf int
+	keyBuf       []byte // Other keys are put together in
+
+	offsets    int // Offset of the first entry offset
+	numOffsets int
+
+	// Plain blocks may be padded, so they are read as far as their entry
+	// count instead of their end
+	numEntries uint32
+	read       uint32
+
+	offset int    // Of the next entry
+	key    []byte // Of the entry read, in the block or keyBuf
+	entry  SSTableEntry
+	err    error
+}
+
+// reset positions it before the first entry of block
+func (it *blockIter) reset(block []byte, format blockFormat, compare compareBytesFunc) {
+	*it = blockIter{block: block, format: format, compare: compare, end: len(block), offset: 4, restartKeyOf: -1, keyBuf: it.keyBuf}
+	if len(block) < 4 {
+		it.end = 0
+		return
+	}
+	it.numEntries = binary.LittleEndian.Uint32(block[0:])
+	if format == blockFormatPlain {
+		return
+	}
+
+	if format == blockFormatOffsets {
+		if len(block) < 8 {
+			it.err = fmt.Errorf("block truncated")
+			return
+		}
+		numOffsets := binary.LittleEndian.Uint32(block[len(block)-4:])
+		if uint64(numOffsets)*2 > uint64(len(block)-8) {
+			it.err = fmt.Errorf("entry offsets out of range")
+			return
+		}
+		it.numOffsets = int(numOffsets)
+		it.offsets = len(block) - 4 - 2*it.numOffsets
+		it.end = it.offsets
+	}
+
+	if it.end < 8 {
+		it.err = fmt.Errorf("block truncated")
+		return
+	}
+	numRestarts := binary.LittleEndian.Uint32(block[it.end-4:])
+	if uint64(numRestarts)*4 > uint64(it.end-8) {
+		it.err = fmt.Errorf("restart points out of range")
+		return
+	}
+	it.numRestarts = int(numRestarts)
+	it.restarts = it.end - 4 - 4*it.numRestarts
+	it.end = it.restarts
+}
+
+// seekToFirst positions it before the first entry
+func (it *blockIter) seekToFirst() {
+	it.offset, it.read, it.restart = 4, 0, 0
+}
+
+// next reads the next entry, returning false at the end of the block or
+// on damage, which err reports
+func (it *blockIter) next() bool {
+	if !it.advance() {
+		return false
+	}
+	it.entry.Key = string(it.key)
+	return true
+}
+
+// advance is next leaving the entry's Key unset, for seeks to compare
+// key in place
+func (it *blockIter) advance() bool {
+	if it.err != nil || it.offset >= it.end {
+		return false
+	}
+	if it.format == blockFormatPlain && it.read >= it.numEntries {
+		return false
+	}
+
+	if it.format >= blockFormatDelta {
+		return it.advanceDelta()
+	}
+
+	offset := it.offset
+	if offset+entryHeaderSize > it.end {
+		it.err = fmt.Errorf("block truncated")
+		return false
+	}
+	keySize := binary.LittleEndian.Uint32(it.block[offset:])
+	valueSize := binary.LittleEndian.Uint32(it.block[offset+4:])
+	flags := it.block[offset+8]
+	offset += entryHeaderSize
+
+	if uint64(offset)+uint64(keySize)+uint64(valueSize) > uint64(it.end) {
+		it.err = fmt.Errorf("block truncated")
+		return false
+	}
+	it.key = it.block[offset : offset+int(keySize)]
+	offset += int(keySize)
+
+	return it.setEntry(flags, offset, int(valueSize))
+}
+
+// advanceDelta is advance for blocks with delta-encoded keys
+func (it *blockIter) advanceDelta() bool {
+	offset := it.offset
+	var sizes [3]uint64 // Shared, unshared and value sizes
+	for i := range sizes {
+		size, n := binary.Uvarint(it.block[offset:it.end])
+		if n <= 0 {
+			it.err = fmt.Errorf("block truncated")
+			return false
+		}
+		sizes[i] = size
+		offset += n
+	}
+	shared, unshared, valueSize := sizes[0], sizes[1], sizes[2]
+	if offset >= it.end {
+		it.err = fmt.Errorf("block truncated")
+		return false
+	}
+	if room := uint64(it.end - offset - 1); unshared > room || valueSize > room-unshared {
+		it.err = fmt.Errorf("block truncated")
+		return false
+	}
+	flags := it.block[offset]
+	offset++
+
+	atRestart := it.restart < it.numRestarts && it.offset == it.restartOffset(it.restart)
+	if atRestart {
+		it.restartKey = nil
+	}
+	if shared > uint64(len(it.restartKey)) {
+		it.err = fmt.Errorf("key shares %d bytes with a %d byte key", shared, len(it.restartKey))
+		return false
+	}
+	suffix := it.block[offset : offset+int(unshared)]
+	if shared == 0 {
+		it.key = suffix
+	} else {
+		it.keyBuf = append(append(it.keyBuf[:0], it.restartKey[:shared]...), suffix...)
+		it.key = it.keyBuf
+	}
+	offset += int(unshared)
+	if atRestart {
+		it.restartKey, it.restartKeyOf = it.key, it.restart
+		it.restart++
+	}
+
+	return it.setEntry(flags, offset, int(valueSize))
+}
+
+// setEntry sets the entry read, but for its Key, whose value is at
+// offset, and moves past it
+func (it *blockIter) setEntry(flags byte, offset, valueSize int) bool {
+	// A tombstone's value is the one its delete retains, if any
+	it.entry = SSTableEntry{Deleted: flags&entryDeleted != 0}
+	it.entry.Value = it.block[offset : offset+valueSize]
+	if !it.entry.Deleted {
+		it.entry.ValuePointer = flags&entryValuePointer != 0
+	}
+	if flags&entrySequence != 0 {
+		if valueSize < sequenceSize {
+			it.err = fmt.Errorf("%d byte value has no room for its sequence number", valueSize)
+			return false
+		}
+		it.entry.Sequence = binary.LittleEndian.Uint64(it.entry.Value)
+		it.entry.Value = it.entry.Value[sequenceSize:]
+	}
+	it.offset = offset + valueSize
+	it.read++
+	return true
+}
+
+// seekGE positions it at the first entry >= key, returning false if
+// there is none. Blocks with restart points are binary searched for the
+// last restart point before key and read on from there; blocks with
+// entry offsets are binary searched throughout.
+func (it *blockIter) seekGE(key string) bool {
+	it.seekToFirst()
+	if it.err != nil {
+		return false
+	}
+
+	found := false
+	switch {
+	case it.numOffsets > 0:
+		found = it.seekOffsets(key)
+	case it.numRestarts > 0:
+		found = it.seekRestarts(key)
+	default:
+		found = it.seekFrom(key)
+	}
+	if found {
+		it.entry.Key = string(it.key)
+	}
+	return found
+}
+
+// seekFrom reads on to the first entry >= key
+func (it *blockIter) seekFrom(key string) bool {
+	for it.advance() {
+		if it.compare(it.key, key) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// seekRestarts binary searches the restart points for the last before key
+// and reads on from there
+func (it *blockIter) seekRestarts(key string) bool {
+	lo, hi := 0, it.numRestarts-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if !it.seekRestart(mid) {
+			return false
+		}
+		if it.compare(it.key, key) < 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if !it.seekRestart(lo) {
+		return false
+	}
+	if it.compare(it.key, key) >= 0 {
+		return true
+	}
+	return it.seekFrom(key)
+}
+
+// seekRestart reads the entry at restart point i
+func (it *blockIter) seekRestart(i int) bool {
+	offset := it.restartOffset(i)
+	if offset < 4 || offset >= it.end {
+		it.err = fmt.Errorf("restart point %d out of range", i)
+		return false
+	}
+	it.offset, it.restart = offset, i
+	return it.advance()
+}
+
+// seekOffsets binary searches every entry of a block with entry offsets
+func (it *blockIter) seekOffsets(key string) bool {
+	lo, hi := 0, it.numOffsets
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if !it.seekEntry(mid) {
+			return false
+		}
+		if it.compare(it.key, key) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == it.numOffsets {
+		return false
+	}
+	return it.seekEntry(lo)
+}
+
+// seekEntry reads entry i of a block with entry offsets, first reading
+// its restart point's entry for the key it shares a prefix with
+func (it *blockIter) seekEntry(i int) bool {
+	offset := int(binary.LittleEndian.Uint16(it.block[it.offsets+2*i:]))
+	if offset < 4 || offset >= it.end {
+		it.err = fmt.Errorf("entry offset %d out of range", i)
+		return false
+	}
+
+	// The last restart point at or before the entry, which is usually
+	// where the builder puts it
+	restart := i / blockRestartInterval
+	if restart >= it.numRestarts || it.restartOffset(restart) > offset ||
+		restart+1 < it.numRestarts && it.restartOffset(restart+1) <= offset {
+		restart = sort.Search(it.numRestarts, func(r int) bool {
+			return it.restartOffset(r) > offset
+		}) - 1
+	}
+	if restart < 0 {
+		it.err = fmt.Errorf("entry %d precedes every restart point", i)
+		return false
+	}
+
+	if it.restartOffset(restart) == offset {
+		return it.seekRestart(restart)
+	}
+	if it.restartKeyOf != restart && !it.seekRestart(restart) {
+		return false
+	}
+	it.offset, it.restart = offset, restart+1
+	return it.advance()
+}
+
+// restartOffset returns the offset of restart point i's entry
+func (it *blockIter) restartOffset(i int) int {
+	return int(binary.LittleEndian.Uint32(it.block[it.restarts+4*i:]))
+}
+
+// searchBlock searches for a key within a data block; a tombstone is
+// returned with Deleted set, so it can hide older versions. The value
+// returned is a slice of block.
+func searchBlock(block []byte, format blockFormat, key string, compare compareBytesFunc) (SSTableEntry, bool, error) {
+	var it blockIter
+	it.reset(block, format, compare)
+	if !it.seekGE(key) || it.entry.Key != key {
+		return SSTableEntry{}, false, it.err
+	}
+	return it.entry, true, nil
+}
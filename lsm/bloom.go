@@ -6,6 +6,10 @@ import (
 	"math"
 )
 
+// maxBloomHashes bounds the hash count accepted when decoding a filter;
+// any real false positive rate needs far fewer
+const maxBloomHashes = 256
+
 // BloomFilter is a probabilistic data structure for membership testing
 type BloomFilter struct {
 	bits      []byte // Bit array
@@ -40,6 +44,13 @@ func NewBloomFilter(expectedKeys int, falsePositiveRate float64) *BloomFilter {
 	}
 }
 
+// bloomFalsePositiveRate returns the false positive rate of a filter with
+// bitsPerKey bits per key and the optimal number of hashes:
+// p = e^(-(m/n) * ln(2)^2)
+func bloomFalsePositiveRate(bitsPerKey int) float64 {
+	return math.Exp(-float64(bitsPerKey) * math.Ln2 * math.Ln2)
+}
+
 // hash1 and hash2 are used for double hashing
 func (bf *BloomFilter) hash1(key string) uint64 {
 	h := fnv.New64a()
@@ -101,7 +112,8 @@ func (bf *BloomFilter) Encode() []byte {
 	return buf
 }
 
-// DecodeBloomFilter deserializes a bloom filter from bytes
+// DecodeBloomFilter deserializes a bloom filter from bytes, returning nil
+// if they don't hold a usable one
 func DecodeBloomFilter(data []byte) *BloomFilter {
 	if len(data) < 12 {
 		return nil
@@ -109,6 +121,9 @@ func DecodeBloomFilter(data []byte) *BloomFilter {
 
 	numBits := binary.LittleEndian.Uint64(data[0:])
 	numHashes := binary.LittleEndian.Uint32(data[8:])
+	if numBits == 0 || numBits > uint64(len(data)-12)*8 || numHashes > maxBloomHashes {
+		return nil // Damaged
+	}
 	bits := make([]byte, len(data)-12)
 	copy(bits, data[12:])
 
@@ -0,0 +1,160 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Checkpoint implements common.Checkpointer. The checkpoint holds the
+// live SSTables and value log files, which are immutable except for the
+// value log head (cut off at its current end), with a MANIFEST listing
+// those SSTables and a copy of the WAL for the writes not yet flushed.
+// Flushes, compactions and writes go on while fn runs; SSTables they
+// replace and value log files GC removes are kept until it returns.
+//
+// SSTables that failed to open on startup can't be read, so they are
+// left out.
+func (lsm *LSM) Checkpoint(fn func(files []common.CheckpointFile) error) error {
+	return lsm.CheckpointSeq(func(files []common.CheckpointFile, _ uint64) error {
+		return fn(files)
+	})
+}
+
+// CheckpointSeq implements common.SequencedCheckpointer: it is Checkpoint,
+// also passing fn the sequence number of the last write the checkpoint
+// holds, which is also the MANIFEST's LastSequence. Writes are numbered
+// under lsm.mu, so the checkpoint holds every write up to it.
+func (lsm *LSM) CheckpointSeq(fn func(files []common.CheckpointFile, seq uint64) error) error {
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	// As for Scan: with the value log pinned, GC keeps the files listed
+	// below readable until unpin
+	lsm.vlog.gcMu.RLock()
+	lsm.vlog.pin()
+	defer lsm.vlog.unpin()
+
+	// The value log first, so the WAL copied never points past it
+	if err := lsm.vlog.sync(); err != nil {
+		lsm.vlog.gcMu.RUnlock()
+		return err
+	}
+
+	// With lsm.mu held for writing no write is half done and no flush or
+	// compaction half installed, so the WAL and the levels agree
+	lsm.mu.Lock()
+	err := lsm.wal.Sync()
+	lsm.walErr.Set(err)
+	var walData []byte
+	if err == nil {
+		walData, err = common.ReadFile(lsm.config.FS, filepath.Join(lsm.config.DataDir, "wal.log"))
+	}
+	var vlogFiles []common.CheckpointFile
+	if err == nil {
+		vlogFiles, err = lsm.vlog.checkpointFiles()
+	}
+	if err != nil {
+		lsm.mu.Unlock()
+		lsm.vlog.gcMu.RUnlock()
+		return fmt.Errorf("failed to checkpoint: %w", err)
+	}
+
+	var sstables []*SSTable
+	m := *lsm.manifest
+	m.Files = nil
+	m.HasFiles = true
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			sst.ref()
+			sstables = append(sstables, sst)
+			m.Files = append(m.Files, liveFile{Level: level, FileNum: sst.FileNum()})
+		}
+	}
+	m.LastSequence = atomic.LoadUint64(&lsm.sequence)
+	lsm.mu.Unlock()
+	lsm.vlog.gcMu.RUnlock()
+
+	defer func() {
+		for _, sst := range sstables {
+			sst.unref()
+		}
+	}()
+
+	files := make([]common.CheckpointFile, 0, len(sstables)+len(vlogFiles)+2)
+	for _, sst := range sstables {
+		files = append(files, common.CheckpointFile{
+			Name:      filepath.Base(sst.Path()),
+			Size:      sst.Size(),
+			Immutable: true,
+			Open:      sectionOpener(sst.file, sst.Size()),
+		})
+	}
+	files = append(files, vlogFiles...)
+	files = append(files, bytesCheckpointFile(manifestFile, encodeManifest(&m)))
+	files = append(files, bytesCheckpointFile("wal.log", walData))
+	return fn(files, m.LastSequence)
+}
+
+// checkpointFiles returns the value log files for a checkpoint: the sealed
+// files, and the head up to its current end. Caller must have pinned the
+// value log.
+func (vl *valueLog) checkpointFiles() ([]common.CheckpointFile, error) {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	var files []common.CheckpointFile
+	for fileNum, file := range vl.files {
+		size := vl.headSize
+		head := vl.head != nil && fileNum == vl.headNum
+		if !head {
+			info, err := file.Stat()
+			if err != nil {
+				return nil, err
+			}
+			size = info.Size()
+		}
+		files = append(files, common.CheckpointFile{
+			Name:      filepath.Base(vl.filePath(fileNum)),
+			Size:      size,
+			Immutable: !head,
+			Open:      sectionOpener(file, size),
+		})
+	}
+	return files, nil
+}
+
+// sectionOpener returns an Open func reading the first size bytes of file
+func sectionOpener(file io.ReaderAt, size int64) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(file, 0, size)), nil
+	}
+}
+
+// bytesCheckpointFile returns a checkpoint file holding data
+func bytesCheckpointFile(name string, data []byte) common.CheckpointFile {
+	return common.CheckpointFile{
+		Name: name,
+		Size: int64(len(data)),
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+// Checkpoint implements common.Checkpointer (see LSM.Checkpoint)
+func (a *Adapter) Checkpoint(fn func(files []common.CheckpointFile) error) error {
+	return a.lsm.Checkpoint(fn)
+}
+
+// CheckpointSeq implements common.SequencedCheckpointer (see
+// LSM.CheckpointSeq)
+func (a *Adapter) CheckpointSeq(fn func(files []common.CheckpointFile, seq uint64) error) error {
+	return a.lsm.CheckpointSeq(fn)
+}
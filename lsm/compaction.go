@@ -2,49 +2,71 @@ package lsm
 
 import (
 	"container/heap"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 // CompactionEntry represents an entry during compaction
 type CompactionEntry struct {
-	Key      string
-	Value    []byte
-	Sequence uint64
-	Deleted  bool
-	sstIndex int // Which SSTable this came from
+	Key          string
+	Value        []byte
+	Sequence     uint64
+	Deleted      bool
+	ValuePointer bool // Value is a pointer into the value log
+	sstIndex     int  // Which SSTable this came from
 }
 
 // CompactionHeap implements a min-heap for k-way merge
-type CompactionHeap []CompactionEntry
+type CompactionHeap struct {
+	entries []CompactionEntry
+	compare compareFunc
+}
 
-func (h CompactionHeap) Len() int { return len(h) }
-func (h CompactionHeap) Less(i, j int) bool {
-	if h[i].Key != h[j].Key {
-		return h[i].Key < h[j].Key
+func (h *CompactionHeap) Len() int { return len(h.entries) }
+func (h *CompactionHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if c := h.compare(a.Key, b.Key); c != 0 {
+		return c < 0
 	}
-	// If keys are equal, prefer higher sequence number (newer)
-	return h[i].Sequence > h[j].Sequence
+	// Inputs are ordered newest first, and yield a key's versions newest
+	// first. Not all record sequence numbers, so they aren't compared.
+	return a.sstIndex < b.sstIndex
+}
+func (h *CompactionHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
 }
-func (h CompactionHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
-func (h *CompactionHeap) Push(x interface{}) { *h = append(*h, x.(CompactionEntry)) }
+func (h *CompactionHeap) Push(x interface{}) { h.entries = append(h.entries, x.(CompactionEntry)) }
 func (h *CompactionHeap) Pop() interface{} {
-	old := *h
+	old := h.entries
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.entries = old[0 : n-1]
 	return x
 }
 
-// SSTableIterator iterates over entries in an SSTable
+// SSTableIterator iterates over entries in an SSTable, parsing them one
+// at a time from the block they are in. Blocks are read into two buffers
+// in turn, so an entry's Value, a slice of its block, stays valid through
+// the following call to Next.
 type SSTableIterator struct {
 	sst          *SSTable
 	blockIdx     int
-	entryIdx     int
 	currentBlock []byte
-	entries      []CompactionEntry
+	block        blockIter
+	bufs         [2][]byte // Blocks are read into, alternately
+	seeked       bool      // block is at an entry seek found, not yet returned
+	err          error     // Set if a block could not be read
+
+	// scan is set for a Scan, which checks block checksums as often as
+	// VerifyChecksumsOnRead says; compaction checks every block
+	scan bool
 }
 
 // NewSSTableIterator creates an iterator for an SSTable
@@ -52,7 +74,6 @@ func NewSSTableIterator(sst *SSTable, sstIndex int) (*SSTableIterator, error) {
 	it := &SSTableIterator{
 		sst:      sst,
 		blockIdx: 0,
-		entryIdx: 0,
 	}
 
 	// Load first block
@@ -65,109 +86,104 @@ func NewSSTableIterator(sst *SSTable, sstIndex int) (*SSTableIterator, error) {
 	return it, nil
 }
 
-// loadBlock loads a block and parses its entries
+// loadBlock reads a block, into the buffer the previous block wasn't
+// read into, and positions the iterator before its first entry
 func (it *SSTableIterator) loadBlock(blockIdx int) error {
 	if blockIdx >= len(it.sst.index) {
 		return nil
 	}
 
-	blockOffset := it.sst.index[blockIdx].BlockOffset
-	block, err := it.sst.readBlock(blockOffset)
+	buf := &it.bufs[blockIdx%2]
+	block, err := it.sst.readBlockInto(*buf, blockIdx, !it.scan || it.sst.verify.Verify())
 	if err != nil {
 		return err
 	}
+	*buf = block
 
 	it.currentBlock = block
 	it.blockIdx = blockIdx
-	it.entryIdx = 0
-	it.entries = nil
+	it.seeked = false
+	it.block.reset(block, it.sst.blockFormat, it.sst.compareBytes)
+	return it.blockErr()
+}
 
-	// Parse all entries in the block
-	if len(block) < 4 {
+// blockErr returns the damage reading the current block found, if any
+func (it *SSTableIterator) blockErr() error {
+	if it.block.err == nil {
 		return nil
 	}
+	offset := it.sst.index[it.blockIdx].BlockOffset
+	return common.Corruptf(it.sst.path, "block at offset %d: %w", offset, it.block.err)
+}
 
-	numEntries := binary.LittleEndian.Uint32(block[0:])
-	offset := 4
+// Next advances to the next entry
+func (it *SSTableIterator) Next() (CompactionEntry, bool) {
+	if it.err != nil || it.currentBlock == nil {
+		return CompactionEntry{}, false
+	}
 
-	for i := uint32(0); i < numEntries; i++ {
-		if offset+9 > len(block) {
-			break
+	if it.seeked {
+		it.seeked = false
+	} else if !it.block.next() {
+		if it.err = it.blockErr(); it.err != nil {
+			return CompactionEntry{}, false
 		}
 
-		keySize := binary.LittleEndian.Uint32(block[offset:])
-		offset += 4
-		valueSize := binary.LittleEndian.Uint32(block[offset:])
-		offset += 4
-		deleted := block[offset] == 1
-		offset += 1
-
-		if offset+int(keySize)+int(valueSize) > len(block) {
-			break
+		// Try to load next block. One holding no entries is damaged: the
+		// builder never writes one.
+		if it.blockIdx+1 >= len(it.sst.index) {
+			return CompactionEntry{}, false
+		}
+		if it.err = it.loadBlock(it.blockIdx + 1); it.err != nil {
+			return CompactionEntry{}, false
+		}
+		if !it.block.next() {
+			if it.err = it.blockErr(); it.err == nil {
+				offset := it.sst.index[it.blockIdx].BlockOffset
+				it.err = common.Corruptf(it.sst.path, "block at offset %d holds no entries", offset)
+			}
+			return CompactionEntry{}, false
 		}
-
-		key := string(block[offset : offset+int(keySize)])
-		offset += int(keySize)
-		value := make([]byte, valueSize)
-		copy(value, block[offset:offset+int(valueSize)])
-		offset += int(valueSize)
-
-		it.entries = append(it.entries, CompactionEntry{
-			Key:      key,
-			Value:    value,
-			Deleted:  deleted,
-			Sequence: 0, // SSTables don't store sequence, we'll use file order
-		})
 	}
 
-	return nil
+	entry := it.block.entry
+	return CompactionEntry{
+		Key:          entry.Key,
+		Value:        entry.Value,
+		Deleted:      entry.Deleted,
+		ValuePointer: entry.ValuePointer,
+		Sequence:     entry.Sequence, // 0 unless versions are kept
+	}, true
 }
 
-// Next advances to the next entry
-func (it *SSTableIterator) Next() (CompactionEntry, bool) {
-	if it.entryIdx < len(it.entries) {
-		entry := it.entries[it.entryIdx]
-		it.entryIdx++
-		return entry, true
-	}
-
-	// Try to load next block
-	it.blockIdx++
-	if it.blockIdx >= len(it.sst.index) {
-		return CompactionEntry{}, false
+// seek positions the iterator at the first entry >= key
+func (it *SSTableIterator) seek(key string) error {
+	// Last block whose first key is <= key
+	blockIdx := sort.Search(len(it.sst.index), func(i int) bool {
+		return it.sst.compare(it.sst.index[i].Key, key) > 0
+	})
+	if blockIdx > 0 {
+		blockIdx--
 	}
 
-	if err := it.loadBlock(it.blockIdx); err != nil {
-		return CompactionEntry{}, false
-	}
-
-	if it.entryIdx < len(it.entries) {
-		entry := it.entries[it.entryIdx]
-		it.entryIdx++
-		return entry, true
+	if err := it.loadBlock(blockIdx); err != nil {
+		return err
 	}
-
-	return CompactionEntry{}, false
+	it.seeked = it.block.seekGE(key)
+	return it.blockErr()
 }
 
-// CompactL0ToL1 merges all L0 SSTables into L1
+// CompactL0ToL1 merges all L0 SSTables into L1, or into targetLevel when
+// dynamic level sizing has moved the base level down (l1Files are then
+// that level's files)
 // Returns: new L1 files, old L1 files that were compacted, error
-func CompactL0ToL1(dataDir string, l0Files, l1Files []*SSTable, nextFileNum *uint64) ([]*SSTable, []*SSTable, error) {
+func CompactL0ToL1(dataDir string, l0Files, l1Files []*SSTable, targetLevel int, nextFileNum *uint64, opts CompactionOptions) ([]*SSTable, []*SSTable, error) {
 	if len(l0Files) == 0 {
 		return nil, nil, nil
 	}
 
 	// Find overlapping L1 files
-	minKey := l0Files[0].MinKey()
-	maxKey := l0Files[0].MaxKey()
-	for _, sst := range l0Files {
-		if sst.MinKey() < minKey {
-			minKey = sst.MinKey()
-		}
-		if sst.MaxKey() > maxKey {
-			maxKey = sst.MaxKey()
-		}
-	}
+	minKey, maxKey := keyRange(l0Files, newCompareFunc(opts.Comparator))
 
 	var overlappingL1 []*SSTable
 	for _, sst := range l1Files {
@@ -176,9 +192,14 @@ func CompactL0ToL1(dataDir string, l0Files, l1Files []*SSTable, nextFileNum *uin
 		}
 	}
 
-	// Merge all files
-	allFiles := append(l0Files, overlappingL1...)
-	newFiles, err := mergeFiles(dataDir, allFiles, 1, nextFileNum)
+	// Merge all files, newest first: L0 is kept oldest first, and all of
+	// it is newer than L1
+	allFiles := make([]*SSTable, 0, len(l0Files)+len(overlappingL1))
+	for i := len(l0Files) - 1; i >= 0; i-- {
+		allFiles = append(allFiles, l0Files[i])
+	}
+	allFiles = append(allFiles, overlappingL1...)
+	newFiles, err := subcompact(dataDir, allFiles, targetLevel, nextFileNum, opts)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -188,22 +209,13 @@ func CompactL0ToL1(dataDir string, l0Files, l1Files []*SSTable, nextFileNum *uin
 
 // CompactLnToLn1 compacts files from level n to level n+1
 // Returns: new files at target level, old files from target level that were compacted, error
-func CompactLnToLn1(dataDir string, lnFiles, ln1Files []*SSTable, targetLevel int, nextFileNum *uint64) ([]*SSTable, []*SSTable, error) {
+func CompactLnToLn1(dataDir string, lnFiles, ln1Files []*SSTable, targetLevel int, nextFileNum *uint64, opts CompactionOptions) ([]*SSTable, []*SSTable, error) {
 	if len(lnFiles) == 0 {
 		return nil, nil, nil
 	}
 
 	// Find overlapping files in next level
-	minKey := lnFiles[0].MinKey()
-	maxKey := lnFiles[0].MaxKey()
-	for _, sst := range lnFiles {
-		if sst.MinKey() < minKey {
-			minKey = sst.MinKey()
-		}
-		if sst.MaxKey() > maxKey {
-			maxKey = sst.MaxKey()
-		}
-	}
+	minKey, maxKey := keyRange(lnFiles, newCompareFunc(opts.Comparator))
 
 	var overlapping []*SSTable
 	for _, sst := range ln1Files {
@@ -212,9 +224,9 @@ func CompactLnToLn1(dataDir string, lnFiles, ln1Files []*SSTable, targetLevel in
 		}
 	}
 
-	// Merge all files
+	// Merge all files (level n is newer than level n+1)
 	allFiles := append(lnFiles, overlapping...)
-	newFiles, err := mergeFiles(dataDir, allFiles, targetLevel, nextFileNum)
+	newFiles, err := subcompact(dataDir, allFiles, targetLevel, nextFileNum, opts)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -222,8 +234,200 @@ func CompactLnToLn1(dataDir string, lnFiles, ln1Files []*SSTable, targetLevel in
 	return newFiles, overlapping, nil
 }
 
-// mergeFiles performs k-way merge of multiple SSTables
-func mergeFiles(dataDir string, sstables []*SSTable, targetLevel int, nextFileNum *uint64) ([]*SSTable, error) {
+// keyRange returns the smallest and largest key across sstables
+func keyRange(sstables []*SSTable, compare compareFunc) (string, string) {
+	minKey := sstables[0].MinKey()
+	maxKey := sstables[0].MaxKey()
+	for _, sst := range sstables[1:] {
+		if compare(sst.MinKey(), minKey) < 0 {
+			minKey = sst.MinKey()
+		}
+		if compare(sst.MaxKey(), maxKey) > 0 {
+			maxKey = sst.MaxKey()
+		}
+	}
+	return minKey, maxKey
+}
+
+// CompactL0ToL0 stitches L0 SSTables into a single L0 file without
+// touching L1. l0Files must be every L0 file at the time the compaction
+// started, oldest first, and fileNum must be allocated along with that
+// snapshot, with no flush in progress: the output then sorts after its
+// inputs and before any file flushed while the merge runs, so file order
+// still matches data age.
+// Only opts.Comparator, opts.FS and opts.Workers apply: the output is
+// always one file.
+func CompactL0ToL0(dataDir string, l0Files []*SSTable, fileNum uint64, opts CompactionOptions) (*SSTable, error) {
+	if len(l0Files) == 0 {
+		return nil, nil
+	}
+
+	newest := make([]*SSTable, 0, len(l0Files))
+	for i := len(l0Files) - 1; i >= 0; i-- {
+		newest = append(newest, l0Files[i])
+	}
+
+	// No target file size, so exactly one (reserved) file number is used
+	newFiles, err := mergeFiles(dataDir, newest, 0, &fileNum, CompactionOptions{Comparator: opts.Comparator, FS: opts.FS, Workers: opts.Workers})
+	if err != nil || len(newFiles) == 0 {
+		return nil, err
+	}
+
+	return newFiles[0], nil
+}
+
+// CompactionOptions controls how a compaction writes its output
+type CompactionOptions struct {
+	TargetFileSize    int64 // Start a new output file past this size (0 = single file)
+	MaxSubcompactions int   // Key ranges merged in parallel (<= 1 = no split)
+	Bottommost        bool  // Output goes to the last level, so tombstones are dropped
+
+	Comparator common.Comparator // Key order of the inputs (nil = bytewise)
+	FS         common.FS         // Where the output is written (nil = the OS)
+
+	VerifyChecksums common.ChecksumVerification // Set as the outputs' VerifyChecksumsOnRead
+	BloomBitsPerKey int                         // Of the outputs' bloom filters (0 = default)
+
+	// UndeleteWindow is Config.UndeleteWindow: tombstones of deletes made
+	// since keep the value they retain, older ones lose it
+	UndeleteWindow time.Duration
+
+	// KeepVersions is Config.KeepVersions: the versions of each key kept,
+	// the newest included (<= 1 = only the newest, without its sequence
+	// number)
+	KeepVersions int
+
+	Workers *common.WorkerLimiter // Bounds the merges running at once (nil = no limit)
+}
+
+const (
+	// assumedEntrySize sizes output bloom filters: a file of TargetFileSize
+	// is expected to hold TargetFileSize/assumedEntrySize keys
+	assumedEntrySize = 40
+
+	// defaultExpectedEntries sizes bloom filters of unbounded outputs
+	defaultExpectedEntries = 100000
+
+	// minSubcompactionBytes is the least input a sub-compaction is given;
+	// smaller compactions are not worth splitting
+	minSubcompactionBytes = 1024 * 1024 // 1MB
+)
+
+// subcompact merges sstables (newest first) into targetLevel, splitting
+// the key space into up to opts.MaxSubcompactions ranges that are merged in
+// parallel. Each range produces its own output files, so file boundaries
+// line up with range boundaries and the outputs never overlap.
+func subcompact(dataDir string, sstables []*SSTable, targetLevel int, nextFileNum *uint64, opts CompactionOptions) ([]*SSTable, error) {
+	bounds := subcompactionBounds(sstables, opts.MaxSubcompactions, newCompareFunc(opts.Comparator))
+	if len(bounds) == 0 {
+		return mergeFiles(dataDir, sstables, targetLevel, nextFileNum, opts)
+	}
+
+	// Range i covers [bounds[i-1], bounds[i]); the first starts at the
+	// smallest key and the last runs to the end ("" = unbounded)
+	outputs := make([][]*SSTable, len(bounds)+1)
+	errs := make([]error, len(bounds)+1)
+
+	var wg sync.WaitGroup
+	for i := range outputs {
+		var lo, hi string
+		if i > 0 {
+			lo = bounds[i-1]
+		}
+		if i < len(bounds) {
+			hi = bounds[i]
+		}
+
+		wg.Add(1)
+		go func(i int, lo, hi string) {
+			defer wg.Done()
+			outputs[i], errs[i] = mergeRange(dataDir, sstables, targetLevel, nextFileNum, opts, lo, hi)
+		}(i, lo, hi)
+	}
+	wg.Wait()
+
+	var newSSTables []*SSTable
+	for _, files := range outputs {
+		newSSTables = append(newSSTables, files...)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			// The compaction is abandoned, drop what the other ranges wrote
+			DeleteSSTables(newSSTables)
+			return nil, err
+		}
+	}
+
+	return newSSTables, nil
+}
+
+// subcompactionBounds picks the keys that split a compaction into up to
+// maxSubcompactions ranges of similar size. Block index keys serve as
+// samples of the key distribution, roughly one per 4KB of input. Returns
+// nil when the compaction should not be split.
+func subcompactionBounds(sstables []*SSTable, maxSubcompactions int, compare compareFunc) []string {
+	var inputBytes int64
+	for _, sst := range sstables {
+		inputBytes += sst.Size()
+	}
+
+	n := maxSubcompactions
+	if limit := int(inputBytes / minSubcompactionBytes); limit < n {
+		n = limit
+	}
+	if n < 2 {
+		return nil
+	}
+
+	var samples []string
+	for _, sst := range sstables {
+		for _, entry := range sst.index {
+			samples = append(samples, entry.Key)
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return compare(samples[i], samples[j]) < 0
+	})
+
+	// Deduplicate (L0 files overlap)
+	unique := samples[:0]
+	for i, key := range samples {
+		if i == 0 || key != samples[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	samples = unique
+
+	if len(samples) < n {
+		n = len(samples)
+	}
+
+	var bounds []string
+	for i := 1; i < n; i++ {
+		key := samples[i*len(samples)/n]
+		if len(bounds) == 0 || compare(key, bounds[len(bounds)-1]) > 0 {
+			bounds = append(bounds, key)
+		}
+	}
+	return bounds
+}
+
+// mergeFiles performs k-way merge of multiple SSTables, ordered newest
+// first so that the newest version of each key wins
+func mergeFiles(dataDir string, sstables []*SSTable, targetLevel int, nextFileNum *uint64, opts CompactionOptions) ([]*SSTable, error) {
+	return mergeRange(dataDir, sstables, targetLevel, nextFileNum, opts, "", "")
+}
+
+// mergeRange is mergeFiles restricted to keys in [lo, hi); an empty bound
+// is unbounded. File numbers are taken atomically, so ranges of the same
+// compaction can be merged concurrently.
+func mergeRange(dataDir string, sstables []*SSTable, targetLevel int, nextFileNum *uint64, opts CompactionOptions, lo, hi string) ([]*SSTable, error) {
+	opts.Workers.Acquire()
+	defer opts.Workers.Release()
+
+	compare := newCompareFunc(opts.Comparator)
+
 	// Create iterators for each SSTable
 	iterators := make([]*SSTableIterator, len(sstables))
 	for i, sst := range sstables {
@@ -231,87 +435,159 @@ func mergeFiles(dataDir string, sstables []*SSTable, targetLevel int, nextFileNu
 		if err != nil {
 			return nil, err
 		}
+		if lo != "" {
+			if err := it.seek(lo); err != nil {
+				return nil, err
+			}
+		}
 		iterators[i] = it
 	}
 
+	// next returns an iterator's next entry inside the range
+	next := func(i int) (CompactionEntry, bool) {
+		entry, ok := iterators[i].Next()
+		if !ok || (hi != "" && compare(entry.Key, hi) >= 0) {
+			return CompactionEntry{}, false
+		}
+		entry.sstIndex = i
+		return entry, true
+	}
+
 	// Initialize heap with first entry from each iterator
-	h := &CompactionHeap{}
+	h := &CompactionHeap{compare: compare}
 	heap.Init(h)
 
-	for i, it := range iterators {
-		if entry, ok := it.Next(); ok {
-			entry.sstIndex = i
+	for i := range iterators {
+		if entry, ok := next(i); ok {
 			heap.Push(h, entry)
 		}
 	}
 
+	// Tombstones of deletes before this are past the undelete window
+	retainAfter := time.Now().Add(-opts.UndeleteWindow)
+
+	// Outputs inherit the read counts of tracked inputs
+	heir := newHeatInheritor(sstables)
+	var outHeat *fileHeat
+
 	// Merge entries into new SSTables
 	var newSSTables []*SSTable
 	var builder *SSTableBuilder
 	var currentFileNum uint64
-	var entriesInFile int
-	const maxEntriesPerFile = 100000 // ~4MB with 40-byte entries
+	var lastKey string
+	haveLast := false
+	keep := max(opts.KeepVersions, 1)
+	kept := 0          // Versions of lastKey kept
+	var lastSeq uint64 // Of the last of them
+
+	// Tombstones of lastKey held back in the final level, to be kept only
+	// if an older version is: one that hides nothing is dropped
+	var held []uint64
 
 	for h.Len() > 0 {
 		// Get smallest entry
 		entry := heap.Pop(h).(CompactionEntry)
 
 		// Advance the iterator that produced this entry
-		it := iterators[entry.sstIndex]
-		if nextEntry, ok := it.Next(); ok {
-			nextEntry.sstIndex = entry.sstIndex
+		if nextEntry, ok := next(entry.sstIndex); ok {
 			heap.Push(h, nextEntry)
 		}
 
-		// Skip duplicates (keep only the first occurrence, which has highest sequence)
-		if h.Len() > 0 {
-			peek := (*h)[0]
-			if peek.Key == entry.Key {
-				// Skip this entry, we'll process the newer one
+		// Keep the first occurrences of a key, which are the newest
+		if haveLast && entry.Key == lastKey {
+			if kept >= keep || !olderVersion(entry.Sequence, lastSeq) {
 				continue
 			}
+		} else {
+			lastKey, haveLast = entry.Key, true
+			kept, held = 0, held[:0]
+
+			// Finish file if it's getting large, between keys so that a
+			// key's versions stay in one file
+			if builder != nil && opts.TargetFileSize > 0 && builder.EstimatedSize() >= opts.TargetFileSize {
+				if err := builder.Finish(); err != nil {
+					return nil, err
+				}
+
+				// Open the newly created SSTable
+				path := filepath.Join(dataDir, fmt.Sprintf("L%d-%06d.sst", targetLevel, currentFileNum))
+				sst, err := openSSTable(common.FSOrDefault(opts.FS), path, targetLevel, currentFileNum, opts.Comparator)
+				if err != nil {
+					return nil, err
+				}
+				sst.heat = outHeat
+				sst.verify = opts.VerifyChecksums
+				newSSTables = append(newSSTables, sst)
+
+				builder = nil
+			}
 		}
+		kept++
+		lastSeq = entry.Sequence
 
-		// Drop tombstones in final level (L4)
-		if targetLevel == 4 && entry.Deleted {
+		// A tombstone past the undelete window no longer retains a value
+		if entry.Deleted && len(entry.Value) > 0 && !retainedSince(entry.Value, retainAfter) {
+			entry.Value = nil
+		}
+
+		// Drop tombstones in the final level, but for those retaining one
+		// and those hiding an older version kept, held back until one is
+		if opts.Bottommost && entry.Deleted && len(entry.Value) == 0 {
+			if keep > 1 {
+				held = append(held, entry.Sequence)
+			}
 			continue
 		}
 
 		// Create new builder if needed
 		if builder == nil {
-			currentFileNum = *nextFileNum
-			*nextFileNum++
+			currentFileNum = atomic.AddUint64(nextFileNum, 1) - 1
 			path := filepath.Join(dataDir, fmt.Sprintf("L%d-%06d.sst", targetLevel, currentFileNum))
 			var err error
-			builder, err = NewSSTableBuilder(path, maxEntriesPerFile)
+			expected := defaultExpectedEntries
+			if opts.TargetFileSize > 0 {
+				expected = int(opts.TargetFileSize / assumedEntrySize)
+			}
+			builder, err = newSSTableBuilder(common.FSOrDefault(opts.FS), path, expected, opts.BloomBitsPerKey)
 			if err != nil {
 				return nil, err
 			}
-			entriesInFile = 0
+			outHeat = heir.newOutput()
 		}
 
-		// Add entry to current builder
-		if err := builder.Add(entry.Key, entry.Value, entry.Deleted); err != nil {
+		// Add entry to current builder, after the tombstones it was hidden
+		// by. Sequence numbers are only kept with the versions.
+		var err error
+		if keep > 1 {
+			for _, seq := range held {
+				if err = builder.addVersion(entry.Key, nil, entryDeleted, seq); err != nil {
+					break
+				}
+			}
+			held = held[:0]
+			if err == nil {
+				err = builder.addVersion(entry.Key, entry.Value, entryFlags(entry.Deleted, entry.ValuePointer), entry.Sequence)
+			}
+		} else {
+			err = builder.add(entry.Key, entry.Value, entryFlags(entry.Deleted, entry.ValuePointer))
+		}
+		if err != nil {
 			builder.Abort()
 			return nil, err
 		}
-		entriesInFile++
-
-		// Finish file if it's getting large
-		if entriesInFile >= maxEntriesPerFile {
-			if err := builder.Finish(); err != nil {
-				return nil, err
-			}
+		heir.inherit(outHeat, entry.Key, entry.sstIndex)
+		builder.props.MaxSequence = max(builder.props.MaxSequence, sstables[entry.sstIndex].props.MaxSequence)
+	}
 
-			// Open the newly created SSTable
-			path := filepath.Join(dataDir, fmt.Sprintf("L%d-%06d.sst", targetLevel, currentFileNum))
-			sst, err := OpenSSTable(path, targetLevel, currentFileNum)
-			if err != nil {
-				return nil, err
+	// An input that stopped early hit a block it couldn't read; its
+	// remaining entries are missing from the outputs
+	for _, it := range iterators {
+		if it.err != nil {
+			if builder != nil {
+				builder.Abort()
 			}
-			newSSTables = append(newSSTables, sst)
-
-			builder = nil
+			DeleteSSTables(newSSTables)
+			return nil, it.err
 		}
 	}
 
@@ -322,10 +598,12 @@ func mergeFiles(dataDir string, sstables []*SSTable, targetLevel int, nextFileNu
 		}
 
 		path := filepath.Join(dataDir, fmt.Sprintf("L%d-%06d.sst", targetLevel, currentFileNum))
-		sst, err := OpenSSTable(path, targetLevel, currentFileNum)
+		sst, err := openSSTable(common.FSOrDefault(opts.FS), path, targetLevel, currentFileNum, opts.Comparator)
 		if err != nil {
 			return nil, err
 		}
+		sst.heat = outHeat
+		sst.verify = opts.VerifyChecksums
 		newSSTables = append(newSSTables, sst)
 	}
 
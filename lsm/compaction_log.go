@@ -0,0 +1,204 @@
+package lsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+const (
+	// compactionLogFile is the compaction log in the data directory, one
+	// JSON CompactionEvent per line
+	compactionLogFile = "compaction_log.jsonl"
+
+	// compactionLogMaxSize is the size at which the compaction log is
+	// moved to compaction_log.jsonl.1, replacing the one there, and
+	// started over
+	compactionLogMaxSize = 16 << 20
+)
+
+// CompactionReason says why a compaction ran
+type CompactionReason string
+
+const (
+	// CompactionL0Files: L0 reached MaxL0Files and was pushed down
+	CompactionL0Files CompactionReason = "l0_files"
+	// CompactionL0Stitch: L0 reached MaxL0Files and was merged into one
+	// L0 file (see Config.L0StitchMaxBytes)
+	CompactionL0Stitch CompactionReason = "l0_stitch"
+	// CompactionL0Emergency: L0 reached L0EmergencyFiles while compaction
+	// was paused or outside its windows, and was pushed down anyway
+	CompactionL0Emergency CompactionReason = "l0_emergency"
+	// CompactionLevelSize: a level grew past its target size
+	CompactionLevelSize CompactionReason = "level_size"
+	// CompactionCold: a level grew past its target size, and its coldest
+	// file was pushed down (see Config.TrackTemperature)
+	CompactionCold CompactionReason = "cold"
+	// CompactionRekey: a file was rewritten onto the current encryption
+	// key (see RotateKeys)
+	CompactionRekey CompactionReason = "rekey"
+)
+
+// CompactionFile is an SSTable a compaction read or wrote
+type CompactionFile struct {
+	FileNum uint64 `json:"file_num"`
+	Level   int    `json:"level"`
+	Size    int64  `json:"size"`
+}
+
+// CompactionEvent describes a compaction, for Config.OnCompaction and the
+// compaction log
+type CompactionEvent struct {
+	Reason      CompactionReason `json:"reason"`
+	SourceLevel int              `json:"source_level"`
+	TargetLevel int              `json:"target_level"`
+
+	// Move is set when the inputs were moved to the target level without
+	// being rewritten; they are then also the outputs
+	Move bool `json:"move,omitempty"`
+
+	Inputs  []CompactionFile `json:"inputs"`
+	Outputs []CompactionFile `json:"outputs"`
+
+	// BytesRead and BytesWritten are the sizes of the input files merged
+	// and of the files written
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+
+	// Error is why the compaction failed, leaving the inputs in place
+	Error string `json:"error,omitempty"`
+}
+
+// compactionFiles describes SSTables of a level for a CompactionEvent
+func compactionFiles(level int, sstables []*SSTable) []CompactionFile {
+	files := make([]CompactionFile, 0, len(sstables))
+	for _, sst := range sstables {
+		files = append(files, CompactionFile{FileNum: sst.FileNum(), Level: level, Size: sst.Size()})
+	}
+	return files
+}
+
+// compactionLog appends CompactionEvents to the compaction log
+type compactionLog struct {
+	fs   common.FS
+	path string
+
+	mu   sync.Mutex
+	file common.File
+	size int64
+}
+
+// openCompactionLog opens the compaction log in dataDir, creating it if
+// needed
+func openCompactionLog(fs common.FS, dataDir string) (*compactionLog, error) {
+	l := &compactionLog{fs: fs, path: filepath.Join(dataDir, compactionLogFile)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file for appending
+func (l *compactionLog) open() error {
+	file, err := l.fs.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open compaction log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat compaction log: %w", err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// write appends an event to the log
+func (l *compactionLog) write(event CompactionEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("compaction log closed")
+	}
+
+	if l.size > 0 && l.size+int64(len(line)) > compactionLogMaxSize {
+		l.file.Close()
+		l.file = nil
+		if err := l.fs.Rename(l.path, l.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate compaction log: %w", err)
+		}
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.file.WriteAt(line, l.size); err != nil {
+		return fmt.Errorf("failed to write compaction log: %w", err)
+	}
+	l.size += int64(len(line))
+	return nil
+}
+
+// close closes the log file
+func (l *compactionLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// recordCompaction completes an event that started at event.Start and
+// reports it to Config.OnCompaction, the compaction log and Config.Tracer.
+// err is what the compaction failed with, if it did.
+func (lsm *LSM) recordCompaction(event CompactionEvent, err error) {
+	if lsm.config.OnCompaction == nil && lsm.compactionLog == nil && lsm.config.Tracer == nil {
+		return
+	}
+
+	event.Duration = time.Since(event.Start)
+	if event.Outputs == nil {
+		event.Outputs = []CompactionFile{}
+	}
+	if !event.Move {
+		for _, f := range event.Inputs {
+			event.BytesRead += f.Size
+		}
+		for _, f := range event.Outputs {
+			event.BytesWritten += f.Size
+		}
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	if lsm.config.Tracer != nil {
+		lsm.traceCompaction(event, err)
+	}
+	if lsm.config.OnCompaction != nil {
+		lsm.config.OnCompaction(event)
+	}
+	if lsm.compactionLog != nil {
+		if err := lsm.compactionLog.write(event); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package lsm
+
+import (
+	"cmp"
+	"strings"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// compareFunc orders LSM keys: negative, zero or positive as a sorts
+// before, equal to or after b
+type compareFunc func(a, b string) int
+
+// newCompareFunc adapts a comparator to string keys. The bytewise order
+// (and nil) use strings.Compare directly to avoid conversions.
+func newCompareFunc(c common.Comparator) compareFunc {
+	if common.IsBytewise(c) {
+		return strings.Compare
+	}
+	return func(a, b string) int {
+		return c.Compare([]byte(a), []byte(b))
+	}
+}
+
+// compareBytesFunc orders a key held as bytes against one held as a
+// string, like compareFunc, without converting either
+type compareBytesFunc func(a []byte, b string) int
+
+// newCompareBytesFunc adapts a comparator to compareBytesFunc
+func newCompareBytesFunc(c common.Comparator) compareBytesFunc {
+	if common.IsBytewise(c) {
+		return compareBytes
+	}
+	return func(a []byte, b string) int {
+		return c.Compare(a, []byte(b))
+	}
+}
+
+// compareBytes orders a and b bytewise
+func compareBytes(a []byte, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
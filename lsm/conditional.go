@@ -0,0 +1,216 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Conditional writes give callers optimistic concurrency without
+// transactions: read a key with GetWithMeta, then write it back with
+// PutIf, which fails with common.ErrConflict if another write reached
+// the key in between, so the caller can read it again and retry.
+//
+// SSTables don't record a sequence number per key, only the highest of
+// the file (SSTableProperties.MaxSequence), so a key that is only on disk
+// reports that. It is at least the sequence number of the key's last
+// write and grows with every later write of it, so a conditional write
+// never succeeds over one; but it also grows when the key is flushed or
+// compacted, so a conditional write can fail without one. With
+// Config.KeepVersions, SSTables record each key's, which is reported
+// instead.
+
+// GetWithMeta is Get also returning the key's sequence number, as PutIf
+// expects it: that of its last write while it is in a memtable, and of
+// the SSTable holding it after. A missing key has 0.
+func (lsm *LSM) GetWithMeta(key string) (value []byte, seq uint64, found bool, err error) {
+	if err := lsm.gate.Enter(); err != nil {
+		return nil, 0, false, err
+	}
+	defer lsm.gate.Exit()
+
+	// Track read
+	lsm.stats.readCount.Add(1)
+
+	// Keep value log GC from removing a file the pointer we find is into
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	var valuePtr bool
+	lsm.mu.RLock()
+	found, seq, err = lsm.lookupLocked(key, &readProbes{}, lsm.mu.RUnlock, func(v []byte, ptr bool) error {
+		value, valuePtr = bytes.Clone(v), ptr
+		return nil
+	})
+	if err != nil {
+		lsm.handleCorruption(err)
+		return nil, 0, false, err
+	}
+	if !found {
+		return nil, 0, false, nil
+	}
+	if valuePtr {
+		if value, err = lsm.vlog.read(key, value); err != nil {
+			return nil, 0, false, err
+		}
+	}
+	return value, seq, true, nil
+}
+
+// PutIf writes key only if its sequence number is still expectedSeq, as
+// GetWithMeta returned it (0 = the key doesn't exist), and fails with
+// common.ErrConflict otherwise
+func (lsm *LSM) PutIf(key string, value []byte, expectedSeq uint64) error {
+	return lsm.update(key, false, func(_ []byte, seq uint64, _ bool) ([]byte, error) {
+		if seq != expectedSeq {
+			return nil, fmt.Errorf("%w: %s is at sequence %d, not %d", common.ErrConflict, key, seq, expectedSeq)
+		}
+		return value, nil
+	})
+}
+
+// CompareAndSwap writes value to key only if the key holds old, or
+// doesn't exist if old is nil, and fails with common.ErrConflict
+// otherwise. An empty old matches an empty value, not a missing key.
+func (lsm *LSM) CompareAndSwap(key string, old, value []byte) error {
+	return lsm.update(key, true, func(current []byte, _ uint64, found bool) ([]byte, error) {
+		if found != (old != nil) || !bytes.Equal(current, old) {
+			return nil, fmt.Errorf("%w: %s has changed", common.ErrConflict, key)
+		}
+		return value, nil
+	})
+}
+
+// Incr adds delta to the counter at key and returns its new value (see
+// common.Incrementer). It reads and writes the key under the write lock,
+// as CompareAndSwap does, so concurrent increments never lose one.
+func (lsm *LSM) Incr(key string, delta int64) (int64, error) {
+	var n int64
+	err := lsm.update(key, true, func(current []byte, _ uint64, found bool) ([]byte, error) {
+		value, sum, err := common.AddCounter(current, found, delta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		n = sum
+		return value, nil
+	})
+	return n, err
+}
+
+// Append adds suffix to the end of key's value, a missing key taking
+// suffix as its value (see common.Appender). Like Incr it reads and
+// writes the key under the write lock.
+func (lsm *LSM) Append(key string, suffix []byte) error {
+	return lsm.update(key, true, func(current []byte, _ uint64, _ bool) ([]byte, error) {
+		return append(current, suffix...), nil
+	})
+}
+
+// errKeyExists stops PutIfAbsent's update from writing
+var errKeyExists = errors.New("key exists")
+
+// PutIfAbsent writes key only if it doesn't exist, reporting whether it
+// did (see common.Inserter). The memtables and SSTables are searched
+// under the write lock the write then holds, without reading a value.
+func (lsm *LSM) PutIfAbsent(key string, value []byte) (bool, error) {
+	err := lsm.update(key, false, func(_ []byte, _ uint64, found bool) ([]byte, error) {
+		if found {
+			return nil, errKeyExists
+		}
+		return value, nil
+	})
+	if err == errKeyExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// update writes to key the value fn returns for the key's current value,
+// sequence number and existence, or nothing if fn fails. It holds lsm.mu
+// for writing from the read to the write, so no other write lands in
+// between. The current value is only read from the value log if resolve
+// is set; otherwise fn gets nil.
+func (lsm *LSM) update(key string, resolve bool, fn func(value []byte, seq uint64, found bool) ([]byte, error)) error {
+	return lsm.readLocked(key, resolve, func(current []byte, seq uint64, found bool) error {
+		value, err := fn(current, seq, found)
+		if err != nil {
+			return err
+		}
+		if err := lsm.putLocked(key, value); err != nil {
+			return err
+		}
+		lsm.stats.writeCount.Add(1)
+		return nil
+	})
+}
+
+// readLocked reads key as update does, and calls fn with it holding
+// lsm.mu for writing, for fn to write the key
+func (lsm *LSM) readLocked(key string, resolve bool, fn func(value []byte, seq uint64, found bool) error) error {
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+
+	// Taken before lsm.mu, as reads do
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	var current []byte
+	var valuePtr bool
+	found, seq, err := lsm.lookupLocked(key, nil, func() {}, func(v []byte, ptr bool) error {
+		if resolve {
+			current, valuePtr = bytes.Clone(v), ptr
+		}
+		return nil
+	})
+	if err != nil {
+		lsm.handleCorruption(err)
+		return err
+	}
+	if found && valuePtr {
+		if current, err = lsm.vlog.read(key, current); err != nil {
+			return err
+		}
+	}
+
+	return fn(current, seq, found)
+}
+
+// putLocked is Put for a caller holding lsm.mu for writing
+func (lsm *LSM) putLocked(key string, value []byte) error {
+	if lsm.config.ValueThreshold > 0 && len(value) >= lsm.config.ValueThreshold {
+		return lsm.putValuePointerLocked(key, value)
+	}
+
+	seq := atomic.AddUint64(&lsm.sequence, 1)
+	err := lsm.wal.Append(key, value, seq, false)
+	lsm.walErr.Set(err)
+	if err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+	lsm.activeMemtable.Put(key, value, seq)
+	lsm.rotateMemtable()
+	return nil
+}
+
+// fileSequence returns the sequence number of the keys an SSTable holds,
+// as GetWithMeta reports them. Files that don't record one were written
+// before the tree was opened, so the sequence number it was opened at is
+// as high as any of their writes.
+func (lsm *LSM) fileSequence(sst *SSTable) uint64 {
+	if seq := sst.props.MaxSequence; seq != 0 {
+		return seq
+	}
+	return lsm.legacySequence
+}
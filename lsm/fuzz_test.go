@@ -0,0 +1,124 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/common/wal"
+)
+
+// sstableSeed returns the bytes of a small SSTable, for the fuzzers to
+// start from
+func sstableSeed(t testing.TB, numKeys int) []byte {
+	fs := common.NewMemFS()
+	builder, err := newSSTableBuilder(fs, "seed.sst", numKeys, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := builder.Add(fmt.Sprintf("key%05d", i), []byte(fmt.Sprintf("value%d", i)), i%7 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open("seed.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// FuzzSSTable opens corrupt SSTables and reads everything in them: the
+// footer, metadata, index and bloom filter must be rejected or parse, and
+// damaged blocks fail reads, without a panic
+func FuzzSSTable(f *testing.F) {
+	f.Add(sstableSeed(f, 3))
+	f.Add(sstableSeed(f, 500))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := common.NewMemFS()
+		file, err := fs.Create("fuzz.sst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(data)
+		file.Close()
+
+		sst, err := openSSTable(fs, "fuzz.sst", 0, 1, nil)
+		if err != nil {
+			return
+		}
+		defer sst.Close()
+
+		it, err := NewSSTableIterator(sst, 0)
+		if err != nil {
+			return
+		}
+		for {
+			entry, ok := it.Next()
+			if !ok {
+				break
+			}
+			sst.Get(entry.Key)
+		}
+		sst.Get(sst.MinKey())
+		sst.Get(sst.MaxKey())
+		sst.Get("")
+
+		scan := newSSTableScanIterator(sst, sst.MinKey())
+		for scan.SeekToFirst(); scan.Valid(); scan.Next() {
+			scan.Key()
+			scan.Value()
+		}
+	})
+}
+
+// FuzzDecodeIndex decodes corrupt index blocks, with and without block
+// checksums
+func FuzzDecodeIndex(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 'k', 'e', 'y'}, false)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, true)
+
+	f.Fuzz(func(t *testing.T, data []byte, checksums bool) {
+		decodeIndex(data, checksums)
+	})
+}
+
+// FuzzSearchBlock searches corrupt data blocks of each format
+func FuzzSearchBlock(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 'k', 'v'}, uint8(blockFormatPlain), "k")
+	f.Add([]byte{2, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0}, uint8(blockFormatPlain), "k")
+	f.Add([]byte{1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 'k', 'v', 4, 0, 0, 0, 1, 0, 0, 0}, uint8(blockFormatRestarts), "k")
+	f.Add([]byte{1, 0, 0, 0, 0xff, 0, 0, 0, 2, 0, 0, 0}, uint8(blockFormatRestarts), "k")
+	f.Add([]byte{2, 0, 0, 0, 0, 2, 1, 0, 'k', 'a', 'v', 1, 1, 1, 0, 'b', 'w', 4, 0, 0, 0, 1, 0, 0, 0}, uint8(blockFormatDelta), "kb")
+	f.Add([]byte{2, 0, 0, 0, 0, 2, 1, 0, 'k', 'a', 'v', 1, 1, 1, 0, 'b', 'w', 4, 0, 0, 0, 1, 0, 0, 0, 4, 0, 11, 0, 2, 0, 0, 0}, uint8(blockFormatOffsets), "kb")
+
+	f.Fuzz(func(t *testing.T, block []byte, format uint8, key string) {
+		entry, found, err := searchBlock(block, blockFormat(format%4), key, newCompareBytesFunc(nil))
+		if found && err == nil && entry.Key != key {
+			t.Fatalf("searchBlock(%q) found %q", key, entry.Key)
+		}
+	})
+}
+
+// FuzzDecodeWALEntry decodes corrupt WAL record payloads of every type
+func FuzzDecodeWALEntry(f *testing.F) {
+	f.Add(uint8(walPut), []byte{1, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 'k', 'e', 'y', 'v'})
+	f.Add(uint8(walPutDeflated), []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 'k', 0xff, 0xff})
+	f.Add(uint8(walDelete), []byte{})
+
+	f.Fuzz(func(t *testing.T, typ uint8, data []byte) {
+		decodeEntry(wal.Record{Type: wal.RecordType(typ), Data: data})
+	})
+}
@@ -0,0 +1,57 @@
+package lsm
+
+import (
+	"fmt"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Health diagnoses the tree (see common.Health). It counts as stalled
+// when a full memtable is waiting on the previous flush, or when L0 has
+// collected twice MaxL0Files files because compaction can't keep up.
+func (lsm *LSM) Health() common.Health {
+	h := common.Health{
+		WALWritable: true,
+		DiskFree:    common.DiskFreeOrUnknown(lsm.config.FS, lsm.config.DataDir),
+		DiskReserve: lsm.config.DiskReserveBytes,
+		ReadOnly:    lsm.disk.ReadOnly(),
+		Workers: map[string]bool{
+			"flush":        lsm.workers.flush.Load(),
+			"compaction":   lsm.workers.compaction.Load(),
+			"value log GC": lsm.workers.valueLogGC.Load(),
+		},
+		CorruptionCount: lsm.corruption.Count(),
+		Quarantined:     lsm.corruption.Files(),
+		Closed:          lsm.gate.Closed(),
+	}
+	if lsm.config.WALArchive != nil {
+		h.Workers["WAL archive"] = lsm.workers.walArchive.Load()
+	}
+	h.WorkerPanics, h.LastWorkerPanic = lsm.supervisor.Panics()
+	if err := lsm.walErr.Err(); err != nil {
+		h.WALWritable = false
+		h.WALError = err
+	}
+
+	h.StallReason = lsm.stallReason()
+	h.Stalled = h.StallReason != ""
+
+	h.Diagnose()
+	return h
+}
+
+// stallReason returns why writes are stalled, or "" if they aren't
+func (lsm *LSM) stallReason() string {
+	lsm.mu.RLock()
+	flushBehind := lsm.immutableMemtable != nil && lsm.activeMemtable.IsFull()
+	lsm.mu.RUnlock()
+
+	l0Files := lsm.levels.NumFiles(0)
+	switch {
+	case flushBehind:
+		return "a full memtable is waiting on the previous flush"
+	case lsm.config.MaxL0Files > 0 && l0Files >= 2*lsm.config.MaxL0Files:
+		return fmt.Sprintf("L0 has %d files, compaction is behind", l0Files)
+	}
+	return ""
+}
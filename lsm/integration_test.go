@@ -1,14 +1,25 @@
 package lsm
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/common/wal"
 )
 
 func TestCrashRecovery(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/lsm-crash-test-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-crash-test-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	// Create LSM and write data
@@ -63,7 +74,7 @@ func TestCrashRecovery(t *testing.T) {
 }
 
 func TestCompactionPreservesData(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/lsm-compaction-test-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-compaction-test-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -116,7 +127,7 @@ func TestCompactionPreservesData(t *testing.T) {
 }
 
 func TestBloomFilterEffectiveness(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/lsm-bloom-test-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-bloom-test-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -161,7 +172,7 @@ func TestBloomFilterEffectiveness(t *testing.T) {
 }
 
 func TestUpdatesDuringCompaction(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/lsm-update-test-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-update-test-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -218,8 +229,243 @@ func TestUpdatesDuringCompaction(t *testing.T) {
 	t.Log("Updates are correctly preserved with latest values")
 }
 
+func TestScanSnapshotDuringCompaction(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-scan-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 16 * 1024
+	config.MaxL0Files = 2
+	config.ValueThreshold = 256
+	config.ValueLogFileSize = 64 * 1024
+	config.ValueLogGCInterval = time.Hour // GC is run by hand below
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	// Even keys get large values, which live in the value log
+	const numKeys = 3000
+	valueFor := func(version, i int) []byte {
+		value := []byte(fmt.Sprintf("v%d-%05d", version, i))
+		if i%2 == 0 {
+			value = append(value, make([]byte, 300)...)
+		}
+		return value
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), valueFor(1, i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%200 == 199 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for i := 0; i < numKeys; i += 10 {
+		if err := lsm.Delete(fmt.Sprintf("key%05d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Everything the snapshot holds: keys not deleted, at version 1
+	iter := lsm.Scan("", "")
+
+	// Overwrite, delete and add keys, flushing and compacting underneath
+	// the iterator, while value log GC reclaims the overwritten values
+	done := make(chan struct{})
+	writeErr := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			var err error
+			switch {
+			case i%10 == 1:
+				err = lsm.Delete(key)
+			default:
+				err = lsm.Put(key, valueFor(2, i))
+			}
+			if err == nil {
+				err = lsm.Put(key+"-new", []byte("new"))
+			}
+			if err != nil {
+				writeErr <- err
+				return
+			}
+			if i%200 == 199 {
+				time.Sleep(10 * time.Millisecond)
+				lsm.RunValueLogGC(0.1)
+			}
+		}
+	}()
+
+	count := 0
+	lastKey := ""
+	for ; iter.Valid(); iter.Next() {
+		var i int
+		if _, err := fmt.Sscanf(iter.Key(), "key%05d", &i); err != nil || iter.Key() != fmt.Sprintf("key%05d", i) {
+			t.Fatalf("Unexpected key %q in snapshot", iter.Key())
+		}
+		if iter.Key() <= lastKey {
+			t.Fatalf("Key %s returned after %s", iter.Key(), lastKey)
+		}
+		if i%10 == 0 {
+			t.Fatalf("Deleted key %s returned", iter.Key())
+		}
+		if !bytes.Equal(iter.Value(), valueFor(1, i)) {
+			t.Fatalf("Key %s has value %q, expected the snapshot's", iter.Key(), iter.Value()[:8])
+		}
+		lastKey = iter.Key()
+		count++
+		if count%100 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatalf("Iterator error: %v", err)
+	}
+	if expected := numKeys - numKeys/10; count != expected {
+		t.Fatalf("Expected %d keys in snapshot, got %d", expected, count)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	<-done
+	select {
+	case err := <-writeErr:
+		t.Fatalf("Write failed: %v", err)
+	default:
+	}
+	if lsm.stats.compactCount.Load() == 0 {
+		t.Error("Expected compactions while the iterator was open")
+	}
+
+	// A bounded scan sees the new state
+	iter = lsm.Scan("key00100", "key00119")
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	iter.Close()
+	var expected []string
+	for i := 100; i < 120; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if i%10 != 1 {
+			expected = append(expected, key)
+		}
+		if i < 119 {
+			expected = append(expected, key+"-new")
+		}
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("Bounded scan returned %v, expected %v", keys, expected)
+	}
+
+	// Files compacted away while the iterator held them are gone now
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	onDisk := 0
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".sst") {
+			onDisk++
+		}
+	}
+	if live := lsm.levels.GetTotalFiles(); onDisk != live {
+		t.Errorf("Expected %d SSTables on disk, found %d", live, onDisk)
+	}
+}
+
+func TestConcurrentScans(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-scan-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 8 * 1024
+	config.MaxL0Files = 2
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	// Stable keys are always present; churn keys come and go
+	const numStable = 500
+	for i := 0; i < numStable; i++ {
+		if err := lsm.Put(fmt.Sprintf("stable%04d", i), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for round := 0; ; round++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for i := 0; i < 100; i++ {
+				lsm.Put(fmt.Sprintf("stable%04d", (round*100+i)%numStable), []byte(fmt.Sprintf("v%d", round)))
+				lsm.Put(fmt.Sprintf("churn%04d", i), []byte("c"))
+			}
+			for i := 0; i < 100; i += 2 {
+				lsm.Delete(fmt.Sprintf("churn%04d", i))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	errs := make(chan error, 4)
+	for s := 0; s < 4; s++ {
+		go func() {
+			for n := 0; n < 30; n++ {
+				iter := lsm.Scan("stable", "stable~")
+				seen := 0
+				last := ""
+				for ; iter.Valid(); iter.Next() {
+					if iter.Key() <= last {
+						errs <- fmt.Errorf("key %s returned after %s", iter.Key(), last)
+						iter.Close()
+						return
+					}
+					last = iter.Key()
+					seen++
+				}
+				err := iter.Error()
+				iter.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if seen != numStable {
+					errs <- fmt.Errorf("scan returned %d of %d stable keys", seen, numStable)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	for s := 0; s < 4; s++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	<-writerDone
+}
+
 func TestPersistenceAcrossRestart(t *testing.T) {
-	dir := fmt.Sprintf("/tmp/lsm-persist-test-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-persist-test-%d", time.Now().UnixNano()))
 	defer os.RemoveAll(dir)
 
 	config := DefaultConfig(dir)
@@ -278,3 +524,1426 @@ func TestPersistenceAcrossRestart(t *testing.T) {
 
 	t.Log("Data persisted across restart successfully")
 }
+
+func TestRecoveryProgressAndCancel(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-progress-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	lsm.Close()
+
+	// Reopen with a progress callback: SSTable loading must finish
+	var reports []common.RecoveryProgress
+	config.OnRecoveryProgress = func(p common.RecoveryProgress) {
+		reports = append(reports, p)
+	}
+	lsm2, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	lsm2.Close()
+
+	var loaded bool
+	for _, p := range reports {
+		if p.Phase == common.PhaseSSTableLoad && p.Done {
+			loaded = true
+			if p.Entries != p.TotalEntries || p.Entries == 0 {
+				t.Errorf("Expected all %d SSTables loaded, got %d", p.TotalEntries, p.Entries)
+			}
+		}
+	}
+	if !loaded {
+		t.Fatalf("No completed %s report in %+v", common.PhaseSSTableLoad, reports)
+	}
+
+	// A cancelled context aborts the open
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewWithContext(ctx, DefaultConfig(dir)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// and leaves the database openable
+	lsm3, err := New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM after cancelled open: %v", err)
+	}
+	defer lsm3.Close()
+	if _, found, err := lsm3.Get("key0042"); err != nil || !found {
+		t.Fatalf("Expected key0042 after reopen, found=%v err=%v", found, err)
+	}
+}
+
+func TestCrashWithMemFS(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-memfs")
+	config.FS = fs
+	config.MemTableSize = 16 * 1024
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	// Enough to flush a few SSTables, then sync the WAL
+	const numSynced = 1000
+	for i := 0; i < numSynced; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), bytes.Repeat([]byte{'v'}, 100)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := lsm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// Written but never synced: a crash loses these
+	for i := numSynced; i < numSynced+10; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), []byte("unsynced")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(config.DataDir); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing on disk, stat returned %v", err)
+	}
+
+	config.FS = fs.CrashClone()
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover LSM: %v", err)
+	}
+	defer recovered.Close()
+
+	for i := 0; i < numSynced; i++ {
+		if _, found, err := recovered.Get(fmt.Sprintf("key%05d", i)); err != nil || !found {
+			t.Fatalf("Synced key%05d lost in crash: found=%v err=%v", i, found, err)
+		}
+	}
+	for i := numSynced; i < numSynced+10; i++ {
+		if _, found, _ := recovered.Get(fmt.Sprintf("key%05d", i)); found {
+			t.Errorf("Unsynced key%05d survived the crash", i)
+		}
+	}
+}
+
+func TestWALDamage(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-wal-damage")
+	config.FS = fs
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	walPath := filepath.Join(config.DataDir, "wal.log")
+	damage := func(fs *common.MemFS, flag int, apply func(f common.File)) {
+		f, err := fs.OpenFile(walPath, os.O_RDWR|flag, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open WAL: %v", err)
+		}
+		apply(f)
+		f.Close()
+	}
+	reopen := func(fs *common.MemFS) *LSM {
+		config := config
+		config.FS = fs
+		recovered, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to recover LSM: %v", err)
+		}
+		return recovered
+	}
+	check := func(lsm *LSM, intact int) {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			if _, found, err := lsm.Get(key); err != nil || found != (i < intact) {
+				t.Fatalf("Get %s: expected found=%v, got %v err=%v", key, i < intact, found, err)
+			}
+		}
+	}
+
+	// A torn last record is dropped, and appends after it are readable
+	torn := fs.CrashClone()
+	damage(torn, os.O_APPEND, func(f common.File) { f.Write([]byte("partial record")) })
+	recovered := reopen(torn)
+	check(recovered, 100)
+	if n := recovered.corruption.Count(); n != 0 {
+		t.Errorf("Expected a torn write not to count as corruption, got %d", n)
+	}
+	if err := recovered.Put("after", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := recovered.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	again := reopen(torn.CrashClone())
+	if _, found, err := again.Get("after"); err != nil || !found {
+		t.Errorf("Expected the record written after the torn one, found=%v err=%v", found, err)
+	}
+	again.Close()
+	recovered.Close()
+
+	// A damaged record ends the log there: it and the records after it
+	// are dropped, the ones before it recovered
+	corrupt := fs.CrashClone()
+	const recordHeaderSize = 9 + 12 // Framing, then sequence and key size
+	recordSize := int64(recordHeaderSize + len("key0000") + len("value"))
+	damage(corrupt, 0, func(f common.File) {
+		f.WriteAt([]byte{0xff}, wal.HeaderSize+60*recordSize+recordHeaderSize)
+	})
+	recovered = reopen(corrupt)
+	defer recovered.Close()
+	check(recovered, 60)
+	if n := recovered.corruption.Count(); n != 1 {
+		t.Errorf("Expected 1 corruption, got %d", n)
+	}
+}
+
+func TestWALCompression(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-wal-compression")
+	config.FS = fs
+	config.WALCompression = true
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	value := bytes.Repeat([]byte("compressible "), 100)
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Put("small", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := lsm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	info, err := fs.Stat(filepath.Join(config.DataDir, "wal.log"))
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	if raw := int64(100 * len(value)); info.Size() > raw/4 {
+		t.Errorf("Expected the WAL well under %d bytes, got %d", raw, info.Size())
+	}
+
+	// Readable without the setting
+	config.FS = fs.CrashClone()
+	config.WALCompression = false
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover LSM: %v", err)
+	}
+	defer recovered.Close()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if got, found, err := recovered.Get(key); err != nil || !found || !bytes.Equal(got, value) {
+			t.Fatalf("Get %s: found=%v err=%v, value intact %v", key, found, err, bytes.Equal(got, value))
+		}
+	}
+	if got, found, err := recovered.Get("small"); err != nil || !found || string(got) != "value" {
+		t.Errorf("Get small: got %q found=%v err=%v", got, found, err)
+	}
+}
+
+func TestLegacyWAL(t *testing.T) {
+	// Records as written before the shared log format: version 1 has no
+	// header, version 2 has one and may deflate values
+	record := func(key string, value []byte, seq uint64, flags byte) []byte {
+		buf := make([]byte, 21+len(key)+len(value))
+		binary.LittleEndian.PutUint64(buf[4:], seq)
+		binary.LittleEndian.PutUint32(buf[12:], uint32(len(key)))
+		binary.LittleEndian.PutUint32(buf[16:], uint32(len(value)))
+		buf[20] = flags
+		copy(buf[21:], key)
+		copy(buf[21+len(key):], value)
+		binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+		return buf
+	}
+	value := bytes.Repeat([]byte("v"), 200)
+	version2 := binary.LittleEndian.AppendUint32(nil, legacyWALMagic)
+	version2 = binary.LittleEndian.AppendUint32(version2, 2)
+
+	for name, contents := range map[string][]byte{
+		"version1": nil,
+		"version2": version2,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs := common.NewMemFS()
+			config := DefaultConfig("/lsm-legacy-wal")
+			config.FS = fs
+
+			for i := 0; i < 10; i++ {
+				contents = append(contents, record(fmt.Sprintf("key%04d", i), value, uint64(i+1), 0)...)
+			}
+			contents = append(contents, record("key0003", nil, 11, entryDeleted)...)
+			if name == "version2" {
+				contents = append(contents, record("key0010", deflate(value), 12, legacyWALCompressedFlag)...)
+			}
+			if err := fs.MkdirAll(config.DataDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			walPath := filepath.Join(config.DataDir, "wal.log")
+			f, err := fs.Create(walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(contents); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			lsm, err := New(config)
+			if err != nil {
+				t.Fatalf("Failed to open LSM: %v", err)
+			}
+			defer lsm.Close()
+
+			converted, err := common.ReadFile(fs, walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(converted, []byte(walMagic)) {
+				t.Errorf("Expected the WAL converted on open, starts with %q", converted[:8])
+			}
+
+			// The converted WAL carries on
+			if err := lsm.Put("key0011", value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if err := lsm.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			config.FS = fs.CrashClone()
+			recovered, err := New(config)
+			if err != nil {
+				t.Fatalf("Failed to recover LSM: %v", err)
+			}
+			defer recovered.Close()
+
+			for i := 0; i <= 11; i++ {
+				key := fmt.Sprintf("key%04d", i)
+				want := i != 3 && (i != 10 || name == "version2")
+				got, found, err := recovered.Get(key)
+				if err != nil || found != want || (found && !bytes.Equal(got, value)) {
+					t.Fatalf("Get %s: expected found=%v, got %v err=%v", key, want, found, err)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectedWALFault(t *testing.T) {
+	fs := common.NewFaultFS(common.NewMemFS())
+	config := DefaultConfig("/lsm-faults")
+	config.FS = fs
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	if err := lsm.Put("before", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// A write the WAL can't persist must not be acknowledged
+	fs.FailAfter(common.FaultWrite, "wal.log", 0, nil)
+	if err := lsm.Put("failed", []byte("value")); !errors.Is(err, common.ErrInjectedFault) {
+		t.Fatalf("Expected the injected fault, got %v", err)
+	}
+
+	fs.Heal()
+	if err := lsm.Put("after", []byte("value")); err != nil {
+		t.Fatalf("Put after heal failed: %v", err)
+	}
+	for _, key := range []string{"before", "after"} {
+		if _, found, err := lsm.Get(key); err != nil || !found {
+			t.Errorf("Get %s: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+// TestHealth tests that Health reports a failing WAL, a full disk and
+// a closed tree, and recovers once the WAL does
+func TestHealth(t *testing.T) {
+	mem := common.NewMemFS()
+	fs := common.NewFaultFS(mem)
+	config := DefaultConfig("/lsm-health")
+	config.FS = fs
+	config.DiskReserveBytes = 1 << 20
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	if h := lsm.Health(); !h.OK || h.DiskFree != -1 {
+		t.Fatalf("Expected a healthy tree with unknown disk space, got %+v", h)
+	}
+	for _, name := range []string{"flush", "compaction", "value log GC"} {
+		if running, ok := lsm.Health().Workers[name]; !ok || !running {
+			t.Errorf("Expected the %s worker to be running", name)
+		}
+	}
+
+	mem.SetDiskFree(1 << 10)
+	if h := lsm.Health(); h.OK || h.DiskFree != 1<<10 || len(h.Problems) != 1 {
+		t.Errorf("Expected the disk reserve problem, got %+v", h)
+	}
+	mem.SetDiskFree(1 << 30)
+
+	fs.FailAfter(common.FaultWrite, "wal.log", 0, nil)
+	lsm.Put("failed", []byte("value"))
+	h := lsm.Health()
+	if h.OK || h.WALWritable || !errors.Is(h.WALError, common.ErrInjectedFault) {
+		t.Errorf("Expected an unwritable WAL, got %+v", h)
+	}
+
+	fs.Heal()
+	if err := lsm.Put("after", []byte("value")); err != nil {
+		t.Fatalf("Put after heal failed: %v", err)
+	}
+	if h := lsm.Health(); !h.OK {
+		t.Errorf("Expected a healthy tree once the WAL recovered, got %+v", h)
+	}
+
+	lsm.Close()
+	h = lsm.Health()
+	if h.OK || !h.Closed || len(h.Problems) != 1 {
+		t.Errorf("Expected only the closed problem after Close, got %+v", h)
+	}
+}
+
+// TestWorkerPanic tests that a panic in the compaction worker is
+// recovered, reported to the hook and by Health, and that the worker is
+// restarted and compacts again
+func TestWorkerPanic(t *testing.T) {
+	config := DefaultConfig("/lsm-panic")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 4 * 1024
+	config.L0StitchMaxBytes = 0
+
+	var compactions atomic.Int64
+	config.OnCompaction = func(CompactionEvent) {
+		if compactions.Add(1) == 1 {
+			panic("injected")
+		}
+	}
+	panics := make(chan *common.WorkerPanic, 10)
+	config.OnWorkerPanic = func(p *common.WorkerPanic) { panics <- p }
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	// Writes until compactions have run again after the panic
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; compactions.Load() < 2; i++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected compactions after the panic, got %d", compactions.Load())
+		}
+		if err := lsm.Put(fmt.Sprintf("key%04d", i%500), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	select {
+	case p := <-panics:
+		if p.Worker != "compaction" || p.Value != "injected" || len(p.Stack) == 0 {
+			t.Errorf("Unexpected panic: %+v", p)
+		}
+	default:
+		t.Fatal("Expected the panic reported to OnWorkerPanic")
+	}
+	h := lsm.Health()
+	if h.OK || h.WorkerPanics != 1 || h.LastWorkerPanic == nil || !h.Workers["compaction"] {
+		t.Errorf("Expected the panic reported and the worker running again, got %+v", h)
+	}
+	if _, found, err := lsm.Get("key0001"); err != nil || !found {
+		t.Errorf("Get after the panic: found=%v err=%v", found, err)
+	}
+}
+
+// TestDiskLowWatermark tests that a flush finding the disk nearly full is
+// refused, turning the tree read-only, and that it recovers once space is
+// freed
+func TestDiskLowWatermark(t *testing.T) {
+	mem := common.NewMemFS()
+	config := DefaultConfig("/lsm-watermark")
+	config.FS = mem
+	config.MemTableSize = 4 * 1024
+	config.DiskLowWatermarkBytes = 1 << 20
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	mem.SetDiskFree(1 << 10)
+	var refused error
+	for i := 0; i < 1000 && refused == nil; i++ {
+		refused = lsm.Put(fmt.Sprintf("key%04d", i), []byte("value"))
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(refused, common.ErrDiskFull) {
+		t.Fatalf("Expected writes to be refused with ErrDiskFull, got %v", refused)
+	}
+	if n := lsm.levels.NumFiles(0); n != 0 {
+		t.Errorf("Expected no SSTables written, got %d", n)
+	}
+	if h := lsm.Health(); !h.ReadOnly {
+		t.Errorf("Expected Health to report read-only, got %+v", h)
+	}
+	if err := lsm.Delete("key0000"); !errors.Is(err, common.ErrDiskFull) {
+		t.Errorf("Expected Delete to be refused, got %v", err)
+	}
+
+	mem.SetDiskFree(1 << 30)
+	if err := lsm.Put("after", []byte("value")); err != nil {
+		t.Fatalf("Put after freeing space failed: %v", err)
+	}
+	for i := 0; i < 100 && lsm.levels.NumFiles(0) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lsm.levels.NumFiles(0) == 0 {
+		t.Error("Expected the refused flush to be retried")
+	}
+	if h := lsm.Health(); h.ReadOnly {
+		t.Errorf("Expected the tree writable again, got %+v", h)
+	}
+	if _, found, err := lsm.Get("key0000"); err != nil || !found {
+		t.Errorf("Get key0000: found=%v err=%v", found, err)
+	}
+	if events := lsm.disk.Events(); events != 1 {
+		t.Errorf("Expected 1 disk full event, got %d", events)
+	}
+}
+
+// TestPacedDeletion tests that compacted SSTables are deleted in the
+// background, and that ones a crash leaves behind are deleted on the next
+// open rather than loaded
+func TestPacedDeletion(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-paced-delete")
+	config.FS = fs
+	config.MemTableSize = 4 * 1024
+	config.MaxL0Files = 2
+	config.DeleteBytesPerSecond = 1 // Only the first file goes before Close
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	// Scattered keys, so flushed files overlap and compaction rewrites
+	// them instead of moving them down
+	keyNum := func(i int) int { return i * 7 % 2000 }
+
+	written := 0
+	for ; written < 2000 && lsm.deleter.Pending() == 0; written++ {
+		n := keyNum(written)
+		if err := lsm.Put(fmt.Sprintf("key%05d", n), []byte(fmt.Sprintf("value%05d", n))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if written%50 == 49 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if lsm.deleter.Pending() == 0 {
+		t.Fatal("Expected compacted files queued for deletion")
+	}
+	if err := lsm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	sstFiles := func(fs common.FS) map[string]bool {
+		entries, err := fs.ReadDir(config.DataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]bool)
+		for _, e := range entries {
+			if filepath.Ext(e.Name()) == ".sst" {
+				names[e.Name()] = true
+			}
+		}
+		return names
+	}
+	liveFiles := func(lsm *LSM) map[string]bool {
+		names := make(map[string]bool)
+		for level := 0; level < lsm.levels.NumLevels(); level++ {
+			for _, sst := range lsm.levels.GetAllSSTables(level) {
+				names[filepath.Base(sst.Path())] = true
+			}
+		}
+		return names
+	}
+	if len(sstFiles(fs)) <= len(liveFiles(lsm)) {
+		t.Fatal("Expected replaced SSTables still on disk")
+	}
+
+	crashed := fs.CrashClone()
+	config.FS = crashed
+	config.DeleteBytesPerSecond = 0
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover LSM: %v", err)
+	}
+	if onDisk, live := sstFiles(crashed), liveFiles(recovered); len(onDisk) != len(live) {
+		t.Errorf("Expected leftovers deleted on open: %d files on disk, %d live", len(onDisk), len(live))
+	}
+	for i := 0; i < written; i++ {
+		key := fmt.Sprintf("key%05d", keyNum(i))
+		value, found, err := recovered.Get(key)
+		if err != nil || !found || string(value) != fmt.Sprintf("value%05d", keyNum(i)) {
+			t.Fatalf("Get %s: got %q, found=%v err=%v", key, value, found, err)
+		}
+	}
+	recovered.Close()
+
+	lsm.Close()
+	m, err := readManifest(fs, config.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk := len(sstFiles(fs)); onDisk != len(m.Files) || lsm.deleter.Pending() != 0 {
+		t.Errorf("Expected the queue drained by Close: %d files on disk, %d in the manifest, %d pending", onDisk, len(m.Files), lsm.deleter.Pending())
+	}
+}
+
+// TestInMemory tests that an in-memory LSM flushes, compacts and reads
+// back like one on disk without creating any files
+func TestInMemory(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	config := DefaultConfig(dir)
+	config.InMemory = true
+	config.MemTableSize = 16 * 1024
+	config.ValueThreshold = 512 // Exercise the value log too
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	value := func(i int) []byte {
+		if i%10 == 0 {
+			return bytes.Repeat([]byte{byte('a' + i%26)}, 1024)
+		}
+		return []byte(fmt.Sprintf("value%05d", i))
+	}
+
+	const numKeys = 2000
+	for i := 0; i < numKeys; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), value(i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for i := 0; i < numKeys; i += 7 {
+		if err := lsm.Delete(fmt.Sprintf("key%05d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if len(lsm.GetLevels().GetAllSSTables(0))+len(lsm.GetLevels().GetAllSSTables(1)) == 0 {
+		t.Error("Expected memtables to be flushed to SSTables")
+	}
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val, found, err := lsm.Get(key)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", key, err)
+		}
+		if i%7 == 0 {
+			if found {
+				t.Errorf("Expected %s deleted", key)
+			}
+		} else if !found || !bytes.Equal(val, value(i)) {
+			t.Errorf("Key %s: found=%v, got %q", key, found, val)
+		}
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected no files for an in-memory LSM, got err=%v", err)
+	}
+
+	config.FS = common.NewMemFS()
+	if _, err := New(config); !errors.Is(err, common.ErrInMemoryWithFS) {
+		t.Errorf("Expected ErrInMemoryWithFS, got %v", err)
+	}
+}
+
+// TestDirectoryLock tests that a data directory can only be open once
+func TestDirectoryLock(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-lock-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	lsm, err := New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	if _, err := New(DefaultConfig(dir)); !errors.Is(err, common.ErrLocked) {
+		t.Fatalf("Expected ErrLocked opening a directory twice, got %v", err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	lsm, err = New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen after Close: %v", err)
+	}
+	lsm.Close()
+}
+
+// TestDeferredDelete tests that SSTables compaction can't delete yet, as
+// on Windows while they're open elsewhere, are hidden and deleted later
+func TestDeferredDelete(t *testing.T) {
+	mem := common.NewMemFS()
+	fs := common.NewFaultFS(mem)
+	fs.FailAfter(common.FaultRemove, ".sst", 0, nil)
+
+	config := DefaultConfig("/lsm-deferred")
+	config.FS = fs
+	config.MemTableSize = 16 * 1024
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	// Scattered keys, so flushed files overlap and compaction rewrites
+	// them instead of moving them down
+	const numKeys = 2000
+	for i := 0; i < numKeys; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i*7%numKeys), bytes.Repeat([]byte{'v'}, 100)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	deferred := lsm.config.FS.(*common.DeferredDeleteFS)
+	pending := deferred.Pending()
+	if len(pending) == 0 {
+		t.Fatal("Expected compacted SSTables to be queued for deletion")
+	}
+	if _, err := deferred.Stat(pending[0]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected %s hidden while queued, got err=%v", pending[0], err)
+	}
+	if _, err := mem.Stat(pending[0]); err != nil {
+		t.Errorf("Expected %s still on disk, got err=%v", pending[0], err)
+	}
+
+	// Closing files retries the deletions
+	fs.Heal()
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if pending := deferred.Pending(); len(pending) != 0 {
+		t.Errorf("Expected queued deletions done after Close, still have %v", pending)
+	}
+	for _, name := range pending {
+		if _, err := mem.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %s deleted, got err=%v", name, err)
+		}
+	}
+
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if _, found, err := lsm.Get(key); err != nil || !found {
+			t.Fatalf("Key %s after reopen: found=%v, err=%v", key, found, err)
+		}
+	}
+}
+
+// TestCorruptSSTableQuarantined tests that damaged SSTables are moved
+// aside, at open or when a read finds them, while the rest keeps serving
+func TestCorruptSSTableQuarantined(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-corrupt")
+	config.FS = fs
+
+	// One L0 file per batch of keys
+	for _, prefix := range []string{"a", "b", "c"} {
+		lsm, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create LSM: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := lsm.Put(fmt.Sprintf("%s%03d", prefix, i), []byte("value")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := lsm.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		// Close flushed the batch; without its WAL the next one gets a
+		// file of its own, and reads have to reach the SSTables
+		if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+			t.Fatalf("Failed to remove WAL: %v", err)
+		}
+	}
+
+	corrupt := func(name string, offset int64) {
+		f, err := fs.OpenFile(filepath.Join(config.DataDir, name), os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		defer f.Close()
+		if offset < 0 {
+			info, _ := f.Stat()
+			offset += info.Size()
+		}
+		if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, offset); err != nil {
+			t.Fatalf("Failed to corrupt %s: %v", name, err)
+		}
+	}
+	corrupt("L0-000000.sst", 4)  // Key size of the first entry
+	corrupt("L0-000001.sst", -4) // Footer magic
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Expected open to survive a corrupt SSTable, got %v", err)
+	}
+	defer lsm.Close()
+	adapter := &Adapter{lsm: lsm}
+
+	stats := adapter.Stats()
+	if stats.CorruptionCount != 1 || len(stats.Quarantined) != 1 {
+		t.Fatalf("Expected 1 file quarantined at open, got count=%d files=%v", stats.CorruptionCount, stats.Quarantined)
+	}
+
+	if _, _, err := lsm.Get("a050"); !errors.Is(err, common.ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption reading a damaged block, got %v", err)
+	}
+	if _, found, err := lsm.Get("a050"); err != nil || found {
+		t.Errorf("Expected the damaged file gone after quarantine, got found=%v err=%v", found, err)
+	}
+	if _, found, err := lsm.Get("c050"); err != nil || !found {
+		t.Errorf("Expected intact files still served, got found=%v err=%v", found, err)
+	}
+
+	stats = adapter.Stats()
+	if stats.CorruptionCount != 2 || len(stats.Quarantined) != 2 {
+		t.Fatalf("Expected 2 files quarantined, got count=%d files=%v", stats.CorruptionCount, stats.Quarantined)
+	}
+	for _, name := range []string{"L0-000000.sst", "L0-000001.sst"} {
+		if _, err := fs.Stat(filepath.Join(config.DataDir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %s moved out of the data directory, got err=%v", name, err)
+		}
+		if _, err := fs.Stat(filepath.Join(config.DataDir, common.QuarantineDir, name)); err != nil {
+			t.Errorf("Expected %s in quarantine: %v", name, err)
+		}
+	}
+}
+
+// TestStaleFilesRemoved tests that open deletes temporary files and
+// SSTables the MANIFEST doesn't list, instead of loading them as data
+func TestStaleFilesRemoved(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-stale")
+	config.FS = fs
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// What a crash mid-compaction or mid-rewrite leaves behind
+	stale := []string{"MANIFEST.tmp", "wal.log.tmp", "L1-000900.sst"}
+	for _, name := range stale {
+		f, err := fs.Create(filepath.Join(config.DataDir, name))
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if _, err := f.Write([]byte("leftover")); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		f.Close()
+	}
+
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer lsm.Close()
+
+	for _, name := range stale {
+		if _, err := fs.Stat(filepath.Join(config.DataDir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %s deleted, stat err=%v", name, err)
+		}
+	}
+	if n := lsm.corruption.Count(); n != 0 {
+		t.Errorf("Expected no corruption reported for stale files, got %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		if _, found, err := lsm.Get(fmt.Sprintf("key%03d", i)); err != nil || !found {
+			t.Fatalf("Get key%03d after reopen: found=%v err=%v", i, found, err)
+		}
+	}
+}
+
+// TestSSTableInstalledOnFinish tests that an SSTable only appears under
+// its final name once complete, and that a build cut short is cleaned up
+func TestSSTableInstalledOnFinish(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-sst-tmp")
+	config.FS = fs
+	if err := fs.MkdirAll(config.DataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(path string) bool {
+		_, err := fs.Stat(path)
+		return err == nil
+	}
+	build := func(path string) *SSTableBuilder {
+		builder, err := newSSTableBuilder(fs, path, 10, 0)
+		if err != nil {
+			t.Fatalf("Failed to create builder: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := builder.Add(fmt.Sprintf("key%02d", i), []byte("value"), false); err != nil {
+				t.Fatalf("Add failed: %v", err)
+			}
+		}
+		return builder
+	}
+
+	path := filepath.Join(config.DataDir, "L0-000000.sst")
+	builder := build(path)
+	if exists(path) || !exists(path+".tmp") {
+		t.Fatal("Expected the SSTable written under a temporary name")
+	}
+	if err := builder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if !exists(path) || exists(path+".tmp") {
+		t.Fatal("Expected Finish to rename the SSTable into place")
+	}
+
+	// A build the process never finished
+	partial := filepath.Join(config.DataDir, "L1-000001.sst")
+	build(partial)
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer lsm.Close()
+
+	if exists(partial) || exists(partial+".tmp") {
+		t.Error("Expected the unfinished SSTable deleted on open")
+	}
+	if n := lsm.corruption.Count(); n != 0 {
+		t.Errorf("Expected no corruption reported, got %d", n)
+	}
+}
+
+// TestBlockChecksums tests that a damaged data block fails Get unless
+// VerifyChecksumsOnRead turns the check off, and always fails compaction
+func TestBlockChecksums(t *testing.T) {
+	fs := common.NewMemFS()
+	path := "/L0-000000.sst"
+	builder, err := newSSTableBuilder(fs, path, 10, 0)
+	if err != nil {
+		t.Fatalf("Failed to create builder: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := builder.Add(fmt.Sprintf("key%02d", i), []byte("value"), false); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := builder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	// The first entry's value: [numEntries(4)][shared(1)][unshared(1)][valueSize(1)][flags(1)][key(5)]
+	f, err := fs.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("V"), 4+4+5); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	sst, err := openSSTable(fs, path, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sst.Close()
+
+	if _, _, err := sst.Get("key00"); !errors.Is(err, common.ErrCorruption) {
+		t.Errorf("Expected ErrCorruption reading a damaged block, got %v", err)
+	}
+
+	sst.verify = common.VerifyNever
+	if value, found, err := sst.Get("key00"); err != nil || !found || string(value) != "Value" {
+		t.Errorf("Expected the damaged value unchecked, got %q found=%v err=%v", value, found, err)
+	}
+	if _, err := NewSSTableIterator(sst, 0); !errors.Is(err, common.ErrCorruption) {
+		t.Errorf("Expected compaction to check the block anyway, got %v", err)
+	}
+}
+
+// TestBlockSeek tests that lookups and scans that binary search blocks'
+// restart points or entry offsets find the same entries as reading the
+// blocks in order, in files of each block format
+func TestBlockSeek(t *testing.T) {
+	sizes := make(map[blockFormat]uint64)
+	for _, format := range []blockFormat{blockFormatPlain, blockFormatRestarts, blockFormatDelta, blockFormatOffsets} {
+		fs := common.NewMemFS()
+		path := "/L0-000000.sst"
+		builder, err := newSSTableBuilder(fs, path, 2000, 0)
+		if err != nil {
+			t.Fatalf("Failed to create builder: %v", err)
+		}
+		builder.format = format
+		for i := 0; i < 4000; i += 2 {
+			if err := builder.Add(fmt.Sprintf("key%05d", i), []byte(fmt.Sprintf("value%d", i)), i%10 == 0); err != nil {
+				t.Fatalf("Add failed: %v", err)
+			}
+		}
+		if err := builder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		sst, err := openSSTable(fs, path, 0, 0, nil)
+		if err != nil {
+			t.Fatalf("Failed to open SSTable: %v", err)
+		}
+		defer sst.Close()
+		if sst.blockFormat != format || len(sst.index) < 2 {
+			t.Fatalf("Expected several blocks of format %d, got format %d and %d blocks", format, sst.blockFormat, len(sst.index))
+		}
+		sizes[format] = sst.indexOffset
+
+		// Full blocks hold hundreds of these entries
+		if format == blockFormatOffsets {
+			block, err := sst.readBlock(0, true)
+			if err != nil {
+				t.Fatalf("Failed to read block: %v", err)
+			}
+			var it blockIter
+			if it.reset(block, format, sst.compareBytes); it.numOffsets < blockOffsetsMinEntries {
+				t.Fatalf("Expected the first block to have entry offsets, got %d", it.numOffsets)
+			}
+		}
+
+		for i := -1; i <= 4000; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			value, found, err := sst.Get(key)
+			if err != nil {
+				t.Fatalf("Format %d: Get(%s) failed: %v", format, key, err)
+			}
+			if want := i >= 0 && i%2 == 0 && i%10 != 0; found != want || found && string(value) != fmt.Sprintf("value%d", i) {
+				t.Errorf("Format %d: Get(%s) = %q, %v", format, key, value, found)
+			}
+
+			if i%3 != 0 {
+				continue
+			}
+			for blockIdx := range sst.index {
+				block, err := sst.readBlock(blockIdx, true)
+				if err != nil {
+					t.Fatalf("Failed to read block %d: %v", blockIdx, err)
+				}
+				seeked, seekFound, err := searchBlock(block, format, key, sst.compareBytes)
+				if err != nil {
+					t.Fatalf("Failed to search block %d: %v", blockIdx, err)
+				}
+				scanned, scanFound, err := searchInOrder(block, format, key, sst.compareBytes)
+				if err != nil {
+					t.Fatalf("Failed to read block %d in order: %v", blockIdx, err)
+				}
+				if seekFound != scanFound || seeked.Key != scanned.Key || !bytes.Equal(seeked.Value, scanned.Value) {
+					t.Fatalf("Format %d, block %d: seeking %s found %+v, reading in order %+v", format, blockIdx, key, seeked, scanned)
+				}
+			}
+		}
+
+		for _, start := range []int{-1, 0, 1, 777, 1000, 3997, 3998, 3999} {
+			it := newSSTableScanIterator(sst, fmt.Sprintf("key%05d", start))
+			it.SeekToFirst()
+			want := max(start+start%2, 0)
+			for n := 0; n < 100 && want < 4000; n++ {
+				if !it.Valid() {
+					t.Fatalf("Format %d: scan from %d ended early: %v", format, start, it.Error())
+				}
+				if it.Key() != fmt.Sprintf("key%05d", want) {
+					t.Fatalf("Format %d: scan from %d returned %s, want key%05d", format, start, it.Key(), want)
+				}
+				it.Next()
+				want += 2
+			}
+			if want >= 4000 && it.Valid() {
+				t.Errorf("Format %d: scan from %d returned %s past the end", format, start, it.Key())
+			}
+		}
+	}
+
+	// The keys share all but their last few bytes
+	if sizes[blockFormatDelta] >= sizes[blockFormatRestarts]*9/10 {
+		t.Errorf("Expected delta-encoded keys to shrink the data blocks, got %d bytes, %d without", sizes[blockFormatDelta], sizes[blockFormatRestarts])
+	}
+}
+
+// TestSSTableIteratorStreams tests that iterating an SSTable allocates
+// little more than the keys, and that each entry's value stays valid
+// through the following Next, across blocks
+func TestSSTableIteratorStreams(t *testing.T) {
+	fs := common.NewMemFS()
+	path := "/L0-000000.sst"
+	builder, err := newSSTableBuilder(fs, path, 2000, 0)
+	if err != nil {
+		t.Fatalf("Failed to create builder: %v", err)
+	}
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 100)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := builder.Add(fmt.Sprintf("key%05d", i), value(i), false); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := builder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	sst, err := openSSTable(fs, path, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer sst.Close()
+
+	it, err := NewSSTableIterator(sst, 0)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	prev, ok := it.Next()
+	for i := 1; ok; i++ {
+		entry, ok2 := it.Next()
+		if !bytes.Equal(prev.Value, value(i-1)) {
+			t.Fatalf("Entry %d's value changed after the next Next", i-1)
+		}
+		prev, ok = entry, ok2
+		if !ok && i != 2000 {
+			t.Fatalf("Iterator stopped after %d entries: %v", i, it.err)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(5, func() {
+		it, err := NewSSTableIterator(sst, 0)
+		if err != nil {
+			t.Fatalf("Failed to create iterator: %v", err)
+		}
+		for _, ok := it.Next(); ok; _, ok = it.Next() {
+		}
+	})
+	if allocs > 2000*1.1 {
+		t.Errorf("Expected about one allocation per entry, for its key, got %.0f for 2000", allocs)
+	}
+}
+
+// searchInOrder searches a block like searchBlock, reading every entry
+// before key rather than seeking
+func searchInOrder(block []byte, format blockFormat, key string, compare compareBytesFunc) (SSTableEntry, bool, error) {
+	var it blockIter
+	it.reset(block, format, compare)
+	for it.next() {
+		if c := compare([]byte(it.entry.Key), key); c >= 0 {
+			if c > 0 {
+				return SSTableEntry{}, false, nil
+			}
+			return it.entry, true, nil
+		}
+	}
+	return SSTableEntry{}, false, it.err
+}
+
+// TestScrubber tests that the background scrubber finds a damaged block
+// no read has touched, quarantines its file and reports it to the hook
+func TestScrubber(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-scrub")
+	config.FS = fs
+
+	// One L0 file per batch of keys, as in TestCorruptSSTableQuarantined
+	for _, prefix := range []string{"a", "b"} {
+		lsm, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create LSM: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := lsm.Put(fmt.Sprintf("%s%05d", prefix, i), []byte("value")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := lsm.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+			t.Fatalf("Failed to remove WAL: %v", err)
+		}
+	}
+
+	// The first entry's value: [numEntries(4)][keySize(4)][valueSize(4)][flags(1)][key(6)]
+	f, err := fs.OpenFile(filepath.Join(config.DataDir, "L0-000000.sst"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("V"), 4+9+6); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	found := make(chan error, 10)
+	config.ScrubInterval = 10 * time.Millisecond
+	config.OnCorruption = func(err error) { found <- err }
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	select {
+	case err := <-found:
+		if !errors.Is(err, common.ErrCorruption) || common.CorruptPath(err) != filepath.Join(config.DataDir, "L0-000000.sst") {
+			t.Errorf("Expected the damaged SSTable reported, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the scrubber to find the damaged block")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	adapter := &Adapter{lsm: lsm}
+	for {
+		stats := adapter.Stats()
+		if len(stats.Quarantined) == 1 && stats.ScrubPasses > 0 {
+			if stats.ScrubbedBytes == 0 {
+				t.Error("Expected ScrubbedBytes counted")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the file quarantined and a pass completed, got files=%v passes=%d", stats.Quarantined, stats.ScrubPasses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestEncryption tests that with an encryption key no file holds data in
+// the clear, and that the tree only opens with the same key
+func TestEncryption(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-encrypted")
+	config.FS = fs
+	config.MemTableSize = 4 * 1024
+	config.MaxL0Files = 2
+	config.ValueThreshold = 512 // Exercise the value log too
+	config.EncryptionKey = bytes.Repeat([]byte{0x42}, 32)
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	value := func(i int) []byte {
+		v := []byte(fmt.Sprintf("secret-%04d", i))
+		if i%10 == 0 {
+			v = append(v, bytes.Repeat([]byte("x"), 600)...)
+		}
+		return v
+	}
+	for i := 0; i < 1000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), value(i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// The WAL as well as the SSTables, MANIFEST and value log
+	crashed := fs.CrashClone()
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	var scan func(fs *common.MemFS, dir string)
+	scan = func(fs *common.MemFS, dir string) {
+		entries, err := fs.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			if e.IsDir() {
+				scan(fs, path)
+				continue
+			}
+			data, err := common.ReadFile(fs, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("secret-")) || bytes.Contains(data, []byte("key0")) {
+				t.Errorf("%s holds data in the clear", path)
+			}
+		}
+	}
+	scan(fs, config.DataDir)
+	scan(crashed, config.DataDir)
+
+	for _, fs := range []*common.MemFS{fs, crashed} {
+		config.FS = fs
+		lsm, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			got, found, err := lsm.Get(fmt.Sprintf("key%04d", i))
+			if err != nil || !found || !bytes.Equal(got, value(i)) {
+				t.Fatalf("Get key%04d: found=%v err=%v", i, found, err)
+			}
+		}
+		lsm.Close()
+	}
+
+	config.EncryptionKey = bytes.Repeat([]byte{0x43}, 32)
+	if _, err := New(config); !errors.Is(err, common.ErrEncryptionKey) {
+		t.Errorf("Expected ErrEncryptionKey opening with another key, got %v", err)
+	}
+	config.FS = common.NewMemFS()
+	config.EncryptionKey = nil
+	plain, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+	config.EncryptionKey = bytes.Repeat([]byte{0x42}, 32)
+	if _, err := New(config); !errors.Is(err, common.ErrNotEncrypted) {
+		t.Errorf("Expected ErrNotEncrypted opening plaintext data with a key, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	fs := common.NewMemFS()
+	keys := common.NewKeyRing(1, bytes.Repeat([]byte{0x42}, 32))
+	config := DefaultConfig("/lsm-rekey")
+	config.FS = fs
+	config.MemTableSize = 4 * 1024
+	config.MaxL0Files = 2
+	config.KeyProvider = keys
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("value-%04d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), value(i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	if n := lsm.staleKeyFiles(); n != 0 {
+		t.Fatalf("Expected no stale files before rotating, got %d", n)
+	}
+	keys.Rotate(2, bytes.Repeat([]byte{0x43}, 32))
+	if n := lsm.staleKeyFiles(); n == 0 {
+		t.Fatal("Expected stale files after rotating the key")
+	}
+	if err := lsm.RotateKeys(); err != nil {
+		t.Fatalf("RotateKeys failed: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for lsm.staleKeyFiles() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d files still on the old key", lsm.staleKeyFiles())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Nothing needs the old key any more
+	if err := keys.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen without the old key: %v", err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 1000; i++ {
+		got, found, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || !found || !bytes.Equal(got, value(i)) {
+			t.Fatalf("Get key%04d: found=%v err=%v", i, found, err)
+		}
+	}
+}
@@ -1,7 +1,15 @@
 package lsm
 
 import (
+	"bytes"
 	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 // Iterator provides sequential access to key-value pairs in sorted order
@@ -18,9 +26,21 @@ type Iterator interface {
 	Value() []byte
 	// Error returns any error that occurred
 	Error() error
+	// Close releases the resources the iterator holds
+	Close() error
+}
+
+// entryIterator is implemented by the iterators Scan merges. Besides live
+// entries they yield tombstones, which hide older versions of a key, and
+// value log pointers, which the merge resolves only for entries it returns.
+type entryIterator interface {
+	Iterator
+	deleted() bool
+	valuePointer() bool
 }
 
-// MemTableIterator iterates over a memtable
+// MemTableIterator iterates over a copy of a memtable's entries, taken
+// when it is created. Deleted keys are yielded as tombstones.
 type MemTableIterator struct {
 	entries []MemTableEntry
 	index   int
@@ -34,20 +54,35 @@ func NewMemTableIterator(memtable *MemTable) *MemTableIterator {
 	}
 }
 
+// bound drops the entries outside [start, end] (empty = unbounded)
+func (it *MemTableIterator) bound(start, end string, compare compareFunc) {
+	lo, hi := 0, len(it.entries)
+	if start != "" {
+		lo = sort.Search(len(it.entries), func(i int) bool {
+			return compare(it.entries[i].Key, start) >= 0
+		})
+	}
+	if end != "" {
+		hi = sort.Search(len(it.entries), func(i int) bool {
+			return compare(it.entries[i].Key, end) > 0
+		})
+	}
+	if lo > hi {
+		lo = hi
+	}
+	it.entries = it.entries[lo:hi]
+}
+
 func (it *MemTableIterator) SeekToFirst() {
 	it.index = 0
 }
 
 func (it *MemTableIterator) Valid() bool {
-	return it.index >= 0 && it.index < len(it.entries) && !it.entries[it.index].Deleted
+	return it.index >= 0 && it.index < len(it.entries)
 }
 
 func (it *MemTableIterator) Next() {
 	it.index++
-	// Skip deleted entries
-	for it.index < len(it.entries) && it.entries[it.index].Deleted {
-		it.index++
-	}
 }
 
 func (it *MemTableIterator) Key() string {
@@ -68,45 +103,147 @@ func (it *MemTableIterator) Error() error {
 	return nil
 }
 
+func (it *MemTableIterator) Close() error {
+	it.entries = nil
+	return nil
+}
+
+func (it *MemTableIterator) deleted() bool {
+	return it.Valid() && it.entries[it.index].Deleted
+}
+
+func (it *MemTableIterator) valuePointer() bool {
+	return it.Valid() && it.entries[it.index].ValuePointer
+}
+
+// sstableScanIterator iterates over an SSTable from the first key >= start.
+// It holds a reference on the file (taken by the caller) until closed.
+type sstableScanIterator struct {
+	sst    *SSTable
+	start  string
+	iter   *SSTableIterator
+	entry  CompactionEntry
+	valid  bool
+	err    error
+	closed bool
+}
+
+func newSSTableScanIterator(sst *SSTable, start string) *sstableScanIterator {
+	return &sstableScanIterator{sst: sst, start: start}
+}
+
+func (it *sstableScanIterator) SeekToFirst() {
+	it.iter = &SSTableIterator{sst: it.sst, scan: true}
+	if err := it.iter.seek(it.start); err != nil {
+		it.err = err
+		it.valid = false
+		return
+	}
+	it.Next()
+}
+
+func (it *sstableScanIterator) Valid() bool {
+	return it.valid
+}
+
+func (it *sstableScanIterator) Next() {
+	it.entry, it.valid = it.iter.Next()
+	if !it.valid && it.iter.err != nil {
+		it.err = it.iter.err
+	}
+
+	// Scan callers may keep values past the next entry, which reuses the
+	// block it came from
+	it.entry.Value = bytes.Clone(it.entry.Value)
+}
+
+func (it *sstableScanIterator) Key() string {
+	if !it.valid {
+		return ""
+	}
+	return it.entry.Key
+}
+
+func (it *sstableScanIterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.entry.Value
+}
+
+func (it *sstableScanIterator) Error() error {
+	return it.err
+}
+
+func (it *sstableScanIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.valid = false
+	return it.sst.unref()
+}
+
+func (it *sstableScanIterator) deleted() bool {
+	return it.valid && it.entry.Deleted
+}
+
+func (it *sstableScanIterator) valuePointer() bool {
+	return it.valid && it.entry.ValuePointer
+}
+
 // MergingIteratorEntry represents an entry in the merging iterator heap
 type MergingIteratorEntry struct {
 	key      string
 	value    []byte
 	sequence uint64
+	deleted  bool
+	valuePtr bool // value is a value log pointer
 	iter     Iterator
 	priority int // Lower priority = checked first (memtable > L0 > L1 > L2)
 }
 
 // MergingIteratorHeap implements a min-heap for merging multiple iterators
-type MergingIteratorHeap []MergingIteratorEntry
+type MergingIteratorHeap struct {
+	entries []MergingIteratorEntry
+	compare compareFunc
+}
 
-func (h MergingIteratorHeap) Len() int { return len(h) }
-func (h MergingIteratorHeap) Less(i, j int) bool {
+func (h *MergingIteratorHeap) Len() int { return len(h.entries) }
+func (h *MergingIteratorHeap) Less(i, j int) bool {
 	// First compare by key
-	if h[i].key != h[j].key {
-		return h[i].key < h[j].key
+	if c := h.compare(h.entries[i].key, h.entries[j].key); c != 0 {
+		return c < 0
 	}
 	// If keys are equal, prefer lower priority (newer data)
-	return h[i].priority < h[j].priority
+	return h.entries[i].priority < h.entries[j].priority
+}
+func (h *MergingIteratorHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+}
+func (h *MergingIteratorHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(MergingIteratorEntry))
 }
-func (h MergingIteratorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
-func (h *MergingIteratorHeap) Push(x interface{}) { *h = append(*h, x.(MergingIteratorEntry)) }
 func (h *MergingIteratorHeap) Pop() interface{} {
-	old := *h
+	old := h.entries
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.entries = old[0 : n-1]
 	return x
 }
 
 // MergingIterator merges multiple sorted iterators
 type MergingIterator struct {
-	iterators []Iterator
-	priorities []int
-	heap      *MergingIteratorHeap
-	currentKey string
+	iterators    []Iterator
+	priorities   []int
+	heap         *MergingIteratorHeap
+	currentKey   string
 	currentValue []byte
-	err error
+	err          error
+
+	end     string       // Last key to return (empty = no limit)
+	vlog    *valueLog    // Resolves value pointers
+	release func() error // Releases the snapshot on Close
 }
 
 // NewMergingIterator creates a merging iterator from multiple iterators
@@ -115,7 +252,7 @@ func NewMergingIterator(iterators []Iterator, priorities []int) *MergingIterator
 	it := &MergingIterator{
 		iterators:  iterators,
 		priorities: priorities,
-		heap:       &MergingIteratorHeap{},
+		heap:       &MergingIteratorHeap{compare: newCompareFunc(nil)},
 	}
 
 	heap.Init(it.heap)
@@ -124,73 +261,97 @@ func NewMergingIterator(iterators []Iterator, priorities []int) *MergingIterator
 
 func (it *MergingIterator) SeekToFirst() {
 	// Initialize heap with first entry from each iterator
-	*it.heap = (*it.heap)[:0]
+	it.heap.entries = it.heap.entries[:0]
 	heap.Init(it.heap)
 
 	for i, iter := range it.iterators {
 		iter.SeekToFirst()
-		if iter.Valid() {
-			heap.Push(it.heap, MergingIteratorEntry{
-				key:      iter.Key(),
-				value:    iter.Value(),
-				iter:     iter,
-				priority: it.priorities[i],
-			})
-		}
+		it.push(iter, it.priorities[i])
 	}
 
 	// Advance to first entry
 	it.Next()
 }
 
+// push adds an iterator's current entry to the heap, if it has one
+func (it *MergingIterator) push(iter Iterator, priority int) {
+	if !iter.Valid() {
+		return
+	}
+	entry := MergingIteratorEntry{
+		key:      iter.Key(),
+		value:    iter.Value(),
+		iter:     iter,
+		priority: priority,
+	}
+	if e, ok := iter.(entryIterator); ok {
+		entry.deleted = e.deleted()
+		entry.valuePtr = e.valuePointer()
+	}
+	heap.Push(it.heap, entry)
+}
+
 func (it *MergingIterator) Valid() bool {
 	return it.currentKey != ""
 }
 
 func (it *MergingIterator) Next() {
-	if it.heap.Len() == 0 {
-		it.currentKey = ""
-		it.currentValue = nil
-		return
-	}
+	for {
+		if it.heap.Len() == 0 {
+			it.stop()
+			return
+		}
 
-	// Get smallest entry
-	entry := heap.Pop(it.heap).(MergingIteratorEntry)
-	it.currentKey = entry.key
-	it.currentValue = entry.value
+		// Get smallest entry, and advance the iterator that produced it
+		entry := heap.Pop(it.heap).(MergingIteratorEntry)
+		entry.iter.Next()
+		it.push(entry.iter, entry.priority)
 
-	// Advance the iterator that produced this entry
-	entry.iter.Next()
-	if entry.iter.Valid() {
-		heap.Push(it.heap, MergingIteratorEntry{
-			key:      entry.iter.Key(),
-			value:    entry.iter.Value(),
-			iter:     entry.iter,
-			priority: entry.priority,
-		})
-	}
+		// Skip duplicate keys (keep only the first, which has highest priority)
+		for it.heap.Len() > 0 && it.heap.compare(it.heap.entries[0].key, entry.key) == 0 {
+			dup := heap.Pop(it.heap).(MergingIteratorEntry)
+			dup.iter.Next()
+			it.push(dup.iter, dup.priority)
+		}
 
-	// Skip duplicate keys (keep only the first, which has highest priority)
-	for it.heap.Len() > 0 {
-		peek := (*it.heap)[0]
-		if peek.key != it.currentKey {
-			break
+		if it.end != "" && it.heap.compare(entry.key, it.end) > 0 {
+			it.stop()
+			return
+		}
+		// The newest version is a tombstone: the key is deleted
+		if entry.deleted {
+			continue
 		}
 
-		// Duplicate key, skip it
-		entry := heap.Pop(it.heap).(MergingIteratorEntry)
-		entry.iter.Next()
-		if entry.iter.Valid() {
-			heap.Push(it.heap, MergingIteratorEntry{
-				key:      entry.iter.Key(),
-				value:    entry.iter.Value(),
-				iter:     entry.iter,
-				priority: entry.priority,
-			})
+		value := entry.value
+		if entry.valuePtr {
+			if it.vlog == nil {
+				it.err = fmt.Errorf("value pointer for key %q without a value log", entry.key)
+				it.stop()
+				return
+			}
+			resolved, err := it.vlog.read(entry.key, value)
+			if err != nil {
+				it.err = err
+				it.stop()
+				return
+			}
+			value = resolved
 		}
+
+		it.currentKey = entry.key
+		it.currentValue = value
+		return
 	}
 }
 
+// stop ends the iteration
+func (it *MergingIterator) stop() {
+	it.heap.entries = it.heap.entries[:0]
+	it.currentKey = ""
+	it.currentValue = nil
+}
+
 func (it *MergingIterator) Key() string {
 	return it.currentKey
 }
@@ -200,39 +361,176 @@ func (it *MergingIterator) Value() []byte {
 }
 
 func (it *MergingIterator) Error() error {
-	return it.err
+	if it.err != nil {
+		return it.err
+	}
+	for _, iter := range it.iterators {
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Close closes the merged iterators and releases the snapshot they read
+func (it *MergingIterator) Close() error {
+	it.stop()
+
+	var firstErr error
+	for _, iter := range it.iterators {
+		if err := iter.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if it.release != nil {
+		if err := it.release(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		it.release = nil
+	}
+	return firstErr
+}
+
+// errIterator is an empty iterator that reports an error, returned by
+// Scan when it can't read anything
+type errIterator struct {
+	err error
+}
+
+func (it *errIterator) SeekToFirst()  {}
+func (it *errIterator) Valid() bool   { return false }
+func (it *errIterator) Next()         {}
+func (it *errIterator) Key() string   { return "" }
+func (it *errIterator) Value() []byte { return nil }
+func (it *errIterator) Error() error  { return it.err }
+func (it *errIterator) Close() error  { return nil }
+
 // Scan returns an iterator over the key range [start, end]
 // If start is empty, starts from the beginning
 // If end is empty, continues to the end
+//
+// The iterator reads a snapshot taken when Scan is called: writes,
+// flushes and compactions that happen while it is open neither add, drop
+// nor duplicate keys. The SSTables and value log files it reads are kept
+// on disk until Close, which must be called when done.
 func (lsm *LSM) Scan(start, end string) Iterator {
+	return lsm.ScanContext(context.Background(), start, end)
+}
+
+// ScanContext is Scan with the span its Config.Tracer span is a child
+// of. The span lasts until the iterator is closed.
+func (lsm *LSM) ScanContext(ctx context.Context, start, end string) Iterator {
+	o := lsm.startOp(ctx, "lsm.Scan")
+	if o == nil {
+		return lsm.scan(start, end)
+	}
+	subject := func() string { return fmt.Sprintf("[%.64q, %.64q]", start, end) }
+	it := lsm.scan(start, end)
+	merging, ok := it.(*MergingIterator)
+	if !ok {
+		o.endAfter(time.Since(o.start), subject(), it.Error(), func() string { return "no sources" })
+		return it
+	}
+	o.setAttributes(common.Attribute{Key: "lsm.sources", Value: int64(len(merging.iterators))})
+
+	timed := &timedIterator{MergingIterator: merging, busy: time.Since(o.start)}
+	release := merging.release
+	merging.release = func() error {
+		err := release()
+		o.endAfter(timed.busy, subject(), errors.Join(merging.Error(), err), func() string {
+			return fmt.Sprintf("%d sources merged, %d keys returned", len(merging.iterators), timed.keys)
+		})
+		return err
+	}
+	return timed
+}
+
+// timedIterator adds up the time a scan spends in the tree, from Scan to
+// Close but for the caller's time between calls, for the slow op log
+type timedIterator struct {
+	*MergingIterator
+	busy time.Duration
+	keys int // Returned so far
+}
+
+func (it *timedIterator) SeekToFirst() {
+	start := time.Now()
+	it.MergingIterator.SeekToFirst()
+	it.count(start)
+}
+
+func (it *timedIterator) Next() {
+	start := time.Now()
+	it.MergingIterator.Next()
+	it.count(start)
+}
+
+// count adds the time since start, and the key positioned at if any
+func (it *timedIterator) count(start time.Time) {
+	it.busy += time.Since(start)
+	if it.Valid() {
+		it.keys++
+	}
+}
+
+func (lsm *LSM) scan(start, end string) Iterator {
+	if err := lsm.gate.Enter(); err != nil {
+		return &errIterator{err: err}
+	}
+	defer lsm.gate.Exit()
+
 	var iterators []Iterator
-	var priorities []int
-	priority := 0
+	inRange := func(sst *SSTable) bool {
+		return (start == "" || lsm.compare(sst.MaxKey(), start) >= 0) &&
+			(end == "" || lsm.compare(sst.MinKey(), end) <= 0)
+	}
 
-	// Add active memtable iterator
-	lsm.mu.RLock()
-	activeIter := NewMemTableIterator(lsm.activeMemtable)
-	iterators = append(iterators, activeIter)
-	priorities = append(priorities, priority)
-	priority++
+	// Pin the value log with GC held off, so every pointer in the
+	// snapshot stays resolvable until Close
+	lsm.vlog.gcMu.RLock()
+	lsm.vlog.pin()
 
-	// Add immutable memtable iterator if present
+	// Flushes and compactions install their results under lsm.mu, so the
+	// memtables and levels read under it are one consistent view
+	lsm.mu.RLock()
+	memtables := []*MemTable{lsm.activeMemtable}
 	if lsm.immutableMemtable != nil {
-		immutableIter := NewMemTableIterator(lsm.immutableMemtable)
-		iterators = append(iterators, immutableIter)
-		priorities = append(priorities, priority)
-		priority++
+		memtables = append(memtables, lsm.immutableMemtable)
+	}
+	for _, memtable := range memtables {
+		iter := NewMemTableIterator(memtable)
+		iter.bound(start, end, lsm.compare)
+		iterators = append(iterators, iter)
+	}
+
+	// Newest data first: L0 is kept oldest first, then L1, L2, ...
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		sstables := lsm.levels.GetAllSSTables(level)
+		for i := range sstables {
+			sst := sstables[i]
+			if level == 0 {
+				sst = sstables[len(sstables)-1-i]
+			}
+			if !inRange(sst) {
+				continue
+			}
+			sst.ref()
+			iterators = append(iterators, newSSTableScanIterator(sst, start))
+		}
 	}
 	lsm.mu.RUnlock()
+	lsm.vlog.gcMu.RUnlock()
 
-	// Add SSTable iterators from each level
-	// Note: In a full implementation, we'd create proper SSTable iterators
-	// For now, this is a simplified version
-	// TODO: Implement full SSTable iterator support
+	priorities := make([]int, len(iterators))
+	for i := range priorities {
+		priorities[i] = i
+	}
 
 	mergingIter := NewMergingIterator(iterators, priorities)
+	mergingIter.heap.compare = lsm.compare
+	mergingIter.end = end
+	mergingIter.vlog = lsm.vlog
+	mergingIter.release = lsm.vlog.unpin
 	mergingIter.SeekToFirst()
 
 	return mergingIter
@@ -1,17 +1,18 @@
 package lsm
 
 import (
+	"math"
 	"sort"
 	"sync"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 const (
-	maxL0Files = 4                      // Trigger L0->L1 compaction
-	l0MaxSize  = 40 * 1024 * 1024       // 40 MB
-	l1MaxSize  = 400 * 1024 * 1024      // 400 MB
-	l2MaxSize  = 4 * 1024 * 1024 * 1024 // 4 GB
-	l3MaxSize  = 40 * 1024 * 1024 * 1024 // 40 GB
-	l4MaxSize  = 400 * 1024 * 1024 * 1024 // 400 GB
+	maxL0Files    = 4                 // Trigger L0->L1 compaction
+	l0MaxSize     = 40 * 1024 * 1024  // 40 MB
+	levelBaseSize = 400 * 1024 * 1024 // 400 MB, L1 target size
 )
 
 // LevelInfo contains metadata for a single level
@@ -23,21 +24,107 @@ type LevelInfo struct {
 
 // LevelManager manages SSTables across multiple levels
 type LevelManager struct {
-	mu     sync.RWMutex
-	levels []LevelInfo
+	mu      sync.RWMutex
+	levels  []LevelInfo
+	memory  *common.MemoryAccountant // Charged for bloom filters and indexes (optional)
+	compare compareFunc              // Key order, for sorting L1+ files
+
+	multiplier int
+	dynamic    bool // Level targets derived from the last level's size
+	baseLevel  int  // Level L0 compacts into
 }
 
-// NewLevelManager creates a new level manager with 5 levels (L0, L1, L2, L3, L4)
-func NewLevelManager() *LevelManager {
-	return &LevelManager{
-		levels: []LevelInfo{
-			{sstables: make([]*SSTable, 0), maxSize: l0MaxSize},  // L0
-			{sstables: make([]*SSTable, 0), maxSize: l1MaxSize},  // L1
-			{sstables: make([]*SSTable, 0), maxSize: l2MaxSize},  // L2
-			{sstables: make([]*SSTable, 0), maxSize: l3MaxSize},  // L3
-			{sstables: make([]*SSTable, 0), maxSize: l4MaxSize},  // L4
-		},
+// NewLevelManager creates a level manager with numLevels levels (L0 to
+// L{numLevels-1}). L1 may hold levelBaseSize bytes and each deeper level
+// multiplier times more than the one above it.
+func NewLevelManager(numLevels, multiplier int) *LevelManager {
+	levels := make([]LevelInfo, numLevels)
+	levels[0] = LevelInfo{sstables: make([]*SSTable, 0), maxSize: l0MaxSize}
+
+	maxSize := int64(levelBaseSize)
+	for level := 1; level < numLevels; level++ {
+		levels[level] = LevelInfo{sstables: make([]*SSTable, 0), maxSize: maxSize}
+		if maxSize > math.MaxInt64/int64(multiplier) {
+			maxSize = math.MaxInt64
+		} else {
+			maxSize *= int64(multiplier)
+		}
 	}
+
+	return &LevelManager{levels: levels, compare: newCompareFunc(nil), multiplier: multiplier, baseLevel: 1}
+}
+
+// EnableDynamicLevelBytes derives level targets from the data actually in
+// the last level instead of fixed sizes. The last level's target is its
+// current size and each level above gets 1/multiplier of the one below,
+// up to the first level whose target fits in levelBaseSize. That level
+// becomes the base level that L0 compacts into; the levels above it stay
+// empty. With most data in the last level, space amplification stays
+// near 1 + 1/multiplier whatever the dataset size.
+func (lm *LevelManager) EnableDynamicLevelBytes() {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.dynamic = true
+	lm.updateTargets()
+}
+
+// BaseLevel returns the level L0 compacts into: L1, or with dynamic level
+// sizing the highest level currently in use
+func (lm *LevelManager) BaseLevel() int {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	return lm.baseLevel
+}
+
+// LevelTarget returns the size at which a level (L1+) needs compacting
+func (lm *LevelManager) LevelTarget(level int) int64 {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	if level >= len(lm.levels) {
+		return 0
+	}
+	return lm.levels[level].maxSize
+}
+
+// updateTargets recomputes dynamic level targets and the base level
+// Must be called with lock held
+func (lm *LevelManager) updateTargets() {
+	if !lm.dynamic {
+		return
+	}
+
+	last := len(lm.levels) - 1
+	for level := 1; level < last; level++ {
+		lm.levels[level].maxSize = 0
+	}
+
+	target := lm.levels[last].size
+	lm.levels[last].maxSize = target
+
+	base := last
+	for base > 1 && target > levelBaseSize {
+		base--
+		target /= int64(lm.multiplier)
+		lm.levels[base].maxSize = target
+	}
+
+	// Data in a level above the computed base is older than anything L0
+	// holds, so L0 must not skip past it: keep compacting into it until it
+	// drains (its target is 0)
+	for level := 1; level < base; level++ {
+		if len(lm.levels[level].sstables) > 0 {
+			base = level
+			break
+		}
+	}
+	lm.baseLevel = base
+}
+
+// NumLevels returns the number of levels, including L0
+func (lm *LevelManager) NumLevels() int {
+	return len(lm.levels)
 }
 
 // AddSSTable adds an SSTable to a level
@@ -51,11 +138,18 @@ func (lm *LevelManager) AddSSTable(sst *SSTable, level int) {
 	}
 
 	lm.levels[level].sstables = append(lm.levels[level].sstables, sst)
+	lm.chargeSSTable(sst, 1)
 
 	// Sort by minimum key for L1+ (maintains non-overlapping order)
 	if level > 0 {
 		sort.Slice(lm.levels[level].sstables, func(i, j int) bool {
-			return lm.levels[level].sstables[i].MinKey() < lm.levels[level].sstables[j].MinKey()
+			return lm.compare(lm.levels[level].sstables[i].MinKey(), lm.levels[level].sstables[j].MinKey()) < 0
+		})
+	} else {
+		// L0 stays oldest first whatever order files are added in: file
+		// numbers are handed out in the order the data was written
+		sort.SliceStable(lm.levels[0].sstables, func(i, j int) bool {
+			return lm.levels[0].sstables[i].FileNum() < lm.levels[0].sstables[j].FileNum()
 		})
 	}
 
@@ -77,6 +171,7 @@ func (lm *LevelManager) RemoveSSTable(sst *SSTable, level int) {
 	for i, s := range sstables {
 		if s.FileNum() == sst.FileNum() {
 			lm.levels[level].sstables = append(sstables[:i], sstables[i+1:]...)
+			lm.chargeSSTable(s, -1)
 			break
 		}
 	}
@@ -84,6 +179,35 @@ func (lm *LevelManager) RemoveSSTable(sst *SSTable, level int) {
 	lm.updateLevelSize(level)
 }
 
+// ReplaceL0 swaps the given L0 files for their stitched replacement. The
+// replacement holds the oldest data in L0, so it goes to the front; files
+// flushed while it was being built stay after it.
+func (lm *LevelManager) ReplaceL0(old []*SSTable, stitched *SSTable) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	replaced := make(map[uint64]bool, len(old))
+	for _, sst := range old {
+		replaced[sst.FileNum()] = true
+	}
+
+	remaining := make([]*SSTable, 0, len(lm.levels[0].sstables)-len(old)+1)
+	if stitched != nil {
+		remaining = append(remaining, stitched)
+		lm.chargeSSTable(stitched, 1)
+	}
+	for _, sst := range lm.levels[0].sstables {
+		if replaced[sst.FileNum()] {
+			lm.chargeSSTable(sst, -1)
+			continue
+		}
+		remaining = append(remaining, sst)
+	}
+
+	lm.levels[0].sstables = remaining
+	lm.updateLevelSize(0)
+}
+
 // GetOverlapping returns SSTables in a level that overlap with [start, end]
 // For L0, may return multiple overlapping files
 // For L1+, returns files whose key ranges overlap
@@ -135,7 +259,7 @@ func (lm *LevelManager) ShouldCompact(level int) bool {
 	}
 
 	// L1+ uses size threshold
-	return lm.levels[level].size >= lm.levels[level].maxSize
+	return lm.levels[level].size > 0 && lm.levels[level].size >= lm.levels[level].maxSize
 }
 
 // NumFiles returns the number of SSTables in a level
@@ -165,9 +289,12 @@ func (lm *LevelManager) LevelSize(level int) int64 {
 // updateLevelSize recalculates the total size of a level
 // Must be called with lock held
 func (lm *LevelManager) updateLevelSize(level int) {
-	// Approximate size based on number of files and average block count
-	// In a real implementation, we'd track actual file sizes
-	lm.levels[level].size = int64(len(lm.levels[level].sstables)) * 4 * 1024 * 1024 // Assume ~4MB per file
+	var size int64
+	for _, sst := range lm.levels[level].sstables {
+		size += sst.Size()
+	}
+	lm.levels[level].size = size
+	lm.updateTargets()
 }
 
 // CloseAll closes all SSTables
@@ -177,6 +304,7 @@ func (lm *LevelManager) CloseAll() error {
 
 	for _, level := range lm.levels {
 		for _, sst := range level.sstables {
+			lm.chargeSSTable(sst, -1)
 			if err := sst.Close(); err != nil {
 				return err
 			}
@@ -186,9 +314,25 @@ func (lm *LevelManager) CloseAll() error {
 	return nil
 }
 
+// chargeSSTable charges (sign 1) or releases (sign -1) the memory an
+// SSTable keeps resident
+func (lm *LevelManager) chargeSSTable(sst *SSTable, sign int64) {
+	if lm.memory == nil {
+		return
+	}
+	if sign > 0 {
+		lm.memory.Charge(common.MemBloom, sst.bloomMemory())
+		lm.memory.Charge(common.MemIndex, sst.indexMemory())
+	} else {
+		lm.memory.Release(common.MemBloom, sst.bloomMemory())
+		lm.memory.Release(common.MemIndex, sst.indexMemory())
+	}
+}
+
 // PickCompactionFiles selects files for compaction at a given level
 // For L0: returns all files (they may overlap)
-// For L1+: returns 1-2 files that should be compacted
+// For L1+: returns the file with the best compactionScore, the first by
+// key order on ties
 func (lm *LevelManager) PickCompactionFiles(level int) []*SSTable {
 	lm.mu.RLock()
 	defer lm.mu.RUnlock()
@@ -204,12 +348,72 @@ func (lm *LevelManager) PickCompactionFiles(level int) []*SSTable {
 		return files
 	}
 
-	// L1+: pick oldest file (simple strategy)
-	if len(lm.levels[level].sstables) > 0 {
-		return []*SSTable{lm.levels[level].sstables[0]}
+	var best *SSTable
+	bestScore := 0.0
+	for _, sst := range lm.levels[level].sstables {
+		if score := lm.compactionScore(sst, level); best == nil || score > bestScore {
+			best, bestScore = sst, score
+		}
+	}
+	if best == nil {
+		return nil
 	}
+	return []*SSTable{best}
+}
 
-	return nil
+// compactionScore rates compacting an L1+ file into the next level by the
+// space it may reclaim per byte written. Merging rewrites the file and
+// every file it overlaps below, so little overlap makes it cheap; each
+// tombstone frees the versions it shadows below as well as itself, so
+// the share of tombstones from the file's properties weighs the gain up.
+// Caller must hold lm.mu.
+func (lm *LevelManager) compactionScore(sst *SSTable, level int) float64 {
+	size := float64(sst.Size())
+	if size == 0 {
+		return 0
+	}
+
+	var overlap int64
+	if level+1 < len(lm.levels) {
+		for _, next := range lm.levels[level+1].sstables {
+			if next.Overlaps(sst.MinKey(), sst.MaxKey()) {
+				overlap += next.Size()
+			}
+		}
+	}
+
+	tombstones := 0.0
+	if props := sst.Properties(); props.Recorded && props.NumEntries > 0 {
+		tombstones = float64(props.NumTombstones) / float64(props.NumEntries)
+	}
+	return size * (1 + tombstones) / (size + float64(overlap))
+}
+
+// PickColdestFile selects the least read file at a level (L1+), the first
+// by key order on ties
+func (lm *LevelManager) PickColdestFile(level int, now time.Time) []*SSTable {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	if level < 1 || level >= len(lm.levels) || len(lm.levels[level].sstables) == 0 {
+		return nil
+	}
+
+	coldest := lm.levels[level].sstables[0]
+	coldestRate := 0.0
+	if coldest.heat != nil {
+		coldestRate = coldest.heat.readRate(now)
+	}
+	for _, sst := range lm.levels[level].sstables[1:] {
+		rate := 0.0
+		if sst.heat != nil {
+			rate = sst.heat.readRate(now)
+		}
+		if rate < coldestRate {
+			coldest, coldestRate = sst, rate
+		}
+	}
+	return []*SSTable{coldest}
 }
 
 // GetTotalFiles returns the total number of SSTables across all levels
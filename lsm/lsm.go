@@ -1,27 +1,282 @@
 package lsm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
+// lockFileName is locked while an engine has the data directory open
+const lockFileName = "LOCK"
+
 // Config contains configuration for the LSM-Tree
 type Config struct {
 	DataDir      string
 	MemTableSize int // Maximum memtable size in bytes
 	MaxL0Files   int // Trigger compaction when L0 reaches this many files
+
+	// MemTableMaxEntries and MemTableMaxAge also flush the memtable once
+	// it holds this many entries, or once its first write is this old,
+	// even if it isn't full, so a quiet tree's WAL, replayed on open,
+	// stays short. The age is checked on writes and every quarter of
+	// MemTableMaxAge. 0 disables either.
+	MemTableMaxEntries int
+	MemTableMaxAge     time.Duration
+
+	// OnRecoveryProgress, if set, is called during WAL replay and SSTable
+	// loading on open
+	OnRecoveryProgress common.ProgressFunc
+
+	// L0StitchMaxBytes enables L0->L0 compaction: when L0 needs compacting
+	// and its files total at most this many bytes, they are merged into a
+	// single L0 file instead of being pushed into L1, as long as that is
+	// cheaper than rewriting the overlapping L1 files. 0 disables it.
+	L0StitchMaxBytes int64
+
+	// MaxSubcompactions splits large L0->L1 and Ln->Ln+1 compactions into
+	// up to this many key ranges that are merged in parallel. Compactions
+	// are only split when each range gets at least 1MB of input. 1 or 0
+	// disables splitting.
+	MaxSubcompactions int
+
+	// MaxBackgroundWorkers bounds how many background goroutines flush,
+	// compact (each sub-compaction counting as one) or collect value log
+	// garbage at once, and BackgroundCPUPercent bounds them to that share
+	// of GOMAXPROCS, at least one, so they leave cores to the application.
+	// Work over the limit waits its turn, so a long compaction can hold up
+	// a flush. 0 = no limit. See common.WorkerLimiter.
+	MaxBackgroundWorkers int
+	BackgroundCPUPercent int
+
+	// Workers, if set, is used instead of the two limits above. One
+	// limiter may be shared by several engines, bounding their combined
+	// background work.
+	Workers *common.WorkerLimiter
+
+	// TargetFileSizeBytes is the size at which compaction starts a new
+	// output SSTable
+	TargetFileSizeBytes int64
+
+	// LevelSizeMultiplier is how many times larger each level below L1 may
+	// grow than the level above it
+	LevelSizeMultiplier int
+
+	// NumLevels is the number of levels including L0. It is fixed when the
+	// tree is created; reopening with a different value fails.
+	//
+	// These three are recorded in the MANIFEST file; zero values are
+	// filled in from it when reopening.
+	NumLevels int
+
+	// DynamicLevelBytes derives level size targets from the amount of data
+	// in the last level rather than fixed sizes, and lets L0 compact
+	// straight into the highest level in use (see
+	// LevelManager.EnableDynamicLevelBytes)
+	DynamicLevelBytes bool
+
+	// Comparator orders keys (nil = bytewise). Its name is recorded in the
+	// MANIFEST, and reopening with a different comparator fails with
+	// common.ErrComparatorMismatch.
+	Comparator common.Comparator
+
+	// ValueThreshold enables key-value separation: values of at least this
+	// many bytes are appended to the value log and the tree stores only a
+	// pointer to them, so compaction no longer rewrites them. 0 disables
+	// it for new writes; existing value log data stays readable.
+	ValueThreshold int
+
+	// ValueLogFileSize is the size at which a new value log file is started
+	ValueLogFileSize int64
+
+	// ValueLogGCInterval is how often background GC checks a value log
+	// file, which it rewrites when at least ValueLogGCDiscardRatio of the
+	// file is garbage
+	ValueLogGCInterval     time.Duration
+	ValueLogGCDiscardRatio float64
+
+	// TrackTemperature counts the reads that reach each SSTable, with a
+	// count-min sketch per file estimating reads per key so compaction
+	// outputs inherit the heat of the keys they hold. Compaction then
+	// pushes the coldest file out of a level first, and sends a cold file
+	// past any lower levels with nothing in its key range. See Temperature.
+	TrackTemperature bool
+
+	// ColdReadRate is the reads per second below which a file counts as
+	// cold, once its read history is at least ColdMinAge long
+	ColdReadRate float64
+	ColdMinAge   time.Duration
+
+	// BloomBitsPerKey sizes the bloom filters of new SSTables (0 = about
+	// 9.6, a 1% false positive rate). Fewer bits save memory, which
+	// Stats().BloomMemory reports per level, at the cost of more reads of
+	// files that don't hold the key.
+	BloomBitsPerKey int
+
+	// WALCompression deflates WAL record values of at least 128 bytes,
+	// when that makes them smaller, trading CPU on the write path for
+	// less WAL IO. A WAL reads back whatever the setting.
+	WALCompression bool
+
+	// WALArchive, if set, keeps every WAL a flush replaces, for
+	// point-in-time recovery (see backup.WALArchive). The WAL is moved
+	// into the wal-archive directory under DataDir, and a background
+	// goroutine hands it to WALArchive and deletes it once archived,
+	// retrying a minute later if that fails. Records pointing into the
+	// value log can't be replayed from an archive, so trees using
+	// ValueThreshold can't be rolled forward past their backups.
+	WALArchive common.WALArchiver
+
+	// Memory, if set, accounts memtables, bloom filters and block indexes
+	// against a (possibly shared) budget. Exceeding it flushes the active
+	// memtable early.
+	Memory *common.MemoryAccountant
+
+	// FS is the filesystem the engine keeps its files in (nil = the OS).
+	// A common.MemFS runs it without touching disk; a common.FaultFS
+	// injects IO errors for testing.
+	FS common.FS
+
+	// InMemory runs the engine without files: everything lives in a
+	// private in-memory FS and is gone after Close. DataDir then only
+	// names the files. Can't be combined with FS.
+	InMemory bool
+
+	// DiskReserveBytes is the free disk space Health expects to remain on
+	// the data directory's filesystem (0 = none)
+	DiskReserveBytes int64
+
+	// DiskLowWatermarkBytes guards against running out of disk: with less
+	// free space than this, flushes, compactions and value log GC are
+	// skipped and writes fail with common.ErrDiskFull until space is
+	// freed (0 = off)
+	DiskLowWatermarkBytes int64
+
+	// DeleteBytesPerSecond paces the deletion of SSTables replaced by
+	// compaction, which then happens in a background goroutine, so a big
+	// compaction doesn't free all its input at once (0 = delete right
+	// away). Files still queued at Close are deleted then; after a crash,
+	// the next open finds them missing from the MANIFEST and queues them
+	// again.
+	DeleteBytesPerSecond int64
+
+	// EncryptionKey encrypts every file the tree writes with AES-GCM, using
+	// this AES key (16, 24 or 32 bytes). KeyProvider does the same with
+	// keys that can change over time. Files can then only be read with the
+	// key they were written with; opening unencrypted data with a key set
+	// fails with common.ErrNotEncrypted. See common.EncryptedFS.
+	EncryptionKey []byte
+	KeyProvider   common.KeyProvider
+
+	// VerifyChecksumsOnRead says how often Get and Scan check the checksum
+	// of an SSTable block they read (default: every time). Compaction
+	// always checks. Files written before block checksums have none.
+	VerifyChecksumsOnRead common.ChecksumVerification
+
+	// ScrubInterval, if set, starts a background pass over every SSTable
+	// and sealed value log file this often, checking their checksums so
+	// damage is found before a read runs into it. ScrubBytesPerSecond
+	// limits how fast it reads (0 = unlimited). A damaged SSTable is
+	// quarantined as when a read finds it.
+	ScrubInterval       time.Duration
+	ScrubBytesPerSecond int64
+
+	// OnCorruption, if set, is called with each instance of corruption
+	// found by reads, compaction or the scrubber, on the goroutine that
+	// found it, e.g. to restore the data from a replica. It should hand
+	// slow work off.
+	OnCorruption func(err error)
+
+	// OnWorkerPanic, if set, is called with each panic recovered from a
+	// background worker (flush, compaction, value log GC, WAL archive),
+	// which is then restarted with a backoff. Health reports them too.
+	OnWorkerPanic func(p *common.WorkerPanic)
+
+	// CompactionWindows, if set, restricts compaction to these daily
+	// windows of local time (see ParseCompactionWindow), keeping its IO
+	// out of busy hours; outside them compactions are deferred to the next
+	// window. PauseCompaction holds them back at runtime too. Either way,
+	// L0 is still compacted once it has L0EmergencyFiles files (0 = twice
+	// MaxL0Files, where Health reports a stall), so reads don't degrade
+	// without bound.
+	CompactionWindows []CompactionWindow
+	L0EmergencyFiles  int
+
+	// CompactionLog appends a line of JSON to compaction_log.jsonl in
+	// DataDir for every compaction, failed ones included: why it ran, the
+	// files it read and wrote, their sizes and how long it took (see
+	// CompactionEvent), to look into write amplification and stalls after
+	// the fact. At 16MB the log is moved to compaction_log.jsonl.1 and
+	// started over. OnCompaction, if set, is called with the same events,
+	// on the compaction goroutine.
+	CompactionLog bool
+	OnCompaction  func(CompactionEvent)
+
+	// Tracer, if set, is given a span for every Put, Get and Scan, with
+	// the sizes read and written, and for every flush and compaction, with
+	// the levels, files and bytes involved (see common.Tracer). Spans of
+	// PutContext, GetContext and ScanContext are children of the span in
+	// their context.
+	Tracer common.Tracer
+
+	// SlowOpThreshold, if set, logs every Put, Get and Scan taking at
+	// least this long, with what it did: the value size and whether it
+	// went to the value log for a Put; the memtables and SSTables probed
+	// and blocks read for a Get; the sources merged and keys returned for
+	// a Scan, whose time is that spent in the iterator's calls; and, for
+	// all of them, whether writes were stalled (see Health). There is no
+	// block cache, so every block read is a cache miss. Lines go to
+	// Logger, or the standard logger if it is nil.
+	SlowOpThreshold time.Duration
+	Logger          common.Logger
+
+	// UndeleteWindow, if set, has Delete keep the value it removes in the
+	// key's tombstone, restorable with Undelete for this long after.
+	// Compactions past the window strip it, and drop the tombstone in the
+	// last level as usual. Such a Delete reads the key under the write
+	// lock, as CompareAndSwap does, and copies a value in the value log
+	// into the tombstone.
+	UndeleteWindow time.Duration
+
+	// KeepVersions, if above 1, keeps this many of the most recent versions
+	// of each key, the newest included, deletes counting as versions, for
+	// VersionsOf and GetVersion. Memtables and SSTables hold them, each
+	// recording the sequence number of its write; older ones are dropped as
+	// newer ones are compacted over them. A deleted key keeps its versions,
+	// and its tombstone, until newer writes push them out. Values in the
+	// value log are only kept for the newest version: value log GC drops
+	// those of older ones, which can then no longer be read.
+	KeepVersions int
 }
 
 // DefaultConfig returns a default configuration
 func DefaultConfig(dataDir string) Config {
 	return Config{
-		DataDir:      dataDir,
-		MemTableSize: 4 * 1024 * 1024, // 4MB
-		MaxL0Files:   4,
+		DataDir:           dataDir,
+		MemTableSize:      4 * 1024 * 1024, // 4MB
+		MaxL0Files:        4,
+		L0StitchMaxBytes:  16 * 1024 * 1024, // 16MB
+		MaxSubcompactions: 4,
+
+		TargetFileSizeBytes: 4 * 1024 * 1024, // 4MB
+		LevelSizeMultiplier: 10,
+		NumLevels:           5,
+
+		ValueLogFileSize:       64 * 1024 * 1024, // 64MB
+		ValueLogGCInterval:     time.Minute,
+		ValueLogGCDiscardRatio: 0.5,
+
+		ColdReadRate: 0.01, // Fewer than one read per 100 seconds
+		ColdMinAge:   10 * time.Minute,
 	}
 }
 
@@ -32,14 +287,50 @@ type LSM struct {
 	activeMemtable    *MemTable
 	immutableMemtable *MemTable
 	wal               *WAL
+	vlog              *valueLog
 	levels            *LevelManager
 	sequence          uint64 // Atomic counter for ordering
+	legacySequence    uint64 // Of SSTables that don't record one (see fileSequence)
 	nextFileNum       uint64 // Atomic counter for SSTable numbering
+	compare           compareFunc
 
 	flushChan      chan struct{}
 	compactionChan chan struct{}
-	closeChan      chan struct{}
-	wg             sync.WaitGroup
+
+	// compactionPaused is set by PauseCompaction
+	compactionPaused atomic.Bool
+	closeChan        chan struct{}
+	wg               sync.WaitGroup
+	gate             common.OpGate // Put, Get, ... in flight, drained by Close
+
+	memory            *common.MemoryAccountant
+	unregisterReclaim func()
+	lock              io.Closer // On the data directory
+	corruption        common.CorruptionLog
+	walErr            common.LastError // Of the latest WAL append or sync
+	disk              *common.DiskGuard
+	deleter           *common.DeleteScheduler
+	compactionLog     *compactionLog   // nil unless Config.CompactionLog is set
+	scrubber          *common.Scrubber // nil unless ScrubInterval is set
+	background        *common.WorkerLimiter
+
+	// manifest as last written. unopened lists SSTables that failed to
+	// load but are kept in it, so they aren't taken for leftovers.
+	manifest *manifest
+	unopened []liveFile
+
+	// Background workers running, for Health, and the supervisor
+	// restarting them if they panic
+	supervisor *common.Supervisor
+	workers    struct {
+		flush      atomic.Bool
+		compaction atomic.Bool
+		valueLogGC atomic.Bool
+		walArchive atomic.Bool
+	}
+
+	// walArchived signals the WAL archive worker that a WAL was archived
+	walArchived chan struct{}
 
 	// Stats tracking
 	stats struct {
@@ -47,67 +338,262 @@ type LSM struct {
 		readCount    atomic.Int64
 		flushCount   atomic.Int64
 		compactCount atomic.Int64
+		stitchCount  atomic.Int64 // L0->L0 compactions
+		vlogGCCount  atomic.Int64 // Value log files collected
+		coldMoves    atomic.Int64 // Cold files compacted past empty levels
+		trivialMoves atomic.Int64 // Files moved down a level without a rewrite
+		readAmp      common.ReadAmpHistogram
+
+		// Where Gets were satisfied (see HitLocations)
+		hitActive    atomic.Int64
+		hitImmutable atomic.Int64
+		hitLevel     []atomic.Int64 // one per level
+		hitMiss      atomic.Int64
 	}
 }
 
 // New creates a new LSM-Tree storage engine
 func New(config Config) (*LSM, error) {
+	return NewWithContext(context.Background(), config)
+}
+
+// NewWithContext creates the engine like New, abandoning recovery with the
+// context's error if ctx is cancelled before it finishes
+func NewWithContext(ctx context.Context, config Config) (*LSM, error) {
+	fs, err := common.ConfigFS(config.FS, config.InMemory)
+	if err != nil {
+		return nil, err
+	}
+	if fs, err = common.Encrypt(fs, config.EncryptionKey, config.KeyProvider); err != nil {
+		return nil, err
+	}
+	config.FS = fs
+
 	// Create data directory if it doesn't exist
-	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+	if err := config.FS.MkdirAll(config.DataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	// Only one engine may use the directory at a time
+	lock, err := config.FS.Lock(filepath.Join(config.DataDir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	defer func() {
+		if !opened {
+			lock.Close()
+		}
+	}()
+
+	// Now that no other engine can be writing them, clear out files a
+	// crash left behind
+	if err := finishWALArchive(config.FS, config.DataDir); err != nil {
+		return nil, err
+	}
+	removeStaleFiles(config.FS, config.DataDir)
+
+	// Settle the tree's shape against the manifest
+	var stored *manifest
+	config, stored, err = applyManifest(config)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := DefaultConfig(config.DataDir)
+	if config.ValueLogFileSize == 0 {
+		config.ValueLogFileSize = defaults.ValueLogFileSize
+	}
+	if config.ValueLogGCInterval == 0 {
+		config.ValueLogGCInterval = defaults.ValueLogGCInterval
+	}
+	if config.ValueLogGCDiscardRatio == 0 {
+		config.ValueLogGCDiscardRatio = defaults.ValueLogGCDiscardRatio
+	}
+	if config.ColdReadRate == 0 {
+		config.ColdReadRate = defaults.ColdReadRate
+	}
+	if config.ColdMinAge == 0 {
+		config.ColdMinAge = defaults.ColdMinAge
+	}
+
+	// Open the value log before the WAL, whose records may point into it
+	vlog, err := openValueLog(config.FS, config.DataDir, config.ValueLogFileSize)
+	if err != nil {
+		return nil, err
+	}
+
 	// Open WAL
 	walPath := filepath.Join(config.DataDir, "wal.log")
-	wal, err := NewWAL(walPath)
+	wal, err := openWAL(config.FS, walPath, config.WALCompression)
 	if err != nil {
+		vlog.close()
 		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
 
+	memory := config.Memory
+	if memory == nil {
+		memory = common.NewMemoryAccountant(0)
+	}
+	background := config.Workers
+	if background == nil {
+		background = common.NewWorkerLimiter(config.MaxBackgroundWorkers, config.BackgroundCPUPercent)
+	}
+
 	lsm := &LSM{
 		config:         config,
-		activeMemtable: NewMemTable(config.MemTableSize),
-		levels:         NewLevelManager(),
+		levels:         NewLevelManager(config.NumLevels, config.LevelSizeMultiplier),
 		wal:            wal,
+		vlog:           vlog,
 		flushChan:      make(chan struct{}, 1),
 		compactionChan: make(chan struct{}, 1),
 		closeChan:      make(chan struct{}),
+		memory:         memory,
+		lock:           lock,
+		compare:        newCompareFunc(config.Comparator),
+		disk:           common.NewDiskGuard(config.FS, config.DataDir, config.DiskLowWatermarkBytes),
+		deleter:        common.NewDeleteScheduler(config.FS, config.DeleteBytesPerSecond),
+		background:     background,
+		manifest:       stored,
+
+		// Writes since the last flush are in the WAL, and recoverFromWAL
+		// raises it past theirs
+		sequence: stored.LastSequence,
+	}
+	lsm.corruption.OnCorruption = config.OnCorruption
+	lsm.supervisor = common.NewSupervisor(lsm.closeChan)
+	lsm.supervisor.OnPanic = config.OnWorkerPanic
+	lsm.levels.memory = memory
+	lsm.levels.compare = lsm.compare
+	if config.DynamicLevelBytes {
+		lsm.levels.EnableDynamicLevelBytes()
 	}
+	lsm.stats.hitLevel = make([]atomic.Int64, config.NumLevels)
+	lsm.activeMemtable = lsm.newMemTable()
 
 	// Recover from WAL
-	if err := lsm.recoverFromWAL(); err != nil {
+	if err := lsm.recoverFromWAL(ctx); err != nil {
+		wal.Close()
+		vlog.close()
+		lsm.deleter.Close()
 		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
 	}
+	lsm.legacySequence = lsm.sequence
 
 	// Load existing SSTables
-	if err := lsm.loadSSTables(); err != nil {
+	if err := lsm.loadSSTables(ctx); err != nil {
+		wal.Close()
+		vlog.close()
+		lsm.levels.CloseAll()
+		lsm.deleter.Close()
 		return nil, fmt.Errorf("failed to load SSTables: %w", err)
 	}
 
+	if config.CompactionLog {
+		if lsm.compactionLog, err = openCompactionLog(config.FS, config.DataDir); err != nil {
+			wal.Close()
+			vlog.close()
+			lsm.levels.CloseAll()
+			lsm.deleter.Close()
+			return nil, err
+		}
+	}
+
+	lsm.unregisterReclaim = memory.RegisterReclaimer(lsm.reclaimMemory)
+
 	// Start background workers
-	lsm.wg.Add(2)
-	go lsm.flushWorker()
-	go lsm.compactionWorker()
+	lsm.wg.Add(3)
+	lsm.workers.flush.Store(true)
+	lsm.workers.compaction.Store(true)
+	lsm.workers.valueLogGC.Store(true)
+	go lsm.supervise("flush", &lsm.workers.flush, lsm.flushWorker)
+	go lsm.supervise("compaction", &lsm.workers.compaction, lsm.compactionWorker)
+	go lsm.supervise("value log GC", &lsm.workers.valueLogGC, lsm.valueLogGCWorker)
+	if config.WALArchive != nil {
+		lsm.walArchived = make(chan struct{}, 1)
+		lsm.wg.Add(1)
+		lsm.workers.walArchive.Store(true)
+		go lsm.supervise("WAL archive", &lsm.workers.walArchive, lsm.walArchiveWorker)
+	}
+	lsm.scrubber = common.NewScrubber(config.ScrubInterval, config.ScrubBytesPerSecond, lsm.scrub)
 
 	log.Printf("LSM-Tree initialized at %s", config.DataDir)
 
+	opened = true
 	return lsm, nil
 }
 
 // Put inserts a key-value pair
 func (lsm *LSM) Put(key string, value []byte) error {
-	// Get next sequence number
+	return lsm.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put with the span its Config.Tracer span is a child of
+func (lsm *LSM) PutContext(ctx context.Context, key string, value []byte) error {
+	o := lsm.startOp(ctx, "lsm.Put")
+	if o == nil {
+		return lsm.put(key, value)
+	}
+	valueLog := lsm.config.ValueThreshold > 0 && len(value) >= lsm.config.ValueThreshold
+	o.setAttributes(
+		common.Attribute{Key: "lsm.key_bytes", Value: int64(len(key))},
+		common.Attribute{Key: "lsm.value_bytes", Value: int64(len(value))},
+		common.Attribute{Key: "lsm.value_log", Value: valueLog})
+	err := lsm.put(key, value)
+	o.end(key, err, func() string {
+		if valueLog {
+			return fmt.Sprintf("%d byte value, to the value log", len(value))
+		}
+		return fmt.Sprintf("%d byte value", len(value))
+	})
+	return err
+}
+
+func (lsm *LSM) put(key string, value []byte) error {
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+
+	// Large values go to the value log; the tree gets a pointer
+	var ptr []byte
+	if lsm.config.ValueThreshold > 0 && len(value) >= lsm.config.ValueThreshold {
+		var err error
+		if ptr, err = lsm.vlog.append(key, value); err != nil {
+			return err
+		}
+	}
+
+	// The flush worker replaces the WAL under the write lock. Taking the
+	// sequence number under it too means that whoever holds it for
+	// writing sees every write numbered so far in the WAL.
+	lsm.mu.RLock()
 	seq := atomic.AddUint64(&lsm.sequence, 1)
 
 	// Append to WAL
-	if err := lsm.wal.Append(key, value, seq, false); err != nil {
+	var err error
+	if ptr != nil {
+		err = lsm.wal.AppendValuePointer(key, ptr, seq)
+	} else {
+		err = lsm.wal.Append(key, value, seq, false)
+	}
+	lsm.walErr.Set(err)
+	if err != nil {
+		lsm.mu.RUnlock()
 		return fmt.Errorf("failed to append to WAL: %w", err)
 	}
 
 	// Insert into active memtable
-	lsm.mu.RLock()
-	lsm.activeMemtable.Put(key, value, seq)
-	isFull := lsm.activeMemtable.IsFull()
+	if ptr != nil {
+		lsm.activeMemtable.PutValuePointer(key, ptr, seq)
+	} else {
+		lsm.activeMemtable.Put(key, value, seq)
+	}
+	isFull := lsm.shouldRotate()
 
 	lsm.mu.RUnlock()
 
@@ -119,162 +605,659 @@ func (lsm *LSM) Put(key string, value []byte) error {
 
 		lsm.mu.Lock()
 		// Double-check after acquiring write lock
-		if lsm.activeMemtable.IsFull() && lsm.immutableMemtable == nil {
-			// Freeze current memtable
-			lsm.immutableMemtable = lsm.activeMemtable
-			lsm.activeMemtable = NewMemTable(lsm.config.MemTableSize)
-
-			// Signal flush worker
-			select {
-			case lsm.flushChan <- struct{}{}:
-			default:
-			}
-		}
+		lsm.rotateMemtable()
 		lsm.mu.Unlock()
 	}
 
 	return nil
 }
 
-// Get retrieves a value for a key
+// checkWritable refuses writes while a flush or compaction has found the
+// disk below the low watermark. Once space is freed the flush that was
+// refused meanwhile is retried.
+func (lsm *LSM) checkWritable() error {
+	if !lsm.disk.ReadOnly() {
+		return nil
+	}
+	if err := lsm.disk.Check(); err != nil {
+		return err
+	}
+	select {
+	case lsm.flushChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Reasons a memtable is flushed (see LSM.NextFlushReason)
+const (
+	FlushReasonSize    = "size"    // It reached MemTableSize
+	FlushReasonEntries = "entries" // It reached MemTableMaxEntries
+	FlushReasonAge     = "age"     // It reached MemTableMaxAge
+	FlushReasonMemory  = "memory"  // The memory budget was exceeded
+)
+
+// shouldRotate reports whether the active memtable should be frozen and
+// flushed: it has reached a flush trigger, or the memory budget is
+// exceeded. Caller must hold lsm.mu.
+func (lsm *LSM) shouldRotate() bool {
+	_, progress := lsm.flushTrigger()
+	return progress >= 1
+}
+
+// flushTrigger returns the flush trigger the active memtable is closest
+// to, and how far it is towards it, 1 or more once reached. Caller must
+// hold lsm.mu.
+func (lsm *LSM) flushTrigger() (reason string, progress float64) {
+	mt := lsm.activeMemtable
+	if mt.IsFull() {
+		return FlushReasonSize, 1
+	}
+	if lsm.memory.OverBudget() && mt.Len() > 0 {
+		return FlushReasonMemory, 1
+	}
+
+	reason, progress = FlushReasonSize, float64(mt.Size())/float64(lsm.config.MemTableSize)
+	if limit := lsm.config.MemTableMaxEntries; limit > 0 {
+		if p := float64(mt.Len()) / float64(limit); p > progress {
+			reason, progress = FlushReasonEntries, p
+		}
+	}
+	if limit := lsm.config.MemTableMaxAge; limit > 0 {
+		if p := float64(mt.Age(time.Now())) / float64(limit); p > progress {
+			reason, progress = FlushReasonAge, p
+		}
+	}
+	return reason, progress
+}
+
+// NextFlushReason names the flush trigger the active memtable is closest
+// to reaching, one of the FlushReason constants, or FlushReasonMemory if
+// the memory budget is exceeded
+func (lsm *LSM) NextFlushReason() string {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	reason, _ := lsm.flushTrigger()
+	return reason
+}
+
+// rotateMemtable freezes the active memtable and signals the flush worker
+// if it should rotate and no flush is pending. Caller must hold lsm.mu
+// for writing.
+func (lsm *LSM) rotateMemtable() {
+	if !lsm.shouldRotate() || lsm.immutableMemtable != nil {
+		return
+	}
+
+	// Freeze current memtable. Readers take lsm.mu, so none sees the new
+	// active memtable without the frozen one behind it.
+	lsm.immutableMemtable = lsm.activeMemtable
+	lsm.activeMemtable = lsm.newMemTable()
+
+	// Signal flush worker
+	select {
+	case lsm.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+// newMemTable creates an empty memtable charged to the accountant
+func (lsm *LSM) newMemTable() *MemTable {
+	mt := NewMemTable(lsm.config.MemTableSize)
+	mt.memory = lsm.memory
+	mt.keepVersions = lsm.config.KeepVersions
+	mt.compare = lsm.compare
+	return mt
+}
+
+// reclaimMemory is registered with the memory accountant. Memtable memory
+// is only freed by flushing, so it starts an early flush and reports
+// nothing reclaimed immediately.
+func (lsm *LSM) reclaimMemory(need int64) int64 {
+	// Charges can arrive with lsm.mu held (e.g. from Put), so don't wait
+	if !lsm.mu.TryLock() {
+		return 0
+	}
+	lsm.rotateMemtable()
+	lsm.mu.Unlock()
+	return 0
+}
+
+// Get retrieves a value for a key. It sees every Put and Delete that
+// returned before it was called, whatever flushes and compactions are
+// doing meanwhile (see the consistency section of the README).
 func (lsm *LSM) Get(key string) ([]byte, bool, error) {
+	return lsm.GetContext(context.Background(), key)
+}
+
+// GetContext is Get with the span its Config.Tracer span is a child of
+func (lsm *LSM) GetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	var probes readProbes
+	o := lsm.startOp(ctx, "lsm.Get")
+	if o == nil {
+		return lsm.get(key, &probes)
+	}
+	value, found, err := lsm.get(key, &probes)
+	o.setAttributes(
+		common.Attribute{Key: "lsm.key_bytes", Value: int64(len(key))},
+		common.Attribute{Key: "lsm.found", Value: found},
+		common.Attribute{Key: "lsm.value_bytes", Value: int64(len(value))},
+		common.Attribute{Key: "lsm.sstables", Value: int64(probes.sstables)},
+		common.Attribute{Key: "lsm.blocks_read", Value: int64(probes.blocks)})
+	o.end(key, err, func() string {
+		state := "missing"
+		if found {
+			state = "found"
+		}
+		return fmt.Sprintf("%s, %d memtables, %d SSTables, %d blocks read", state, probes.memtables, probes.sstables, probes.blocks)
+	})
+	return value, found, err
+}
+
+// get is Get, filling in probes with what it read
+func (lsm *LSM) get(key string, probes *readProbes) ([]byte, bool, error) {
+	if err := lsm.gate.Enter(); err != nil {
+		return nil, false, err
+	}
+	defer lsm.gate.Exit()
+
 	// Track read
 	lsm.stats.readCount.Add(1)
 
-	// Check active memtable
-	lsm.mu.RLock()
-	value, _, deleted, found := lsm.activeMemtable.Get(key)
-	if found {
-		lsm.mu.RUnlock()
-		if deleted {
-			return nil, false, nil
+	// Keep value log GC from removing a file the pointer we find is into
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	var value []byte
+	var valuePtr bool
+	found, err := lsm.lookup(key, probes, func(v []byte, ptr bool) error {
+		value, valuePtr = bytes.Clone(v), ptr
+		return nil
+	})
+	if err != nil {
+		lsm.handleCorruption(err)
+		return nil, false, err
+	}
+	if !found {
+		return nil, false, nil
+	}
+	if valuePtr {
+		if value, err = lsm.vlog.read(key, value); err != nil {
+			return nil, false, err
+		}
+	}
+	return value, true, nil
+}
+
+// GetValue calls fn with the value for a key without copying it out of
+// the memtable or the data block it was read into (see
+// common.ValueGetter). A value kept in the value log is read into a new
+// buffer. Returns common.ErrKeyNotFound, without calling fn, if the key
+// doesn't exist.
+func (lsm *LSM) GetValue(key string, fn func(value []byte) error) error {
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	// Track read
+	lsm.stats.readCount.Add(1)
+
+	// Keep value log GC from removing a file the pointer we find is into
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	var ptr []byte
+	found, err := lsm.lookup(key, &readProbes{}, func(value []byte, valuePtr bool) error {
+		if valuePtr {
+			ptr = bytes.Clone(value)
+			return nil
+		}
+		return fn(value)
+	})
+	if err != nil {
+		lsm.handleCorruption(err)
+		return err
+	}
+	if !found {
+		return common.ErrKeyNotFound
+	}
+	if ptr == nil {
+		return nil
+	}
+	value, err := lsm.vlog.read(key, ptr)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+// Has reports whether key exists. It looks the key up like Get, so an
+// SSTable's bloom filter and index rule it out without a block read, but
+// never reads a value from the value log.
+func (lsm *LSM) Has(key string) (bool, error) {
+	if err := lsm.gate.Enter(); err != nil {
+		return false, err
+	}
+	defer lsm.gate.Exit()
+
+	found, err := lsm.lookup(key, nil, nil)
+	if err != nil {
+		lsm.handleCorruption(err)
+		return false, err
+	}
+	return found, nil
+}
+
+// GetMulti looks up several keys, returning the value of each found;
+// missing keys are left out. Every key is read from one snapshot of the
+// tree, so of two writes the second is never seen without the first, as
+// separate Gets could see them.
+//
+// Writes hold lsm.mu for reading, so the memtables are read for every key
+// under it held for writing, with no write landing in between, and the
+// SSTables to search are picked and referenced there. They are searched
+// once it's released: flushes and compactions since then don't change
+// the referenced files, and the value log isn't collected until the call
+// returns.
+func (lsm *LSM) GetMulti(keys []string) (map[string][]byte, error) {
+	if err := lsm.gate.Enter(); err != nil {
+		return nil, err
+	}
+	defer lsm.gate.Exit()
+
+	// Track reads
+	lsm.stats.readCount.Add(int64(len(keys)))
+
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	points := make([]readPoint, len(keys))
+	lsm.mu.Lock()
+	for i, key := range keys {
+		points[i] = lsm.readPointLocked(key)
+	}
+	lsm.mu.Unlock()
+
+	values := make(map[string][]byte, len(keys))
+	var err error
+	for i, key := range keys {
+		if err != nil {
+			points[i].release()
+			continue
+		}
+		var value []byte
+		var valuePtr, found bool
+		found, _, err = lsm.search(key, points[i], &readProbes{}, func(v []byte, ptr bool) error {
+			value, valuePtr = bytes.Clone(v), ptr
+			return nil
+		})
+		if err != nil {
+			lsm.handleCorruption(err)
+			continue
 		}
-		return value, true, nil
+		if !found {
+			continue
+		}
+		if valuePtr {
+			if value, err = lsm.vlog.read(key, value); err != nil {
+				continue
+			}
+		}
+		values[key] = value
 	}
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
 
-	// Check immutable memtable
+// lookup finds the newest version of key and, if fn is set, calls it with
+// the value, value log pointers unresolved (valuePtr true). The value is
+// only valid during fn: it may be a slice of a pooled block buffer. If
+// track is set, the read is counted in read amplification and hit
+// locations, which only user reads should be, and track is filled in with
+// what it probed.
+func (lsm *LSM) lookup(key string, track *readProbes, fn func(value []byte, valuePtr bool) error) (found bool, err error) {
+	lsm.mu.RLock()
+	found, _, err = lsm.lookupLocked(key, track, lsm.mu.RUnlock, fn)
+	return found, err
+}
+
+// lookupLocked is lookup for a caller holding lsm.mu, which it calls
+// unlock to release once it has read the memtables and picked the
+// SSTables to search. It also returns the sequence number of the version
+// found (see GetWithMeta).
+func (lsm *LSM) lookupLocked(key string, track *readProbes, unlock func(), fn func(value []byte, valuePtr bool) error) (found bool, seq uint64, err error) {
+	point := lsm.readPointLocked(key)
+	unlock()
+	return lsm.search(key, point, track, fn)
+}
+
+// readProbes counts what a lookup read: memtables, SSTables searched and
+// data blocks read from them. There is no block cache, so every block is
+// read from disk.
+type readProbes struct {
+	memtables, sstables, blocks int
+}
+
+// readPoint is what a lookup of a key reads under lsm.mu: the key's
+// version in a memtable or, if neither has one, the SSTables to search
+// for it, each referenced
+type readPoint struct {
+	entry      MemTableEntry
+	hits       *atomic.Int64 // Of the memtable entry is from, nil for none
+	memtables  int           // Memtables looked in
+	candidates []levelSSTable
+}
+
+// readPointLocked reads the memtables for key and picks the SSTables to
+// search. Caller must hold lsm.mu, and pass the result to search or
+// release.
+func (lsm *LSM) readPointLocked(key string) readPoint {
+	point := readPoint{memtables: 1}
+	if entry, found := lsm.activeMemtable.getEntry(key); found {
+		point.entry, point.hits = entry, &lsm.stats.hitActive
+		return point
+	}
 	if lsm.immutableMemtable != nil {
-		value, _, deleted, found := lsm.immutableMemtable.Get(key)
+		point.memtables++
+		if entry, found := lsm.immutableMemtable.getEntry(key); found {
+			point.entry, point.hits = entry, &lsm.stats.hitImmutable
+			return point
+		}
+	}
+	point.candidates = lsm.sstablesFor(key)
+	return point
+}
+
+// release unreferences the SSTables of a read point not searched
+func (p readPoint) release() {
+	for _, c := range p.candidates {
+		c.sst.unref()
+	}
+}
+
+// search finishes a lookup of key from what readPointLocked read, without
+// lsm.mu, and releases the read point
+func (lsm *LSM) search(key string, point readPoint, track *readProbes, fn func(value []byte, valuePtr bool) error) (found bool, seq uint64, err error) {
+	defer point.release()
+
+	// Count memtables, SSTables and data blocks touched (read amplification)
+	probes := readProbes{memtables: point.memtables}
+	if track != nil {
+		defer func() {
+			*track = probes
+			lsm.stats.readAmp.Record(probes.memtables + probes.sstables + probes.blocks)
+		}()
+	}
+	hit := func(counter *atomic.Int64) {
+		if track != nil {
+			counter.Add(1)
+		}
+	}
+	call := func(value []byte, valuePtr bool) error {
+		if fn == nil {
+			return nil
+		}
+		return fn(value, valuePtr)
+	}
+
+	if point.hits != nil {
+		hit(point.hits)
+		if point.entry.Deleted {
+			return false, 0, nil
+		}
+		return true, point.entry.Sequence, call(point.entry.Value, point.entry.ValuePointer)
+	}
+
+	// Check SSTables newest first; the first version found wins
+	for _, c := range point.candidates {
+		probes.sstables++
+		var deleted bool
+		var seq uint64
+		found, blockRead, err := c.sst.find(key, func(entry SSTableEntry) error {
+			// A tombstone hides older versions further down
+			if entry.Deleted {
+				deleted = true
+				return nil
+			}
+			seq = entry.Sequence
+			return call(entry.Value, entry.ValuePointer)
+		})
+		if blockRead {
+			probes.blocks++
+			if track != nil && c.sst.heat != nil {
+				c.sst.heat.record(key)
+			}
+		}
+		if err != nil {
+			return false, 0, err
+		}
 		if found {
-			lsm.mu.RUnlock()
+			hit(&lsm.stats.hitLevel[c.level])
 			if deleted {
-				return nil, false, nil
+				return false, 0, nil
+			}
+			if seq != 0 {
+				return true, seq, nil // Kept with the versions
 			}
-			return value, true, nil
+			return true, lsm.fileSequence(c.sst), nil
 		}
 	}
-	lsm.mu.RUnlock()
 
-	// Check SSTables in order (L0, L1, L2, L3, L4)
-	for level := 0; level < 5; level++ {
-		sstables := lsm.levels.GetAllSSTables(level)
+	hit(&lsm.stats.hitMiss)
+	return false, 0, nil
+}
+
+// levelSSTable is an SSTable and the level it is in
+type levelSSTable struct {
+	level int
+	sst   *SSTable
+}
 
-		// For L0, check all files (they may overlap)
+// sstablesFor returns the SSTables whose key range holds key, newest
+// first, each referenced so a compaction replacing it meanwhile leaves it
+// open: L0 files may overlap, so every one that could hold the key, newest
+// first; in L1+ at most one file per level. A file whose key range
+// excludes the key isn't touched, not even its bloom filter. Caller must
+// hold lsm.mu, which compactions install their output under, and unref
+// each.
+func (lsm *LSM) sstablesFor(key string) []levelSSTable {
+	var candidates []levelSSTable
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		sstables := lsm.levels.GetAllSSTables(level)
 		if level == 0 {
-			for _, sst := range sstables {
-				value, found, err := sst.Get(key)
-				if err != nil {
-					return nil, false, err
-				}
-				if found {
-					return value, true, nil
-				}
+			slices.Reverse(sstables)
+		}
+
+		for _, sst := range sstables {
+			if lsm.compare(key, sst.MinKey()) < 0 || lsm.compare(key, sst.MaxKey()) > 0 {
+				continue
 			}
-		} else {
-			// For L1+, use binary search on non-overlapping files
-			for _, sst := range sstables {
-				if key >= sst.MinKey() && key <= sst.MaxKey() {
-					value, found, err := sst.Get(key)
-					if err != nil {
-						return nil, false, err
-					}
-					if found {
-						return value, true, nil
-					}
-					break // Non-overlapping, so can stop
-				}
+			sst.ref()
+			candidates = append(candidates, levelSSTable{level, sst})
+			if level > 0 {
+				break // Non-overlapping, so can stop
 			}
 		}
 	}
+	return candidates
+}
+
+// HitLocations returns how many Gets were satisfied by each component:
+// "memtable", "immutable", "L0".."L{NumLevels-1}", and "miss" for keys
+// found nowhere.
+// A healthy tree serves most hits from memtables and the bottom level,
+// with few misses reaching SSTable blocks thanks to bloom filters.
+func (lsm *LSM) HitLocations() map[string]int64 {
+	hits := map[string]int64{
+		"memtable":  lsm.stats.hitActive.Load(),
+		"immutable": lsm.stats.hitImmutable.Load(),
+		"miss":      lsm.stats.hitMiss.Load(),
+	}
+	for level := range lsm.stats.hitLevel {
+		hits[fmt.Sprintf("L%d", level)] = lsm.stats.hitLevel[level].Load()
+	}
+	return hits
+}
 
-	return nil, false, nil
+// MemoryByLevel returns the bytes held by each level's bloom filters and
+// block indexes, keyed "L0".."L{NumLevels-1}". Both grow with the data
+// set: bloom filters by BloomBitsPerKey per key, indexes with the number
+// of blocks and the length of their first keys.
+func (lsm *LSM) MemoryByLevel() (bloom, index map[string]int64) {
+	bloom = make(map[string]int64, lsm.levels.NumLevels())
+	index = make(map[string]int64, lsm.levels.NumLevels())
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		name := fmt.Sprintf("L%d", level)
+		bloom[name], index[name] = 0, 0
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			bloom[name] += sst.bloomMemory()
+			index[name] += sst.indexMemory()
+		}
+	}
+	return bloom, index
 }
 
 // Delete marks a key as deleted
 func (lsm *LSM) Delete(key string) error {
-	// Get next sequence number
+	if lsm.config.UndeleteWindow > 0 {
+		return lsm.deleteRetaining(key)
+	}
+
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+
+	// The sequence number is taken under the lock, as for Put
+	lsm.mu.RLock()
 	seq := atomic.AddUint64(&lsm.sequence, 1)
 
 	// Append tombstone to WAL
-	if err := lsm.wal.Append(key, nil, seq, true); err != nil {
+	err := lsm.wal.Append(key, nil, seq, true)
+	lsm.walErr.Set(err)
+	if err != nil {
+		lsm.mu.RUnlock()
 		return fmt.Errorf("failed to append to WAL: %w", err)
 	}
 
 	// Insert tombstone into active memtable
-	lsm.mu.RLock()
 	lsm.activeMemtable.Delete(key, seq)
-	isFull := lsm.activeMemtable.IsFull()
+	isFull := lsm.shouldRotate()
 	lsm.mu.RUnlock()
 
 	// Trigger flush if memtable is full
 	if isFull {
 		lsm.mu.Lock()
-		if lsm.activeMemtable.IsFull() && lsm.immutableMemtable == nil {
-			lsm.immutableMemtable = lsm.activeMemtable
-			lsm.activeMemtable = NewMemTable(lsm.config.MemTableSize)
-
-			select {
-			case lsm.flushChan <- struct{}{}:
-			default:
-			}
-		}
+		lsm.rotateMemtable()
 		lsm.mu.Unlock()
 	}
 
 	return nil
 }
 
-// Sync forces a WAL sync to disk
+// Sync forces the value log and WAL to disk
 func (lsm *LSM) Sync() error {
-	return lsm.wal.Sync()
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	// The value log first, so synced WAL records never point past it
+	if err := lsm.vlog.sync(); err != nil {
+		return err
+	}
+
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	err := lsm.wal.Sync()
+	lsm.walErr.Set(err)
+	return err
 }
 
-// Close closes the LSM-Tree and flushes all data
+// Close closes the LSM-Tree and flushes all data. New operations fail
+// with common.ErrClosed from the moment it's called; those already in
+// flight are waited for, then the background workers finish what they
+// are doing and stop. Every file is closed even if an earlier step fails.
+// Iterators must be closed first.
 func (lsm *LSM) Close() error {
+	if !lsm.gate.Close() {
+		return nil // Already closed
+	}
+	defer lsm.lock.Close()
 
 	// Signal workers to stop
 	close(lsm.closeChan)
+	lsm.scrubber.Close()
 	lsm.wg.Wait()
+	lsm.unregisterReclaim()
 
-	// Flush active memtable if it has data
+	// Flush the memtables, oldest first. Whatever isn't flushed is still
+	// in the WAL, synced below, and replayed on the next open.
+	var firstErr error
 	lsm.mu.Lock()
-	if lsm.activeMemtable.Len() > 0 {
-		if err := lsm.flushMemtable(lsm.activeMemtable); err != nil {
-			lsm.mu.Unlock()
-			return err
+	for _, memtable := range []*MemTable{lsm.immutableMemtable, lsm.activeMemtable} {
+		if memtable == nil || memtable.Len() == 0 {
+			continue
+		}
+		if err := lsm.flushMemtable(memtable); err != nil {
+			firstErr = fmt.Errorf("failed to flush memtable: %w", err)
+			break
 		}
 	}
 	lsm.mu.Unlock()
 
 	// Close WAL
-	if err := lsm.wal.Close(); err != nil {
-		return err
+	if err := lsm.wal.Sync(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := lsm.wal.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	// Close the value log
+	if err := lsm.vlog.close(); err != nil && firstErr == nil {
+		firstErr = err
 	}
 
 	// Close all SSTables
-	if err := lsm.levels.CloseAll(); err != nil {
-		return err
+	if err := lsm.levels.CloseAll(); err != nil && firstErr == nil {
+		firstErr = err
 	}
 
-	return nil
+	// Finish deleting compacted files
+	lsm.deleter.Close()
+
+	if lsm.compactionLog != nil {
+		if err := lsm.compactionLog.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Hand memtable memory back to a shared accountant
+	lsm.memory.Release(common.MemMemtable, int64(lsm.activeMemtable.Size()))
+	if lsm.immutableMemtable != nil {
+		lsm.memory.Release(common.MemMemtable, int64(lsm.immutableMemtable.Size()))
+	}
+
+	return firstErr
 }
 
 // recoverFromWAL replays the WAL to restore memtable state
-func (lsm *LSM) recoverFromWAL() error {
-	entries, err := lsm.wal.ReadAll()
+func (lsm *LSM) recoverFromWAL(ctx context.Context) error {
+	entries, damage, err := lsm.wal.readAll()
 	if err != nil {
 		return err
 	}
+	if damage != nil {
+		lsm.corruption.Record(damage)
+	}
 
 	if len(entries) == 0 {
 		return nil
@@ -282,33 +1265,75 @@ func (lsm *LSM) recoverFromWAL() error {
 
 	log.Printf("Recovering %d entries from WAL", len(entries))
 
+	progress := common.NewRecoveryTracker(ctx, lsm.config.OnRecoveryProgress, common.PhaseWALReplay, int64(len(entries)), 0)
+
 	for _, entry := range entries {
+		if err := progress.Add(1, int64(len(entry.Key)+len(entry.Value))); err != nil {
+			return err
+		}
+
 		if entry.Sequence > lsm.sequence {
 			lsm.sequence = entry.Sequence
 		}
 
 		if entry.Deleted {
-			lsm.activeMemtable.Delete(entry.Key, entry.Sequence)
+			lsm.activeMemtable.deleteRetaining(entry.Key, entry.Value, entry.Sequence)
+		} else if entry.ValuePointer {
+			lsm.activeMemtable.PutValuePointer(entry.Key, entry.Value, entry.Sequence)
 		} else {
 			lsm.activeMemtable.Put(entry.Key, entry.Value, entry.Sequence)
 		}
 	}
 
+	progress.Done()
 	return nil
 }
 
-// loadSSTables scans the data directory and loads existing SSTables
-func (lsm *LSM) loadSSTables() error {
-	files, err := os.ReadDir(lsm.config.DataDir)
+// loadSSTables scans the data directory and loads the SSTables the
+// manifest lists. Others were left behind by a crash before a compaction
+// or flush was recorded, or before replaced files were deleted, and are
+// deleted now.
+func (lsm *LSM) loadSSTables(ctx context.Context) error {
+	files, err := lsm.config.FS.ReadDir(lsm.config.DataDir)
 	if err != nil {
 		return err
 	}
 
+	// File numbers are unique across levels. A file moved down without a
+	// rewrite keeps the level it was written at in its name, so the
+	// manifest's level is the one that counts.
+	listed := make(map[uint64]int, len(lsm.manifest.Files))
+	for _, f := range lsm.manifest.Files {
+		listed[f.FileNum] = f.Level
+	}
+	changed := !lsm.manifest.HasFiles
+
+	var numTables, totalBytes int64
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".sst" {
+			continue
+		}
+		numTables++
+		if info, err := file.Info(); err == nil {
+			totalBytes += info.Size()
+		}
+	}
+
+	progress := common.NewRecoveryTracker(ctx, lsm.config.OnRecoveryProgress, common.PhaseSSTableLoad, numTables, totalBytes)
+
 	for _, file := range files {
 		if filepath.Ext(file.Name()) != ".sst" {
 			continue
 		}
 
+		var size int64
+		if info, err := file.Info(); err == nil {
+			size = info.Size()
+		}
+		if err := progress.Add(1, size); err != nil {
+			return err
+		}
+
 		// Parse filename: L{level}-{filenum}.sst
 		var level int
 		var fileNum uint64
@@ -317,35 +1342,93 @@ func (lsm *LSM) loadSSTables() error {
 			log.Printf("Warning: skipping malformed SSTable filename: %s", file.Name())
 			continue
 		}
+		if level >= lsm.levels.NumLevels() {
+			return fmt.Errorf("SSTable %s is beyond the last level (NumLevels %d)", file.Name(), lsm.levels.NumLevels())
+		}
+
+		// Track max file number, leftovers included so the number isn't
+		// reused before the file is gone
+		if fileNum >= lsm.nextFileNum {
+			lsm.nextFileNum = fileNum + 1
+		}
 
-		// Open SSTable
 		path := filepath.Join(lsm.config.DataDir, file.Name())
-		sst, err := OpenSSTable(path, level, fileNum)
+		if lsm.manifest.HasFiles {
+			listedLevel, ok := listed[fileNum]
+			if !ok {
+				log.Printf("Deleting leftover SSTable %s", file.Name())
+				if err := lsm.deleter.Delete(path); err != nil {
+					log.Printf("Warning: failed to delete SSTable %s: %v", file.Name(), err)
+				}
+				continue
+			}
+			level = listedLevel
+			delete(listed, fileNum)
+		}
+		id := liveFile{Level: level, FileNum: fileNum}
+
+		// Open SSTable
+		sst, err := openSSTable(lsm.config.FS, path, level, fileNum, lsm.config.Comparator)
+		if errors.Is(err, common.ErrCorruption) {
+			lsm.corruption.Record(err)
+			log.Printf("Warning: quarantining SSTable: %v", err)
+			lsm.quarantined(common.Quarantine(lsm.config.FS, lsm.config.DataDir, path))
+			changed = true
+			continue
+		}
 		if err != nil {
 			log.Printf("Warning: failed to open SSTable %s: %v", file.Name(), err)
+			lsm.unopened = append(lsm.unopened, id)
 			continue
 		}
+		lsm.trackHeat(sst)
+		sst.verify = lsm.config.VerifyChecksumsOnRead
 
 		// Add to level manager
 		lsm.levels.AddSSTable(sst, level)
+	}
 
-		// Track max file number
-		if fileNum >= lsm.nextFileNum {
-			lsm.nextFileNum = fileNum + 1
+	for fileNum, level := range listed {
+		log.Printf("Warning: SSTable %06d of L%d is in the manifest but missing", fileNum, level)
+		changed = true
+	}
+	if changed {
+		if err := lsm.saveManifest(nil, nil); err != nil {
+			return err
 		}
-
 	}
 
+	progress.Done()
 	return nil
 }
 
-// flushMemtable writes a memtable to disk as an L0 SSTable
-func (lsm *LSM) flushMemtable(memtable *MemTable) error {
-	entries := memtable.GetAllEntries()
-	if len(entries) == 0 {
+// flushMemtable writes a memtable to disk as an L0 SSTable, straight from
+// its entries. It must no longer be written to.
+func (lsm *LSM) flushMemtable(memtable *MemTable) (err error) {
+	numEntries := memtable.Len()
+	if numEntries == 0 {
 		return nil
 	}
 
+	var span common.Span
+	if lsm.config.Tracer != nil {
+		span = lsm.startSpan(context.Background(), "lsm.Flush",
+			common.Attribute{Key: "lsm.entries", Value: int64(numEntries)},
+			common.Attribute{Key: "lsm.memtable_bytes", Value: int64(memtable.Size())})
+		defer func() { span.End(time.Now(), err) }()
+	}
+
+	// Better to keep the memtable than to run out of space mid-file
+	if err := lsm.disk.Check(); err != nil {
+		return err
+	}
+
+	// The WAL is deleted after the flush, so the values its pointers
+	// refer to must be on disk first
+	if err := lsm.vlog.sync(); err != nil {
+		return err
+	}
+
 	fileNum := atomic.AddUint64(&lsm.nextFileNum, 1) - 1
 	path := filepath.Join(lsm.config.DataDir, fmt.Sprintf("L0-%06d.sst", fileNum))
 
@@ -353,16 +1436,22 @@ func (lsm *LSM) flushMemtable(memtable *MemTable) error {
 	lsm.stats.flushCount.Add(1)
 
 	// Build SSTable
-	builder, err := NewSSTableBuilder(path, len(entries))
+	builder, err := newSSTableBuilder(lsm.config.FS, path, numEntries, lsm.config.BloomBitsPerKey)
 	if err != nil {
 		return err
 	}
 
-	for _, entry := range entries {
-		if err := builder.Add(entry.Key, entry.Value, entry.Deleted); err != nil {
-			builder.Abort()
-			return err
-		}
+	builder.props.MaxSequence = memtable.maxSequence()
+	if lsm.config.KeepVersions > 1 {
+		err = memtable.eachVersion(func(entry MemTableEntry) error {
+			return builder.addVersion(entry.Key, entry.Value, entryFlags(entry.Deleted, entry.ValuePointer), entry.Sequence)
+		})
+	} else {
+		err = builder.addAll(memtable.flushIterator())
+	}
+	if err != nil {
+		builder.Abort()
+		return err
 	}
 
 	if err := builder.Finish(); err != nil {
@@ -370,45 +1459,62 @@ func (lsm *LSM) flushMemtable(memtable *MemTable) error {
 	}
 
 	// Open the newly created SSTable
-	sst, err := OpenSSTable(path, 0, fileNum)
+	sst, err := openSSTable(lsm.config.FS, path, 0, fileNum, lsm.config.Comparator)
 	if err != nil {
 		return err
 	}
+	lsm.trackHeat(sst)
+	sst.verify = lsm.config.VerifyChecksumsOnRead
 
-	// Add to L0
+	// Record it as live, then add to L0
+	if err := lsm.saveManifest(nil, []*SSTable{sst}); err != nil {
+		sst.Remove()
+		return err
+	}
 	lsm.levels.AddSSTable(sst, 0)
 
+	if span != nil {
+		span.SetAttributes(
+			common.Attribute{Key: "lsm.file", Value: int64(fileNum)},
+			common.Attribute{Key: "lsm.bytes_written", Value: sst.Size()})
+	}
 	return nil
 }
 
+// trackHeat starts read tracking for a new or newly loaded SSTable
+func (lsm *LSM) trackHeat(sst *SSTable) {
+	if lsm.config.TrackTemperature {
+		sst.heat = newFileHeat(time.Now())
+	}
+}
+
+// supervise runs a background worker's loop under lsm.supervisor until
+// Close
+func (lsm *LSM) supervise(name string, running *atomic.Bool, work func()) {
+	defer lsm.wg.Done()
+	lsm.supervisor.Run(name, running, work)
+}
+
 // flushWorker handles background memtable flushes
 func (lsm *LSM) flushWorker() {
-	defer lsm.wg.Done()
+
+	// Flush a memtable that reaches MemTableMaxAge without being written
+	// to
+	var ageCheck <-chan time.Time
+	if lsm.config.MemTableMaxAge > 0 {
+		ticker := time.NewTicker(max(lsm.config.MemTableMaxAge/4, time.Millisecond))
+		defer ticker.Stop()
+		ageCheck = ticker.C
+	}
 
 	for {
 		select {
 		case <-lsm.closeChan:
 			return
+		case <-ageCheck:
+			lsm.rotateIfOld()
 		case <-lsm.flushChan:
-			lsm.mu.Lock()
-			if lsm.immutableMemtable != nil {
-				if err := lsm.flushMemtable(lsm.immutableMemtable); err != nil {
-					log.Printf("Error flushing memtable: %v", err)
-				} else {
-					lsm.immutableMemtable = nil
-
-					// Delete WAL (it's been persisted to SSTable)
-					lsm.wal.Delete()
-					walPath := filepath.Join(lsm.config.DataDir, "wal.log")
-					wal, err := NewWAL(walPath)
-					if err != nil {
-						log.Printf("Error recreating WAL: %v", err)
-					} else {
-						lsm.wal = wal
-					}
-				}
-			}
-			lsm.mu.Unlock()
+			lsm.flushImmutable()
 
 			// Check if compaction is needed
 			if lsm.levels.ShouldCompact(0) {
@@ -421,9 +1527,58 @@ func (lsm *LSM) flushWorker() {
 	}
 }
 
+// locked calls fn holding lsm.mu for writing. The lock is released by a
+// defer, so a panic in a background worker doesn't leave it held for the
+// worker's restart.
+func (lsm *LSM) locked(fn func() error) error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	return fn()
+}
+
+// rotateIfOld rotates the active memtable if it reached MemTableMaxAge
+func (lsm *LSM) rotateIfOld() {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	lsm.rotateMemtable()
+}
+
+// flushImmutable flushes the immutable memtable, if there is one. Its
+// locks are released by defers, so a panic doesn't leave them held for
+// the restarted worker.
+func (lsm *LSM) flushImmutable() {
+	lsm.background.Acquire()
+	defer lsm.background.Release()
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if lsm.immutableMemtable == nil {
+		return
+	}
+
+	if err := lsm.flushMemtable(lsm.immutableMemtable); err != nil {
+		log.Printf("Error flushing memtable: %v", err)
+		return
+	}
+	// The flush added its SSTable to L0, so the memtable can go without
+	// its writes disappearing from reads
+	lsm.memory.Release(common.MemMemtable, int64(lsm.immutableMemtable.Size()))
+	lsm.immutableMemtable = nil
+
+	// Drop the flushed records from the WAL
+	if err := lsm.resetWAL(); err != nil {
+		log.Printf("Error resetting WAL: %v", err)
+	}
+}
+
 // compactionWorker handles background compactions
 func (lsm *LSM) compactionWorker() {
-	defer lsm.wg.Done()
+	// Run what was deferred once a window opens
+	var windowCheck <-chan time.Time
+	if len(lsm.config.CompactionWindows) > 0 {
+		ticker := time.NewTicker(compactionWindowCheck)
+		defer ticker.Stop()
+		windowCheck = ticker.C
+	}
 
 	for {
 		select {
@@ -431,22 +1586,43 @@ func (lsm *LSM) compactionWorker() {
 			return
 		case <-lsm.compactionChan:
 			lsm.performCompaction()
+		case <-windowCheck:
+			lsm.performCompaction()
 		}
 	}
 }
 
-// performCompaction performs compaction across all levels (L0→L1, L1→L2, L2→L3, L3→L4)
+// performCompaction performs compaction across all levels (L0→L1, L1→L2, ...)
 func (lsm *LSM) performCompaction() {
+	// Compaction needs room for its output before it frees its input
+	if err := lsm.disk.Check(); err != nil {
+		log.Printf("Skipping compaction: %v", err)
+		return
+	}
+
+	// Held back by PauseCompaction or CompactionWindows, unless L0 has
+	// reached its hard cap
+	if !lsm.compactionAllowed(time.Now()) {
+		if lsm.levels.NumFiles(0) >= lsm.l0EmergencyFiles() {
+			lsm.compactL0ToL1(CompactionL0Emergency)
+		}
+		return
+	}
+
 	// Check if L0 needs compaction
 	if lsm.levels.ShouldCompact(0) {
-		lsm.compactL0ToL1()
+		if lsm.shouldStitchL0() {
+			lsm.compactL0ToL0()
+			return
+		}
+		lsm.compactL0ToL1(CompactionL0Files)
 		// Trigger next level compaction if needed
-		lsm.triggerNextLevelCompaction(1)
+		lsm.triggerNextLevelCompaction(lsm.levels.BaseLevel())
 		return
 	}
 
-	// Check L1→L2, L2→L3, L3→L4 compactions
-	for level := 1; level < 4; level++ {
+	// Check L1→L2, L2→L3, ... compactions
+	for level := 1; level < lsm.levels.NumLevels()-1; level++ {
 		if lsm.levels.ShouldCompact(level) {
 			lsm.compactLevel(level, level+1)
 			// Trigger next level compaction if needed
@@ -454,72 +1630,388 @@ func (lsm *LSM) performCompaction() {
 			return
 		}
 	}
+
+	// Nothing due: move a file off an old encryption key, if any
+	lsm.rekeyNext()
+}
+
+// shouldStitchL0 decides whether L0 is better compacted into itself: its
+// files are small in total, and pushing them down would mostly rewrite L1
+func (lsm *LSM) shouldStitchL0() bool {
+	if lsm.config.L0StitchMaxBytes <= 0 {
+		return false
+	}
+
+	l0Files := lsm.levels.GetAllSSTables(0)
+	if len(l0Files) < 2 {
+		return false
+	}
+
+	var l0Bytes int64
+	for _, sst := range l0Files {
+		l0Bytes += sst.Size()
+	}
+	if l0Bytes > lsm.config.L0StitchMaxBytes {
+		return false
+	}
+
+	minKey, maxKey := keyRange(l0Files, lsm.compare)
+
+	var l1Bytes int64
+	for _, sst := range lsm.levels.GetOverlapping(lsm.levels.BaseLevel(), minKey, maxKey) {
+		l1Bytes += sst.Size()
+	}
+	return l1Bytes > l0Bytes
 }
 
-// compactL0ToL1 handles L0→L1 compaction (special case for overlapping files)
-func (lsm *LSM) compactL0ToL1() {
+// resetWAL replaces the WAL with one holding only the active memtable's
+// entries, once everything older has been flushed. The old WAL also holds
+// the writes made since the memtable was frozen, so it can't simply be
+// deleted. The new one is synced before it replaces the old, and on error
+// the old one stays in use. Both are closed across the rename, which
+// Windows refuses on open files. Caller must hold lsm.mu for writing.
+func (lsm *LSM) resetWAL() error {
+	walPath := filepath.Join(lsm.config.DataDir, "wal.log")
+	tmpPath := walPath + ".tmp"
+	lsm.config.FS.Remove(tmpPath) // Left over from a crash
+
+	wal, err := openWAL(lsm.config.FS, tmpPath, lsm.config.WALCompression)
+	if err != nil {
+		return err
+	}
+	// Writers wait for lsm.mu, so the memtable can be read in place
+	err = lsm.activeMemtable.eachVersion(func(entry MemTableEntry) error {
+		switch {
+		case entry.Deleted:
+			return wal.Append(entry.Key, entry.Value, entry.Sequence, true)
+		case entry.ValuePointer:
+			return wal.AppendValuePointer(entry.Key, entry.Value, entry.Sequence)
+		default:
+			return wal.Append(entry.Key, entry.Value, entry.Sequence, false)
+		}
+	})
+	if err != nil {
+		wal.Delete()
+		return err
+	}
+	if err := wal.Sync(); err != nil {
+		wal.Delete()
+		return err
+	}
+	if err := wal.Close(); err != nil {
+		lsm.config.FS.Remove(tmpPath)
+		return err
+	}
+
+	lsm.wal.Close()
+
+	// An archived WAL is moved out of the way first, and moved back if
+	// its replacement can't be put in place
+	var archivedPath string
+	if lsm.config.WALArchive != nil {
+		if archivedPath, err = lsm.archiveWAL(walPath); err != nil {
+			lsm.config.FS.Remove(tmpPath)
+			if reopened, reopenErr := openWAL(lsm.config.FS, walPath, lsm.config.WALCompression); reopenErr == nil {
+				lsm.wal = reopened
+			}
+			return err
+		}
+	}
+	if err := lsm.config.FS.Rename(tmpPath, walPath); err != nil {
+		if archivedPath != "" && lsm.config.FS.Rename(archivedPath, walPath) != nil {
+			// With neither in place, writes fail until the next open
+			// finds the replacement and puts it in place
+			return err
+		}
+		lsm.config.FS.Remove(tmpPath)
+		if reopened, reopenErr := openWAL(lsm.config.FS, walPath, lsm.config.WALCompression); reopenErr == nil {
+			lsm.wal = reopened
+		}
+		return err
+	}
+	reopened, err := openWAL(lsm.config.FS, walPath, lsm.config.WALCompression)
+	if err != nil {
+		return err
+	}
+	lsm.wal = reopened
+
+	if archivedPath != "" {
+		select {
+		case lsm.walArchived <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
 
+// compactL0ToL0 merges every current L0 file into one L0 file
+func (lsm *LSM) compactL0ToL0() {
 	lsm.stats.compactCount.Add(1)
+	lsm.stats.stitchCount.Add(1)
+
+	// Snapshot L0 and reserve the output number under lsm.mu, which a
+	// flush holds from taking its number to adding its file: the output
+	// then sorts after every file in the snapshot and before every flush
+	// not in it (see CompactL0ToL0)
+	var l0Files []*SSTable
+	var fileNum uint64
+	lsm.locked(func() error {
+		l0Files = lsm.levels.GetAllSSTables(0)
+		fileNum = atomic.AddUint64(&lsm.nextFileNum, 1) - 1
+		return nil
+	})
+	event := CompactionEvent{Reason: CompactionL0Stitch, Inputs: compactionFiles(0, l0Files), Start: time.Now()}
 
-	l0Files := lsm.levels.GetAllSSTables(0)
-	l1Files := lsm.levels.GetAllSSTables(1)
+	stitched, err := CompactL0ToL0(lsm.config.DataDir, l0Files, fileNum, lsm.compactionOptions(0))
+	if err != nil {
+		log.Printf("Error during L0->L0 compaction: %v", err)
+		lsm.recordCompaction(event, err)
+		lsm.handleCorruption(err)
+		return
+	}
 
-	newL1Files, oldL1Files, err := CompactL0ToL1(lsm.config.DataDir, l0Files, l1Files, &lsm.nextFileNum)
+	var added []*SSTable
+	if stitched != nil {
+		added = []*SSTable{stitched}
+	}
+	err = lsm.locked(func() error {
+		if err := lsm.saveManifest(l0Files, added); err != nil {
+			return err
+		}
+		lsm.levels.ReplaceL0(l0Files, stitched)
+		return nil
+	})
 	if err != nil {
-		log.Printf("Error during L0->L1 compaction: %v", err)
+		log.Printf("Error during L0->L0 compaction: %v", err)
+		lsm.recordCompaction(event, err)
+		DeleteSSTables(added)
 		return
 	}
+	event.Outputs = compactionFiles(0, added)
+	lsm.recordCompaction(event, nil)
 
-	// Update level manager
-	lsm.mu.Lock()
-	for _, sst := range l0Files {
-		lsm.levels.RemoveSSTable(sst, 0)
+	lsm.deleteSSTables(l0Files)
+}
+
+// compactL0ToL1 handles L0→L1 compaction (special case for overlapping
+// files), for the reason given
+func (lsm *LSM) compactL0ToL1(reason CompactionReason) {
+	// L1 unless dynamic level sizing moved the base level down
+	baseLevel := lsm.levels.BaseLevel()
+
+	l0Files := lsm.levels.GetAllSSTables(0)
+	if lsm.trivialMove(0, baseLevel, l0Files, reason) {
+		return
 	}
-	for _, sst := range oldL1Files {
-		lsm.levels.RemoveSSTable(sst, 1)
+
+	lsm.stats.compactCount.Add(1)
+	l1Files := lsm.levels.GetAllSSTables(baseLevel)
+	event := CompactionEvent{Reason: reason, TargetLevel: baseLevel, Start: time.Now()}
+
+	newL1Files, oldL1Files, err := CompactL0ToL1(lsm.config.DataDir, l0Files, l1Files, baseLevel, &lsm.nextFileNum, lsm.compactionOptions(baseLevel))
+	event.Inputs = append(compactionFiles(0, l0Files), compactionFiles(baseLevel, oldL1Files)...)
+	if err != nil {
+		log.Printf("Error during L0->L%d compaction: %v", baseLevel, err)
+		lsm.recordCompaction(event, err)
+		lsm.handleCorruption(err)
+		return
 	}
-	for _, sst := range newL1Files {
-		lsm.levels.AddSSTable(sst, 1)
+
+	// Update level manager
+	err = lsm.locked(func() error {
+		if err := lsm.saveManifest(append(l0Files, oldL1Files...), newL1Files); err != nil {
+			return err
+		}
+		for _, sst := range l0Files {
+			lsm.levels.RemoveSSTable(sst, 0)
+		}
+		for _, sst := range oldL1Files {
+			lsm.levels.RemoveSSTable(sst, baseLevel)
+		}
+		for _, sst := range newL1Files {
+			lsm.levels.AddSSTable(sst, baseLevel)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error during L0->L%d compaction: %v", baseLevel, err)
+		lsm.recordCompaction(event, err)
+		DeleteSSTables(newL1Files)
+		return
 	}
-	lsm.mu.Unlock()
+	event.Outputs = compactionFiles(baseLevel, newL1Files)
+	lsm.recordCompaction(event, nil)
 
 	// Delete old files
-	DeleteSSTables(l0Files)
-	DeleteSSTables(oldL1Files)
+	lsm.deleteSSTables(l0Files)
+	lsm.deleteSSTables(oldL1Files)
 
 }
 
 // compactLevel handles Ln→Ln+1 compaction for levels 1 and above
 func (lsm *LSM) compactLevel(sourceLevel, targetLevel int) {
+	sourceFiles := lsm.levels.PickCompactionFiles(sourceLevel)
+	reason := CompactionLevelSize
+	if lsm.config.TrackTemperature {
+		// Keep hot files up; a cold one may skip levels on the way down
+		sourceFiles = lsm.levels.PickColdestFile(sourceLevel, time.Now())
+		reason = CompactionCold
+		if level := lsm.coldTargetLevel(sourceFiles, targetLevel); level != targetLevel {
+			lsm.stats.coldMoves.Add(1)
+			targetLevel = level
+		}
+	}
+	lsm.compactFiles(sourceLevel, targetLevel, sourceFiles, reason)
+}
+
+// compactFiles merges sourceFiles with the files they overlap in
+// targetLevel, and installs the result in targetLevel. The two levels may
+// be the same, to rewrite files in place.
+func (lsm *LSM) compactFiles(sourceLevel, targetLevel int, sourceFiles []*SSTable, reason CompactionReason) {
+	if lsm.trivialMove(sourceLevel, targetLevel, sourceFiles, reason) {
+		return
+	}
 
 	lsm.stats.compactCount.Add(1)
+	event := CompactionEvent{Reason: reason, SourceLevel: sourceLevel, TargetLevel: targetLevel, Start: time.Now()}
 
-	sourceFiles := lsm.levels.PickCompactionFiles(sourceLevel)
-	targetFiles := lsm.levels.GetAllSSTables(targetLevel)
+	var targetFiles []*SSTable
+	for _, sst := range lsm.levels.GetAllSSTables(targetLevel) {
+		if !slices.Contains(sourceFiles, sst) {
+			targetFiles = append(targetFiles, sst)
+		}
+	}
 
-	newFiles, oldTargetFiles, err := CompactLnToLn1(lsm.config.DataDir, sourceFiles, targetFiles, targetLevel, &lsm.nextFileNum)
+	newFiles, oldTargetFiles, err := CompactLnToLn1(lsm.config.DataDir, sourceFiles, targetFiles, targetLevel, &lsm.nextFileNum, lsm.compactionOptions(targetLevel))
+	event.Inputs = append(compactionFiles(sourceLevel, sourceFiles), compactionFiles(targetLevel, oldTargetFiles)...)
 	if err != nil {
 		log.Printf("Error during L%d->L%d compaction: %v", sourceLevel, targetLevel, err)
+		lsm.recordCompaction(event, err)
+		lsm.handleCorruption(err)
 		return
 	}
 
 	// Update level manager
-	lsm.mu.Lock()
-	for _, sst := range sourceFiles {
-		lsm.levels.RemoveSSTable(sst, sourceLevel)
+	err = lsm.locked(func() error {
+		if err := lsm.saveManifest(append(sourceFiles, oldTargetFiles...), newFiles); err != nil {
+			return err
+		}
+		for _, sst := range sourceFiles {
+			lsm.levels.RemoveSSTable(sst, sourceLevel)
+		}
+		for _, sst := range oldTargetFiles {
+			lsm.levels.RemoveSSTable(sst, targetLevel)
+		}
+		for _, sst := range newFiles {
+			lsm.levels.AddSSTable(sst, targetLevel)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error during L%d->L%d compaction: %v", sourceLevel, targetLevel, err)
+		lsm.recordCompaction(event, err)
+		DeleteSSTables(newFiles)
+		return
+	}
+	event.Outputs = compactionFiles(targetLevel, newFiles)
+	lsm.recordCompaction(event, nil)
+
+	// Delete old files
+	lsm.deleteSSTables(sourceFiles)
+	lsm.deleteSSTables(oldTargetFiles)
+
+}
+
+// trivialMove moves files from sourceLevel down to targetLevel without
+// rewriting them, when none of them overlaps another or a file already in
+// targetLevel, as sequential ingest leaves them. Only the manifest
+// changes: files keep the names they were written under. It reports
+// whether the files were moved; if not, they need a compaction.
+func (lsm *LSM) trivialMove(sourceLevel, targetLevel int, files []*SSTable, reason CompactionReason) bool {
+	if len(files) == 0 || sourceLevel == targetLevel {
+		return false
 	}
-	for _, sst := range oldTargetFiles {
-		lsm.levels.RemoveSSTable(sst, targetLevel)
+
+	bottommost := targetLevel == lsm.levels.NumLevels()-1
+	for i, sst := range files {
+		// A rewrite re-encrypts a file on an old key, and drops the
+		// tombstones of one going to the last level
+		if common.StaleKey(sst.fs, sst.file) {
+			return false
+		}
+		if props := sst.Properties(); bottommost && (!props.Recorded || props.NumTombstones > 0) {
+			return false
+		}
+
+		// Compaction would have cut it into smaller files
+		if target := lsm.config.TargetFileSizeBytes; target > 0 && sst.indexOffset > uint64(target)+blockSize {
+			return false
+		}
+
+		for _, other := range files[:i] {
+			if other.Overlaps(sst.MinKey(), sst.MaxKey()) {
+				return false
+			}
+		}
+		if len(lsm.levels.GetOverlapping(targetLevel, sst.MinKey(), sst.MaxKey())) > 0 {
+			return false
+		}
 	}
-	for _, sst := range newFiles {
-		lsm.levels.AddSSTable(sst, targetLevel)
+
+	event := CompactionEvent{Reason: reason, SourceLevel: sourceLevel, TargetLevel: targetLevel, Move: true, Start: time.Now()}
+	err := lsm.locked(func() error {
+		for _, sst := range files {
+			sst.level = targetLevel
+		}
+		if err := lsm.saveManifest(files, files); err != nil {
+			for _, sst := range files {
+				sst.level = sourceLevel
+			}
+			return err
+		}
+		for _, sst := range files {
+			lsm.levels.RemoveSSTable(sst, sourceLevel)
+			lsm.levels.AddSSTable(sst, targetLevel)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error moving L%d files to L%d: %v", sourceLevel, targetLevel, err)
+		return false
 	}
-	lsm.mu.Unlock()
+	lsm.stats.trivialMoves.Add(int64(len(files)))
 
-	// Delete old files
-	DeleteSSTables(sourceFiles)
-	DeleteSSTables(oldTargetFiles)
+	event.Inputs = compactionFiles(sourceLevel, files)
+	event.Outputs = compactionFiles(targetLevel, files)
+	lsm.recordCompaction(event, nil)
+	return true
+}
 
+// deleteSSTables deletes files compaction has replaced, through the
+// delete scheduler
+func (lsm *LSM) deleteSSTables(sstables []*SSTable) {
+	for _, sst := range sstables {
+		if err := sst.removeWith(lsm.deleter); err != nil {
+			log.Printf("Warning: failed to delete SSTable %s: %v", sst.Path(), err)
+		}
+	}
+}
+
+// compactionOptions returns the output settings for compacting into
+// targetLevel
+func (lsm *LSM) compactionOptions(targetLevel int) CompactionOptions {
+	return CompactionOptions{
+		TargetFileSize:    lsm.config.TargetFileSizeBytes,
+		MaxSubcompactions: lsm.config.MaxSubcompactions,
+		Bottommost:        targetLevel == lsm.levels.NumLevels()-1,
+		Comparator:        lsm.config.Comparator,
+		FS:                lsm.config.FS,
+		VerifyChecksums:   lsm.config.VerifyChecksumsOnRead,
+		BloomBitsPerKey:   lsm.config.BloomBitsPerKey,
+		UndeleteWindow:    lsm.config.UndeleteWindow,
+		KeepVersions:      lsm.config.KeepVersions,
+		Workers:           lsm.background,
+	}
 }
 
 // triggerNextLevelCompaction triggers compaction for the next level if needed
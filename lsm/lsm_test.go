@@ -1,14 +1,27 @@
 package lsm
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 func setupTestLSM(t *testing.T) (*LSM, func()) {
-	dir := fmt.Sprintf("/tmp/lsm-test-%d", time.Now().UnixNano())
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
 	config := DefaultConfig(dir)
 	config.MemTableSize = 1024 // Small memtable for testing
 
@@ -162,6 +175,128 @@ func TestMemtableFlush(t *testing.T) {
 	t.Logf("L0 has %d files", numL0Files)
 }
 
+// TestFlushStreamsMemtable tests that a flush writes a memtable's entries,
+// tombstones and value pointers included, straight from the memtable
+func TestFlushStreamsMemtable(t *testing.T) {
+	config := DefaultConfig("/lsm-flush")
+	config.FS = common.NewMemFS()
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	memtable := lsm.newMemTable()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		switch i % 10 {
+		case 3:
+			memtable.Delete(key, uint64(i))
+		case 7:
+			memtable.PutValuePointer(key, []byte("pointer"), uint64(i))
+		default:
+			memtable.Put(key, []byte(fmt.Sprintf("value%04d", i)), uint64(i))
+		}
+	}
+	if it := memtable.flushIterator(); &it.entries[0] != &memtable.entries[0] {
+		t.Fatal("Expected the flush iterator to read the memtable's entries in place")
+	}
+
+	lsm.mu.Lock()
+	err = lsm.flushMemtable(memtable)
+	lsm.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	ssts := lsm.levels.GetAllSSTables(0)
+	if len(ssts) != 1 {
+		t.Fatalf("Expected 1 L0 file after the flush, got %d", len(ssts))
+	}
+	it, err := NewSSTableIterator(ssts[0], 0)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	i := 0
+	for entry, ok := it.Next(); ok; entry, ok = it.Next() {
+		want := memtable.entries[i]
+		if entry.Key != want.Key || entry.Deleted != want.Deleted || entry.ValuePointer != want.ValuePointer ||
+			!entry.Deleted && !bytes.Equal(entry.Value, want.Value) {
+			t.Fatalf("Entry %d = %+v, want %+v", i, entry, want)
+		}
+		i++
+	}
+	if i != 1000 {
+		t.Fatalf("Expected 1000 entries flushed, got %d", i)
+	}
+}
+
+// TestFlushTriggers tests flushing small memtables by entry count and by
+// age, and the reason Stats reports for the next flush
+func TestFlushTriggers(t *testing.T) {
+	open := func(t *testing.T, maxEntries int, maxAge time.Duration) *LSM {
+		config := DefaultConfig("/lsm-triggers")
+		config.FS = common.NewMemFS()
+		config.MemTableMaxEntries = maxEntries
+		config.MemTableMaxAge = maxAge
+		lsm, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create LSM: %v", err)
+		}
+		t.Cleanup(func() { lsm.Close() })
+		return lsm
+	}
+	waitForFlush := func(t *testing.T, lsm *LSM) {
+		deadline := time.Now().Add(5 * time.Second)
+		for lsm.levels.NumFiles(0) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Memtable not flushed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("Entries", func(t *testing.T) {
+		lsm := open(t, 10, 0)
+		for i := 0; i < 9; i++ {
+			if err := lsm.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if reason := (&Adapter{lsm: lsm}).Stats().NextFlushReason; reason != FlushReasonEntries {
+			t.Fatalf("Expected the next flush for %q, got %q", FlushReasonEntries, reason)
+		}
+		if lsm.levels.NumFiles(0) != 0 {
+			t.Fatal("Memtable flushed before reaching MemTableMaxEntries")
+		}
+		if err := lsm.Put("key9", []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		waitForFlush(t, lsm)
+	})
+
+	t.Run("Age", func(t *testing.T) {
+		lsm := open(t, 0, 300*time.Millisecond)
+		if reason := lsm.NextFlushReason(); reason != FlushReasonSize {
+			t.Fatalf("Expected an empty memtable's next flush for %q, got %q", FlushReasonSize, reason)
+		}
+		if err := lsm.Put("key", []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if reason := lsm.NextFlushReason(); reason != FlushReasonAge {
+			t.Fatalf("Expected the next flush for %q, got %q", FlushReasonAge, reason)
+		}
+		waitForFlush(t, lsm)
+
+		value, found, err := lsm.Get("key")
+		if err != nil || !found || string(value) != "value" {
+			t.Fatalf("Get after the flush = %q, %v, %v", value, found, err)
+		}
+	})
+}
+
 func TestL0Compaction(t *testing.T) {
 	lsm, cleanup := setupTestLSM(t)
 	defer cleanup()
@@ -217,6 +352,7 @@ func TestRangeScan(t *testing.T) {
 
 	// Scan all keys
 	iter := lsm.Scan("", "")
+	defer iter.Close()
 	var scannedKeys []string
 	for iter.Valid() {
 		scannedKeys = append(scannedKeys, iter.Key())
@@ -276,6 +412,227 @@ func TestTombstones(t *testing.T) {
 	}
 }
 
+func TestUndelete(t *testing.T) {
+	config := DefaultConfig("/lsm-undelete")
+	config.FS = common.NewMemFS()
+	config.NumLevels = 2
+	config.MaxL0Files = 100 // Compactions are run by hand below
+	config.UndeleteWindow = time.Hour
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for _, key := range []string{"key0", "key1", "key2", "missing"} {
+		if err := lsm.Delete(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	expectUndelete := func(key string, want error) {
+		t.Helper()
+		if err := lsm.Undelete(key); !errors.Is(err, want) {
+			t.Fatalf("Undelete %s: expected %v, got %v", key, want, err)
+		}
+	}
+	expectValue := func(key, expected string) {
+		t.Helper()
+		if value, found, err := lsm.Get(key); err != nil || !found || string(value) != expected {
+			t.Fatalf("Get %s: expected %s, got %q found=%v err=%v", key, expected, value, found, err)
+		}
+	}
+
+	expectUndelete("key0", nil)
+	expectValue("key0", "value0")
+	expectUndelete("key0", common.ErrKeyNotFound)    // Not deleted
+	expectUndelete("key9", common.ErrKeyNotFound)    // Never deleted
+	expectUndelete("missing", common.ErrKeyNotFound) // Held no value
+
+	// The tombstones are flushed and merged into the last level, which
+	// keeps those retaining a value
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	lsm.compactL0ToL1(CompactionL0Files)
+	tombstones := func() int64 {
+		var n int64
+		for _, sst := range lsm.levels.GetAllSSTables(1) {
+			n += sst.Properties().NumTombstones
+		}
+		return n
+	}
+	if n := tombstones(); n != 2 {
+		t.Fatalf("Expected the 2 tombstones retaining a value kept in the last level, got %d", n)
+	}
+	if _, found, _ := lsm.Get("key2"); found {
+		t.Fatal("Expected key2 still deleted")
+	}
+	expectUndelete("key1", nil)
+	expectValue("key1", "value1")
+
+	// Past the window, a tombstone no longer restores its value, and
+	// compaction drops it
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	config.UndeleteWindow = time.Millisecond
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	expectUndelete("key2", common.ErrKeyNotFound)
+	lsm.compactL0ToL1(CompactionL0Files)
+	if n := tombstones(); n != 0 {
+		t.Fatalf("Expected the expired tombstone dropped, %d remain", n)
+	}
+	expectValue("key1", "value1")
+	if _, found, _ := lsm.Get("key2"); found {
+		t.Fatal("Expected key2 still deleted after compaction")
+	}
+}
+
+func TestKeepVersions(t *testing.T) {
+	config := DefaultConfig("/lsm-versions")
+	config.FS = common.NewMemFS()
+	config.NumLevels = 2
+	config.MaxL0Files = 100 // Compactions are run by hand below
+	config.KeepVersions = 3
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+	flush := func() {
+		lsm.mu.Lock()
+		lsm.immutableMemtable, lsm.activeMemtable = lsm.activeMemtable, lsm.newMemTable()
+		lsm.mu.Unlock()
+		lsm.flushImmutable()
+	}
+
+	// Each round writes every key again, and is flushed to its own L0
+	// file. Enough keys are written to fill many blocks.
+	const rounds, keys = 4, 300
+	seqs := make([]uint64, rounds) // Of key000 in each round
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			value := fmt.Sprintf("%s-round%d-%040d", key, round, i)
+			if err := lsm.Put(key, []byte(value)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		_, seqs[round], _, _ = lsm.GetWithMeta("key000")
+		flush()
+	}
+
+	// deleted is deleted after a write, undeleted deleted before one, and
+	// absent only deleted
+	for _, op := range []struct {
+		key    string
+		delete bool
+	}{{"deleted", false}, {"deleted", true}, {"undeleted", true}, {"undeleted", false}, {"absent", true}} {
+		if op.delete {
+			err = lsm.Delete(op.key)
+		} else {
+			err = lsm.Put(op.key, []byte(op.key))
+		}
+		if err != nil {
+			t.Fatalf("Write of %s failed: %v", op.key, err)
+		}
+	}
+
+	expectVersions := func(key string, expected ...string) {
+		t.Helper()
+		versions, err := lsm.VersionsOf(key)
+		if err != nil {
+			t.Fatalf("VersionsOf %s failed: %v", key, err)
+		}
+		var got []string
+		for _, v := range versions {
+			if v.Deleted {
+				got = append(got, "deleted")
+			} else {
+				got = append(got, string(v.Value))
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("VersionsOf %s: expected %v, got %v", key, expected, got)
+		}
+	}
+	round := func(i, round int) string {
+		return fmt.Sprintf("key%03d-round%d-%040d", i, round, i)
+	}
+	check := func(deletes ...string) {
+		t.Helper()
+		for i := 0; i < keys; i += 7 {
+			key := fmt.Sprintf("key%03d", i)
+			expectVersions(key, round(i, 3), round(i, 2), round(i, 1))
+			if value, found, err := lsm.Get(key); err != nil || !found || string(value) != round(i, 3) {
+				t.Fatalf("Get %s: got %q found=%v err=%v", key, value, found, err)
+			}
+		}
+
+		// As of a round's write, and between two
+		for r, expected := range map[int]string{3: round(0, 3), 2: round(0, 2), 1: round(0, 1)} {
+			if value, found, err := lsm.GetVersion("key000", seqs[r]); err != nil || !found || string(value) != expected {
+				t.Fatalf("GetVersion as of round %d: got %q found=%v err=%v", r, value, found, err)
+			}
+			if value, _, _ := lsm.GetVersion("key000", seqs[r]+1); r < 3 && string(value) != expected {
+				t.Fatalf("GetVersion after round %d: got %q", r, value)
+			}
+		}
+		if _, found, err := lsm.GetVersion("key000", seqs[0]); err != nil || found {
+			t.Fatalf("Expected round 0 no longer kept, found=%v err=%v", found, err)
+		}
+
+		expectVersions("deleted", "deleted", "deleted")
+		if _, found, _ := lsm.Get("deleted"); found {
+			t.Fatal("Expected deleted to stay deleted")
+		}
+		_, seq, _, _ := lsm.GetWithMeta("undeleted")
+		if value, found, _ := lsm.GetVersion("deleted", seq); found {
+			t.Fatalf("GetVersion of deleted after its delete: got %q", value)
+		}
+		expectVersions("undeleted", append([]string{"undeleted"}, deletes...)...)
+		expectVersions("absent", deletes...)
+		expectVersions("never")
+	}
+
+	// Close flushes the memtable, and the WAL replayed on reopening holds
+	// the same writes again; then they are in two L0 files. Compacted into
+	// the last level, tombstones hiding nothing are dropped.
+	check("deleted")
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	check("deleted")
+	flush()
+	check("deleted")
+	lsm.compactL0ToL1(CompactionL0Files)
+	if n := len(lsm.levels.GetAllSSTables(0)); n != 0 {
+		t.Fatalf("Expected L0 compacted, %d files left", n)
+	}
+	check()
+
+	if _, seq, _, _ := lsm.GetWithMeta("key000"); seq != seqs[3] {
+		t.Fatalf("Expected GetWithMeta to report the sequence number of the write, %d, got %d", seqs[3], seq)
+	}
+}
+
 func TestConcurrentWrites(t *testing.T) {
 	lsm, cleanup := setupTestLSM(t)
 	defer cleanup()
@@ -325,3 +682,2402 @@ func TestConcurrentWrites(t *testing.T) {
 
 	t.Logf("Successfully wrote and verified %d keys", 10*50)
 }
+
+// TestReadYourWrites tests that a Get, Has or Scan on the goroutine that
+// made a write sees it, while flushes swap memtables and compactions
+// replace SSTables underneath
+func TestReadYourWrites(t *testing.T) {
+	config := DefaultConfig("/lsm-ryw")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 1024 // A flush every few writes
+	config.MaxL0Files = 2
+	config.ValueThreshold = 64
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	// Stats reads the memtables too
+	stop := make(chan struct{})
+	statsDone := make(chan struct{})
+	go func() {
+		defer close(statsDone)
+		adapter := &Adapter{lsm: lsm}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				adapter.Stats()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-statsDone
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				// Overwrite a few keys, so older versions sit below the new
+				// one, some with values in the value log
+				key := fmt.Sprintf("key%02d%02d", id, i%20)
+				value := []byte(fmt.Sprintf("value%d", i))
+				if i%3 == 0 {
+					value = bytes.Repeat(value, 10)
+				}
+
+				if i%7 == 6 {
+					if err := lsm.Delete(key); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+						t.Errorf("Delete failed: %v", err)
+						return
+					}
+					if found, err := lsm.Has(key); err != nil || found {
+						t.Errorf("Has(%s) after its Delete = %v, %v", key, found, err)
+						return
+					}
+					continue
+				}
+
+				if err := lsm.Put(key, value); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				got, found, err := lsm.Get(key)
+				if err != nil || !found || !bytes.Equal(got, value) {
+					t.Errorf("Get(%s) after its Put = %q, %v, %v, want %q", key, got, found, err, value)
+					return
+				}
+				if i%10 == 0 {
+					it := lsm.Scan(key, key)
+					if !it.Valid() || it.Key() != key || !bytes.Equal(it.Value(), value) {
+						t.Errorf("Scan(%s) after its Put = %q, %q, %v", key, it.Key(), it.Value(), it.Error())
+					}
+					it.Close()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// TestMemTableKeepsNewest tests that a write reaching the memtable after a
+// newer one for the same key, as concurrent writers can, doesn't replace
+// it
+func TestMemTableKeepsNewest(t *testing.T) {
+	mt := NewMemTable(1024)
+	mt.Put("key", []byte("new"), 2)
+	mt.Put("key", []byte("old"), 1)
+	mt.Delete("key", 1)
+	if value, seq, deleted, found := mt.Get("key"); !found || deleted || seq != 2 || string(value) != "new" {
+		t.Fatalf("Get = %q, %d, %v, %v, want the write with sequence 2", value, seq, deleted, found)
+	}
+
+	mt.Delete("key", 3)
+	if _, _, deleted, _ := mt.Get("key"); !deleted {
+		t.Fatal("Expected a newer Delete to replace the write")
+	}
+}
+
+// TestConditionalWrites tests PutIf and CompareAndSwap against keys in
+// memtables, in SSTables and in the value log
+func TestConditionalWrites(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-cas")
+	config.FS = fs
+	config.ValueThreshold = 64
+	open := func() *LSM {
+		lsm, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create LSM: %v", err)
+		}
+		return lsm
+	}
+	lsm := open()
+	defer func() { lsm.Close() }()
+
+	if err := lsm.PutIf("key", []byte("v1"), 0); err != nil {
+		t.Fatalf("PutIf of a missing key failed: %v", err)
+	}
+	if err := lsm.PutIf("key", []byte("v2"), 0); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("Expected ErrConflict writing an existing key as missing, got %v", err)
+	}
+	_, seq, found, err := lsm.GetWithMeta("key")
+	if err != nil || !found || seq == 0 {
+		t.Fatalf("GetWithMeta = %d, %v, %v", seq, found, err)
+	}
+	if err := lsm.PutIf("key", []byte("v2"), seq); err != nil {
+		t.Fatalf("PutIf at the current sequence failed: %v", err)
+	}
+	if err := lsm.PutIf("key", []byte("v3"), seq); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("Expected ErrConflict at a stale sequence, got %v", err)
+	}
+
+	// On disk the key has its SSTable's sequence number, which a write
+	// and flush since must change
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	lsm = open()
+	value, seq, found, err := lsm.GetWithMeta("key")
+	if err != nil || !found || string(value) != "v2" {
+		t.Fatalf("GetWithMeta after reopening = %q, %v, %v", value, found, err)
+	}
+	if err := lsm.Put("key", []byte("v2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	lsm = open()
+	if err := lsm.PutIf("key", []byte("v3"), seq); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("Expected ErrConflict after a write was flushed, got %v", err)
+	}
+	if _, seq, _, _ = lsm.GetWithMeta("key"); lsm.PutIf("key", []byte("v3"), seq) != nil {
+		t.Fatal("PutIf at the sequence of a key on disk failed")
+	}
+
+	big := bytes.Repeat([]byte("b"), 100)
+	for _, tc := range []struct {
+		old, value []byte
+		ok         bool
+	}{
+		{[]byte("v2"), []byte("v4"), false},
+		{nil, []byte("v4"), false},
+		{[]byte("v3"), big, true},
+		{[]byte("v3"), []byte("v4"), false},
+		{big, []byte{}, true}, // From the value log
+		{nil, []byte("v5"), false},
+		{[]byte{}, []byte("v5"), true},
+	} {
+		err := lsm.CompareAndSwap("key", tc.old, tc.value)
+		if tc.ok && err != nil || !tc.ok && !errors.Is(err, common.ErrConflict) {
+			t.Fatalf("CompareAndSwap(%.10q, %.10q) = %v, want success %v", tc.old, tc.value, err, tc.ok)
+		}
+	}
+	if err := lsm.CompareAndSwap("missing", nil, []byte("v")); err != nil {
+		t.Fatalf("CompareAndSwap of a missing key failed: %v", err)
+	}
+}
+
+// TestConditionalCounter tests that concurrent read-modify-write loops
+// over PutIf lose no increments while flushes and compactions renumber
+// the key
+func TestConditionalCounter(t *testing.T) {
+	config := DefaultConfig("/lsm-counter")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 1024
+	config.MaxL0Files = 2
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				// Other keys fill memtables so the counter is flushed
+				if err := lsm.Put(fmt.Sprintf("filler%d-%d", id, i), bytes.Repeat([]byte("f"), 50)); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				for {
+					value, seq, _, err := lsm.GetWithMeta("counter")
+					if err != nil {
+						t.Errorf("GetWithMeta failed: %v", err)
+						return
+					}
+					n := 0
+					if value != nil {
+						fmt.Sscan(string(value), &n)
+					}
+					err = lsm.PutIf("counter", []byte(fmt.Sprint(n+1)), seq)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, common.ErrConflict) {
+						t.Errorf("PutIf failed: %v", err)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	value, found, err := lsm.Get("counter")
+	if err != nil || !found || string(value) != "400" {
+		t.Fatalf("Expected the counter at 400, got %q, %v, %v", value, found, err)
+	}
+}
+
+// TestGetMulti reads keys written in order by a concurrent writer, while
+// memtables are flushed and compacted: a snapshot never sees the second
+// write of a round without the first
+func TestGetMulti(t *testing.T) {
+	config := DefaultConfig("/lsm-getmulti")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 1024
+	config.MaxL0Files = 2
+	config.ValueThreshold = 512
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	big := bytes.Repeat([]byte("b"), 1000)
+	if err := lsm.Put("big", big); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	values, err := lsm.GetMulti([]string{"big", "missing"})
+	if err != nil {
+		t.Fatalf("GetMulti failed: %v", err)
+	}
+	if _, ok := values["missing"]; ok || len(values) != 1 || !bytes.Equal(values["big"], big) {
+		t.Fatalf("Expected only big's value from the value log, got %d values", len(values))
+	}
+
+	padding := bytes.Repeat([]byte("p"), 100)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 500; i++ {
+			value := append([]byte(fmt.Sprintf("%06d", i)), padding...)
+			for _, key := range []string{"first", "second"} {
+				if err := lsm.Put(key, value); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+			}
+		}
+		close(done)
+	}()
+
+	round := func(values map[string][]byte, key string) int {
+		value, ok := values[key]
+		if !ok {
+			return 0
+		}
+		n, err := strconv.Atoi(string(value[:6]))
+		if err != nil {
+			t.Fatalf("Bad value %.10q", value)
+		}
+		return n
+	}
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		values, err := lsm.GetMulti([]string{"first", "second"})
+		if err != nil {
+			t.Fatalf("GetMulti failed: %v", err)
+		}
+		if first, second := round(values, "first"), round(values, "second"); first != second && first != second+1 {
+			t.Fatalf("Saw round %d of first with round %d of second", first, second)
+		}
+	}
+	wg.Wait()
+}
+
+// TestPutIfAbsent inserts keys that are in the memtable, on disk, deleted
+// or missing
+func TestPutIfAbsent(t *testing.T) {
+	config := DefaultConfig("/lsm-putifabsent")
+	config.FS = common.NewMemFS()
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	// Flushed by closing
+	for _, key := range []string{"flushed", "deleted"} {
+		if err := lsm.Put(key, []byte("old")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Delete("deleted"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	if err := lsm.Put("active", []byte("old")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	adapter := &Adapter{lsm: lsm}
+	for key, want := range map[string]bool{"active": false, "flushed": false, "deleted": true, "missing": true} {
+		inserted, err := adapter.PutIfAbsent([]byte(key), []byte("new"))
+		if err != nil || inserted != want {
+			t.Fatalf("PutIfAbsent(%s) = %v, %v, expected %v", key, inserted, err, want)
+		}
+		expected := "old"
+		if want {
+			expected = "new"
+		}
+		if value, _, _ := lsm.Get(key); string(value) != expected {
+			t.Fatalf("Expected %s to hold %q, got %q", key, expected, value)
+		}
+	}
+
+	// Racing inserts of one key: exactly one wins
+	var wg sync.WaitGroup
+	var wins atomic.Int32
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inserted, err := lsm.PutIfAbsent("race", []byte("v"))
+			if err != nil {
+				t.Errorf("PutIfAbsent failed: %v", err)
+			}
+			if inserted {
+				wins.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := wins.Load(); n != 1 {
+		t.Fatalf("Expected one insert to win, got %d", n)
+	}
+}
+
+// TestAppend appends to values from several goroutines, in the memtable
+// and the value log, every append landing
+func TestAppend(t *testing.T) {
+	config := DefaultConfig("/lsm-append")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 1024
+	config.ValueThreshold = 256
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := lsm.Append("log", []byte{byte('a' + id)}); err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	value, found, err := lsm.Get("log")
+	if err != nil || !found || len(value) != 400 {
+		t.Fatalf("Expected 400 bytes appended, got %d, %v, %v", len(value), found, err)
+	}
+	for g := 0; g < 4; g++ {
+		if n := bytes.Count(value, []byte{byte('a' + g)}); n != 100 {
+			t.Fatalf("Expected 100 appends from goroutine %d, got %d", g, n)
+		}
+	}
+
+	adapter := &Adapter{lsm: lsm}
+	if err := adapter.Append([]byte("log"), []byte("!")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if value, _, _ := lsm.Get("log"); len(value) != 401 || value[400] != '!' {
+		t.Fatalf("Expected the value to end with the suffix, got %.10q", value[max(len(value)-10, 0):])
+	}
+}
+
+// TestIncr increments a counter from several goroutines while other keys
+// flush it to SSTables, none of which may lose another's increment
+func TestIncr(t *testing.T) {
+	config := DefaultConfig("/lsm-incr")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 1024
+	config.MaxL0Files = 2
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := lsm.Put(fmt.Sprintf("filler%d-%d", id, i), bytes.Repeat([]byte("f"), 50)); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				if _, err := lsm.Incr("counter", 2); err != nil {
+					t.Errorf("Incr failed: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	adapter := &Adapter{lsm: lsm}
+	n, err := adapter.Incr([]byte("counter"), -801)
+	if err != nil || n != -1 {
+		t.Fatalf("Expected the counter at -1, got %d, %v", n, err)
+	}
+	value, found, err := lsm.Get("counter")
+	if err != nil || !found || string(value) != "-1" {
+		t.Fatalf("Expected -1 stored, got %q, %v, %v", value, found, err)
+	}
+
+	if err := lsm.Put("max", []byte(strconv.FormatInt(math.MaxInt64, 10))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := lsm.Incr("max", 1); !errors.Is(err, common.ErrNotCounter) {
+		t.Fatalf("Expected ErrNotCounter on overflow, got %v", err)
+	}
+	if _, err := lsm.Incr("filler0-0", 1); !errors.Is(err, common.ErrNotCounter) {
+		t.Fatalf("Expected ErrNotCounter, got %v", err)
+	}
+}
+
+// TestCloseDuringWrites tests that Close waits for in-flight writes, that
+// every write acknowledged before it survives, and that later operations
+// fail with ErrClosed
+func TestCloseDuringWrites(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 16 * 1024
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	const writers = 8
+	acked := make([]int, writers) // Writes each writer got nil back for
+	done := make(chan struct{})
+	for g := 0; g < writers; g++ {
+		go func(id int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; ; i++ {
+				err := lsm.Put(fmt.Sprintf("key%02d%06d", id, i), []byte(fmt.Sprintf("value%d", i)))
+				if errors.Is(err, common.ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				acked[id]++
+			}
+		}(g)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	for g := 0; g < writers; g++ {
+		<-done
+	}
+
+	if _, _, err := lsm.Get("key00000000"); !errors.Is(err, common.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Get after Close, got %v", err)
+	}
+	if err := lsm.Delete("key00000000"); !errors.Is(err, common.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Delete after Close, got %v", err)
+	}
+	if err := lsm.Scan("", "").Error(); !errors.Is(err, common.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Scan after Close, got %v", err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Errorf("Expected a second Close to do nothing, got %v", err)
+	}
+
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+	for g := 0; g < writers; g++ {
+		for i := 0; i < acked[g]; i++ {
+			key := fmt.Sprintf("key%02d%06d", g, i)
+			if _, found, err := lsm.Get(key); err != nil || !found {
+				t.Fatalf("Acknowledged write %s lost: found=%v, err=%v", key, found, err)
+			}
+		}
+	}
+}
+
+// TestHas tests existence checks against memtables and SSTables, including
+// values kept in the value log
+func TestHas(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-has")
+	config.FS = fs
+	config.ValueThreshold = 64
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	big := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		value := []byte("value")
+		if i%10 == 0 {
+			value = big
+		}
+		if err := lsm.Put(fmt.Sprintf("key%03d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Delete("key050"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	check := func(when string) {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if found, err := lsm.Has(key); err != nil || found != (i != 50) {
+				t.Fatalf("%s: Has(%s): expected %v, got %v err=%v", when, key, i != 50, found, err)
+			}
+		}
+		if found, err := lsm.Has("missing"); err != nil || found {
+			t.Fatalf("%s: Has(missing): expected false, got %v err=%v", when, found, err)
+		}
+	}
+	check("in the memtable")
+
+	// Close flushes the memtable; without the WAL nothing is replayed
+	// into a new one
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+		t.Fatalf("Failed to remove WAL: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	check("in an SSTable")
+}
+
+func TestGetValue(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-getvalue")
+	config.FS = fs
+	config.ValueThreshold = 64
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	big := bytes.Repeat([]byte("v"), 100)
+	want := func(i int) []byte {
+		if i%10 == 0 {
+			return big // In the value log
+		}
+		return []byte(fmt.Sprintf("value%03d", i))
+	}
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%03d", i), want(i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Delete("key050"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	check := func(when string) {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			var got []byte
+			err := lsm.GetValue(key, func(value []byte) error {
+				got = append(got, value...)
+				return nil
+			})
+			if i == 50 {
+				if err != common.ErrKeyNotFound || got != nil {
+					t.Fatalf("%s: GetValue(%s): expected ErrKeyNotFound, got %q err=%v", when, key, got, err)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(got, want(i)) {
+				t.Fatalf("%s: GetValue(%s): expected %q, got %q err=%v", when, key, want(i), got, err)
+			}
+		}
+
+		// fn's error is returned
+		errStop := errors.New("stop")
+		if err := lsm.GetValue("key001", func([]byte) error { return errStop }); err != errStop {
+			t.Fatalf("%s: expected fn's error, got %v", when, err)
+		}
+	}
+	check("in the memtable")
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+		t.Fatalf("Failed to remove WAL: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	check("in an SSTable")
+
+	// Get copies the value out of the pooled block
+	value, found, err := lsm.Get("key001")
+	if err != nil || !found {
+		t.Fatalf("Get failed: found=%v err=%v", found, err)
+	}
+	lsm.GetValue("key002", func([]byte) error { return nil })
+	if string(value) != "value001" {
+		t.Fatalf("Get value changed to %q by a later read", value)
+	}
+}
+
+func TestApproximateSizes(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-sizes")
+	config.FS = fs
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	value := bytes.Repeat([]byte("v"), 50)
+	for i := 0; i < 2000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	ranges := []common.KeyRange{
+		{},
+		{End: []byte("key1000")},
+		{Start: []byte("key1000")},
+		{Start: []byte("key0500"), End: []byte("key0500")},
+		{Start: []byte("zzz")},
+	}
+	within := func(got, want int64) bool {
+		return got >= want*8/10 && got <= want*12/10
+	}
+
+	sizes := lsm.ApproximateSizes(ranges)
+	total := int64(lsm.activeMemtable.Size())
+	if sizes[0].MemoryBytes != total || sizes[0].DiskBytes != 0 {
+		t.Errorf("Whole range in the memtable: expected %d in memory, got %+v", total, sizes[0])
+	}
+	if sizes[1].MemoryBytes+sizes[2].MemoryBytes != total {
+		t.Errorf("Halves should add up to %d, got %+v and %+v", total, sizes[1], sizes[2])
+	}
+	if sizes[3].MemoryBytes != 0 || sizes[4].MemoryBytes != 0 {
+		t.Errorf("Expected empty ranges to take nothing, got %+v and %+v", sizes[3], sizes[4])
+	}
+
+	// Close flushes the memtable; without the WAL nothing is replayed
+	// into a new one
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+		t.Fatalf("Failed to remove WAL: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+
+	sizes = lsm.ApproximateSizes(ranges)
+	total = lsm.levels.GetTotalSize()
+	if !within(sizes[0].DiskBytes, total) || sizes[0].MemoryBytes != 0 {
+		t.Errorf("Whole range on disk: expected about %d, got %+v", total, sizes[0])
+	}
+	for _, size := range sizes[1:3] {
+		if !within(size.DiskBytes, total/2) {
+			t.Errorf("Half the keys: expected about %d, got %+v", total/2, size)
+		}
+	}
+	if sizes[3].DiskBytes != 0 || sizes[4].DiskBytes != 0 {
+		t.Errorf("Expected empty ranges to take nothing, got %+v and %+v", sizes[3], sizes[4])
+	}
+}
+
+func TestL0ReadOrder(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-l0-order")
+	config.FS = fs
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	// Close flushes the memtable; without the WAL nothing is replayed
+	// into a new one, so each call leaves one more SSTable
+	flush := func() {
+		if err := lsm.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+			t.Fatalf("Failed to remove WAL: %v", err)
+		}
+		if lsm, err = New(config); err != nil {
+			t.Fatalf("Failed to reopen LSM: %v", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte("v1")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	flush()
+	lsm.compactL0ToL1(CompactionL0Files)
+
+	// Two L0 files over L1: updates to the first half, then deletes
+	for i := 0; i < 50; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte("v2")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	flush()
+	for _, key := range []string{"key0001", "key0075"} {
+		if err := lsm.Delete(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	flush()
+	if n := len(lsm.levels.GetAllSSTables(0)); n != 2 {
+		t.Fatalf("Expected 2 L0 files, got %d", n)
+	}
+
+	// Neither L0 file's key range holds key0090: the memtable and one
+	// L1 file and block are touched
+	if _, found, err := lsm.Get("key0090"); err != nil || !found {
+		t.Fatalf("Get key0090: found=%v err=%v", found, err)
+	}
+	if readAmp := lsm.stats.readAmp.Mean(); readAmp != 3 {
+		t.Errorf("Expected L0 files skipped by key range, read amplification %.1f", readAmp)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		value, found, err := lsm.Get(key)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", key, err)
+		}
+		switch {
+		case i == 1 || i == 75:
+			if found {
+				t.Errorf("Expected %s deleted, got %s", key, value)
+			}
+		case i < 50:
+			if !found || string(value) != "v2" {
+				t.Errorf("Expected %s from the newest L0 file, got %q found=%v", key, value, found)
+			}
+		default:
+			if !found || string(value) != "v1" {
+				t.Errorf("Expected %s from L1, got %q found=%v", key, value, found)
+			}
+		}
+	}
+}
+
+func TestSequenceAcrossRestart(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-sequence")
+	config.FS = fs
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Delete("key0000"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	last := lsm.sequence
+
+	// Close flushes the memtable; with the WAL gone only the manifest
+	// knows how far the counter got
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+		t.Fatalf("Failed to remove WAL: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	if lsm.sequence != last {
+		t.Fatalf("Expected sequence %d after reopening, got %d", last, lsm.sequence)
+	}
+
+	// Writes in the WAL take it further
+	if err := lsm.Put("key0000", []byte("again")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := lsm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	crashed := fs.CrashClone()
+	config.FS = crashed
+	recovered, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to recover LSM: %v", err)
+	}
+	defer recovered.Close()
+	if recovered.sequence != last+1 {
+		t.Errorf("Expected sequence %d after recovering the WAL, got %d", last+1, recovered.sequence)
+	}
+}
+
+func TestHitLocations(t *testing.T) {
+	lsm, cleanup := setupTestLSM(t)
+	defer cleanup()
+
+	// Write enough data to flush some of it to SSTables
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := lsm.Put(key, []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// Wait for flush to complete
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if _, _, err := lsm.Get(fmt.Sprintf("key%04d", i)); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, err := lsm.Get(fmt.Sprintf("missing%04d", i)); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+
+	hits := lsm.HitLocations()
+	if hits["miss"] != 10 {
+		t.Fatalf("Expected 10 misses, got %d", hits["miss"])
+	}
+
+	var total int64
+	for _, count := range hits {
+		total += count
+	}
+	if total != 110 {
+		t.Fatalf("Expected 110 recorded lookups, got %d", total)
+	}
+
+	var sstableHits int64
+	for level := 0; level < 5; level++ {
+		sstableHits += hits[fmt.Sprintf("L%d", level)]
+	}
+	if sstableHits == 0 {
+		t.Fatal("Expected some hits to be served from SSTables")
+	}
+	t.Logf("Hit locations: %v", hits)
+}
+
+func TestMemoryBudget(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	// Memtable would hold everything; the budget forces early flushes
+	budget := int64(64 * 1024)
+	config := DefaultConfig(dir)
+	config.Memory = common.NewMemoryAccountant(budget)
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	value := make([]byte, 100)
+	for i := 0; i < 5000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// Wait for flushes to complete
+	time.Sleep(200 * time.Millisecond)
+
+	if lsm.stats.flushCount.Load() == 0 {
+		t.Fatal("Expected the memory budget to trigger memtable flushes")
+	}
+	usage := config.Memory.Usage()
+	if usage[common.MemBloom] == 0 || usage[common.MemIndex] == 0 {
+		t.Errorf("Expected bloom and index memory to be charged, got %v", usage)
+	}
+
+	for i := 0; i < 5000; i += 7 {
+		if _, found, err := lsm.Get(fmt.Sprintf("key%05d", i)); err != nil || !found {
+			t.Fatalf("Get key%05d: found=%v err=%v", i, found, err)
+		}
+	}
+
+	lsm.Close()
+	if used := config.Memory.Used(); used != 0 {
+		t.Errorf("Expected all memory released on close, got %d (%v)", used, config.Memory.Usage())
+	}
+}
+
+// TestMemoryByLevel tests that bloom filter and index memory is reported
+// per level, adding up to what is charged, and that BloomBitsPerKey sizes
+// the filters
+func TestMemoryByLevel(t *testing.T) {
+	bloomBytes := func(bitsPerKey int) int64 {
+		config := DefaultConfig("/lsm-memory")
+		config.FS = common.NewMemFS()
+		config.BloomBitsPerKey = bitsPerKey
+
+		lsm, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create LSM: %v", err)
+		}
+		defer lsm.Close()
+		for i := 0; i < 1000; i++ {
+			if err := lsm.Put(fmt.Sprintf("key%05d", i), []byte("value")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := lsm.flushMemtable(lsm.activeMemtable); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+
+		bloom, index := lsm.MemoryByLevel()
+		if len(bloom) != lsm.levels.NumLevels() || len(index) != lsm.levels.NumLevels() {
+			t.Fatalf("Expected every level reported, got bloom=%v index=%v", bloom, index)
+		}
+		if bloom["L0"] == 0 || index["L0"] == 0 {
+			t.Fatalf("Expected the flushed file counted in L0, got bloom=%v index=%v", bloom, index)
+		}
+		usage := lsm.memory.Usage()
+		if bloom["L0"] != usage[common.MemBloom] || index["L0"] != usage[common.MemIndex] {
+			t.Errorf("Expected levels to add up to the charged memory %v, got bloom=%v index=%v", usage, bloom, index)
+		}
+		return bloom["L0"]
+	}
+
+	// 1000 keys at the default ~9.6 bits, and at 4
+	if def, small := bloomBytes(0), bloomBytes(4); def < 1150 || small > 550 {
+		t.Errorf("Expected about 1200 and 500 bytes of bloom filter, got %d and %d", def, small)
+	}
+}
+
+func TestL0Stitching(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 1024 // Small memtable for testing
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	// Build up a large L1, pausing so that each batch gets flushed
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := lsm.Put(key, []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%50 == 49 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	l1Before := make(map[uint64]bool)
+	for _, sst := range lsm.levels.GetAllSSTables(1) {
+		l1Before[sst.FileNum()] = true
+	}
+	if len(l1Before) == 0 {
+		t.Fatal("Expected data in L1")
+	}
+	stitchesBefore := lsm.stats.stitchCount.Load()
+
+	// Small bursts of updates spread across the whole key range
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i += 25 {
+			key := fmt.Sprintf("key%04d", i)
+			if err := lsm.Put(key, []byte(fmt.Sprintf("update%d-%04d", round, i))); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if lsm.stats.stitchCount.Load() == stitchesBefore {
+		t.Fatal("Expected small L0 files to be compacted within L0")
+	}
+	if n := len(lsm.levels.GetAllSSTables(0)); n >= maxL0Files {
+		t.Errorf("Expected L0 to shrink, has %d files", n)
+	}
+	for _, sst := range lsm.levels.GetAllSSTables(1) {
+		if !l1Before[sst.FileNum()] {
+			t.Errorf("Expected L1 untouched, found new file %d", sst.FileNum())
+		}
+	}
+
+	// Stitch whatever is left so L0 holds a single file, then check that
+	// the newest version of every key won the merge
+	lsm.compactL0ToL0()
+	if n := len(lsm.levels.GetAllSSTables(0)); n != 1 {
+		t.Fatalf("Expected L0 stitched into one file, has %d files", n)
+	}
+
+	verify := func(lsm *LSM) {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			expected := fmt.Sprintf("value%04d", i)
+			if i%25 == 0 {
+				expected = fmt.Sprintf("update4-%04d", i)
+			}
+
+			value, found, err := lsm.Get(key)
+			if err != nil || !found {
+				t.Fatalf("Get %s: found=%v err=%v", key, found, err)
+			}
+			if string(value) != expected {
+				t.Fatalf("Key %s: expected %s, got %s", key, expected, value)
+			}
+		}
+	}
+	verify(lsm)
+
+	// Close flushes the memtable behind the stitched file; after a restart
+	// L0 must still be ordered so that stitching again keeps the newest data
+	lsm.Close()
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+	lsm.compactL0ToL0()
+	verify(lsm)
+}
+
+// gateFS holds up opening the next L0 SSTable until open is
+// closed, signalling entered once it is waiting
+type gateFS struct {
+	common.FS
+	armed   atomic.Bool
+	entered chan struct{}
+	open    chan struct{}
+}
+
+func (g *gateFS) OpenFile(name string, flag int, perm os.FileMode) (common.File, error) {
+	if strings.Contains(filepath.Base(name), "L0-") && g.armed.CompareAndSwap(true, false) {
+		close(g.entered)
+		<-g.open
+	}
+	return g.FS.OpenFile(name, flag, perm)
+}
+
+// TestL0StitchDuringFlush tests that a stitch starting while a flush is
+// in progress doesn't order its older data after the flushed file's
+func TestL0StitchDuringFlush(t *testing.T) {
+	fs := &gateFS{FS: common.NewMemFS(), entered: make(chan struct{}), open: make(chan struct{})}
+	config := DefaultConfig("/data")
+	config.FS = fs
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	lsm.PauseCompaction()
+
+	// Freeze the active memtable without waking the flush worker, so the
+	// test runs the flush itself
+	freeze := func() {
+		lsm.mu.Lock()
+		defer lsm.mu.Unlock()
+		lsm.immutableMemtable = lsm.activeMemtable
+		lsm.activeMemtable = lsm.newMemTable()
+	}
+
+	lsm.Put("a", []byte("v1"))
+	freeze()
+	lsm.flushImmutable()
+
+	// Flush a=v2, held up after taking its file number, and stitch L0
+	// meanwhile
+	lsm.Put("a", []byte("v2"))
+	freeze()
+	fs.armed.Store(true)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		lsm.flushImmutable()
+	}()
+	<-fs.entered
+	go func() {
+		defer wg.Done()
+		lsm.compactL0ToL0()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(fs.open)
+	wg.Wait()
+
+	check := func(when string) {
+		t.Helper()
+		value, found, err := lsm.Get("a")
+		if err != nil || !found || string(value) != "v2" {
+			t.Fatalf("Get a %s: got %q, found=%v, err=%v, want v2", when, value, found, err)
+		}
+	}
+	check("after the stitch")
+
+	// The next flush sorts L0 by file number
+	lsm.Put("b", []byte("x"))
+	freeze()
+	lsm.flushImmutable()
+	check("after the next flush")
+
+	lsm.Close()
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+	check("after reopening")
+}
+
+func TestSubcompactions(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 1024 * 1024
+	config.MaxSubcompactions = 4
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	// Enough data for a first L0->L1 compaction with several MB of input
+	value := make([]byte, 1024)
+	numKeys := 6000
+	for i := 0; i < numKeys; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%500 == 499 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// One unsplit merge would write a single file; ranges write their own
+	l1Files := lsm.levels.GetAllSSTables(1)
+	if len(l1Files) < 2 {
+		t.Fatalf("Expected the compaction to be split into several L1 files, got %d", len(l1Files))
+	}
+	for i := 1; i < len(l1Files); i++ {
+		if l1Files[i].MinKey() <= l1Files[i-1].MaxKey() {
+			t.Errorf("L1 files overlap: [%s, %s] and [%s, %s]",
+				l1Files[i-1].MinKey(), l1Files[i-1].MaxKey(), l1Files[i].MinKey(), l1Files[i].MaxKey())
+		}
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if _, found, err := lsm.Get(key); err != nil || !found {
+			t.Fatalf("Get %s: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+func TestBackgroundWorkerLimit(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	// One slot, shared with the test, and sub-compactions that each need it
+	workers := common.NewWorkerLimiter(1, 0)
+	config := DefaultConfig(dir)
+	config.MemTableSize = 1024 * 1024
+	config.MaxSubcompactions = 4
+	config.Workers = workers
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	value := make([]byte, 1024)
+	numKeys := 6000
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := lsm.Put(fmt.Sprintf("key%05d", i), value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if i%500 == 499 {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}
+
+	// While the test holds the slot, a full memtable isn't flushed
+	workers.Acquire()
+	put(0, 1500)
+	time.Sleep(200 * time.Millisecond)
+	if n := lsm.stats.flushCount.Load(); n != 0 {
+		t.Errorf("Expected no flush while the slot is held, got %d", n)
+	}
+	workers.Release()
+
+	// Once it is free, flushes and a split compaction share it in turn
+	put(1500, numKeys)
+	time.Sleep(500 * time.Millisecond)
+	if n := lsm.stats.flushCount.Load(); n == 0 {
+		t.Fatal("Expected flushes once the slot was released")
+	}
+	if l1Files := lsm.levels.GetAllSSTables(1); len(l1Files) < 2 {
+		t.Fatalf("Expected the compaction to be split into several L1 files, got %d", len(l1Files))
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if _, found, err := lsm.Get(key); err != nil || !found {
+			t.Fatalf("Get %s: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+func TestLevelShapeConfig(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 64 * 1024
+	config.TargetFileSizeBytes = 32 * 1024
+	config.LevelSizeMultiplier = 4
+	config.NumLevels = 3
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	if n := lsm.levels.NumLevels(); n != 3 {
+		t.Fatalf("Expected 3 levels, got %d", n)
+	}
+
+	value := make([]byte, 100)
+	for i := 0; i < 5000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%500 == 499 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Compaction output is cut at the target size (plus index and filter)
+	l1Files := lsm.levels.GetAllSSTables(1)
+	if len(l1Files) < 2 {
+		t.Fatalf("Expected compaction output split into several files, got %d", len(l1Files))
+	}
+	for _, sst := range l1Files {
+		if sst.Size() > 2*config.TargetFileSizeBytes {
+			t.Errorf("L1 file %d is %d bytes, target %d", sst.FileNum(), sst.Size(), config.TargetFileSizeBytes)
+		}
+	}
+	lsm.Close()
+
+	// Zero values are taken from the manifest
+	reopen := Config{DataDir: dir, MemTableSize: config.MemTableSize}
+	lsm, err = New(reopen)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	if lsm.config.NumLevels != 3 || lsm.config.LevelSizeMultiplier != 4 || lsm.config.TargetFileSizeBytes != 32*1024 {
+		t.Errorf("Expected settings from manifest, got NumLevels=%d LevelSizeMultiplier=%d TargetFileSizeBytes=%d",
+			lsm.config.NumLevels, lsm.config.LevelSizeMultiplier, lsm.config.TargetFileSizeBytes)
+	}
+	for i := 0; i < 5000; i += 50 {
+		if _, found, err := lsm.Get(fmt.Sprintf("key%05d", i)); err != nil || !found {
+			t.Fatalf("Get key%05d: found=%v err=%v", i, found, err)
+		}
+	}
+	lsm.Close()
+
+	// The number of levels is fixed once the tree exists
+	config.NumLevels = 5
+	if lsm, err := New(config); err == nil {
+		lsm.Close()
+		t.Fatal("Expected reopening with a different NumLevels to fail")
+	}
+}
+
+func TestDynamicLevelBytes(t *testing.T) {
+	lm := NewLevelManager(5, 10)
+	lm.EnableDynamicLevelBytes()
+	if base := lm.BaseLevel(); base != 4 {
+		t.Fatalf("Expected an empty tree to compact L0 into the last level, got base L%d", base)
+	}
+
+	// Targets scale down from the last level until one fits in L1's size
+	lm.mu.Lock()
+	lm.levels[4].size = 100 * levelBaseSize
+	lm.updateTargets()
+	lm.mu.Unlock()
+
+	if base := lm.BaseLevel(); base != 2 {
+		t.Errorf("Expected base level L2, got L%d", base)
+	}
+	expected := []int64{0, 0, levelBaseSize, 10 * levelBaseSize, 100 * levelBaseSize}
+	for level := 1; level < 5; level++ {
+		if target := lm.LevelTarget(level); target != expected[level] {
+			t.Errorf("L%d: expected target %d, got %d", level, expected[level], target)
+		}
+	}
+
+	// L0 may not skip a level that still holds data
+	lm.mu.Lock()
+	lm.levels[1].sstables = append(lm.levels[1].sstables, &SSTable{})
+	lm.updateTargets()
+	lm.mu.Unlock()
+	if base := lm.BaseLevel(); base != 1 {
+		t.Errorf("Expected base level L1 while it holds files, got L%d", base)
+	}
+
+	// End to end: a small tree keeps all its data in the last level
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 1024
+	config.DynamicLevelBytes = true
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%50 == 49 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if lsm.levels.NumFiles(4) == 0 {
+		t.Fatal("Expected L0 to compact into the last level")
+	}
+	for level := 1; level < 4; level++ {
+		if n := lsm.levels.NumFiles(level); n != 0 {
+			t.Errorf("Expected L%d empty, has %d files", level, n)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if _, found, err := lsm.Get(key); err != nil || !found {
+			t.Fatalf("Get %s: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+func TestCompactionScore(t *testing.T) {
+	lm := NewLevelManager(3, 10)
+	fileNum := uint64(0)
+	file := func(minKey, maxKey string, size, tombstones int64) *SSTable {
+		fileNum++
+		return &SSTable{
+			fileNum: fileNum,
+			minKey:  minKey,
+			maxKey:  maxKey,
+			size:    size,
+			compare: newCompareFunc(nil),
+			props:   SSTableProperties{Recorded: true, NumEntries: 100, NumTombstones: tombstones},
+		}
+	}
+
+	// Scores: overlapping a big file 100/1100, no overlap 100/100, half
+	// tombstones over a small overlap 150/200, no tombstones 100/160
+	wide := file("a", "c", 100, 0)
+	free := file("d", "f", 100, 0)
+	deletes := file("g", "i", 100, 50)
+	live := file("x", "z", 100, 0)
+	lm.mu.Lock()
+	lm.levels[1].sstables = []*SSTable{wide, free, deletes, live}
+	lm.levels[2].sstables = []*SSTable{file("a", "c", 1000, 0), file("h", "h", 100, 0), file("y", "y", 60, 0)}
+	lm.mu.Unlock()
+
+	for _, expected := range []*SSTable{free, deletes, live, wide} {
+		picked := lm.PickCompactionFiles(1)
+		if len(picked) != 1 || picked[0] != expected {
+			t.Fatalf("Expected the file starting at %s, got %v", expected.MinKey(), picked)
+		}
+		lm.RemoveSSTable(expected, 1)
+	}
+	if picked := lm.PickCompactionFiles(1); picked != nil {
+		t.Errorf("Expected nothing to pick from an empty level, got %v", picked)
+	}
+}
+
+func TestTrivialMove(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-trivial-move")
+	config.FS = fs
+	config.NumLevels = 3
+	config.MemTableSize = 4 * 1024
+	config.MaxL0Files = 100 // Compactions are run by hand below
+	config.L0StitchMaxBytes = 0
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	// Sequential ingest: each flush covers a range of its own
+	for i := 0; i < 1000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	fileNums := func(level int) map[uint64]bool {
+		nums := make(map[uint64]bool)
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			nums[sst.FileNum()] = true
+		}
+		return nums
+	}
+	// Files flushed so far, some of which the compaction worker may have
+	// moved to L1 already
+	flushed := fileNums(0)
+	for num := range fileNums(1) {
+		flushed[num] = true
+	}
+	if len(flushed) < 2 {
+		t.Fatalf("Expected several flushed files, got %d", len(flushed))
+	}
+
+	lsm.compactL0ToL1(CompactionL0Files)
+	if l1 := fileNums(1); len(l1) != len(flushed) || len(fileNums(0)) != 0 {
+		t.Fatalf("Expected all %d flushed files moved to L1, L1 has %d", len(flushed), len(l1))
+	}
+	for num := range fileNums(1) {
+		if !flushed[num] {
+			t.Errorf("Expected L1 to hold the flushed files, found new file %d", num)
+		}
+	}
+
+	lsm.compactLevel(1, 2)
+	l2 := fileNums(2)
+	if len(l2) != 1 || len(fileNums(1)) != len(flushed)-1 {
+		t.Fatalf("Expected one file moved to L2, got %d", len(l2))
+	}
+	if moves := lsm.stats.trivialMoves.Load(); moves != int64(len(flushed))+1 {
+		t.Errorf("Expected %d trivial moves, got %d", len(flushed)+1, moves)
+	}
+	if n := lsm.stats.compactCount.Load(); n != 0 {
+		t.Errorf("Expected no files rewritten, got %d compactions", n)
+	}
+
+	// An update to a key in L1 overlaps it, so it is merged in
+	if err := lsm.Put("key0500", []byte("updated")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Close flushes the memtable; without the WAL nothing is replayed
+	// into a new one. The manifest has the levels the files were moved to.
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Remove(filepath.Join(config.DataDir, "wal.log")); err != nil {
+		t.Fatalf("Failed to remove WAL: %v", err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	for num := range l2 {
+		if !fileNums(2)[num] {
+			t.Errorf("Expected file %d in L2 after reopening", num)
+		}
+	}
+	if n := len(fileNums(1)); n != len(flushed)-1 {
+		t.Errorf("Expected %d files in L1 after reopening, got %d", len(flushed)-1, n)
+	}
+
+	lsm.compactL0ToL1(CompactionL0Files)
+	if n := lsm.stats.compactCount.Load(); n != 1 {
+		t.Errorf("Expected the overlapping file to be merged, got %d compactions", n)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		expected := fmt.Sprintf("value%04d", i)
+		if i == 500 {
+			expected = "updated"
+		}
+		if value, found, err := lsm.Get(key); err != nil || !found || string(value) != expected {
+			t.Fatalf("Get %s: expected %s, got %q found=%v err=%v", key, expected, value, found, err)
+		}
+	}
+}
+
+func TestSSTableProperties(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	lsm, err := New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := lsm.Delete(fmt.Sprintf("key%04d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	// Close flushes the memtable into a single SSTable
+	lsm.Close()
+	lsm, err = New(DefaultConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	files := lsm.levels.GetAllSSTables(0)
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 SSTable, got %d", len(files))
+	}
+
+	props := files[0].Properties()
+	if !props.Recorded {
+		t.Fatal("Expected properties to be recorded")
+	}
+	if props.NumEntries != 100 || props.NumTombstones != 10 {
+		t.Errorf("Expected 100 entries and 10 tombstones, got %d and %d", props.NumEntries, props.NumTombstones)
+	}
+	if props.RawKeyBytes != 100*7 || props.RawValueBytes != 90*9 {
+		t.Errorf("Expected 700 key bytes and 810 value bytes, got %d and %d", props.RawKeyBytes, props.RawValueBytes)
+	}
+	if props.CreatedAt.Before(start) || props.CreatedAt.After(time.Now()) {
+		t.Errorf("Unexpected creation time %v", props.CreatedAt)
+	}
+}
+
+// reverseComparator orders keys in descending byte order
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string            { return "test.reverse" }
+
+func TestCustomComparator(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 64 * 1024
+	config.TargetFileSizeBytes = 32 * 1024
+	config.Comparator = reverseComparator{}
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	value := make([]byte, 100)
+	for i := 0; i < 3000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%500 == 499 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Files and the ranges between them follow the comparator's order
+	l1Files := lsm.levels.GetAllSSTables(1)
+	if len(l1Files) < 2 {
+		t.Fatalf("Expected compaction into several L1 files, got %d", len(l1Files))
+	}
+	for i, sst := range l1Files {
+		if sst.MinKey() < sst.MaxKey() {
+			t.Errorf("L1 file %d has range [%s, %s], expected descending keys", sst.FileNum(), sst.MinKey(), sst.MaxKey())
+		}
+		if i > 0 && l1Files[i-1].MaxKey() <= sst.MinKey() {
+			t.Errorf("L1 files %d and %d are out of order", l1Files[i-1].FileNum(), sst.FileNum())
+		}
+	}
+	for i := 0; i < 3000; i += 30 {
+		if _, found, err := lsm.Get(fmt.Sprintf("key%05d", i)); err != nil || !found {
+			t.Fatalf("Get key%05d: found=%v err=%v", i, found, err)
+		}
+	}
+	lsm.Close()
+
+	// The comparator is recorded in the manifest
+	if _, err := New(DefaultConfig(dir)); !errors.Is(err, common.ErrComparatorMismatch) {
+		t.Fatalf("Expected ErrComparatorMismatch opening with bytewise order, got %v", err)
+	}
+
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 3000; i += 30 {
+		if _, found, err := lsm.Get(fmt.Sprintf("key%05d", i)); err != nil || !found {
+			t.Fatalf("Get key%05d after reopen: found=%v err=%v", i, found, err)
+		}
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.MemTableSize = 64 * 1024
+	config.ValueThreshold = 512
+	config.ValueLogFileSize = 256 * 1024
+	config.ValueLogGCInterval = time.Hour // GC is run by hand below
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+
+	valueFor := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("v%d-%05d;", version, i)), 100)
+	}
+
+	// Large values are separated, small ones stay inline
+	const numKeys = 1000
+	for i := 0; i < numKeys; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), valueFor(i, 1)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := lsm.Put("small", []byte("inline")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Overwrite every other key, leaving the older files half garbage
+	for i := 0; i < numKeys; i += 2 {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), valueFor(i, 2)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 98 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// The tree holds pointers, not the values
+	var treeBytes int64
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			treeBytes += sst.Size()
+		}
+	}
+	if vlogBytes := lsm.vlog.size(); treeBytes >= vlogBytes/4 {
+		t.Errorf("Expected SSTables (%d bytes) much smaller than the value log (%d bytes)", treeBytes, vlogBytes)
+	}
+
+	check := func(db *LSM) {
+		t.Helper()
+		for i := 0; i < numKeys; i++ {
+			expected := valueFor(i, 1)
+			if i%2 == 0 {
+				expected = valueFor(i, 2)
+			}
+			value, found, err := db.Get(fmt.Sprintf("key%05d", i))
+			if err != nil || !found {
+				t.Fatalf("Get key%05d: found=%v err=%v", i, found, err)
+			}
+			if !bytes.Equal(value, expected) {
+				t.Fatalf("Get key%05d returned the wrong value", i)
+			}
+		}
+		if value, found, err := db.Get("small"); err != nil || !found || string(value) != "inline" {
+			t.Fatalf("Get small: value=%q found=%v err=%v", value, found, err)
+		}
+	}
+	check(lsm)
+
+	// GC rewrites the live half of old files and removes them
+	var reclaimed int64
+	for i := 0; i < 10; i++ {
+		n, err := lsm.RunValueLogGC(0.4)
+		if err != nil {
+			t.Fatalf("RunValueLogGC failed: %v", err)
+		}
+		reclaimed += n
+	}
+	if reclaimed == 0 || lsm.stats.vlogGCCount.Load() == 0 {
+		t.Fatal("Expected value log GC to collect files")
+	}
+	check(lsm)
+
+	// Mostly live files are left alone
+	if n, err := lsm.RunValueLogGC(0.99); err != nil || n != 0 {
+		t.Errorf("Expected no collection at a 0.99 discard ratio, got %d bytes (err %v)", n, err)
+	}
+	lsm.Close()
+
+	lsm, err = New(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+	check(lsm)
+}
+
+func TestTemperature(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lsm-test-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig(dir)
+	config.NumLevels = 4
+	config.MemTableSize = 64 * 1024
+	config.TargetFileSizeBytes = 32 * 1024
+	config.MaxL0Files = 100 // Compactions are run by hand below
+	config.L0StitchMaxBytes = 0
+	config.TrackTemperature = true
+	config.ColdReadRate = 1
+	config.ColdMinAge = time.Nanosecond
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	value := make([]byte, 100)
+	for i := 0; i < 4000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%500 == 499 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	lsm.compactL0ToL1(CompactionL0Files)
+
+	l1Files := lsm.levels.GetAllSSTables(1)
+	if len(l1Files) < 3 {
+		t.Fatalf("Expected several L1 files, got %d", len(l1Files))
+	}
+
+	// Heat up the first file; the rest are never read
+	hot := l1Files[0]
+	hotKey := hot.MinKey()
+	for i := 0; i < 1000; i++ {
+		if _, found, err := lsm.Get(hotKey); err != nil || !found {
+			t.Fatalf("Get %s: found=%v err=%v", hotKey, found, err)
+		}
+	}
+	if hot.Reads() != 1000 {
+		t.Errorf("Expected 1000 reads of the hot file, got %d", hot.Reads())
+	}
+	if got := hot.EstimateKeyReads(hotKey); got < 1000 {
+		t.Errorf("Expected at least 1000 estimated reads of %s, got %d", hotKey, got)
+	}
+
+	temps := lsm.Temperature()
+	if len(temps) != 4 {
+		t.Fatalf("Expected temperatures for 4 levels, got %d", len(temps))
+	}
+	if temps[1].Reads != 1000 || temps[1].ColdFiles != len(l1Files)-1 {
+		t.Errorf("Expected L1 to have 1000 reads and %d cold files, got %+v", len(l1Files)-1, temps[1])
+	}
+
+	// The coldest file moves first, straight past the empty L2
+	cold := l1Files[1]
+	lsm.compactLevel(1, 2)
+	if n := len(lsm.levels.GetAllSSTables(2)); n != 0 {
+		t.Errorf("Expected the cold file to skip L2, found %d files there", n)
+	}
+	l3Files := lsm.levels.GetAllSSTables(3)
+	if len(l3Files) != 1 || l3Files[0].MinKey() != cold.MinKey() {
+		t.Errorf("Expected the file starting at %s in L3, got %d files", cold.MinKey(), len(l3Files))
+	}
+	if lsm.levels.GetAllSSTables(1)[0] != hot {
+		t.Error("Expected the hot file to stay in L1")
+	}
+	if moves := lsm.stats.coldMoves.Load(); moves != 1 {
+		t.Errorf("Expected 1 cold move, got %d", moves)
+	}
+
+	// Compaction outputs inherit the reads of the keys they hold
+	outputs, _, err := CompactLnToLn1(dir, []*SSTable{hot}, nil, 2, &lsm.nextFileNum, lsm.compactionOptions(2))
+	if err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	defer DeleteSSTables(outputs)
+
+	var inherited int64
+	for _, sst := range outputs {
+		inherited += sst.Reads()
+	}
+	if inherited != hot.Reads() {
+		t.Errorf("Expected outputs to inherit %d reads, got %d", hot.Reads(), inherited)
+	}
+	if got := outputs[0].EstimateKeyReads(hotKey); got < 1000 {
+		t.Errorf("Expected at least 1000 inherited reads of %s, got %d", hotKey, got)
+	}
+
+	// Data is intact wherever it landed
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if _, found, err := lsm.Get(key); err != nil || !found {
+			t.Fatalf("Get %s: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+// recordingArchiver keeps the WALs handed to it in memory
+type recordingArchiver struct {
+	mu   sync.Mutex
+	wals []common.ArchivedWAL
+	data [][]byte
+}
+
+func (a *recordingArchiver) ArchiveWAL(ctx context.Context, w common.ArchivedWAL) error {
+	r, err := w.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.wals = append(a.wals, w)
+	a.data = append(a.data, data)
+	return nil
+}
+
+func (a *recordingArchiver) lastSequence() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.wals) == 0 {
+		return 0
+	}
+	return a.wals[len(a.wals)-1].LastSequence
+}
+
+func TestWALArchive(t *testing.T) {
+	fs := common.NewMemFS()
+	archiver := &recordingArchiver{}
+	config := DefaultConfig("/lsm-archive")
+	config.FS = fs
+	config.MemTableSize = 1024
+	config.WALArchive = archiver
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for archiver.lastSequence() < 400 {
+		if time.Now().After(deadline) {
+			t.Fatalf("WALs archived up to %d, want 400", archiver.lastSequence())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Between them the archived WALs hold every write they cover, and
+	// the local copies are gone once archived
+	archiver.mu.Lock()
+	seen := make(map[uint64]bool)
+	for i, w := range archiver.wals {
+		if i > 0 && w.LastSequence < archiver.wals[i-1].LastSequence {
+			t.Errorf("WAL %d archived out of order", i)
+		}
+		path := fmt.Sprintf("/archived-%d.wal", i)
+		file, err := fs.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(archiver.data[i])
+		file.Close()
+		w, err := openWAL(fs, path, false)
+		if err != nil {
+			t.Fatalf("Failed to open archived WAL: %v", err)
+		}
+		entries, err := w.ReadAll()
+		w.Close()
+		if err != nil {
+			t.Fatalf("Failed to read archived WAL: %v", err)
+		}
+		for _, entry := range entries {
+			seen[entry.Sequence] = true
+		}
+	}
+	last := archiver.wals[len(archiver.wals)-1].LastSequence
+	archiver.mu.Unlock()
+	for seq := uint64(1); seq <= last; seq++ {
+		if !seen[seq] {
+			t.Fatalf("Write %d missing from the archive", seq)
+		}
+	}
+	if entries, _ := fs.ReadDir(filepath.Join(config.DataDir, walArchiveDir)); len(entries) != 0 {
+		t.Errorf("%d archived WALs left locally", len(entries))
+	}
+
+	// A crash after the WAL was archived, before its replacement was
+	// renamed into place, leaves only the replacement
+	walPath := filepath.Join(config.DataDir, "wal.log")
+	if err := fs.Rename(walPath, walPath+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if lsm, err = New(config); err != nil {
+		t.Fatalf("Failed to reopen LSM: %v", err)
+	}
+	defer lsm.Close()
+	if lsm.activeMemtable.Len() == 0 {
+		t.Error("Replacement WAL not renamed into place")
+	}
+}
+
+func TestCompactionLog(t *testing.T) {
+	fs := common.NewMemFS()
+	config := DefaultConfig("/lsm-compaction-log")
+	config.FS = fs
+	config.MemTableSize = 4 * 1024
+	config.L0StitchMaxBytes = 0
+	config.CompactionLog = true
+	var mu sync.Mutex
+	var events []CompactionEvent
+	config.OnCompaction = func(event CompactionEvent) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	// Overwrites, so every flush overlaps the others
+	for i := 0; i < 2000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i%200), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	lsm.compactL0ToL1(CompactionL0Files)
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := common.ReadFile(fs, filepath.Join(config.DataDir, compactionLogFile))
+	if err != nil {
+		t.Fatalf("Failed to read compaction log: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(events) == 0 || len(lines) != len(events) {
+		t.Fatalf("Expected a line per compaction, got %d lines for %d compactions", len(lines), len(events))
+	}
+
+	for i, line := range lines {
+		var logged CompactionEvent
+		if err := json.Unmarshal(line, &logged); err != nil {
+			t.Fatalf("Line %d of the compaction log: %v", i, err)
+		}
+		if !logged.Start.Equal(events[i].Start) || logged.BytesWritten != events[i].BytesWritten {
+			t.Errorf("Logged %+v, OnCompaction got %+v", logged, events[i])
+		}
+
+		if logged.Reason != CompactionL0Files || logged.SourceLevel != 0 || logged.Error != "" {
+			t.Errorf("Unexpected compaction: %+v", logged)
+		}
+		var read, written int64
+		for _, f := range logged.Inputs {
+			read += f.Size
+		}
+		for _, f := range logged.Outputs {
+			if f.Level != logged.TargetLevel {
+				t.Errorf("Output %d logged at L%d, compaction into L%d", f.FileNum, f.Level, logged.TargetLevel)
+			}
+			written += f.Size
+		}
+		if logged.Move {
+			read, written = 0, 0
+		}
+		if len(logged.Inputs) == 0 || len(logged.Outputs) == 0 || logged.BytesRead != read || logged.BytesWritten != written {
+			t.Errorf("Inputs and outputs don't add up: %+v", logged)
+		}
+		if logged.Duration <= 0 || logged.Start.IsZero() {
+			t.Errorf("Unexpected timing: %+v", logged)
+		}
+	}
+}
+
+// testSpan is a span recorded by testTracer
+type testSpan struct {
+	name   string
+	parent any // Value of testSpanKey in the context it started in
+	attrs  map[string]any
+	err    error
+	start  time.Time
+	end    time.Time
+}
+
+func (s *testSpan) SetAttributes(attrs ...common.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) End(end time.Time, err error) {
+	s.end, s.err = end, err
+}
+
+type testSpanKey struct{}
+
+// testTracer records the spans started, ended or not
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string, start time.Time) common.Span {
+	span := &testSpan{name: name, parent: ctx.Value(testSpanKey{}), attrs: make(map[string]any), start: start}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mu.Unlock()
+	return span
+}
+
+// named returns the spans named name
+func (tr *testTracer) named(name string) []*testSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var spans []*testSpan
+	for _, span := range tr.spans {
+		if span.name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// TestTracer tests the spans of Puts, Gets, Scans, flushes and
+// compactions
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	config := DefaultConfig("/lsm-tracer")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 4 * 1024
+	config.L0StitchMaxBytes = 0
+	config.Tracer = tracer
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	ctx := context.WithValue(context.Background(), testSpanKey{}, "request")
+	if err := lsm.PutContext(ctx, "key", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, _, err := lsm.GetContext(ctx, "key"); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	lsm.Get("missing")
+	it := lsm.ScanContext(ctx, "", "")
+	if len(tracer.named("lsm.Scan")) != 1 || !tracer.named("lsm.Scan")[0].end.IsZero() {
+		t.Fatal("Expected the Scan span to stay open until the iterator is closed")
+	}
+	it.Close()
+
+	puts := tracer.named("lsm.Put")
+	if len(puts) != 1 || puts[0].parent != "request" || puts[0].attrs["lsm.value_bytes"] != int64(5) || puts[0].end.Before(puts[0].start) {
+		t.Fatalf("Unexpected Put spans: %+v", puts)
+	}
+	gets := tracer.named("lsm.Get")
+	if len(gets) != 2 || gets[0].parent != "request" || gets[0].attrs["lsm.found"] != true || gets[1].parent != nil || gets[1].attrs["lsm.found"] != false {
+		t.Fatalf("Unexpected Get spans: %+v", gets)
+	}
+	if scans := tracer.named("lsm.Scan"); scans[0].parent != "request" || scans[0].end.IsZero() || scans[0].attrs["lsm.sources"] != int64(1) {
+		t.Fatalf("Unexpected Scan span: %+v", scans[0])
+	}
+
+	// Overwrites, so every flush overlaps the others
+	for i := 0; i < 2000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i%200), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	lsm.compactL0ToL1(CompactionL0Files)
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	flushes := tracer.named("lsm.Flush")
+	if len(flushes) == 0 {
+		t.Fatal("Expected flush spans")
+	}
+	for _, span := range flushes {
+		if span.err != nil || span.attrs["lsm.entries"].(int64) == 0 || span.attrs["lsm.bytes_written"].(int64) == 0 {
+			t.Errorf("Unexpected flush span: %+v", span)
+		}
+	}
+	compactions := tracer.named("lsm.Compaction")
+	if len(compactions) == 0 {
+		t.Fatal("Expected compaction spans")
+	}
+	for _, span := range compactions {
+		if span.err != nil || span.attrs["lsm.source_level"] != int64(0) || span.attrs["lsm.input_files"].(int64) == 0 || span.end.Before(span.start) {
+			t.Errorf("Unexpected compaction span: %+v", span)
+		}
+	}
+}
+
+// testLogger records the lines logged
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, args ...any) {
+	l.mu.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+// TestSlowOpLog tests that operations over SlowOpThreshold are logged with
+// what they did
+func TestSlowOpLog(t *testing.T) {
+	logger := &testLogger{}
+	config := DefaultConfig("/lsm-slow")
+	config.FS = common.NewMemFS()
+	config.SlowOpThreshold = time.Nanosecond
+	config.Logger = logger
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	if err := lsm.Put("key", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	lsm.Get("key")
+	lsm.Get("missing")
+	it := lsm.Scan("", "")
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+	}
+	it.Close()
+
+	want := []string{
+		`Warning: slow Put of "key" took `,
+		`(5 byte value)`,
+		`Warning: slow Get of "key" took `,
+		`(found, 1 memtables, 0 SSTables, 0 blocks read)`,
+		`Warning: slow Get of "missing" took `,
+		`(missing, 1 memtables, 0 SSTables, 0 blocks read)`,
+		`Warning: slow Scan of ["", ""] took `,
+		`(1 sources merged, 1 keys returned)`,
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.lines) != 4 {
+		t.Fatalf("Expected 4 lines logged, got %q", logger.lines)
+	}
+	for i, line := range logger.lines {
+		if !strings.HasPrefix(line, want[2*i]) || !strings.HasSuffix(line, want[2*i+1]) {
+			t.Errorf("Line %d = %q, expected %q...%q", i, line, want[2*i], want[2*i+1])
+		}
+	}
+}
+
+// TestPauseCompaction tests that a paused tree only compacts L0 at its
+// emergency cap, and catches up once resumed
+func TestPauseCompaction(t *testing.T) {
+	config := DefaultConfig("/lsm-pause")
+	config.FS = common.NewMemFS()
+	config.MemTableSize = 4 * 1024
+	config.L0StitchMaxBytes = 0
+	config.L0EmergencyFiles = 8
+
+	var mu sync.Mutex
+	var reasons []CompactionReason
+	config.OnCompaction = func(event CompactionEvent) {
+		mu.Lock()
+		reasons = append(reasons, event.Reason)
+		mu.Unlock()
+	}
+
+	lsm, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create LSM: %v", err)
+	}
+	defer lsm.Close()
+
+	lsm.PauseCompaction()
+	if !lsm.CompactionPaused() {
+		t.Fatal("Expected compaction paused")
+	}
+	maxL0 := 0
+	for i := 0; i < 3000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%05d", i), []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+			maxL0 = max(maxL0, lsm.levels.NumFiles(0))
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	paused := append([]CompactionReason(nil), reasons...)
+	mu.Unlock()
+	if maxL0 <= config.MaxL0Files || maxL0 > config.L0EmergencyFiles+1 {
+		t.Errorf("Expected L0 to grow past MaxL0Files up to the cap while paused, peaked at %d", maxL0)
+	}
+	if len(paused) == 0 {
+		t.Fatal("Expected emergency compactions at the L0 cap")
+	}
+	for _, reason := range paused {
+		if reason != CompactionL0Emergency {
+			t.Errorf("Expected only emergency compactions while paused, got %q", reason)
+		}
+	}
+
+	lsm.ResumeCompaction()
+	deadline := time.Now().Add(5 * time.Second)
+	for lsm.levels.NumFiles(0) >= config.MaxL0Files {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected L0 compacted once resumed, has %d files", lsm.levels.NumFiles(0))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3000; i += 97 {
+		key := fmt.Sprintf("key%05d", i)
+		if value, found, err := lsm.Get(key); err != nil || !found || string(value) != fmt.Sprintf("value%05d", i) {
+			t.Errorf("Get(%s) = %q, %v, %v", key, value, found, err)
+		}
+	}
+}
+
+// TestCompactionWindows tests parsing windows and which times they allow
+func TestCompactionWindows(t *testing.T) {
+	night, err := ParseCompactionWindow("22:00-06:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if night.Start != 22*time.Hour || night.End != 6*time.Hour+30*time.Minute {
+		t.Fatalf("Unexpected window %+v", night)
+	}
+	for _, bad := range []string{"22:00", "25:00-01:00", "22:00-6pm"} {
+		if _, err := ParseCompactionWindow(bad); err == nil {
+			t.Errorf("Expected %q rejected", bad)
+		}
+	}
+
+	at := func(hour, minute int) time.Time { return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local) }
+	lsm := &LSM{config: Config{CompactionWindows: []CompactionWindow{night, {Start: 12 * time.Hour, End: 13 * time.Hour}}}}
+	for _, c := range []struct {
+		at      time.Time
+		allowed bool
+	}{
+		{at(23, 0), true},
+		{at(3, 0), true},
+		{at(6, 30), false},
+		{at(12, 15), true},
+		{at(13, 0), false},
+		{at(21, 59), false},
+	} {
+		if got := lsm.compactionAllowed(c.at); got != c.allowed {
+			t.Errorf("compactionAllowed(%s) = %v, want %v", c.at.Format("15:04"), got, c.allowed)
+		}
+	}
+	lsm.PauseCompaction()
+	if lsm.compactionAllowed(at(23, 0)) {
+		t.Error("Expected a paused tree not to compact in a window")
+	}
+}
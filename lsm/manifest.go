@@ -0,0 +1,297 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+const (
+	manifestFile    = "MANIFEST"
+	manifestMagic   = 0x4C534D4D // "LSMM" in hex
+	manifestVersion = 4
+
+	// manifestNoFiles stands in for numFiles until the files are recorded
+	manifestNoFiles = ^uint32(0)
+)
+
+// manifest records the settings that shape the tree on disk, so a reopen
+// with a different configuration can be detected or completed, and the
+// SSTables that make up the tree, so files left behind by a crash can be
+// told apart from live ones, and the last sequence number handed out
+// File format: [magic(4)][version(4)][numLevels(4)][levelSizeMultiplier(4)]
+// [targetFileSizeBytes(8)][comparatorNameSize(2)][comparatorName]
+// [numFiles(4)]{[level(4)][fileNum(8)]}*[lastSequence(8)][crc32(4)]
+// Version 1 files end after targetFileSizeBytes (bytewise comparator);
+// version 2 files end after comparatorName, version 3 after the files.
+type manifest struct {
+	NumLevels           int
+	LevelSizeMultiplier int
+	TargetFileSizeBytes int64
+	ComparatorName      string
+
+	// Files are the live SSTables. HasFiles is false for manifests written
+	// before they were recorded, when every SSTable found counts as live.
+	Files    []liveFile
+	HasFiles bool
+
+	// LastSequence is the sequence number counter when the manifest was
+	// written. The WAL only holds writes since the last flush, so on its
+	// own it can't tell how far the counter got.
+	LastSequence uint64
+}
+
+// liveFile names a live SSTable
+type liveFile struct {
+	Level   int
+	FileNum uint64
+}
+
+// sameSettings reports whether m and other shape the tree the same way
+func (m *manifest) sameSettings(other *manifest) bool {
+	return m.NumLevels == other.NumLevels &&
+		m.LevelSizeMultiplier == other.LevelSizeMultiplier &&
+		m.TargetFileSizeBytes == other.TargetFileSizeBytes &&
+		m.ComparatorName == other.ComparatorName
+}
+
+// readManifest loads the manifest from dataDir; it returns nil if the
+// directory has none yet
+func readManifest(fs common.FS, dataDir string) (*manifest, error) {
+	data, err := common.ReadFile(fs, filepath.Join(dataDir, manifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	if len(data) < 12 {
+		return nil, fmt.Errorf("manifest too small")
+	}
+
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("manifest checksum mismatch")
+	}
+	if binary.LittleEndian.Uint32(body[0:]) != manifestMagic {
+		return nil, fmt.Errorf("invalid manifest magic number")
+	}
+	version := binary.LittleEndian.Uint32(body[4:])
+	if version < 1 || version > manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", version)
+	}
+	if len(body) < 24 {
+		return nil, fmt.Errorf("manifest truncated")
+	}
+
+	m := &manifest{
+		NumLevels:           int(binary.LittleEndian.Uint32(body[8:])),
+		LevelSizeMultiplier: int(binary.LittleEndian.Uint32(body[12:])),
+		TargetFileSizeBytes: int64(binary.LittleEndian.Uint64(body[16:])),
+		ComparatorName:      common.BytewiseComparator.Name(),
+	}
+
+	if version >= 2 {
+		if len(body) < 26 {
+			return nil, fmt.Errorf("manifest truncated")
+		}
+		nameSize := int(binary.LittleEndian.Uint16(body[24:]))
+		if len(body) < 26+nameSize {
+			return nil, fmt.Errorf("manifest truncated")
+		}
+		m.ComparatorName = string(body[26 : 26+nameSize])
+
+		if version >= 3 {
+			pos := 26 + nameSize
+			if len(body) < pos+4 {
+				return nil, fmt.Errorf("manifest truncated")
+			}
+			numFiles := binary.LittleEndian.Uint32(body[pos:])
+			pos += 4
+			if numFiles != manifestNoFiles {
+				if int64(numFiles) > int64((len(body)-pos)/12) {
+					return nil, fmt.Errorf("manifest truncated")
+				}
+				m.Files = make([]liveFile, numFiles)
+				for i := range m.Files {
+					m.Files[i].Level = int(binary.LittleEndian.Uint32(body[pos:]))
+					m.Files[i].FileNum = binary.LittleEndian.Uint64(body[pos+4:])
+					pos += 12
+				}
+				m.HasFiles = true
+			}
+
+			if version >= 4 {
+				if len(body) < pos+8 {
+					return nil, fmt.Errorf("manifest truncated")
+				}
+				m.LastSequence = binary.LittleEndian.Uint64(body[pos:])
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// encodeManifest returns the contents of a manifest file
+func encodeManifest(m *manifest) []byte {
+	filesOffset := 26 + len(m.ComparatorName)
+	sequenceOffset := filesOffset + 4 + 12*len(m.Files)
+	bodySize := sequenceOffset + 8
+	data := make([]byte, bodySize+4)
+	binary.LittleEndian.PutUint32(data[0:], manifestMagic)
+	binary.LittleEndian.PutUint32(data[4:], manifestVersion)
+	binary.LittleEndian.PutUint32(data[8:], uint32(m.NumLevels))
+	binary.LittleEndian.PutUint32(data[12:], uint32(m.LevelSizeMultiplier))
+	binary.LittleEndian.PutUint64(data[16:], uint64(m.TargetFileSizeBytes))
+	binary.LittleEndian.PutUint16(data[24:], uint16(len(m.ComparatorName)))
+	copy(data[26:], m.ComparatorName)
+	numFiles := uint32(len(m.Files))
+	if !m.HasFiles {
+		numFiles = manifestNoFiles
+	}
+	binary.LittleEndian.PutUint32(data[filesOffset:], numFiles)
+	for i, f := range m.Files {
+		pos := filesOffset + 4 + 12*i
+		binary.LittleEndian.PutUint32(data[pos:], uint32(f.Level))
+		binary.LittleEndian.PutUint64(data[pos+4:], f.FileNum)
+	}
+	binary.LittleEndian.PutUint64(data[sequenceOffset:], m.LastSequence)
+	binary.LittleEndian.PutUint32(data[bodySize:], crc32.ChecksumIEEE(data[:bodySize]))
+	return data
+}
+
+// writeManifest atomically replaces the manifest in dataDir
+func writeManifest(fs common.FS, dataDir string, m *manifest) error {
+	data := encodeManifest(m)
+	path := filepath.Join(dataDir, manifestFile)
+	tmpPath := path + ".tmp"
+
+	file, err := fs.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest: %w", err)
+	}
+
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install manifest: %w", err)
+	}
+	return nil
+}
+
+// applyManifest fills unset shape settings in config from the stored
+// manifest (or the defaults for a new tree), checks them against the
+// manifest, and records the result, which it returns along with the live
+// files the stored manifest lists. NumLevels cannot change once data has
+// been written, since files in the removed levels would be unreachable.
+func applyManifest(config Config) (Config, *manifest, error) {
+	stored, err := readManifest(config.FS, config.DataDir)
+	if err != nil {
+		return config, nil, err
+	}
+
+	defaults := DefaultConfig(config.DataDir)
+	if stored != nil {
+		defaults.NumLevels = stored.NumLevels
+		defaults.LevelSizeMultiplier = stored.LevelSizeMultiplier
+		defaults.TargetFileSizeBytes = stored.TargetFileSizeBytes
+	}
+
+	if config.NumLevels == 0 {
+		config.NumLevels = defaults.NumLevels
+	}
+	if config.LevelSizeMultiplier == 0 {
+		config.LevelSizeMultiplier = defaults.LevelSizeMultiplier
+	}
+	if config.TargetFileSizeBytes == 0 {
+		config.TargetFileSizeBytes = defaults.TargetFileSizeBytes
+	}
+
+	if config.NumLevels < 2 {
+		return config, nil, fmt.Errorf("NumLevels must be at least 2, got %d", config.NumLevels)
+	}
+	if config.LevelSizeMultiplier < 2 {
+		return config, nil, fmt.Errorf("LevelSizeMultiplier must be at least 2, got %d", config.LevelSizeMultiplier)
+	}
+	if config.TargetFileSizeBytes < 0 {
+		return config, nil, fmt.Errorf("TargetFileSizeBytes must be positive, got %d", config.TargetFileSizeBytes)
+	}
+	if stored != nil && stored.NumLevels != config.NumLevels {
+		return config, nil, fmt.Errorf("NumLevels %d does not match %d in manifest", config.NumLevels, stored.NumLevels)
+	}
+
+	comparatorName := common.ComparatorName(config.Comparator)
+	if stored != nil && stored.ComparatorName != comparatorName {
+		return config, nil, fmt.Errorf("%w: manifest has %q, config has %q", common.ErrComparatorMismatch, stored.ComparatorName, comparatorName)
+	}
+
+	current := &manifest{
+		NumLevels:           config.NumLevels,
+		LevelSizeMultiplier: config.LevelSizeMultiplier,
+		TargetFileSizeBytes: config.TargetFileSizeBytes,
+		ComparatorName:      comparatorName,
+		HasFiles:            stored == nil, // A new tree has none yet
+	}
+	if stored != nil {
+		current.Files = stored.Files
+		current.HasFiles = stored.HasFiles
+		current.LastSequence = stored.LastSequence
+	}
+	if stored == nil || !stored.sameSettings(current) {
+		if err := writeManifest(config.FS, config.DataDir, current); err != nil {
+			return config, nil, err
+		}
+	}
+
+	return config, current, nil
+}
+
+// saveManifest records the tree's live SSTables in the manifest, with
+// removed taken out and added put in, ahead of making the same change to
+// lsm.levels, along with the sequence number counter. Until it succeeds, the next open treats added as leftovers
+// and keeps removed. Caller must hold lsm.mu for writing.
+func (lsm *LSM) saveManifest(removed, added []*SSTable) error {
+	gone := make(map[uint64]bool, len(removed))
+	for _, sst := range removed {
+		gone[sst.FileNum()] = true
+	}
+
+	files := append([]liveFile(nil), lsm.unopened...)
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			if !gone[sst.FileNum()] {
+				files = append(files, liveFile{Level: level, FileNum: sst.FileNum()})
+			}
+		}
+	}
+	for _, sst := range added {
+		files = append(files, liveFile{Level: sst.Level(), FileNum: sst.FileNum()})
+	}
+
+	m := *lsm.manifest
+	m.Files = files
+	m.HasFiles = true
+	m.LastSequence = atomic.LoadUint64(&lsm.sequence)
+	if err := writeManifest(lsm.config.FS, lsm.config.DataDir, &m); err != nil {
+		return err
+	}
+	lsm.manifest = &m
+	return nil
+}
@@ -1,16 +1,25 @@
 package lsm
 
 import (
+	"slices"
 	"sort"
 	"sync"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 // MemTableEntry represents a single entry in the memtable
 type MemTableEntry struct {
-	Key      string
-	Value    []byte
-	Sequence uint64
-	Deleted  bool
+	Key          string
+	Value        []byte
+	Sequence     uint64
+	Deleted      bool
+	ValuePointer bool // Value is a pointer into the value log
+
+	// older holds the key's earlier versions kept, newest first (see
+	// MemTable.keepVersions)
+	older []MemTableEntry
 }
 
 // MemTable is an in-memory sorted structure for storing recent writes
@@ -20,6 +29,15 @@ type MemTable struct {
 	entries []MemTableEntry
 	size    int // Approximate size in bytes
 	maxSize int // Maximum size before flush
+	compare compareFunc
+	first   time.Time // Of the first write, zero while empty
+	maxSeq  uint64    // Highest sequence number written
+
+	// keepVersions is Config.KeepVersions: above 1, a key's earlier
+	// versions are kept with its newest, up to that many in all
+	keepVersions int
+
+	memory *common.MemoryAccountant // Charged as size changes (optional)
 }
 
 // NewMemTable creates a new memtable with the given maximum size
@@ -27,68 +45,132 @@ func NewMemTable(maxSize int) *MemTable {
 	return &MemTable{
 		entries: make([]MemTableEntry, 0, 1024),
 		maxSize: maxSize,
+		compare: newCompareFunc(nil),
 	}
 }
 
 // Put inserts a key-value pair with a sequence number
 func (m *MemTable) Put(key string, value []byte, seq uint64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.insert(MemTableEntry{
+		Key:      key,
+		Value:    value,
+		Sequence: seq,
+		Deleted:  false,
+	})
+}
 
-	// Binary search to find insertion point
-	idx := sort.Search(len(m.entries), func(i int) bool {
-		return m.entries[i].Key >= key
+// PutValuePointer inserts a key whose value is stored in the value log
+func (m *MemTable) PutValuePointer(key string, ptr []byte, seq uint64) {
+	m.insert(MemTableEntry{
+		Key:          key,
+		Value:        ptr,
+		Sequence:     seq,
+		ValuePointer: true,
 	})
+}
 
-	entry := MemTableEntry{
+// Delete marks a key as deleted with a tombstone
+func (m *MemTable) Delete(key string, seq uint64) {
+	m.insert(MemTableEntry{
 		Key:      key,
-		Value:    value,
+		Value:    nil,
 		Sequence: seq,
-		Deleted:  false,
+		Deleted:  true,
+	})
+}
+
+// deleteRetaining is Delete for a tombstone retaining the value it
+// deletes (see encodeRetained), nil for none
+func (m *MemTable) deleteRetaining(key string, retained []byte, seq uint64) {
+	m.insert(MemTableEntry{
+		Key:      key,
+		Value:    retained,
+		Sequence: seq,
+		Deleted:  true,
+	})
+}
+
+// insert adds entry, replacing any existing entry for its key unless that
+// one is newer. Concurrent writers take sequence numbers and insert in
+// different orders, so the newest write wins regardless, as on WAL replay.
+func (m *MemTable) insert(entry MemTableEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.first.IsZero() {
+		m.first = time.Now()
 	}
+	m.maxSeq = max(m.maxSeq, entry.Sequence)
+
+	// Binary search to find insertion point
+	idx := sort.Search(len(m.entries), func(i int) bool {
+		return m.compare(m.entries[i].Key, entry.Key) >= 0
+	})
 
 	// If key exists at this position, replace it (same key)
-	if idx < len(m.entries) && m.entries[idx].Key == key {
+	if idx < len(m.entries) && m.entries[idx].Key == entry.Key {
+		if m.keepVersions > 1 {
+			m.addVersion(idx, entry)
+			return
+		}
+		if m.entries[idx].Sequence > entry.Sequence {
+			return
+		}
 		oldSize := len(m.entries[idx].Value)
 		m.entries[idx] = entry
-		m.size += len(value) - oldSize
+		m.grow(len(entry.Value) - oldSize)
 	} else {
 		// Insert at the correct position
 		m.entries = append(m.entries, MemTableEntry{})
 		copy(m.entries[idx+1:], m.entries[idx:])
 		m.entries[idx] = entry
-		m.size += len(key) + len(value) + 16 // key + value + overhead
+		m.grow(len(entry.Key) + len(entry.Value) + 16) // key + value + overhead
 	}
 }
 
-// Delete marks a key as deleted with a tombstone
-func (m *MemTable) Delete(key string, seq uint64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// addVersion adds entry to the versions of the key at idx, keeping the
+// newest keepVersions of them. Caller must hold m.mu.
+func (m *MemTable) addVersion(idx int, entry MemTableEntry) {
+	current := m.entries[idx]
+	versions := make([]MemTableEntry, 0, len(current.older)+2)
+	versions = append(versions, current)
+	versions[0].older = nil
+	versions = append(versions, current.older...)
 
-	// Binary search to find insertion point
-	idx := sort.Search(len(m.entries), func(i int) bool {
-		return m.entries[i].Key >= key
+	// Versions are ordered by sequence number, newest first, whatever
+	// order concurrent writers inserted them in
+	at := sort.Search(len(versions), func(i int) bool {
+		return versions[i].Sequence <= entry.Sequence
 	})
-
-	entry := MemTableEntry{
-		Key:      key,
-		Value:    nil,
-		Sequence: seq,
-		Deleted:  true,
+	delta := len(entry.Value) + 8 // value + sequence number
+	if at < len(versions) && versions[at].Sequence == entry.Sequence {
+		delta -= len(versions[at].Value) + 8
+		versions[at] = entry
+	} else {
+		versions = slices.Insert(versions, at, entry)
 	}
+	for _, dropped := range versions[min(len(versions), m.keepVersions):] {
+		delta -= len(dropped.Value) + 8
+	}
+	versions = versions[:min(len(versions), m.keepVersions)]
 
-	// If key exists at this position, replace it
-	if idx < len(m.entries) && m.entries[idx].Key == key {
-		oldSize := len(m.entries[idx].Value)
-		m.entries[idx] = entry
-		m.size -= oldSize
+	newest := versions[0]
+	newest.older = versions[1:]
+	m.entries[idx] = newest
+	m.grow(delta)
+}
+
+// grow adjusts the size by delta bytes and charges the accountant.
+// Caller must hold m.mu.
+func (m *MemTable) grow(delta int) {
+	m.size += delta
+	if m.memory == nil || delta == 0 {
+		return
+	}
+	if delta > 0 {
+		m.memory.Charge(common.MemMemtable, int64(delta))
 	} else {
-		// Insert tombstone at the correct position
-		m.entries = append(m.entries, MemTableEntry{})
-		copy(m.entries[idx+1:], m.entries[idx:])
-		m.entries[idx] = entry
-		m.size += len(key) + 16 // key + overhead
+		m.memory.Release(common.MemMemtable, int64(-delta))
 	}
 }
 
@@ -100,7 +182,7 @@ func (m *MemTable) Get(key string) ([]byte, uint64, bool, bool) {
 
 	// Binary search
 	idx := sort.Search(len(m.entries), func(i int) bool {
-		return m.entries[i].Key >= key
+		return m.compare(m.entries[i].Key, key) >= 0
 	})
 
 	if idx < len(m.entries) && m.entries[idx].Key == key {
@@ -111,6 +193,22 @@ func (m *MemTable) Get(key string) ([]byte, uint64, bool, bool) {
 	return nil, 0, false, false
 }
 
+// getEntry returns the entry for a key, including tombstones and value
+// pointers
+func (m *MemTable) getEntry(key string) (MemTableEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	idx := sort.Search(len(m.entries), func(i int) bool {
+		return m.compare(m.entries[i].Key, key) >= 0
+	})
+
+	if idx < len(m.entries) && m.entries[idx].Key == key {
+		return m.entries[idx], true
+	}
+	return MemTableEntry{}, false
+}
+
 // Size returns the approximate size in bytes
 func (m *MemTable) Size() int {
 	m.mu.RLock()
@@ -125,7 +223,18 @@ func (m *MemTable) IsFull() bool {
 	return m.size >= m.maxSize
 }
 
-// GetAllEntries returns all entries in sorted order for flushing to disk
+// Age returns how long before now the memtable was first written to, or 0
+// if it is empty
+func (m *MemTable) Age(now time.Time) time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.first.IsZero() {
+		return 0
+	}
+	return now.Sub(m.first)
+}
+
+// GetAllEntries returns a copy of all entries in sorted order
 func (m *MemTable) GetAllEntries() []MemTableEntry {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -136,6 +245,43 @@ func (m *MemTable) GetAllEntries() []MemTableEntry {
 	return entries
 }
 
+// flushIterator returns an iterator over the memtable's entries in place,
+// rather than over a copy as NewMemTableIterator does. Only a memtable no
+// longer written to, as one being flushed, may be iterated this way.
+func (m *MemTable) flushIterator() *MemTableIterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &MemTableIterator{entries: m.entries, index: -1}
+}
+
+// eachVersion calls fn with every version of every key, in key order and
+// each key's newest first, stopping at the first error. Like
+// flushIterator, it reads the entries in place, so the memtable mustn't
+// be written to meanwhile.
+func (m *MemTable) eachVersion(fn func(entry MemTableEntry) error) error {
+	m.mu.RLock()
+	entries := m.entries
+	m.mu.RUnlock()
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+		for _, older := range entry.older {
+			if err := fn(older); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// maxSequence returns the highest sequence number written to the memtable
+func (m *MemTable) maxSequence() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxSeq
+}
+
 // Len returns the number of entries
 func (m *MemTable) Len() int {
 	m.mu.RLock()
@@ -0,0 +1,58 @@
+package lsm
+
+import (
+	"log"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// handleCorruption takes the SSTable a corruption error is about out of
+// the tree and moves its file into quarantine (see common.Quarantine), so
+// reads and compactions carry on with the remaining files. Keys whose
+// newest version was in it then read older versions, or not at all.
+// Errors that don't report corruption in an SSTable are ignored.
+func (lsm *LSM) handleCorruption(err error) {
+	path := common.CorruptPath(err)
+	if path == "" {
+		return
+	}
+
+	lsm.mu.Lock()
+	sst, level := lsm.findSSTable(path)
+	if sst != nil {
+		if err := lsm.saveManifest([]*SSTable{sst}, nil); err != nil {
+			log.Printf("Warning: failed to drop corrupt SSTable from the manifest: %v", err)
+		}
+		lsm.levels.RemoveSSTable(sst, level)
+	}
+	lsm.mu.Unlock()
+	if sst == nil {
+		return // Already quarantined, or not one of ours
+	}
+
+	lsm.corruption.Record(err)
+	log.Printf("Warning: quarantining SSTable: %v", err)
+	sst.quarantine(lsm.config.DataDir, lsm.quarantined)
+}
+
+// quarantined records a file moved into quarantine
+func (lsm *LSM) quarantined(dest string, err error) {
+	if err != nil {
+		log.Printf("Warning: failed to quarantine SSTable: %v", err)
+		return
+	}
+	lsm.corruption.Quarantined(dest)
+}
+
+// findSSTable returns the SSTable in the tree stored at path and its
+// level, or nil. Caller must hold lsm.mu.
+func (lsm *LSM) findSSTable(path string) (*SSTable, int) {
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			if sst.Path() == path {
+				return sst, level
+			}
+		}
+	}
+	return nil, 0
+}
@@ -0,0 +1,139 @@
+package lsm
+
+import (
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// RotateKeys moves the tree onto the key provider's current key, after a
+// new one was made current (see common.KeyRing). The MANIFEST, WAL and
+// value log head are replaced right away. SSTables still encrypted with
+// an older key are rewritten by the compaction worker one at a time, when
+// it has nothing else to do, and value log files by value log GC whatever
+// their garbage ratio. Stats().StaleKeyFiles counts the files left. It
+// does nothing without encryption.
+func (lsm *LSM) RotateKeys() error {
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	if _, ok := lsm.config.FS.(*common.EncryptedFS); !ok {
+		return nil
+	}
+
+	lsm.mu.Lock()
+	err := lsm.saveManifest(nil, nil)
+	if err == nil && lsm.immutableMemtable == nil && lsm.wal.log.StaleKey() {
+		// Otherwise the flush in progress replaces it
+		err = lsm.resetWAL()
+	}
+	lsm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := lsm.vlog.rotateStaleHead(); err != nil {
+		return err
+	}
+
+	select {
+	case lsm.compactionChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rekeyNext rewrites an SSTable still encrypted with an old key, and asks
+// for another round if that made progress. An L0 file goes down with the
+// rest of L0, a file in a lower level is compacted into the next one, and
+// one in the last level is rewritten in place.
+func (lsm *LSM) rekeyNext() {
+	level, sst := lsm.staleSSTable()
+	if sst == nil {
+		return
+	}
+	before := lsm.staleKeyFiles()
+
+	switch last := lsm.levels.NumLevels() - 1; {
+	case level == 0:
+		lsm.compactL0ToL1(CompactionRekey)
+	case level < last:
+		lsm.compactFiles(level, level+1, []*SSTable{sst}, CompactionRekey)
+	default:
+		lsm.compactFiles(level, level, []*SSTable{sst}, CompactionRekey)
+	}
+
+	// A failed rewrite is left for the next compaction to retry
+	if lsm.staleKeyFiles() < before {
+		select {
+		case lsm.compactionChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// staleSSTable returns an SSTable encrypted with an old key and its level,
+// nil if there is none
+func (lsm *LSM) staleSSTable() (int, *SSTable) {
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			if common.StaleKey(sst.fs, sst.file) {
+				return level, sst
+			}
+		}
+	}
+	return 0, nil
+}
+
+// staleKeyFiles counts the SSTables, value log files and WAL still
+// encrypted with an old key
+func (lsm *LSM) staleKeyFiles() int {
+	n := lsm.vlog.staleKeyFiles()
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			if common.StaleKey(sst.fs, sst.file) {
+				n++
+			}
+		}
+	}
+
+	lsm.mu.RLock()
+	if lsm.wal.log.StaleKey() {
+		n++
+	}
+	lsm.mu.RUnlock()
+	return n
+}
+
+// staleKey reports whether a value log file is encrypted with an old key
+func (vl *valueLog) staleKey(fileNum uint32) bool {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+	file, ok := vl.files[fileNum]
+	return ok && common.StaleKey(vl.fs, file)
+}
+
+// staleKeyFiles counts the value log files encrypted with an old key
+func (vl *valueLog) staleKeyFiles() int {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	n := 0
+	for _, file := range vl.files {
+		if common.StaleKey(vl.fs, file) {
+			n++
+		}
+	}
+	return n
+}
+
+// rotateStaleHead starts a new head file if the current one is encrypted
+// with an old key, so GC can rewrite the old one
+func (vl *valueLog) rotateStaleHead() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if vl.head == nil || !common.StaleKey(vl.fs, vl.head) {
+		return nil
+	}
+	return vl.rotate()
+}
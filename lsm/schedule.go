@@ -0,0 +1,112 @@
+package lsm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CompactionWindow is a daily span of local time compaction may run in,
+// as offsets from midnight. A window whose End is before its Start runs
+// past midnight.
+type CompactionWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseCompactionWindow parses a window written "HH:MM-HH:MM", e.g.
+// "22:00-06:00" for the night
+func ParseCompactionWindow(s string) (CompactionWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return CompactionWindow{}, fmt.Errorf("compaction window %q is not HH:MM-HH:MM", s)
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return CompactionWindow{}, fmt.Errorf("compaction window %q: %w", s, err)
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return CompactionWindow{}, fmt.Errorf("compaction window %q: %w", s, err)
+	}
+	return CompactionWindow{Start: start, End: end}, nil
+}
+
+// parseTimeOfDay parses "HH:MM" as an offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether the time of day at is in the window
+func (w CompactionWindow) contains(at time.Time) bool {
+	midnight := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	offset := at.Sub(midnight)
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// compactionWindowCheck is how often the compaction worker looks for a
+// window having opened, to run the compactions deferred until then
+const compactionWindowCheck = time.Minute
+
+// PauseCompaction stops compactions from starting until ResumeCompaction,
+// e.g. for a traffic peak or a backup; one running carries on. Flushes
+// continue, and L0 is still compacted once it reaches L0EmergencyFiles.
+func (lsm *LSM) PauseCompaction() {
+	lsm.compactionPaused.Store(true)
+}
+
+// ResumeCompaction undoes PauseCompaction, and runs the compactions that
+// were held back
+func (lsm *LSM) ResumeCompaction() {
+	if lsm.compactionPaused.Swap(false) {
+		lsm.triggerCompaction()
+	}
+}
+
+// CompactionPaused reports whether compaction is held back, paused or
+// outside every CompactionWindow
+func (lsm *LSM) CompactionPaused() bool {
+	return !lsm.compactionAllowed(time.Now())
+}
+
+// compactionAllowed reports whether compaction may run at now: it isn't
+// paused, and now is in a CompactionWindow if any are set
+func (lsm *LSM) compactionAllowed(now time.Time) bool {
+	if lsm.compactionPaused.Load() {
+		return false
+	}
+	if len(lsm.config.CompactionWindows) == 0 {
+		return true
+	}
+	for _, w := range lsm.config.CompactionWindows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// l0EmergencyFiles returns the L0 file count at which L0 is compacted
+// whether or not compaction is allowed
+func (lsm *LSM) l0EmergencyFiles() int {
+	if lsm.config.L0EmergencyFiles > 0 {
+		return lsm.config.L0EmergencyFiles
+	}
+	return 2 * max(lsm.config.MaxL0Files, 1)
+}
+
+// triggerCompaction wakes the compaction worker, unless it is already
+// due to run
+func (lsm *LSM) triggerCompaction() {
+	select {
+	case lsm.compactionChan <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package lsm
+
+import (
+	"sort"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// ApproximateSizes estimates the space each key range takes, to plan
+// shard splits or page sizes without scanning. The disk estimate sums the
+// data blocks of every SSTable that may hold keys in the range, found from
+// the in-memory block index, plus their share of the file's index and
+// bloom filter; nothing is read from disk. Superseded versions and
+// tombstones not yet compacted away are counted, values moved to the
+// value log are not. The memory estimate sums the memtable entries in the
+// range.
+func (lsm *LSM) ApproximateSizes(ranges []common.KeyRange) []common.RangeSize {
+	lsm.mu.RLock()
+	memtables := []*MemTable{lsm.activeMemtable}
+	if lsm.immutableMemtable != nil {
+		memtables = append(memtables, lsm.immutableMemtable)
+	}
+	lsm.mu.RUnlock()
+
+	var sstables []*SSTable
+	for level := 0; level < lsm.levels.NumLevels(); level++ {
+		sstables = append(sstables, lsm.levels.GetAllSSTables(level)...)
+	}
+
+	sizes := make([]common.RangeSize, len(ranges))
+	for i, r := range ranges {
+		start, end := string(r.Start), string(r.End)
+		for _, m := range memtables {
+			sizes[i].MemoryBytes += m.rangeSize(start, end)
+		}
+		for _, sst := range sstables {
+			sizes[i].DiskBytes += sst.approximateSize(start, end)
+		}
+	}
+	return sizes
+}
+
+// approximateSize estimates the bytes of the file holding keys in
+// [start, end): the data blocks that may hold such keys, scaled up by the
+// file's index, bloom filter and footer
+func (sst *SSTable) approximateSize(start, end string) int64 {
+	if len(sst.index) == 0 || sst.indexOffset == 0 {
+		return 0
+	}
+	if end != "" && sst.compare(start, end) >= 0 {
+		return 0
+	}
+	if start != "" && sst.compare(sst.maxKey, start) < 0 {
+		return 0
+	}
+	if end != "" && sst.compare(sst.minKey, end) >= 0 {
+		return 0
+	}
+
+	// Block i holds keys from its index key up to the next block's
+	first := 0
+	if start != "" {
+		first = sort.Search(len(sst.index), func(i int) bool {
+			return sst.compare(sst.index[i].Key, start) > 0
+		})
+		if first > 0 {
+			first--
+		}
+	}
+	last := len(sst.index)
+	if end != "" {
+		last = sort.Search(len(sst.index), func(i int) bool {
+			return sst.compare(sst.index[i].Key, end) >= 0
+		})
+	}
+	if first >= last {
+		return 0
+	}
+
+	// Blocks are padded on disk, so a block spans up to the next one
+	from := sst.index[first].BlockOffset
+	to := sst.indexOffset
+	if last < len(sst.index) {
+		to = sst.index[last].BlockOffset
+	}
+	if to <= from {
+		return 0
+	}
+	return int64(float64(to-from) * float64(sst.size) / float64(sst.indexOffset))
+}
+
+// rangeSize returns the bytes of the entries with keys in [start, end),
+// counted as Size counts them
+func (m *MemTable) rangeSize(start, end string) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.entries), func(i int) bool {
+		return m.compare(m.entries[i].Key, start) >= 0
+	})
+
+	var n int64
+	for ; i < len(m.entries); i++ {
+		e := m.entries[i]
+		if end != "" && m.compare(e.Key, end) >= 0 {
+			break
+		}
+		n += int64(len(e.Key) + len(e.Value) + 16)
+	}
+	return n
+}
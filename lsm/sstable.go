@@ -1,28 +1,90 @@
 package lsm
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
-	"os"
+	"hash/crc32"
 	"sort"
+	"sync"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
 const (
 	blockSize      = 4096 // 4KB blocks
 	sstableMagic   = 0x5354424C // "STBL" in hex
+	sstableMagicV2 = 0x53544232 // "STB2": index entries carry block checksums
+	sstableMagicV3 = 0x53544233 // "STB3": data blocks end with restart points
+	sstableMagicV4 = 0x53544234 // "STB4": data block keys are delta-encoded
+	sstableMagicV5 = 0x53544235 // "STB5": large data blocks carry entry offsets
+)
+
+// Entry flags, stored in the byte after the key and value sizes of data
+// block entries and WAL records
+const (
+	entryDeleted      = 1 // Tombstone
+	entryValuePointer = 2 // Value is a pointer into the value log
+	entrySequence     = 4 // Value starts with the write's sequence number (8 bytes), as kept versions record it
 )
 
+// sequenceSize is the size of the sequence number of an entry with
+// entrySequence set
+const sequenceSize = 8
+
+// entryFlags encodes an entry's flags byte
+func entryFlags(deleted, valuePointer bool) byte {
+	var flags byte
+	if deleted {
+		flags |= entryDeleted
+	}
+	if valuePointer {
+		flags |= entryValuePointer
+	}
+	return flags
+}
+
 // SSTableEntry represents a single entry in an SSTable
 type SSTableEntry struct {
-	Key      string
-	Value    []byte
-	Deleted  bool
+	Key          string
+	Value        []byte
+	Deleted      bool
+	ValuePointer bool   // Value is a pointer into the value log
+	Sequence     uint64 // Of the write, if recorded (see Config.KeepVersions); 0 if not
+}
+
+// SSTableProperties describes an SSTable's contents. It is recorded when
+// the file is written; files from before properties were added report
+// Recorded false and zero values.
+type SSTableProperties struct {
+	Recorded      bool
+	NumEntries    int64     // Entries including tombstones
+	NumTombstones int64     // Deletion markers
+	RawKeyBytes   int64     // Sum of key lengths
+	RawValueBytes int64     // Sum of value lengths
+	CreatedAt     time.Time // When the file was written
+
+	// MaxSequence is the highest sequence number of the writes the file
+	// holds, 0 in files written before it was recorded
+	MaxSequence uint64
 }
 
+// propertiesSize is the encoded size of SSTableProperties, and
+// propertiesSizeNoSequence that of properties without MaxSequence
+const (
+	propertiesSize           = 48
+	propertiesSizeNoSequence = 40
+)
+
 // IndexEntry maps a key to its block offset
 type IndexEntry struct {
 	Key         string
 	BlockOffset uint64
+
+	// Length and CRC32 of the block, in files written with block checksums
+	BlockSize uint32
+	Checksum  uint32
 }
 
 // SSTable is an immutable sorted file on disk
@@ -32,7 +94,8 @@ type IndexEntry struct {
 // [Bloom Filter]
 // [Footer]
 type SSTable struct {
-	file        *os.File
+	file        common.File
+	fs          common.FS
 	path        string
 	level       int
 	fileNum     uint64
@@ -42,6 +105,26 @@ type SSTable struct {
 	bloomFilter *BloomFilter
 	indexOffset uint64
 	bloomOffset uint64
+	size        int64 // File size in bytes
+	props       SSTableProperties
+	compare     compareFunc
+	heat        *fileHeat // Read tracking (nil unless TrackTemperature)
+
+	// Whether index entries carry block checksums, and how often Get and
+	// Scan check them
+	checksums bool
+	verify    common.ChecksumVerification
+
+	blockFormat  blockFormat
+	compareBytes compareBytesFunc // Of keys in blocks
+
+	// Iterator snapshots referencing the file; Remove defers deleting a
+	// referenced file to the last unref
+	refMu    sync.Mutex
+	refs     int
+	obsolete bool
+	moveAway func()                  // Set by quarantine: replaces deleting the file
+	deleter  *common.DeleteScheduler // Set by removeWith: paces deleting the file
 }
 
 // Footer format: [indexOffset(8)][bloomOffset(8)][metadataOffset(8)][magic(4)]
@@ -49,7 +132,18 @@ const footerSize = 28
 
 // OpenSSTable opens an existing SSTable and loads metadata into memory
 func OpenSSTable(path string, level int, fileNum uint64) (*SSTable, error) {
-	file, err := os.Open(path)
+	return OpenSSTableWithComparator(path, level, fileNum, nil)
+}
+
+// OpenSSTableWithComparator opens an SSTable whose keys are ordered by
+// comparator (nil = bytewise)
+func OpenSSTableWithComparator(path string, level int, fileNum uint64, comparator common.Comparator) (*SSTable, error) {
+	return openSSTable(common.OSFS{}, path, level, fileNum, comparator)
+}
+
+// openSSTable opens an SSTable stored in fs
+func openSSTable(fs common.FS, path string, level int, fileNum uint64, comparator common.Comparator) (*SSTable, error) {
+	file, err := fs.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open sstable: %w", err)
 	}
@@ -64,7 +158,7 @@ func OpenSSTable(path string, level int, fileNum uint64) (*SSTable, error) {
 
 	if fileSize < footerSize {
 		file.Close()
-		return nil, fmt.Errorf("sstable file too small")
+		return nil, common.Corruptf(path, "sstable file too small")
 	}
 
 	// Read footer
@@ -77,14 +171,18 @@ func OpenSSTable(path string, level int, fileNum uint64) (*SSTable, error) {
 
 	// Verify magic number
 	magic := binary.LittleEndian.Uint32(footer[24:])
-	if magic != sstableMagic {
+	if magic != sstableMagic && magic != sstableMagicV2 && magic != sstableMagicV3 && magic != sstableMagicV4 && magic != sstableMagicV5 {
 		file.Close()
-		return nil, fmt.Errorf("invalid sstable magic number")
+		return nil, common.Corruptf(path, "invalid sstable magic number")
 	}
 
 	indexOffset := binary.LittleEndian.Uint64(footer[0:])
 	bloomOffset := binary.LittleEndian.Uint64(footer[8:])
 	metadataOffset := binary.LittleEndian.Uint64(footer[16:])
+	if indexOffset > metadataOffset || metadataOffset > bloomOffset || bloomOffset > uint64(fileSize-footerSize) {
+		file.Close()
+		return nil, common.Corruptf(path, "footer offsets out of range")
+	}
 
 	// Read metadata (minKey and maxKey)
 	metadataSize := bloomOffset - metadataOffset
@@ -96,10 +194,10 @@ func OpenSSTable(path string, level int, fileNum uint64) (*SSTable, error) {
 	}
 
 	// Decode metadata
-	minKey, maxKey, err := decodeMetadata(metadataData)
+	minKey, maxKey, props, err := decodeMetadata(metadataData)
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+		return nil, common.Corruptf(path, "failed to decode metadata: %w", err)
 	}
 
 	// Read index
@@ -112,10 +210,11 @@ func OpenSSTable(path string, level int, fileNum uint64) (*SSTable, error) {
 	}
 
 	// Decode index
-	index, err := decodeIndex(indexData)
+	checksums := magic != sstableMagic
+	index, err := decodeIndex(indexData, checksums)
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to decode index: %w", err)
+		return nil, common.Corruptf(path, "failed to decode index: %w", err)
 	}
 
 	// Read bloom filter
@@ -127,55 +226,103 @@ func OpenSSTable(path string, level int, fileNum uint64) (*SSTable, error) {
 		return nil, fmt.Errorf("failed to read bloom filter: %w", err)
 	}
 	bloomFilter := DecodeBloomFilter(bloomData)
+	if bloomFilter == nil {
+		file.Close()
+		return nil, common.Corruptf(path, "invalid bloom filter")
+	}
+
+	format := blockFormatPlain
+	switch magic {
+	case sstableMagicV3:
+		format = blockFormatRestarts
+	case sstableMagicV4:
+		format = blockFormatDelta
+	case sstableMagicV5:
+		format = blockFormatOffsets
+	}
 
 	return &SSTable{
-		file:        file,
-		path:        path,
-		level:       level,
-		fileNum:     fileNum,
-		minKey:      minKey,
-		maxKey:      maxKey,
-		index:       index,
-		bloomFilter: bloomFilter,
-		indexOffset: indexOffset,
-		bloomOffset: bloomOffset,
+		file:         file,
+		fs:           fs,
+		path:         path,
+		level:        level,
+		fileNum:      fileNum,
+		minKey:       minKey,
+		maxKey:       maxKey,
+		index:        index,
+		bloomFilter:  bloomFilter,
+		indexOffset:  indexOffset,
+		bloomOffset:  bloomOffset,
+		size:         fileSize,
+		props:        props,
+		compare:      newCompareFunc(comparator),
+		checksums:    checksums,
+		blockFormat:  format,
+		compareBytes: newCompareBytesFunc(comparator),
 	}, nil
 }
 
-// decodeMetadata decodes the metadata block containing minKey and maxKey
-// Format: [minKeySize(4)][maxKeySize(4)][minKey][maxKey]
-func decodeMetadata(data []byte) (string, string, error) {
+// decodeMetadata decodes the metadata block containing minKey, maxKey
+// and, in files that have them, the properties
+// Format: [minKeySize(4)][maxKeySize(4)][minKey][maxKey][properties]
+func decodeMetadata(data []byte) (string, string, SSTableProperties, error) {
+	var props SSTableProperties
 	if len(data) < 8 {
-		return "", "", fmt.Errorf("metadata too small")
+		return "", "", props, fmt.Errorf("metadata too small")
 	}
 
 	minKeySize := binary.LittleEndian.Uint32(data[0:])
 	maxKeySize := binary.LittleEndian.Uint32(data[4:])
 
-	if len(data) < 8+int(minKeySize)+int(maxKeySize) {
-		return "", "", fmt.Errorf("metadata truncated")
+	keysEnd := 8 + int(minKeySize) + int(maxKeySize)
+	if len(data) < keysEnd {
+		return "", "", props, fmt.Errorf("metadata truncated")
 	}
 
 	minKey := string(data[8 : 8+minKeySize])
-	maxKey := string(data[8+minKeySize : 8+minKeySize+maxKeySize])
+	maxKey := string(data[8+minKeySize : keysEnd])
+
+	if rest := data[keysEnd:]; len(rest) >= propertiesSizeNoSequence {
+		props = SSTableProperties{
+			Recorded:      true,
+			NumEntries:    int64(binary.LittleEndian.Uint64(rest[0:])),
+			NumTombstones: int64(binary.LittleEndian.Uint64(rest[8:])),
+			RawKeyBytes:   int64(binary.LittleEndian.Uint64(rest[16:])),
+			RawValueBytes: int64(binary.LittleEndian.Uint64(rest[24:])),
+			CreatedAt:     time.Unix(0, int64(binary.LittleEndian.Uint64(rest[32:]))),
+		}
+		if len(rest) >= propertiesSize {
+			props.MaxSequence = binary.LittleEndian.Uint64(rest[40:])
+		}
+	}
 
-	return minKey, maxKey, nil
+	return minKey, maxKey, props, nil
 }
 
-// decodeIndex decodes the index block
+// decodeIndex decodes the index block, whose entries carry block
+// checksums if checksums is set
 // Format: [numEntries(4)][entry1][entry2]...
-// Entry: [keySize(4)][blockOffset(8)][key]
-func decodeIndex(data []byte) ([]IndexEntry, error) {
+// Entry: [keySize(4)][blockOffset(8)][key], or with checksums
+// [keySize(4)][blockOffset(8)][blockSize(4)][crc32(4)][key]
+func decodeIndex(data []byte, checksums bool) ([]IndexEntry, error) {
 	if len(data) < 4 {
 		return nil, fmt.Errorf("index too small")
 	}
 
+	fixedSize := 12
+	if checksums {
+		fixedSize = 20
+	}
+
 	numEntries := binary.LittleEndian.Uint32(data[0:])
+	if uint64(numEntries)*uint64(fixedSize) > uint64(len(data)-4) {
+		return nil, fmt.Errorf("index truncated")
+	}
 	entries := make([]IndexEntry, numEntries)
 
 	offset := 4
 	for i := uint32(0); i < numEntries; i++ {
-		if offset+12 > len(data) {
+		if offset+fixedSize > len(data) {
 			return nil, fmt.Errorf("index truncated")
 		}
 
@@ -183,6 +330,12 @@ func decodeIndex(data []byte) ([]IndexEntry, error) {
 		offset += 4
 		blockOffset := binary.LittleEndian.Uint64(data[offset:])
 		offset += 8
+		var blockSize, checksum uint32
+		if checksums {
+			blockSize = binary.LittleEndian.Uint32(data[offset:])
+			checksum = binary.LittleEndian.Uint32(data[offset+4:])
+			offset += 8
+		}
 
 		if offset+int(keySize) > len(data) {
 			return nil, fmt.Errorf("index truncated")
@@ -194,107 +347,129 @@ func decodeIndex(data []byte) ([]IndexEntry, error) {
 		entries[i] = IndexEntry{
 			Key:         key,
 			BlockOffset: blockOffset,
+			BlockSize:   blockSize,
+			Checksum:    checksum,
 		}
 	}
 
 	return entries, nil
 }
 
-// Get searches for a key in the SSTable
+// Get searches for a key in the SSTable. Values kept in the value log are
+// returned as encoded pointers; LSM.Get resolves them.
 func (sst *SSTable) Get(key string) ([]byte, bool, error) {
+	entry, found, _, err := sst.get(key)
+	return entry.Value, found && !entry.Deleted, err
+}
+
+// get searches for a key and also reports whether a data block was read
+// (false when the bloom filter or index ruled the key out). A tombstone
+// is found, with Deleted set.
+func (sst *SSTable) get(key string) (SSTableEntry, bool, bool, error) {
+	var entry SSTableEntry
+	found, blockRead, err := sst.find(key, func(e SSTableEntry) error {
+		entry = e
+		entry.Value = bytes.Clone(e.Value)
+		return nil
+	})
+	return entry, found, blockRead, err
+}
+
+// blockBuffers holds the buffers find reads data blocks into and the
+// builder builds them in. A block holding one large entry isn't worth
+// keeping.
+var blockBuffers = common.NewBufferPool(16 * blockSize)
+
+// find searches for a key like get, reading its block into a pooled
+// buffer, and calls fn with the entry found. Its Value is a slice of the
+// block, only valid during fn.
+func (sst *SSTable) find(key string, fn func(entry SSTableEntry) error) (found, blockRead bool, err error) {
 	// Check bloom filter first
 	if !sst.bloomFilter.MayContain(key) {
-		return nil, false, nil
+		return false, false, nil
 	}
 
 	// Find the block that might contain the key
 	blockIdx := sort.Search(len(sst.index), func(i int) bool {
-		return sst.index[i].Key > key
+		return sst.compare(sst.index[i].Key, key) > 0
 	})
 
 	// If key is greater than all index keys, check the last block
 	if blockIdx == 0 {
-		return nil, false, nil
+		return false, false, nil
 	}
 	blockIdx--
 
 	// Read the block
 	blockOffset := sst.index[blockIdx].BlockOffset
-	block, err := sst.readBlock(blockOffset)
+	buf := blockBuffers.Get(0)
+	defer blockBuffers.Put(buf)
+	block, err := sst.readBlockInto(*buf, blockIdx, sst.verify.Verify())
 	if err != nil {
-		return nil, false, err
+		return false, true, err
 	}
+	*buf = block
 
 	// Search within the block
-	return searchBlock(block, key)
+	entry, found, err := searchBlock(block, sst.blockFormat, key, sst.compareBytes)
+	if err != nil {
+		return false, true, common.Corruptf(sst.path, "block at offset %d: %w", blockOffset, err)
+	}
+	if !found {
+		return false, true, nil
+	}
+	return true, true, fn(entry)
 }
 
-// readBlock reads a data block from disk
-func (sst *SSTable) readBlock(offset uint64) ([]byte, error) {
-	block := make([]byte, blockSize)
-	n, err := sst.file.ReadAt(block, int64(offset))
-	if err != nil && err.Error() != "EOF" {
-		return nil, err
-	}
-	return block[:n], nil
+// readBlock reads the data block at index position blockIdx from disk,
+// checking its checksum if verify is set and the file has them
+func (sst *SSTable) readBlock(blockIdx int, verify bool) ([]byte, error) {
+	return sst.readBlockInto(nil, blockIdx, verify)
 }
 
-// searchBlock searches for a key within a data block
-// Block format: [numEntries(4)][entry1][entry2]...
-// Entry: [keySize(4)][valueSize(4)][deleted(1)][key][value]
-func searchBlock(block []byte, key string) ([]byte, bool, error) {
-	if len(block) < 4 {
-		return nil, false, nil
+// readBlockInto is readBlock reading into buf if it is large enough
+func (sst *SSTable) readBlockInto(buf []byte, blockIdx int, verify bool) ([]byte, error) {
+	entry := sst.index[blockIdx]
+	offset := entry.BlockOffset
+	if offset >= sst.indexOffset {
+		return nil, common.Corruptf(sst.path, "block offset %d past the data blocks", offset)
 	}
-
-	numEntries := binary.LittleEndian.Uint32(block[0:])
-	offset := 4
-
-	for i := uint32(0); i < numEntries; i++ {
-		if offset+9 > len(block) {
-			return nil, false, fmt.Errorf("block truncated")
+	if !sst.checksums {
+		block := grow(buf, blockSize)
+		n, err := sst.file.ReadAt(block, int64(offset))
+		if err != nil && err.Error() != "EOF" {
+			return nil, err
 		}
+		return block[:n], nil
+	}
 
-		keySize := binary.LittleEndian.Uint32(block[offset:])
-		offset += 4
-		valueSize := binary.LittleEndian.Uint32(block[offset:])
-		offset += 4
-		deleted := block[offset] == 1
-		offset += 1
-
-		if offset+int(keySize)+int(valueSize) > len(block) {
-			return nil, false, fmt.Errorf("block truncated")
-		}
-
-		entryKey := string(block[offset : offset+int(keySize)])
-		offset += int(keySize)
-
-		if entryKey == key {
-			if deleted {
-				return nil, false, nil
-			}
-			value := make([]byte, valueSize)
-			copy(value, block[offset:offset+int(valueSize)])
-			return value, true, nil
-		}
-
-		offset += int(valueSize)
-
-		// Early exit if we've passed the key (block is sorted)
-		if entryKey > key {
-			return nil, false, nil
-		}
+	if offset+uint64(entry.BlockSize) > sst.indexOffset {
+		return nil, common.Corruptf(sst.path, "block at offset %d runs past the data blocks", offset)
+	}
+	block := grow(buf, int(entry.BlockSize))
+	if _, err := sst.file.ReadAt(block, int64(offset)); err != nil {
+		return nil, err
+	}
+	if verify && crc32.ChecksumIEEE(block) != entry.Checksum {
+		return nil, common.Corruptf(sst.path, "block at offset %d: checksum mismatch", offset)
 	}
+	return block, nil
+}
 
-	return nil, false, nil
+// grow returns buf resliced to n bytes, or a new buffer if it is too small
+func grow(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
 }
 
 // Overlaps checks if this SSTable's key range overlaps with [start, end]
 func (sst *SSTable) Overlaps(start, end string) bool {
-	if start != "" && sst.maxKey < start {
+	if start != "" && sst.compare(sst.maxKey, start) < 0 {
 		return false
 	}
-	if end != "" && sst.minKey > end {
+	if end != "" && sst.compare(sst.minKey, end) > 0 {
 		return false
 	}
 	return true
@@ -308,10 +483,129 @@ func (sst *SSTable) Close() error {
 	return nil
 }
 
-// Remove deletes the SSTable file
+// Remove deletes the SSTable file, or marks it for deletion once the
+// iterators that reference it are closed
 func (sst *SSTable) Remove() error {
+	sst.refMu.Lock()
+	if sst.refs > 0 {
+		sst.obsolete = true
+		sst.refMu.Unlock()
+		return nil
+	}
+	sst.refMu.Unlock()
+
+	return sst.retire()
+}
+
+// removeWith is Remove, handing the file to a DeleteScheduler instead of
+// deleting it directly
+func (sst *SSTable) removeWith(deleter *common.DeleteScheduler) error {
+	sst.refMu.Lock()
+	sst.deleter = deleter
+	sst.refMu.Unlock()
+	return sst.Remove()
+}
+
+// quarantine moves the file into the quarantine directory under dataDir
+// (see common.Quarantine) once the iterators that reference it are
+// closed, then calls moved with its new path or the error
+func (sst *SSTable) quarantine(dataDir string, moved func(dest string, err error)) {
+	sst.refMu.Lock()
+	sst.obsolete = true
+	sst.moveAway = func() {
+		moved(common.Quarantine(sst.fs, dataDir, sst.path))
+	}
+	referenced := sst.refs > 0
+	sst.refMu.Unlock()
+
+	if !referenced {
+		sst.retire()
+	}
+}
+
+// retire closes an obsolete file and deletes it, or moves it into
+// quarantine
+func (sst *SSTable) retire() error {
 	sst.Close()
-	return os.Remove(sst.path)
+	sst.refMu.Lock()
+	moveAway := sst.moveAway
+	deleter := sst.deleter
+	sst.refMu.Unlock()
+	if moveAway != nil {
+		moveAway()
+		return nil
+	}
+	if deleter != nil {
+		return deleter.Delete(sst.path)
+	}
+	return sst.fs.Remove(sst.path)
+}
+
+// ref keeps the file readable until the matching unref
+func (sst *SSTable) ref() {
+	sst.refMu.Lock()
+	sst.refs++
+	sst.refMu.Unlock()
+}
+
+// unref releases a reference, deleting the file if it was removed while
+// referenced
+func (sst *SSTable) unref() error {
+	sst.refMu.Lock()
+	sst.refs--
+	remove := sst.refs == 0 && sst.obsolete
+	sst.refMu.Unlock()
+
+	if !remove {
+		return nil
+	}
+	return sst.retire()
+}
+
+// bloomMemory returns the bytes held by the in-memory bloom filter
+func (sst *SSTable) bloomMemory() int64 {
+	if sst.bloomFilter == nil {
+		return 0
+	}
+	return int64(len(sst.bloomFilter.bits))
+}
+
+// indexMemory returns the approximate bytes held by the in-memory block
+// index: key bytes plus string header and offset per entry
+func (sst *SSTable) indexMemory() int64 {
+	n := int64(0)
+	for _, e := range sst.index {
+		n += int64(len(e.Key)) + 16 + 8
+	}
+	return n
+}
+
+// Size returns the file size in bytes
+func (sst *SSTable) Size() int64 {
+	return sst.size
+}
+
+// Properties returns the SSTable's recorded properties
+func (sst *SSTable) Properties() SSTableProperties {
+	return sst.props
+}
+
+// Reads returns how many reads reached one of the SSTable's data blocks
+// (0 unless temperature tracking is enabled)
+func (sst *SSTable) Reads() int64 {
+	if sst.heat == nil {
+		return 0
+	}
+	return sst.heat.reads.Load()
+}
+
+// EstimateKeyReads returns an upper-bound estimate of how many of those
+// reads were for key
+func (sst *SSTable) EstimateKeyReads(key string) int64 {
+	if sst.heat == nil {
+		return 0
+	}
+	return int64(sst.heat.sketch.estimate(key))
 }
 
 // MinKey returns the smallest key in the SSTable
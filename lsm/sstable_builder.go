@@ -3,45 +3,98 @@ package lsm
 import (
 	"encoding/binary"
 	"fmt"
-	"os"
+	"hash/crc32"
+	"math"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
 )
 
-// SSTableBuilder constructs a new SSTable from sorted entries
+// SSTableBuilder constructs a new SSTable from sorted entries. The file
+// is written under a ".tmp" name and only renamed to its final path by
+// Finish, so a crash mid-build never leaves a truncated SSTable behind.
 type SSTableBuilder struct {
-	file         *os.File
+	file         common.File
+	fs           common.FS
 	path         string
 	currentBlock []byte
+	blockBuf     *[]byte  // Pooled buffer currentBlock is built in
+	blockEntries int      // Entries in currentBlock
+	firstKey     string   // Of currentBlock, for the index
+	restarts     []uint32 // Offsets of currentBlock's restart points
+	restartKey   string   // Of the last restart point, for delta encoding
+	offsets      []uint16 // Of currentBlock's entries
 	blockOffset  uint64
 	index        []IndexEntry
 	bloomFilter  *BloomFilter
 	minKey       string
 	maxKey       string
 	numEntries   int
+	props        SSTableProperties
+
+	// format is blockFormatOffsets; tests write older formats to check
+	// they are still read
+	format blockFormat
 }
 
 // NewSSTableBuilder creates a new SSTable builder
 func NewSSTableBuilder(path string, expectedKeys int) (*SSTableBuilder, error) {
-	file, err := os.Create(path)
+	return newSSTableBuilder(common.OSFS{}, path, expectedKeys, 0)
+}
+
+// newSSTableBuilder creates a builder writing to a file in fs, with a bloom
+// filter of bitsPerKey bits per expected key (0 = a 1% false positive rate)
+func newSSTableBuilder(fs common.FS, path string, expectedKeys, bitsPerKey int) (*SSTableBuilder, error) {
+	file, err := fs.Create(path + ".tmp")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create sstable: %w", err)
 	}
 
-	// Create bloom filter with 1% false positive rate
-	bloomFilter := NewBloomFilter(expectedKeys, 0.01)
+	falsePositiveRate := 0.01
+	if bitsPerKey > 0 {
+		falsePositiveRate = bloomFalsePositiveRate(bitsPerKey)
+	}
+	bloomFilter := NewBloomFilter(expectedKeys, falsePositiveRate)
+
+	// Blocks are built in a pooled buffer, with room for their padding
+	blockBuf := blockBuffers.Get(blockSize)
 
 	return &SSTableBuilder{
 		file:         file,
+		fs:           fs,
 		path:         path,
-		currentBlock: make([]byte, 4), // Start with numEntries = 0
+		currentBlock: (*blockBuf)[:4], // Start with numEntries = 0
+		blockBuf:     blockBuf,
 		blockOffset:  0,
 		index:        make([]IndexEntry, 0),
 		bloomFilter:  bloomFilter,
+		format:       blockFormatOffsets,
 	}, nil
 }
 
 // Add adds a key-value pair to the SSTable
 // MUST be called in sorted key order!
 func (b *SSTableBuilder) Add(key string, value []byte, deleted bool) error {
+	return b.add(key, value, entryFlags(deleted, false))
+}
+
+// add adds an entry with the given flags (see entryFlags)
+func (b *SSTableBuilder) add(key string, value []byte, flags byte) error {
+	return b.addVersion(key, value, flags, 0)
+}
+
+// addVersion is add for a version of a key kept for KeepVersions, which
+// records seq, the sequence number of its write (0 = not recorded). A
+// key's versions are added newest first, and kept in one block.
+func (b *SSTableBuilder) addVersion(key string, value []byte, flags byte, seq uint64) error {
+	deleted := flags&entryDeleted != 0
+	valueSize := len(value)
+	if seq != 0 {
+		flags |= entrySequence
+		valueSize += sequenceSize
+	}
+	sameKey := b.numEntries > 0 && key == b.maxKey
+
 	// Track min/max keys
 	if b.numEntries == 0 {
 		b.minKey = key
@@ -49,44 +102,131 @@ func (b *SSTableBuilder) Add(key string, value []byte, deleted bool) error {
 	b.maxKey = key
 	b.numEntries++
 
-	// Add to bloom filter
-	b.bloomFilter.Add(key)
-
-	// Encode entry: [keySize(4)][valueSize(4)][deleted(1)][key][value]
-	keySize := uint32(len(key))
-	valueSize := uint32(len(value))
-	entrySize := 4 + 4 + 1 + int(keySize) + int(valueSize)
-
-	entry := make([]byte, entrySize)
-	offset := 0
-	binary.LittleEndian.PutUint32(entry[offset:], keySize)
-	offset += 4
-	binary.LittleEndian.PutUint32(entry[offset:], valueSize)
-	offset += 4
+	b.props.NumEntries++
 	if deleted {
-		entry[offset] = 1
-	} else {
-		entry[offset] = 0
+		b.props.NumTombstones++
+	}
+	b.props.RawKeyBytes += int64(len(key))
+	b.props.RawValueBytes += int64(len(value))
+
+	// Add to bloom filter
+	if !sameKey {
+		b.bloomFilter.Add(key)
 	}
-	offset += 1
-	copy(entry[offset:], key)
-	offset += int(keySize)
-	copy(entry[offset:], value)
 
-	// Check if adding this entry would exceed block size
-	if len(b.currentBlock)+entrySize > blockSize {
+	// Check if adding this entry, and a restart point for it, would
+	// exceed block size. Lookups read the one block a key can be in, so
+	// its versions aren't split.
+	if !sameKey && len(b.currentBlock)+b.entrySize(key, valueSize)+b.trailerSize(1) > blockSize {
 		// Flush current block
 		if err := b.flushBlock(); err != nil {
 			return err
 		}
 	}
 
-	// Add entry to current block
-	b.currentBlock = append(b.currentBlock, entry...)
+	if b.blockEntries == 0 {
+		b.firstKey = key
+	}
+	shared := b.sharedPrefix(key)
+	if b.format != blockFormatPlain && b.blockEntries%blockRestartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.currentBlock)))
+		b.restartKey = key
+	}
+	if b.format == blockFormatOffsets {
+		b.offsets = append(b.offsets, uint16(len(b.currentBlock)))
+	}
+	b.blockEntries++
+
+	// Encode the entry straight into the current block (see blockFormat)
+	if b.format >= blockFormatDelta {
+		b.currentBlock = binary.AppendUvarint(b.currentBlock, uint64(shared))
+		b.currentBlock = binary.AppendUvarint(b.currentBlock, uint64(len(key)-shared))
+		b.currentBlock = binary.AppendUvarint(b.currentBlock, uint64(valueSize))
+	} else {
+		b.currentBlock = binary.LittleEndian.AppendUint32(b.currentBlock, uint32(len(key)))
+		b.currentBlock = binary.LittleEndian.AppendUint32(b.currentBlock, uint32(valueSize))
+	}
+	b.currentBlock = append(b.currentBlock, flags)
+	b.currentBlock = append(b.currentBlock, key[shared:]...)
+	if seq != 0 {
+		b.currentBlock = binary.LittleEndian.AppendUint64(b.currentBlock, seq)
+	}
+	b.currentBlock = append(b.currentBlock, value...)
 
 	return nil
 }
 
+// addAll adds every entry of it, which must be in sorted key order
+func (b *SSTableBuilder) addAll(it entryIterator) error {
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err := b.add(it.Key(), it.Value(), entryFlags(it.deleted(), it.valuePointer())); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// sharedPrefix returns how many bytes of key the next entry shares with
+// its restart point's key: none unless keys are delta-encoded and the
+// entry isn't a restart point itself
+func (b *SSTableBuilder) sharedPrefix(key string) int {
+	if b.format < blockFormatDelta || b.blockEntries%blockRestartInterval == 0 {
+		return 0
+	}
+	n := min(len(key), len(b.restartKey))
+	for i := 0; i < n; i++ {
+		if key[i] != b.restartKey[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// entrySize returns the encoded size of the next entry, with a value of
+// valueSize bytes
+func (b *SSTableBuilder) entrySize(key string, valueSize int) int {
+	if b.format < blockFormatDelta {
+		return entryHeaderSize + len(key) + valueSize
+	}
+	shared := b.sharedPrefix(key)
+	unshared := len(key) - shared
+	return uvarintSize(uint64(shared)) + uvarintSize(uint64(unshared)) +
+		uvarintSize(uint64(valueSize)) + 1 + unshared + valueSize
+}
+
+// trailerSize returns the size of the current block's restart points
+// and entry offsets once extra more entries are added, assuming each
+// starts a restart point
+func (b *SSTableBuilder) trailerSize(extra int) int {
+	if b.format == blockFormatPlain {
+		return 0
+	}
+	size := 4*(len(b.restarts)+extra) + 4
+	if b.format == blockFormatOffsets {
+		size += 4
+		if entries := b.blockEntries + extra; entries >= blockOffsetsMinEntries {
+			size += 2 * entries
+		}
+	}
+	return size
+}
+
+// uvarintSize returns the number of bytes x takes as a uvarint
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// EstimatedSize returns the size of the data written so far, including
+// the block being filled
+func (b *SSTableBuilder) EstimatedSize() int64 {
+	return int64(b.blockOffset) + int64(len(b.currentBlock))
+}
+
 // flushBlock writes the current block to disk and adds an index entry
 func (b *SSTableBuilder) flushBlock() error {
 	if len(b.currentBlock) <= 4 {
@@ -94,95 +234,74 @@ func (b *SSTableBuilder) flushBlock() error {
 		return nil
 	}
 
-	// Get the first key from the block for the index
-	firstKey, err := b.getFirstKeyFromBlock()
-	if err != nil {
-		return err
+	// Update block header with entry count, and end the block with its
+	// restart points
+	binary.LittleEndian.PutUint32(b.currentBlock[0:], uint32(b.blockEntries))
+	entriesEnd := len(b.currentBlock)
+	if b.format != blockFormatPlain {
+		for _, restart := range b.restarts {
+			b.currentBlock = binary.LittleEndian.AppendUint32(b.currentBlock, restart)
+		}
+		b.currentBlock = binary.LittleEndian.AppendUint32(b.currentBlock, uint32(len(b.restarts)))
 	}
-
-	// Update block header with entry count
-	numEntriesInBlock := b.getNumEntriesInBlock()
-	binary.LittleEndian.PutUint32(b.currentBlock[0:], numEntriesInBlock)
-
-	// Write block to file
-	_, err = b.file.Write(b.currentBlock)
-	if err != nil {
-		return fmt.Errorf("failed to write block: %w", err)
+	if b.format == blockFormatOffsets {
+		// Offsets are left out of small blocks, and of one a key's
+		// versions grew past where 2 bytes reach
+		if b.blockEntries < blockOffsetsMinEntries || entriesEnd > math.MaxUint16 {
+			b.offsets = b.offsets[:0]
+		}
+		for _, offset := range b.offsets {
+			b.currentBlock = binary.LittleEndian.AppendUint16(b.currentBlock, offset)
+		}
+		b.currentBlock = binary.LittleEndian.AppendUint32(b.currentBlock, uint32(len(b.offsets)))
 	}
 
 	// Add index entry
 	b.index = append(b.index, IndexEntry{
-		Key:         firstKey,
+		Key:         b.firstKey,
 		BlockOffset: b.blockOffset,
+		BlockSize:   uint32(len(b.currentBlock)),
+		Checksum:    crc32.ChecksumIEEE(b.currentBlock),
 	})
 
-	// Update offset for next block
-	b.blockOffset += uint64(len(b.currentBlock))
-
-	// Pad block to blockSize if needed
-	if len(b.currentBlock) < blockSize {
-		padding := make([]byte, blockSize-len(b.currentBlock))
-		_, err = b.file.Write(padding)
-		if err != nil {
-			return fmt.Errorf("failed to write padding: %w", err)
-		}
-		b.blockOffset += uint64(len(padding))
+	// Pad block to blockSize if needed, and write it out with its padding
+	block := b.currentBlock
+	if len(block) < blockSize {
+		block = block[:blockSize]
+		clear(block[len(b.currentBlock):])
 	}
-
-	// Reset block
-	b.currentBlock = make([]byte, 4)
-
-	return nil
-}
-
-// getFirstKeyFromBlock extracts the first key from the current block
-func (b *SSTableBuilder) getFirstKeyFromBlock() (string, error) {
-	if len(b.currentBlock) < 13 { // 4 (numEntries) + 4 (keySize) + 4 (valueSize) + 1 (deleted)
-		return "", fmt.Errorf("block too small")
+	if _, err := b.file.Write(block); err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
 	}
 
-	offset := 4 // Skip numEntries
-	keySize := binary.LittleEndian.Uint32(b.currentBlock[offset:])
-	offset += 4
-	offset += 4 // Skip valueSize
-	offset += 1 // Skip deleted
+	// Update offset for next block
+	b.blockOffset += uint64(len(block))
 
-	if offset+int(keySize) > len(b.currentBlock) {
-		return "", fmt.Errorf("block truncated")
+	// Reset block, keeping a buffer an oversized entry grew
+	if cap(b.currentBlock) > cap(*b.blockBuf) {
+		*b.blockBuf = b.currentBlock
 	}
+	b.currentBlock = (*b.blockBuf)[:4]
+	b.blockEntries = 0
+	b.restarts = b.restarts[:0]
+	b.offsets = b.offsets[:0]
 
-	return string(b.currentBlock[offset : offset+int(keySize)]), nil
+	return nil
 }
 
-// getNumEntriesInBlock counts entries in the current block
-func (b *SSTableBuilder) getNumEntriesInBlock() uint32 {
-	count := uint32(0)
-	offset := 4 // Skip numEntries header
-
-	for offset < len(b.currentBlock) {
-		if offset+9 > len(b.currentBlock) {
-			break
-		}
-
-		keySize := binary.LittleEndian.Uint32(b.currentBlock[offset:])
-		offset += 4
-		valueSize := binary.LittleEndian.Uint32(b.currentBlock[offset:])
-		offset += 4
-		offset += 1 // deleted
-
-		if offset+int(keySize)+int(valueSize) > len(b.currentBlock) {
-			break
-		}
-
-		offset += int(keySize) + int(valueSize)
-		count++
+// Finish flushes remaining data and writes index, bloom filter, and
+// footer, then installs the file at its final path. On failure the
+// partial file is deleted.
+func (b *SSTableBuilder) Finish() error {
+	if err := b.finish(); err != nil {
+		b.Abort()
+		return err
 	}
-
-	return count
+	b.releaseBlock()
+	return nil
 }
 
-// Finish flushes remaining data and writes index, bloom filter, and footer
-func (b *SSTableBuilder) Finish() error {
+func (b *SSTableBuilder) finish() error {
 	// Flush any remaining block
 	if len(b.currentBlock) > 4 {
 		if err := b.flushBlock(); err != nil {
@@ -203,7 +322,8 @@ func (b *SSTableBuilder) Finish() error {
 	// Remember metadata offset
 	metadataOffset := b.blockOffset + uint64(len(indexData))
 
-	// Write metadata (minKey and maxKey)
+	// Write metadata (minKey, maxKey and properties)
+	b.props.CreatedAt = time.Now()
 	metadataData := b.encodeMetadata()
 	_, err = b.file.Write(metadataData)
 	if err != nil {
@@ -225,7 +345,7 @@ func (b *SSTableBuilder) Finish() error {
 	binary.LittleEndian.PutUint64(footer[0:], indexOffset)
 	binary.LittleEndian.PutUint64(footer[8:], bloomOffset)
 	binary.LittleEndian.PutUint64(footer[16:], metadataOffset)
-	binary.LittleEndian.PutUint32(footer[24:], sstableMagic)
+	binary.LittleEndian.PutUint32(footer[24:], b.format.magic())
 
 	_, err = b.file.Write(footer)
 	if err != nil {
@@ -237,17 +357,25 @@ func (b *SSTableBuilder) Finish() error {
 	if err != nil {
 		return fmt.Errorf("failed to sync sstable: %w", err)
 	}
+	if err := b.file.Close(); err != nil {
+		return fmt.Errorf("failed to close sstable: %w", err)
+	}
 
-	return b.file.Close()
+	if err := b.fs.Rename(b.path+".tmp", b.path); err != nil {
+		return fmt.Errorf("failed to install sstable: %w", err)
+	}
+	return nil
 }
 
 // encodeMetadata encodes the metadata block
-// Format: [minKeySize(4)][maxKeySize(4)][minKey][maxKey]
+// Format: [minKeySize(4)][maxKeySize(4)][minKey][maxKey][properties]
+// Properties: [numEntries(8)][numTombstones(8)][rawKeyBytes(8)]
+// [rawValueBytes(8)][createdAt(8, unix nanos)]
 func (b *SSTableBuilder) encodeMetadata() []byte {
 	minKeySize := uint32(len(b.minKey))
 	maxKeySize := uint32(len(b.maxKey))
 
-	size := 4 + 4 + int(minKeySize) + int(maxKeySize)
+	size := 4 + 4 + int(minKeySize) + int(maxKeySize) + propertiesSize
 	buf := make([]byte, size)
 
 	binary.LittleEndian.PutUint32(buf[0:], minKeySize)
@@ -255,17 +383,25 @@ func (b *SSTableBuilder) encodeMetadata() []byte {
 	copy(buf[8:], b.minKey)
 	copy(buf[8+minKeySize:], b.maxKey)
 
+	props := buf[8+minKeySize+maxKeySize:]
+	binary.LittleEndian.PutUint64(props[0:], uint64(b.props.NumEntries))
+	binary.LittleEndian.PutUint64(props[8:], uint64(b.props.NumTombstones))
+	binary.LittleEndian.PutUint64(props[16:], uint64(b.props.RawKeyBytes))
+	binary.LittleEndian.PutUint64(props[24:], uint64(b.props.RawValueBytes))
+	binary.LittleEndian.PutUint64(props[32:], uint64(b.props.CreatedAt.UnixNano()))
+	binary.LittleEndian.PutUint64(props[40:], b.props.MaxSequence)
+
 	return buf
 }
 
 // encodeIndex encodes the index block
 // Format: [numEntries(4)][entry1][entry2]...
-// Entry: [keySize(4)][blockOffset(8)][key]
+// Entry: [keySize(4)][blockOffset(8)][blockSize(4)][crc32(4)][key]
 func (b *SSTableBuilder) encodeIndex() []byte {
 	// Calculate size
 	size := 4 // numEntries
 	for _, entry := range b.index {
-		size += 4 + 8 + len(entry.Key)
+		size += 4 + 8 + 4 + 4 + len(entry.Key)
 	}
 
 	buf := make([]byte, size)
@@ -282,6 +418,10 @@ func (b *SSTableBuilder) encodeIndex() []byte {
 		offset += 4
 		binary.LittleEndian.PutUint64(buf[offset:], entry.BlockOffset)
 		offset += 8
+		binary.LittleEndian.PutUint32(buf[offset:], entry.BlockSize)
+		offset += 4
+		binary.LittleEndian.PutUint32(buf[offset:], entry.Checksum)
+		offset += 4
 		copy(buf[offset:], entry.Key)
 		offset += int(keySize)
 	}
@@ -291,6 +431,20 @@ func (b *SSTableBuilder) encodeIndex() []byte {
 
 // Abort closes and deletes the SSTable file
 func (b *SSTableBuilder) Abort() error {
+	b.releaseBlock()
 	b.file.Close()
-	return os.Remove(b.path)
+	return b.fs.Remove(b.path + ".tmp")
+}
+
+// releaseBlock hands the block buffer back to the pool
+func (b *SSTableBuilder) releaseBlock() {
+	if b.blockBuf == nil {
+		return
+	}
+	if cap(b.currentBlock) > cap(*b.blockBuf) {
+		*b.blockBuf = b.currentBlock
+	}
+	blockBuffers.Put(b.blockBuf)
+	b.blockBuf = nil
+	b.currentBlock = nil
 }
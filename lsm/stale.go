@@ -0,0 +1,29 @@
+package lsm
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// removeStaleFiles deletes the temporary files a crash can leave in
+// dataDir: an SSTable being built, or a MANIFEST or WAL replacement, that
+// was never renamed into place. SSTables the MANIFEST doesn't list are deleted by loadSSTables.
+func removeStaleFiles(fs common.FS, dataDir string) {
+	entries, err := fs.ReadDir(dataDir)
+	if err != nil {
+		log.Printf("Warning: failed to look for stale files: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".tmp" {
+			continue
+		}
+		log.Printf("Deleting stale file %s", entry.Name())
+		if err := fs.Remove(filepath.Join(dataDir, entry.Name())); err != nil {
+			log.Printf("Warning: failed to delete stale file %s: %v", entry.Name(), err)
+		}
+	}
+}
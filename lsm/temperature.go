@@ -0,0 +1,197 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Count-min sketch dimensions: 4 rows of 256 counters (4KB per SSTable)
+const (
+	sketchDepth = 4
+	sketchWidth = 256
+)
+
+// countMinSketch estimates how often each key was seen in fixed memory.
+// Each key increments one counter per row; its estimate is the smallest of
+// those counters, which overestimates only when keys collide.
+type countMinSketch struct {
+	counters [sketchDepth][sketchWidth]atomic.Uint32
+}
+
+// sketchHash is 64-bit FNV-1a, split into two halves for double hashing
+func sketchHash(key string) (uint32, uint32) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return uint32(h), uint32(h>>32) | 1
+}
+
+func (s *countMinSketch) add(key string, n uint32) {
+	h1, h2 := sketchHash(key)
+	for row := uint32(0); row < sketchDepth; row++ {
+		s.counters[row][(h1+row*h2)%sketchWidth].Add(n)
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint32 {
+	h1, h2 := sketchHash(key)
+	min := ^uint32(0)
+	for row := uint32(0); row < sketchDepth; row++ {
+		if c := s.counters[row][(h1+row*h2)%sketchWidth].Load(); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// fileHeat tracks reads of one SSTable. It lives in memory only: files
+// loaded on open start cold, while compaction outputs inherit the reads of
+// the keys they took from their inputs.
+type fileHeat struct {
+	since  time.Time // Start of the read history
+	reads  atomic.Int64
+	sketch countMinSketch
+}
+
+func newFileHeat(since time.Time) *fileHeat {
+	return &fileHeat{since: since}
+}
+
+// record counts a read of key that reached a data block
+func (h *fileHeat) record(key string) {
+	h.reads.Add(1)
+	h.sketch.add(key, 1)
+}
+
+// readRate returns reads per second over the file's read history
+func (h *fileHeat) readRate(now time.Time) float64 {
+	age := now.Sub(h.since).Seconds()
+	if age <= 0 {
+		return 0
+	}
+	return float64(h.reads.Load()) / age
+}
+
+// heatInheritor passes the reads recorded for compaction inputs on to the
+// outputs, key by key, using each input's sketch. An input never hands on
+// more reads than it recorded, which bounds the sketch's overestimates.
+// A nil heatInheritor (no tracked inputs) does nothing.
+type heatInheritor struct {
+	inputs    []*SSTable
+	inherited []int64 // Reads handed on so far, per input
+	since     time.Time
+}
+
+// newHeatInheritor returns nil if none of the inputs track reads
+func newHeatInheritor(inputs []*SSTable) *heatInheritor {
+	var heir *heatInheritor
+	for _, sst := range inputs {
+		if sst.heat == nil {
+			continue
+		}
+		if heir == nil {
+			heir = &heatInheritor{
+				inputs:    inputs,
+				inherited: make([]int64, len(inputs)),
+				since:     sst.heat.since,
+			}
+		}
+		// Outputs cover the longest history among the inputs
+		if sst.heat.since.Before(heir.since) {
+			heir.since = sst.heat.since
+		}
+	}
+	return heir
+}
+
+// newOutput returns the read tracking for a new output file
+func (hi *heatInheritor) newOutput() *fileHeat {
+	if hi == nil {
+		return nil
+	}
+	return newFileHeat(hi.since)
+}
+
+// inherit credits out with the estimated reads of key in input
+func (hi *heatInheritor) inherit(out *fileHeat, key string, input int) {
+	if hi == nil {
+		return
+	}
+	src := hi.inputs[input].heat
+	if src == nil {
+		return
+	}
+
+	n := int64(src.sketch.estimate(key))
+	if left := src.reads.Load() - hi.inherited[input]; n > left {
+		n = left
+	}
+	if n <= 0 {
+		return
+	}
+	hi.inherited[input] += n
+	out.reads.Add(n)
+	out.sketch.add(key, uint32(n))
+}
+
+// LevelTemperature summarizes how often one level's SSTables are read
+type LevelTemperature struct {
+	Level          int
+	Files          int
+	ColdFiles      int     // Read less than ColdReadRate, and at least ColdMinAge old
+	Reads          int64   // Reads that reached a data block
+	ReadsPerSecond float64 // Sum of the files' read rates
+}
+
+// Temperature reports per-level read activity. It is empty unless
+// Config.TrackTemperature is set.
+func (lsm *LSM) Temperature() []LevelTemperature {
+	if !lsm.config.TrackTemperature {
+		return nil
+	}
+
+	now := time.Now()
+	temps := make([]LevelTemperature, lsm.levels.NumLevels())
+	for level := range temps {
+		temps[level].Level = level
+		for _, sst := range lsm.levels.GetAllSSTables(level) {
+			temps[level].Files++
+			if sst.heat == nil {
+				continue
+			}
+			temps[level].Reads += sst.heat.reads.Load()
+			temps[level].ReadsPerSecond += sst.heat.readRate(now)
+			if lsm.isCold(sst, now) {
+				temps[level].ColdFiles++
+			}
+		}
+	}
+	return temps
+}
+
+// isCold reports whether an SSTable has been read too rarely, over a long
+// enough history, to keep in an upper level
+func (lsm *LSM) isCold(sst *SSTable, now time.Time) bool {
+	if sst.heat == nil || now.Sub(sst.heat.since) < lsm.config.ColdMinAge {
+		return false
+	}
+	return sst.heat.readRate(now) < lsm.config.ColdReadRate
+}
+
+// coldTargetLevel returns where a compaction of files from above
+// targetLevel should go. A single cold file skips every level that has
+// nothing in its key range, landing on the first level that does (or the
+// last level); anything else goes to targetLevel.
+func (lsm *LSM) coldTargetLevel(files []*SSTable, targetLevel int) int {
+	if !lsm.config.TrackTemperature || len(files) != 1 || !lsm.isCold(files[0], time.Now()) {
+		return targetLevel
+	}
+
+	minKey, maxKey := files[0].MinKey(), files[0].MaxKey()
+	for targetLevel < lsm.levels.NumLevels()-1 && len(lsm.levels.GetOverlapping(targetLevel, minKey, maxKey)) == 0 {
+		targetLevel++
+	}
+	return targetLevel
+}
@@ -0,0 +1,102 @@
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// startSpan starts a span of Config.Tracer, which must be set, for an
+// operation starting now
+func (lsm *LSM) startSpan(ctx context.Context, name string, attrs ...common.Attribute) common.Span {
+	span := lsm.config.Tracer.Start(ctx, name, time.Now())
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	return span
+}
+
+// traceCompaction gives Config.Tracer a span for a compaction that has
+// ended, from the event describing it
+func (lsm *LSM) traceCompaction(event CompactionEvent, err error) {
+	span := lsm.config.Tracer.Start(context.Background(), "lsm.Compaction", event.Start)
+	span.SetAttributes(
+		common.Attribute{Key: "lsm.reason", Value: string(event.Reason)},
+		common.Attribute{Key: "lsm.source_level", Value: int64(event.SourceLevel)},
+		common.Attribute{Key: "lsm.target_level", Value: int64(event.TargetLevel)},
+		common.Attribute{Key: "lsm.move", Value: event.Move},
+		common.Attribute{Key: "lsm.input_files", Value: int64(len(event.Inputs))},
+		common.Attribute{Key: "lsm.output_files", Value: int64(len(event.Outputs))},
+		common.Attribute{Key: "lsm.bytes_read", Value: event.BytesRead},
+		common.Attribute{Key: "lsm.bytes_written", Value: event.BytesWritten})
+	span.End(event.Start.Add(event.Duration), err)
+}
+
+// op is a Put, Get or Scan being traced, timed for the slow op log, or
+// both
+type op struct {
+	lsm   *LSM
+	name  string // Of the span, e.g. "lsm.Get"
+	start time.Time
+	span  common.Span // nil without Config.Tracer
+}
+
+// startOp starts an operation named name, or returns nil if neither
+// Config.Tracer nor Config.SlowOpThreshold is set
+func (lsm *LSM) startOp(ctx context.Context, name string) *op {
+	if lsm.config.Tracer == nil && lsm.config.SlowOpThreshold <= 0 {
+		return nil
+	}
+	o := &op{lsm: lsm, name: name, start: time.Now()}
+	if lsm.config.Tracer != nil {
+		o.span = lsm.config.Tracer.Start(ctx, name, o.start)
+	}
+	return o
+}
+
+// setAttributes adds details to the operation's span, if it has one
+func (o *op) setAttributes(attrs ...common.Attribute) {
+	if o.span != nil {
+		o.span.SetAttributes(attrs...)
+	}
+}
+
+// end ends the operation on key, failed with err if it isn't nil, and
+// logs it if it was slow, with what detail returns
+func (o *op) end(key string, err error, detail func() string) {
+	o.endAfter(time.Since(o.start), fmt.Sprintf("%.64q", key), err, detail)
+}
+
+// endAfter is end for an operation that took took, which may be less
+// than its span, on what subject describes
+func (o *op) endAfter(took time.Duration, subject string, err error, detail func() string) {
+	if o.span != nil {
+		o.span.End(time.Now(), err)
+	}
+	threshold := o.lsm.config.SlowOpThreshold
+	if threshold <= 0 || took < threshold {
+		return
+	}
+
+	msg := detail()
+	if reason := o.lsm.stallReason(); reason != "" {
+		msg += "; writes stalled: " + reason
+	}
+	if err != nil {
+		msg += "; failed: " + err.Error()
+	}
+	o.lsm.logger().Printf("Warning: slow %s of %s took %v (%s)",
+		strings.TrimPrefix(o.name, "lsm."), subject, took, msg)
+}
+
+// logger returns Config.Logger, or the standard logger if it is nil
+func (lsm *LSM) logger() common.Logger {
+	if lsm.config.Logger != nil {
+		return lsm.config.Logger
+	}
+	return log.Default()
+}
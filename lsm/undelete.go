@@ -0,0 +1,125 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// With an UndeleteWindow, tombstones are versioned: one carries the value
+// its delete removed and when, as [deletedAt(8)][value], so Undelete can
+// restore it until compaction strips it past the window. A tombstone
+// retaining nothing has no value, as before.
+const retainedHeaderSize = 8
+
+// encodeRetained encodes the value a tombstone retains
+func encodeRetained(deletedAt time.Time, value []byte) []byte {
+	buf := make([]byte, retainedHeaderSize, retainedHeaderSize+len(value))
+	binary.LittleEndian.PutUint64(buf, uint64(deletedAt.UnixNano()))
+	return append(buf, value...)
+}
+
+// decodeRetained decodes what a tombstone retains, reporting false if it
+// retains nothing
+func decodeRetained(data []byte) (deletedAt time.Time, value []byte, ok bool) {
+	if len(data) < retainedHeaderSize {
+		return time.Time{}, nil, false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(data))), data[retainedHeaderSize:], true
+}
+
+// retainedSince reports whether a tombstone retaining data was deleted
+// after t
+func retainedSince(data []byte, t time.Time) bool {
+	deletedAt, _, ok := decodeRetained(data)
+	return ok && deletedAt.After(t)
+}
+
+// deleteRetaining is Delete with an UndeleteWindow: the tombstone retains
+// the key's value, read under the write lock so no write lands between
+func (lsm *LSM) deleteRetaining(key string) error {
+	return lsm.readLocked(key, true, func(current []byte, _ uint64, found bool) error {
+		var retained []byte
+		if found {
+			retained = encodeRetained(time.Now(), current)
+		}
+
+		seq := atomic.AddUint64(&lsm.sequence, 1)
+		err := lsm.wal.Append(key, retained, seq, true)
+		lsm.walErr.Set(err)
+		if err != nil {
+			return fmt.Errorf("failed to append to WAL: %w", err)
+		}
+		lsm.activeMemtable.deleteRetaining(key, retained, seq)
+		lsm.rotateMemtable()
+		return nil
+	})
+}
+
+// Undelete restores the value key held before its latest Delete, if that
+// was made with an UndeleteWindow and within it (see common.Undeleter).
+// It fails with common.ErrKeyNotFound if there is nothing to restore.
+func (lsm *LSM) Undelete(key string) error {
+	if err := lsm.gate.Enter(); err != nil {
+		return err
+	}
+	defer lsm.gate.Exit()
+
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+
+	// Taken before lsm.mu, as update does: the value may go to the log
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	version, found, err := lsm.newestVersionLocked(key)
+	if err != nil {
+		lsm.handleCorruption(err)
+		return err
+	}
+	deletedAt, value, retained := decodeRetained(version.Value)
+	if !found || !version.Deleted || !retained || time.Since(deletedAt) > lsm.config.UndeleteWindow {
+		return fmt.Errorf("%w: %s has no deleted value to restore", common.ErrKeyNotFound, key)
+	}
+
+	if err := lsm.putLocked(key, value); err != nil {
+		return err
+	}
+	lsm.stats.writeCount.Add(1)
+	return nil
+}
+
+// newestVersionLocked returns key's newest version, a tombstone with the
+// value it retains included, and whether there is one. Caller must hold
+// lsm.mu.
+func (lsm *LSM) newestVersionLocked(key string) (MemTableEntry, bool, error) {
+	point := lsm.readPointLocked(key)
+	defer point.release()
+	if point.hits != nil {
+		return point.entry, true, nil
+	}
+
+	// SSTables newest first, as for a lookup
+	for _, c := range point.candidates {
+		entry, found, _, err := c.sst.get(key)
+		if err != nil {
+			return MemTableEntry{}, false, err
+		}
+		if found {
+			return MemTableEntry{
+				Key:          key,
+				Value:        entry.Value,
+				Deleted:      entry.Deleted,
+				ValuePointer: entry.ValuePointer,
+			}, true, nil
+		}
+	}
+	return MemTableEntry{}, false, nil
+}
@@ -0,0 +1,193 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Version is one of the versions of a key kept for Config.KeepVersions
+type Version struct {
+	// Sequence is the sequence number of the write, as GetWithMeta reports
+	// it; 0 if it wasn't recorded, as for writes flushed before
+	// KeepVersions was set
+	Sequence uint64
+	Value    []byte // nil for a delete
+	Deleted  bool   // The version is a delete
+}
+
+// VersionsOf returns the versions of key kept, newest first: up to
+// Config.KeepVersions of them, or the newest alone if it isn't set. A
+// delete is a version with Deleted set. A key never written has none.
+// Reading an older version's value from the value log fails once value
+// log GC has dropped it.
+func (lsm *LSM) VersionsOf(key string) ([]Version, error) {
+	if err := lsm.gate.Enter(); err != nil {
+		return nil, err
+	}
+	defer lsm.gate.Exit()
+
+	// Track read
+	lsm.stats.readCount.Add(1)
+
+	// Keep value log GC from removing a file the pointers we find are into
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	entries, err := lsm.versionsOf(key)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, len(entries))
+	for i, entry := range entries {
+		if versions[i], err = lsm.version(entry); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// GetVersion returns key's value as of seq, a sequence number as
+// GetWithMeta and VersionsOf report them: the value of the newest version
+// kept written at or before it. It reports false if that version is a
+// delete or no version kept is that old.
+func (lsm *LSM) GetVersion(key string, seq uint64) ([]byte, bool, error) {
+	if err := lsm.gate.Enter(); err != nil {
+		return nil, false, err
+	}
+	defer lsm.gate.Exit()
+
+	// Track read
+	lsm.stats.readCount.Add(1)
+
+	// Keep value log GC from removing a file the pointer we find is into
+	lsm.vlog.gcMu.RLock()
+	defer lsm.vlog.gcMu.RUnlock()
+
+	entries, err := lsm.versionsOf(key)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, entry := range entries {
+		if entry.Sequence > seq {
+			continue
+		}
+		version, err := lsm.version(entry)
+		if err != nil {
+			return nil, false, err
+		}
+		return version.Value, !version.Deleted, nil
+	}
+	return nil, false, nil
+}
+
+// versionsOf returns the versions of key kept, newest first, as VersionsOf
+// does but with value log pointers unresolved: those in the memtables,
+// then those in the SSTables that could hold the key, newest first. A
+// key's versions may be spread over several until compaction merges them.
+func (lsm *LSM) versionsOf(key string) ([]MemTableEntry, error) {
+	keep := max(lsm.config.KeepVersions, 1)
+
+	var versions []MemTableEntry
+	lsm.mu.RLock()
+	for _, mt := range []*MemTable{lsm.activeMemtable, lsm.immutableMemtable} {
+		if mt == nil {
+			continue
+		}
+		if entry, found := mt.getEntry(key); found {
+			versions = append(versions, entry)
+			versions = append(versions, entry.older...)
+		}
+	}
+	if len(versions) >= keep {
+		lsm.mu.RUnlock()
+		return versions[:keep], nil
+	}
+	candidates := lsm.sstablesFor(key)
+	lsm.mu.RUnlock()
+	defer func() {
+		for _, c := range candidates {
+			c.sst.unref()
+		}
+	}()
+
+	for _, c := range candidates {
+		err := c.sst.versions(key, func(entry SSTableEntry) error {
+			if n := len(versions); n > 0 && !olderVersion(entry.Sequence, versions[n-1].Sequence) {
+				return nil
+			}
+			versions = append(versions, MemTableEntry{
+				Key:          key,
+				Value:        bytes.Clone(entry.Value),
+				Sequence:     entry.Sequence,
+				Deleted:      entry.Deleted,
+				ValuePointer: entry.ValuePointer,
+			})
+			return nil
+		})
+		if err != nil {
+			lsm.handleCorruption(err)
+			return nil, err
+		}
+		if len(versions) >= keep {
+			return versions[:keep], nil
+		}
+	}
+	return versions, nil
+}
+
+// version returns the Version an entry versionsOf returned is, reading its
+// value from the value log if it is there
+func (lsm *LSM) version(entry MemTableEntry) (Version, error) {
+	version := Version{Sequence: entry.Sequence, Deleted: entry.Deleted}
+	switch {
+	case entry.Deleted:
+		// The value a tombstone retains is Undelete's, not a version
+	case entry.ValuePointer:
+		value, err := lsm.vlog.read(entry.Key, entry.Value)
+		if err != nil {
+			return Version{}, fmt.Errorf("version %d of %s: %w", entry.Sequence, entry.Key, err)
+		}
+		version.Value = value
+	default:
+		version.Value = bytes.Clone(entry.Value)
+	}
+	return version, nil
+}
+
+// versions calls fn with each version of key the SSTable holds, newest
+// first. Their Values are slices of the block they are in, only valid
+// during fn.
+func (sst *SSTable) versions(key string, fn func(entry SSTableEntry) error) error {
+	if !sst.bloomFilter.MayContain(key) {
+		return nil
+	}
+
+	it := &SSTableIterator{sst: sst}
+	if err := it.seek(key); err != nil {
+		return err
+	}
+	for {
+		entry, ok := it.Next()
+		if !ok || entry.Key != key {
+			return it.err
+		}
+		err := fn(SSTableEntry{
+			Key:          entry.Key,
+			Value:        entry.Value,
+			Deleted:      entry.Deleted,
+			ValuePointer: entry.ValuePointer,
+			Sequence:     entry.Sequence,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// olderVersion reports whether a version of a key recorded as written at
+// seq, found after one written at last, is an older one rather than a
+// copy of the same write, as an SSTable and the WAL replayed after it was
+// flushed both hold. Versions not recorded (0) are taken as older.
+func olderVersion(seq, last uint64) bool {
+	return seq == 0 || last == 0 || seq < last
+}
@@ -0,0 +1,631 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// Value log (key-value separation, as in WiscKey)
+// Values of at least Config.ValueThreshold bytes are appended to value log
+// files and the tree stores only a pointer to them, so flushes and
+// compactions move small pointers instead of rewriting large values.
+// Values that are overwritten or deleted leave garbage behind, which value
+// log GC reclaims by copying the live values of a mostly-dead file to the
+// head of the log and removing the file.
+//
+// File name: {fileNum}.vlog
+// Record format: [crc32(4)][keySize(4)][valueSize(4)][key][value]
+// Pointer format: [fileNum(4)][offset(8)][recordSize(4)]
+const (
+	vlogHeaderSize   = 12
+	valuePointerSize = 16
+)
+
+// valuePointer locates a record in the value log
+type valuePointer struct {
+	fileNum uint32
+	offset  int64
+	size    uint32 // Record size including header
+}
+
+func (p valuePointer) encode() []byte {
+	buf := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint32(buf[0:], p.fileNum)
+	binary.LittleEndian.PutUint64(buf[4:], uint64(p.offset))
+	binary.LittleEndian.PutUint32(buf[12:], p.size)
+	return buf
+}
+
+func decodeValuePointer(data []byte) (valuePointer, error) {
+	if len(data) != valuePointerSize {
+		return valuePointer{}, fmt.Errorf("invalid value pointer size %d", len(data))
+	}
+	return valuePointer{
+		fileNum: binary.LittleEndian.Uint32(data[0:]),
+		offset:  int64(binary.LittleEndian.Uint64(data[4:])),
+		size:    binary.LittleEndian.Uint32(data[12:]),
+	}, nil
+}
+
+// valueLog manages the value log files in the data directory
+type valueLog struct {
+	fs       common.FS
+	dir      string
+	fileSize int64 // Size at which a new head file is started
+
+	mu       sync.RWMutex
+	files    map[uint32]common.File
+	head     common.File // File being appended to (nil until the first append)
+	headNum  uint32
+	headSize int64
+	nextNum  uint32
+
+	// gcMu is held for reading while a pointer may be resolved, and for
+	// writing by GC to remove a file, so a reader that found a pointer
+	// into a file can still read it
+	gcMu   sync.RWMutex
+	gcRun  sync.Mutex // Serializes GC runs
+	gcNext uint32     // Next file GC considers
+
+	// Files GC removed while an iterator snapshot was open stay readable
+	// in retired until the last snapshot is released (guarded by mu)
+	snapshots int
+	retired   map[uint32]common.File
+}
+
+// openValueLog opens the value log files in dir. The newest file becomes
+// the head; a torn record at its end (from a crash) is truncated away.
+func openValueLog(fs common.FS, dir string, fileSize int64) (*valueLog, error) {
+	vl := &valueLog{
+		fs:       fs,
+		dir:      dir,
+		fileSize: fileSize,
+		files:    make(map[uint32]common.File),
+		retired:  make(map[uint32]common.File),
+		nextNum:  1,
+	}
+
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".vlog" {
+			continue
+		}
+
+		var fileNum uint32
+		if _, err := fmt.Sscanf(entry.Name(), "%d.vlog", &fileNum); err != nil {
+			log.Printf("Warning: skipping malformed value log filename: %s", entry.Name())
+			continue
+		}
+
+		file, err := fs.OpenFile(filepath.Join(dir, entry.Name()), os.O_RDWR, 0644)
+		if err != nil {
+			vl.close()
+			return nil, fmt.Errorf("failed to open value log: %w", err)
+		}
+		vl.files[fileNum] = file
+
+		if fileNum >= vl.nextNum {
+			vl.nextNum = fileNum + 1
+		}
+	}
+
+	if len(vl.files) == 0 {
+		return vl, nil
+	}
+
+	// Resume appending to the newest file after its last valid record
+	vl.headNum = vl.nextNum - 1
+	vl.head = vl.files[vl.headNum]
+	validSize, err := vl.scan(vl.headNum, nil)
+	if err != nil {
+		vl.close()
+		return nil, err
+	}
+	if err := vl.head.Truncate(validSize); err != nil {
+		vl.close()
+		return nil, fmt.Errorf("failed to truncate value log: %w", err)
+	}
+	vl.headSize = validSize
+
+	return vl, nil
+}
+
+// append writes a record to the head file and returns its encoded pointer
+func (vl *valueLog) append(key string, value []byte) ([]byte, error) {
+	recordSize := vlogHeaderSize + len(key) + len(value)
+	record := make([]byte, recordSize)
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(value)))
+	copy(record[vlogHeaderSize:], key)
+	copy(record[vlogHeaderSize+len(key):], value)
+	binary.LittleEndian.PutUint32(record[0:], crc32.ChecksumIEEE(record[4:]))
+
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	if vl.head == nil || vl.headSize >= vl.fileSize {
+		if err := vl.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := vl.head.WriteAt(record, vl.headSize); err != nil {
+		return nil, fmt.Errorf("failed to write value log: %w", err)
+	}
+
+	ptr := valuePointer{fileNum: vl.headNum, offset: vl.headSize, size: uint32(recordSize)}
+	vl.headSize += int64(recordSize)
+	return ptr.encode(), nil
+}
+
+// filePath returns the path of value log file fileNum
+func (vl *valueLog) filePath(fileNum uint32) string {
+	return filepath.Join(vl.dir, fmt.Sprintf("%06d.vlog", fileNum))
+}
+
+// rotate syncs the head file and starts a new one. Caller must hold vl.mu.
+func (vl *valueLog) rotate() error {
+	if vl.head != nil {
+		if err := vl.head.Sync(); err != nil {
+			return fmt.Errorf("failed to sync value log: %w", err)
+		}
+	}
+
+	fileNum := vl.nextNum
+	path := vl.filePath(fileNum)
+	file, err := vl.fs.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create value log: %w", err)
+	}
+
+	vl.files[fileNum] = file
+	vl.head = file
+	vl.headNum = fileNum
+	vl.headSize = 0
+	vl.nextNum++
+	return nil
+}
+
+// read returns the value an encoded pointer refers to, checking that the
+// record belongs to key
+func (vl *valueLog) read(key string, encoded []byte) ([]byte, error) {
+	ptr, err := decodeValuePointer(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	vl.mu.RLock()
+	file := vl.files[ptr.fileNum]
+	if file == nil {
+		file = vl.retired[ptr.fileNum]
+	}
+	vl.mu.RUnlock()
+	if file == nil {
+		return nil, fmt.Errorf("value log file %d not found", ptr.fileNum)
+	}
+
+	record := make([]byte, ptr.size)
+	if _, err := file.ReadAt(record, ptr.offset); err != nil {
+		return nil, fmt.Errorf("failed to read value log: %w", err)
+	}
+
+	recordKey, value, err := decodeVlogRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	if recordKey != key {
+		return nil, fmt.Errorf("value log record at %d:%d belongs to a different key", ptr.fileNum, ptr.offset)
+	}
+	return value, nil
+}
+
+// decodeVlogRecord verifies a record's checksum and splits it into key and
+// value
+func decodeVlogRecord(record []byte) (string, []byte, error) {
+	if len(record) < vlogHeaderSize {
+		return "", nil, fmt.Errorf("value log record truncated")
+	}
+
+	keySize := int(binary.LittleEndian.Uint32(record[4:]))
+	valueSize := int(binary.LittleEndian.Uint32(record[8:]))
+	if len(record) != vlogHeaderSize+keySize+valueSize {
+		return "", nil, fmt.Errorf("value log record size mismatch")
+	}
+	if crc32.ChecksumIEEE(record[4:]) != binary.LittleEndian.Uint32(record[0:]) {
+		return "", nil, fmt.Errorf("value log corruption detected: CRC mismatch")
+	}
+
+	key := string(record[vlogHeaderSize : vlogHeaderSize+keySize])
+	return key, record[vlogHeaderSize+keySize:], nil
+}
+
+// scan calls fn for each record in a file, in order, and returns the size
+// of the valid prefix. It stops at the first torn or corrupt record. fn
+// may be nil.
+func (vl *valueLog) scan(fileNum uint32, fn func(key string, ptr valuePointer) error) (int64, error) {
+	vl.mu.RLock()
+	file := vl.files[fileNum]
+	vl.mu.RUnlock()
+	if file == nil {
+		return 0, fmt.Errorf("value log file %d not found", fileNum)
+	}
+
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, 0, 1<<62), 1024*1024)
+	header := make([]byte, vlogHeaderSize)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			// EOF or a torn header ends the valid prefix
+			return offset, nil
+		}
+
+		keySize := int(binary.LittleEndian.Uint32(header[4:]))
+		valueSize := int(binary.LittleEndian.Uint32(header[8:]))
+		recordSize := vlogHeaderSize + keySize + valueSize
+
+		record := make([]byte, recordSize)
+		copy(record, header)
+		if _, err := io.ReadFull(reader, record[vlogHeaderSize:]); err != nil {
+			return offset, nil
+		}
+
+		key, _, err := decodeVlogRecord(record)
+		if err != nil {
+			return offset, nil
+		}
+
+		if fn != nil {
+			ptr := valuePointer{fileNum: fileNum, offset: offset, size: uint32(recordSize)}
+			if err := fn(key, ptr); err != nil {
+				return offset, err
+			}
+		}
+		offset += int64(recordSize)
+	}
+}
+
+// sealedFiles returns the value log files other than the head
+func (vl *valueLog) sealedFiles() []uint32 {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	var sealed []uint32
+	for fileNum := range vl.files {
+		if vl.head == nil || fileNum != vl.headNum {
+			sealed = append(sealed, fileNum)
+		}
+	}
+	return sealed
+}
+
+// nextGCCandidate returns the next file GC should consider, cycling
+// through every file except the head
+func (vl *valueLog) nextGCCandidate() (uint32, bool) {
+	sealed := vl.sealedFiles()
+	if len(sealed) == 0 {
+		return 0, false
+	}
+	sort.Slice(sealed, func(i, j int) bool { return sealed[i] < sealed[j] })
+
+	idx := sort.Search(len(sealed), func(i int) bool { return sealed[i] >= vl.gcNext })
+	if idx == len(sealed) {
+		idx = 0
+	}
+	vl.gcNext = sealed[idx] + 1
+	return sealed[idx], true
+}
+
+// remove deletes a file once no reader can still be resolving a pointer
+// into it, and returns its size. With iterator snapshots open, the file
+// is retired instead and deleted by the last unpin.
+func (vl *valueLog) remove(fileNum uint32) (int64, error) {
+	vl.gcMu.Lock()
+	defer vl.gcMu.Unlock()
+
+	vl.mu.Lock()
+	file := vl.files[fileNum]
+	delete(vl.files, fileNum)
+	retire := file != nil && vl.snapshots > 0
+	if retire {
+		vl.retired[fileNum] = file
+	}
+	vl.mu.Unlock()
+	if file == nil {
+		return 0, nil
+	}
+
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	if retire {
+		return size, nil
+	}
+	file.Close()
+
+	if err := vl.fs.Remove(file.Name()); err != nil {
+		return 0, fmt.Errorf("failed to remove value log: %w", err)
+	}
+	return size, nil
+}
+
+// pin keeps every current file readable until unpin, for an iterator
+// snapshot whose pointers are resolved later. Caller must hold gcMu for
+// reading, so no file is being removed.
+func (vl *valueLog) pin() {
+	vl.mu.Lock()
+	vl.snapshots++
+	vl.mu.Unlock()
+}
+
+// unpin releases a snapshot; the last one deletes the retired files
+func (vl *valueLog) unpin() error {
+	vl.mu.Lock()
+	vl.snapshots--
+	var retired map[uint32]common.File
+	if vl.snapshots == 0 && len(vl.retired) > 0 {
+		retired = vl.retired
+		vl.retired = make(map[uint32]common.File)
+	}
+	vl.mu.Unlock()
+
+	return vl.removeFiles(retired)
+}
+
+// removeFiles closes and deletes files
+func (vl *valueLog) removeFiles(files map[uint32]common.File) error {
+	var firstErr error
+	for _, file := range files {
+		file.Close()
+		if err := vl.fs.Remove(file.Name()); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove value log: %w", err)
+		}
+	}
+	return firstErr
+}
+
+// sync forces the head file to disk
+func (vl *valueLog) sync() error {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+	if vl.head == nil {
+		return nil
+	}
+	return vl.head.Sync()
+}
+
+// size returns the total bytes in value log files
+func (vl *valueLog) size() int64 {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	var total int64
+	for fileNum, file := range vl.files {
+		if vl.head != nil && fileNum == vl.headNum {
+			total += vl.headSize
+			continue
+		}
+		if info, err := file.Stat(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// close syncs the head file and closes all files
+func (vl *valueLog) close() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	var firstErr error
+	if vl.head != nil {
+		firstErr = vl.head.Sync()
+	}
+	for _, file := range vl.files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	// Retired files hold only garbage; iterators still open lose them
+	if err := vl.removeFiles(vl.retired); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	vl.files = map[uint32]common.File{}
+	vl.retired = map[uint32]common.File{}
+	vl.head = nil
+	return firstErr
+}
+
+// RunValueLogGC checks one value log file (cycling through them on each
+// call) and, if at least discardRatio of it is garbage, copies its live
+// values to the head of the log and removes it. It returns the number of
+// bytes reclaimed, 0 if no file was collected.
+func (lsm *LSM) RunValueLogGC(discardRatio float64) (int64, error) {
+	if err := lsm.gate.Enter(); err != nil {
+		return 0, err
+	}
+	defer lsm.gate.Exit()
+
+	lsm.vlog.gcRun.Lock()
+	defer lsm.vlog.gcRun.Unlock()
+
+	fileNum, ok := lsm.vlog.nextGCCandidate()
+	if !ok {
+		return 0, nil
+	}
+
+	// Find the records the tree still points to
+	type liveRecord struct {
+		key string
+		ptr []byte
+	}
+	var live []liveRecord
+	var liveBytes int64
+	total, err := lsm.vlog.scan(fileNum, func(key string, ptr valuePointer) error {
+		encoded := ptr.encode()
+		isLive, err := lsm.pointsTo(key, encoded)
+		if err != nil {
+			return err
+		}
+		if isLive {
+			live = append(live, liveRecord{key: key, ptr: encoded})
+			liveBytes += int64(ptr.size)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// A file on an old encryption key is rewritten whatever its garbage
+	if total > 0 && float64(total-liveBytes)/float64(total) < discardRatio && !lsm.vlog.staleKey(fileNum) {
+		return 0, nil
+	}
+	if err := lsm.disk.Check(); err != nil {
+		return 0, err
+	}
+
+	// Rewrite the live values, then make the new pointers durable before
+	// the old copies disappear
+	for _, rec := range live {
+		if err := lsm.rewriteValue(rec.key, rec.ptr); err != nil {
+			return 0, err
+		}
+	}
+	if err := lsm.vlog.sync(); err != nil {
+		return 0, err
+	}
+	if err := lsm.Sync(); err != nil {
+		return 0, err
+	}
+
+	reclaimed, err := lsm.vlog.remove(fileNum)
+	if err != nil {
+		return 0, err
+	}
+	lsm.stats.vlogGCCount.Add(1)
+	return reclaimed, nil
+}
+
+// pointsTo reports whether the newest version of key is the given value
+// log pointer
+func (lsm *LSM) pointsTo(key string, ptr []byte) (bool, error) {
+	var live bool
+	_, err := lsm.lookup(key, nil, func(value []byte, valuePtr bool) error {
+		live = valuePtr && bytes.Equal(value, ptr)
+		return nil
+	})
+	return live, err
+}
+
+// rewriteValue copies a live value to the head of the value log and points
+// key at the copy, unless key has been written since oldPtr was found live
+func (lsm *LSM) rewriteValue(key string, oldPtr []byte) error {
+	value, err := lsm.vlog.read(key, oldPtr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// A flush between the check and taking the lock could move a newer
+		// version out of the memtables, so retry if one happened
+		flushes := lsm.stats.flushCount.Load()
+		live, err := lsm.pointsTo(key, oldPtr)
+		if err != nil || !live {
+			return err
+		}
+
+		lsm.mu.Lock()
+		if lsm.stats.flushCount.Load() != flushes {
+			lsm.mu.Unlock()
+			continue
+		}
+
+		// Writes that landed after the check are still in a memtable
+		if lsm.supersededInMemtables(key, oldPtr) {
+			lsm.mu.Unlock()
+			return nil
+		}
+
+		err = lsm.putValuePointerLocked(key, value)
+		lsm.mu.Unlock()
+		return err
+	}
+}
+
+// supersededInMemtables reports whether the memtables hold a version of key
+// other than ptr. Caller must hold lsm.mu.
+func (lsm *LSM) supersededInMemtables(key string, ptr []byte) bool {
+	for _, mt := range []*MemTable{lsm.activeMemtable, lsm.immutableMemtable} {
+		if mt == nil {
+			continue
+		}
+		if entry, found := mt.getEntry(key); found {
+			return !entry.ValuePointer || !bytes.Equal(entry.Value, ptr)
+		}
+	}
+	return false
+}
+
+// putValuePointerLocked appends value to the value log and writes key's
+// pointer to the WAL and active memtable. Caller must hold lsm.mu for
+// writing.
+func (lsm *LSM) putValuePointerLocked(key string, value []byte) error {
+	ptr, err := lsm.vlog.append(key, value)
+	if err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint64(&lsm.sequence, 1)
+	if err := lsm.wal.AppendValuePointer(key, ptr, seq); err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+	lsm.activeMemtable.PutValuePointer(key, ptr, seq)
+	lsm.rotateMemtable()
+	return nil
+}
+
+// valueLogGCWorker runs value log GC periodically
+func (lsm *LSM) valueLogGCWorker() {
+
+	ticker := time.NewTicker(lsm.config.ValueLogGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lsm.closeChan:
+			return
+		case <-ticker.C:
+			if err := lsm.runBackgroundValueLogGC(); err != nil && !errors.Is(err, common.ErrClosed) {
+				log.Printf("Error during value log GC: %v", err)
+			}
+		}
+	}
+}
+
+// runBackgroundValueLogGC runs a GC pass holding a background worker slot
+func (lsm *LSM) runBackgroundValueLogGC() error {
+	lsm.background.Acquire()
+	defer lsm.background.Release()
+	_, err := lsm.RunValueLogGC(lsm.config.ValueLogGCDiscardRatio)
+	return err
+}
@@ -1,156 +1,360 @@
 package lsm
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"os"
+	"log"
+	"sync"
+
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/common/wal"
+)
+
+const (
+	walMagic   = "LWAL"
+	walVersion = 3
+
+	// Record types. Payload: [sequence(8)][keySize(4)][key][value]
+	walPut          wal.RecordType = 1
+	walDelete       wal.RecordType = 2 // No value
+	walValuePointer wal.RecordType = 3 // Value is a pointer into the value log
+	walPutDeflated  wal.RecordType = 4 // Value is deflated
+
+	// A tombstone whose value is the one the delete retains (see
+	// Config.UndeleteWindow)
+	walDeleteRetained wal.RecordType = 5
+
+	// walCompressMinSize is the smallest value WALCompression deflates
+	walCompressMinSize = 128
 )
 
-// WAL is a Write-Ahead Log for durability
-// Record format: [crc32][sequence][keySize][valueSize][deleted][key][value]
+// walOptions describe the LSM's log. It is reset after every flush, so it
+// stays in one segment.
+var walOptions = wal.Options{Magic: walMagic, Version: walVersion}
+
+// flateWriters reuses deflate state, which is large, across records
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// WAL is a Write-Ahead Log for durability, kept in the shared log format
+// (see common/wal). A WAL written before that format is converted to it on
+// open.
 type WAL struct {
-	file *os.File
-	path string
+	log      *wal.Log
+	compress bool  // Deflate large values of new records
+	damage   error // Found converting an older WAL, reported by readAll
 }
 
 // NewWAL creates a new write-ahead log
 func NewWAL(path string) (*WAL, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	return openWAL(common.OSFS{}, path, false)
+}
+
+// openWAL opens or creates a write-ahead log in fs
+func openWAL(fs common.FS, path string, compress bool) (*WAL, error) {
+	w := &WAL{compress: compress}
+	l, err := wal.Open(fs, path, walOptions)
+	var formatErr *wal.FormatError
+	if errors.As(err, &formatErr) && formatErr.Path == path {
+		l, w.damage, err = convertWAL(fs, path)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
-
-	return &WAL{
-		file: file,
-		path: path,
-	}, nil
+	w.log = l
+	return w, nil
 }
 
 // Append writes a record to the WAL
 func (w *WAL) Append(key string, value []byte, seq uint64, deleted bool) error {
-	// Calculate sizes
-	keySize := uint32(len(key))
-	valueSize := uint32(len(value))
-
-	// Build record (without CRC first)
-	recordSize := 4 + 8 + 4 + 4 + 1 + int(keySize) + int(valueSize)
-	record := make([]byte, recordSize)
-
-	offset := 4 // Skip CRC for now
-	binary.LittleEndian.PutUint64(record[offset:], seq)
-	offset += 8
-	binary.LittleEndian.PutUint32(record[offset:], keySize)
-	offset += 4
-	binary.LittleEndian.PutUint32(record[offset:], valueSize)
-	offset += 4
 	if deleted {
-		record[offset] = 1
-	} else {
-		record[offset] = 0
+		if len(value) > 0 {
+			return w.appendRecord(walDeleteRetained, key, value, seq)
+		}
+		return w.appendRecord(walDelete, key, nil, seq)
+	}
+	if w.compress && len(value) >= walCompressMinSize {
+		if compressed := deflate(value); len(compressed) < len(value) {
+			return w.appendRecord(walPutDeflated, key, compressed, seq)
+		}
+	}
+	return w.appendRecord(walPut, key, value, seq)
+}
+
+// AppendValuePointer writes a record for a key whose value is stored in
+// the value log
+func (w *WAL) AppendValuePointer(key string, ptr []byte, seq uint64) error {
+	return w.appendRecord(walValuePointer, key, ptr, seq)
+}
+
+// appendEntry writes a recovered entry back out
+func (w *WAL) appendEntry(entry WALEntry) error {
+	if entry.ValuePointer {
+		return w.AppendValuePointer(entry.Key, entry.Value, entry.Sequence)
 	}
-	offset += 1
-	copy(record[offset:], key)
-	offset += int(keySize)
-	copy(record[offset:], value)
+	return w.Append(entry.Key, entry.Value, entry.Sequence, entry.Deleted)
+}
 
-	// Calculate and write CRC
-	crc := crc32.ChecksumIEEE(record[4:])
-	binary.LittleEndian.PutUint32(record[0:], crc)
+// payloadBuffers holds the buffers records are encoded into before they
+// are handed to the log
+var payloadBuffers = common.NewBufferPool(64 << 10)
 
-	// Write to file
-	_, err := w.file.Write(record)
-	return err
+// appendRecord writes a record of the given type
+func (w *WAL) appendRecord(typ wal.RecordType, key string, value []byte, seq uint64) error {
+	buf := payloadBuffers.Get(12 + len(key) + len(value))
+	defer payloadBuffers.Put(buf)
+	payload := *buf
+	binary.LittleEndian.PutUint64(payload[0:], seq)
+	binary.LittleEndian.PutUint32(payload[8:], uint32(len(key)))
+	copy(payload[12:], key)
+	copy(payload[12+len(key):], value)
+	return w.log.Append(typ, payload)
+}
+
+// decodeEntry decodes a record's payload
+func decodeEntry(r wal.Record) (WALEntry, error) {
+	if len(r.Data) < 12 {
+		return WALEntry{}, fmt.Errorf("record of %d bytes is too short", len(r.Data))
+	}
+	keySize := int(binary.LittleEndian.Uint32(r.Data[8:]))
+	if keySize > len(r.Data)-12 {
+		return WALEntry{}, fmt.Errorf("key of %d bytes overruns its record", keySize)
+	}
+	entry := WALEntry{
+		Key:      string(r.Data[12 : 12+keySize]),
+		Value:    r.Data[12+keySize:],
+		Sequence: binary.LittleEndian.Uint64(r.Data[0:]),
+	}
+
+	switch r.Type {
+	case walPut:
+	case walDelete:
+		entry.Deleted = true
+		entry.Value = nil
+	case walDeleteRetained:
+		entry.Deleted = true
+	case walValuePointer:
+		entry.ValuePointer = true
+	case walPutDeflated:
+		inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(entry.Value)))
+		if err != nil {
+			return WALEntry{}, fmt.Errorf("failed to decompress value: %w", err)
+		}
+		entry.Value = inflated
+	default:
+		return WALEntry{}, fmt.Errorf("unknown record type %d", r.Type)
+	}
+	return entry, nil
+}
+
+// deflate compresses data
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := flateWriters.Get().(*flate.Writer)
+	zw.Reset(&buf)
+	zw.Write(data)
+	zw.Close()
+	flateWriters.Put(zw)
+	return buf.Bytes()
 }
 
 // Sync forces a sync to disk
 func (w *WAL) Sync() error {
-	return w.file.Sync()
+	return w.log.Sync()
 }
 
 // Close closes the WAL file
 func (w *WAL) Close() error {
-	if w.file != nil {
-		return w.file.Close()
-	}
-	return nil
+	return w.log.Close()
 }
 
 // WALEntry represents a recovered entry from the WAL
 type WALEntry struct {
-	Key      string
-	Value    []byte
-	Sequence uint64
-	Deleted  bool
+	Key          string
+	Value        []byte
+	Sequence     uint64
+	Deleted      bool
+	ValuePointer bool // Value is a pointer into the value log
 }
 
-// ReadAll reads all entries from the WAL for recovery
+// ReadAll reads all entries from the WAL for recovery. A torn or corrupt
+// record ends the log: it and everything after it are truncated away, so
+// new records don't land behind it.
 func (w *WAL) ReadAll() ([]WALEntry, error) {
-	// Seek to beginning
-	if _, err := w.file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek WAL: %w", err)
-	}
+	entries, _, err := w.readAll()
+	return entries, err
+}
 
+// readAll is ReadAll, also returning the corruption that ended the log
+// early, if any (a torn last record isn't corruption)
+func (w *WAL) readAll() ([]WALEntry, error, error) {
 	var entries []WALEntry
-	buf := make([]byte, 1024*1024) // 1MB buffer
-
-	for {
-		// Read header (CRC + sequence + keySise + valueSize + deleted)
-		header := make([]byte, 21)
-		_, err := io.ReadFull(w.file, header)
-		if err == io.EOF {
-			break
-		}
+	damage, err := w.log.Replay(func(r wal.Record) error {
+		entry, err := decodeEntry(r)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read WAL header: %w", err)
+			return err
 		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read WAL: %w", err)
+	}
+	if damage == nil {
+		damage, w.damage = w.damage, nil
+	}
+	return entries, damage, nil
+}
+
+// Delete removes the WAL file
+func (w *WAL) Delete() error {
+	return w.log.Delete()
+}
 
-		// Parse header
-		crc := binary.LittleEndian.Uint32(header[0:])
-		seq := binary.LittleEndian.Uint64(header[4:])
-		keySize := binary.LittleEndian.Uint32(header[12:])
-		valueSize := binary.LittleEndian.Uint32(header[16:])
-		deleted := header[20] == 1
-
-		// Read key and value
-		dataSize := int(keySize + valueSize)
-		if dataSize > len(buf) {
-			buf = make([]byte, dataSize)
+// convertWAL rewrites a WAL from before the shared log format in it, by
+// way of a temporary file so a crash leaves one or the other. Returns the
+// corruption that ended the old WAL early, if any.
+func convertWAL(fs common.FS, path string) (*wal.Log, error, error) {
+	entries, damage, err := readLegacyWAL(fs, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpPath := path + ".tmp"
+	fs.Remove(tmpPath) // Left over from a crash
+	w, err := openWAL(fs, tmpPath, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if err := w.appendEntry(entry); err != nil {
+			w.Delete()
+			return nil, nil, err
+		}
+	}
+	if err := w.Sync(); err != nil {
+		w.Delete()
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		fs.Remove(tmpPath)
+		return nil, nil, err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		fs.Remove(tmpPath)
+		return nil, nil, err
+	}
+	log.Printf("Converted WAL %s to version %d (%d entries)", path, walVersion, len(entries))
+
+	l, err := wal.Open(fs, path, walOptions)
+	return l, damage, err
+}
+
+// Formats from before the shared log: version 2 starts with this header,
+// version 1 has none. Records are
+// [crc32][sequence][keySize][valueSize][flags][key][value], the CRC
+// covering everything after it.
+const (
+	legacyWALMagic          = 0x4C57414C
+	legacyWALHeaderSize     = 8 // [magic(4)][version(4)]
+	legacyWALRecordHeader   = 21
+	legacyWALCompressedFlag = 4 // Version 2 only: the value is deflated
+)
+
+// readLegacyWAL reads a WAL from before the shared log format, up to its
+// first torn or damaged record. Returns the corruption that stopped it
+// early, if any.
+func readLegacyWAL(fs common.FS, path string) ([]WALEntry, error, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start := int64(0)
+	header := make([]byte, legacyWALHeaderSize)
+	if _, err := file.ReadAt(header, 0); err == nil && binary.LittleEndian.Uint32(header) == legacyWALMagic {
+		start = legacyWALHeaderSize
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(file, start, stat.Size()-start))
+	var entries []WALEntry
+	offset := start
+	for offset < stat.Size() {
+		entry, size, err := readLegacyRecord(r, stat.Size()-offset)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Printf("Warning: torn write in WAL at offset %d, dropping %d bytes", offset, stat.Size()-offset)
+			break
 		}
-		data := buf[:dataSize]
-		_, err = io.ReadFull(w.file, data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read WAL data: %w", err)
+			damage := common.Corruptf(path, "record at offset %d: %w", offset, err)
+			log.Printf("Warning: %v, dropping %d bytes", damage, stat.Size()-offset)
+			return entries, damage, nil
 		}
+		entries = append(entries, entry)
+		offset += size
+	}
+	return entries, nil, nil
+}
 
-		// Verify CRC
-		recordData := make([]byte, 17+dataSize)
-		copy(recordData, header[4:])
-		copy(recordData[17:], data)
-		expectedCRC := crc32.ChecksumIEEE(recordData)
-		if crc != expectedCRC {
-			return nil, fmt.Errorf("WAL corruption detected: CRC mismatch")
-		}
+// readLegacyRecord reads the next record, at most remaining bytes long,
+// and returns it with its size. A record cut short returns
+// io.ErrUnexpectedEOF.
+func readLegacyRecord(r io.Reader, remaining int64) (WALEntry, int64, error) {
+	header := make([]byte, legacyWALRecordHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return WALEntry{}, 0, io.ErrUnexpectedEOF
+	}
+	crc := binary.LittleEndian.Uint32(header[0:])
+	seq := binary.LittleEndian.Uint64(header[4:])
+	keySize := int64(binary.LittleEndian.Uint32(header[12:]))
+	valueSize := int64(binary.LittleEndian.Uint32(header[16:]))
+	flags := header[20]
 
-		// Extract key and value
-		key := string(data[:keySize])
-		value := make([]byte, valueSize)
-		copy(value, data[keySize:])
+	size := legacyWALRecordHeader + keySize + valueSize
+	if size > remaining {
+		return WALEntry{}, 0, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, keySize+valueSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return WALEntry{}, 0, io.ErrUnexpectedEOF
+	}
 
-		entries = append(entries, WALEntry{
-			Key:      key,
-			Value:    value,
-			Sequence: seq,
-			Deleted:  deleted,
-		})
+	digest := crc32.NewIEEE()
+	digest.Write(header[4:])
+	digest.Write(data)
+	if digest.Sum32() != crc {
+		return WALEntry{}, 0, fmt.Errorf("CRC mismatch")
 	}
 
-	return entries, nil
-}
+	value := data[keySize:]
+	if flags&legacyWALCompressedFlag != 0 {
+		inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(value)))
+		if err != nil {
+			return WALEntry{}, 0, fmt.Errorf("failed to decompress value: %w", err)
+		}
+		value = inflated
+	}
 
-// Delete removes the WAL file
-func (w *WAL) Delete() error {
-	w.Close()
-	return os.Remove(w.path)
+	return WALEntry{
+		Key:          string(data[:keySize]),
+		Value:        value,
+		Sequence:     seq,
+		Deleted:      flags&entryDeleted != 0,
+		ValuePointer: flags&entryValuePointer != 0,
+	}, size, nil
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/btree"
+	"github.com/intellect4all/storage-engines/common"
+	"github.com/intellect4all/storage-engines/hashindex"
+	"github.com/intellect4all/storage-engines/lsm"
+)
+
+// scanKeys returns the keys a namespace's scan of [start, end) returns
+func scanKeys(t *testing.T, ns *common.NamespacedEngine, start, end []byte) []string {
+	t.Helper()
+	it, err := ns.Scan(start, end)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	defer it.Close()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return keys
+}
+
+// TestNamespaceIsolation tests that namespaces whose names are prefixes
+// of each other's never see each other's keys
+func TestNamespaceIsolation(t *testing.T) {
+	engines := []struct {
+		name string
+		open func(common.FS) (common.StorageEngine, error)
+		scan bool
+	}{
+		{"hashindex", openHashIndex, false},
+		{"lsm", openLSM, true},
+		{"btree", openBTree, true},
+	}
+	names := []string{"a", "a\x00", "ab", "a\xff", ""}
+
+	for _, e := range engines {
+		t.Run(e.name, func(t *testing.T) {
+			engine, err := e.open(common.NewMemFS())
+			if err != nil {
+				t.Fatalf("Failed to open engine: %v", err)
+			}
+			defer engine.Close()
+
+			namespaces := make([]*common.NamespacedEngine, len(names))
+			for i, name := range names {
+				namespaces[i] = common.NewNamespacedEngine(engine, name)
+				// The same keys in each, including ones that would
+				// make a name plus a key look like another name's
+				for _, key := range []string{"\x00", "b", "key", "\xff"} {
+					if err := namespaces[i].Put([]byte(key), []byte(name+"/"+key)); err != nil {
+						t.Fatalf("Put failed: %v", err)
+					}
+				}
+				if err := namespaces[i].Put([]byte(fmt.Sprintf("only%d", i)), []byte("in "+name)); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+
+			for i, ns := range namespaces {
+				for _, key := range []string{"\x00", "b", "key", "\xff"} {
+					value, err := ns.Get([]byte(key))
+					if err != nil || string(value) != names[i]+"/"+key {
+						t.Errorf("Namespace %q: Get(%q) = %q, %v", names[i], key, value, err)
+					}
+				}
+				for j := range names {
+					found, err := ns.Has([]byte(fmt.Sprintf("only%d", j)))
+					if err != nil || found != (i == j) {
+						t.Errorf("Namespace %q: Has(only%d) = %v, %v", names[i], j, found, err)
+					}
+				}
+				if !e.scan {
+					continue
+				}
+				want := []string{"\x00", "b", "key", fmt.Sprintf("only%d", i), "\xff"}
+				if got := scanKeys(t, ns, nil, nil); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("Namespace %q: Scan = %q, want %q", names[i], got, want)
+				}
+				if n := ns.Stats().NumKeys; n != int64(len(want)) {
+					t.Errorf("Namespace %q: NumKeys = %d, want %d", names[i], n, len(want))
+				}
+			}
+
+			// Deleting from one leaves the others be
+			if err := namespaces[0].Delete([]byte("b")); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			for i, ns := range namespaces[1:] {
+				if _, err := ns.Get([]byte("b")); err != nil {
+					t.Errorf("Namespace %q lost b: %v", names[i+1], err)
+				}
+			}
+		})
+	}
+}
+
+// TestNamespaceScan tests that a namespace's scans are bounded by it and
+// return its keys without its prefix
+func TestNamespaceScan(t *testing.T) {
+	engine, err := openBTree(common.NewMemFS())
+	if err != nil {
+		t.Fatalf("Failed to open engine: %v", err)
+	}
+	defer engine.Close()
+
+	// Keys on either side of the namespace's range
+	if err := engine.Put([]byte("a"), []byte("outside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Put([]byte("z"), []byte("outside")); err != nil {
+		t.Fatal(err)
+	}
+	ns := common.NewNamespacedEngine(engine, "tenant")
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		if err := ns.Put([]byte(key), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		start, end []byte
+		want       string
+	}{
+		{nil, nil, "[k1 k2 k3 k4]"},
+		{[]byte("k2"), nil, "[k2 k3 k4]"},
+		{nil, []byte("k3"), "[k1 k2]"},
+		{[]byte("k2"), []byte("k4"), "[k2 k3]"},
+		{[]byte("k5"), nil, "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(scanKeys(t, ns, tt.start, tt.end)); got != tt.want {
+			t.Errorf("Scan(%q, %q) = %s, want %s", tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	ns.Close()
+	if _, err := ns.Scan(nil, nil); !errors.Is(err, common.ErrClosed) {
+		t.Errorf("Scan after Close = %v, want ErrClosed", err)
+	}
+}
+
+// TestDeleteNamespace tests that DeleteNamespace deletes every key of a
+// namespace holding several batches' worth, and no other namespace's
+func TestDeleteNamespace(t *testing.T) {
+	for _, e := range []struct {
+		name string
+		open func(common.FS) (common.StorageEngine, error)
+	}{
+		{"lsm", openLSM},
+		{"btree", openBTree},
+	} {
+		t.Run(e.name, func(t *testing.T) {
+			engine, err := e.open(common.NewMemFS())
+			if err != nil {
+				t.Fatalf("Failed to open engine: %v", err)
+			}
+			defer engine.Close()
+
+			const numKeys = 2500 // Three batches
+			doomed := common.NewNamespacedEngine(engine, "a")
+			kept := common.NewNamespacedEngine(engine, "ab")
+			for i := 0; i < numKeys; i++ {
+				key := []byte(fmt.Sprintf("key%05d", i))
+				if err := doomed.Put(key, []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+				if err := kept.Put(key, []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deleted, err := doomed.DeleteNamespace()
+			if err != nil || deleted != numKeys {
+				t.Fatalf("DeleteNamespace = %d, %v; want %d", deleted, err, numKeys)
+			}
+			if keys := scanKeys(t, doomed, nil, nil); len(keys) != 0 {
+				t.Errorf("%d keys left, the first %q", len(keys), keys[0])
+			}
+			if _, err := doomed.Get([]byte("key00000")); !errors.Is(err, common.ErrKeyNotFound) {
+				t.Errorf("Get after DeleteNamespace = %v, want ErrKeyNotFound", err)
+			}
+			if n := kept.Stats().NumKeys; n != numKeys {
+				t.Errorf("The other namespace holds %d keys, want %d", n, numKeys)
+			}
+		})
+	}
+}
+
+// TestNamespaceNotSupported tests that scanning a namespace, or deleting
+// one, on an engine that can't scan fails with ErrNotSupported
+func TestNamespaceNotSupported(t *testing.T) {
+	engine, err := openHashIndex(common.NewMemFS())
+	if err != nil {
+		t.Fatalf("Failed to open engine: %v", err)
+	}
+	defer engine.Close()
+
+	ns := common.NewNamespacedEngine(engine, "tenant")
+	if err := ns.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Scan(nil, nil); !errors.Is(err, common.ErrNotSupported) {
+		t.Errorf("Scan = %v, want ErrNotSupported", err)
+	}
+	if _, err := ns.DeleteNamespace(); !errors.Is(err, common.ErrNotSupported) {
+		t.Errorf("DeleteNamespace = %v, want ErrNotSupported", err)
+	}
+	if value, err := ns.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
+
+// The engines are configured small, so they flush, compact and split
+// within a few hundred operations
+
+func openHashIndex(fs common.FS) (common.StorageEngine, error) {
+	config := hashindex.DefaultConfig("/data")
+	config.FS = fs
+	config.SegmentSizeBytes = 2048
+	config.MaxSegments = 2
+	return hashindex.New(config)
+}
+
+func openLSM(fs common.FS) (common.StorageEngine, error) {
+	config := lsm.DefaultConfig("/data")
+	config.FS = fs
+	config.MemTableSize = 2048
+	config.TargetFileSizeBytes = 4096
+	return lsm.NewAdapter(config)
+}
+
+func openBTree(fs common.FS) (common.StorageEngine, error) {
+	config := btree.DefaultConfig("/data")
+	config.FS = fs
+	config.Order = 4
+	config.CacheSize = 16
+	return btree.NewAdapter(config)
+}
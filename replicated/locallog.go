@@ -0,0 +1,193 @@
+package replicated
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// LocalLog is a Log whose replicas all live in one process. It stands in
+// for a consensus protocol to show how a replicated deployment behaves:
+// an entry is committed once a majority of the replicas have applied it,
+// replicas can be disconnected to simulate failures, and a reconnected
+// replica catches up on the entries it missed, or from another replica's
+// snapshot if those were compacted away.
+//
+// It applies entries synchronously on the caller's goroutine, and there
+// is no leader to lose; a real deployment puts a Raft library behind Log.
+type LocalLog struct {
+	mu       sync.Mutex
+	entries  [][]byte // Entry at index first+i
+	first    uint64
+	replicas []*localReplica
+}
+
+// localReplica is a replica of a LocalLog
+type localReplica struct {
+	sm        *StateMachine
+	connected bool
+}
+
+// NewLocalLog returns an empty log with no replicas
+func NewLocalLog() *LocalLog {
+	return &LocalLog{first: 1}
+}
+
+// AddReplica adds a replica, bringing it up to date first
+func (l *LocalLog) AddReplica(sm *StateMachine) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.find(sm) != nil {
+		return fmt.Errorf("replicated: replica added twice")
+	}
+	r := &localReplica{sm: sm}
+	l.replicas = append(l.replicas, r)
+	return l.catchUp(r)
+}
+
+// Disconnect stops a replica receiving entries, as if it had failed or
+// been cut off from the others
+func (l *LocalLog) Disconnect(sm *StateMachine) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r := l.find(sm); r != nil {
+		r.connected = false
+	}
+}
+
+// Reconnect brings a disconnected replica up to date and has it receive
+// entries again
+func (l *LocalLog) Reconnect(sm *StateMachine) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.find(sm)
+	if r == nil {
+		return fmt.Errorf("replicated: unknown replica")
+	}
+	return l.catchUp(r)
+}
+
+// LastIndex returns the index of the last entry appended
+func (l *LocalLog) LastIndex() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.first + uint64(len(l.entries)) - 1
+}
+
+// Compact discards the entries through index, which every replica is
+// then expected to have applied: replicas still behind catch up from a
+// snapshot. Raft compacts its log the same way.
+func (l *LocalLog) Compact(index uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	last := l.first + uint64(len(l.entries)) - 1
+	index = min(index, last)
+	if index < l.first {
+		return
+	}
+	l.entries = l.entries[index-l.first+1:]
+	l.first = index + 1
+}
+
+// Append appends an entry and applies it to the connected replicas. It
+// fails with ErrNoQuorum, without appending, unless a majority of the
+// replicas are connected, and also if too few of them could apply the
+// entry, which stays in the log.
+func (l *LocalLog) Append(ctx context.Context, data []byte) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.quorum(l.connected()) {
+		return 0, ErrNoQuorum
+	}
+
+	l.entries = append(l.entries, bytes.Clone(data))
+	index := l.first + uint64(len(l.entries)) - 1
+
+	for _, r := range l.replicas {
+		if !r.connected {
+			continue
+		}
+		if err := r.sm.Apply(index, data); err != nil {
+			log.Printf("Warning: replica failed to apply entry %d, disconnecting it: %v", index, err)
+			r.connected = false
+		}
+	}
+
+	if !l.quorum(l.connected()) {
+		return index, ErrNoQuorum
+	}
+	return index, nil
+}
+
+// connected returns how many replicas are connected. Must be called with
+// mu held.
+func (l *LocalLog) connected() int {
+	n := 0
+	for _, r := range l.replicas {
+		if r.connected {
+			n++
+		}
+	}
+	return n
+}
+
+// quorum reports whether n replicas are a majority. Must be called with
+// mu held.
+func (l *LocalLog) quorum(n int) bool {
+	return n*2 > len(l.replicas)
+}
+
+// find returns the replica running sm. Must be called with mu held.
+func (l *LocalLog) find(sm *StateMachine) *localReplica {
+	for _, r := range l.replicas {
+		if r.sm == sm {
+			return r
+		}
+	}
+	return nil
+}
+
+// catchUp applies the entries a replica is missing and connects it,
+// restoring it from a connected replica's snapshot first if some of them
+// were compacted away. Must be called with mu held.
+func (l *LocalLog) catchUp(r *localReplica) error {
+	if r.sm.AppliedIndex()+1 < l.first {
+		var source *localReplica
+		for _, other := range l.replicas {
+			if other.connected && other != r {
+				source = other
+				break
+			}
+		}
+		if source == nil {
+			return fmt.Errorf("replicated: no replica to restore from: %w", ErrNoQuorum)
+		}
+
+		var snapshot bytes.Buffer
+		if err := source.sm.Snapshot(&snapshot); err != nil {
+			return fmt.Errorf("failed to snapshot replica: %w", err)
+		}
+		if err := r.sm.Restore(&snapshot); err != nil {
+			return fmt.Errorf("failed to restore replica: %w", err)
+		}
+	}
+
+	for index := r.sm.AppliedIndex() + 1; index < l.first+uint64(len(l.entries)); index++ {
+		if err := r.sm.Apply(index, l.entries[index-l.first]); err != nil {
+			return err
+		}
+	}
+	r.connected = true
+	return nil
+}
@@ -0,0 +1,135 @@
+// Package replicated runs a storage engine as the state machine of a
+// replicated log, such as a Raft log, so several copies of the data on
+// different machines stay identical and survive the loss of a minority.
+//
+// Writes go through the Log rather than to the engine: a Store proposes
+// each Put or Delete, and once the log has committed it, every replica's
+// StateMachine applies it in log order. The StateMachine's Apply,
+// Snapshot and Restore are the hooks Raft libraries expect from an
+// application, so it can be plugged into one; LocalLog is an in-process
+// log for trying the package out and testing it, without a network.
+package replicated
+
+import (
+	"context"
+	"errors"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+var (
+	// ErrNoQuorum is returned when too few replicas are reachable to
+	// commit an entry
+	ErrNoQuorum = errors.New("replicated: no quorum")
+
+	// ErrBadEntry is returned applying a log entry this package didn't
+	// write
+	ErrBadEntry = errors.New("replicated: invalid log entry")
+
+	// ErrBadSnapshot is returned restoring a damaged or foreign snapshot
+	ErrBadSnapshot = errors.New("replicated: invalid snapshot")
+)
+
+// Log is a replicated log, the part of a consensus protocol such as Raft
+// a Store needs. Committed entries are handed to every replica's
+// StateMachine through Apply, in index order.
+type Log interface {
+	// Append proposes an entry and waits until it is committed, returning
+	// its index. An entry that fails may still be committed later.
+	Append(ctx context.Context, data []byte) (uint64, error)
+}
+
+// Store is one replica's view of the replicated data. Writes are proposed
+// to the log and return once this replica has applied them; reads are
+// served by this replica alone, so they see its own writes but may miss
+// ones committed through other replicas and not yet applied here.
+//
+// It implements common.StorageEngine, except that Close leaves the log
+// and the engine to their owners.
+type Store struct {
+	log Log
+	sm  *StateMachine
+}
+
+// NewStore returns a Store writing through log and reading from sm, which
+// log must apply its entries to
+func NewStore(log Log, sm *StateMachine) *Store {
+	return &Store{log: log, sm: sm}
+}
+
+// StateMachine returns the replica the Store reads from
+func (s *Store) StateMachine() *StateMachine {
+	return s.sm
+}
+
+// PutContext stores a key through the log, waiting at most as long as ctx
+func (s *Store) PutContext(ctx context.Context, key, value []byte) error {
+	if len(key) == 0 {
+		return common.ErrKeyEmpty
+	}
+	return s.propose(ctx, encodeCommand(opPut, key, value))
+}
+
+// DeleteContext deletes a key through the log, waiting at most as long as
+// ctx
+func (s *Store) DeleteContext(ctx context.Context, key []byte) error {
+	if len(key) == 0 {
+		return common.ErrKeyEmpty
+	}
+	return s.propose(ctx, encodeCommand(opDelete, key, nil))
+}
+
+// propose commits a command and waits for this replica to apply it
+func (s *Store) propose(ctx context.Context, cmd []byte) error {
+	index, err := s.log.Append(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return s.sm.WaitApplied(ctx, index)
+}
+
+func (s *Store) Put(key, value []byte) error {
+	return s.PutContext(context.Background(), key, value)
+}
+
+func (s *Store) Delete(key []byte) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+func (s *Store) Get(key []byte) ([]byte, error) {
+	return s.sm.data.Get(key)
+}
+
+func (s *Store) Has(key []byte) (bool, error) {
+	return s.sm.data.Has(key)
+}
+
+// Scan returns an iterator over this replica's keys in [start, end)
+func (s *Store) Scan(start, end []byte) (common.Iterator, error) {
+	return s.sm.data.Scan(start, end)
+}
+
+// Stats returns the statistics of the replicated data on this replica
+func (s *Store) Stats() common.Stats {
+	return s.sm.data.Stats()
+}
+
+// Sync syncs this replica's engine
+func (s *Store) Sync() error {
+	return s.sm.data.Sync()
+}
+
+// Compact compacts this replica's engine
+func (s *Store) Compact() error {
+	return s.sm.data.Compact()
+}
+
+// Health diagnoses this replica's engine
+func (s *Store) Health() common.Health {
+	return s.sm.data.Health()
+}
+
+// Close does nothing: the log and the state machine belong to the caller
+func (s *Store) Close() error {
+	return nil
+}
@@ -0,0 +1,261 @@
+package replicated
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/intellect4all/storage-engines/btree"
+	"github.com/intellect4all/storage-engines/common"
+)
+
+// newReplica opens a state machine on an in-memory B-Tree
+func newReplica(t *testing.T) (*StateMachine, *btree.Adapter) {
+	config := btree.DefaultConfig(filepath.Join(t.TempDir(), "replica"))
+	config.InMemory = true
+	engine, err := btree.NewAdapter(config)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	t.Cleanup(func() { engine.Close() })
+
+	sm, err := NewStateMachine(engine)
+	if err != nil {
+		t.Fatalf("Failed to create state machine: %v", err)
+	}
+	return sm, engine
+}
+
+// newCluster returns a log with n replicas, and a store on the first
+func newCluster(t *testing.T, n int) (*LocalLog, []*StateMachine, *Store) {
+	log := NewLocalLog()
+	var replicas []*StateMachine
+	for i := 0; i < n; i++ {
+		sm, _ := newReplica(t)
+		if err := log.AddReplica(sm); err != nil {
+			t.Fatalf("AddReplica failed: %v", err)
+		}
+		replicas = append(replicas, sm)
+	}
+	return log, replicas, NewStore(log, replicas[0])
+}
+
+// contents returns a replica's keys and values
+func contents(t *testing.T, sm *StateMachine) map[string]string {
+	it, err := sm.data.Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	defer it.Close()
+
+	kv := make(map[string]string)
+	for it.Next() {
+		kv[string(it.Key())] = string(it.Value())
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return kv
+}
+
+// checkReplicas checks that every replica holds want
+func checkReplicas(t *testing.T, replicas []*StateMachine, want map[string]string) {
+	t.Helper()
+	for i, sm := range replicas {
+		got := contents(t, sm)
+		if len(got) != len(want) {
+			t.Fatalf("Replica %d has %d keys, want %d", i, len(got), len(want))
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Fatalf("Replica %d: %s = %q, want %q", i, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestStoreReplicates(t *testing.T) {
+	log, replicas, store := newCluster(t, 3)
+
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key, value := fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i)
+		if err := store.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = value
+	}
+	for i := 0; i < 500; i += 4 {
+		key := fmt.Sprintf("key%04d", i)
+		if err := store.Delete([]byte(key)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		delete(want, key)
+	}
+
+	checkReplicas(t, replicas, want)
+	for _, sm := range replicas {
+		if sm.AppliedIndex() != log.LastIndex() {
+			t.Errorf("Replica applied %d, log is at %d", sm.AppliedIndex(), log.LastIndex())
+		}
+	}
+
+	// Reads see the store's own writes
+	value, err := store.Get([]byte("key0001"))
+	if err != nil || string(value) != "value0001" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	if _, err := store.Get([]byte("key0000")); !errors.Is(err, common.ErrKeyNotFound) {
+		t.Errorf("Get of deleted key: %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestNoQuorum(t *testing.T) {
+	log, replicas, store := newCluster(t, 3)
+
+	if err := store.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// One replica down: a majority remains
+	log.Disconnect(replicas[2])
+	if err := store.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Put with one replica down failed: %v", err)
+	}
+
+	// Two down: writes must fail, and not be applied anywhere
+	log.Disconnect(replicas[1])
+	if err := store.Put([]byte("c"), []byte("3")); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("Put without quorum: %v, want ErrNoQuorum", err)
+	}
+	if _, err := store.Get([]byte("c")); !errors.Is(err, common.ErrKeyNotFound) {
+		t.Fatalf("Write without quorum was applied: %v", err)
+	}
+
+	// Replicas coming back catch up on what they missed
+	if err := log.Reconnect(replicas[1]); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	if err := store.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("Put after reconnect failed: %v", err)
+	}
+	if err := log.Reconnect(replicas[2]); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	checkReplicas(t, replicas, map[string]string{"a": "1", "b": "2", "c": "3"})
+}
+
+func TestCatchUpFromSnapshot(t *testing.T) {
+	log, replicas, store := newCluster(t, 3)
+
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := store.Put([]byte(key), []byte("old")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = "old"
+	}
+
+	log.Disconnect(replicas[2])
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("key%04d", i)
+		if err := store.Delete([]byte(key)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		delete(want, key)
+	}
+	for i := 100; i < 200; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := store.Put([]byte(key), []byte("new")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = "new"
+	}
+
+	// The entries the replica missed are gone: it needs a snapshot
+	log.Compact(log.LastIndex())
+	if err := log.Reconnect(replicas[2]); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	checkReplicas(t, replicas, want)
+	if replicas[2].AppliedIndex() != log.LastIndex() {
+		t.Errorf("Restored replica applied %d, log is at %d", replicas[2].AppliedIndex(), log.LastIndex())
+	}
+
+	// And follows the log again
+	if err := store.Put([]byte("after"), []byte("x")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	want["after"] = "x"
+	checkReplicas(t, replicas, want)
+}
+
+func TestStateMachineResumes(t *testing.T) {
+	sm, engine := newReplica(t)
+
+	for i := uint64(1); i <= 10; i++ {
+		cmd := encodeCommand(opPut, []byte(fmt.Sprintf("key%d", i)), []byte("v"))
+		if err := sm.Apply(i, cmd); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+
+	// A state machine reopened on the engine carries on after entry 10
+	sm, err := NewStateMachine(engine)
+	if err != nil {
+		t.Fatalf("Failed to reopen state machine: %v", err)
+	}
+	if sm.AppliedIndex() != 10 {
+		t.Fatalf("AppliedIndex = %d, want 10", sm.AppliedIndex())
+	}
+
+	// Replayed entries are skipped, and gaps rejected
+	if err := sm.Apply(5, encodeCommand(opDelete, []byte("key5"), nil)); err != nil {
+		t.Fatalf("Replayed Apply failed: %v", err)
+	}
+	if _, err := sm.data.Get([]byte("key5")); err != nil {
+		t.Fatalf("Replayed entry was applied again: %v", err)
+	}
+	if err := sm.Apply(12, encodeCommand(opDelete, []byte("key5"), nil)); err == nil {
+		t.Fatal("Apply after a gap succeeded")
+	}
+	if err := sm.Apply(11, []byte{99}); !errors.Is(err, ErrBadEntry) {
+		t.Fatalf("Apply of a bad entry: %v, want ErrBadEntry", err)
+	}
+}
+
+func TestRestoreBadSnapshot(t *testing.T) {
+	source, _ := newReplica(t)
+	for i := uint64(1); i <= 20; i++ {
+		cmd := encodeCommand(opPut, []byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+		if err := source.Apply(i, cmd); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := source.Snapshot(&snapshot); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	target, _ := newReplica(t)
+	damaged := bytes.Clone(snapshot.Bytes())
+	damaged[len(damaged)/2] ^= 0xFF
+	if err := target.Restore(bytes.NewReader(damaged)); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Restore of a damaged snapshot: %v, want ErrBadSnapshot", err)
+	}
+	if err := target.Restore(bytes.NewReader(snapshot.Bytes()[:10])); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Restore of a truncated snapshot: %v, want ErrBadSnapshot", err)
+	}
+
+	if err := target.Restore(&snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if target.AppliedIndex() != 20 || len(contents(t, target)) != 20 {
+		t.Fatalf("Restored replica at %d with %d keys, want 20 and 20",
+			target.AppliedIndex(), len(contents(t, target)))
+	}
+}
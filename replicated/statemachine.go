@@ -0,0 +1,320 @@
+package replicated
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/intellect4all/storage-engines/common"
+)
+
+const (
+	// Namespaces of the state machine's engine: the replicated keys, and
+	// the state machine's own bookkeeping
+	dataNamespace = "data"
+	metaNamespace = "replicated"
+
+	// appliedKey holds the index of the last entry applied, in the meta
+	// namespace
+	appliedKey = "applied"
+
+	snapshotMagic   = "RKVS"
+	snapshotVersion = 1
+)
+
+// Commands stored in log entries: an op byte, the key's length as a
+// uvarint, the key, and for puts the value
+const (
+	opPut    = 1
+	opDelete = 2
+)
+
+// encodeCommand returns the log entry for a write
+func encodeCommand(op byte, key, value []byte) []byte {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(key)+len(value))
+	buf = append(buf, op)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+// decodeCommand splits a log entry into its op, key and value
+func decodeCommand(data []byte) (op byte, key, value []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, ErrBadEntry
+	}
+	op = data[0]
+	keyLen, n := binary.Uvarint(data[1:])
+	if n <= 0 || keyLen == 0 || keyLen > uint64(len(data)-1-n) {
+		return 0, nil, nil, ErrBadEntry
+	}
+	key = data[1+n : 1+n+int(keyLen)]
+	value = data[1+n+int(keyLen):]
+	switch op {
+	case opPut:
+	case opDelete:
+		if len(value) != 0 {
+			return 0, nil, nil, ErrBadEntry
+		}
+	default:
+		return 0, nil, nil, ErrBadEntry
+	}
+	return op, key, value, nil
+}
+
+// StateMachine applies committed log entries to one replica's engine. It
+// remembers the last index applied in the engine, so a replica reopened
+// on its data carries on from there and entries replayed to it are
+// skipped.
+//
+// The replicated keys are kept in a namespace of the engine (see
+// common.NamespacedEngine) next to the state machine's own. Snapshot and
+// Restore need an engine implementing common.Scanner.
+type StateMachine struct {
+	data *common.NamespacedEngine
+	meta *common.NamespacedEngine
+
+	mu      sync.Mutex // Serializes Apply, Snapshot and Restore
+	applied uint64
+	changed chan struct{} // Closed when applied changes
+}
+
+// NewStateMachine returns the state machine of a replica storing its data
+// in engine, resuming after the last entry applied to it
+func NewStateMachine(engine common.StorageEngine) (*StateMachine, error) {
+	sm := &StateMachine{
+		data:    common.NewNamespacedEngine(engine, dataNamespace),
+		meta:    common.NewNamespacedEngine(engine, metaNamespace),
+		changed: make(chan struct{}),
+	}
+
+	value, err := sm.meta.Get([]byte(appliedKey))
+	switch {
+	case errors.Is(err, common.ErrKeyNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read applied index: %w", err)
+	case len(value) != 8:
+		return nil, fmt.Errorf("failed to read applied index: %w", common.ErrCorruption)
+	default:
+		sm.applied = binary.LittleEndian.Uint64(value)
+	}
+	return sm, nil
+}
+
+// AppliedIndex returns the index of the last entry applied
+func (sm *StateMachine) AppliedIndex() uint64 {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.applied
+}
+
+// WaitApplied waits until the entry at index has been applied
+func (sm *StateMachine) WaitApplied(ctx context.Context, index uint64) error {
+	for {
+		sm.mu.Lock()
+		applied, changed := sm.applied, sm.changed
+		sm.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Apply applies the committed entry at index. Entries must be applied in
+// index order; ones already applied are skipped. If it fails, the entry
+// isn't counted as applied and must be applied again.
+func (sm *StateMachine) Apply(index uint64, data []byte) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if index <= sm.applied {
+		return nil
+	}
+	if index != sm.applied+1 {
+		return fmt.Errorf("replicated: entry %d applied after %d", index, sm.applied)
+	}
+
+	op, key, value, err := decodeCommand(data)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case opPut:
+		err = sm.data.Put(key, value)
+	case opDelete:
+		err = sm.data.Delete(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Replaying the write after a crash before this is harmless
+	return sm.setApplied(index)
+}
+
+// setApplied records the last index applied and wakes its waiters. Must
+// be called with mu held.
+func (sm *StateMachine) setApplied(index uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], index)
+	if err := sm.meta.Put([]byte(appliedKey), buf[:]); err != nil {
+		return err
+	}
+
+	sm.applied = index
+	close(sm.changed)
+	sm.changed = make(chan struct{})
+	return nil
+}
+
+// Snapshot writes the replica's data as of the last entry applied to w,
+// for Restore to bring another replica up to the same index. Entries
+// can't be applied while it runs.
+//
+// A snapshot holds a header (magic, version, applied index), the keys
+// and values as uvarint-length-prefixed strings ending with an empty key,
+// and a CRC32 of everything before it.
+func (sm *StateMachine) Snapshot(w io.Writer) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	it, err := sm.data.Scan(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(bw, crc)
+
+	header := make([]byte, 0, 16)
+	header = append(header, snapshotMagic...)
+	header = binary.LittleEndian.AppendUint32(header, snapshotVersion)
+	header = binary.LittleEndian.AppendUint64(header, sm.applied)
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for it.Next() {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(it.Key())))
+		buf = append(buf, it.Key()...)
+		buf = binary.AppendUvarint(buf, uint64(len(it.Value())))
+		buf = append(buf, it.Value()...)
+		if _, err := out.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	buf = binary.AppendUvarint(buf[:0], 0)
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore replaces the replica's data with a snapshot's, leaving it at
+// the snapshot's applied index. If it fails the replica's data is lost
+// and must be restored again.
+func (sm *StateMachine) Restore(r io.Reader) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	crc := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	in := &crcReader{r: br, crc: crc}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	if string(header[:4]) != snapshotMagic || binary.LittleEndian.Uint32(header[4:]) != snapshotVersion {
+		return ErrBadSnapshot
+	}
+	index := binary.LittleEndian.Uint64(header[8:])
+
+	if _, err := sm.data.DeleteNamespace(); err != nil {
+		return err
+	}
+
+	for {
+		key, err := readString(in)
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			break
+		}
+		value, err := readString(in)
+		if err != nil {
+			return err
+		}
+		if err := sm.data.Put(key, value); err != nil {
+			return err
+		}
+	}
+
+	want := crc.Sum32()
+	var got uint32
+	if err := binary.Read(br, binary.LittleEndian, &got); err != nil || got != want {
+		return ErrBadSnapshot
+	}
+
+	// Wake waiters even if the index went backwards
+	return sm.setApplied(index)
+}
+
+// readString reads a uvarint-length-prefixed string of a snapshot
+func readString(r *crcReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	if n > 1<<32 {
+		return nil, ErrBadSnapshot
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	return buf, nil
+}
+
+// crcReader checksums what is read through it
+type crcReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc.Write([]byte{b})
+	}
+	return b, err
+}